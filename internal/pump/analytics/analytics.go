@@ -6,10 +6,16 @@
 package analytics
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
 )
 
 // AnalyticsRecord encodes the details of a authorization request.
@@ -22,6 +28,205 @@ type AnalyticsRecord struct {
 	Policies   string    `json:"policies"`
 	Deciders   string    `json:"deciders"`
 	ExpireAt   time.Time `json:"expireAt"   bson:"expireAt"`
+	// Extra holds the additional fields attached to the record by the pump pipeline.
+	Extra map[string]interface{} `json:"extra,omitempty" bson:"extra,omitempty" msgpack:"-"`
+	// Raw holds the original payload read from the analytics storage, it is only kept when a pump requests it.
+	Raw []byte `json:"-" bson:"-" msgpack:"-"`
+}
+
+// DefaultOmittedFields are the fields cleared when detailed recording is omitted and no list of
+// fields is configured.
+var DefaultOmittedFields = []string{"policies", "deciders"}
+
+// recordFields maps the json name of each AnalyticsRecord field to its index.
+var recordFields = func() map[string]int {
+	typ := reflect.TypeOf(AnalyticsRecord{})
+	fields := make(map[string]int, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		jsonName := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if jsonName != "-" {
+			fields[jsonName] = i
+		}
+	}
+
+	return fields
+}()
+
+// ValidateFieldNames checks the names of the fields to clear. The record fields are named by their
+// json name, a name which only differs from one by its case, e.g. the go name Policies, is refused
+// rather than silently taken as an extra field.
+func ValidateFieldNames(names []string) error {
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("field name cannot be empty")
+		}
+		if _, ok := recordFields[name]; ok {
+			continue
+		}
+		for field := range recordFields {
+			if strings.EqualFold(field, name) {
+				return fmt.Errorf("field %s is not a record field, the record fields are named by their json name %s",
+					name, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ClearFields resets the record fields with the given json names to their zero value. Names which
+// are not record fields are removed from the extra fields, the extra fields are copied before as
+// copies of a record share them.
+func (a *AnalyticsRecord) ClearFields(names []string) {
+	val := reflect.ValueOf(a).Elem()
+	copied := false
+	for _, name := range names {
+		if i, ok := recordFields[name]; ok {
+			field := val.Field(i)
+			field.Set(reflect.Zero(field.Type()))
+
+			continue
+		}
+
+		if _, ok := a.Extra[name]; !ok {
+			continue
+		}
+
+		if !copied {
+			a.copyExtra()
+			copied = true
+		}
+		delete(a.Extra, name)
+	}
+}
+
+// HashFields replaces the string values of the record fields and extra fields with the given json
+// names by their hex encoded HMAC-SHA256 under key, or their SHA-256 when key is empty, so that the
+// records of a user or an address can still be correlated. The values which are not strings are
+// cleared as by ClearFields.
+func (a *AnalyticsRecord) HashFields(names []string, key []byte) {
+	hash := func(value string) string {
+		if len(key) == 0 {
+			sum := sha256.Sum256([]byte(value))
+
+			return hex.EncodeToString(sum[:])
+		}
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	val := reflect.ValueOf(a).Elem()
+	copied := false
+	for _, name := range names {
+		if i, ok := recordFields[name]; ok {
+			field := val.Field(i)
+			if field.Kind() != reflect.String {
+				field.Set(reflect.Zero(field.Type()))
+			} else if field.String() != "" {
+				field.SetString(hash(field.String()))
+			}
+
+			continue
+		}
+
+		value, ok := a.Extra[name]
+		if !ok {
+			continue
+		}
+
+		if !copied {
+			a.copyExtra()
+			copied = true
+		}
+		if str, ok := value.(string); ok {
+			a.Extra[name] = hash(str)
+		} else {
+			delete(a.Extra, name)
+		}
+	}
+}
+
+// copyExtra replaces the extra fields by a copy, before they are modified.
+func (a *AnalyticsRecord) copyExtra() {
+	extra := make(map[string]interface{}, len(a.Extra))
+	for k, v := range a.Extra {
+		extra[k] = v
+	}
+	a.Extra = extra
+}
+
+// SetExtra attaches an additional field to the record.
+func (a *AnalyticsRecord) SetExtra(name string, value interface{}) {
+	if a.Extra == nil {
+		a.Extra = make(map[string]interface{})
+	}
+
+	a.Extra[name] = value
+}
+
+// FieldValue returns the value of the record field with the given json name, falling back to
+// the extra fields attached by the pump pipeline.
+func (a *AnalyticsRecord) FieldValue(name string) (interface{}, bool) {
+	switch name {
+	case "timestamp":
+		return a.TimeStamp, true
+	case "username":
+		return a.Username, true
+	case "effect":
+		return a.Effect, true
+	case "conclusion":
+		return a.Conclusion, true
+	case "request":
+		return a.Request, true
+	case "policies":
+		return a.Policies, true
+	case "deciders":
+		return a.Deciders, true
+	case "expireAt":
+		return a.ExpireAt, true
+	}
+
+	value, ok := a.Extra[name]
+
+	return value, ok
+}
+
+// HasField reports whether the record field, or extra field, with the given json name is set to a
+// non zero value.
+func (a *AnalyticsRecord) HasField(name string) bool {
+	value, ok := a.FieldValue(name)
+	if !ok || value == nil {
+		return false
+	}
+
+	return !reflect.ValueOf(value).IsZero()
+}
+
+// IsRecordField reports whether name is already used by a field of AnalyticsRecord,
+// either by its go name or by its json name.
+func IsRecordField(name string) bool {
+	typ := reflect.TypeOf(AnalyticsRecord{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if strings.EqualFold(name, field.Name) || name == jsonName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordOverhead is the approximate size of the fixed length fields of AnalyticsRecord.
+const recordOverhead = 32
+
+// EstimateSize returns the approximate size in bytes of the record once serialized.
+func (a *AnalyticsRecord) EstimateSize() int {
+	return recordOverhead + len(a.Username) + len(a.Effect) + len(a.Conclusion) +
+		len(a.Request) + len(a.Policies) + len(a.Deciders)
 }
 
 // GetFieldNames returns all the AnalyticsRecord field names.
@@ -31,6 +236,9 @@ func (a *AnalyticsRecord) GetFieldNames() []string {
 
 	for i := 0; i < val.NumField(); i++ {
 		typeField := val.Type().Field(i)
+		if typeField.Tag.Get("json") == "-" {
+			continue
+		}
 		fields = append(fields, typeField.Name)
 	}
 
@@ -45,6 +253,9 @@ func (a *AnalyticsRecord) GetLineValues() []string {
 	for i := 0; i < val.NumField(); i++ {
 		valueField := val.Field(i)
 		typeField := val.Type().Field(i)
+		if typeField.Tag.Get("json") == "-" {
+			continue
+		}
 		var thisVal string
 		switch typeField.Type.String() {
 		case "int":
@@ -60,6 +271,11 @@ func (a *AnalyticsRecord) GetLineValues() []string {
 		case "time.Month":
 			tmpVal, _ := valueField.Interface().(time.Month)
 			thisVal = tmpVal.String()
+		case "map[string]interface {}":
+			if valueField.Len() > 0 {
+				b, _ := json.Marshal(valueField.Interface())
+				thisVal = string(b)
+			}
 		default:
 			thisVal = valueField.String()
 		}
@@ -69,3 +285,97 @@ func (a *AnalyticsRecord) GetLineValues() []string {
 
 	return fields
 }
+
+// timeStringLayout is the layout of time.Time.String, used by GetLineValues.
+const timeStringLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// SetLineValues sets the record fields from the line values returned by GetLineValues, names are
+// the field names returned by GetFieldNames. Unknown field names are ignored.
+func (a *AnalyticsRecord) SetLineValues(names []string, values []string) error {
+	val := reflect.ValueOf(a).Elem()
+	for i, name := range names {
+		if i >= len(values) || values[i] == "" {
+			continue
+		}
+
+		field := val.FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+
+		value := values[i]
+		switch field.Interface().(type) {
+		case int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %s: %w", name, value, err)
+			}
+			field.SetInt(n)
+		case string:
+			field.SetString(value)
+		case time.Time:
+			// the monotonic clock reading is not parsable
+			t, err := time.Parse(timeStringLayout, strings.Split(value, " m=")[0])
+			if err != nil {
+				return fmt.Errorf("invalid %s value %s: %w", name, value, err)
+			}
+			field.Set(reflect.ValueOf(t))
+		case map[string]interface{}:
+			extra, err := decodeJSONObject(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %s: %w", name, value, err)
+			}
+			field.Set(reflect.ValueOf(extra))
+		}
+	}
+
+	return nil
+}
+
+// jsonNumber is implemented by the numbers decoded with UseNumber.
+type jsonNumber interface {
+	Int64() (int64, error)
+	Float64() (float64, error)
+}
+
+// decodeJSONObject decodes a json object without losing the precision of its integers, which are
+// decoded as int64 rather than float64: a float64 can not represent every 64-bit id.
+func decodeJSONObject(data string) (map[string]interface{}, error) {
+	object := make(map[string]interface{})
+
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	for name, value := range object {
+		object[name] = typedNumbers(value)
+	}
+
+	return object, nil
+}
+
+// typedNumbers replaces the json numbers of the value by int64 values, or float64 values for the
+// numbers which are not integers or overflow an int64.
+func typedNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case jsonNumber:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+
+		return f
+	case map[string]interface{}:
+		for name, v := range value {
+			value[name] = typedNumbers(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = typedNumbers(v)
+		}
+	}
+
+	return value
+}
@@ -4,39 +4,180 @@
 
 package analytics
 
-// AnalyticsFilters defines the analytics options.
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AnalyticsFilters defines the analytics options. The usernames and resources are matched exactly,
+// as globs when they hold a *, e.g. svc-*, or as regular expressions when they start with ^, e.g.
+// ^/v1/secrets/.*.
 type AnalyticsFilters struct {
 	Usernames        []string `json:"usernames"`
-	SkippedUsernames []string `json:"skip_usernames"`
+	SkippedUsernames []string `json:"skip_usernames" mapstructure:"skip_usernames"`
+	// Resources and SkippedResources match the resource attribute of the authorization request.
+	Resources        []string `json:"resources"`
+	SkippedResources []string `json:"skip_resources" mapstructure:"skip_resources"`
+	// Expression is a CEL expression the records must match, e.g.
+	// record.Effect == "deny" && record.Username != "healthcheck".
+	Expression string `json:"filter_expression" mapstructure:"filter_expression"`
+
+	// compiled holds the compiled patterns and expression, see Compile.
+	compiled *compiledFilters
+}
+
+// compiledFilters are the patterns and the expression of the filters, compiled.
+type compiledFilters struct {
+	usernames        []pattern
+	skippedUsernames []pattern
+	resources        []pattern
+	skippedResources []pattern
+	expression       *filterExpression
 }
 
-// ShouldFilter determine whether a record should to be filtered out.
+// ShouldFilter determine whether a record should to be filtered out. The filters which fail to
+// compile filter out every record.
 func (filters AnalyticsFilters) ShouldFilter(record AnalyticsRecord) bool {
+	if !filters.HasFilter() {
+		return false
+	}
+
+	compiled := filters.compiled
+	if compiled == nil {
+		var err error
+		if compiled, err = filters.compile(); err != nil {
+			return true
+		}
+	}
+
 	switch {
-	case len(filters.SkippedUsernames) > 0 && stringInSlice(record.Username, filters.SkippedUsernames):
+	case len(compiled.skippedUsernames) > 0 && matchAny(record.Username, compiled.skippedUsernames):
 		return true
-	case len(filters.Usernames) > 0 && !stringInSlice(record.Username, filters.Usernames):
+	case len(compiled.usernames) > 0 && !matchAny(record.Username, compiled.usernames):
 		return true
 	}
 
-	return false
+	if len(compiled.resources) > 0 || len(compiled.skippedResources) > 0 {
+		resource := requestResource(record.Request)
+		switch {
+		case len(compiled.skippedResources) > 0 && matchAny(resource, compiled.skippedResources):
+			return true
+		case len(compiled.resources) > 0 && !matchAny(resource, compiled.resources):
+			return true
+		}
+	}
+
+	return compiled.expression != nil && !compiled.expression.matches(record)
 }
 
 // HasFilter determine whether a record has a filter.
 func (filters AnalyticsFilters) HasFilter() bool {
-	if len(filters.SkippedUsernames) == 0 && len(filters.Usernames) == 0 {
+	if len(filters.SkippedUsernames) == 0 && len(filters.Usernames) == 0 && len(filters.SkippedResources) == 0 &&
+		len(filters.Resources) == 0 && filters.Expression == "" {
 		return false
 	}
 
 	return true
 }
 
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
+// Compile returns the filters with their patterns and expression compiled, so that they are not
+// compiled again for every record. An invalid pattern or expression is reported.
+func (filters AnalyticsFilters) Compile() (AnalyticsFilters, error) {
+	if !filters.HasFilter() {
+		return filters, nil
+	}
+
+	compiled, err := filters.compile()
+	if err != nil {
+		return filters, err
+	}
+	filters.compiled = compiled
+
+	return filters, nil
+}
+
+func (filters AnalyticsFilters) compile() (*compiledFilters, error) {
+	var compiled compiledFilters
+	var err error
+	for _, list := range []struct {
+		name     string
+		patterns []string
+		compiled *[]pattern
+	}{
+		{"usernames", filters.Usernames, &compiled.usernames},
+		{"skip_usernames", filters.SkippedUsernames, &compiled.skippedUsernames},
+		{"resources", filters.Resources, &compiled.resources},
+		{"skip_resources", filters.SkippedResources, &compiled.skippedResources},
+	} {
+		if *list.compiled, err = compilePatterns(list.patterns); err != nil {
+			return nil, fmt.Errorf("invalid %s filter: %w", list.name, err)
+		}
+	}
+
+	if filters.Expression != "" {
+		if compiled.expression, err = compileFilterExpression(filters.Expression); err != nil {
+			return nil, err
+		}
+	}
+
+	return &compiled, nil
+}
+
+// pattern matches a value exactly, or with its regular expression for the globs and the regular
+// expressions.
+type pattern struct {
+	value string
+	re    *regexp.Regexp
+}
+
+func compilePatterns(values []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(values))
+	for _, value := range values {
+		expr := ""
+		switch {
+		case strings.HasPrefix(value, "^"):
+			expr = value
+		case strings.Contains(value, "*"):
+			parts := strings.Split(value, "*")
+			for i := range parts {
+				parts[i] = regexp.QuoteMeta(parts[i])
+			}
+			expr = "^" + strings.Join(parts, ".*") + "$"
+		default:
+			patterns = append(patterns, pattern{value: value})
+
+			continue
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern{value: value, re: re})
+	}
+
+	return patterns, nil
+}
+
+func matchAny(value string, patterns []pattern) bool {
+	for _, p := range patterns {
+		if (p.re == nil && p.value == value) || (p.re != nil && p.re.MatchString(value)) {
 			return true
 		}
 	}
 
 	return false
 }
+
+// requestResource returns the resource attribute of the authorization request, empty when the
+// request has none.
+func requestResource(request string) string {
+	var attributes struct {
+		Resource string `json:"resource"`
+	}
+	_ = json.Unmarshal([]byte(request), &attributes)
+
+	return attributes.Resource
+}
@@ -53,3 +53,88 @@ func TestHasFilter(t *testing.T) {
 		t.Fatal("HasFilter should be true.")
 	}
 }
+
+func TestShouldFilterExpression(t *testing.T) {
+	filters, err := AnalyticsFilters{
+		Expression: `record.Effect == "deny" && record.Username != "healthcheck" && record.Extra.region != "local"`,
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !filters.HasFilter() {
+		t.Fatal("an expression should be a filter")
+	}
+
+	denied := AnalyticsRecord{Username: "colin", Effect: "deny", Extra: map[string]interface{}{"region": "eu"}}
+	if filters.ShouldFilter(denied) {
+		t.Error("the records matching the expression should be kept")
+	}
+
+	for _, record := range []AnalyticsRecord{
+		{Username: "colin", Effect: "allow", Extra: map[string]interface{}{"region": "eu"}},
+		{Username: "healthcheck", Effect: "deny", Extra: map[string]interface{}{"region": "eu"}},
+		// the evaluation fails without the region
+		{Username: "colin", Effect: "deny"},
+	} {
+		if !filters.ShouldFilter(record) {
+			t.Errorf("the record %+v should be filtered out", record)
+		}
+	}
+
+	// the expression is compiled on the fly when the filters were not compiled
+	if (AnalyticsFilters{Expression: `record.Effect == "deny"`}).ShouldFilter(denied) {
+		t.Error("an uncompiled expression should be evaluated")
+	}
+
+	if _, err := (AnalyticsFilters{Expression: `record.Effect ==`}).Compile(); err == nil {
+		t.Error("an invalid expression should not compile")
+	}
+
+	if _, err := (AnalyticsFilters{Expression: `"deny"`}).Compile(); err == nil {
+		t.Error("an expression which is not a bool should not compile")
+	}
+}
+
+func TestShouldFilterPatterns(t *testing.T) {
+	filters, err := AnalyticsFilters{
+		Usernames:        []string{"svc-*", "colin"},
+		SkippedUsernames: []string{"^svc-(probe|health)$"},
+		SkippedResources: []string{"^/v1/secrets/.*"},
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		username string
+		resource string
+		filtered bool
+	}{
+		{username: "colin", resource: "/v1/users/colin"},
+		{username: "svc-billing", resource: "/v1/users/colin"},
+		{username: "colinx", resource: "/v1/users/colin", filtered: true},
+		{username: "svc-probe", resource: "/v1/users/colin", filtered: true},
+		{username: "svc-billing", resource: "/v1/secrets/db", filtered: true},
+	} {
+		record := AnalyticsRecord{Username: test.username, Request: `{"resource":"` + test.resource + `"}`}
+		if filtered := filters.ShouldFilter(record); filtered != test.filtered {
+			t.Errorf("%s on %s: expected filtered %v, got %v", test.username, test.resource, test.filtered, filtered)
+		}
+	}
+
+	resources := AnalyticsFilters{Resources: []string{"/v1/policies/*"}}
+	if resources.ShouldFilter(AnalyticsRecord{Request: `{"resource":"/v1/policies/admin"}`}) ||
+		!resources.ShouldFilter(AnalyticsRecord{Request: `{"resource":"/v1/users/admin"}`}) {
+		t.Error("only the records on the allowed resources should be kept")
+	}
+
+	// a glob only matches the whole value, its other characters literally
+	if !(AnalyticsFilters{Usernames: []string{"a.b*"}}).ShouldFilter(AnalyticsRecord{Username: "axb-c"}) {
+		t.Error("the dots of a glob should match literally")
+	}
+
+	if _, err := (AnalyticsFilters{SkippedUsernames: []string{"^svc-("}}).Compile(); err == nil {
+		t.Error("an invalid regular expression should not compile")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateSize(t *testing.T) {
+	record := AnalyticsRecord{Username: "colin", Effect: "allow", Request: `{"action":"delete"}`}
+	if size := record.EstimateSize(); size != recordOverhead+5+5+19 {
+		t.Fatalf("the size should account the variable length fields, got %d", size)
+	}
+}
+
+func TestIsRecordField(t *testing.T) {
+	for _, name := range []string{"username", "Username", "expireAt", "extra"} {
+		if !IsRecordField(name) {
+			t.Fatalf("%s should be a record field", name)
+		}
+	}
+
+	if IsRecordField("hostname") {
+		t.Fatal("hostname should not be a record field")
+	}
+}
+
+func TestValidateFieldNames(t *testing.T) {
+	if err := ValidateFieldNames([]string{"policies", "request", "hostname"}); err != nil {
+		t.Fatalf("record fields and extra fields should be accepted: %v", err)
+	}
+
+	for _, names := range [][]string{{"Policies"}, {"expireat"}, {""}} {
+		if err := ValidateFieldNames(names); err == nil {
+			t.Fatalf("%q should be rejected", names)
+		}
+	}
+}
+
+func TestLineValuesSkipRaw(t *testing.T) {
+	record := AnalyticsRecord{Username: "colin", Raw: []byte("raw")}
+
+	names := record.GetFieldNames()
+	values := record.GetLineValues()
+	if len(names) != len(values) {
+		t.Fatalf("got %d field names for %d values", len(names), len(values))
+	}
+
+	for _, name := range names {
+		if name == "Raw" {
+			t.Fatal("raw payload should not be part of the line values")
+		}
+	}
+}
+
+func TestClearFields(t *testing.T) {
+	record := AnalyticsRecord{Username: "colin", Request: "body", Policies: "p", Deciders: "d"}
+	record.SetExtra("hostname", "pump-0")
+	shared := record.Extra
+
+	record.ClearFields([]string{"request", "hostname"})
+	if record.Request != "" || len(record.Extra) != 0 {
+		t.Fatalf("request and hostname should be cleared, got %+v", record)
+	}
+
+	if record.Username != "colin" || record.Policies != "p" {
+		t.Fatalf("other fields should be kept, got %+v", record)
+	}
+
+	if _, ok := shared["hostname"]; !ok {
+		t.Fatal("clear fields should not modify the shared extra fields")
+	}
+
+	record.ClearFields(DefaultOmittedFields)
+	if record.Policies != "" || record.Deciders != "" {
+		t.Fatalf("default fields should be cleared, got %+v", record)
+	}
+}
+
+func TestHashFields(t *testing.T) {
+	record := AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "allow"}
+	record.SetExtra("remoteIPAddress", "10.0.0.1")
+	record.SetExtra("geo", map[string]interface{}{"city": "Beijing"})
+
+	other := record
+	record.HashFields([]string{"username", "timestamp", "remoteIPAddress", "geo"}, nil)
+	// sha256("colin")
+	if record.Username != "4c1001c251c1c923bca00789638afb17e908d526bf3e9975407c65d2b03f4b10" {
+		t.Fatalf("username should be hashed, got %s", record.Username)
+	}
+	if record.TimeStamp != 0 || record.Effect != "allow" {
+		t.Fatalf("only the string fields should be hashed, got %+v", record)
+	}
+	if _, ok := record.Extra["geo"]; ok || record.Extra["remoteIPAddress"] == "10.0.0.1" {
+		t.Fatalf("the extra fields should be hashed or cleared, got %v", record.Extra)
+	}
+	if other.Extra["remoteIPAddress"] != "10.0.0.1" {
+		t.Fatalf("the extra fields of the copies should be kept, got %v", other.Extra)
+	}
+
+	keyed := other
+	keyed.HashFields([]string{"username"}, []byte("secret"))
+	if keyed.Username == record.Username || len(keyed.Username) != 64 {
+		t.Fatalf("the hash should depend on the key, got %s", keyed.Username)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	newRecord := func() AnalyticsRecord {
+		record := AnalyticsRecord{}
+		record.SetExtra("hostname", "pump-0")
+		record.SetExtra("geo", map[string]interface{}{"city": "Beijing", "tags": []interface{}{"cn"}})
+
+		return record
+	}
+
+	record := newRecord()
+	record.Flatten(FlattenJSONString, "")
+	if record.Extra["geo"] != `{"city":"Beijing","tags":["cn"]}` {
+		t.Fatalf("nested field should be json encoded, got %v", record.Extra["geo"])
+	}
+
+	record = newRecord()
+	record.Flatten(FlattenDrop, "")
+	if _, ok := record.Extra["geo"]; ok || record.Extra["hostname"] != "pump-0" {
+		t.Fatalf("only the nested field should be dropped, got %v", record.Extra)
+	}
+
+	record = newRecord()
+	shared := record.Extra
+	record.Flatten(FlattenDelimited, "_")
+	if record.Extra["geo_city"] != "Beijing" || record.Extra["geo_tags_0"] != "cn" {
+		t.Fatalf("nested field should be expanded, got %v", record.Extra)
+	}
+
+	if _, ok := shared["geo"]; !ok {
+		t.Fatal("flatten should not modify the shared extra fields")
+	}
+
+	if err := ValidateFlatten("xml"); err == nil {
+		t.Fatal("unknown strategy should be rejected")
+	}
+}
+
+func TestECS(t *testing.T) {
+	record := AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "deny", Conclusion: "no policy"}
+	record.SetExtra("ip", "10.0.0.1")
+	record.SetExtra("hostname", "pump-0")
+
+	doc := record.ECS()
+	if doc["@timestamp"] != "2020-09-13T12:26:40Z" {
+		t.Fatalf("wrong @timestamp, got %v", doc["@timestamp"])
+	}
+
+	user, _ := doc["user"].(map[string]interface{})
+	source, _ := doc["source"].(map[string]interface{})
+	event, _ := doc["event"].(map[string]interface{})
+	custom, _ := doc[ECSCustomNamespace].(map[string]interface{})
+	if user["name"] != "colin" || source["ip"] != "10.0.0.1" || custom["hostname"] != "pump-0" {
+		t.Fatalf("fields should be mapped to ecs, got %v", doc)
+	}
+
+	if event["outcome"] != "failure" || event["reason"] != "no policy" || event["action"] != "authorize" {
+		t.Fatalf("wrong ecs event, got %v", event)
+	}
+
+	if _, ok := event["end"]; ok {
+		t.Fatal("a zero expireAt should not be mapped")
+	}
+
+	if err := ValidateFormat("xml"); err == nil {
+		t.Fatal("xml should not be a supported format")
+	}
+}
+
+func TestSetLineValues(t *testing.T) {
+	record := AnalyticsRecord{
+		TimeStamp: 1600000000,
+		Username:  "colin",
+		Effect:    "allow",
+		ExpireAt:  time.Unix(1600003600, 0),
+	}
+	record.SetExtra("hostname", "pump-0")
+
+	decoded := AnalyticsRecord{}
+	if err := decoded.SetLineValues(record.GetFieldNames(), record.GetLineValues()); err != nil {
+		t.Fatalf("line values should be decoded, got %v", err)
+	}
+
+	if decoded.TimeStamp != record.TimeStamp || decoded.Username != "colin" || !decoded.ExpireAt.Equal(record.ExpireAt) ||
+		decoded.Extra["hostname"] != "pump-0" {
+		t.Fatalf("decoded record should match the written one, got %+v", decoded)
+	}
+
+	if err := decoded.SetLineValues([]string{"TimeStamp"}, []string{"yesterday"}); err == nil {
+		t.Fatal("an invalid timestamp should not be decoded")
+	}
+}
+
+func TestSetLineValuesLargeIDs(t *testing.T) {
+	// 2^53 + 1 is the first integer a float64 can not represent
+	const id int64 = 9007199254740993
+
+	record := AnalyticsRecord{}
+	record.SetExtra("request_id", id)
+	record.SetExtra("trace", map[string]interface{}{"span_ids": []interface{}{int64(9223372036854775807)}})
+	record.SetExtra("ratio", 0.5)
+
+	decoded := AnalyticsRecord{}
+	if err := decoded.SetLineValues(record.GetFieldNames(), record.GetLineValues()); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Extra["request_id"] != id {
+		t.Fatalf("the 64-bit id should be decoded without precision loss, got %v (%T)",
+			decoded.Extra["request_id"], decoded.Extra["request_id"])
+	}
+
+	trace, _ := decoded.Extra["trace"].(map[string]interface{})
+	spans, _ := trace["span_ids"].([]interface{})
+	if len(spans) != 1 || spans[0] != int64(9223372036854775807) {
+		t.Fatalf("the nested 64-bit ids should be decoded without precision loss, got %v", trace)
+	}
+
+	if decoded.Extra["ratio"] != 0.5 {
+		t.Fatalf("the floats should be decoded as float64, got %v (%T)", decoded.Extra["ratio"], decoded.Extra["ratio"])
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Defines the sources of the fields of the documents written by the pumps. A field set by several
+// sources holds the value of the source with the highest precedence.
+const (
+	// FieldSourceOriginal are the fields of the analytics record.
+	FieldSourceOriginal = "original"
+	// FieldSourceEnrichment are the extra fields attached by the pump pipeline.
+	FieldSourceEnrichment = "enrichment"
+	// FieldSourceStatic are the static metadata and the metadata fields of the pump.
+	FieldSourceStatic = "static"
+	// FieldSourceTransform are the fields set by the format, e.g. ecs.version.
+	FieldSourceTransform = "transform"
+)
+
+// DefaultFieldPrecedence lists the sources of the fields from the lowest to the highest precedence.
+var DefaultFieldPrecedence = []string{
+	FieldSourceOriginal,
+	FieldSourceEnrichment,
+	FieldSourceStatic,
+	FieldSourceTransform,
+}
+
+// FieldCollision is a field of the documents set by several sources.
+type FieldCollision struct {
+	// Field is the name of the field in the document, its dotted path in the ECS format.
+	Field string
+	// Sources are the sources setting the field, from the lowest to the highest precedence, the
+	// value of the last one is written.
+	Sources []string
+	// Names are the names the sources set the field from.
+	Names []string
+}
+
+// ValidateFieldPrecedence checks that precedence orders all the field sources, an empty
+// precedence uses DefaultFieldPrecedence.
+func ValidateFieldPrecedence(precedence []string) error {
+	if len(precedence) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(precedence))
+	for _, source := range precedence {
+		switch source {
+		case FieldSourceOriginal, FieldSourceEnrichment, FieldSourceStatic, FieldSourceTransform:
+		default:
+			return fmt.Errorf("unsupported field source %s", source)
+		}
+
+		if seen[source] {
+			return fmt.Errorf("field source %s is listed twice", source)
+		}
+		seen[source] = true
+	}
+
+	if len(seen) != len(DefaultFieldPrecedence) {
+		return fmt.Errorf("the field precedence must order all of %s", strings.Join(DefaultFieldPrecedence, ", "))
+	}
+
+	return nil
+}
+
+// Document returns the record as the document written in the given format, along with the static
+// fields of the pump. The fields of every source are set from the lowest to the highest source of
+// the precedence, DefaultFieldPrecedence when empty, so that the highest source wins a collision.
+// The fields of a source are set in the order of their names, the extra fields written to the same
+// ECS field, e.g. ip and client_ip, resolve the same way for every record.
+func (a *AnalyticsRecord) Document(format string, static map[string]interface{}, precedence []string) map[string]interface{} {
+	if len(precedence) == 0 {
+		precedence = DefaultFieldPrecedence
+	}
+
+	ecs := format == FormatECS
+	doc := make(map[string]interface{}, len(recordFields)+len(a.Extra)+len(static))
+	for _, source := range precedence {
+		fields := a.sourceFields(source, ecs, static)
+		for _, name := range sortedNames(fields) {
+			value := fields[name]
+			if !ecs {
+				doc[name] = value
+
+				continue
+			}
+
+			if (source == FieldSourceOriginal || source == FieldSourceEnrichment) && isEmpty(value) {
+				continue
+			}
+			setPath(doc, fieldPath(source, name, ecs), value)
+		}
+	}
+
+	return doc
+}
+
+// FieldCollisions returns the fields of the documents written in format which are set by several
+// sources, given the names of the extra fields attached by the pipeline and of the static fields
+// of the pump. The extra fields attached by the clients are not known before the records are read.
+func FieldCollisions(format string, enrichment, static []string, precedence []string) []FieldCollision {
+	if len(precedence) == 0 {
+		precedence = DefaultFieldPrecedence
+	}
+
+	ecs := format == FormatECS
+	names := map[string][]string{
+		FieldSourceEnrichment: enrichment,
+		FieldSourceStatic:     static,
+	}
+	for name := range recordFields {
+		if name != "extra" {
+			names[FieldSourceOriginal] = append(names[FieldSourceOriginal], name)
+		}
+	}
+	if ecs {
+		for name := range ecsStaticFields {
+			names[FieldSourceTransform] = append(names[FieldSourceTransform], name)
+		}
+	}
+
+	fields := make(map[string]*FieldCollision)
+	for _, source := range precedence {
+		sorted := append([]string(nil), names[source]...)
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			path := fieldPath(source, name, ecs)
+			if fields[path] == nil {
+				fields[path] = &FieldCollision{Field: path}
+			}
+			fields[path].Sources = append(fields[path].Sources, source)
+			fields[path].Names = append(fields[path].Names, name)
+		}
+	}
+
+	collisions := make([]FieldCollision, 0)
+	for _, field := range fields {
+		if len(field.Sources) > 1 {
+			collisions = append(collisions, *field)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Field < collisions[j].Field })
+
+	return collisions
+}
+
+// sourceFields returns the fields set by the source, by name.
+func (a *AnalyticsRecord) sourceFields(source string, ecs bool, static map[string]interface{}) map[string]interface{} {
+	switch source {
+	case FieldSourceOriginal:
+		if ecs {
+			return a.ecsFields()
+		}
+
+		return a.fields()
+	case FieldSourceEnrichment:
+		return a.Extra
+	case FieldSourceStatic:
+		return static
+	case FieldSourceTransform:
+		if ecs {
+			return ecsStaticFields
+		}
+	}
+
+	return nil
+}
+
+// fields returns the fields of the record by json name.
+func (a *AnalyticsRecord) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"timestamp":  a.TimeStamp,
+		"username":   a.Username,
+		"effect":     a.Effect,
+		"conclusion": a.Conclusion,
+		"request":    a.Request,
+		"policies":   a.Policies,
+		"deciders":   a.Deciders,
+		"expireAt":   a.ExpireAt,
+	}
+}
+
+// fieldPath returns the name of the field the source sets from name: the ECS fields of the record
+// and extra fields are mapped, the static and transform fields are set as named.
+func fieldPath(source string, name string, ecs bool) string {
+	if !ecs || source == FieldSourceStatic || source == FieldSourceTransform {
+		return name
+	}
+
+	if path, ok := ECSFieldMapping[name]; ok {
+		return path
+	}
+
+	return ECSCustomNamespace + "." + name
+}
+
+func sortedNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"testing"
+)
+
+func TestDocumentPrecedence(t *testing.T) {
+	record := AnalyticsRecord{Username: "colin", Effect: "allow", Extra: map[string]interface{}{"username": "alice"}}
+	static := map[string]interface{}{"effect": "static", "ecs.version": "static"}
+
+	tests := []struct {
+		name       string
+		format     string
+		precedence []string
+		field      string
+		expected   interface{}
+	}{
+		{"enrichment over original", FormatDefault, nil, "username", "alice"},
+		{"static over original", FormatDefault, nil, "effect", "static"},
+		{"static added", FormatDefault, nil, "ecs.version", "static"},
+		{
+			"original over all", FormatDefault,
+			[]string{FieldSourceEnrichment, FieldSourceStatic, FieldSourceTransform, FieldSourceOriginal},
+			"username", "colin",
+		},
+		{"transform over static", FormatECS, nil, "ecs", map[string]interface{}{"version": ECSVersion}},
+		{
+			"static over transform", FormatECS,
+			[]string{FieldSourceOriginal, FieldSourceEnrichment, FieldSourceTransform, FieldSourceStatic},
+			"ecs", map[string]interface{}{"version": "static"},
+		},
+	}
+
+	for _, test := range tests {
+		doc := record.Document(test.format, static, test.precedence)
+		if got := doc[test.field]; !equalValues(got, test.expected) {
+			t.Errorf("%s: expected %s to be %v, got %v", test.name, test.field, test.expected, got)
+		}
+	}
+
+	// the record is not modified
+	if record.Username != "colin" || record.Extra["username"] != "alice" {
+		t.Errorf("the record should not be modified, got %+v", record)
+	}
+}
+
+func TestDocumentSameField(t *testing.T) {
+	// ip and client_ip are both written to the ECS source.ip field, the last name wins
+	for i := 0; i < 20; i++ {
+		record := AnalyticsRecord{Extra: map[string]interface{}{"ip": "10.0.0.1", "client_ip": "10.0.0.2"}}
+		source, _ := record.Document(FormatECS, nil, nil)["source"].(map[string]interface{})
+		if source["ip"] != "10.0.0.1" {
+			t.Fatalf("expected the ip extra field to win, got %v", source["ip"])
+		}
+	}
+}
+
+func TestValidateFieldPrecedence(t *testing.T) {
+	valid := [][]string{nil, {FieldSourceTransform, FieldSourceStatic, FieldSourceEnrichment, FieldSourceOriginal}}
+	for _, precedence := range valid {
+		if err := ValidateFieldPrecedence(precedence); err != nil {
+			t.Errorf("%v should be valid: %v", precedence, err)
+		}
+	}
+
+	invalid := [][]string{
+		{FieldSourceOriginal, FieldSourceStatic},
+		{FieldSourceOriginal, FieldSourceOriginal, FieldSourceStatic, FieldSourceTransform},
+		{FieldSourceOriginal, FieldSourceEnrichment, FieldSourceStatic, "format"},
+	}
+	for _, precedence := range invalid {
+		if err := ValidateFieldPrecedence(precedence); err == nil {
+			t.Errorf("%v should be invalid", precedence)
+		}
+	}
+}
+
+func TestFieldCollisions(t *testing.T) {
+	collisions := FieldCollisions(FormatDefault, []string{"instance", "username"}, []string{"cluster", "effect"}, nil)
+	if len(collisions) != 2 || collisions[0].Field != "effect" || collisions[1].Field != "username" {
+		t.Fatalf("unexpected collisions %+v", collisions)
+	}
+
+	if sources := collisions[0].Sources; len(sources) != 2 || sources[0] != FieldSourceOriginal ||
+		sources[1] != FieldSourceStatic {
+		t.Errorf("the sources should be ordered by precedence, got %v", sources)
+	}
+
+	// in ECS the fields are compared once mapped
+	collisions = FieldCollisions(FormatECS, []string{"client_ip", "ip"}, []string{"event.kind", "user.name"}, nil)
+	fields := make([]string, 0, len(collisions))
+	for _, collision := range collisions {
+		fields = append(fields, collision.Field)
+	}
+	if len(fields) != 3 || fields[0] != "event.kind" || fields[1] != "source.ip" || fields[2] != "user.name" {
+		t.Errorf("unexpected ECS collisions %v", fields)
+	}
+
+	if collisions := FieldCollisions(FormatDefault, []string{"instance"}, []string{"cluster"}, nil); len(collisions) != 0 {
+		t.Errorf("expected no collision, got %+v", collisions)
+	}
+}
+
+func equalValues(a, b interface{}) bool {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		return a == b
+	}
+
+	if len(am) != len(bm) {
+		return false
+	}
+	for k, v := range am {
+		if !equalValues(v, bm[k]) {
+			return false
+		}
+	}
+
+	return true
+}
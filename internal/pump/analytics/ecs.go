@@ -0,0 +1,123 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ory/ladon"
+)
+
+// Defines the formats the document pumps write the records in.
+const (
+	// FormatDefault writes the records with their json field names.
+	FormatDefault = ""
+	// FormatECS writes the records in the Elastic Common Schema.
+	FormatECS = "ecs"
+)
+
+// ECSVersion is the version of the Elastic Common Schema the records are mapped to.
+const ECSVersion = "8.11.0"
+
+// ECSFieldMapping maps the record fields, and the well-known extra fields attached by the pump
+// pipeline, to their Elastic Common Schema field. The other extra fields are written under
+// ECSCustomNamespace.
+var ECSFieldMapping = map[string]string{
+	"timestamp":  "@timestamp",
+	"username":   "user.name",
+	"effect":     "event.outcome",
+	"conclusion": "event.reason",
+	"request":    "iam.request",
+	"policies":   "iam.policies",
+	"deciders":   "iam.deciders",
+	"expireAt":   "event.end",
+	"ip":         "source.ip",
+	"client_ip":  "source.ip",
+	"geo":        "source.geo",
+	"user_agent": "user_agent.original",
+	"instance":   "observer.name",
+}
+
+// ECSOutcomes maps the effect of the authorizations to the ECS event outcome.
+var ECSOutcomes = map[string]string{
+	ladon.AllowAccess: "success",
+	ladon.DenyAccess:  "failure",
+}
+
+// ECSCustomNamespace is the ECS custom field set holding the fields without ECS equivalent.
+const ECSCustomNamespace = "iam"
+
+// ecsStaticFields are the fields set on all the records mapped to ECS.
+var ecsStaticFields = map[string]interface{}{
+	"ecs.version":    ECSVersion,
+	"event.kind":     "event",
+	"event.category": []string{"iam"},
+	"event.action":   "authorize",
+}
+
+// ValidateFormat checks that format is a supported document format.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatDefault, FormatECS:
+		return nil
+	default:
+		return fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+// ECS returns the record as an Elastic Common Schema document, the dotted ECS field names are
+// expanded into nested objects.
+func (a *AnalyticsRecord) ECS() map[string]interface{} {
+	return a.Document(FormatECS, nil, nil)
+}
+
+// ecsFields returns the fields of the record by json name, with their ECS values.
+func (a *AnalyticsRecord) ecsFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"timestamp":  time.Unix(a.TimeStamp, 0).UTC().Format(time.RFC3339),
+		"username":   a.Username,
+		"effect":     ecsOutcome(a.Effect),
+		"conclusion": a.Conclusion,
+		"request":    a.Request,
+		"policies":   a.Policies,
+		"deciders":   a.Deciders,
+	}
+	if !a.ExpireAt.IsZero() {
+		fields["expireAt"] = a.ExpireAt.UTC().Format(time.RFC3339)
+	}
+
+	return fields
+}
+
+func ecsOutcome(effect string) string {
+	if outcome, ok := ECSOutcomes[effect]; ok {
+		return outcome
+	}
+
+	return "unknown"
+}
+
+func isEmpty(value interface{}) bool {
+	s, ok := value.(string)
+
+	return value == nil || ok && s == ""
+}
+
+// setPath sets the value at the dotted path of the document, creating the intermediate objects.
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			doc[part] = child
+		}
+		doc = child
+	}
+
+	doc[parts[len(parts)-1]] = value
+}
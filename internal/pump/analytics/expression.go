@@ -0,0 +1,79 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+)
+
+// filterExpressionVariable is the variable holding the record in the filter expressions.
+const filterExpressionVariable = "record"
+
+// filterExpressionEnv declares the record variable of the filter expressions, a map of the
+// AnalyticsRecord fields by their Go name, e.g. record.Username or record.Extra.region.
+var filterExpressionEnv, filterExpressionEnvErr = cel.NewEnv(
+	cel.Variable(filterExpressionVariable, cel.MapType(cel.StringType, cel.DynType)),
+)
+
+// filterExpression is a compiled CEL filter expression, safe for concurrent use.
+type filterExpression struct {
+	program cel.Program
+}
+
+// compileFilterExpression compiles the CEL expression, which must evaluate to a bool.
+func compileFilterExpression(expression string) (*filterExpression, error) {
+	if filterExpressionEnvErr != nil {
+		return nil, filterExpressionEnvErr
+	}
+
+	ast, issues := filterExpressionEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid filter_expression %q: %w", expression, issues.Err())
+	}
+
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("filter_expression %q must evaluate to a bool, not %s", expression, ast.OutputType())
+	}
+
+	program, err := filterExpressionEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter_expression %q: %w", expression, err)
+	}
+
+	return &filterExpression{program: program}, nil
+}
+
+// matches reports whether the expression evaluates to true for the record.
+func (e *filterExpression) matches(record AnalyticsRecord) bool {
+	value, _, err := e.program.Eval(map[string]interface{}{filterExpressionVariable: expressionRecord(&record)})
+	if err != nil {
+		return false
+	}
+
+	matched, ok := value.Value().(bool)
+
+	return ok && matched
+}
+
+// expressionRecord returns the fields of the record by their Go name, the extra fields under Extra.
+func expressionRecord(record *AnalyticsRecord) map[string]interface{} {
+	value := reflect.ValueOf(record).Elem()
+	typ := value.Type()
+	fields := make(map[string]interface{}, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		if field := typ.Field(i); field.Name != "Raw" {
+			fields[field.Name] = value.Field(i).Interface()
+		}
+	}
+
+	if record.Extra == nil {
+		fields["Extra"] = map[string]interface{}{}
+	}
+
+	return fields
+}
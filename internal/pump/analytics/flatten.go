@@ -0,0 +1,117 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+)
+
+// Defines the strategies used to write the nested extra fields of the records to flat back-ends.
+const (
+	// FlattenJSONString replaces each nested field by its json encoding.
+	FlattenJSONString = "json-string"
+	// FlattenDrop removes the nested fields.
+	FlattenDrop = "drop"
+	// FlattenDelimited expands the nested fields into one field per leaf value, named after the
+	// path of the value joined by the delimiter, e.g. geo.city or tags.0.
+	FlattenDelimited = "flatten"
+)
+
+// DefaultFlattenDelimiter joins the path of the fields expanded by FlattenDelimited.
+const DefaultFlattenDelimiter = "."
+
+// ValidateFlatten checks that strategy is a supported flattening strategy, an empty strategy keeps
+// the nested fields as they are.
+func ValidateFlatten(strategy string) error {
+	switch strategy {
+	case "", FlattenJSONString, FlattenDrop, FlattenDelimited:
+		return nil
+	default:
+		return fmt.Errorf("unsupported flatten strategy %s", strategy)
+	}
+}
+
+// Flatten applies the strategy to the nested extra fields of the record, so that every extra
+// field holds a scalar value. The extra fields are replaced, not modified in place, as copies of
+// a record share them.
+func (a *AnalyticsRecord) Flatten(strategy string, delimiter string) {
+	if strategy == "" || len(a.Extra) == 0 {
+		return
+	}
+
+	if delimiter == "" {
+		delimiter = DefaultFlattenDelimiter
+	}
+
+	extra := make(map[string]interface{}, len(a.Extra))
+	for name, value := range a.Extra {
+		if !isNested(value) {
+			extra[name] = value
+
+			continue
+		}
+
+		switch strategy {
+		case FlattenJSONString:
+			b, _ := json.Marshal(value)
+			extra[name] = string(b)
+		case FlattenDelimited:
+			flattenValue(extra, name, reflect.ValueOf(value), delimiter)
+		}
+	}
+
+	a.Extra = extra
+}
+
+func isNested(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+
+	if _, ok := value.(time.Time); ok {
+		return false
+	}
+
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	default:
+		return false
+	}
+}
+
+func flattenValue(extra map[string]interface{}, path string, value reflect.Value, delimiter string) {
+	if value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			extra[path] = nil
+
+			return
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			flattenValue(extra, path+delimiter+fmt.Sprint(iter.Key().Interface()), iter.Value(), delimiter)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			flattenValue(extra, path+delimiter+strconv.Itoa(i), value.Index(i), delimiter)
+		}
+	case reflect.Struct:
+		// structs have no generic layout, keep them whole as json
+		b, _ := json.Marshal(value.Interface())
+		extra[path] = string(b)
+	default:
+		extra[path] = value.Interface()
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	// embeds the protobuf schema of the analytics records.
+	_ "embed"
+)
+
+// ProtoSchema is analytics.proto, the protobuf schema of the analytics records registered with the
+// schema registries.
+//
+//go:embed analytics.proto
+var ProtoSchema string
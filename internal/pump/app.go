@@ -28,6 +28,8 @@ func NewApp(basename string) *app.App {
 		app.WithDefaultValidArgs(),
 		app.WithRunFunc(run(opts)),
 	)
+	application.Command().AddCommand(newBackfillCommand(opts, application.Command().Flags().Lookup("config")))
+	application.Command().AddCommand(newReplayCommand(opts, application.Command().Flags().Lookup("config")))
 
 	return application
 }
@@ -0,0 +1,283 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the outcomes of a purge window recorded in the audit log.
+const (
+	auditProcessed = "processed"
+	auditPaused    = "paused"
+	auditHalted    = "halted"
+	auditLocked    = "locked"
+	auditNoPumps   = "no-pumps"
+	auditAbandoned = "abandoned"
+)
+
+// maxAuditErrors bounds the pump errors recorded per purge window.
+const maxAuditErrors = 20
+
+// auditBackupLayout is the layout of the suffix of the rotated audit log files.
+const auditBackupLayout = "20060102T150405.000"
+
+// auditLog appends a structured summary of every purge window to a file, independent of the
+// application log, as an audit trail of the pump activity. The file is only ever appended to, it
+// is rotated once larger than maxSize, keeping maxBackups rotated files, or all when 0.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// auditError is an error of a pump recorded in the summary of the window it happened in.
+type auditError struct {
+	Pump  string `json:"pump"`
+	Error string `json:"error"`
+}
+
+// auditWindow is the summary of a purge window written to the audit log.
+type auditWindow struct {
+	Time       time.Time    `json:"time"`
+	Source     string       `json:"source"`
+	Status     string       `json:"status"`
+	DurationMs int64        `json:"durationMs"`
+	Read       int64        `json:"read"`
+	Written    int64        `json:"written"`
+	Filtered   int64        `json:"filtered"`
+	Dropped    int64        `json:"dropped"`
+	Errored    int64        `json:"errored"`
+	Errors     []auditError `json:"errors,omitempty"`
+}
+
+// windowAuditKey is the context key of the audit of a purge window.
+type windowAuditKey struct{}
+
+// windowAudit accounts the records and the pump errors of a purge window besides the lifetime
+// stats, so that the summary of the window only counts its own records, whatever the other
+// sources and the queued pumps write meanwhile.
+type windowAudit struct {
+	stats lifetimeStats
+
+	mu     sync.Mutex
+	errors []auditError
+}
+
+// withWindowAudit returns a copy of ctx accounting the records written in the window to w.
+func withWindowAudit(ctx context.Context, w *windowAudit) context.Context {
+	return context.WithValue(ctx, windowAuditKey{}, w)
+}
+
+// auditOf returns the audit of the window of ctx, nil for the writes outside a purge window, which
+// are only accounted in the lifetime stats.
+func auditOf(ctx context.Context) *windowAudit {
+	w, _ := ctx.Value(windowAuditKey{}).(*windowAudit)
+
+	return w
+}
+
+func (w *windowAudit) addRead(n int) {
+	stats.addRead(n)
+	if w != nil {
+		w.stats.addRead(n)
+	}
+}
+
+func (w *windowAudit) addWritten(n int) {
+	stats.addWritten(n)
+	if w != nil {
+		w.stats.addWritten(n)
+	}
+}
+
+func (w *windowAudit) addFiltered(n int) {
+	stats.addFiltered(n)
+	if w != nil {
+		w.stats.addFiltered(n)
+	}
+}
+
+func (w *windowAudit) addDropped(n int) {
+	stats.addDropped(n)
+	if w != nil {
+		w.stats.addDropped(n)
+	}
+}
+
+func (w *windowAudit) addErrored(n int) {
+	stats.addErrored(n)
+	if w != nil {
+		w.stats.addErrored(n)
+	}
+}
+
+// error records the error of a pump, it is written along the summary of the window.
+func (w *windowAudit) error(pump string, err error) {
+	if w == nil || err == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.errors) < maxAuditErrors {
+		w.errors = append(w.errors, auditError{Pump: pump, Error: err.Error()})
+	}
+}
+
+// newAuditLog opens the audit log, it returns nil when no file is configured.
+func newAuditLog(path string, maxSizeMB, maxBackups int) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	a := &auditLog{path: path, maxSize: int64(maxSizeMB) << 20, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Recording the purge windows in audit log %s", path)
+
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create audit log directory")
+	}
+
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit log")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return errors.Wrap(err, "failed to stat audit log")
+	}
+
+	a.file, a.size = file, info.Size()
+
+	return nil
+}
+
+// window writes the summary of the window of the source started at start, as accounted by w.
+func (a *auditLog) window(start time.Time, source string, w *windowAudit, status string) {
+	if a == nil {
+		return
+	}
+
+	counts := w.stats.snapshot()
+	w.mu.Lock()
+	event := auditWindow{
+		Time:       start,
+		Source:     source,
+		Status:     status,
+		DurationMs: time.Since(start).Milliseconds(),
+		Read:       counts.Read,
+		Written:    counts.Written,
+		Filtered:   counts.Filtered,
+		Dropped:    counts.Dropped,
+		Errored:    counts.Errored,
+		Errors:     w.errors,
+	}
+	w.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	line, _ := json.Marshal(event)
+	a.write(append(line, '\n'))
+}
+
+func (a *auditLog) write(line []byte) {
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Errorf("Failed to rotate audit log %s: %s", a.path, err.Error())
+		}
+	}
+
+	if a.file == nil {
+		return
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Errorf("Failed to write audit log %s: %s", a.path, err.Error())
+	}
+}
+
+// rotate renames the audit log with a timestamp suffix and starts a new file.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+
+	backup := fmt.Sprintf("%s.%s", a.path, time.Now().Format(auditBackupLayout))
+	if err := os.Rename(a.path, backup); err != nil {
+		return err
+	}
+
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	a.removeBackups()
+
+	return nil
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups.
+func (a *auditLog) removeBackups() {
+	if a.maxBackups <= 0 {
+		return
+	}
+
+	backups, _ := filepath.Glob(a.path + ".*")
+	sort.Strings(backups)
+	for len(backups) > a.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Warnf("Failed to remove rotated audit log %s: %s", backups[0], err.Error())
+		}
+		backups = backups[1:]
+	}
+}
+
+// close closes the audit log, it is called at shutdown.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		if err := a.file.Close(); err != nil {
+			log.Errorf("Failed to close audit log %s: %s", a.path, err.Error())
+		}
+		a.file = nil
+	}
+}
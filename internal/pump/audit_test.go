@@ -0,0 +1,159 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func readAuditWindows(t *testing.T, path string) []auditWindow {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var windows []auditWindow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var window auditWindow
+		if err := json.Unmarshal(scanner.Bytes(), &window); err != nil {
+			t.Fatalf("invalid audit line %q: %s", scanner.Text(), err)
+		}
+		windows = append(windows, window)
+	}
+
+	return windows
+}
+
+func TestAuditLogWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "iam-pump.audit")
+	audit, err := newAuditLog(path, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	window := &windowAudit{}
+	window.addRead(3)
+	window.addWritten(2)
+	window.addErrored(1)
+	window.error("mock", errors.New("boom"))
+	// the records of another window meanwhile are not counted
+	(&windowAudit{}).addRead(5)
+	audit.window(time.Now(), primarySourceName, window, auditProcessed)
+	audit.window(time.Now(), "other", &windowAudit{}, auditPaused)
+	audit.close()
+
+	windows := readAuditWindows(t, path)
+	if len(windows) != 2 {
+		t.Fatalf("expected 2 windows, got %d", len(windows))
+	}
+
+	first := windows[0]
+	if first.Source != primarySourceName || first.Status != auditProcessed || first.Read != 3 || first.Written != 2 || first.Errored != 1 {
+		t.Errorf("unexpected summary %+v", first)
+	}
+	if len(first.Errors) != 1 || first.Errors[0].Pump != "mock" || first.Errors[0].Error != "boom" {
+		t.Errorf("unexpected errors %+v", first.Errors)
+	}
+
+	second := windows[1]
+	if second.Source != "other" || second.Status != auditPaused || second.Read != 0 || len(second.Errors) != 0 {
+		t.Errorf("the errors and counts should be those of the window, got %+v", second)
+	}
+
+	// the file is appended to when reopened
+	audit, err = newAuditLog(path, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.window(time.Now(), primarySourceName, &windowAudit{}, auditLocked)
+	audit.close()
+
+	if windows := readAuditWindows(t, path); len(windows) != 3 {
+		t.Errorf("expected 3 windows after reopening, got %d", len(windows))
+	}
+}
+
+func TestAuditSourceWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iam-pump.audit")
+	audit, err := newAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	primary := &chunkedStore{values: []interface{}{string(b)}}
+	other := &analyticsSource{name: "other", key: "other", store: &chunkedStore{values: []interface{}{string(b), string(b)}}}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: primary,
+		sources:        []*analyticsSource{other},
+		audit:          audit,
+		pmps:           []*pumpInstance{{Pump: &mockPump{}, name: "mock"}},
+	}
+
+	s.pump()
+	s.purgeSource(other)
+	audit.close()
+
+	windows := readAuditWindows(t, path)
+	if len(windows) != 2 {
+		t.Fatalf("expected a window per source, got %+v", windows)
+	}
+	if windows[0].Source != primarySourceName || windows[0].Read != 1 || windows[0].Written != 1 {
+		t.Errorf("unexpected window of the primary source %+v", windows[0])
+	}
+	if windows[1].Source != "other" || windows[1].Read != 2 || windows[1].Written != 2 {
+		t.Errorf("unexpected window of the additional source %+v", windows[1])
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iam-pump.audit")
+	audit, err := newAuditLog(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.maxSize = 1
+
+	for i := 0; i < 5; i++ {
+		audit.window(time.Now(), primarySourceName, &windowAudit{}, auditProcessed)
+		// the backups are named after the time of the rotation
+		time.Sleep(2 * time.Millisecond)
+	}
+	audit.close()
+
+	if windows := readAuditWindows(t, path); len(windows) != 1 {
+		t.Errorf("the current file should hold the last window, got %d", len(windows))
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 rotated files, got %v", backups)
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	audit, err := newAuditLog("", 100, 0)
+	if err != nil || audit != nil {
+		t.Fatalf("expected no audit log, got %v, %v", audit, err)
+	}
+
+	audit.window(time.Now(), primarySourceName, &windowAudit{}, auditProcessed)
+	audit.close()
+}
@@ -0,0 +1,454 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cliflag "github.com/marmotedu/component-base/pkg/cli/flag"
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
+
+	genericapiserver "github.com/marmotedu/iam/internal/pkg/server"
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/config"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+const backfillDesc = `Replay the analytics records archived by the csv or the s3 pump through the configured pumps,
+with their filters and transformations, then exit. It is meant for disaster recovery and back-end migrations.`
+
+// maxArchiveLineSize is the size of the longest json line read from an archive.
+const maxArchiveLineSize = 16 * 1024 * 1024
+
+// newBackfillCommand creates the backfill sub command. The pumps configuration is read from the
+// configuration file of iam-pump, given by configFlag.
+func newBackfillCommand(opts *options.Options, configFlag *pflag.Flag) *cobra.Command {
+	backfillOpts := options.NewBackfillOptions()
+	cmd := &cobra.Command{
+		Use:           "backfill",
+		Short:         "Replay archived analytics records through the pumps",
+		Long:          backfillDesc,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := viper.Unmarshal(opts); err != nil {
+				return err
+			}
+
+			if errs := append(opts.Validate(), backfillOpts.Validate()...); len(errs) != 0 {
+				return errors.NewAggregate(errs)
+			}
+
+			log.Init(opts.Log)
+			defer log.Flush()
+
+			cfg, err := config.CreateConfigFromOptions(opts)
+			if err != nil {
+				return err
+			}
+
+			return Backfill(cfg, backfillOpts, genericapiserver.SetupSignalHandler())
+		},
+	}
+
+	namedFlagSets := backfillOpts.Flags()
+	namedFlagSets.FlagSet("global").AddFlag(configFlag)
+	for _, fs := range namedFlagSets.FlagSets {
+		cmd.Flags().AddFlagSet(fs)
+	}
+
+	// the usage of iam-pump lists the flags of the purge loop, not the backfill ones
+	cmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\nUsage:\n  %s\n", cmd.Long, cmd.UseLine())
+		cliflag.PrintSections(cmd.OutOrStdout(), namedFlagSets, 0)
+	})
+
+	return cmd
+}
+
+// Backfill replays the records of the archive through the pumps, it returns once all the records
+// in the time range are written or stopCh is closed.
+func Backfill(cfg *config.Config, opts *options.BackfillOptions, stopCh <-chan struct{}) error {
+	tuneMemory(cfg.MemoryLimit, cfg.GCPercent)
+
+	server, err := createPumpServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := server.initialize(); err != nil {
+		return err
+	}
+	defer server.shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var source archiveSource = dirArchive(opts.Archive)
+	if strings.HasPrefix(opts.Archive, "s3://") {
+		if source, err = pumps.NewS3Archive(ctx, opts.Archive, opts.S3Endpoint, opts.S3Region,
+			opts.S3ForcePathStyle); err != nil {
+			return err
+		}
+	}
+
+	files, err := source.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	csvArchive, err := pumps.NewCSVArchive(csvPumpConfig(cfg.Pumps, opts.Archive))
+	if err != nil {
+		return err
+	}
+
+	since, until, err := opts.TimeRange()
+	if err != nil {
+		return err
+	}
+
+	limit := rate.Inf
+	if opts.Rate > 0 {
+		limit = rate.Limit(opts.Rate)
+	}
+
+	replay := &backfill{
+		server:    server,
+		source:    source,
+		csvFiles:  csvArchive,
+		since:     since,
+		until:     until,
+		limiter:   rate.NewLimiter(limit, opts.BatchSize),
+		batchSize: opts.BatchSize,
+	}
+
+	log.Infof("Replaying %d archive files from %s", len(files), opts.Archive)
+	for _, file := range files {
+		if err := replay.file(ctx, file); err != nil {
+			return errors.Wrapf(err, "failed to replay %s", file)
+		}
+	}
+	log.Infof("Replayed %d records from %s", replay.replayed, opts.Archive)
+
+	return nil
+}
+
+// archiveSource lists and reads the files of an archive.
+type archiveSource interface {
+	List(ctx context.Context) ([]string, error)
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// dirArchive is an archive directory written by the csv pump, or holding the objects of the s3 pump.
+type dirArchive string
+
+// List returns the archives of the directory, in the order they were written in. The files being
+// compressed are skipped, their source is still in the directory.
+func (d dirArchive) List(context.Context) ([]string, error) {
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read archive directory")
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && archiveFormat(entry.Name()) != "" {
+			files = append(files, filepath.Join(string(d), entry.Name()))
+		}
+	}
+	sortArchives(files)
+
+	return files, nil
+}
+
+// Get returns the content of the archive file.
+func (d dirArchive) Get(_ context.Context, name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// Defines the formats of the archives, by extension.
+var archiveFormats = []string{".csv", ".csv.gz", ".jsonl", ".jsonl.gz", ".parquet", ".msgpack.gz"}
+
+// archiveFormat returns the extension of the archive format of the file, empty if it is not one.
+func archiveFormat(name string) string {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(name, format) {
+			return strings.TrimSuffix(format, ".gz")
+		}
+	}
+
+	return ""
+}
+
+// sortArchives sorts the csv archives by period, then by sequence within their period, e.g. the
+// 2020-September-13-9.csv, 2020-September-13-9.1.csv and 2020-September-13-10.csv rotations. The
+// other files, e.g. the objects of the s3 pump named after their time, are sorted by name after them.
+func sortArchives(files []string) {
+	type rotation struct {
+		period   time.Time
+		sequence int
+		ok       bool
+	}
+
+	rotations := make(map[string]rotation, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".csv")
+		sequence := 0
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			if n, err := strconv.Atoi(name[i+1:]); err == nil {
+				name, sequence = name[:i], n
+			}
+		}
+
+		for _, layout := range []string{"2006-January-2-15", "2006-January-2"} {
+			if period, err := time.Parse(layout, name); err == nil {
+				rotations[file] = rotation{period: period, sequence: sequence, ok: true}
+
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := rotations[files[i]], rotations[files[j]]
+		switch {
+		case a.ok != b.ok:
+			return a.ok
+		case !a.ok:
+			return files[i] < files[j]
+		case !a.period.Equal(b.period):
+			return a.period.Before(b.period)
+		default:
+			return a.sequence < b.sequence
+		}
+	})
+}
+
+// backfill replays archived records through the pumps of the server.
+type backfill struct {
+	server    *pumpServer
+	source    archiveSource
+	csvFiles  *pumps.CSVArchive
+	since     time.Time
+	until     time.Time
+	limiter   *rate.Limiter
+	batchSize int
+	replayed  int
+}
+
+// file replays the records of the archive in the time range, in batches.
+func (b *backfill) file(ctx context.Context, name string) error {
+	content, err := b.source.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = bytes.NewReader(content)
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	batch := make([]interface{}, 0, b.batchSize)
+	add := func(record analytics.AnalyticsRecord) error {
+		if !b.inRange(record.TimeStamp) {
+			return nil
+		}
+
+		b.server.transform(&record)
+		if batch = append(batch, record); len(batch) == b.batchSize {
+			if err := b.write(ctx, batch); err != nil {
+				return err
+			}
+			// the pumps may still hold the written batch, e.g. an abandoned write
+			batch = make([]interface{}, 0, b.batchSize)
+		}
+
+		return nil
+	}
+
+	switch archiveFormat(name) {
+	case ".csv":
+		err = b.csv(name, r, add)
+	case ".jsonl":
+		err = b.jsonLines(name, r, add)
+	case ".parquet":
+		err = b.parquet(content, add)
+	case ".msgpack":
+		err = b.raw(name, r, add)
+	default:
+		err = errors.Errorf("unknown archive format of %s", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.write(ctx, batch)
+}
+
+// csv reads the records of a csv archive, with the options of the csv pump which wrote it.
+func (b *backfill) csv(name string, r io.Reader, add func(analytics.AnalyticsRecord) error) error {
+	if b.csvFiles == nil {
+		var err error
+		if b.csvFiles, err = pumps.NewCSVArchive(nil); err != nil {
+			return err
+		}
+	}
+
+	return b.csvFiles.Read(r, func(record analytics.AnalyticsRecord, err error) error {
+		if err != nil {
+			log.Warnf("Skipping undecodable record of %s: %s", name, err.Error())
+
+			return nil
+		}
+
+		return add(record)
+	})
+}
+
+// csvPumpConfig returns the configuration of the csv pump writing to the archive directory, nil
+// when no csv pump writes to it.
+func csvPumpConfig(configs map[string]options.PumpConfig, archive string) map[string]interface{} {
+	dir, err := filepath.Abs(archive)
+	if err != nil {
+		return nil
+	}
+
+	for key, pmp := range configs {
+		csvDir, _ := pmp.Meta["csv_dir"].(string)
+		if pumpType(key, pmp) != "csv" || csvDir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(csvDir); err == nil && abs == dir {
+			return pmp.Meta
+		}
+	}
+
+	return nil
+}
+
+// jsonLines reads the records of a json lines object of the s3 pump.
+func (b *backfill) jsonLines(name string, r io.Reader, add func(analytics.AnalyticsRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxArchiveLineSize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		record := analytics.AnalyticsRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warnf("Skipping undecodable record of %s: %s", name, err.Error())
+
+			continue
+		}
+
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parquet reads the records of a parquet object of the s3 pump.
+func (b *backfill) parquet(content []byte, add func(analytics.AnalyticsRecord) error) error {
+	records, err := pumps.DecodeParquet(content)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// raw reads the original payloads of a raw object of the s3 pump, decoded with the codec of the
+// server.
+func (b *backfill) raw(name string, r io.Reader, add func(analytics.AnalyticsRecord) error) error {
+	codec := newCodec(b.server.codec)()
+	decoder := msgpack.NewDecoder(r)
+	for {
+		payload, err := decoder.DecodeBytes()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record := analytics.AnalyticsRecord{}
+		if err := codec.decode(string(payload), &record); err != nil {
+			log.Warnf("Skipping undecodable record of %s: %s", name, err.Error())
+
+			continue
+		}
+		if b.server.keepRaw {
+			record.Raw = payload
+		}
+
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *backfill) inRange(timestamp int64) bool {
+	created := time.Unix(timestamp, 0)
+
+	return (b.since.IsZero() || !created.Before(b.since)) && (b.until.IsZero() || created.Before(b.until))
+}
+
+// write writes the batch to the pumps once the rate limit allows it.
+func (b *backfill) write(ctx context.Context, batch []interface{}) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := b.limiter.WaitN(ctx, len(batch)); err != nil {
+		return err
+	}
+
+	stats.addRead(len(batch))
+	b.server.writeToPumps(context.Background(), batch)
+	b.replayed += len(batch)
+
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+)
+
+func writeArchive(t *testing.T, name string, records ...analytics.AnalyticsRecord) {
+	t.Helper()
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w *csv.Writer
+	if filepath.Ext(name) == ".gz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = csv.NewWriter(gz)
+	} else {
+		w = csv.NewWriter(f)
+	}
+
+	_ = w.Write((&analytics.AnalyticsRecord{}).GetFieldNames())
+	for _, record := range records {
+		_ = w.Write(record.GetLineValues())
+	}
+	w.Flush()
+}
+
+func TestBackfill(t *testing.T) {
+	dir := t.TempDir()
+	writeArchive(t, filepath.Join(dir, "2020-September-13-12.csv"),
+		analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"},
+		analytics.AnalyticsRecord{TimeStamp: 1500000000, Username: "old"})
+	writeArchive(t, filepath.Join(dir, "2020-September-13-11.csv.gz"),
+		analytics.AnalyticsRecord{TimeStamp: 1600000001, Username: "admin"})
+	writeArchive(t, filepath.Join(dir, "partial.csv.gz.partial"))
+
+	files, err := dirArchive(dir).List(context.Background())
+	if err != nil || len(files) != 2 {
+		t.Fatalf("the csv archives should be listed, got %v (%v)", files, err)
+	}
+
+	mock := &mockPump{}
+	replay := &backfill{
+		server:    &pumpServer{secInterval: 1, pmps: []*pumpInstance{{Pump: mock, name: "mock"}}},
+		source:    dirArchive(dir),
+		since:     time.Unix(1600000000, 0),
+		limiter:   rate.NewLimiter(rate.Inf, 1),
+		batchSize: 1,
+	}
+
+	for _, file := range files {
+		if err := replay.file(context.Background(), file); err != nil {
+			t.Fatalf("the archive should be replayed, got %v", err)
+		}
+	}
+
+	if replay.replayed != 2 || len(mock.records()) != 2 {
+		t.Fatalf("the records in the time range should be replayed, got %v", mock.records())
+	}
+
+	record, _ := mock.records()[0].(analytics.AnalyticsRecord)
+	if record.Username != "admin" {
+		t.Fatalf("the gzipped archive should be replayed first, got %+v", record)
+	}
+}
+
+func TestSortArchives(t *testing.T) {
+	files := []string{
+		"2020-September-13-10.csv",
+		"0001-objects.jsonl.gz",
+		"2020-September-13-9.1.csv.gz",
+		"2020-September-13-9.csv.gz",
+		"2020-September-13-9.10.csv",
+		"2020-September-13-9.2.csv",
+		"2020-September-12.csv",
+	}
+	sortArchives(files)
+
+	want := []string{
+		"2020-September-12.csv",
+		"2020-September-13-9.csv.gz",
+		"2020-September-13-9.1.csv.gz",
+		"2020-September-13-9.2.csv",
+		"2020-September-13-9.10.csv",
+		"2020-September-13-10.csv",
+		"0001-objects.jsonl.gz",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("the archives should be sorted by period and sequence, got %v", files)
+	}
+}
+
+func TestBackfillS3Objects(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method == http.MethodPut {
+			objects[strings.TrimPrefix(r.URL.Path, "/archive/")], _ = ioutil.ReadAll(r.Body)
+
+			return
+		}
+
+		if r.URL.Query().Get("list-type") == "2" {
+			fmt.Fprint(w, "<ListBucketResult>")
+			for key := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", key)
+				}
+			}
+			fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+
+			return
+		}
+
+		_, _ = w.Write(objects[strings.TrimPrefix(r.URL.Path, "/archive/")])
+	}))
+	defer server.Close()
+
+	// every format of the s3 pump is replayed, in the order the objects were written
+	usernames := []string{"colin", "admin", "guest"}
+	for i, format := range []string{pumps.S3FormatParquet, pumps.S3FormatJSONL, pumps.S3FormatRaw} {
+		pump := &pumps.S3Pump{}
+		if err := pump.Init(map[string]interface{}{
+			"endpoint": server.URL, "bucket": "archive", "force_path_style": true, "prefix": "iam/",
+			"format": format, "access_key_id": "AKID", "secret_access_key": "SECRET",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		record := analytics.AnalyticsRecord{TimeStamp: 1600000000 + int64(i), Username: usernames[i]}
+		if err := pump.WriteData(context.Background(), []interface{}{record}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pump.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	source, err := pumps.NewS3Archive(context.Background(), "s3://archive/iam/", server.URL, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := source.List(context.Background())
+	if err != nil || len(files) != 3 {
+		t.Fatalf("the objects should be listed, got %v (%v)", files, err)
+	}
+
+	mock := &mockPump{}
+	replay := &backfill{
+		server:    &pumpServer{secInterval: 1, pmps: []*pumpInstance{{Pump: mock, name: "mock"}}},
+		source:    source,
+		limiter:   rate.NewLimiter(rate.Inf, 1),
+		batchSize: 10,
+	}
+	for _, file := range files {
+		if err := replay.file(context.Background(), file); err != nil {
+			t.Fatalf("the object should be replayed, got %v", err)
+		}
+	}
+
+	if len(mock.records()) != len(usernames) {
+		t.Fatalf("the records of the objects should be replayed, got %v", mock.records())
+	}
+	for i, value := range mock.records() {
+		if record, _ := value.(analytics.AnalyticsRecord); record.Username != usernames[i] {
+			t.Fatalf("the records should be replayed in order, got %+v", mock.records())
+		}
+	}
+}
+
+func TestBackfillCSVOptions(t *testing.T) {
+	dir := t.TempDir()
+	meta := map[string]interface{}{"csv_dir": dir, "columns": []string{"timestamp", "username"}, "delimiter": ";"}
+	writer := &pumps.CSVPump{}
+	if err := writer.Init(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteData(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := map[string]options.PumpConfig{
+		"archive": {Type: "csv", Meta: meta},
+		"other":   {Type: "csv", Meta: map[string]interface{}{"csv_dir": t.TempDir()}},
+	}
+	csvFiles, err := pumps.NewCSVArchive(csvPumpConfig(configs, dir+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := dirArchive(dir).List(context.Background())
+	mock := &mockPump{}
+	replay := &backfill{
+		server:    &pumpServer{secInterval: 1, pmps: []*pumpInstance{{Pump: mock, name: "mock"}}},
+		source:    dirArchive(dir),
+		csvFiles:  csvFiles,
+		limiter:   rate.NewLimiter(rate.Inf, 1),
+		batchSize: 10,
+	}
+	if len(files) != 1 || replay.file(context.Background(), files[0]) != nil {
+		t.Fatalf("the csv archive should be replayed, got %v", files)
+	}
+
+	if record, _ := mock.records()[0].(analytics.AnalyticsRecord); record.Username != "colin" {
+		t.Fatalf("the records should be read with the options of the csv pump writing the archive, got %+v", record)
+	}
+
+	// an archive written with other options fails rather than replaying empty records
+	replay.csvFiles = nil
+	if err := replay.file(context.Background(), files[0]); err == nil {
+		t.Fatal("the csv archive should be refused with the default options")
+	}
+}
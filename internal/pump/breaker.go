@@ -0,0 +1,239 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the states of a circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+	breakerDisabled = "disabled"
+)
+
+// defaultBreakerCooldown is the time an open breaker waits before probing the back-end again.
+const defaultBreakerCooldown = 30 * time.Second
+
+// deadLetterBreakerOpen is the dead-letter reason of the records not written while the breaker is open.
+const deadLetterBreakerOpen = "breaker-open"
+
+// circuitBreaker stops writing to a pump after threshold consecutive failed writes, so that a down
+// back-end does not hold every purge window until the timeout. Once the cooldown elapsed, a single
+// write probes the back-end: its success closes the breaker, its failure opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breakerState is the state of the breaker of a pump returned by the control api.
+type breakerState struct {
+	Pump     string     `json:"pump"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+	RetryAt  *time.Time `json:"retryAt,omitempty"`
+}
+
+// newCircuitBreaker creates the breaker of a pump, it returns nil when threshold is 0.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// allow reports whether a write may be sent to the pump. An open breaker lets a single probe
+// through once the cooldown elapsed.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the outcome of a write allowed by the breaker.
+func (b *circuitBreaker) done(pump string, err error, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Infof("Circuit breaker of pump %s closed, the back-end recovered", pump)
+		}
+		b.close(pump)
+
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state == breakerClosed {
+			log.Warnf("Circuit breaker of pump %s opened after %d consecutive failed writes", pump, b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = now
+		metrics.BreakerOpen.WithLabelValues(pump).Set(1)
+	}
+}
+
+// release lets another probe through when the write allowed did not reach the back-end.
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// reset force-closes the breaker, the next write is sent to the back-end.
+func (b *circuitBreaker) reset(pump string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log.Infof("Circuit breaker of pump %s reset", pump)
+	b.close(pump)
+}
+
+func (b *circuitBreaker) close(pump string) {
+	b.state = breakerClosed
+	b.failures = 0
+	b.openedAt = time.Time{}
+	metrics.BreakerOpen.WithLabelValues(pump).Set(0)
+}
+
+func (b *circuitBreaker) snapshot(pump string) breakerState {
+	if b == nil {
+		return breakerState{Pump: pump, State: breakerDisabled}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := breakerState{Pump: pump, State: b.state, Failures: b.failures}
+	if !b.openedAt.IsZero() {
+		openedAt, retryAt := b.openedAt, b.openedAt.Add(b.cooldown)
+		state.OpenedAt = &openedAt
+		state.RetryAt = &retryAt
+	}
+
+	return state
+}
+
+// serveBreakers returns the state of the circuit breaker of every pump.
+func (s *pumpServer) serveBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+
+	states := make([]breakerState, 0, len(s.pmps))
+	for _, pmp := range s.pmps {
+		states = append(states, pmp.breaker.snapshot(pmp.name))
+	}
+
+	data, _ := json.Marshal(states)
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// resetBreaker force-closes the circuit breaker of the pump in the /breakers/{pump}/reset path.
+func (s *pumpServer) resetBreaker(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/breakers/"), "/reset")
+	if name == "" || strings.Contains(name, "/") || !strings.HasSuffix(r.URL.Path, "/reset") {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+
+	for _, pmp := range s.pmps {
+		if pmp.name != name {
+			continue
+		}
+
+		if pmp.breaker == nil {
+			w.WriteHeader(http.StatusConflict)
+
+			return
+		}
+		pmp.breaker.reset(pmp.name)
+
+		data, _ := json.Marshal(pmp.breaker.snapshot(pmp.name))
+
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	flaky := &flakyPump{failures: 3, err: errors.New("backend unavailable")}
+	pmp := &pumpInstance{Pump: flaky, name: "flaky", breaker: newCircuitBreaker(2, time.Hour)}
+	keys := []interface{}{analytics.AnalyticsRecord{}}
+
+	for i := 0; i < 3; i++ {
+		_ = writePump(context.Background(), pmp, &keys, 1)
+	}
+	if flaky.calls != 2 || !errors.Is(writePump(context.Background(), pmp, &keys, 1), errBreakerOpen) {
+		t.Fatalf("the breaker should open after 2 consecutive failures, got %d calls", flaky.calls)
+	}
+
+	// the cooldown elapsed: a single probe is let through, its failure opens the breaker again
+	pmp.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := writePump(context.Background(), pmp, &keys, 1); err == nil || errors.Is(err, errBreakerOpen) {
+		t.Fatalf("the probe should reach the back-end, got %v", err)
+	}
+	if state := pmp.breaker.snapshot(pmp.name); state.State != breakerOpen {
+		t.Fatalf("a failed probe should open the breaker again, got %s", state.State)
+	}
+
+	s := &pumpServer{pmps: []*pumpInstance{pmp, {Pump: &mockPump{}, name: "mock"}}, controlToken: "secret"}
+	req := httptest.NewRequest(http.MethodPost, "/breakers/flaky/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.control(s.resetBreaker)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the breaker to be reset, got %d", w.Code)
+	}
+
+	if err := writePump(context.Background(), pmp, &keys, 1); err != nil || len(flaky.records()) != 1 {
+		t.Fatalf("the writes should resume once the breaker is reset, got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/breakers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	s.control(s.serveBreakers)(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `"state":"closed"`) || !strings.Contains(body, `"state":"disabled"`) {
+		t.Fatalf("unexpected breaker states: %s", body)
+	}
+
+	for path, code := range map[string]int{"/breakers/mock/reset": http.StatusConflict, "/breakers/unknown/reset": http.StatusNotFound} {
+		req = httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w = httptest.NewRecorder()
+		s.control(s.resetBreaker)(w, req)
+		if w.Code != code {
+			t.Fatalf("expected %d resetting %s, got %d", code, path, w.Code)
+		}
+	}
+}
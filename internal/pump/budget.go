@@ -0,0 +1,213 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the running estimate of the size of the records read from the analytics storage.
+const (
+	// defaultRecordSize is the estimate used until records were read.
+	defaultRecordSize = 1024
+	// recordSizeWeight is the weight of the last purge window in the estimate.
+	recordSizeWeight = 0.2
+)
+
+// drain reads the analytics data from the storage and writes it to the pumps.
+func (s *pumpServer) drain(ctx context.Context) {
+	s.drainSource(ctx, s.primarySource())
+}
+
+// drainSource reads the analytics data from the source and writes it to the pumps. When a memory
+// budget or a chunk size is set and the backlog exceeds it, the backlog is read and written in
+// chunks instead of being loaded at once, the chunks not read in the window being left in the
+// storage.
+func (s *pumpServer) drainSource(ctx context.Context, src *analyticsSource) {
+	defer s.expireBacklog(src)
+
+	chunked, ok := src.store.(storage.ChunkedAnalyticsStorage)
+	if (s.memoryBudget <= 0 && s.purgeChunkSize <= 0) || !ok {
+		s.drainAll(ctx, src)
+
+		return
+	}
+
+	length := chunked.GetSetLength(src.key)
+	chunk := s.chunkSize()
+	if length <= chunk {
+		s.drainAll(ctx, src)
+
+		return
+	}
+
+	log.Warnf("The %d records to purge exceed the memory budget of %d bytes or the chunk size of %d records, "+
+		"purging them in chunks of %d records", length, s.memoryBudget, s.purgeChunkSize, chunk)
+	metrics.ChunkedPurges.Inc()
+
+	// the records added while draining are left to the next window
+	for read := int64(0); read < length; {
+		if ctx.Err() != nil {
+			log.Warnf("The deadline of the window is exceeded, leaving %d records to the next window", length-read)
+
+			return
+		}
+
+		values := chunked.GetAndDeleteChunk(src.key, chunk)
+		if len(values) == 0 {
+			return
+		}
+
+		if s.window(ctx, src, values) {
+			return
+		}
+		s.acknowledge(src)
+
+		if s.decodeErrors.isHalted() {
+			return
+		}
+		read += int64(len(values))
+		chunk = s.chunkSize()
+	}
+}
+
+// drainAll reads and deletes all the analytics data of the source at once.
+func (s *pumpServer) drainAll(ctx context.Context, src *analyticsSource) {
+	analyticsValues := src.store.GetAndDeleteSet(src.key)
+	if len(analyticsValues) == 0 {
+		// the buffered pumps are flushed on their schedule, whether new data was read or not
+		s.windowMu.Lock()
+		s.writeToPumps(ctx, nil)
+		s.windowMu.Unlock()
+
+		return
+	}
+
+	// the data requeued for the pumps which failed is only acknowledged once they write it
+	if s.window(ctx, src, analyticsValues) {
+		return
+	}
+
+	s.acknowledge(src)
+}
+
+// acknowledge acknowledges the analytics data read from the source, once written to the pumps.
+func (s *pumpServer) acknowledge(src *analyticsSource) {
+	if acknowledging, ok := src.store.(storage.AcknowledgingStorage); ok {
+		if err := acknowledging.Ack(); err != nil {
+			log.Errorf("Failed to acknowledge the analytics data read, it will be read again: %s", err.Error())
+		}
+	}
+}
+
+// window writes the values read from the source to the pumps, the values of the sources being
+// written one window at a time. It reports whether the values were put back in the source, as a
+// pump retaining them, or any in at-least-once mode, failed to write them synchronously, the
+// values are acknowledged otherwise.
+func (s *pumpServer) window(ctx context.Context, src *analyticsSource, values []interface{}) bool {
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+
+	undecodable := s.process(withWindowSource(ctx, src), values)
+	retained := s.retain(src, values)
+	if len(undecodable) > 0 {
+		if retained {
+			// the undecodable values of the window were put back with the others
+			undecodable = undecodable[:len(undecodable)-1]
+		}
+		s.requeueUndecodable(src, undecodable)
+	}
+
+	return retained
+}
+
+// requeueUndecodable puts the undecodable values of the windows which halted the loop back in the
+// source, ahead of the values not read yet, so that they are read again once iam-pump is fixed.
+func (s *pumpServer) requeueUndecodable(src *analyticsSource, windows [][]interface{}) {
+	var values []interface{}
+	for _, window := range windows {
+		values = append(values, window...)
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	requeueing, ok := src.store.(storage.RequeueingStorage)
+	if !ok {
+		log.Errorf("The %d undecodable records are lost, the %s storage can not put them back",
+			len(values), src.store.GetName())
+
+		return
+	}
+
+	if err := requeueing.Requeue(src.key, values); err != nil {
+		log.Errorf("Failed to put the %d undecodable records back, they are lost: %s", len(values), err.Error())
+
+		return
+	}
+	log.Warnf("Put the %d undecodable records back in the analytics storage", len(values))
+}
+
+// chunkSize returns the number of records fitting the memory budget, according to the running
+// estimate of the record size, and the chunk size.
+func (s *pumpServer) chunkSize() int64 {
+	if s.memoryBudget <= 0 {
+		return s.purgeChunkSize
+	}
+
+	s.windowMu.Lock()
+	size := s.recordSize
+	s.windowMu.Unlock()
+	if size <= 0 {
+		size = defaultRecordSize
+	}
+
+	chunk := int64(float64(s.memoryBudget) / size)
+	if s.purgeChunkSize > 0 && chunk > s.purgeChunkSize {
+		return s.purgeChunkSize
+	}
+	if chunk > 0 {
+		return chunk
+	}
+
+	return 1
+}
+
+// expireBacklog refreshes the expiration of the analytics data left in the source by the window,
+// so that it expires once no instance drains it anymore.
+func (s *pumpServer) expireBacklog(src *analyticsSource) {
+	if s.expiration <= 0 {
+		return
+	}
+
+	chunked, ok := src.store.(storage.ChunkedAnalyticsStorage)
+	expiring, canExpire := src.store.(storage.ExpiringStorage)
+	if !ok || !canExpire || chunked.GetSetLength(src.key) == 0 {
+		return
+	}
+
+	if err := expiring.SetExp(src.key, s.expiration); err != nil {
+		log.Errorf("Failed to set the expiration of the analytics data left in the storage: %s", err.Error())
+	}
+}
+
+// observeRecordSize updates the running estimate of the record size with the records read.
+func (s *pumpServer) observeRecordSize(size, count int) {
+	if count == 0 {
+		return
+	}
+
+	average := float64(size) / float64(count)
+	if s.recordSize <= 0 {
+		s.recordSize = average
+	} else {
+		s.recordSize = (1-recordSizeWeight)*s.recordSize + recordSizeWeight*average
+	}
+	metrics.RecordSize.Set(s.recordSize)
+}
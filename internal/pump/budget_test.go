@@ -0,0 +1,124 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// chunkedStore is an in-memory analytics storage which records the size of the reads.
+type chunkedStore struct {
+	values []interface{}
+	reads  []int
+}
+
+func (c *chunkedStore) Init(config interface{}) error { return nil }
+func (c *chunkedStore) GetName() string               { return "chunked" }
+func (c *chunkedStore) Connect() bool                 { return true }
+func (c *chunkedStore) GetSetLength(string) int64     { return int64(len(c.values)) }
+
+func (c *chunkedStore) GetAndDeleteSet(key string) []interface{} {
+	return c.GetAndDeleteChunk(key, int64(len(c.values)))
+}
+
+func (c *chunkedStore) GetAndDeleteChunk(_ string, size int64) []interface{} {
+	if size > int64(len(c.values)) {
+		size = int64(len(c.values))
+	}
+
+	values := c.values[:size]
+	c.values = c.values[size:]
+	c.reads = append(c.reads, len(values))
+
+	return values
+}
+
+func TestDrainMemoryBudget(t *testing.T) {
+	store := &chunkedStore{}
+	for i := 0; i < 10; i++ {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+		store.values = append(store.values, string(b))
+	}
+
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		memoryBudget:   3 * defaultRecordSize,
+		pmps:           []*pumpInstance{{Pump: mock, name: "mock"}},
+	}
+
+	s.drain(context.Background())
+	if len(mock.records()) != 10 || len(store.values) != 0 {
+		t.Fatalf("all the records should be written, got %d", len(mock.records()))
+	}
+
+	if store.reads[0] != 3 || len(store.reads) != 2 {
+		t.Fatalf("the backlog should be read in chunks fitting the budget, got reads %v", store.reads)
+	}
+
+	if s.recordSize <= 0 || s.recordSize >= defaultRecordSize {
+		t.Fatalf("the record size estimate should follow the records read, got %v", s.recordSize)
+	}
+}
+
+// expiringStore is a chunked store recording the expirations set on its key.
+type expiringStore struct {
+	chunkedStore
+	expirations []int64
+}
+
+func (e *expiringStore) SetExp(_ string, timeout int64) error {
+	e.expirations = append(e.expirations, timeout)
+
+	return nil
+}
+
+func TestDrainChunkSize(t *testing.T) {
+	store := &expiringStore{}
+	for i := 0; i < 10; i++ {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+		store.values = append(store.values, string(b))
+	}
+
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		purgeChunkSize: 4,
+		expiration:     60,
+		pmps:           []*pumpInstance{{Pump: mock, name: "mock"}},
+	}
+
+	s.drain(context.Background())
+	if len(mock.records()) != 10 || len(store.values) != 0 {
+		t.Fatalf("all the records should be written, got %d", len(mock.records()))
+	}
+
+	if len(store.reads) != 3 || store.reads[0] != 4 || store.reads[2] != 2 {
+		t.Fatalf("the backlog should be read in chunks of the chunk size, got reads %v", store.reads)
+	}
+
+	if len(store.expirations) != 0 {
+		t.Fatalf("a drained storage should not be expired, got %v", store.expirations)
+	}
+
+	store.values = append(store.values, mock.records()...)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.drain(ctx)
+	if len(store.values) != 10 {
+		t.Fatalf("the chunks not read in the window should be left in the storage, got %d", len(store.values))
+	}
+
+	if len(store.expirations) != 1 || store.expirations[0] != 60 {
+		t.Fatalf("the records left in the storage should expire, got %v", store.expirations)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// setReadInterval reads the analytics storage as often as the most frequently flushed pump needs,
+// the pumps flushed less often buffer the records in between. The buffers are only held in memory:
+// the buffered records are already removed from the analytics storage, a crash loses them, only
+// a graceful shutdown flushes them.
+func (s *pumpServer) setReadInterval() {
+	s.readInterval = time.Duration(s.secInterval) * time.Second
+	for _, pmp := range s.pmps {
+		if pmp.purgeDelay < s.readInterval {
+			s.readInterval = pmp.purgeDelay
+		}
+	}
+
+	now := time.Now()
+	for _, pmp := range s.pmps {
+		pmp.buffered = pmp.purgeDelay > s.readInterval
+		pmp.lastFlush = now
+		if pmp.buffered {
+			log.Warnf("Pump %s is flushed every %s, the analytics storage is read every %s: up to %s of records "+
+				"are buffered in memory only and lost if iam-pump crashes before they are flushed",
+				pmp.name, pmp.purgeDelay, s.readInterval, pmp.purgeDelay)
+		}
+	}
+}
+
+// bufferBatches appends the batches of the buffered pumps to their buffer. The batch of a buffered
+// pump is replaced by its buffered records when its purge delay elapsed since its last flush, and
+// emptied otherwise.
+func (s *pumpServer) bufferBatches(batches [][]interface{}, now time.Time) {
+	for i, pmp := range s.pmps {
+		if !pmp.buffered {
+			continue
+		}
+
+		pmp.buffer = append(pmp.buffer, batches[i]...)
+		if now.Sub(pmp.lastFlush) < pmp.purgeDelay {
+			batches[i] = nil
+			metrics.BufferedRecords.WithLabelValues(pmp.name).Set(float64(len(pmp.buffer)))
+
+			continue
+		}
+
+		batches[i] = pmp.buffer
+		pmp.buffer = nil
+		pmp.lastFlush = now
+		metrics.BufferedRecords.WithLabelValues(pmp.name).Set(0)
+	}
+}
+
+// flushBuffers writes the records still buffered by the pumps, it is called at shutdown.
+func (s *pumpServer) flushBuffers() {
+	s.flushPumpBuffers(s.pmps)
+}
+
+// flushPumpBuffers writes the records still buffered by the given pumps.
+func (s *pumpServer) flushPumpBuffers(instances []*pumpInstance) {
+	var wg sync.WaitGroup
+	for _, pmp := range instances {
+		if len(pmp.buffer) == 0 {
+			continue
+		}
+
+		log.Infof("Flushing %d records buffered by pump %s", len(pmp.buffer), pmp.name)
+		batch := pmp.buffer
+		pmp.buffer = nil
+		metrics.BufferedRecords.WithLabelValues(pmp.name).Set(0)
+
+		pmp.send(context.Background(), &wg, batch, s.secInterval)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestPerPumpPurgeDelay(t *testing.T) {
+	fast := &mockPump{}
+	slow := &mockPump{}
+	s := &pumpServer{
+		secInterval: 10,
+		pmps: []*pumpInstance{
+			{Pump: fast, name: "fast", purgeDelay: time.Second},
+			{Pump: slow, name: "slow", purgeDelay: time.Hour},
+		},
+	}
+
+	s.setReadInterval()
+	if s.readInterval != time.Second || s.pmps[0].buffered || !s.pmps[1].buffered {
+		t.Fatalf("the storage should be read at the fastest pump cadence, got %s", s.readInterval)
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{Username: "colin"}})
+	s.writeToPumps(context.Background(), nil)
+	if len(fast.records()) != 1 || len(slow.records()) != 0 {
+		t.Fatalf("only the fast pump should be written, got %d and %d", len(fast.records()), len(slow.records()))
+	}
+
+	s.pmps[1].lastFlush = time.Now().Add(-time.Hour)
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{Username: "admin"}})
+	if len(slow.records()) != 2 || len(s.pmps[1].buffer) != 0 {
+		t.Fatalf("the slow pump should be flushed once its purge delay elapsed, got %d", len(slow.records()))
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{Username: "colin"}})
+	s.flushBuffers()
+	if len(slow.records()) != 3 {
+		t.Fatalf("the buffers should be flushed at shutdown, got %d", len(slow.records()))
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+)
+
+// defaultCoalesceCountField is the extra field holding the number of records a coalesced record stands for.
+const defaultCoalesceCountField = "count"
+
+// coalescer collapses the runs of consecutive identical records of a purge window, e.g. the
+// denials of a retry storm, into their first record annotated with the size of the run. Records
+// are identical when the key fields, and the timestamps when required, are equal.
+type coalescer struct {
+	fields     []string
+	timestamps bool
+	countField string
+}
+
+// newCoalescer creates the coalescer of the pipeline, it returns nil when no key field is configured.
+func newCoalescer(fields []string, timestamps bool, countField string) *coalescer {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if countField == "" {
+		countField = defaultCoalesceCountField
+	}
+
+	return &coalescer{fields: fields, timestamps: timestamps, countField: countField}
+}
+
+// coalesce returns the records with the runs of identical records collapsed. Every record
+// returned is annotated with its count, 1 for the records which were not coalesced, so that the
+// back-ends get a consistent schema. The keys which are not records are returned as-is and end the
+// run they interrupt.
+func (c *coalescer) coalesce(keys []interface{}) []interface{} {
+	if c == nil || len(keys) == 0 {
+		return keys
+	}
+
+	coalesced := make([]interface{}, 0, len(keys))
+	var first analytics.AnalyticsRecord
+	var previous string
+	var count int64
+	flush := func() {
+		if count == 0 {
+			return
+		}
+
+		first.SetExtra(c.countField, count)
+		coalesced = append(coalesced, first)
+		count = 0
+	}
+
+	for _, key := range keys {
+		record, ok := key.(analytics.AnalyticsRecord)
+		if !ok {
+			flush()
+			coalesced = append(coalesced, key)
+
+			continue
+		}
+
+		current := c.key(&record)
+		if count > 0 && current == previous {
+			count++
+
+			continue
+		}
+
+		flush()
+		first, previous, count = record, current, 1
+	}
+	flush()
+
+	metrics.CoalescedRecords.Add(float64(len(keys) - len(coalesced)))
+
+	return coalesced
+}
+
+// field returns the count field the coalesced records are annotated with, empty when the records
+// are not coalesced.
+func (c *coalescer) field() string {
+	if c == nil {
+		return ""
+	}
+
+	return c.countField
+}
+
+// key returns the values of the key fields of the record.
+func (c *coalescer) key(record *analytics.AnalyticsRecord) string {
+	var key strings.Builder
+	if c.timestamps {
+		fmt.Fprintf(&key, "%d\x00", record.TimeStamp)
+	}
+
+	for _, field := range c.fields {
+		value, _ := record.FieldValue(field)
+		fmt.Fprintf(&key, "%v\x00", value)
+	}
+
+	return key.String()
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestCoalesce(t *testing.T) {
+	denied := func(timestamp int64, username string) analytics.AnalyticsRecord {
+		return analytics.AnalyticsRecord{TimeStamp: timestamp, Username: username, Effect: "deny"}
+	}
+	keys := []interface{}{
+		denied(1, "colin"), denied(1, "colin"), denied(2, "colin"),
+		denied(2, "james"),
+		denied(3, "colin"),
+	}
+
+	counts := func(coalesced []interface{}) []int64 {
+		values := make([]int64, 0, len(coalesced))
+		for _, key := range coalesced {
+			record, _ := key.(analytics.AnalyticsRecord)
+			count, _ := record.Extra[defaultCoalesceCountField].(int64)
+			values = append(values, count)
+		}
+
+		return values
+	}
+
+	c := newCoalescer([]string{"username", "effect"}, false, "")
+	if got := counts(c.coalesce(keys)); len(got) != 3 || got[0] != 3 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("only the consecutive identical records should be coalesced, got counts %v", got)
+	}
+
+	c = newCoalescer([]string{"username", "effect"}, true, "")
+	if got := counts(c.coalesce(keys)); len(got) != 4 || got[0] != 2 {
+		t.Fatalf("the records should only be coalesced with the same timestamp, got counts %v", got)
+	}
+
+	if original, _ := keys[0].(analytics.AnalyticsRecord); original.Extra != nil {
+		t.Fatal("the records read should not be modified")
+	}
+
+	c = newCoalescer([]string{"username", "effect"}, false, "")
+	coalesced := c.coalesce([]interface{}{denied(1, "colin"), "raw", denied(1, "colin"), denied(2, "colin")})
+	if len(coalesced) != 3 || coalesced[1] != "raw" {
+		t.Fatalf("the keys which are not records should be passed as-is, got %v", coalesced)
+	}
+	if got := counts(coalesced); got[0] != 1 || got[2] != 2 {
+		t.Fatalf("a key which is not a record should end the run, got counts %v", got)
+	}
+}
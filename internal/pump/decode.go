@@ -0,0 +1,149 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+// recordCodec decodes the analytics records read from the storage. A recordCodec is not safe for
+// concurrent use, every decode worker creates its own.
+type recordCodec interface {
+	decode(raw string, record *analytics.AnalyticsRecord) error
+}
+
+// codecs are the constructors of the codecs selectable with --codec.
+var codecs = map[string]func() recordCodec{
+	options.CodecMsgpack:  func() recordCodec { return newRecordDecoder() },
+	options.CodecJSON:     func() recordCodec { return jsonDecoder{} },
+	options.CodecProtobuf: func() recordCodec { return protobufDecoder{} },
+	options.CodecAuto:     func() recordCodec { return newAutoDecoder() },
+}
+
+// newCodec returns the constructor of the named codec, msgpack by default.
+func newCodec(name string) func() recordCodec {
+	if codec, ok := codecs[name]; ok {
+		return codec
+	}
+
+	return codecs[options.CodecMsgpack]
+}
+
+// recordDecoder decodes msgpack encoded analytics records. The same reader and decoder are reused
+// for every record of a purge window, which avoids converting each raw value to a []byte and
+// allocating a new reader per record. A recordDecoder is not safe for concurrent use.
+type recordDecoder struct {
+	reader  *strings.Reader
+	decoder *msgpack.Decoder
+}
+
+func newRecordDecoder() *recordDecoder {
+	reader := strings.NewReader("")
+
+	return &recordDecoder{
+		reader: reader,
+		// strings.Reader implements io.ByteScanner, so the decoder reads it without extra buffering
+		decoder: msgpack.NewDecoder(reader),
+	}
+}
+
+// decode decodes raw into record. The decoder copies every decoded string out of its internal
+// buffer, so the record does not alias any memory reused by the next decode.
+func (d *recordDecoder) decode(raw string, record *analytics.AnalyticsRecord) error {
+	d.reader.Reset(raw)
+	d.decoder.Reset(d.reader)
+
+	return d.decoder.Decode(record)
+}
+
+// jsonDecoder decodes json encoded analytics records, with the json field names of AnalyticsRecord.
+type jsonDecoder struct{}
+
+func (jsonDecoder) decode(raw string, record *analytics.AnalyticsRecord) error {
+	return json.Unmarshal([]byte(raw), record)
+}
+
+// autoDecoder detects the encoding of every record from its first byte: a json object starts with
+// {, a msgpack encoded record with a map header, and a protobuf encoded one with the tag of one of
+// the fields of the analytics.proto message, none of which is a msgpack map header.
+type autoDecoder struct {
+	msgpack *recordDecoder
+}
+
+func newAutoDecoder() *autoDecoder {
+	return &autoDecoder{msgpack: newRecordDecoder()}
+}
+
+func (d *autoDecoder) decode(raw string, record *analytics.AnalyticsRecord) error {
+	if raw == "" {
+		return errors.New("empty analytics record")
+	}
+
+	switch b := raw[0]; {
+	case b == '{':
+		return jsonDecoder{}.decode(raw, record)
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		return d.msgpack.decode(raw, record)
+	default:
+		return protobufDecoder{}.decode(raw, record)
+	}
+}
+
+// decodeValues decodes the raw analytics values with the codecs created by newCodec and prepares
+// each decoded record with prepare. The values are split in batches of batchSize records, decoded
+// concurrently by up to workers goroutines each using its own codec, so that a large purge does not stretch past the
+// purge interval. The records and the decoding errors are returned in the order of the values.
+func decodeValues(values []interface{}, newCodec func() recordCodec, workers, batchSize int,
+	prepare func(raw string, record *analytics.AnalyticsRecord)) ([]analytics.AnalyticsRecord, []error) {
+	records := make([]analytics.AnalyticsRecord, len(values))
+	errs := make([]error, len(values))
+	decodeRange := func(from, to int) {
+		decoder := newCodec()
+		for i := from; i < to; i++ {
+			raw, _ := values[i].(string)
+			if errs[i] = decoder.decode(raw, &records[i]); errs[i] == nil {
+				prepare(raw, &records[i])
+			}
+		}
+	}
+
+	if workers <= 1 || batchSize <= 0 || len(values) <= batchSize {
+		decodeRange(0, len(values))
+
+		return records, errs
+	}
+
+	batches := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for from := range batches {
+				to := from + batchSize
+				if to > len(values) {
+					to = len(values)
+				}
+				decodeRange(from, to)
+			}
+		}()
+	}
+
+	for from := 0; from < len(values); from += batchSize {
+		batches <- from
+	}
+	close(batches)
+	wg.Wait()
+
+	return records, errs
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func encodeRecords(t testing.TB, records ...analytics.AnalyticsRecord) []string {
+	t.Helper()
+
+	raws := make([]string, 0, len(records))
+	for _, record := range records {
+		b, err := msgpack.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, string(b))
+	}
+
+	return raws
+}
+
+func TestRecordDecoderDoesNotAlias(t *testing.T) {
+	raws := encodeRecords(t,
+		analytics.AnalyticsRecord{Username: "colin", Effect: "allow", Policies: "policy-a"},
+		analytics.AnalyticsRecord{Username: "james", Effect: "deny"},
+	)
+
+	decoder := newRecordDecoder()
+	records := make([]analytics.AnalyticsRecord, len(raws))
+	for i, raw := range raws {
+		if err := decoder.decode(raw, &records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if records[0].Username != "colin" || records[0].Policies != "policy-a" {
+		t.Fatalf("first record was overwritten by the next decode: %+v", records[0])
+	}
+
+	if records[1].Username != "james" || records[1].Policies != "" {
+		t.Fatalf("unexpected second record: %+v", records[1])
+	}
+
+	if err := decoder.decode("not msgpack", &analytics.AnalyticsRecord{}); err == nil {
+		t.Fatal("decoding garbage should fail")
+	}
+}
+
+func TestDecodeValuesKeepsOrder(t *testing.T) {
+	records := make([]analytics.AnalyticsRecord, 25)
+	for i := range records {
+		records[i] = analytics.AnalyticsRecord{TimeStamp: int64(i), Username: "colin"}
+	}
+	values := make([]interface{}, 0, len(records)+1)
+	for _, raw := range encodeRecords(t, records...) {
+		values = append(values, raw)
+	}
+	values = append(values[:10], append([]interface{}{"not msgpack"}, values[10:]...)...)
+
+	decoded, errs := decodeValues(values, newCodec(options.CodecMsgpack), 4, 3, func(raw string, record *analytics.AnalyticsRecord) {
+		record.SetExtra("size", len(raw))
+	})
+	for i := range values {
+		if i == 10 {
+			if errs[i] == nil {
+				t.Fatal("decoding garbage should fail")
+			}
+
+			continue
+		}
+
+		want := int64(i)
+		if i > 10 {
+			want--
+		}
+		if errs[i] != nil || decoded[i].TimeStamp != want || decoded[i].Extra["size"] == nil {
+			t.Fatalf("record %d was not decoded in order: %+v, %v", i, decoded[i], errs[i])
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	expireAt := time.Unix(1600000000, 0).UTC()
+	record := analytics.AnalyticsRecord{TimeStamp: 42, Username: "colin", Effect: "allow", ExpireAt: expireAt}
+
+	encoded, _ := json.Marshal(record)
+	jsonRecord := string(encoded)
+	msgpackRecord := encodeRecords(t, record)[0]
+
+	timestamp := protowire.AppendTag(nil, 1, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(expireAt.Unix()))
+	extra := protowire.AppendTag(nil, 1, protowire.BytesType)
+	extra = protowire.AppendString(extra, "region")
+	extra = protowire.AppendTag(extra, 2, protowire.BytesType)
+	extra = protowire.AppendString(extra, "eu")
+	pb := protowire.AppendTag(nil, 1, protowire.VarintType)
+	pb = protowire.AppendVarint(pb, 42)
+	pb = protowire.AppendTag(pb, 2, protowire.BytesType)
+	pb = protowire.AppendString(pb, "colin")
+	pb = protowire.AppendTag(pb, 3, protowire.BytesType)
+	pb = protowire.AppendString(pb, "allow")
+	pb = protowire.AppendTag(pb, 8, protowire.BytesType)
+	pb = protowire.AppendBytes(pb, timestamp)
+	pb = protowire.AppendTag(pb, 9, protowire.BytesType)
+	pb = protowire.AppendBytes(pb, extra)
+	pb = protowire.AppendTag(pb, 15, protowire.BytesType)
+	pb = protowire.AppendString(pb, "unknown field")
+	protobufRecord := string(pb)
+
+	tests := []struct {
+		codec string
+		raw   string
+	}{
+		{options.CodecMsgpack, msgpackRecord},
+		{options.CodecJSON, jsonRecord},
+		{options.CodecProtobuf, protobufRecord},
+		{options.CodecAuto, msgpackRecord},
+		{options.CodecAuto, jsonRecord},
+		{options.CodecAuto, protobufRecord},
+		{"", msgpackRecord},
+	}
+	for _, tt := range tests {
+		decoded := analytics.AnalyticsRecord{}
+		if err := newCodec(tt.codec)().decode(tt.raw, &decoded); err != nil {
+			t.Fatalf("%s codec failed to decode %q: %v", tt.codec, tt.raw, err)
+		}
+		if decoded.TimeStamp != 42 || decoded.Username != "colin" || decoded.Effect != "allow" ||
+			!decoded.ExpireAt.Equal(expireAt) {
+			t.Fatalf("%s codec decoded %+v", tt.codec, decoded)
+		}
+	}
+
+	decoded := analytics.AnalyticsRecord{}
+	_ = newCodec(options.CodecProtobuf)().decode(protobufRecord, &decoded)
+	if decoded.Extra["region"] != "eu" {
+		t.Fatalf("the extra fields should be decoded, got %v", decoded.Extra)
+	}
+
+	if err := newCodec(options.CodecProtobuf)().decode(string(pb[:len(pb)-3]), &decoded); err == nil {
+		t.Fatal("decoding a truncated protobuf record should fail")
+	}
+}
+
+func benchmarkRecords(b *testing.B) []string {
+	b.Helper()
+
+	records := make([]analytics.AnalyticsRecord, 1000)
+	for i := range records {
+		records[i] = analytics.AnalyticsRecord{
+			TimeStamp: int64(i),
+			Username:  "colin",
+			Effect:    "allow",
+			Request:   `{"subject":"users:colin","action":"delete","resource":"resources:articles:ladon-introduction"}`,
+			Policies:  `[{"id":"1","effect":"allow"}]`,
+		}
+	}
+
+	return encodeRecords(b, records...)
+}
+
+func BenchmarkDecodeUnmarshal(b *testing.B) {
+	raws := benchmarkRecords(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for _, raw := range raws {
+			decoded := analytics.AnalyticsRecord{}
+			_ = msgpack.Unmarshal([]byte(raw), &decoded)
+		}
+	}
+}
+
+func BenchmarkDecodeReuse(b *testing.B) {
+	raws := benchmarkRecords(b)
+	decoder := newRecordDecoder()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for _, raw := range raws {
+			decoded := analytics.AnalyticsRecord{}
+			_ = decoder.decode(raw, &decoded)
+		}
+	}
+}
+
+func BenchmarkDecodeWorkers(b *testing.B) {
+	raws := benchmarkRecords(b)
+	values := make([]interface{}, 0, len(raws))
+	for _, raw := range raws {
+		values = append(values, raw)
+	}
+	prepare := func(string, *analytics.AnalyticsRecord) {}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				decodeValues(values, newCodec(options.CodecMsgpack), workers, 100, prepare)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+)
+
+// defaultDedupFields are the fields identifying a duplicate record when none is configured.
+var defaultDedupFields = []string{"username", "resource", "action"}
+
+// deduplicator drops the records identical to a record already shipped in the same timestamp
+// bucket, e.g. the records of an authorization the authz-server retried. Records are identical
+// when the key fields, read from the record or else from the attributes of its authorization
+// request, are equal and their timestamps fall in the same bucket of the window. The keys are
+// remembered across purge windows, until their bucket is older than the one preceding the newest
+// bucket seen.
+type deduplicator struct {
+	window int64
+	fields []string
+	seen   map[string]int64
+	newest int64
+}
+
+// newDeduplicator creates the deduplicator of the pipeline, it returns nil when the window is not
+// positive.
+func newDeduplicator(window time.Duration, fields []string) *deduplicator {
+	seconds := int64(window / time.Second)
+	if seconds <= 0 {
+		return nil
+	}
+
+	if len(fields) == 0 {
+		fields = defaultDedupFields
+	}
+
+	return &deduplicator{window: seconds, fields: fields, seen: make(map[string]int64)}
+}
+
+// dedup returns the records without the duplicates of the records already seen.
+func (d *deduplicator) dedup(keys []interface{}) []interface{} {
+	if d == nil || len(keys) == 0 {
+		return keys
+	}
+
+	deduped := keys[:0:0]
+	for _, key := range keys {
+		record, ok := key.(analytics.AnalyticsRecord)
+		if !ok {
+			deduped = append(deduped, key)
+
+			continue
+		}
+
+		bucket := record.TimeStamp / d.window
+		current := d.key(&record, bucket)
+		if _, ok := d.seen[current]; ok {
+			continue
+		}
+
+		d.seen[current] = bucket
+		if bucket > d.newest {
+			d.newest = bucket
+		}
+		deduped = append(deduped, key)
+	}
+
+	for key, bucket := range d.seen {
+		if bucket < d.newest-1 {
+			delete(d.seen, key)
+		}
+	}
+
+	metrics.DuplicateRecords.Add(float64(len(keys) - len(deduped)))
+
+	return deduped
+}
+
+// key returns the timestamp bucket and the values of the key fields of the record.
+func (d *deduplicator) key(record *analytics.AnalyticsRecord, bucket int64) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%d\x00", bucket)
+
+	var request map[string]interface{}
+	for _, field := range d.fields {
+		value, ok := record.FieldValue(field)
+		if !ok {
+			if request == nil {
+				request = make(map[string]interface{})
+				_ = json.Unmarshal([]byte(record.Request), &request)
+			}
+			value = request[field]
+		}
+		fmt.Fprintf(&key, "%v\x00", value)
+	}
+
+	return key.String()
+}
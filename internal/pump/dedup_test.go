@@ -0,0 +1,45 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestDedup(t *testing.T) {
+	authorized := func(timestamp int64, username, resource string) analytics.AnalyticsRecord {
+		return analytics.AnalyticsRecord{
+			TimeStamp: timestamp,
+			Username:  username,
+			Request:   `{"resource":"` + resource + `","action":"get"}`,
+		}
+	}
+
+	d := newDeduplicator(10*time.Second, nil)
+	deduped := d.dedup([]interface{}{
+		authorized(100, "colin", "articles"), authorized(105, "colin", "articles"),
+		authorized(105, "colin", "books"),
+		authorized(110, "colin", "articles"),
+	})
+	if len(deduped) != 3 {
+		t.Fatalf("the retries of the same bucket should be dropped, got %d records", len(deduped))
+	}
+
+	if deduped = d.dedup([]interface{}{authorized(109, "colin", "books")}); len(deduped) != 0 {
+		t.Fatal("the duplicates should be dropped across the purge windows")
+	}
+
+	d.dedup([]interface{}{authorized(130, "james", "articles")})
+	if deduped = d.dedup([]interface{}{authorized(101, "colin", "articles")}); len(deduped) != 1 {
+		t.Fatal("the keys of the old buckets should be forgotten")
+	}
+
+	if newDeduplicator(0, nil) != nil {
+		t.Fatal("the deduplication should be disabled without a window")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// diagnostics is the snapshot of the runtime state of iam-pump logged on the diagnostics signal,
+// to troubleshoot a stuck or slow instance without restarting it.
+type diagnostics struct {
+	Time       time.Time         `json:"time"`
+	Goroutines int               `json:"goroutines"`
+	Backlog    *int64            `json:"backlog,omitempty"`
+	Window     *time.Time        `json:"window,omitempty"`
+	Paused     bool              `json:"paused"`
+	Halted     bool              `json:"halted"`
+	Stats      statsSnapshot     `json:"stats"`
+	Pumps      []pumpDiagnostics `json:"pumps"`
+}
+
+// pumpDiagnostics is the runtime state of a pump.
+type pumpDiagnostics struct {
+	Pump        string       `json:"pump"`
+	Writing     bool         `json:"writing"`
+	StuckSince  *time.Time   `json:"stuckSince,omitempty"`
+	LastWrite   *time.Time   `json:"lastWrite,omitempty"`
+	LastError   string       `json:"lastError,omitempty"`
+	LastErrorAt *time.Time   `json:"lastErrorAt,omitempty"`
+	Queued      *int         `json:"queued,omitempty"`
+	Written     int64        `json:"written"`
+	Breaker     breakerState `json:"breaker"`
+}
+
+// wrote records the outcome of a write of records which reached the pump.
+func (p *pumpInstance) wrote(records int, err error, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.lastError, p.lastErrorAt = err.Error(), now
+
+		return
+	}
+	p.lastWrite = now
+	p.written += int64(records)
+}
+
+// diagnostics returns the runtime state of the pump.
+func (p *pumpInstance) diagnostics() pumpDiagnostics {
+	p.mu.Lock()
+	state := pumpDiagnostics{Pump: p.name, Writing: p.writing, LastError: p.lastError, Written: p.written}
+	state.StuckSince = timeOrNil(p.abandoned)
+	state.LastWrite = timeOrNil(p.lastWrite)
+	state.LastErrorAt = timeOrNil(p.lastErrorAt)
+	p.mu.Unlock()
+
+	if p.queue != nil {
+		p.queue.mu.Lock()
+		queued := len(p.queue.records)
+		p.queue.mu.Unlock()
+		state.Queued = &queued
+	}
+	state.Breaker = p.breaker.snapshot(p.name)
+
+	return state
+}
+
+// diagnostics returns the runtime state of the server. The backlog is the number of records left
+// in the analytics storage, when the storage can count them.
+func (s *pumpServer) diagnostics() diagnostics {
+	snapshot := diagnostics{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		Paused:     s.isPaused(),
+		Halted:     s.decodeErrors.isHalted(),
+		Stats:      stats.snapshot(),
+	}
+
+	if chunked, ok := s.analyticsStore.(storage.ChunkedAnalyticsStorage); ok {
+		backlog := chunked.GetSetLength(storage.AnalyticsKeyName)
+		snapshot.Backlog = &backlog
+	}
+
+	if start := atomic.LoadInt64(&s.windowStart); start != 0 {
+		window := time.Unix(0, start)
+		snapshot.Window = &window
+	}
+
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+
+	snapshot.Pumps = make([]pumpDiagnostics, 0, len(s.pmps))
+	for _, pmp := range s.pmps {
+		snapshot.Pumps = append(snapshot.Pumps, pmp.diagnostics())
+	}
+
+	return snapshot
+}
+
+// dumpDiagnostics logs the runtime state of the server.
+func (s *pumpServer) dumpDiagnostics() {
+	data, err := json.Marshal(s.diagnostics())
+	if err != nil {
+		log.Errorf("Failed to serialize the runtime diagnostics: %s", err.Error())
+
+		return
+	}
+
+	log.Infof("Runtime diagnostics: %s", data)
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestDiagnostics(t *testing.T) {
+	flaky := &flakyPump{failures: 1, err: errors.New("backend unavailable")}
+	pmp := &pumpInstance{Pump: flaky, name: "flaky", breaker: newCircuitBreaker(5, time.Hour)}
+	queued := &pumpInstance{Pump: &mockPump{}, name: "queued", queue: &pumpQueue{records: make([]interface{}, 3)}}
+	s := &pumpServer{
+		analyticsStore: &chunkedStore{values: make([]interface{}, 7)},
+		pmps:           []*pumpInstance{pmp, queued},
+	}
+	keys := []interface{}{analytics.AnalyticsRecord{}}
+
+	_ = writePump(context.Background(), pmp, &keys, 1)
+	snapshot := s.diagnostics()
+	if snapshot.Backlog == nil || *snapshot.Backlog != 7 || snapshot.Goroutines == 0 || snapshot.Window != nil {
+		t.Fatalf("unexpected diagnostics: %+v", snapshot)
+	}
+
+	state := snapshot.Pumps[0]
+	if state.LastError != "backend unavailable" || state.LastErrorAt == nil || state.LastWrite != nil {
+		t.Fatalf("the failed write should be reported, got %+v", state)
+	}
+	if state.Breaker.State != breakerClosed || state.Breaker.Failures != 1 || state.Queued != nil {
+		t.Fatalf("unexpected breaker state: %+v", state)
+	}
+	if queued := snapshot.Pumps[1]; queued.Queued == nil || *queued.Queued != 3 || queued.Breaker.State != breakerDisabled {
+		t.Fatalf("the queued records should be reported, got %+v", queued)
+	}
+
+	_ = writePump(context.Background(), pmp, &keys, 1)
+	if state := pmp.diagnostics(); state.LastWrite == nil || state.LastError == "" || state.Writing {
+		t.Fatalf("the last write and error should both be kept, got %+v", state)
+	}
+}
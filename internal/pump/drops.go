@@ -0,0 +1,141 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the reasons why records are not written to a pump.
+const (
+	dropReasonFilter   = "filter"
+	dropReasonHook     = "hook"
+	dropReasonStuck    = "stuck"
+	dropReasonAbort    = "abort"
+	dropReasonFields   = "missing-fields"
+	dropReasonQueue    = "queue-full"
+	dropReasonSample   = "sampled"
+	dropReasonStale    = "stale"
+	dropReasonOversize = "oversized"
+	dropReasonUnrouted = "unrouted"
+)
+
+// Defines the extra fields set on the sampled dropped records.
+const (
+	dropReasonField = "drop_reason"
+	droppedByField  = "dropped_by"
+)
+
+// maxDropSamples bounds the number of dropped records sampled per purge window.
+const maxDropSamples = 100
+
+// dropSampler forwards a sampled fraction of the records dropped by the pumps, annotated with the
+// reason of the drop, to a sink pump, or logs them when no sink is configured. It lets operators
+// spot-check what the filters drop while tuning them.
+type dropSampler struct {
+	rate float64
+	sink *pumpInstance
+
+	mu      sync.Mutex
+	samples []interface{}
+}
+
+// setDropSink moves the pump configured as the sink of the dropped record samples out of the
+// pumps written by the purge loop, so that it only receives the samples.
+func (s *pumpServer) setDropSink() error {
+	if s.drops == nil || s.dropSamplePump == "" {
+		return nil
+	}
+
+	for i, pmp := range s.pmps {
+		if pmp.name == s.dropSamplePump {
+			s.drops.sink = pmp
+			s.pmps = append(s.pmps[:i], s.pmps[i+1:]...)
+			log.Infof("Pump %s receives the dropped record samples", pmp.name)
+
+			return nil
+		}
+	}
+
+	if s.strict {
+		return errors.Errorf("drop sample pump %s could not be initialized", s.dropSamplePump)
+	}
+	log.Warnf("Drop sample pump %s could not be initialized, logging the dropped record samples", s.dropSamplePump)
+
+	return nil
+}
+
+// sample keeps each record dropped by the pump with the probability of the sampling rate.
+func (d *dropSampler) sample(pump, reason string, records ...interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range records {
+		if len(d.samples) >= maxDropSamples {
+			return
+		}
+
+		record, ok := key.(analytics.AnalyticsRecord)
+		if !ok || rand.Float64() >= d.rate { //nolint: gosec // sampling does not need a secure source
+			continue
+		}
+
+		// the extra fields are shared by the copies of the record written to the other pumps
+		extra := make(map[string]interface{}, len(record.Extra)+2)
+		for name, value := range record.Extra {
+			extra[name] = value
+		}
+		extra[dropReasonField] = reason
+		extra[droppedByField] = pump
+		record.Extra = extra
+
+		d.samples = append(d.samples, record)
+	}
+}
+
+// flush writes the records sampled during the purge window to the sink.
+func (d *dropSampler) flush(timeout time.Duration) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	samples := d.samples
+	d.samples = nil
+	d.mu.Unlock()
+
+	if len(samples) == 0 {
+		return
+	}
+
+	if d.sink == nil {
+		for _, sample := range samples {
+			data, _ := json.Marshal(sample)
+			log.Infof("Dropped record sample: %s", data)
+		}
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := d.sink.write(ctx, samples); err != nil {
+		log.Warnf("Failed to write %d dropped record samples to %s: %s", len(samples), d.sink.name, err.Error())
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestDropSamples(t *testing.T) {
+	sink := &mockPump{}
+	filtered := &mockPump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{SkippedUsernames: []string{"admin"}})
+
+	drops := &dropSampler{rate: 1, sink: &pumpInstance{Pump: sink, name: "debug"}}
+	s := &pumpServer{
+		secInterval: 1,
+		drops:       drops,
+		pmps:        []*pumpInstance{{Pump: filtered, name: "filtered", drops: drops}},
+	}
+
+	admin := analytics.AnalyticsRecord{Username: "admin"}
+	admin.SetExtra("hostname", "pump-0")
+	s.writeToPumps(context.Background(), []interface{}{admin, analytics.AnalyticsRecord{Username: "colin"}})
+
+	samples := sink.records()
+	if len(samples) != 1 {
+		t.Fatalf("the filtered record should be sampled, got %v", samples)
+	}
+
+	sample, _ := samples[0].(analytics.AnalyticsRecord)
+	if sample.Username != "admin" || sample.Extra[dropReasonField] != dropReasonFilter ||
+		sample.Extra[droppedByField] != "filtered" || sample.Extra["hostname"] != "pump-0" {
+		t.Fatalf("the sample should carry the reason of the drop, got %+v", sample)
+	}
+
+	if _, ok := admin.Extra[dropReasonField]; ok {
+		t.Fatal("the extra fields of the dropped record should not be modified")
+	}
+
+	many := make([]interface{}, 2*maxDropSamples)
+	for i := range many {
+		many[i] = admin
+	}
+	drops.sample("filtered", dropReasonFilter, many...)
+	if len(drops.samples) != maxDropSamples {
+		t.Fatalf("the samples of a window should be bounded, got %d", len(drops.samples))
+	}
+
+	var none *dropSampler
+	none.sample("filtered", dropReasonFilter, admin)
+	none.flush(0)
+}
+
+func TestDropSamplesStaleOversized(t *testing.T) {
+	sink := &mockPump{}
+	mock := &mockPump{}
+	drops := &dropSampler{rate: 1, sink: &pumpInstance{Pump: sink, name: "debug"}}
+	s := &pumpServer{
+		secInterval: 1,
+		drops:       drops,
+		pmps: []*pumpInstance{{
+			Pump: mock, name: "limited", drops: drops, maxRecordAge: time.Hour, maxRecordSize: 200,
+		}},
+	}
+
+	now := time.Now().Unix()
+	s.writeToPumps(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: now, Username: "colin"},
+		analytics.AnalyticsRecord{TimeStamp: now - 7200, Username: "stale"},
+		analytics.AnalyticsRecord{TimeStamp: now, Username: "oversized", Request: strings.Repeat("a", 200)},
+	})
+
+	if got := len(mock.records()); got != 1 {
+		t.Fatalf("the stale and oversized records should be dropped, got %d records", got)
+	}
+
+	reasons := make(map[string]interface{})
+	for _, sample := range sink.records() {
+		record, _ := sample.(analytics.AnalyticsRecord)
+		reasons[record.Username] = record.Extra[dropReasonField]
+	}
+	if reasons["stale"] != dropReasonStale || reasons["oversized"] != dropReasonOversize {
+		t.Fatalf("the samples should carry the stale and oversized reasons, got %v", reasons)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"io"
+
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/enrichers"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// newEnrichers creates and initializes the enrichers configured, the records are annotated by
+// them in their order.
+func newEnrichers(configs []options.EnricherConfig) ([]enrichers.Enricher, error) {
+	initialized := make([]enrichers.Enricher, 0, len(configs))
+	for i, config := range configs {
+		enricher, err := enrichers.GetEnricherByName(config.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid enricher %d", i)
+		}
+
+		if err := enricher.Init(config.Meta); err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize the %s enricher", config.Type)
+		}
+		initialized = append(initialized, enricher)
+	}
+
+	return initialized, nil
+}
+
+// closeEnrichers releases the resources of the enrichers, e.g. their databases.
+func (s *pumpServer) closeEnrichers() {
+	for _, enricher := range s.enrichers {
+		if closer, ok := enricher.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Errorf("could not close the %s enricher. err: %v", enricher.GetName(), err)
+			}
+		}
+	}
+}
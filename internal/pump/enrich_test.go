@@ -0,0 +1,34 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func TestEnrichers(t *testing.T) {
+	configured, err := newEnrichers([]options.EnricherConfig{
+		{Type: "user-agent", Meta: map[string]interface{}{"user_agent_field": "agent", "field": "client"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &pumpServer{enrichers: configured}
+	record := &analytics.AnalyticsRecord{Request: `{"context":{"agent":"curl/7.79.1"}}`}
+	s.transform(record)
+
+	client, ok := record.Extra["client"].(map[string]interface{})
+	if !ok || client["browser"] != "curl" {
+		t.Fatalf("the record should be enriched before it is written, got %v", record.Extra)
+	}
+
+	if _, err := newEnrichers([]options.EnricherConfig{{Type: "missing"}}); err == nil {
+		t.Fatal("an unknown enricher should be rejected")
+	}
+}
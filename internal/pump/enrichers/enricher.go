@@ -0,0 +1,106 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package enrichers defines the enrichers which annotate the analytics records before they are
+// written to the pumps.
+package enrichers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// Enricher annotates the analytics records read from the analytics storage, once decoded and
+// before they are written to the pumps. Enrich is called concurrently when the records are decoded
+// by several workers.
+type Enricher interface {
+	GetName() string
+	Init(config interface{}) error
+	Enrich(record *analytics.AnalyticsRecord)
+}
+
+// Factory creates an enricher, each enricher configured gets its own instance.
+type Factory func() Enricher
+
+var (
+	enrichersMu        sync.RWMutex
+	availableEnrichers = map[string]Factory{
+		"geoip":      func() Enricher { return &GeoIPEnricher{} },
+		"user-agent": func() Enricher { return &UserAgentEnricher{} },
+	}
+)
+
+// Register registers a named enricher, which can then be referenced by the type of an enricher in
+// the `enrichers` configuration. Enrichers are plain go code compiled into iam-pump.
+func Register(name string, factory Factory) error {
+	if name == "" || factory == nil {
+		return errors.New("enricher needs a name and a factory")
+	}
+
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+
+	if _, ok := availableEnrichers[name]; ok {
+		return errors.New("enricher " + name + " already registered")
+	}
+
+	availableEnrichers[name] = factory
+
+	return nil
+}
+
+// GetEnricherByName returns a new instance of the enricher registered with the given name.
+func GetEnricherByName(name string) (Enricher, error) {
+	enrichersMu.RLock()
+	defer enrichersMu.RUnlock()
+
+	if factory, ok := availableEnrichers[name]; ok {
+		return factory(), nil
+	}
+
+	return nil, errors.New("enricher " + name + " Not found")
+}
+
+// attributeValue returns the value of the record field or extra field name, or else of the
+// attribute name of the authorization request or of its context, e.g. its remoteIPAddress.
+func attributeValue(record *analytics.AnalyticsRecord, name string) string {
+	if value, ok := record.FieldValue(name); ok && value != nil {
+		return fmt.Sprint(value)
+	}
+
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(record.Request), &request); err != nil {
+		return ""
+	}
+
+	value, ok := request[name]
+	if !ok {
+		if attributes, isMap := request["context"].(map[string]interface{}); isMap {
+			value, ok = attributes[name]
+		}
+	}
+	if !ok || value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+// checkField verifies that the extra field an enricher writes does not shadow a record field.
+func checkField(enricher, field string) error {
+	if field == "" {
+		return fmt.Errorf("the field of the %s enricher must be set", enricher)
+	}
+
+	if analytics.IsRecordField(field) {
+		return fmt.Errorf("the field %s of the %s enricher is a record field", field, enricher)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package enrichers
+
+import (
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+type tagEnricher struct{}
+
+func (t *tagEnricher) GetName() string                          { return "tag" }
+func (t *tagEnricher) Init(interface{}) error                   { return nil }
+func (t *tagEnricher) Enrich(record *analytics.AnalyticsRecord) { record.SetExtra("tag", true) }
+
+func TestRegister(t *testing.T) {
+	if err := Register("tag", func() Enricher { return &tagEnricher{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Register("tag", func() Enricher { return &tagEnricher{} }); err == nil {
+		t.Fatal("an enricher should not be registered twice")
+	}
+
+	enricher, err := GetEnricherByName("tag")
+	if err != nil || enricher.GetName() != "tag" {
+		t.Fatalf("the registered enricher should be returned, got %v %v", enricher, err)
+	}
+
+	if _, err := GetEnricherByName("missing"); err == nil {
+		t.Fatal("an unknown enricher should be rejected")
+	}
+}
+
+func TestUserAgentEnricher(t *testing.T) {
+	u := &UserAgentEnricher{}
+	if err := u.Init(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	record := &analytics.AnalyticsRecord{
+		Request: `{"resource":"resources:articles","context":{"userAgent":"Mozilla/5.0 (X11; Linux x86_64) ` +
+			`AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36"}}`,
+	}
+	u.Enrich(record)
+
+	parsed, ok := record.Extra["user_agent"].(map[string]interface{})
+	if !ok || parsed["browser"] != "Chrome" || parsed["browser_version"] != "96.0.4664.45" || parsed["mobile"] != false {
+		t.Fatalf("the user agent of the request context should be parsed, got %v", record.Extra)
+	}
+
+	record = &analytics.AnalyticsRecord{Request: `{"resource":"resources:articles"}`}
+	u.Enrich(record)
+	if record.Extra != nil {
+		t.Fatalf("a record without user agent should be left as is, got %v", record.Extra)
+	}
+
+	if err := u.Init(map[string]interface{}{"field": "username"}); err == nil {
+		t.Fatal("a field shadowing a record field should be rejected")
+	}
+}
+
+func TestGeoIPEnricherInit(t *testing.T) {
+	if err := (&GeoIPEnricher{}).Init(map[string]interface{}{}); err == nil {
+		t.Fatal("the database should be required")
+	}
+
+	if err := (&GeoIPEnricher{}).Init(map[string]interface{}{"database": "/nonexistent/GeoLite2-City.mmdb"}); err == nil {
+		t.Fatal("a missing database should be rejected")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package enrichers
+
+import (
+	"net"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/oschwald/geoip2-golang"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// GeoIPEnricher attaches the location of the client ip of the records, looked up in a MaxMind
+// database, e.g. GeoLite2-City.mmdb.
+type GeoIPEnricher struct {
+	conf *GeoIPConf
+	db   *geoip2.Reader
+}
+
+// GeoIPConf defines the configuration of the geoip enricher.
+type GeoIPConf struct {
+	// Database is the path of the MaxMind city or country database.
+	Database string `mapstructure:"database"`
+	// IPField is the field, or request attribute, holding the client ip, remoteIPAddress by default.
+	IPField string `mapstructure:"ip_field"`
+	// Field is the extra field the location is attached to, geo by default.
+	Field string `mapstructure:"field"`
+}
+
+// GetName returns the geoip enricher name.
+func (g *GeoIPEnricher) GetName() string {
+	return "geoip"
+}
+
+// Init opens the MaxMind database of the geoip enricher.
+func (g *GeoIPEnricher) Init(config interface{}) error {
+	g.conf = &GeoIPConf{IPField: "remoteIPAddress", Field: "geo"}
+	if err := mapstructure.Decode(config, g.conf); err != nil {
+		return errors.Wrap(err, "failed to decode geoip enricher configuration")
+	}
+
+	if err := checkField(g.GetName(), g.conf.Field); err != nil {
+		return err
+	}
+
+	if g.conf.Database == "" {
+		return errors.New("the database of the geoip enricher must be set")
+	}
+
+	db, err := geoip2.Open(g.conf.Database)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the geoip database %s", g.conf.Database)
+	}
+	g.db = db
+
+	log.Infof("Enriching the records with the location of their %s from %s", g.conf.IPField, g.conf.Database)
+
+	return nil
+}
+
+// Enrich attaches the country, city and coordinates of the client ip of the record, the records
+// without a client ip known by the database are left as is.
+func (g *GeoIPEnricher) Enrich(record *analytics.AnalyticsRecord) {
+	value := attributeValue(record, g.conf.IPField)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return
+	}
+
+	city, err := g.db.City(ip)
+	if err != nil {
+		log.Debugf("Failed to look up the location of %s: %s", value, err.Error())
+
+		return
+	}
+
+	location := map[string]interface{}{}
+	if city.Country.IsoCode != "" {
+		location["country"] = city.Country.IsoCode
+	}
+	if name := city.City.Names["en"]; name != "" {
+		location["city"] = name
+	}
+	if city.Location.Latitude != 0 || city.Location.Longitude != 0 {
+		location["latitude"] = city.Location.Latitude
+		location["longitude"] = city.Location.Longitude
+	}
+	if len(location) == 0 {
+		return
+	}
+
+	record.SetExtra(g.conf.Field, location)
+}
+
+// Close closes the MaxMind database.
+func (g *GeoIPEnricher) Close() error {
+	if g.db == nil {
+		return nil
+	}
+
+	return g.db.Close()
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package enrichers
+
+import (
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/mssola/user_agent"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// UserAgentEnricher attaches the browser, operating system and device of the user agent of the
+// records.
+type UserAgentEnricher struct {
+	conf *UserAgentConf
+}
+
+// UserAgentConf defines the configuration of the user-agent enricher.
+type UserAgentConf struct {
+	// UserAgentField is the field, or request attribute, holding the user agent, userAgent by default.
+	UserAgentField string `mapstructure:"user_agent_field"`
+	// Field is the extra field the parsed user agent is attached to, user_agent by default.
+	Field string `mapstructure:"field"`
+}
+
+// GetName returns the user-agent enricher name.
+func (u *UserAgentEnricher) GetName() string {
+	return "user-agent"
+}
+
+// Init initializes the user-agent enricher.
+func (u *UserAgentEnricher) Init(config interface{}) error {
+	u.conf = &UserAgentConf{UserAgentField: "userAgent", Field: "user_agent"}
+	if err := mapstructure.Decode(config, u.conf); err != nil {
+		return errors.Wrap(err, "failed to decode user-agent enricher configuration")
+	}
+
+	return checkField(u.GetName(), u.conf.Field)
+}
+
+// Enrich attaches the parsed user agent of the record, the records without a user agent are left
+// as is.
+func (u *UserAgentEnricher) Enrich(record *analytics.AnalyticsRecord) {
+	value := attributeValue(record, u.conf.UserAgentField)
+	if value == "" {
+		return
+	}
+
+	ua := user_agent.New(value)
+	browser, version := ua.Browser()
+	record.SetExtra(u.conf.Field, map[string]interface{}{
+		"browser":         browser,
+		"browser_version": version,
+		"os":              ua.OS(),
+		"platform":        ua.Platform(),
+		"mobile":          ua.Mobile(),
+		"bot":             ua.Bot(),
+	})
+}
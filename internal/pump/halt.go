@@ -0,0 +1,77 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"sync/atomic"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// decodeGuard halts the purge loop when the analytics records read fail to decode in a fraction
+// of at least threshold for windows consecutive purge windows. A flood of decode errors usually
+// means the producer changed the format of the records, draining them would silently drop
+// everything: once halted, the records are left in the analytics storage until iam-pump is fixed
+// and restarted. The undecodable values of the failing windows are held meanwhile, they are put
+// back in the storage by the window halting the loop.
+type decodeGuard struct {
+	threshold   float64
+	windows     int
+	failing     int
+	undecodable [][]interface{}
+	halted      int32
+}
+
+// newDecodeGuard creates the guard of the purge loop, it returns nil when threshold is 0.
+func newDecodeGuard(threshold float64, windows int) *decodeGuard {
+	if threshold <= 0 {
+		return nil
+	}
+
+	if windows <= 0 {
+		windows = 1
+	}
+
+	return &decodeGuard{threshold: threshold, windows: windows}
+}
+
+// observe accounts the undecodable values of the total records read in a purge window. When the
+// window halts the loop, the undecodable values of the failing windows are returned, by window, so
+// that they are put back in the storage before the window is acknowledged.
+func (g *decodeGuard) observe(undecodable []interface{}, total int) [][]interface{} {
+	if g == nil || total == 0 {
+		return nil
+	}
+
+	rate := float64(len(undecodable)) / float64(total)
+	if rate < g.threshold {
+		g.failing = 0
+		g.undecodable = nil
+
+		return nil
+	}
+
+	g.failing++
+	g.undecodable = append(g.undecodable, undecodable)
+	log.Warnf("%d of the %d records read failed to decode (%d/%d failing windows)",
+		len(undecodable), total, g.failing, g.windows)
+	if g.failing < g.windows || !atomic.CompareAndSwapInt32(&g.halted, 0, 1) {
+		return nil
+	}
+
+	log.Errorf("Halting the purge loop: the records failed to decode from %.0f%% for %d consecutive windows, "+
+		"the analytics data is left in redis until iam-pump is restarted", g.threshold*100, g.failing)
+	metrics.Halted.Set(1)
+	held := g.undecodable
+	g.undecodable = nil
+
+	return held
+}
+
+// isHalted reports whether the purge loop is halted on decode errors.
+func (g *decodeGuard) isHalted() bool {
+	return g != nil && atomic.LoadInt32(&g.halted) == 1
+}
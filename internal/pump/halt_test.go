@@ -0,0 +1,84 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestDecodeErrorsHaltDrain(t *testing.T) {
+	valid, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+
+	s := &pumpServer{
+		secInterval:  1,
+		decodeErrors: newDecodeGuard(0.5, 2),
+		pmps:         []*pumpInstance{{Pump: &mockPump{}, name: "mock"}},
+	}
+
+	s.process(context.Background(), []interface{}{"garbage", "garbage", string(valid)})
+	s.process(context.Background(), []interface{}{string(valid)})
+	s.process(context.Background(), []interface{}{"garbage", string(valid), string(valid)})
+	if s.decodeErrors.isHalted() {
+		t.Fatal("the loop should only halt after consecutive windows above the threshold")
+	}
+
+	// a backlog drained in chunks of 2 records, each chunk is a window
+	garbage := strings.Repeat("x", defaultRecordSize)
+	store := &chunkedStore{values: []interface{}{garbage, garbage, garbage, garbage, garbage, string(valid)}}
+	s.analyticsStore = store
+	s.memoryBudget = 2 * defaultRecordSize
+	s.recordSize = defaultRecordSize
+	s.drain(context.Background())
+	if !s.decodeErrors.isHalted() {
+		t.Fatal("the loop should halt after 2 consecutive windows above the threshold")
+	}
+
+	if len(store.values) != 2 {
+		t.Fatalf("the records should be left in the storage once halted, got %d left", len(store.values))
+	}
+}
+
+func TestDecodeErrorsHaltRequeue(t *testing.T) {
+	valid, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+
+	// every record failing reaches a threshold of 1
+	store := &requeueingStore{}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		decodeErrors:   newDecodeGuard(1, 2),
+		pmps:           []*pumpInstance{{Pump: &mockPump{}, name: "mock"}},
+	}
+
+	store.values = []interface{}{"first", "second"}
+	s.drain(context.Background())
+	if s.decodeErrors.isHalted() || len(store.values) != 0 {
+		t.Fatalf("the first failing window should not halt the loop, got %d records left", len(store.values))
+	}
+
+	store.values = []interface{}{"third", string(valid)}
+	s.drain(context.Background())
+	if s.decodeErrors.isHalted() {
+		t.Fatal("a window below the threshold should reset the failing windows")
+	}
+
+	store.values = []interface{}{"fourth"}
+	s.drain(context.Background())
+	store.values = []interface{}{"fifth"}
+	s.drain(context.Background())
+	if !s.decodeErrors.isHalted() {
+		t.Fatal("the loop should halt after 2 consecutive failing windows")
+	}
+
+	if len(store.values) != 2 || store.values[0] != "fourth" || store.values[1] != "fifth" {
+		t.Fatalf("the undecodable records of the failing windows should be put back, got %v", store.values)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"net/http"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the overall status reported by the health check.
+const (
+	// healthOK means every pump writes and the sources are reachable.
+	healthOK = "ok"
+	// healthPaused means the purge loop is paused by the maintenance switch.
+	healthPaused = "paused"
+	// healthDegraded means a pump is stuck or its breaker is open, the other pumps still write.
+	healthDegraded = "degraded"
+	// healthUnavailable means a source can not be reached.
+	healthUnavailable = "unavailable"
+	// healthHalted means the purge loop is halted by the decode errors.
+	healthHalted = "halted"
+)
+
+// health is the response of the health check.
+type health struct {
+	Status  string            `json:"status"`
+	Sources []sourceHealth    `json:"sources"`
+	Pumps   []pumpDiagnostics `json:"pumps"`
+}
+
+// sourceHealth is the connectivity of a source, Connected is omitted when the storage of the
+// source can not check it.
+type sourceHealth struct {
+	Source    string `json:"source"`
+	Storage   string `json:"storage"`
+	Connected *bool  `json:"connected,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// serveHealthCheck runs a http server used to provide apis to check pump health status, to serve
+// the control api and to expose the pump operational metrics.
+func (s *pumpServer) serveHealthCheck(healthPath string, healthAddress string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+healthPath, s.serveHealth)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/config", s.control(s.serveConfig))
+	mux.HandleFunc("/stats", s.control(s.serveStats))
+	mux.HandleFunc("/breakers", s.control(s.serveBreakers))
+	mux.HandleFunc("/breakers/", s.control(s.resetBreaker))
+
+	if err := http.ListenAndServe(healthAddress, mux); err != nil {
+		log.Fatalf("Error serving health check endpoint: %s", err.Error())
+	}
+}
+
+// serveHealth reports the state of the pumps and the connectivity of the sources. It answers 503
+// when the purge loop is halted or a source can not be reached, so that the instance is taken out
+// of rotation by a readiness probe, and 200 otherwise, a degraded pump not preventing the others
+// from writing. The errors, which may hold the addresses of the backends, are only reported to the
+// requests carrying the control token.
+func (s *pumpServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	state := s.health(s.controlToken != "" && s.authorized(r))
+
+	code := http.StatusOK
+	if state.Status == healthHalted || state.Status == healthUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+// health returns the state of the pumps and of the sources, along with the overall status, with
+// their errors when detailed. It reads the pumps last initialized, a reload in progress does not
+// delay it.
+func (s *pumpServer) health(detailed bool) health {
+	state := health{Status: healthOK}
+
+	for _, src := range append([]*analyticsSource{s.primarySource()}, s.sources...) {
+		source := sourceHealth{Source: src.name, Storage: src.store.GetName()}
+		if pinging, ok := src.store.(storage.PingingStorage); ok {
+			err := pinging.Ping()
+			connected := err == nil
+			source.Connected = &connected
+			if err != nil {
+				if detailed {
+					source.Error = err.Error()
+				}
+				state.Status = healthUnavailable
+			}
+		}
+		state.Sources = append(state.Sources, source)
+	}
+
+	pmps := s.publishedPumps()
+	state.Pumps = make([]pumpDiagnostics, 0, len(pmps))
+	for _, pmp := range pmps {
+		diagnostics := pmp.diagnostics()
+		if state.Status == healthOK && (diagnostics.StuckSince != nil || diagnostics.Breaker.State == breakerOpen) {
+			state.Status = healthDegraded
+		}
+		if !detailed {
+			diagnostics.LastError = ""
+		}
+		state.Pumps = append(state.Pumps, diagnostics)
+	}
+
+	switch {
+	case s.decodeErrors.isHalted():
+		state.Status = healthHalted
+	case state.Status != healthUnavailable && s.isPaused():
+		state.Status = healthPaused
+	}
+
+	return state
+}
+
+// publishPumps publishes the pumps initialized to the health check.
+func (s *pumpServer) publishPumps() {
+	s.published.Store(s.pmps)
+}
+
+// publishedPumps returns the pumps last initialized.
+func (s *pumpServer) publishedPumps() []*pumpInstance {
+	pmps, _ := s.published.Load().([]*pumpInstance)
+
+	return pmps
+}
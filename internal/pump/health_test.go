@@ -0,0 +1,93 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// pingingStore is a chunked store whose backend is reachable unless err is set.
+type pingingStore struct {
+	chunkedStore
+	err error
+}
+
+func (p *pingingStore) Ping() error { return p.err }
+
+func TestHealth(t *testing.T) {
+	store := &pingingStore{}
+	healthy := &pumpInstance{Pump: &mockPump{}, name: "healthy"}
+	s := &pumpServer{
+		analyticsStore: store,
+		pmps:           []*pumpInstance{healthy},
+		sources:        []*analyticsSource{{name: "other", store: &chunkedStore{}}},
+		controlToken:   "secret",
+	}
+	s.publishPumps()
+
+	keys := []interface{}{analytics.AnalyticsRecord{}, analytics.AnalyticsRecord{}}
+	_ = writePump(context.Background(), healthy, &keys, 1)
+
+	serve := func(token string) (int, health) {
+		request := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		s.serveHealth(recorder, request)
+
+		var state health
+		if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+
+		return recorder.Code, state
+	}
+
+	code, state := serve("")
+	if code != http.StatusOK || state.Status != healthOK || len(state.Sources) != 2 || len(state.Pumps) != 1 {
+		t.Fatalf("a healthy instance should be reported ok, got %d %+v", code, state)
+	}
+	if pmp := state.Pumps[0]; pmp.Written != 2 || pmp.LastWrite == nil {
+		t.Fatalf("the records written by the pump should be reported, got %+v", pmp)
+	}
+	if primary := state.Sources[0]; primary.Connected == nil || !*primary.Connected || state.Sources[1].Connected != nil {
+		t.Fatalf("the connectivity of the sources should be reported when known, got %+v", state.Sources)
+	}
+
+	failing := &pumpInstance{Pump: &failingPump{}, name: "failing", breaker: newCircuitBreaker(1, time.Hour)}
+	s.pmps = append(s.pmps, failing)
+	s.publishPumps()
+	_ = writePump(context.Background(), failing, &keys, 1)
+	if code, state := serve(""); code != http.StatusOK || state.Status != healthDegraded ||
+		state.Pumps[1].LastErrorAt == nil || state.Pumps[1].LastError != "" {
+		t.Fatalf("a pump whose breaker is open should degrade the instance, its error redacted, got %d %+v", code, state)
+	}
+
+	store.err = errors.New("connection refused")
+	if code, state := serve(""); code != http.StatusServiceUnavailable || state.Status != healthUnavailable ||
+		state.Sources[0].Error != "" {
+		t.Fatalf("an unreachable source should make the instance unavailable, got %d %+v", code, state)
+	}
+	if _, state := serve("secret"); state.Sources[0].Error != "connection refused" || state.Pumps[1].LastError == "" {
+		t.Fatalf("the errors should be reported with the control token, got %+v", state)
+	}
+
+	// a reload in progress does not delay the health check
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if code, _ := serve(""); code != http.StatusServiceUnavailable {
+		t.Fatalf("the health check should be served during a reload, got %d", code)
+	}
+}
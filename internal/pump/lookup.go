@@ -0,0 +1,173 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// lookupTable enriches the records with the attributes of the row keyed by the value of their key
+// field. The rows are loaded from a file, and replaced when it is reloaded.
+type lookupTable struct {
+	file     string
+	keyField string
+
+	mu   sync.RWMutex
+	rows map[string]map[string]interface{}
+}
+
+// newLookupTable loads the lookup table of the file, it returns nil when no file is configured.
+func newLookupTable(file string, keyField string) (*lookupTable, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	table := &lookupTable{file: file, keyField: keyField}
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// load reads the rows of the file in place of the current ones.
+func (t *lookupTable) load() error {
+	var rows map[string]map[string]interface{}
+	var err error
+	if strings.EqualFold(filepath.Ext(t.file), ".json") {
+		rows, err = readJSONLookup(t.file)
+	} else {
+		rows, err = readCSVLookup(t.file)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the lookup table %s", t.file)
+	}
+
+	for key, attributes := range rows {
+		for name := range attributes {
+			if analytics.IsRecordField(name) {
+				return fmt.Errorf("the attribute %s of key %s in the lookup table %s is a record field", name, key, t.file)
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.rows = rows
+	t.mu.Unlock()
+	log.Infof("Loaded %d rows of the lookup table %s", len(rows), t.file)
+
+	return nil
+}
+
+// enrich attaches the attributes of the row of the record to its extra fields.
+func (t *lookupTable) enrich(record *analytics.AnalyticsRecord) {
+	if t == nil {
+		return
+	}
+
+	value, ok := record.FieldValue(t.keyField)
+	if !ok || value == nil {
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for name, attribute := range t.rows[fmt.Sprint(value)] {
+		record.SetExtra(name, attribute)
+	}
+}
+
+// attributes returns the names of the attributes of the rows.
+func (t *lookupTable) attributes() []string {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, attributes := range t.rows {
+		for name := range attributes {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// reloadLookup reloads the lookup table from its file. The current rows are kept when the file
+// fails to load.
+func (s *pumpServer) reloadLookup() {
+	if s.lookup == nil {
+		return
+	}
+
+	if err := s.lookup.load(); err != nil {
+		log.Errorf("Failed to reload the lookup table, keeping the current rows: %s", err.Error())
+	}
+}
+
+// readCSVLookup reads the rows of a csv file whose header names the columns, the first column
+// holding the keys.
+func readCSVLookup(file string) (map[string]map[string]interface{}, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 || len(lines[0]) < 2 {
+		return nil, errors.New("the header must name the key column and at least one attribute")
+	}
+
+	header := lines[0]
+	rows := make(map[string]map[string]interface{}, len(lines)-1)
+	for _, line := range lines[1:] {
+		attributes := make(map[string]interface{}, len(header)-1)
+		for i, name := range header[1:] {
+			attributes[name] = line[i+1]
+		}
+		rows[line[0]] = attributes
+	}
+
+	return rows, nil
+}
+
+// readJSONLookup reads the rows of a json file holding an object of the attributes by key.
+func readJSONLookup(file string) (map[string]map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestLookupTable(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.csv")
+	if err := os.WriteFile(file, []byte("username,client,team\nadmin,console,platform\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := newLookupTable(file, "username")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := &pumpServer{lookup: table}
+
+	record := analytics.AnalyticsRecord{Username: "admin"}
+	s.transform(&record)
+	if record.Extra["client"] != "console" || record.Extra["team"] != "platform" {
+		t.Fatalf("the attributes of the row should be attached, got %v", record.Extra)
+	}
+
+	unknown := analytics.AnalyticsRecord{Username: "guest"}
+	s.transform(&unknown)
+	if unknown.Extra != nil {
+		t.Fatalf("a record without a row should not be enriched, got %v", unknown.Extra)
+	}
+
+	// a table failing to reload keeps the current rows
+	if err := os.WriteFile(file, []byte("username,effect\nadmin,allow\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadLookup()
+	record = analytics.AnalyticsRecord{Username: "admin"}
+	s.transform(&record)
+	if record.Extra["client"] != "console" {
+		t.Fatalf("the rows should be kept when the reload fails, got %v", record.Extra)
+	}
+
+	if err := os.WriteFile(file, []byte("username,client\nadmin,cli\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadLookup()
+	record = analytics.AnalyticsRecord{Username: "admin"}
+	s.transform(&record)
+	if record.Extra["client"] != "cli" || record.Extra["team"] != nil {
+		t.Fatalf("the reloaded rows should replace the previous ones, got %v", record.Extra)
+	}
+}
+
+func TestLookupTableJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(file, []byte(`{"console": {"tier": 2, "owner": "platform"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := newLookupTable(file, "client")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	record := analytics.AnalyticsRecord{Extra: map[string]interface{}{"client": "console"}}
+	table.enrich(&record)
+	if record.Extra["owner"] != "platform" || record.Extra["tier"] == nil {
+		t.Fatalf("the attributes of the row should be attached, got %v", record.Extra)
+	}
+
+	if _, err := newLookupTable(filepath.Join(t.TempDir(), "missing.json"), "client"); err == nil {
+		t.Fatal("a missing lookup table should fail to load")
+	}
+}
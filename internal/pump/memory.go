@@ -0,0 +1,29 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"runtime/debug"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// tuneMemory applies the soft memory limit (in MB) and the GC percent to the go runtime, so that
+// the memory of the pump stays under the limit of its container while draining a large backlog.
+// Zero values keep the runtime defaults, which honor the GOMEMLIMIT and GOGC environment variables.
+func tuneMemory(memoryLimit int, gcPercent int) {
+	if memoryLimit > 0 {
+		if setMemoryLimit(int64(memoryLimit) << 20) {
+			log.Infof("Go runtime soft memory limit set to %d MB", memoryLimit)
+		} else {
+			log.Warnf("--memory-limit needs iam-pump to be built with go 1.19 or later, ignoring it")
+		}
+	}
+
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+		log.Infof("Go runtime GC percent set to %d", gcPercent)
+	}
+}
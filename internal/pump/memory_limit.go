@@ -0,0 +1,16 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build go1.19
+
+package pump
+
+import "runtime/debug"
+
+// setMemoryLimit sets the soft memory limit of the go runtime, it reports whether it is supported.
+func setMemoryLimit(limit int64) bool {
+	debug.SetMemoryLimit(limit)
+
+	return true
+}
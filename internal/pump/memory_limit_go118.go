@@ -0,0 +1,12 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.19
+
+package pump
+
+// setMemoryLimit is not supported before go 1.19, which introduced the soft memory limit.
+func setMemoryLimit(limit int64) bool {
+	return false
+}
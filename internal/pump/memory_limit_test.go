@@ -0,0 +1,27 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build go1.19
+
+package pump
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestTuneMemoryLimit(t *testing.T) {
+	previous := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(previous)
+
+	tuneMemory(0, 0)
+	if limit := debug.SetMemoryLimit(-1); limit != previous {
+		t.Fatalf("a zero memory limit should keep the runtime default, got %d", limit)
+	}
+
+	tuneMemory(512, 0)
+	if limit := debug.SetMemoryLimit(-1); limit != 512<<20 {
+		t.Fatalf("the memory limit should be applied in MB, got %d", limit)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestTuneMemoryGCPercent(t *testing.T) {
+	previous := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(previous)
+
+	tuneMemory(0, 0)
+	if percent := debug.SetGCPercent(100); percent != 100 {
+		t.Fatalf("a zero gc percent should keep the runtime default, got %d", percent)
+	}
+
+	tuneMemory(0, 50)
+	if percent := debug.SetGCPercent(100); percent != 50 {
+		t.Fatalf("the gc percent should be applied, got %d", percent)
+	}
+
+	tuneMemory(0, -1)
+	if percent := debug.SetGCPercent(100); percent != -1 {
+		t.Fatalf("a negative gc percent should disable the collector, got %d", percent)
+	}
+}
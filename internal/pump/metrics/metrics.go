@@ -0,0 +1,278 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry holds all the iam-pump operational metrics. It is kept apart from the default
+// prometheus registry which is used by the prometheus pump to expose analytics data.
+var registry = prometheus.NewRegistry()
+
+// analyticsRegistry holds the metrics aggregated from the analytics data by the pumps, exposed
+// along with the operational metrics.
+var analyticsRegistry = prometheus.NewRegistry()
+
+// Paused is set to 1 when the purge loop is paused by the maintenance switch.
+var Paused = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_paused",
+	Help: "Whether the purge loop is paused for backend maintenance (1) or running (0).",
+})
+
+// Halted is set to 1 when the purge loop is halted on decode errors.
+var Halted = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_halted",
+	Help: "Whether the purge loop is halted on decode errors (1) or running (0).",
+})
+
+// DuplicateRecords counts the records dropped as duplicates of a record already shipped.
+var DuplicateRecords = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_duplicate_records_total",
+	Help: "Total number of records dropped as duplicates within the deduplication window.",
+})
+
+// CoalescedRecords counts the records collapsed into a preceding identical record.
+var CoalescedRecords = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_coalesced_records_total",
+	Help: "Total number of consecutive identical records coalesced into a single record.",
+})
+
+// RecordsDecoded counts the analytics records read from the analytics storage and decoded.
+var RecordsDecoded = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_records_decoded_total",
+	Help: "Total number of analytics records read and decoded.",
+})
+
+// DecodeErrors counts the analytics values read from the analytics storage which failed to decode.
+var DecodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_decode_errors_total",
+	Help: "Total number of analytics values which could not be decoded.",
+})
+
+// FilteredRecords counts the records each pump did not write because its filters, sampling or
+// pre-write hooks dropped them.
+var FilteredRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_filtered_records_total",
+	Help: "Total number of analytics records filtered out per pump.",
+}, []string{"pump"})
+
+// WriteDuration observes the duration of the writes completed by each pump, retries included.
+var WriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pump_write_duration_seconds",
+	Help:    "Duration in seconds of the writes per pump.",
+	Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"pump"})
+
+// WriteErrors counts the writes failing in each pump, the timeouts excepted.
+var WriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_write_errors_total",
+	Help: "Total number of failed writes per pump.",
+}, []string{"pump"})
+
+// WriteTimeouts counts the writes of each pump abandoned at their timeout or the deadline of
+// their window.
+var WriteTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_write_timeouts_total",
+	Help: "Total number of timed out writes per pump.",
+}, []string{"pump"})
+
+// RecordsWritten counts the records successfully written by each pump.
+var RecordsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_records_written_total",
+	Help: "Total number of analytics records written per pump.",
+}, []string{"pump"})
+
+// BytesWritten counts the bytes written by each pump. Pumps which serialize the records themselves
+// report the exact size of the payload, for the others it is estimated from the records.
+var BytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_bytes_written_total",
+	Help: "Total number of bytes written per pump.",
+}, []string{"pump"})
+
+// E2ELatency observes the delay between the authorization which produced each record and its
+// successful write by a pump.
+var E2ELatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pump_e2e_latency_seconds",
+	Help:    "Delay in seconds between the creation of the analytics records and their write per pump.",
+	Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+}, []string{"pump"})
+
+// RetainedRecords counts the records put back in the analytics storage because a pump retaining
+// the source data failed to write them.
+var RetainedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_retained_records_total",
+	Help: "Total number of analytics records put back in the analytics storage per pump failing to write them.",
+}, []string{"pump"})
+
+// BackendRejections counts the records the back-end of each pump rejected for their size or rate.
+var BackendRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_backend_rejections_total",
+	Help: "Total number of analytics records rejected by the back-ends per pump and reason, payload-too-large or rate-limited.",
+}, []string{"pump", "reason"})
+
+// AbandonedWindows counts the purge windows whose writes did not complete within the window deadline.
+var AbandonedWindows = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_abandoned_windows_total",
+	Help: "Total number of purge windows abandoned at their deadline, their unwritten records spilled.",
+})
+
+// ChunkedPurges counts the purge windows whose backlog exceeded the memory budget and was read in chunks.
+var ChunkedPurges = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pump_chunked_purges_total",
+	Help: "Total number of purge windows read in chunks because they exceeded the memory budget.",
+})
+
+// RecordSize is the running estimate of the size of the records read from the analytics storage.
+var RecordSize = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_record_size_estimate_bytes",
+	Help: "Running estimate of the size in bytes of the records read from the analytics storage.",
+})
+
+// StuckWrites is the number of writes abandoned on timeout whose goroutine is still running
+// because the pump does not honor the context passed to WriteData.
+var StuckWrites = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pump_stuck_writes",
+	Help: "Number of timed out writes still running per pump.",
+}, []string{"pump"})
+
+// PumpRestarts counts the restarts of the pumps by the watchdog, after windows without a completed write.
+var PumpRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_restarts_total",
+	Help: "Total number of watchdog restarts per pump.",
+}, []string{"pump"})
+
+// QueuedRecords is the number of records waiting in the queue of the pumps written asynchronously.
+var QueuedRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pump_queued_records",
+	Help: "Number of records waiting in the queue per pump.",
+}, []string{"pump"})
+
+// QueueDrops counts the records dropped by the pumps whose queue is full, per queue policy.
+var QueueDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_queue_dropped_records_total",
+	Help: "Total number of records dropped per pump because its queue is full.",
+}, []string{"pump", "policy"})
+
+// BufferedRecords is the number of records buffered by the pumps flushed less often than the
+// analytics storage is read.
+var BufferedRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pump_buffered_records",
+	Help: "Number of records buffered per pump until its next flush.",
+}, []string{"pump"})
+
+// SkippedWrites counts the purge windows skipped by a pump because its previous write is stuck.
+var SkippedWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_skipped_writes_total",
+	Help: "Total number of writes skipped per pump while a previous write is stuck.",
+}, []string{"pump"})
+
+// BreakerOpen is 1 while the circuit breaker of a pump is open, 0 otherwise.
+var BreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pump_breaker_open",
+	Help: "Whether the circuit breaker of the pump is open.",
+}, []string{"pump"})
+
+// MissingFields counts the records rejected by a pump because they miss a field it requires, per
+// first missing field.
+var MissingFields = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_missing_field_records_total",
+	Help: "Total number of records rejected per pump and missing required field.",
+}, []string{"pump", "field"})
+
+// DeadLetters counts the records a pump failed to write which were dead-lettered, per reason.
+var DeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_dead_letters_total",
+	Help: "Total number of records dead-lettered per pump and reason.",
+}, []string{"pump", "reason"})
+
+// UnroutedRecords counts the records dropped because they are only routed to a pump which is not
+// initialized, per pump.
+var UnroutedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pump_unrouted_records_total",
+	Help: "Total number of records dropped per pump they are routed to which is not initialized.",
+}, []string{"pump"})
+
+// BackgroundWorkers is the number of goroutines running background tasks of the pumps, e.g. the
+// parts of the multipart uploads and the compressions of the rotated files.
+var BackgroundWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_background_workers",
+	Help: "Number of goroutines running background tasks of the pumps.",
+})
+
+// BackgroundWorkersMax is the cap of the goroutines running background tasks, 0 when uncapped.
+var BackgroundWorkersMax = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_background_workers_max",
+	Help: "Maximum number of goroutines running background tasks of the pumps, 0 when uncapped.",
+})
+
+// BackgroundTasksQueued is the number of background tasks waiting for a worker.
+var BackgroundTasksQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pump_background_tasks_queued",
+	Help: "Number of background tasks of the pumps waiting for a worker.",
+})
+
+// nolint: gochecknoinits
+func init() {
+	registry.MustRegister(
+		Paused,
+		Halted,
+		CoalescedRecords,
+		DuplicateRecords,
+		RecordsDecoded,
+		DecodeErrors,
+		FilteredRecords,
+		WriteDuration,
+		WriteErrors,
+		WriteTimeouts,
+		RecordsWritten,
+		BytesWritten,
+		E2ELatency,
+		RetainedRecords,
+		BackendRejections,
+		AbandonedWindows,
+		ChunkedPurges,
+		RecordSize,
+		StuckWrites,
+		PumpRestarts,
+		BufferedRecords,
+		QueuedRecords,
+		QueueDrops,
+		SkippedWrites,
+		BreakerOpen,
+		MissingFields,
+		DeadLetters,
+		UnroutedRecords,
+		BackgroundWorkers,
+		BackgroundWorkersMax,
+		BackgroundTasksQueued,
+	)
+}
+
+// RegisterAnalytics registers a collector of metrics aggregated from the analytics data. The
+// collector already registered with the same metrics, by a previous instance of the pump, is
+// returned instead so that the metrics keep counting across reloads.
+func RegisterAnalytics(collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := analyticsRegistry.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			return registered.ExistingCollector, nil
+		}
+
+		return nil, err
+	}
+
+	return collector, nil
+}
+
+// Handler returns a http handler which exposes the iam-pump operational metrics and the metrics
+// aggregated from the analytics data.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{registry, analyticsRegistry}, promhttp.HandlerOpts{})
+}
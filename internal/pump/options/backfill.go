@@ -0,0 +1,100 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	cliflag "github.com/marmotedu/component-base/pkg/cli/flag"
+)
+
+// BackfillOptions defines the options of the backfill command, which replays the records of an
+// archive through the pumps.
+type BackfillOptions struct {
+	Archive          string `json:"archive"             mapstructure:"archive"`
+	S3Endpoint       string `json:"s3-endpoint"         mapstructure:"s3-endpoint"`
+	S3Region         string `json:"s3-region"           mapstructure:"s3-region"`
+	S3ForcePathStyle bool   `json:"s3-force-path-style" mapstructure:"s3-force-path-style"`
+	Since            string `json:"since"               mapstructure:"since"`
+	Until            string `json:"until"               mapstructure:"until"`
+	Rate             int    `json:"rate"                mapstructure:"rate"`
+	BatchSize        int    `json:"batch-size"          mapstructure:"batch-size"`
+}
+
+// NewBackfillOptions creates a new BackfillOptions object with default parameters.
+func NewBackfillOptions() *BackfillOptions {
+	return &BackfillOptions{
+		BatchSize: 1000,
+	}
+}
+
+// Flags returns flags for the backfill command by section name.
+func (o *BackfillOptions) Flags() (fss cliflag.NamedFlagSets) {
+	fs := fss.FlagSet("backfill")
+	fs.StringVar(&o.Archive, "archive", o.Archive, ""+
+		"The directory holding the csv archives written by the csv pump, compressed or not, or the "+
+		"s3://bucket/prefix url of the objects written by the s3 pump. The csv archives are read with the "+
+		"columns, delimiter and timestamp formats of the csv pump configured with the directory as csv_dir.")
+	fs.StringVar(&o.S3Endpoint, "s3-endpoint", o.S3Endpoint, ""+
+		"The endpoint of the storage of a s3 archive, https://s3.<region>.amazonaws.com by default.")
+	fs.StringVar(&o.S3Region, "s3-region", o.S3Region, ""+
+		"The region of the bucket of a s3 archive, us-east-1 by default.")
+	fs.BoolVar(&o.S3ForcePathStyle, "s3-force-path-style", o.S3ForcePathStyle, ""+
+		"Address the bucket of a s3 archive in the path of the urls, as expected by most S3 compatible storages.")
+	fs.StringVar(&o.Since, "since", o.Since, ""+
+		"If set, only the records created at or after this RFC3339 time are replayed.")
+	fs.StringVar(&o.Until, "until", o.Until, ""+
+		"If set, only the records created before this RFC3339 time are replayed.")
+	fs.IntVar(&o.Rate, "rate", o.Rate, ""+
+		"The maximum number of records replayed per second. 0 means no limit.")
+	fs.IntVar(&o.BatchSize, "batch-size", o.BatchSize, ""+
+		"The number of records written to the pumps at once.")
+
+	return fss
+}
+
+// Validate checks BackfillOptions and return a slice of found errs.
+func (o *BackfillOptions) Validate() []error {
+	var errs []error
+
+	if o.Archive == "" {
+		errs = append(errs, fmt.Errorf("--archive must be set"))
+	}
+
+	since, until, err := o.TimeRange()
+	if err != nil {
+		errs = append(errs, err)
+	} else if !since.IsZero() && !until.IsZero() && !since.Before(until) {
+		errs = append(errs, fmt.Errorf("--since must be before --until"))
+	}
+
+	if o.Rate < 0 {
+		errs = append(errs, fmt.Errorf("--rate cannot be negative"))
+	}
+
+	if o.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("--batch-size must be positive"))
+	}
+
+	return errs
+}
+
+// TimeRange returns the time range of the records to replay, a zero bound is open.
+func (o *BackfillOptions) TimeRange() (since time.Time, until time.Time, err error) {
+	if o.Since != "" {
+		if since, err = time.Parse(time.RFC3339, o.Since); err != nil {
+			return since, until, fmt.Errorf("--since %s is not a RFC3339 time", o.Since)
+		}
+	}
+
+	if o.Until != "" {
+		if until, err = time.Parse(time.RFC3339, o.Until); err != nil {
+			return since, until, fmt.Errorf("--until %s is not a RFC3339 time", o.Until)
+		}
+	}
+
+	return since, until, nil
+}
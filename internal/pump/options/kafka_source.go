@@ -0,0 +1,101 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+// Defines the analytics sources iam-pump drains.
+const (
+	// SourceRedis drains the analytics list iam-authz-server writes to redis.
+	SourceRedis = "redis"
+	// SourceKafka consumes the analytics records iam-authz-server produces to a kafka topic.
+	SourceKafka = "kafka"
+)
+
+// KafkaSourceOptions defines options for the kafka analytics source.
+type KafkaSourceOptions struct {
+	Brokers               []string `json:"brokers"                  mapstructure:"brokers"`
+	Topic                 string   `json:"topic"                    mapstructure:"topic"`
+	GroupID               string   `json:"group-id"                 mapstructure:"group-id"`
+	ClientID              string   `json:"client-id"                mapstructure:"client-id"`
+	BatchSize             int      `json:"batch-size"               mapstructure:"batch-size"`
+	FetchTimeout          int      `json:"fetch-timeout"            mapstructure:"fetch-timeout"`
+	UseSSL                bool     `json:"use-ssl"                  mapstructure:"use-ssl"`
+	SSLInsecureSkipVerify bool     `json:"ssl-insecure-skip-verify" mapstructure:"ssl-insecure-skip-verify"`
+	SSLCAFile             string   `json:"ssl-ca-file"              mapstructure:"ssl-ca-file"`
+	SSLCertFile           string   `json:"ssl-cert-file"            mapstructure:"ssl-cert-file"`
+	SSLKeyFile            string   `json:"ssl-key-file"             mapstructure:"ssl-key-file"`
+	SASLMechanism         string   `json:"sasl-mechanism"           mapstructure:"sasl-mechanism"`
+	SASLUsername          string   `json:"sasl-username"            mapstructure:"sasl-username"`
+	SASLPassword          string   `json:"sasl-password"            mapstructure:"sasl-password"`
+	SASLAlgorithm         string   `json:"sasl-algorithm"           mapstructure:"sasl-algorithm"`
+}
+
+// NewKafkaSourceOptions create a `zero` value instance.
+func NewKafkaSourceOptions() *KafkaSourceOptions {
+	return &KafkaSourceOptions{
+		Brokers:      []string{},
+		Topic:        "iam-analytics",
+		GroupID:      "iam-pump",
+		ClientID:     "iam-pump",
+		BatchSize:    1000,
+		FetchTimeout: 1,
+	}
+}
+
+// Validate verifies flags passed to KafkaSourceOptions.
+func (o *KafkaSourceOptions) Validate() []error {
+	errs := []error{}
+
+	if o.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("--kafka-source.batch-size must be positive"))
+	}
+
+	if o.FetchTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--kafka-source.fetch-timeout must be positive"))
+	}
+
+	if (o.SSLCertFile == "") != (o.SSLKeyFile == "") {
+		errs = append(errs, fmt.Errorf("--kafka-source.ssl-cert-file and --kafka-source.ssl-key-file must be set together"))
+	}
+
+	switch o.SASLMechanism {
+	case "", "plain", "PLAIN", "scram", "SCRAM":
+	default:
+		errs = append(errs, fmt.Errorf("--kafka-source.sasl-mechanism must be plain or scram"))
+	}
+
+	return errs
+}
+
+// AddFlags adds flags related to the kafka analytics source to the specified FlagSet.
+func (o *KafkaSourceOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.Brokers, "kafka-source.brokers", o.Brokers, "The kafka brokers consumed with --source=kafka.")
+	fs.StringVar(&o.Topic, "kafka-source.topic", o.Topic, "The topic the analytics records are produced to.")
+	fs.StringVar(&o.GroupID, "kafka-source.group-id", o.GroupID, ""+
+		"The consumer group of the iam-pump instances, which share the partitions of the topic.")
+	fs.StringVar(&o.ClientID, "kafka-source.client-id", o.ClientID, "The client id of the kafka consumer.")
+	fs.IntVar(&o.BatchSize, "kafka-source.batch-size", o.BatchSize, ""+
+		"The maximum number of records consumed per purge window.")
+	fs.IntVar(&o.FetchTimeout, "kafka-source.fetch-timeout", o.FetchTimeout, ""+
+		"The time (in seconds) a purge window waits for records when fewer than the batch size are available.")
+	fs.BoolVar(&o.UseSSL, "kafka-source.use-ssl", o.UseSSL, "Connect to the kafka brokers with TLS.")
+	fs.BoolVar(&o.SSLInsecureSkipVerify, "kafka-source.ssl-insecure-skip-verify", o.SSLInsecureSkipVerify, ""+
+		"Skip the verification of the kafka brokers certificates.")
+	fs.StringVar(&o.SSLCAFile, "kafka-source.ssl-ca-file", o.SSLCAFile, ""+
+		"The CA certificates verifying the kafka brokers, the system pool is used when not set.")
+	fs.StringVar(&o.SSLCertFile, "kafka-source.ssl-cert-file", o.SSLCertFile, "The client certificate of mTLS.")
+	fs.StringVar(&o.SSLKeyFile, "kafka-source.ssl-key-file", o.SSLKeyFile, "The client key of mTLS.")
+	fs.StringVar(&o.SASLMechanism, "kafka-source.sasl-mechanism", o.SASLMechanism, ""+
+		"The SASL mechanism authenticating the consumer, plain or scram.")
+	fs.StringVar(&o.SASLUsername, "kafka-source.sasl-username", o.SASLUsername, "The SASL username.")
+	fs.StringVar(&o.SASLPassword, "kafka-source.sasl-password", o.SASLPassword, "The SASL password.")
+	fs.StringVar(&o.SASLAlgorithm, "kafka-source.sasl-algorithm", o.SASLAlgorithm, ""+
+		"The SCRAM algorithm, sha-256 or sha-512.")
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// LookupOptions defines options for enriching the records with the attributes of a static lookup
+// table, keyed by a field of the records.
+type LookupOptions struct {
+	File     string `json:"file"      mapstructure:"file"`
+	KeyField string `json:"key-field" mapstructure:"key-field"`
+}
+
+// NewLookupOptions create a `zero` value instance.
+func NewLookupOptions() *LookupOptions {
+	return &LookupOptions{}
+}
+
+// Enabled reports whether the records are enriched from a lookup table.
+func (o *LookupOptions) Enabled() bool {
+	return o != nil && o.File != ""
+}
+
+// Validate verifies flags passed to LookupOptions.
+func (o *LookupOptions) Validate() []error {
+	errs := []error{}
+
+	if !o.Enabled() {
+		return errs
+	}
+
+	if o.KeyField == "" {
+		errs = append(errs, fmt.Errorf("--lookup.key-field must be set with --lookup.file"))
+	}
+
+	switch strings.ToLower(filepath.Ext(o.File)) {
+	case ".csv", ".json":
+	default:
+		errs = append(errs, fmt.Errorf("--lookup.file must be a .csv or .json file"))
+	}
+
+	return errs
+}
+
+// AddFlags adds flags related to the lookup table to the specified FlagSet.
+func (o *LookupOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.File, "lookup.file", o.File, ""+
+		"The lookup table the records are enriched from, loaded at startup and reloaded on SIGHUP. A .csv file "+
+		"has a header row, its first column holds the keys and the other columns the attributes. A .json file "+
+		"holds an object of the attributes by key. The attributes are attached to the records as extra fields.")
+	fs.StringVar(&o.KeyField, "lookup.key-field", o.KeyField, ""+
+		"The field of the records, or extra field, whose value is looked up in the table, e.g. username.")
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+// SourceNATS consumes the analytics records published to a NATS JetStream stream.
+const SourceNATS = "nats"
+
+// NATSSourceOptions defines options for the NATS JetStream analytics source.
+type NATSSourceOptions struct {
+	URLs                  []string `json:"urls"                     mapstructure:"urls"`
+	Stream                string   `json:"stream"                   mapstructure:"stream"`
+	Subject               string   `json:"subject"                  mapstructure:"subject"`
+	Durable               string   `json:"durable"                  mapstructure:"durable"`
+	BatchSize             int      `json:"batch-size"               mapstructure:"batch-size"`
+	FetchTimeout          int      `json:"fetch-timeout"            mapstructure:"fetch-timeout"`
+	AckWait               int      `json:"ack-wait"                 mapstructure:"ack-wait"`
+	Username              string   `json:"username"                 mapstructure:"username"`
+	Password              string   `json:"password"                 mapstructure:"password"`
+	Token                 string   `json:"token"                    mapstructure:"token"`
+	CredentialsFile       string   `json:"credentials-file"         mapstructure:"credentials-file"`
+	UseSSL                bool     `json:"use-ssl"                  mapstructure:"use-ssl"`
+	SSLInsecureSkipVerify bool     `json:"ssl-insecure-skip-verify" mapstructure:"ssl-insecure-skip-verify"`
+	SSLCAFile             string   `json:"ssl-ca-file"              mapstructure:"ssl-ca-file"`
+	SSLCertFile           string   `json:"ssl-cert-file"            mapstructure:"ssl-cert-file"`
+	SSLKeyFile            string   `json:"ssl-key-file"             mapstructure:"ssl-key-file"`
+}
+
+// NewNATSSourceOptions create a `zero` value instance.
+func NewNATSSourceOptions() *NATSSourceOptions {
+	return &NATSSourceOptions{
+		URLs:         []string{},
+		Stream:       "IAM_ANALYTICS",
+		Subject:      "iam.analytics",
+		Durable:      "iam-pump",
+		BatchSize:    1000,
+		FetchTimeout: 1,
+		AckWait:      60,
+	}
+}
+
+// Validate verifies flags passed to NATSSourceOptions.
+func (o *NATSSourceOptions) Validate() []error {
+	errs := []error{}
+
+	if o.Stream == "" || o.Durable == "" {
+		errs = append(errs, fmt.Errorf("--nats-source.stream and --nats-source.durable must be set"))
+	}
+
+	if o.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("--nats-source.batch-size must be positive"))
+	}
+
+	if o.FetchTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--nats-source.fetch-timeout must be positive"))
+	}
+
+	if o.AckWait <= 0 {
+		errs = append(errs, fmt.Errorf("--nats-source.ack-wait must be positive"))
+	}
+
+	if (o.SSLCertFile == "") != (o.SSLKeyFile == "") {
+		errs = append(errs, fmt.Errorf("--nats-source.ssl-cert-file and --nats-source.ssl-key-file must be set together"))
+	}
+
+	return errs
+}
+
+// AddFlags adds flags related to the NATS JetStream analytics source to the specified FlagSet.
+func (o *NATSSourceOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.URLs, "nats-source.urls", o.URLs, "The NATS servers consumed with --source=nats.")
+	fs.StringVar(&o.Stream, "nats-source.stream", o.Stream, "The JetStream stream the analytics records are stored in.")
+	fs.StringVar(&o.Subject, "nats-source.subject", o.Subject, ""+
+		"The subject the analytics records are published to, the durable consumer is created filtering it if it does not exist.")
+	fs.StringVar(&o.Durable, "nats-source.durable", o.Durable, ""+
+		"The durable pull consumer shared by the iam-pump instances.")
+	fs.IntVar(&o.BatchSize, "nats-source.batch-size", o.BatchSize, ""+
+		"The maximum number of records consumed per purge window.")
+	fs.IntVar(&o.FetchTimeout, "nats-source.fetch-timeout", o.FetchTimeout, ""+
+		"The time (in seconds) a purge window waits for records when fewer than the batch size are available.")
+	fs.IntVar(&o.AckWait, "nats-source.ack-wait", o.AckWait, ""+
+		"The time (in seconds) JetStream waits for the acknowledgement of the records delivered before delivering "+
+		"them again, it must exceed the time taken to write a purge window to the pumps.")
+	fs.StringVar(&o.Username, "nats-source.username", o.Username, "The username authenticating to the NATS servers.")
+	fs.StringVar(&o.Password, "nats-source.password", o.Password, "The password authenticating to the NATS servers.")
+	fs.StringVar(&o.Token, "nats-source.token", o.Token, "The token authenticating to the NATS servers.")
+	fs.StringVar(&o.CredentialsFile, "nats-source.credentials-file", o.CredentialsFile, ""+
+		"The user credentials file (JWT and NKey seed) authenticating to the NATS servers.")
+	fs.BoolVar(&o.UseSSL, "nats-source.use-ssl", o.UseSSL, "Connect to the NATS servers with TLS.")
+	fs.BoolVar(&o.SSLInsecureSkipVerify, "nats-source.ssl-insecure-skip-verify", o.SSLInsecureSkipVerify, ""+
+		"Skip the verification of the NATS servers certificates.")
+	fs.StringVar(&o.SSLCAFile, "nats-source.ssl-ca-file", o.SSLCAFile, ""+
+		"The CA certificates verifying the NATS servers, the system pool is used when not set.")
+	fs.StringVar(&o.SSLCertFile, "nats-source.ssl-cert-file", o.SSLCertFile, "The client certificate of mTLS.")
+	fs.StringVar(&o.SSLKeyFile, "nats-source.ssl-key-file", o.SSLKeyFile, "The client key of mTLS.")
+}
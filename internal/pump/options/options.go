@@ -9,35 +9,199 @@ import (
 	cliflag "github.com/marmotedu/component-base/pkg/cli/flag"
 	"github.com/marmotedu/component-base/pkg/json"
 
-	genericoptions "github.com/marmotedu/iam/internal/pkg/options"
 	"github.com/marmotedu/iam/internal/pump/analytics"
 	"github.com/marmotedu/iam/pkg/log"
 )
 
+// Defines the error policies of a pump in sequential mode.
+const (
+	// OnErrorContinue writes the window to the next pumps when the pump fails.
+	OnErrorContinue = "continue"
+	// OnErrorAbort stops the write of the window to the next pumps when the pump fails.
+	OnErrorAbort = "abort"
+)
+
+// Defines the handling of the records missing a field required by a pump.
+const (
+	// OnMissingFieldsDrop drops the records.
+	OnMissingFieldsDrop = "drop"
+	// OnMissingFieldsDeadLetter stores the records in the dead-letter queue of the pump.
+	OnMissingFieldsDeadLetter = "dead-letter"
+)
+
+// Defines how the scrub-fields of a pump are scrubbed from the records written to it.
+const (
+	// ScrubModeClear clears the fields.
+	ScrubModeClear = "clear"
+	// ScrubModeHash replaces the string fields by their hash, the other fields are cleared.
+	ScrubModeHash = "hash"
+)
+
+// Defines the handling of the records written to a pump whose queue is full.
+const (
+	// QueuePolicyBlock waits for the queue to have room, which blocks the purge loop.
+	QueuePolicyBlock = "block"
+	// QueuePolicyDropOldest drops the records queued first to make room.
+	QueuePolicyDropOldest = "drop-oldest"
+	// QueuePolicyDropNewest drops the records which do not fit in the queue.
+	QueuePolicyDropNewest = "drop-newest"
+)
+
+// Defines the handling of an analytics key whose Redis type is not the one iam-pump drains.
+const (
+	// KeyTypeCheckWarn logs a warning and starts anyway.
+	KeyTypeCheckWarn = "warn"
+	// KeyTypeCheckFail refuses to start.
+	KeyTypeCheckFail = "fail"
+	// KeyTypeCheckOff skips the check.
+	KeyTypeCheckOff = "off"
+)
+
+// Defines the encodings of the analytics records iam-pump decodes.
+const (
+	// CodecMsgpack decodes the msgpack records iam-authz-server writes.
+	CodecMsgpack = "msgpack"
+	// CodecJSON decodes json records with the field names of the analytics records.
+	CodecJSON = "json"
+	// CodecProtobuf decodes protobuf records of the AnalyticsRecord message of analytics.proto.
+	CodecProtobuf = "protobuf"
+	// CodecAuto detects the encoding of every record.
+	CodecAuto = "auto"
+)
+
 // PumpConfig defines options for pump back-end.
 type PumpConfig struct {
-	Type                  string                     `json:"type"                    mapstructure:"type"`
-	Filters               analytics.AnalyticsFilters `json:"filters"                 mapstructure:"filters"`
-	Timeout               int                        `json:"timeout"                 mapstructure:"timeout"`
-	OmitDetailedRecording bool                       `json:"omit-detailed-recording" mapstructure:"omit-detailed-recording"`
-	Meta                  map[string]interface{}     `json:"meta"                    mapstructure:"meta"`
+	Type                     string                     `json:"type"                        mapstructure:"type"`
+	Filters                  analytics.AnalyticsFilters `json:"filters"                     mapstructure:"filters"`
+	Timeout                  int                        `json:"timeout"                     mapstructure:"timeout"`
+	PurgeDelay               int                        `json:"purge-delay"                 mapstructure:"purge-delay"`
+	OmitDetailedRecording    bool                       `json:"omit-detailed-recording"     mapstructure:"omit-detailed-recording"`
+	OmittedFields            []string                   `json:"omitted-fields"              mapstructure:"omitted-fields"`
+	ScrubFields              []string                   `json:"scrub-fields"                mapstructure:"scrub-fields"`
+	ScrubMode                string                     `json:"scrub-mode"                  mapstructure:"scrub-mode"`
+	ScrubHashKey             string                     `json:"scrub-hash-key"              mapstructure:"scrub-hash-key"`
+	Retention                int                        `json:"retention"                   mapstructure:"retention"`
+	Flatten                  string                     `json:"flatten"                     mapstructure:"flatten"`
+	Format                   string                     `json:"format"                      mapstructure:"format"`
+	FlattenDelimiter         string                     `json:"flatten-delimiter"           mapstructure:"flatten-delimiter"`
+	Marshaler                string                     `json:"marshaler"                   mapstructure:"marshaler"`
+	Order                    int                        `json:"order"                       mapstructure:"order"`
+	OnError                  string                     `json:"on-error"                    mapstructure:"on-error"`
+	MaxRetries               int                        `json:"max-retries"                 mapstructure:"max-retries"`
+	RetryBackoff             int                        `json:"retry-backoff"               mapstructure:"retry-backoff"`
+	MaxRetryBackoff          int                        `json:"max-retry-backoff"           mapstructure:"max-retry-backoff"`
+	RequiredFields           []string                   `json:"required-fields"             mapstructure:"required-fields"`
+	OnMissingFields          string                     `json:"on-missing-fields"           mapstructure:"on-missing-fields"`
+	QueueSize                int                        `json:"queue-size"                  mapstructure:"queue-size"`
+	QueuePolicy              string                     `json:"queue-policy"                mapstructure:"queue-policy"`
+	SampleRate               float64                    `json:"sample-rate"                 mapstructure:"sample-rate"`
+	SampleRateField          string                     `json:"sample-rate-field"           mapstructure:"sample-rate-field"`
+	MaxRecordAge             int                        `json:"max-record-age"              mapstructure:"max-record-age"`
+	MaxRecordSize            int                        `json:"max-record-size"             mapstructure:"max-record-size"`
+	BreakerThreshold         int                        `json:"breaker-threshold"           mapstructure:"breaker-threshold"`
+	BreakerCooldown          int                        `json:"breaker-cooldown"            mapstructure:"breaker-cooldown"`
+	ShutdownPriority         int                        `json:"shutdown-priority"           mapstructure:"shutdown-priority"`
+	PreWriteHooks            []string                   `json:"pre-write-hooks"             mapstructure:"pre-write-hooks"`
+	FieldPrecedence          []string                   `json:"field-precedence"            mapstructure:"field-precedence"`
+	RetainSourceUntilSuccess bool                       `json:"retain-source-until-success" mapstructure:"retain-source-until-success"`
+	Meta                     map[string]interface{}     `json:"meta"                        mapstructure:"meta"`
+}
+
+// Route sends the analytics records matching all its conditions to its pumps only.
+type Route struct {
+	Match []RouteCondition `json:"match" mapstructure:"match"`
+	Pumps []string         `json:"pumps" mapstructure:"pumps"`
+}
+
+// EnricherConfig defines an enricher annotating the analytics records before they are written to
+// the pumps, e.g. geoip or user-agent.
+type EnricherConfig struct {
+	Type string                 `json:"type" mapstructure:"type"`
+	Meta map[string]interface{} `json:"meta" mapstructure:"meta"`
+}
+
+// RouteCondition matches the records whose field, referenced by its json name, has one of the values.
+type RouteCondition struct {
+	Field  string   `json:"field"  mapstructure:"field"`
+	Values []string `json:"values" mapstructure:"values"`
 }
 
 // Options runs a pumpserver.
 type Options struct {
-	PurgeDelay            int                          `json:"purge-delay"             mapstructure:"purge-delay"`
-	Pumps                 map[string]PumpConfig        `json:"pumps"                   mapstructure:"pumps"`
-	HealthCheckPath       string                       `json:"health-check-path"       mapstructure:"health-check-path"`
-	HealthCheckAddress    string                       `json:"health-check-address"    mapstructure:"health-check-address"`
-	OmitDetailedRecording bool                         `json:"omit-detailed-recording" mapstructure:"omit-detailed-recording"`
-	RedisOptions          *genericoptions.RedisOptions `json:"redis"                   mapstructure:"redis"`
-	Log                   *log.Options                 `json:"log"                     mapstructure:"log"`
+	PurgeDelay            int                     `json:"purge-delay"             mapstructure:"purge-delay"`
+	PurgeMemoryBudget     int                     `json:"purge-memory-budget"     mapstructure:"purge-memory-budget"`
+	PurgeChunkSize        int                     `json:"purge-chunk-size"        mapstructure:"purge-chunk-size"`
+	StorageExpirationTime int                     `json:"storage-expiration-time" mapstructure:"storage-expiration-time"`
+	WindowDeadline        int                     `json:"window-deadline"         mapstructure:"window-deadline"`
+	AtLeastOnce           bool                    `json:"at-least-once"           mapstructure:"at-least-once"`
+	RetainMaxWindows      int                     `json:"retain-max-windows"      mapstructure:"retain-max-windows"`
+	Pumps                 map[string]PumpConfig   `json:"pumps"                   mapstructure:"pumps"`
+	HealthCheckPath       string                  `json:"health-check-path"       mapstructure:"health-check-path"`
+	HealthCheckAddress    string                  `json:"health-check-address"    mapstructure:"health-check-address"`
+	OmitDetailedRecording bool                    `json:"omit-detailed-recording" mapstructure:"omit-detailed-recording"`
+	OmittedFields         []string                `json:"omitted-fields"          mapstructure:"omitted-fields"`
+	Retention             int                     `json:"retention"               mapstructure:"retention"`
+	ControlToken          string                  `json:"control-token"           mapstructure:"control-token"`
+	Sequential            bool                    `json:"sequential"              mapstructure:"sequential"`
+	Routes                []Route                 `json:"routes"                  mapstructure:"routes"`
+	DefaultPumps          []string                `json:"default-pumps"           mapstructure:"default-pumps"`
+	DeadLetterKey         string                  `json:"dead-letter-key"         mapstructure:"dead-letter-key"`
+	DeadLetterDir         string                  `json:"dead-letter-dir"         mapstructure:"dead-letter-dir"`
+	AuditLogFile          string                  `json:"audit-log-file"          mapstructure:"audit-log-file"`
+	AuditLogMaxSize       int                     `json:"audit-log-max-size"      mapstructure:"audit-log-max-size"`
+	AuditLogMaxBackups    int                     `json:"audit-log-max-backups"   mapstructure:"audit-log-max-backups"`
+	DropSampleRate        float64                 `json:"drop-sample-rate"        mapstructure:"drop-sample-rate"`
+	DropSamplePump        string                  `json:"drop-sample-pump"        mapstructure:"drop-sample-pump"`
+	PauseFile             string                  `json:"pause-file"              mapstructure:"pause-file"`
+	PauseRedisKey         string                  `json:"pause-redis-key"         mapstructure:"pause-redis-key"`
+	InstanceField         string                  `json:"instance-field"          mapstructure:"instance-field"`
+	InstanceID            string                  `json:"instance-id"             mapstructure:"instance-id"`
+	CoalesceFields        []string                `json:"coalesce-fields"         mapstructure:"coalesce-fields"`
+	CoalesceTimestamps    bool                    `json:"coalesce-timestamps"     mapstructure:"coalesce-timestamps"`
+	CoalesceCountField    string                  `json:"coalesce-count-field"    mapstructure:"coalesce-count-field"`
+	DedupWindow           int                     `json:"dedup-window"            mapstructure:"dedup-window"`
+	DedupFields           []string                `json:"dedup-fields"            mapstructure:"dedup-fields"`
+	Strict                bool                    `json:"strict"                  mapstructure:"strict"`
+	InitTimeout           int                     `json:"init-timeout"            mapstructure:"init-timeout"`
+	ShutdownTimeout       int                     `json:"shutdown-timeout"        mapstructure:"shutdown-timeout"`
+	MaxPumps              int                     `json:"max-pumps"               mapstructure:"max-pumps"`
+	MaxBackgroundWorkers  int                     `json:"max-background-workers"  mapstructure:"max-background-workers"`
+	QueueSize             int                     `json:"queue-size"              mapstructure:"queue-size"`
+	QueuePolicy           string                  `json:"queue-policy"            mapstructure:"queue-policy"`
+	DecodeWorkers         int                     `json:"decode-workers"          mapstructure:"decode-workers"`
+	DecodeBatchSize       int                     `json:"decode-batch-size"       mapstructure:"decode-batch-size"`
+	RedisReadTimeout      int                     `json:"redis-read-timeout"      mapstructure:"redis-read-timeout"`
+	RedisWriteTimeout     int                     `json:"redis-write-timeout"     mapstructure:"redis-write-timeout"`
+	RedisSlowThreshold    int                     `json:"redis-slow-threshold"    mapstructure:"redis-slow-threshold"`
+	KeyTypeCheck          string                  `json:"key-type-check"          mapstructure:"key-type-check"`
+	MemoryLimit           int                     `json:"memory-limit"            mapstructure:"memory-limit"`
+	GCPercent             int                     `json:"gc-percent"              mapstructure:"gc-percent"`
+	WatchdogWindows       int                     `json:"watchdog-windows"        mapstructure:"watchdog-windows"`
+	Codec                 string                  `json:"codec"                   mapstructure:"codec"`
+	DecodeErrorThreshold  float64                 `json:"decode-error-threshold"  mapstructure:"decode-error-threshold"`
+	DecodeErrorWindows    int                     `json:"decode-error-windows"    mapstructure:"decode-error-windows"`
+	WatchConfig           bool                    `json:"watch-config"            mapstructure:"watch-config"`
+	Source                string                  `json:"source"                  mapstructure:"source"`
+	KafkaSource           *KafkaSourceOptions     `json:"kafka-source"            mapstructure:"kafka-source"`
+	NATSSource            *NATSSourceOptions      `json:"nats-source"             mapstructure:"nats-source"`
+	AMQPSource            *AMQPSourceOptions      `json:"amqp-source"             mapstructure:"amqp-source"`
+	Sources               map[string]SourceConfig `json:"sources"                 mapstructure:"sources"`
+	RemoteConfig          *RemoteConfigOptions    `json:"remote-config"           mapstructure:"remote-config"`
+	Lookup                *LookupOptions          `json:"lookup"                  mapstructure:"lookup"`
+	Enrichers             []EnricherConfig        `json:"enrichers"               mapstructure:"enrichers"`
+	RedisOptions          *RedisSourceOptions     `json:"redis"                   mapstructure:"redis"`
+	Log                   *log.Options            `json:"log"                     mapstructure:"log"`
 }
 
 // NewOptions creates a new Options object with default parameters.
 func NewOptions() *Options {
 	s := Options{
-		PurgeDelay: 10,
+		PurgeDelay:       10,
+		ShutdownTimeout:  30,
+		MaxPumps:         64,
+		DecodeWorkers:    1,
+		DecodeBatchSize:  1000,
+		RetainMaxWindows: 3,
 		Pumps: map[string]PumpConfig{
 			"csv": {
 				Type: "csv",
@@ -48,7 +212,19 @@ func NewOptions() *Options {
 		},
 		HealthCheckPath:    "healthz",
 		HealthCheckAddress: "0.0.0.0:7070",
-		RedisOptions:       genericoptions.NewRedisOptions(),
+		KeyTypeCheck:       KeyTypeCheckWarn,
+		DecodeErrorWindows: 1,
+		Codec:              CodecMsgpack,
+		CoalesceCountField: "count",
+		AuditLogMaxSize:    100,
+		QueuePolicy:        QueuePolicyBlock,
+		Source:             SourceRedis,
+		KafkaSource:        NewKafkaSourceOptions(),
+		NATSSource:         NewNATSSourceOptions(),
+		AMQPSource:         NewAMQPSourceOptions(),
+		RemoteConfig:       NewRemoteConfigOptions(),
+		Lookup:             NewLookupOptions(),
+		RedisOptions:       NewRedisSourceOptions(),
 		Log:                log.NewOptions(),
 	}
 
@@ -58,19 +234,170 @@ func NewOptions() *Options {
 // Flags returns flags for a specific APIServer by section name.
 func (o *Options) Flags() (fss cliflag.NamedFlagSets) {
 	o.RedisOptions.AddFlags(fss.FlagSet("redis"))
+	o.KafkaSource.AddFlags(fss.FlagSet("kafka-source"))
+	o.NATSSource.AddFlags(fss.FlagSet("nats-source"))
+	o.AMQPSource.AddFlags(fss.FlagSet("amqp-source"))
+	o.RemoteConfig.AddFlags(fss.FlagSet("remote-config"))
+	o.Lookup.AddFlags(fss.FlagSet("lookup"))
 	o.Log.AddFlags(fss.FlagSet("logs"))
 
 	// Note: the weird ""+ in below lines seems to be the only way to get gofmt to
 	// arrange these text blocks sensibly. Grrr.
 	fs := fss.FlagSet("misc")
+	fs.StringVar(&o.Source, "source", o.Source, ""+
+		"The analytics source drained by iam-pump: redis, kafka to consume the records from the topic "+
+		"configured by the --kafka-source flags, nats to consume them from the JetStream stream configured by "+
+		"the --nats-source flags, or amqp to consume them from the RabbitMQ queue configured by the --amqp-source flags. "+
+		"The records consumed from kafka, nats or amqp are only acknowledged once every pump wrote them, they are "+
+		"consumed again when a pump failed to.")
 	fs.IntVar(&o.PurgeDelay, "purge-delay", o.PurgeDelay, ""+
-		"This setting the purge delay (in seconds) when purge the data from Redis to MongoDB or other data stores.")
+		"This setting the purge delay (in seconds) when purge the data from Redis to MongoDB or other data stores. "+
+		"A pump can configure its own purge delay, the records are then buffered in memory until it is flushed: "+
+		"they are already removed from Redis and are lost if iam-pump crashes before the flush.")
+	fs.IntVar(&o.PurgeMemoryBudget, "purge-memory-budget", o.PurgeMemoryBudget, ""+
+		"The estimated memory (in MB) the records read from Redis in a purge window may use. A larger backlog is read "+
+		"and written to the pumps in chunks fitting the budget. 0 means no budget.")
+	fs.IntVar(&o.PurgeChunkSize, "purge-chunk-size", o.PurgeChunkSize, ""+
+		"The maximum number of records read from Redis and written to the pumps at once. A larger backlog is purged "+
+		"in chunks of at most this size, along with --purge-memory-budget. 0 means no limit.")
+	fs.IntVar(&o.StorageExpirationTime, "storage-expiration-time", o.StorageExpirationTime, ""+
+		"If set, the expiration (in seconds) of the analytics data left in Redis by a purge window, refreshed at every "+
+		"window, so that a backlog no iam-pump instance drains anymore does not grow forever. 0 means no expiration.")
+	fs.IntVar(&o.WindowDeadline, "window-deadline", o.WindowDeadline, ""+
+		"The hard deadline (in seconds) of a purge window, typically the purge delay. The writes still running at the "+
+		"deadline are abandoned and their records dead-lettered, the chunks not read yet are left to the next window, "+
+		"which then starts on schedule. 0 lets a slow window overlap the next ones.")
+	fs.BoolVar(&o.AtLeastOnce, "at-least-once", o.AtLeastOnce, ""+
+		"If true, the records read from Redis are moved to a processing key of the instance and only deleted once "+
+		"every pump wrote the window, they are put back when a pump failed to. The processing keys left by crashed "+
+		"instances are put back at startup. It can not be set with --queue-size, the queued writes complete after "+
+		"the window.")
+	fs.IntVar(&o.RetainMaxWindows, "retain-max-windows", o.RetainMaxWindows, ""+
+		"The number of consecutive windows the records a pump failed to write are put back in the source for it, "+
+		"in at-least-once mode or with its retain-source-until-success. Once reached, the records the pump fails to "+
+		"write are dead-lettered and acknowledged, so that a pump failing for long does not replay the same records "+
+		"to every pump forever. 0 puts them back until written.")
 	fs.StringVar(&o.HealthCheckPath, "health-check-path", o.HealthCheckPath, ""+
-		"Specifies liveness health check request path.")
+		"Specifies liveness health check request path. It reports the state of the pumps and of the sources in "+
+		"JSON, with a 503 status code when the purge loop is halted or a source can not be reached.")
 	fs.StringVar(&o.HealthCheckAddress, "health-check-address", o.HealthCheckAddress, ""+
 		"Specifies liveness health check bind address.")
 	fs.BoolVar(&o.OmitDetailedRecording, "omit-detailed-recording", o.OmitDetailedRecording, ""+
 		"Setting this to true will avoid writing policy fields for each authorization request in pumps.")
+	fs.StringSliceVar(&o.OmittedFields, "omitted-fields", o.OmittedFields, ""+
+		"The analytics record fields cleared when --omit-detailed-recording is set, globally or by a pump. Defaults to policies and deciders.")
+	fs.IntVar(&o.Retention, "retention", o.Retention, ""+
+		"If set, the expireAt of each record is computed from its timestamp plus this retention (in seconds), "+
+		"unless the pump configures its own retention. TTL-capable pumps delete the records once expired.")
+	fs.StringVar(&o.ControlToken, "control-token", o.ControlToken, ""+
+		"If set, the control api endpoints served on --health-check-address require this bearer token. The health "+
+		"check only reports the errors of the pumps and sources to the requests carrying it.")
+	fs.BoolVar(&o.Sequential, "sequential", o.Sequential, ""+
+		"Write each purged window to the pumps one after another, ordered by their order setting, instead of concurrently. "+
+		"A failing pump whose on-error setting is abort stops the write of the window to the remaining pumps.")
+	fs.StringSliceVar(&o.DefaultPumps, "default-pumps", o.DefaultPumps, ""+
+		"The pumps receiving the records which match none of the configured routes. Defaults to all the pumps.")
+	fs.StringVar(&o.DeadLetterKey, "dead-letter-key", o.DeadLetterKey, ""+
+		"If set, the records a pump fails to write, permanently or once its retries are exhausted, are stored in the redis list <key>:<pump>.")
+	fs.StringVar(&o.DeadLetterDir, "dead-letter-dir", o.DeadLetterDir, ""+
+		"If set instead of --dead-letter-key, the records a pump fails to write are appended to the file <dir>/<pump>.json, "+
+		"one json record per line. The dead-lettered records are written again to their pump by iam-pump replay.")
+	fs.Float64Var(&o.DropSampleRate, "drop-sample-rate", o.DropSampleRate, ""+
+		"The fraction, between 0 and 1, of the records dropped by the pumps (filtered, skipped, ...) which are sampled "+
+		"with the reason of the drop for spot-checking. 0 disables the sampling.")
+	fs.StringVar(&o.DropSamplePump, "drop-sample-pump", o.DropSamplePump, ""+
+		"The pump receiving the dropped record samples instead of the analytics data. The samples are logged when not set.")
+	fs.StringVar(&o.PauseFile, "pause-file", o.PauseFile, ""+
+		"When the file exists, the purge loop is paused and analytics data accumulates in Redis until it is removed.")
+	fs.StringVar(&o.PauseRedisKey, "pause-redis-key", o.PauseRedisKey, ""+
+		"When the key is set in Redis, every iam-pump instance sharing that Redis pauses the purge loop until it is deleted.")
+	fs.StringVar(&o.InstanceField, "instance-field", o.InstanceField, ""+
+		"If set, every analytics record is annotated with the id of the iam-pump instance which shipped it under this field name.")
+	fs.StringVar(&o.InstanceID, "instance-id", o.InstanceID, ""+
+		"The iam-pump instance id written to --instance-field. Defaults to the POD_NAME environment variable, then to the hostname.")
+	fs.StringSliceVar(&o.CoalesceFields, "coalesce-fields", o.CoalesceFields, ""+
+		"If set, the consecutive records of a purge window with the same values of these fields are coalesced into "+
+		"their first record, annotated with the number of records under --coalesce-count-field, before they are "+
+		"written to the pumps.")
+	fs.BoolVar(&o.CoalesceTimestamps, "coalesce-timestamps", o.CoalesceTimestamps, ""+
+		"Only coalesce the consecutive records which also have the same timestamp.")
+	fs.StringVar(&o.CoalesceCountField, "coalesce-count-field", o.CoalesceCountField, ""+
+		"The field holding the number of records a coalesced record stands for, the metrics pumps count the "+
+		"coalesced records by it.")
+	fs.IntVar(&o.DedupWindow, "dedup-window", o.DedupWindow, ""+
+		"If set, the records identical to a record already shipped whose timestamps fall in the same bucket of this "+
+		"many seconds are dropped, e.g. the records of the authorizations retried by the authz-server. 0 disables "+
+		"the deduplication.")
+	fs.StringSliceVar(&o.DedupFields, "dedup-fields", o.DedupFields, ""+
+		"The record fields, or attributes of the authorization request, identifying the duplicate records. "+
+		"Defaults to username, resource and action.")
+	fs.BoolVar(&o.Strict, "strict", o.Strict, ""+
+		"Refuse to start when a configured pump can not be loaded or initialized, instead of skipping it.")
+	fs.IntVar(&o.InitTimeout, "init-timeout", o.InitTimeout, ""+
+		"The deadline (in seconds) for each pump to initialize before it is treated as failed. 0 means no deadline.")
+	fs.IntVar(&o.ShutdownTimeout, "shutdown-timeout", o.ShutdownTimeout, ""+
+		"The deadline (in seconds) for iam-pump to stop once signaled: the final purge window draining the records "+
+		"left in redis, the flush of the buffers and queues and the shutdown of the pumps. iam-pump exits with an "+
+		"error at the deadline, leaving what is not written yet. 0 means no deadline.")
+	fs.IntVar(&o.MaxPumps, "max-pumps", o.MaxPumps, ""+
+		"The maximum number of pumps iam-pump accepts to run, guarding against accidentally huge generated configurations. 0 means no limit.")
+	fs.IntVar(&o.MaxBackgroundWorkers, "max-background-workers", o.MaxBackgroundWorkers, ""+
+		"The maximum number of goroutines shared by the pumps to run their background tasks, e.g. the parts of the "+
+		"multipart uploads and the compressions of the rotated files. The tasks over the cap wait for a worker. "+
+		"0 means no limit.")
+	fs.IntVar(&o.QueueSize, "queue-size", o.QueueSize, ""+
+		"The default size of the queue each pump is written through, so that a slow pump does not delay the "+
+		"others. A pump can configure its own queue-size, the pumps retaining the source data are not queued by "+
+		"default. 0, the default, writes the pumps not configuring a queue in the purge window. It can not be set "+
+		"with --at-least-once or a kafka, nats or amqp --source, the queued writes complete after the window.")
+	fs.StringVar(&o.QueuePolicy, "queue-policy", o.QueuePolicy, ""+
+		"The default handling of the records written to a full pump queue: block waits for room, drop-oldest drops "+
+		"the records queued first and drop-newest the records which do not fit. A pump can configure its own "+
+		"queue-policy.")
+	fs.IntVar(&o.DecodeWorkers, "decode-workers", o.DecodeWorkers, ""+
+		"The number of goroutines decoding the analytics records of a purge window. The records are decoded "+
+		"serially when it is 1 or when the window holds at most --decode-batch-size records.")
+	fs.IntVar(&o.DecodeBatchSize, "decode-batch-size", o.DecodeBatchSize, ""+
+		"The number of consecutive records decoded by a decode worker at a time.")
+	fs.IntVar(&o.RedisReadTimeout, "redis-read-timeout", o.RedisReadTimeout, ""+
+		"The timeout (in seconds) of the reads from the analytics Redis storage. Defaults to --redis.timeout.")
+	fs.IntVar(&o.RedisWriteTimeout, "redis-write-timeout", o.RedisWriteTimeout, ""+
+		"The timeout (in seconds) of the writes to the analytics Redis storage. Defaults to --redis.timeout.")
+	fs.IntVar(&o.RedisSlowThreshold, "redis-slow-threshold", o.RedisSlowThreshold, ""+
+		"The duration (in milliseconds) above which a command to the analytics Redis storage is logged as slow. 0 disables the log.")
+	fs.StringVar(&o.KeyTypeCheck, "key-type-check", o.KeyTypeCheck, ""+
+		"What to do at startup when the analytics key exists in Redis with another type than the list iam-pump drains, "+
+		"e.g. when the producer writes a set or a string. One of warn, fail or off.")
+	fs.IntVar(&o.MemoryLimit, "memory-limit", o.MemoryLimit, ""+
+		"The soft memory limit (in MB) of the Go runtime, the GC runs more often as the memory of iam-pump gets close to it. "+
+		"Set it below the memory limit of the container. 0 keeps the GOMEMLIMIT environment variable, or no limit.")
+	fs.IntVar(&o.GCPercent, "gc-percent", o.GCPercent, ""+
+		"The GC target percentage of the Go runtime, as GOGC. A negative value disables the GC, which is only sensible "+
+		"along with --memory-limit. 0 keeps the GOGC environment variable, or 100.")
+	fs.IntVar(&o.WatchdogWindows, "watchdog-windows", o.WatchdogWindows, ""+
+		"The number of consecutive purge windows without a completed write after which a pump is considered stuck "+
+		"and restarted: shut down and initialized again. 0 disables the watchdog.")
+	fs.StringVar(&o.Codec, "codec", o.Codec, ""+
+		"The encoding of the analytics records: msgpack, json, protobuf (the AnalyticsRecord message of "+
+		"analytics.proto) or auto to detect the encoding of every record, letting producers other than "+
+		"iam-authz-server push records to the same key.")
+	fs.Float64Var(&o.DecodeErrorThreshold, "decode-error-threshold", o.DecodeErrorThreshold, ""+
+		"The fraction, between 0 and 1, of the records of a purge window failing to decode from which the window "+
+		"counts as failing. The purge loop halts after --decode-error-windows failing windows, leaving the analytics "+
+		"data in redis, along with the undecodable records of the failing windows, and reporting unhealthy until "+
+		"restarted. 0 disables the check.")
+	fs.IntVar(&o.DecodeErrorWindows, "decode-error-windows", o.DecodeErrorWindows, ""+
+		"The number of consecutive purge windows above --decode-error-threshold which halt the purge loop.")
+	fs.BoolVar(&o.WatchConfig, "watch-config", o.WatchConfig, ""+
+		"Reload the configuration file whenever it changes, as on SIGHUP. The added pumps are initialized, the removed "+
+		"and changed ones shut down once their buffered records are written, the unchanged ones keep running.")
+	fs.StringVar(&o.AuditLogFile, "audit-log-file", o.AuditLogFile, ""+
+		"If set, a json summary of the purge window of every source (records read, written, filtered, dropped, "+
+		"errored and the pump errors) is appended to the file, independently of the application log.")
+	fs.IntVar(&o.AuditLogMaxSize, "audit-log-max-size", o.AuditLogMaxSize, ""+
+		"The size, in megabytes, above which the audit log file is rotated. 0 disables the rotation.")
+	fs.IntVar(&o.AuditLogMaxBackups, "audit-log-max-backups", o.AuditLogMaxBackups, ""+
+		"The number of rotated audit log files to keep. 0 keeps them all.")
 
 	return fss
 }
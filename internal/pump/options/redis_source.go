@@ -0,0 +1,53 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	genericoptions "github.com/marmotedu/iam/internal/pkg/options"
+)
+
+// RedisSourceOptions defines options for the redis analytics source, the redis options shared
+// with iam-authz-server along with those only supported by iam-pump.
+type RedisSourceOptions struct {
+	genericoptions.RedisOptions `mapstructure:",squash"`
+
+	SentinelPassword string `json:"sentinel-password" mapstructure:"sentinel-password"`
+	SSLCAFile        string `json:"ssl-ca-file"       mapstructure:"ssl-ca-file"`
+	SSLCertFile      string `json:"ssl-cert-file"     mapstructure:"ssl-cert-file"`
+	SSLKeyFile       string `json:"ssl-key-file"      mapstructure:"ssl-key-file"`
+}
+
+// NewRedisSourceOptions create a `zero` value instance.
+func NewRedisSourceOptions() *RedisSourceOptions {
+	return &RedisSourceOptions{RedisOptions: *genericoptions.NewRedisOptions()}
+}
+
+// Validate verifies flags passed to RedisSourceOptions.
+func (o *RedisSourceOptions) Validate() []error {
+	errs := o.RedisOptions.Validate()
+
+	if (o.SSLCertFile == "") != (o.SSLKeyFile == "") {
+		errs = append(errs, fmt.Errorf("--redis.ssl-cert-file and --redis.ssl-key-file must be set together"))
+	}
+
+	return errs
+}
+
+// AddFlags adds flags related to the redis analytics source to the specified FlagSet.
+func (o *RedisSourceOptions) AddFlags(fs *pflag.FlagSet) {
+	o.RedisOptions.AddFlags(fs)
+
+	fs.StringVar(&o.SentinelPassword, "redis.sentinel-password", o.SentinelPassword, ""+
+		"The password of the Redis Sentinels, used to discover the master when --redis.master-name is set.")
+	fs.StringVar(&o.SSLCAFile, "redis.ssl-ca-file", o.SSLCAFile, ""+
+		"The CA certificates verifying the Redis server when --redis.use-ssl is set, instead of the system ones.")
+	fs.StringVar(&o.SSLCertFile, "redis.ssl-cert-file", o.SSLCertFile, ""+
+		"The client certificate presented to the Redis server when --redis.use-ssl is set.")
+	fs.StringVar(&o.SSLKeyFile, "redis.ssl-key-file", o.SSLKeyFile, "The private key of --redis.ssl-cert-file.")
+}
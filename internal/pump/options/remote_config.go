@@ -0,0 +1,203 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/marmotedu/iam/internal/pump/remoteconfig"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// RemoteConfigOptions defines options for reading the iam-pump configuration from a key of a
+// Consul or etcd KV store, watched for changes.
+type RemoteConfigOptions struct {
+	Provider string `json:"provider" mapstructure:"provider"`
+	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
+	Path     string `json:"path"     mapstructure:"path"`
+	Format   string `json:"format"   mapstructure:"format"`
+	Watch    bool   `json:"watch"    mapstructure:"watch"`
+}
+
+// NewRemoteConfigOptions create a `zero` value instance.
+func NewRemoteConfigOptions() *RemoteConfigOptions {
+	return &RemoteConfigOptions{
+		Format: "yaml",
+		Watch:  true,
+	}
+}
+
+// Enabled reports whether the configuration is read from a KV store.
+func (o *RemoteConfigOptions) Enabled() bool {
+	return o != nil && o.Provider != ""
+}
+
+// Validate verifies flags passed to RemoteConfigOptions.
+func (o *RemoteConfigOptions) Validate() []error {
+	errs := []error{}
+
+	if !o.Enabled() {
+		return errs
+	}
+
+	switch o.Provider {
+	case remoteconfig.ProviderConsul, remoteconfig.ProviderEtcd:
+	default:
+		errs = append(errs, fmt.Errorf("--remote-config.provider must be %s or %s",
+			remoteconfig.ProviderConsul, remoteconfig.ProviderEtcd))
+	}
+
+	if o.Endpoint == "" || o.Path == "" {
+		errs = append(errs, fmt.Errorf("--remote-config.endpoint and --remote-config.path must be set with --remote-config.provider"))
+	}
+
+	switch o.Format {
+	case "json", "yaml", "yml", "toml":
+	default:
+		errs = append(errs, fmt.Errorf("--remote-config.format must be json, yaml or toml"))
+	}
+
+	return errs
+}
+
+// AddFlags adds flags related to the remote configuration to the specified FlagSet.
+func (o *RemoteConfigOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Provider, "remote-config.provider", o.Provider, ""+
+		"The KV store the configuration is read from, consul or etcd (v3 API). The options it sets override the "+
+		"ones of the configuration file and flags.")
+	fs.StringVar(&o.Endpoint, "remote-config.endpoint", o.Endpoint, ""+
+		"The address of the KV store, e.g. http://127.0.0.1:8500 for consul, a comma separated list for etcd. "+
+		"The consul ACL token is read from the CONSUL_HTTP_TOKEN environment variable.")
+	fs.StringVar(&o.Path, "remote-config.path", o.Path, "The key holding the configuration.")
+	fs.StringVar(&o.Format, "remote-config.format", o.Format, "The format of the configuration, json, yaml or toml.")
+	fs.BoolVar(&o.Watch, "remote-config.watch", o.Watch, ""+
+		"Watch the key and reload the pumps configuration when it changes.")
+}
+
+// Complete reads the options set in the remote configuration, when enabled.
+func (o *Options) Complete() error {
+	if !o.RemoteConfig.Enabled() {
+		return nil
+	}
+
+	if errs := o.RemoteConfig.Validate(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	v, err := o.RemoteConfig.viper()
+	if err != nil {
+		return err
+	}
+
+	if err := v.ReadRemoteConfig(); err != nil {
+		return errors.Wrapf(err, "failed to read the remote configuration %s", o.RemoteConfig.Path)
+	}
+
+	// the pumps of the remote configuration replace the local ones instead of being merged
+	if v.IsSet("pumps") {
+		o.Pumps = nil
+	}
+
+	if err := v.Unmarshal(o); err != nil {
+		return errors.Wrapf(err, "failed to decode the remote configuration %s", o.RemoteConfig.Path)
+	}
+
+	log.Infof("Read the configuration from %s key %s", o.RemoteConfig.Provider, o.RemoteConfig.Path)
+
+	return nil
+}
+
+// WatchRemoteConfig sends the options updated with the remote configuration every time it
+// changes, until stopCh is closed. The channel is nil when the remote configuration is not
+// watched.
+func (o *Options) WatchRemoteConfig(stopCh <-chan struct{}) (<-chan *Options, error) {
+	if !o.RemoteConfig.Enabled() || !o.RemoteConfig.Watch {
+		return nil, nil
+	}
+
+	// the options are updated on a copy, the current ones are still in use
+	current, err := json.Marshal(o)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copy the options")
+	}
+
+	key := remoteconfig.NewKey(o.RemoteConfig.Provider, o.RemoteConfig.Endpoint, o.RemoteConfig.Path)
+	responses, quit := viper.RemoteConfig.WatchChannel(key)
+	updates := make(chan *Options)
+	go func() {
+		defer close(quit)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case resp, ok := <-responses:
+				if !ok {
+					return
+				}
+
+				updated, err := o.updated(current, resp.Value)
+				if err != nil {
+					log.Errorf("Ignoring the invalid remote configuration %s: %s", o.RemoteConfig.Path, err.Error())
+
+					continue
+				}
+
+				select {
+				case updates <- updated:
+				case <-stopCh:
+					return
+				}
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// updated returns the options decoded from current, overridden by the remote configuration.
+func (o *Options) updated(current []byte, remote []byte) (*Options, error) {
+	updated := NewOptions()
+	if err := json.Unmarshal(current, updated); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigType(o.RemoteConfig.Format)
+	if err := v.ReadConfig(bytes.NewReader(remote)); err != nil {
+		return nil, err
+	}
+
+	if v.IsSet("pumps") {
+		updated.Pumps = nil
+	}
+
+	if err := v.Unmarshal(updated); err != nil {
+		return nil, err
+	}
+
+	if errs := updated.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return updated, nil
+}
+
+// viper returns a viper instance reading the remote configuration.
+func (o *RemoteConfigOptions) viper() (*viper.Viper, error) {
+	v := viper.New()
+	if err := v.AddRemoteProvider(o.Provider, o.Endpoint, o.Path); err != nil {
+		return nil, errors.Wrap(err, "invalid remote configuration")
+	}
+	v.SetConfigType(o.Format)
+
+	return v, nil
+}
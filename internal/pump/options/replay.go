@@ -0,0 +1,58 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+
+	cliflag "github.com/marmotedu/component-base/pkg/cli/flag"
+)
+
+// ReplayOptions defines the options of the replay command, which writes the dead-lettered records
+// of a pump to it again.
+type ReplayOptions struct {
+	Pump      string `json:"pump"       mapstructure:"pump"`
+	Rate      int    `json:"rate"       mapstructure:"rate"`
+	BatchSize int    `json:"batch-size" mapstructure:"batch-size"`
+}
+
+// NewReplayOptions creates a new ReplayOptions object with default parameters.
+func NewReplayOptions() *ReplayOptions {
+	return &ReplayOptions{
+		BatchSize: 1000,
+	}
+}
+
+// Flags returns flags for the replay command by section name.
+func (o *ReplayOptions) Flags() (fss cliflag.NamedFlagSets) {
+	fs := fss.FlagSet("replay")
+	fs.StringVar(&o.Pump, "pump", o.Pump, ""+
+		"The name of the pump, as configured in the pumps section, whose dead-lettered records are replayed.")
+	fs.IntVar(&o.Rate, "rate", o.Rate, ""+
+		"The maximum number of records replayed per second. 0 means no limit.")
+	fs.IntVar(&o.BatchSize, "batch-size", o.BatchSize, ""+
+		"The number of records read from the dead-letter queue and written to the pump at once.")
+
+	return fss
+}
+
+// Validate checks ReplayOptions and return a slice of found errs.
+func (o *ReplayOptions) Validate() []error {
+	var errs []error
+
+	if o.Pump == "" {
+		errs = append(errs, fmt.Errorf("--pump must be set"))
+	}
+
+	if o.Rate < 0 {
+		errs = append(errs, fmt.Errorf("--rate cannot be negative"))
+	}
+
+	if o.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("--batch-size must be positive"))
+	}
+
+	return errs
+}
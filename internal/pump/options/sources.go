@@ -0,0 +1,83 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// SourceConfig defines an additional analytics source, e.g. another redis cluster or another
+// key, purged into the pumps by its own loop.
+type SourceConfig struct {
+	// Source is the type of the source, redis, kafka, nats or amqp, redis by default.
+	Source string `json:"source" mapstructure:"source"`
+	// Key is the redis key drained, the key iam-authz-server writes by default.
+	Key string `json:"key"    mapstructure:"key"`
+	// Meta holds the options of the source, those of the redis, kafka-source, nats-source or
+	// amqp-source sections, the unset options taking their default values.
+	Meta map[string]interface{} `json:"meta"   mapstructure:"meta"`
+}
+
+// StorageOptions returns the options of the storage of the source, decoded from its meta over the
+// default options of its type.
+func (c SourceConfig) StorageOptions() (interface{}, error) {
+	var conf interface{}
+	switch c.Source {
+	case "", SourceRedis:
+		conf = NewRedisSourceOptions()
+	case SourceKafka:
+		conf = NewKafkaSourceOptions()
+	case SourceNATS:
+		conf = NewNATSSourceOptions()
+	case SourceAMQP:
+		conf = NewAMQPSourceOptions()
+	default:
+		return nil, fmt.Errorf("source must be %s, %s, %s or %s", SourceRedis, SourceKafka, SourceNATS, SourceAMQP)
+	}
+
+	if err := mapstructure.Decode(c.Meta, conf); err != nil {
+		return nil, fmt.Errorf("invalid meta: %w", err)
+	}
+
+	return conf, nil
+}
+
+// validate verifies the options of the source.
+func (c SourceConfig) validate() []error {
+	conf, err := c.StorageOptions()
+	if err != nil {
+		return []error{err}
+	}
+
+	switch conf := conf.(type) {
+	case *RedisSourceOptions:
+		return conf.Validate()
+	case *KafkaSourceOptions:
+		errs := conf.Validate()
+		if len(conf.Brokers) == 0 {
+			errs = append(errs, fmt.Errorf("brokers must be set"))
+		}
+
+		return errs
+	case *NATSSourceOptions:
+		errs := conf.Validate()
+		if len(conf.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("urls must be set"))
+		}
+
+		return errs
+	case *AMQPSourceOptions:
+		errs := conf.Validate()
+		if conf.URL == "" {
+			errs = append(errs, fmt.Errorf("url must be set"))
+		}
+
+		return errs
+	}
+
+	return nil
+}
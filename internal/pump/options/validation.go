@@ -4,12 +4,313 @@
 
 package options
 
+import (
+	"fmt"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
 // Validate checks Options and return a slice of found errs.
 func (o *Options) Validate() []error {
 	var errs []error
 
 	errs = append(errs, o.RedisOptions.Validate()...)
+
+	switch o.Source {
+	case "", SourceRedis:
+	case SourceKafka:
+		errs = append(errs, o.KafkaSource.Validate()...)
+		if len(o.KafkaSource.Brokers) == 0 {
+			errs = append(errs, fmt.Errorf("--kafka-source.brokers must be set with --source=kafka"))
+		}
+	case SourceNATS:
+		errs = append(errs, o.NATSSource.Validate()...)
+		if len(o.NATSSource.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("--nats-source.urls must be set with --source=nats"))
+		}
+	case SourceAMQP:
+		errs = append(errs, o.AMQPSource.Validate()...)
+		if o.AMQPSource.URL == "" {
+			errs = append(errs, fmt.Errorf("--amqp-source.url must be set with --source=amqp"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("--source must be %s, %s, %s or %s", SourceRedis, SourceKafka, SourceNATS, SourceAMQP))
+	}
+
+	for name, source := range o.Sources {
+		for _, err := range source.validate() {
+			errs = append(errs, fmt.Errorf("source %s: %w", name, err))
+		}
+		if source.Key != "" && source.Source != "" && source.Source != SourceRedis {
+			errs = append(errs, fmt.Errorf("source %s: key is only supported by the redis sources", name))
+		}
+	}
+
+	errs = append(errs, o.Lookup.Validate()...)
 	errs = append(errs, o.Log.Validate()...)
 
+	if o.InitTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--init-timeout cannot be negative"))
+	}
+
+	if o.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--shutdown-timeout cannot be negative"))
+	}
+
+	if o.DedupWindow < 0 {
+		errs = append(errs, fmt.Errorf("--dedup-window cannot be negative"))
+	}
+
+	if o.MaxPumps < 0 {
+		errs = append(errs, fmt.Errorf("--max-pumps cannot be negative"))
+	}
+
+	if o.DecodeWorkers < 0 {
+		errs = append(errs, fmt.Errorf("--decode-workers cannot be negative"))
+	}
+
+	if o.DecodeBatchSize < 0 {
+		errs = append(errs, fmt.Errorf("--decode-batch-size cannot be negative"))
+	}
+
+	if o.MaxBackgroundWorkers < 0 {
+		errs = append(errs, fmt.Errorf("--max-background-workers cannot be negative"))
+	}
+
+	if o.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("--queue-size cannot be negative"))
+	}
+
+	if o.atLeastOnce() && o.QueueSize > 0 {
+		errs = append(errs, fmt.Errorf("--queue-size cannot be set with --at-least-once or a %s, %s or %s --source, "+
+			"the writes of a queued pump complete after the window", SourceKafka, SourceNATS, SourceAMQP))
+	}
+
+	if o.RetainMaxWindows < 0 {
+		errs = append(errs, fmt.Errorf("--retain-max-windows cannot be negative"))
+	}
+
+	switch o.QueuePolicy {
+	case "", QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyDropNewest:
+	default:
+		errs = append(errs, fmt.Errorf("--queue-policy must be %s, %s or %s",
+			QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyDropNewest))
+	}
+
+	if o.PurgeMemoryBudget < 0 {
+		errs = append(errs, fmt.Errorf("--purge-memory-budget cannot be negative"))
+	}
+
+	if o.DeadLetterKey != "" && o.DeadLetterDir != "" {
+		errs = append(errs, fmt.Errorf("--dead-letter-key and --dead-letter-dir are mutually exclusive"))
+	}
+
+	if o.PurgeChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("--purge-chunk-size cannot be negative"))
+	}
+
+	if o.StorageExpirationTime < 0 {
+		errs = append(errs, fmt.Errorf("--storage-expiration-time cannot be negative"))
+	}
+
+	if o.WindowDeadline < 0 {
+		errs = append(errs, fmt.Errorf("--window-deadline cannot be negative"))
+	}
+
+	if o.Retention < 0 {
+		errs = append(errs, fmt.Errorf("--retention cannot be negative"))
+	}
+
+	if o.RedisReadTimeout < 0 || o.RedisWriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--redis-read-timeout and --redis-write-timeout cannot be negative"))
+	}
+
+	if o.RedisSlowThreshold < 0 {
+		errs = append(errs, fmt.Errorf("--redis-slow-threshold cannot be negative"))
+	}
+
+	if o.WatchdogWindows < 0 {
+		errs = append(errs, fmt.Errorf("--watchdog-windows cannot be negative"))
+	}
+
+	if o.DecodeErrorThreshold < 0 || o.DecodeErrorThreshold > 1 {
+		errs = append(errs, fmt.Errorf("--decode-error-threshold must be between 0 and 1"))
+	}
+
+	if o.DecodeErrorWindows < 0 {
+		errs = append(errs, fmt.Errorf("--decode-error-windows cannot be negative"))
+	}
+
+	if o.AuditLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("--audit-log-max-size cannot be negative"))
+	}
+
+	if o.AuditLogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("--audit-log-max-backups cannot be negative"))
+	}
+
+	if o.MemoryLimit < 0 {
+		errs = append(errs, fmt.Errorf("--memory-limit cannot be negative"))
+	}
+
+	switch o.Codec {
+	case "", CodecMsgpack, CodecJSON, CodecProtobuf, CodecAuto:
+	default:
+		errs = append(errs, fmt.Errorf("--codec must be %s, %s, %s or %s",
+			CodecMsgpack, CodecJSON, CodecProtobuf, CodecAuto))
+	}
+
+	switch o.KeyTypeCheck {
+	case KeyTypeCheckWarn, KeyTypeCheckFail, KeyTypeCheckOff:
+	default:
+		errs = append(errs, fmt.Errorf("--key-type-check must be %s, %s or %s",
+			KeyTypeCheckWarn, KeyTypeCheckFail, KeyTypeCheckOff))
+	}
+
+	if err := analytics.ValidateFieldNames(o.OmittedFields); err != nil {
+		errs = append(errs, fmt.Errorf("--omitted-fields: %w", err))
+	}
+
+	for name, pmp := range o.Pumps {
+		if err := analytics.ValidateFieldNames(pmp.OmittedFields); err != nil {
+			errs = append(errs, fmt.Errorf("omitted-fields of pump %s: %w", name, err))
+		}
+
+		if pmp.Retention < 0 {
+			errs = append(errs, fmt.Errorf("retention of pump %s cannot be negative", name))
+		}
+
+		if pmp.PurgeDelay < 0 {
+			errs = append(errs, fmt.Errorf("purge-delay of pump %s cannot be negative", name))
+		}
+
+		if pmp.MaxRetries < 0 {
+			errs = append(errs, fmt.Errorf("max-retries of pump %s cannot be negative", name))
+		}
+
+		if pmp.RetryBackoff < 0 || pmp.MaxRetryBackoff < 0 {
+			errs = append(errs, fmt.Errorf("retry-backoff and max-retry-backoff of pump %s cannot be negative", name))
+		}
+
+		switch pmp.OnMissingFields {
+		case "", OnMissingFieldsDrop, OnMissingFieldsDeadLetter:
+		default:
+			errs = append(errs, fmt.Errorf("on-missing-fields of pump %s must be %s or %s",
+				name, OnMissingFieldsDrop, OnMissingFieldsDeadLetter))
+		}
+
+		switch pmp.ScrubMode {
+		case "", ScrubModeClear, ScrubModeHash:
+		default:
+			errs = append(errs, fmt.Errorf("scrub-mode of pump %s must be %s or %s", name, ScrubModeClear, ScrubModeHash))
+		}
+
+		if pmp.QueueSize < 0 {
+			errs = append(errs, fmt.Errorf("queue-size of pump %s cannot be negative", name))
+		}
+
+		switch pmp.QueuePolicy {
+		case "", QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyDropNewest:
+		default:
+			errs = append(errs, fmt.Errorf("queue-policy of pump %s must be %s, %s or %s",
+				name, QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyDropNewest))
+		}
+
+		if o.atLeastOnce() && pmp.QueueSize > 0 {
+			errs = append(errs, fmt.Errorf("queue-size of pump %s cannot be set with --at-least-once or a %s, %s or %s "+
+				"--source, the writes of a queued pump complete after the window", name, SourceKafka, SourceNATS, SourceAMQP))
+		}
+
+		if pmp.RetainSourceUntilSuccess && pmp.QueueSize > 0 {
+			errs = append(errs, fmt.Errorf("retain-source-until-success of pump %s cannot be set with queue-size, "+
+				"the writes of a queued pump complete after the window", name))
+		}
+
+		if pmp.MaxRecordAge < 0 || pmp.MaxRecordSize < 0 {
+			errs = append(errs, fmt.Errorf("max-record-age and max-record-size of pump %s cannot be negative", name))
+		}
+
+		if pmp.SampleRate < 0 || pmp.SampleRate > 1 {
+			errs = append(errs, fmt.Errorf("sample-rate of pump %s must be between 0 and 1", name))
+		}
+
+		if pmp.BreakerThreshold < 0 || pmp.BreakerCooldown < 0 {
+			errs = append(errs, fmt.Errorf("breaker-threshold and breaker-cooldown of pump %s cannot be negative", name))
+		}
+
+		switch pmp.OnError {
+		case "", OnErrorContinue, OnErrorAbort:
+		default:
+			errs = append(errs, fmt.Errorf("on-error of pump %s must be %s or %s", name, OnErrorContinue, OnErrorAbort))
+		}
+	}
+
+	errs = append(errs, o.validateRoutes()...)
+	errs = append(errs, o.validateEnrichers()...)
+
+	if o.DropSampleRate < 0 || o.DropSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("--drop-sample-rate must be between 0 and 1"))
+	}
+
+	if _, ok := o.Pumps[o.DropSamplePump]; o.DropSamplePump != "" && !ok {
+		errs = append(errs, fmt.Errorf("--drop-sample-pump references pump %s which is not configured", o.DropSamplePump))
+	}
+
+	if len(o.CoalesceFields) > 0 && analytics.IsRecordField(o.CoalesceCountField) {
+		errs = append(errs, fmt.Errorf("--coalesce-count-field %s clashes with an analytics record field", o.CoalesceCountField))
+	}
+
+	if o.InstanceField != "" && analytics.IsRecordField(o.InstanceField) {
+		errs = append(errs, fmt.Errorf("--instance-field %s clashes with an analytics record field", o.InstanceField))
+	}
+
 	return errs
 }
+
+func (o *Options) validateRoutes() []error {
+	var errs []error
+
+	checkPumps := func(names []string, where string) {
+		for _, name := range names {
+			if _, ok := o.Pumps[name]; !ok {
+				errs = append(errs, fmt.Errorf("%s references pump %s which is not configured", where, name))
+			}
+		}
+	}
+
+	for i, route := range o.Routes {
+		where := fmt.Sprintf("route %d", i)
+		if len(route.Match) == 0 || len(route.Pumps) == 0 {
+			errs = append(errs, fmt.Errorf("%s must have match conditions and pumps", where))
+		}
+
+		for _, condition := range route.Match {
+			if condition.Field == "" || len(condition.Values) == 0 {
+				errs = append(errs, fmt.Errorf("%s has a condition without field or values", where))
+			}
+		}
+		checkPumps(route.Pumps, where)
+	}
+
+	checkPumps(o.DefaultPumps, "--default-pumps")
+
+	return errs
+}
+
+// validateEnrichers verifies that every enricher has a type.
+func (o *Options) validateEnrichers() []error {
+	var errs []error
+	for i, enricher := range o.Enrichers {
+		if enricher.Type == "" {
+			errs = append(errs, fmt.Errorf("enricher %d must have a type", i))
+		}
+	}
+
+	return errs
+}
+
+// atLeastOnce reports whether the records read from the source are acknowledged once every pump
+// wrote them: in at-least-once mode, or when consumed from kafka, nats or amqp.
+func (o *Options) atLeastOnce() bool {
+	return o.AtLeastOnce || (o.Source != "" && o.Source != SourceRedis)
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// pauseCheckTimeout bounds the redis lookup of the pause key, so that a slow redis
+// does not stall the purge loop on the maintenance switch itself.
+const pauseCheckTimeout = 2 * time.Second
+
+// checkPaused evaluates the maintenance switch, records the result and logs state transitions.
+// While paused the purge loop leaves the analytics data in the source untouched.
+func (s *pumpServer) checkPaused() bool {
+	paused := s.pauseRequested()
+
+	var state int32
+	if paused {
+		state = 1
+	}
+
+	if old := atomic.SwapInt32(&s.paused, state); old != state {
+		if paused {
+			log.Warn("Maintenance switch is set, pausing purge loop")
+		} else {
+			log.Info("Maintenance switch is cleared, resuming purge loop")
+		}
+	}
+
+	metrics.Paused.Set(float64(state))
+
+	return paused
+}
+
+// isPaused returns the last evaluated state of the maintenance switch.
+func (s *pumpServer) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+func (s *pumpServer) pauseRequested() bool {
+	if s.pauseFile != "" {
+		if _, err := os.Stat(s.pauseFile); err == nil {
+			return true
+		}
+	}
+
+	if s.pauseRedisKey != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), pauseCheckTimeout)
+		defer cancel()
+
+		n, err := s.client.Exists(ctx, s.pauseRedisKey).Result()
+		if err != nil {
+			// keep the previous state rather than flapping on a transient redis error
+			log.Warnf("Failed to check pause key %s in redis: %s", s.pauseRedisKey, err.Error())
+
+			return s.isPaused()
+		}
+
+		if n > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	goredislib "github.com/go-redis/redis/v8"
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+)
+
+func TestPauseFile(t *testing.T) {
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	store := &chunkedStore{values: []interface{}{string(b)}}
+	mock := &mockPump{}
+	pauseFile := filepath.Join(t.TempDir(), "pause")
+	s := &pumpServer{
+		secInterval:    1,
+		pauseFile:      pauseFile,
+		analyticsStore: store,
+		pmps:           []*pumpInstance{{Pump: mock, name: "mock"}},
+	}
+	s.publishPumps()
+
+	status := func() string {
+		recorder := httptest.NewRecorder()
+		s.serveHealth(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		var state health
+		if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+
+		return state.Status
+	}
+
+	if err := os.WriteFile(pauseFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.pump()
+	if len(store.values) != 1 || len(mock.records()) != 0 {
+		t.Fatalf("the purge should be skipped while paused, got %d records left", len(store.values))
+	}
+	if state := status(); state != healthPaused {
+		t.Fatalf("the health check should report the pause, got %s", state)
+	}
+	if paused := testutil.ToFloat64(metrics.Paused); paused != 1 {
+		t.Fatalf("the pause gauge should be set, got %v", paused)
+	}
+
+	if err := os.Remove(pauseFile); err != nil {
+		t.Fatal(err)
+	}
+
+	s.pump()
+	if len(store.values) != 0 || len(mock.records()) != 1 {
+		t.Fatalf("the purge should resume once the pause file is removed, got %d records left", len(store.values))
+	}
+	if state := status(); state != healthOK {
+		t.Fatalf("the health check should report the resumed purge, got %s", state)
+	}
+	if paused := testutil.ToFloat64(metrics.Paused); paused != 0 {
+		t.Fatalf("the pause gauge should be cleared, got %v", paused)
+	}
+}
+
+func TestPauseRedisKeyUnreachable(t *testing.T) {
+	s := &pumpServer{
+		pauseRedisKey: "iam-pump:pause",
+		client:        goredislib.NewClient(&goredislib.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond}),
+		paused:        1,
+	}
+	defer s.client.Close()
+
+	// a redis error keeps the previous state rather than resuming the purge
+	if !s.checkPaused() {
+		t.Fatal("the pause should be kept while the pause key can not be checked")
+	}
+
+	s.paused = 0
+	if s.checkPaused() {
+		t.Fatal("the purge should keep running while the pause key can not be checked")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// warnFieldCollisions warns about the fields of the documents written by the pump which are set
+// by several sources, e.g. a static metadata named after a record field. The value written is the
+// one of the source with the highest field precedence of the pump.
+func (s *pumpServer) warnFieldCollisions(key string, pmp options.PumpConfig) {
+	collisions := analytics.FieldCollisions(pmp.Format, s.enrichmentFields(pmp),
+		pumps.StaticFieldNames(pmp.Meta), pmp.FieldPrecedence)
+
+	for _, collision := range collisions {
+		sources := make([]string, 0, len(collision.Sources))
+		for i, source := range collision.Sources {
+			sources = append(sources, fmt.Sprintf("%s %s", source, collision.Names[i]))
+		}
+
+		winner := len(collision.Sources) - 1
+		log.Warnf("Pump %s: field %s is set by %s, the %s value is written (see field-precedence)",
+			key, collision.Field, strings.Join(sources, ", "), sources[winner])
+	}
+}
+
+// enrichmentFields returns the names of the extra fields the pipeline attaches to the records
+// written to the pump.
+func (s *pumpServer) enrichmentFields(pmp options.PumpConfig) []string {
+	fields := make([]string, 0, 3)
+	if s.instanceField != "" {
+		fields = append(fields, s.instanceField)
+	}
+
+	if s.coalescer != nil {
+		fields = append(fields, s.coalescer.countField)
+	}
+
+	if pmp.SampleRate > 0 && pmp.SampleRate < 1 {
+		fields = append(fields, sampleRateField(pmp.SampleRateField))
+	}
+
+	return append(fields, s.lookup.attributes()...)
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"time"
+
+	"github.com/marmotedu/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// protobufDecoder decodes the analytics records encoded with the AnalyticsRecord message of
+// analytics/analytics.proto. The wire format is read directly, the unknown fields are skipped so
+// that the producers can extend the message.
+type protobufDecoder struct{}
+
+func (protobufDecoder) decode(raw string, record *analytics.AnalyticsRecord) error {
+	b := []byte(raw)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid protobuf analytics record")
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			record.TimeStamp = int64(v)
+		case num >= 2 && num <= 7 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			*stringField(record, num) = string(v)
+		case num == 8 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := decodeTimestamp(v, &record.ExpireAt); err != nil {
+					return err
+				}
+			}
+		case num == 9 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := decodeExtra(v, record); err != nil {
+					return err
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.Wrapf(protowire.ParseError(n), "invalid field %d of protobuf analytics record", num)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// stringField returns the string field of the record with the given field number.
+func stringField(record *analytics.AnalyticsRecord, num protowire.Number) *string {
+	switch num {
+	case 2:
+		return &record.Username
+	case 3:
+		return &record.Effect
+	case 4:
+		return &record.Conclusion
+	case 5:
+		return &record.Request
+	case 6:
+		return &record.Policies
+	default:
+		return &record.Deciders
+	}
+}
+
+// decodeTimestamp decodes a google.protobuf.Timestamp message.
+func decodeTimestamp(b []byte, t *time.Time) error {
+	var seconds, nanos uint64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid protobuf timestamp")
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			seconds, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.VarintType:
+			nanos, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid protobuf timestamp")
+		}
+		b = b[n:]
+	}
+
+	*t = time.Unix(int64(seconds), int64(int32(nanos))).UTC()
+
+	return nil
+}
+
+// decodeExtra decodes an entry of the extra map<string, string> field into the extra fields of the record.
+func decodeExtra(b []byte, record *analytics.AnalyticsRecord) error {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid protobuf extra field")
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			key = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			value = string(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid protobuf extra field")
+		}
+		b = b[n:]
+	}
+
+	record.SetExtra(key, value)
+
+	return nil
+}
@@ -0,0 +1,615 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the ingestion types supported by the adx pump.
+const (
+	// AdxQueuedIngestion uploads the batches to the cluster temporary storage and queues them for
+	// ingestion, it is the recommended mode for high volumes.
+	AdxQueuedIngestion = "queued"
+	// AdxStreamingIngestion posts the batches to the cluster, which ingests them synchronously.
+	// Streaming ingestion must be enabled on the cluster.
+	AdxStreamingIngestion = "streaming"
+)
+
+// adxResourcesTTL is how long the ingestion resources of the cluster are cached.
+const adxResourcesTTL = time.Hour
+
+// adxColumns defines the columns of the analytics table, in the order of the table schema.
+var adxColumns = []struct {
+	name string
+	typ  string
+}{
+	{"timestamp", "long"},
+	{"username", "string"},
+	{"effect", "string"},
+	{"conclusion", "string"},
+	{"request", "string"},
+	{"policies", "string"},
+	{"deciders", "string"},
+	{"expireAt", "datetime"},
+	{"extra", "dynamic"},
+}
+
+// AdxPump defines a pump which ingests analytics records into Azure Data Explorer (Kusto).
+type AdxPump struct {
+	conf   *AdxConf
+	client *http.Client
+	token  *adxTokenSource
+
+	mu        sync.Mutex
+	resources *adxIngestionResources
+
+	CommonPumpConfig
+}
+
+// AdxConf defines adx specific options.
+type AdxConf struct {
+	ClusterURI    string `mapstructure:"cluster_uri"`
+	IngestURI     string `mapstructure:"ingest_uri"`
+	Database      string `mapstructure:"database"`
+	Table         string `mapstructure:"table"`
+	MappingName   string `mapstructure:"mapping_name"`
+	IngestionType string `mapstructure:"ingestion_type"`
+	// TenantID, ClientID and ClientSecret authenticate the pump as an AAD service principal.
+	TenantID     string `mapstructure:"tenant_id"`
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	// UseManagedIdentity authenticates the pump with the managed identity of the host, ClientID
+	// selects a user-assigned identity.
+	UseManagedIdentity bool `mapstructure:"use_managed_identity"`
+	// MultipartConf uploads the large batches of the queued ingestion in blocks.
+	MultipartConf `mapstructure:",squash"`
+}
+
+type adxIngestionResources struct {
+	queues    []string
+	storages  []string
+	authToken string
+	expireAt  time.Time
+	next      int
+}
+
+// New create an adx pump instance.
+func (a *AdxPump) New() Pump {
+	newPump := AdxPump{}
+
+	return &newPump
+}
+
+// GetName returns the adx pump name.
+func (a *AdxPump) GetName() string {
+	return "Azure Data Explorer Pump"
+}
+
+// Init initialize the adx pump instance, creating the analytics table and its ingestion mapping if absent.
+func (a *AdxPump) Init(config interface{}) error {
+	a.conf = &AdxConf{}
+	if err := mapstructure.Decode(config, &a.conf); err != nil {
+		return errors.Wrap(err, "failed to decode adx configuration")
+	}
+
+	if a.conf.ClusterURI == "" || a.conf.Database == "" || a.conf.Table == "" {
+		return errors.New("adx cluster_uri, database and table must be set")
+	}
+
+	a.conf.ClusterURI = strings.TrimSuffix(a.conf.ClusterURI, "/")
+	if a.conf.IngestURI == "" {
+		a.conf.IngestURI = strings.Replace(a.conf.ClusterURI, "https://", "https://ingest-", 1)
+	}
+	a.conf.IngestURI = strings.TrimSuffix(a.conf.IngestURI, "/")
+
+	if a.conf.MappingName == "" {
+		a.conf.MappingName = a.conf.Table + "_mapping"
+	}
+
+	switch a.conf.IngestionType {
+	case "":
+		a.conf.IngestionType = AdxQueuedIngestion
+	case AdxQueuedIngestion, AdxStreamingIngestion:
+	default:
+		return errors.Errorf("adx ingestion type %s is not supported", a.conf.IngestionType)
+	}
+
+	if err := a.conf.MultipartConf.validate(); err != nil {
+		return errors.Wrap(err, "invalid adx multipart options")
+	}
+
+	if !a.conf.UseManagedIdentity && (a.conf.TenantID == "" || a.conf.ClientID == "" || a.conf.ClientSecret == "") {
+		return errors.New("adx requires tenant_id, client_id and client_secret unless use_managed_identity is set")
+	}
+
+	a.client = &http.Client{}
+	a.token = &adxTokenSource{conf: a.conf, client: a.client}
+
+	ctx := context.Background()
+	if _, err := a.mgmt(ctx, a.conf.ClusterURI, a.createTableCommand()); err != nil {
+		return errors.Wrapf(err, "failed to create adx table %s", a.conf.Table)
+	}
+
+	if _, err := a.mgmt(ctx, a.conf.ClusterURI, a.createMappingCommand()); err != nil {
+		return errors.Wrapf(err, "failed to create adx ingestion mapping %s", a.conf.MappingName)
+	}
+
+	log.Infof("ADX pump ingests into %s.%s with %s ingestion", a.conf.Database, a.conf.Table, a.conf.IngestionType)
+
+	return nil
+}
+
+// WriteData serializes the analytics data as multijson and ingests it into the adx table.
+func (a *AdxPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return errors.Wrap(err, "failed to encode analytics record")
+		}
+	}
+
+	if body.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if a.conf.IngestionType == AdxStreamingIngestion {
+		err = a.streamingIngest(ctx, body.Bytes())
+	} else {
+		err = a.queuedIngest(ctx, body.Bytes())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, body.Len())
+
+	return nil
+}
+
+func (a *AdxPump) createTableCommand() string {
+	columns := make([]string, 0, len(adxColumns))
+	for _, column := range adxColumns {
+		columns = append(columns, fmt.Sprintf("['%s']:%s", column.name, column.typ))
+	}
+
+	return fmt.Sprintf(".create-merge table ['%s'] (%s)", a.conf.Table, strings.Join(columns, ", "))
+}
+
+func (a *AdxPump) createMappingCommand() string {
+	mapping := make([]map[string]interface{}, 0, len(adxColumns))
+	for _, column := range adxColumns {
+		mapping = append(mapping, map[string]interface{}{
+			"column":     column.name,
+			"Properties": map[string]string{"Path": "$." + column.name},
+		})
+	}
+	definition, _ := json.Marshal(mapping)
+
+	return fmt.Sprintf(".create-or-alter table ['%s'] ingestion json mapping '%s' '%s'",
+		a.conf.Table, a.conf.MappingName, definition)
+}
+
+// streamingIngest posts the payload to the streaming ingestion endpoint of the cluster.
+func (a *AdxPump) streamingIngest(ctx context.Context, payload []byte) error {
+	reqURL := fmt.Sprintf("%s/v1/rest/ingest/%s/%s?streamFormat=multijson&mappingName=%s", a.conf.ClusterURI,
+		url.PathEscape(a.conf.Database), url.PathEscape(a.conf.Table), url.QueryEscape(a.conf.MappingName))
+
+	compressed, err := gzipPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(compressed))
+	if err != nil {
+		return errors.Wrap(err, "failed to create adx streaming ingestion request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	return errors.Wrap(a.do(ctx, req, nil), "adx streaming ingestion failed")
+}
+
+// queuedIngest uploads the payload to a temporary storage of the cluster and queues its ingestion.
+// Failures of the ingestion itself are reported by the cluster, see .show ingestion failures.
+func (a *AdxPump) queuedIngest(ctx context.Context, payload []byte) error {
+	storage, queue, authToken, err := a.ingestionResources(ctx)
+	if err != nil {
+		return err
+	}
+
+	compressed, err := gzipPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	blob, err := storageURL(storage, fmt.Sprintf("%s__%s__%s.multijson.gz",
+		a.conf.Database, a.conf.Table, uuid.Must(uuid.NewV4()).String()))
+	if err != nil {
+		return err
+	}
+
+	if err := a.uploadBlob(ctx, blob, compressed); err != nil {
+		return errors.Wrap(err, "failed to upload batch to adx temporary storage")
+	}
+
+	message, _ := json.Marshal(map[string]interface{}{
+		"Id":                  uuid.Must(uuid.NewV4()).String(),
+		"BlobPath":            blob,
+		"RawDataSize":         len(payload),
+		"DatabaseName":        a.conf.Database,
+		"TableName":           a.conf.Table,
+		"RetainBlobOnSuccess": false,
+		"FlushImmediately":    false,
+		"AdditionalProperties": map[string]string{
+			"authorizationContext":      authToken,
+			"format":                    "multijson",
+			"ingestionMappingReference": a.conf.MappingName,
+		},
+	})
+
+	queueURL, err := storageURL(queue, "messages")
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("<QueueMessage><MessageText>%s</MessageText></QueueMessage>",
+		base64.StdEncoding.EncodeToString(message))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, queueURL, strings.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create adx ingestion queue request")
+	}
+
+	req.Header.Set("x-ms-version", "2019-12-12")
+
+	return errors.Wrap(doStorage(a.client, req), "failed to queue adx ingestion")
+}
+
+// uploadBlob uploads the payload to the blob in a single request, or in blocks uploaded in
+// parallel when larger than the multipart threshold.
+func (a *AdxPump) uploadBlob(ctx context.Context, blob string, payload []byte) error {
+	if a.conf.multipart(len(payload)) {
+		return a.conf.upload(ctx, &adxBlockUpload{client: a.client, blob: blob}, payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, blob, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create adx blob upload request")
+	}
+
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", "2019-12-12")
+
+	return doStorage(a.client, req)
+}
+
+// adxBlockUpload uploads a block blob in blocks, the blob is created when its block list is committed.
+type adxBlockUpload struct {
+	client *http.Client
+	blob   string
+}
+
+// blockID returns the id of the block of the given index, the ids of the blocks of a blob must
+// have the same length.
+func (u *adxBlockUpload) blockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", index)))
+}
+
+func (u *adxBlockUpload) request(ctx context.Context, method string, params url.Values, body []byte) error {
+	blob, err := url.Parse(u.blob)
+	if err != nil {
+		return errors.Wrap(err, "invalid adx storage url")
+	}
+
+	query := blob.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	blob.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, blob.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create adx blob upload request")
+	}
+
+	req.Header.Set("x-ms-version", "2019-12-12")
+
+	return doStorage(u.client, req)
+}
+
+func (u *adxBlockUpload) uploadPart(ctx context.Context, index int, part []byte) error {
+	return u.request(ctx, http.MethodPut, url.Values{"comp": {"block"}, "blockid": {u.blockID(index)}}, part)
+}
+
+func (u *adxBlockUpload) complete(ctx context.Context, parts int) error {
+	return u.commit(ctx, parts)
+}
+
+// abort commits an empty block list, which discards the uploaded blocks, then deletes the empty
+// blob. The uncommitted blocks would otherwise be kept for a week.
+func (u *adxBlockUpload) abort(ctx context.Context) error {
+	if err := u.commit(ctx, 0); err != nil {
+		return err
+	}
+
+	return u.request(ctx, http.MethodDelete, nil, nil)
+}
+
+func (u *adxBlockUpload) commit(ctx context.Context, parts int) error {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for index := 0; index < parts; index++ {
+		body.WriteString("<Latest>" + u.blockID(index) + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+
+	return u.request(ctx, http.MethodPut, url.Values{"comp": {"blocklist"}}, []byte(body.String()))
+}
+
+// ingestionResources returns a temporary storage and an ingestion queue of the cluster, used in
+// turn, and the token authorizing the ingestion.
+func (a *AdxPump) ingestionResources(ctx context.Context) (string, string, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.resources == nil || time.Now().After(a.resources.expireAt) {
+		resources, err := a.fetchIngestionResources(ctx)
+		if err != nil {
+			return "", "", "", err
+		}
+		a.resources = resources
+	}
+
+	r := a.resources
+	r.next++
+
+	return r.storages[r.next%len(r.storages)], r.queues[r.next%len(r.queues)], r.authToken, nil
+}
+
+func (a *AdxPump) fetchIngestionResources(ctx context.Context) (*adxIngestionResources, error) {
+	rows, err := a.mgmt(ctx, a.conf.IngestURI, ".get ingestion resources")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get adx ingestion resources")
+	}
+
+	resources := &adxIngestionResources{expireAt: time.Now().Add(adxResourcesTTL)}
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+
+		switch row[0] {
+		case "SecuredReadyForAggregationQueue":
+			resources.queues = append(resources.queues, row[1])
+		case "TempStorage":
+			resources.storages = append(resources.storages, row[1])
+		}
+	}
+
+	if len(resources.queues) == 0 || len(resources.storages) == 0 {
+		return nil, errors.New("adx cluster returned no ingestion queue or temporary storage")
+	}
+
+	rows, err = a.mgmt(ctx, a.conf.IngestURI, ".get kusto identity token")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get adx identity token")
+	}
+
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return nil, errors.New("adx cluster returned no identity token")
+	}
+	resources.authToken = rows[0][0]
+
+	return resources, nil
+}
+
+// mgmt runs a management command against the database and returns the rows of its primary result.
+func (a *AdxPump) mgmt(ctx context.Context, endpoint string, command string) ([][]string, error) {
+	body, _ := json.Marshal(map[string]string{"db": a.conf.Database, "csl": command})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v1/rest/mgmt", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create adx management request")
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	var result struct {
+		Tables []struct {
+			Rows [][]interface{} `json:"Rows"`
+		} `json:"Tables"`
+	}
+	if err := a.do(ctx, req, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result.Tables) == 0 {
+		return nil, nil
+	}
+
+	rows := make([][]string, 0, len(result.Tables[0].Rows))
+	for _, row := range result.Tables[0].Rows {
+		values := make([]string, 0, len(row))
+		for _, value := range row {
+			values = append(values, fmt.Sprint(value))
+		}
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+// do authenticates and sends a request to the cluster, decoding the response into result if not nil.
+func (a *AdxPump) do(ctx context.Context, req *http.Request, result interface{}) error {
+	token, err := a.token.get(ctx, a.conf.ClusterURI)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("x-ms-client-request-id", "iam-pump;"+uuid.Must(uuid.NewV4()).String())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send adx request")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("adx", resp); err != nil {
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(result), "failed to decode adx response")
+}
+
+// adxTokenSource caches the AAD access token of the pump until it expires.
+type adxTokenSource struct {
+	conf   *AdxConf
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	expireAt time.Time
+}
+
+func (t *adxTokenSource) get(ctx context.Context, resource string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.expireAt) {
+		return t.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if t.conf.UseManagedIdentity {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if t.conf.ClientID != "" {
+			query.Set("client_id", t.conf.ClientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	} else {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {t.conf.ClientID},
+			"client_secret": {t.conf.ClientSecret},
+			"scope":         {resource + "/.default"},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(
+			"https://login.microsoftonline.com/%s/oauth2/v2.0/token", url.PathEscape(t.conf.TenantID)),
+			strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create adx token request")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get adx access token")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("adx token endpoint", resp); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   interface{} `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "failed to decode adx access token")
+	}
+
+	// the managed identity endpoint returns expires_in as a string, AAD as a number
+	expiresIn, _ := strconv.ParseInt(fmt.Sprint(result.ExpiresIn), 10, 64)
+	t.token = result.AccessToken
+	// renew the token a minute before it expires
+	t.expireAt = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+
+	return t.token, nil
+}
+
+// storageURL appends name to the path of a storage url carrying a SAS token in its query.
+func storageURL(storage string, name string) (string, error) {
+	u, err := url.Parse(storage)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid adx storage url")
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+
+	return u.String(), nil
+}
+
+func doStorage(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("azure storage", resp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func gzipPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, errors.Wrap(err, "failed to compress payload")
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress payload")
+	}
+
+	return buf.Bytes(), nil
+}
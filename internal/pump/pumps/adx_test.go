@@ -0,0 +1,154 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestAdxPumpIngestion(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+
+		if r.URL.Path != "/v1/rest/mgmt" {
+			w.WriteHeader(http.StatusCreated)
+
+			return
+		}
+
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		rows := [][]string{{"token"}}
+		if body["csl"] == ".get ingestion resources" {
+			rows = [][]string{
+				{"SecuredReadyForAggregationQueue", server.URL + "/queue?sig=sas"},
+				{"TempStorage", server.URL + "/temp?sig=sas"},
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"Tables": []map[string]interface{}{{"Rows": rows}},
+		})
+	}))
+	defer server.Close()
+
+	conf := &AdxConf{
+		ClusterURI:  server.URL,
+		IngestURI:   server.URL,
+		Database:    "iam",
+		Table:       "analytics",
+		MappingName: "analytics_mapping",
+	}
+	pmp := &AdxPump{
+		conf:   conf,
+		client: server.Client(),
+		token:  &adxTokenSource{conf: conf, token: "token", expireAt: time.Now().Add(time.Hour)},
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{Username: "colin"}}
+
+	conf.IngestionType = AdxStreamingIngestion
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.IngestionType = AdxQueuedIngestion
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"POST /v1/rest/ingest/iam/analytics",
+		"PUT /temp/",
+		"POST /queue/messages",
+	} {
+		found := false
+		for request := range requests {
+			if strings.HasPrefix(request, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected request %s, got %v", expected, requests)
+		}
+	}
+}
+
+func TestAdxBlockUpload(t *testing.T) {
+	var mu sync.Mutex
+	blocks := make(map[string]int)
+	var commits, deletes int
+	failBlock := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		query := r.URL.Query()
+		if query.Get("sig") != "sas" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodDelete:
+			deletes++
+		case query.Get("comp") == "block":
+			if query.Get("blockid") == failBlock {
+				w.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+			blocks[query.Get("blockid")]++
+		case query.Get("comp") == "blocklist":
+			commits++
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	pmp := &AdxPump{
+		conf:   &AdxConf{MultipartConf: MultipartConf{MultipartThreshold: 8, MultipartPartSize: 4}},
+		client: server.Client(),
+	}
+	if err := pmp.conf.MultipartConf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := server.URL + "/temp/batch.multijson.gz?sig=sas"
+	if err := pmp.uploadBlob(context.Background(), blob, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || commits != 1 || deletes != 0 {
+		t.Fatalf("expected 3 blocks and a commit, got %v and %d commits", blocks, commits)
+	}
+
+	upload := &adxBlockUpload{blob: blob}
+	failBlock = upload.blockID(1)
+	if err := pmp.uploadBlob(context.Background(), blob, []byte("0123456789")); err == nil {
+		t.Fatal("a failed block should fail the upload")
+	}
+	if commits != 2 || deletes != 1 {
+		t.Errorf("a failed upload should discard its blocks and delete the blob, got %d commits and %d deletes",
+			commits, deletes)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// AggregatePump defines a pump which does not store the analytics records but aggregates them
+// into prometheus counters and histograms, exposed on /metrics by the health check server.
+type AggregatePump struct {
+	conf *AggregateConf
+
+	userRequests     *prometheus.CounterVec
+	resourceRequests *prometheus.CounterVec
+	decisionLatency  *prometheus.HistogramVec
+
+	CommonPumpConfig
+}
+
+// AggregateConf defines aggregate specific options.
+type AggregateConf struct {
+	// ResourceField is the record field, extra field or attribute of the authorization request
+	// holding the resource the requests are counted per, resource by default.
+	ResourceField string `mapstructure:"resource_field"`
+	// LatencyField is the record field holding the duration of the authorization decision in
+	// milliseconds, the decision latency is not recorded when it is not set.
+	LatencyField string `mapstructure:"latency_field"`
+	// Buckets are the upper bounds in seconds of the buckets of the decision latency histogram.
+	// The buckets of the first configuration are kept until the pump is restarted.
+	Buckets []float64 `mapstructure:"buckets"`
+	// SampleRateField is the field of the sample rate of the records, see DefaultSampleRateField.
+	SampleRateField string `mapstructure:"sample_rate_field"`
+}
+
+// New create an aggregate pump instance.
+func (a *AggregatePump) New() Pump {
+	newPump := AggregatePump{}
+
+	return &newPump
+}
+
+// GetName returns the aggregate pump name.
+func (a *AggregatePump) GetName() string {
+	return "Prometheus Aggregate Pump"
+}
+
+// Init initialize the aggregate pump instance and registers its metrics.
+func (a *AggregatePump) Init(config interface{}) error {
+	a.conf = &AggregateConf{}
+	if err := mapstructure.Decode(config, &a.conf); err != nil {
+		return errors.Wrap(err, "failed to decode aggregate configuration")
+	}
+
+	if a.conf.SampleRateField == "" {
+		a.conf.SampleRateField = DefaultSampleRateField
+	}
+
+	if a.conf.ResourceField == "" {
+		a.conf.ResourceField = "resource"
+	}
+
+	if len(a.conf.Buckets) == 0 {
+		a.conf.Buckets = prometheus.DefBuckets
+	}
+
+	userRequests, err := metrics.RegisterAnalytics(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iam_authorization_requests_total",
+		Help: "Total number of authorization requests per user and effect.",
+	}, []string{"username", "effect"}))
+	if err != nil {
+		return errors.Wrap(err, "failed to register the requests per user")
+	}
+
+	resourceRequests, err := metrics.RegisterAnalytics(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iam_authorization_resource_requests_total",
+		Help: "Total number of authorization requests per resource and effect.",
+	}, []string{"resource", "effect"}))
+	if err != nil {
+		return errors.Wrap(err, "failed to register the requests per resource")
+	}
+
+	decisionLatency, err := metrics.RegisterAnalytics(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "iam_authorization_decision_duration_seconds",
+		Help:    "Duration of the authorization decisions per effect.",
+		Buckets: a.conf.Buckets,
+	}, []string{"effect"}))
+	if err != nil {
+		return errors.Wrap(err, "failed to register the decision latency")
+	}
+
+	a.userRequests, _ = userRequests.(*prometheus.CounterVec)
+	a.resourceRequests, _ = resourceRequests.(*prometheus.CounterVec)
+	a.decisionLatency, _ = decisionLatency.(*prometheus.HistogramVec)
+	if a.userRequests == nil || a.resourceRequests == nil || a.decisionLatency == nil {
+		return errors.New("aggregate metrics already registered by another collector")
+	}
+
+	log.Infof("Aggregate pump exposes the requests per user and resource on /metrics")
+
+	return nil
+}
+
+// WriteData aggregates the analytics data into the metrics.
+func (a *AggregatePump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	for _, item := range data {
+		record, ok := item.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		weight := sampleWeight(&record, a.conf.SampleRateField, a.GetCountField())
+		a.userRequests.WithLabelValues(record.Username, record.Effect).Add(weight)
+
+		var request map[string]interface{}
+		if resource, ok := attributeValue(&record, a.conf.ResourceField, &request); ok {
+			a.resourceRequests.WithLabelValues(fmt.Sprint(resource), record.Effect).Add(weight)
+		}
+
+		if a.conf.LatencyField == "" {
+			continue
+		}
+		if value, ok := record.FieldValue(a.conf.LatencyField); ok {
+			if ms, err := strconv.ParseFloat(fmt.Sprint(value), 64); err == nil && ms >= 0 {
+				a.decisionLatency.WithLabelValues(record.Effect).Observe(ms / 1000)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+)
+
+func TestAggregatePump(t *testing.T) {
+	record := analytics.AnalyticsRecord{
+		Username: "aggregate",
+		Effect:   "allow",
+		Request:  `{"resource":"resources:articles:ladon-introduction","action":"delete"}`,
+	}
+	record.SetExtra("latency", 20)
+	// a sampled record counts as the records it stands for
+	sampled := analytics.AnalyticsRecord{Username: "sampled", Effect: "deny"}
+	sampled.SetExtra(DefaultSampleRateField, 4.0)
+
+	// a reloaded pump keeps the metrics of the previous instance
+	for i := 0; i < 2; i++ {
+		pmp := (&AggregatePump{}).New()
+		if err := pmp.Init(map[string]interface{}{"latency_field": "latency"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pmp.WriteData(context.Background(), []interface{}{record, sampled}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, want := range []string{
+		`iam_authorization_requests_total{effect="allow",username="aggregate"} 2`,
+		`iam_authorization_requests_total{effect="deny",username="sampled"} 8`,
+		`iam_authorization_resource_requests_total{effect="allow",resource="resources:articles:ladon-introduction"} 2`,
+		`iam_authorization_decision_duration_seconds_bucket{effect="allow",le="0.025"} 2`,
+		`iam_authorization_decision_duration_seconds_sum{effect="allow"} 0.04`,
+		`pump_paused 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// avroSchema is a parsed Avro schema. The primitive types, the timestamp logical types, records,
+// enums, arrays, maps and unions are supported.
+type avroSchema struct {
+	typ      string
+	logical  string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	values   *avroSchema
+	branches []*avroSchema
+}
+
+type avroField struct {
+	name       string
+	schema     *avroSchema
+	def        interface{}
+	hasDefault bool
+}
+
+// avroMarshaler encodes the documents in Avro binary with the provided record schema.
+type avroMarshaler struct {
+	schema *avroSchema
+	// source is the json form of the schema, written in the header of the object container files.
+	source string
+}
+
+// NewAvroMarshaler creates a marshaler encoding the documents in Avro binary with the schema, a
+// record schema in its json form. It can be registered with RegisterMarshaler once created, the
+// records are validated against the schema first.
+func NewAvroMarshaler(schema string) (Marshaler, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, errors.Wrap(err, "failed to decode avro schema")
+	}
+
+	parsed, err := parseAvroSchema(raw, map[string]*avroSchema{})
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.typ != "record" {
+		return nil, errors.Errorf("avro schema must be a record, got %s", parsed.typ)
+	}
+
+	marshaler := &avroMarshaler{schema: parsed, source: schema}
+	if err := marshaler.validate(); err != nil {
+		return nil, err
+	}
+
+	return marshaler, nil
+}
+
+func (m *avroMarshaler) Marshal(doc Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.schema.encode(&buf, map[string]interface{}(doc)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (m *avroMarshaler) ContentType() string {
+	return "avro/binary"
+}
+
+// avroContainerMagic starts the Avro object container files.
+const avroContainerMagic = "Obj\x01"
+
+// encodeContainer encodes the records in an Avro object container file of a single deflate
+// compressed block, as read by the data lake engines. The records which do not match the schema
+// are skipped and logged.
+func (m *avroMarshaler) encodeContainer(records []analytics.AnalyticsRecord) ([]byte, error) {
+	var block bytes.Buffer
+	count := 0
+	for i := range records {
+		value, err := m.Marshal(recordMessage(analytics.FormatDefault, &records[i], nil, nil))
+		if err != nil {
+			log.Error("unable to encode avro record", log.String("error", err.Error()),
+				log.String("username", records[i].Username), log.Int64("timestamp", records[i].TimeStamp))
+
+			continue
+		}
+		block.Write(value)
+		count++
+	}
+
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if _, err := fw.Write(block.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "failed to compress avro block")
+	}
+	if err := fw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress avro block")
+	}
+
+	var file bytes.Buffer
+	file.WriteString(avroContainerMagic)
+	// the metadata map, in a single block of two entries
+	writeAvroLong(&file, 2)
+	for _, entry := range [][2]string{{"avro.schema", m.source}, {"avro.codec", "deflate"}} {
+		writeAvroLong(&file, int64(len(entry[0])))
+		file.WriteString(entry[0])
+		writeAvroLong(&file, int64(len(entry[1])))
+		file.WriteString(entry[1])
+	}
+	writeAvroLong(&file, 0)
+
+	sync := uuid.Must(uuid.NewV4()).Bytes()
+	file.Write(sync)
+	if count > 0 {
+		writeAvroLong(&file, int64(count))
+		writeAvroLong(&file, int64(compressed.Len()))
+		file.Write(compressed.Bytes())
+		file.Write(sync)
+	}
+
+	return file.Bytes(), nil
+}
+
+// validate checks that the records can be encoded with the schema: every field of the schema
+// must be a record field, or be nullable or have a default.
+func (m *avroMarshaler) validate() error {
+	for _, field := range m.schema.fields {
+		if !analytics.IsRecordField(field.name) && !field.hasDefault && !field.schema.nullable() {
+			return errors.Errorf("avro field %s is not a record field, it must be nullable or have a default", field.name)
+		}
+	}
+
+	sample := analytics.AnalyticsRecord{
+		TimeStamp:  time.Now().Unix(),
+		Username:   "username",
+		Effect:     "allow",
+		Conclusion: "conclusion",
+		Request:    "{}",
+		Policies:   "[]",
+		Deciders:   "[]",
+		ExpireAt:   time.Now(),
+	}
+	if _, err := m.Marshal(recordMessage(analytics.FormatDefault, &sample, nil, nil)); err != nil {
+		return errors.Wrap(err, "the records are not compatible with the avro schema")
+	}
+
+	return nil
+}
+
+// parseAvroSchema parses the json form of a schema, named holds the named types already defined.
+func parseAvroSchema(raw interface{}, named map[string]*avroSchema) (*avroSchema, error) {
+	switch raw := raw.(type) {
+	case string:
+		if schema, ok := named[raw]; ok {
+			return schema, nil
+		}
+		if !isAvroPrimitive(raw) {
+			return nil, errors.Errorf("unknown avro type %s", raw)
+		}
+
+		return &avroSchema{typ: raw}, nil
+	case []interface{}:
+		schema := &avroSchema{typ: "union"}
+		for _, branch := range raw {
+			parsed, err := parseAvroSchema(branch, named)
+			if err != nil {
+				return nil, err
+			}
+			schema.branches = append(schema.branches, parsed)
+		}
+
+		return schema, nil
+	case map[string]interface{}:
+		return parseAvroComplex(raw, named)
+	default:
+		return nil, errors.Errorf("invalid avro schema %v", raw)
+	}
+}
+
+func parseAvroComplex(raw map[string]interface{}, named map[string]*avroSchema) (*avroSchema, error) {
+	typ, _ := raw["type"].(string)
+	schema := &avroSchema{typ: typ}
+	schema.logical, _ = raw["logicalType"].(string)
+	schema.name, _ = raw["name"].(string)
+
+	switch typ {
+	case "record":
+		named[schema.name] = schema
+		fields, _ := raw["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			parsed, err := parseAvroSchema(field["type"], named)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid avro field %s", name)
+			}
+			def, hasDefault := field["default"]
+			schema.fields = append(schema.fields, avroField{name: name, schema: parsed, def: def, hasDefault: hasDefault})
+		}
+	case "enum":
+		named[schema.name] = schema
+		symbols, _ := raw["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			schema.symbols = append(schema.symbols, fmt.Sprint(symbol))
+		}
+	case "array":
+		items, err := parseAvroSchema(raw["items"], named)
+		if err != nil {
+			return nil, err
+		}
+		schema.items = items
+	case "map":
+		values, err := parseAvroSchema(raw["values"], named)
+		if err != nil {
+			return nil, err
+		}
+		schema.values = values
+	default:
+		if _, ok := raw["type"].(string); !ok {
+			// a type given as a nested schema
+			return parseAvroSchema(raw["type"], named)
+		}
+		if !isAvroPrimitive(typ) {
+			return nil, errors.Errorf("unsupported avro type %s", typ)
+		}
+	}
+
+	return schema, nil
+}
+
+func isAvroPrimitive(typ string) bool {
+	switch typ {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *avroSchema) nullable() bool {
+	if s.typ == "null" {
+		return true
+	}
+
+	for _, branch := range s.branches {
+		if branch.typ == "null" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encode appends the Avro binary encoding of the value to buf.
+func (s *avroSchema) encode(buf *bytes.Buffer, value interface{}) error {
+	switch s.typ {
+	case "null":
+		if value != nil {
+			return errors.Errorf("expected null, got %T", value)
+		}
+	case "boolean":
+		b, ok := value.(bool)
+		if !ok {
+			return errors.Errorf("expected boolean, got %T", value)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		n, ok := s.integer(value)
+		if !ok {
+			return errors.Errorf("expected %s, got %T", s.typ, value)
+		}
+		if s.typ == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return errors.Errorf("%d overflows an avro int", n)
+		}
+		writeAvroLong(buf, n)
+	case "float", "double":
+		f, ok := avroFloat(value)
+		if !ok {
+			return errors.Errorf("expected %s, got %T", s.typ, value)
+		}
+		if s.typ == "float" {
+			_ = binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(f)))
+		} else {
+			_ = binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		}
+	case "string", "bytes":
+		var data []byte
+		switch v := value.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		case time.Time:
+			data = []byte(v.Format(time.RFC3339Nano))
+		default:
+			return errors.Errorf("expected %s, got %T", s.typ, value)
+		}
+		writeAvroLong(buf, int64(len(data)))
+		buf.Write(data)
+	case "enum":
+		for i, symbol := range s.symbols {
+			if symbol == fmt.Sprint(value) {
+				writeAvroLong(buf, int64(i))
+
+				return nil
+			}
+		}
+
+		return errors.Errorf("%v is not a symbol of enum %s", value, s.name)
+	case "union":
+		return s.encodeUnion(buf, value)
+	case "array":
+		return s.encodeArray(buf, value)
+	case "map":
+		return s.encodeMap(buf, value)
+	case "record":
+		return s.encodeRecord(buf, value)
+	}
+
+	return nil
+}
+
+func (s *avroSchema) encodeUnion(buf *bytes.Buffer, value interface{}) error {
+	for i, branch := range s.branches {
+		var encoded bytes.Buffer
+		if branch.encode(&encoded, value) == nil {
+			writeAvroLong(buf, int64(i))
+			buf.Write(encoded.Bytes())
+
+			return nil
+		}
+	}
+
+	return errors.Errorf("%T matches no branch of the union", value)
+}
+
+func (s *avroSchema) encodeArray(buf *bytes.Buffer, value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return errors.Errorf("expected array, got %T", value)
+	}
+
+	if v.Len() > 0 {
+		writeAvroLong(buf, int64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := s.items.encode(buf, v.Index(i).Interface()); err != nil {
+				return errors.Wrapf(err, "item %d", i)
+			}
+		}
+	}
+	writeAvroLong(buf, 0)
+
+	return nil
+}
+
+func (s *avroSchema) encodeMap(buf *bytes.Buffer, value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return errors.Errorf("expected map, got %T", value)
+	}
+
+	if v.Len() > 0 {
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		// the encoding is deterministic, which keeps the messages comparable
+		sort.Strings(keys)
+
+		writeAvroLong(buf, int64(len(keys)))
+		for _, key := range keys {
+			writeAvroLong(buf, int64(len(key)))
+			buf.WriteString(key)
+			if err := s.values.encode(buf, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).Interface()); err != nil {
+				return errors.Wrapf(err, "value %s", key)
+			}
+		}
+	}
+	writeAvroLong(buf, 0)
+
+	return nil
+}
+
+func (s *avroSchema) encodeRecord(buf *bytes.Buffer, value interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		if message, isMessage := value.(Message); isMessage {
+			fields = message
+		} else {
+			return errors.Errorf("expected record %s, got %T", s.name, value)
+		}
+	}
+
+	for _, field := range s.fields {
+		v, ok := fields[field.name]
+		switch {
+		case ok:
+		case field.hasDefault:
+			v = field.def
+		case field.schema.nullable():
+			v = nil
+		default:
+			return errors.Errorf("field %s is missing", field.name)
+		}
+
+		if err := field.schema.encode(buf, v); err != nil {
+			return errors.Wrapf(err, "field %s", field.name)
+		}
+	}
+
+	return nil
+}
+
+// integer converts the value to an int64, the time values are converted to the precision of the
+// timestamp logical type.
+func (s *avroSchema) integer(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		switch s.logical {
+		case "timestamp-millis":
+			return v.UnixNano() / int64(time.Millisecond), true
+		case "timestamp-micros":
+			return v.UnixNano() / int64(time.Microsecond), true
+		default:
+			return 0, false
+		}
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case float64:
+		// the numbers decoded from json, e.g. a default
+		if v == math.Trunc(v) {
+			return int64(v), true
+		}
+	}
+
+	return 0, false
+}
+
+func avroFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// writeAvroLong writes the zig-zag variable length encoding of n.
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
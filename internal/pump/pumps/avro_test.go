@@ -0,0 +1,103 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+const testAvroSchema = `{
+  "type": "record",
+  "name": "AnalyticsRecord",
+  "fields": [
+    {"name": "timestamp", "type": "long"},
+    {"name": "username", "type": "string"},
+    {"name": "expireAt", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "region", "type": ["null", "string"], "default": null}
+  ]
+}`
+
+func TestAvroMarshaler(t *testing.T) {
+	marshaler, err := NewAvroMarshaler(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", ExpireAt: time.Unix(1600003600, 0)}
+	record.SetExtra("region", "eu")
+
+	data, err := marshaler.Marshal(recordMessage(analytics.FormatDefault, &record, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bytes.NewReader(data)
+	readLong := func() int64 {
+		n, _ := binary.ReadVarint(reader)
+
+		return n
+	}
+	readString := func() string {
+		b := make([]byte, readLong())
+		_, _ = reader.Read(b)
+
+		return string(b)
+	}
+
+	if timestamp := readLong(); timestamp != 1600000000 {
+		t.Fatalf("unexpected timestamp %d", timestamp)
+	}
+	if username := readString(); username != "colin" {
+		t.Fatalf("unexpected username %s", username)
+	}
+	if expireAt := readLong(); expireAt != 1600003600000 {
+		t.Fatalf("expireAt should be encoded in milliseconds, got %d", expireAt)
+	}
+	if branch := readLong(); branch != 1 || readString() != "eu" {
+		t.Fatalf("the region should be encoded in the string branch of the union, got branch %d", branch)
+	}
+
+	record.SetExtra("region", 42)
+	if _, err := marshaler.Marshal(recordMessage(analytics.FormatDefault, &record, nil, nil)); err == nil {
+		t.Fatal("a record not matching the schema should fail to encode")
+	}
+
+	if _, err := NewAvroMarshaler(`{"type": "record", "name": "r", "fields": [{"name": "region", "type": "string"}]}`); err == nil {
+		t.Fatal("a required field the records do not have should be rejected")
+	}
+}
+
+func TestKafkaAvroSchemaFromRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/iam-value/versions/latest" {
+			t.Errorf("unexpected registry path %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"id": 7, "schema": ` + strconv.Quote(testAvroSchema) + `}`))
+	}))
+	defer server.Close()
+
+	pmp := &KafkaPump{}
+	err := pmp.Init(map[string]interface{}{
+		"broker":                    []string{"localhost:9092"},
+		"topic":                     "iam",
+		"schema_registry_url":       server.URL,
+		"avro_schema_from_registry": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pmp.avro == nil || pmp.registry.id != 7 {
+		t.Fatal("the messages should be encoded with the latest registered avro schema")
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+)
+
+// Defines the endpoints and timeouts of the AWS credentials providers.
+const (
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsDefaultMetadataEndpoint  = "http://169.254.169.254"
+	awsMetadataTimeout          = 2 * time.Second
+	awsCredentialsExpiryWindow  = 5 * time.Minute
+)
+
+// awsCredentials are the keys requests to the AWS services are signed with.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+	Expiration      time.Time
+}
+
+// awsCredentialsChain retrieves the credentials from the first provider of the chain of the AWS
+// SDKs which has some: the static keys, the environment, the shared credentials file, the
+// container credentials and the instance metadata service. The temporary credentials are cached
+// until shortly before they expire.
+type awsCredentialsChain struct {
+	static  awsCredentials
+	profile string
+	client  *http.Client
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+// newAWSCredentialsChain returns the credentials chain starting with the static keys, which may
+// be empty, and reading the profile of the shared credentials file.
+func newAWSCredentialsChain(accessKeyID, secretAccessKey, sessionToken, profile string) *awsCredentialsChain {
+	return &awsCredentialsChain{
+		static: awsCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    sessionToken,
+		},
+		profile: profile,
+		client:  &http.Client{Timeout: awsMetadataTimeout},
+	}
+}
+
+// retrieve returns the cached credentials, or the credentials of the first provider of the chain.
+func (c *awsCredentialsChain) retrieve(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials != nil && (c.credentials.Expiration.IsZero() ||
+		time.Now().Add(awsCredentialsExpiryWindow).Before(c.credentials.Expiration)) {
+		return *c.credentials, nil
+	}
+
+	if c.static.AccessKeyID != "" {
+		c.credentials = &c.static
+
+		return c.static, nil
+	}
+
+	providers := []func(context.Context) (*awsCredentials, error){
+		c.environment, c.sharedFile, c.container, c.instanceMetadata,
+	}
+	for _, provider := range providers {
+		credentials, err := provider(ctx)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		if credentials != nil {
+			c.credentials = credentials
+
+			return *credentials, nil
+		}
+	}
+
+	return awsCredentials{}, errors.New("no aws credentials found")
+}
+
+// environment returns the credentials of the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables.
+func (c *awsCredentialsChain) environment(context.Context) (*awsCredentials, error) {
+	credentials := &awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, nil
+	}
+
+	return credentials, nil
+}
+
+// sharedFile returns the credentials of the profile of ~/.aws/credentials, or of the file of
+// AWS_SHARED_CREDENTIALS_FILE. The profile is the configured one, AWS_PROFILE or default.
+func (c *awsCredentialsChain) sharedFile(context.Context) (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open aws shared credentials file")
+	}
+	defer file.Close()
+
+	profile := c.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	var (
+		credentials awsCredentials
+		section     string
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			credentials.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read aws shared credentials file")
+	}
+
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, nil
+	}
+
+	return &credentials, nil
+}
+
+// container returns the credentials of the task role of ECS, or of the pod identity of EKS,
+// served at AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI.
+func (c *awsCredentialsChain) container(ctx context.Context) (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = awsContainerCredentialsHost + relative
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	header := make(http.Header)
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		header.Set("Authorization", token)
+	}
+
+	body, err := c.get(ctx, http.MethodGet, endpoint, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get aws container credentials")
+	}
+
+	credentials := &awsCredentials{}
+	if err := json.Unmarshal(body, credentials); err != nil {
+		return nil, errors.Wrap(err, "failed to decode aws container credentials")
+	}
+
+	return credentials, nil
+}
+
+// instanceMetadata returns the credentials of the role of the EC2 instance, read from the
+// instance metadata service with a session token. It is skipped when AWS_EC2_METADATA_DISABLED
+// is true or the service is not reachable.
+func (c *awsCredentialsChain) instanceMetadata(ctx context.Context) (*awsCredentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, nil
+	}
+
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = awsDefaultMetadataEndpoint
+	}
+
+	token, err := c.get(ctx, http.MethodPut, endpoint+"/latest/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": []string{"21600"}})
+	if err != nil {
+		// not running on EC2
+		return nil, nil
+	}
+
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": []string{string(token)}}
+	path := endpoint + "/latest/meta-data/iam/security-credentials/"
+	role, err := c.get(ctx, http.MethodGet, path, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the role of the instance")
+	}
+
+	body, err := c.get(ctx, http.MethodGet, path+strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]), header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get aws instance credentials")
+	}
+
+	credentials := &awsCredentials{}
+	if err := json.Unmarshal(body, credentials); err != nil {
+		return nil, errors.Wrap(err, "failed to decode aws instance credentials")
+	}
+
+	return credentials, nil
+}
+
+// get returns the body of the response to a request of a credentials endpoint.
+func (c *awsCredentialsChain) get(ctx context.Context, method, endpoint string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("aws credentials", resp); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// signAWSRequest signs the request to the service with the AWS signature version 4, all the
+// headers of the request are signed.
+func signAWSRequest(req *http.Request, payload []byte, credentials awsCredentials, region string, service string,
+	now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// awsEscape encodes s as expected by the signature version 4: every byte but the unreserved
+// characters is percent encoded, and the slashes too unless in an object key.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// awsQuery returns the canonical query string of the signature version 4, sorted by key.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,471 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the defaults and limits of the bigquery pump.
+const (
+	defaultBigQueryEndpoint        = "https://bigquery.googleapis.com"
+	defaultBigQueryRowsPerRequest  = 500
+	bigQueryMaxRowsPerRequest      = 50000
+	defaultBigQueryRequestBytes    = 5 << 20
+	bigQueryMaxRequestBytes        = 10 << 20
+	bigQueryInitTimeout            = 30 * time.Second
+	bigQueryScope                  = "https://www.googleapis.com/auth/bigquery.insertdata"
+	bigQueryAdminScope             = "https://www.googleapis.com/auth/bigquery"
+	bigQueryJWTGrantType           = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	defaultGCEMetadataHost         = "metadata.google.internal"
+	bigQueryMetadataTokenPath      = "/computeMetadata/v1/instance/service-accounts/default/token"
+	bigQueryServiceAccountTokenTTL = time.Hour
+)
+
+// bigQueryColumns defines the columns of the analytics table, the table is partitioned by day on
+// the timestamp of the records.
+var bigQueryColumns = []struct {
+	name string
+	typ  string
+}{
+	{"timestamp", "TIMESTAMP"},
+	{"username", "STRING"},
+	{"effect", "STRING"},
+	{"conclusion", "STRING"},
+	{"request", "STRING"},
+	{"policies", "STRING"},
+	{"deciders", "STRING"},
+	{"expireAt", "TIMESTAMP"},
+	{"extra", "JSON"},
+}
+
+// BigQueryPump defines a pump which streams the analytics records into a BigQuery table with the
+// insertAll API, in requests of a bounded number of rows and size.
+type BigQueryPump struct {
+	conf     *BigQueryConf
+	client   *http.Client
+	token    *bigQueryTokenSource
+	tableURL string
+
+	CommonPumpConfig
+}
+
+// BigQueryConf defines bigquery specific options.
+type BigQueryConf struct {
+	// ProjectID is the project of the dataset, the project of the service account by default.
+	ProjectID string `mapstructure:"project_id"`
+	DatasetID string `mapstructure:"dataset_id"`
+	// TableID is the table the records are inserted into, iam_analytics by default.
+	TableID string `mapstructure:"table_id"`
+	// CredentialsFile is the json key of the service account, GOOGLE_APPLICATION_CREDENTIALS by
+	// default, the service account of the instance is used without one.
+	CredentialsFile string `mapstructure:"credentials_file"`
+	// Endpoint overrides the endpoint of the BigQuery API, e.g. of an emulator.
+	Endpoint string `mapstructure:"endpoint"`
+	// AutoCreate creates the table with the schema of the records at startup, when absent.
+	AutoCreate bool `mapstructure:"auto_create"`
+	// MaxRowsPerRequest is the maximum number of rows per insert request, 500 by default, at
+	// most 50000.
+	MaxRowsPerRequest int `mapstructure:"max_rows_per_request"`
+	// MaxRequestBytes is the maximum size of the insert requests, 5MB by default, at most 10MB.
+	// The larger rows are rejected.
+	MaxRequestBytes     int  `mapstructure:"max_request_bytes"`
+	SkipInvalidRows     bool `mapstructure:"skip_invalid_rows"`
+	IgnoreUnknownValues bool `mapstructure:"ignore_unknown_values"`
+}
+
+// bigQueryServiceAccount is the json key of a service account.
+type bigQueryServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// New create a bigquery pump instance.
+func (b *BigQueryPump) New() Pump {
+	newPump := BigQueryPump{}
+
+	return &newPump
+}
+
+// GetName returns the bigquery pump name.
+func (b *BigQueryPump) GetName() string {
+	return "BigQuery Pump"
+}
+
+// Init initialize the bigquery pump instance, the analytics table is created if absent when
+// auto_create is set.
+func (b *BigQueryPump) Init(config interface{}) error {
+	b.conf = &BigQueryConf{}
+	if err := mapstructure.Decode(config, &b.conf); err != nil {
+		return errors.Wrap(err, "failed to decode bigquery configuration")
+	}
+
+	if b.conf.DatasetID == "" {
+		return errors.New("bigquery dataset_id not set")
+	}
+
+	if b.conf.TableID == "" {
+		b.conf.TableID = "iam_analytics"
+	}
+
+	if b.conf.Endpoint == "" {
+		b.conf.Endpoint = defaultBigQueryEndpoint
+	}
+	b.conf.Endpoint = strings.TrimSuffix(b.conf.Endpoint, "/")
+
+	if b.conf.MaxRowsPerRequest <= 0 {
+		b.conf.MaxRowsPerRequest = defaultBigQueryRowsPerRequest
+	}
+	if b.conf.MaxRowsPerRequest > bigQueryMaxRowsPerRequest {
+		b.conf.MaxRowsPerRequest = bigQueryMaxRowsPerRequest
+	}
+
+	if b.conf.MaxRequestBytes <= 0 {
+		b.conf.MaxRequestBytes = defaultBigQueryRequestBytes
+	}
+	if b.conf.MaxRequestBytes > bigQueryMaxRequestBytes {
+		b.conf.MaxRequestBytes = bigQueryMaxRequestBytes
+	}
+
+	if b.conf.CredentialsFile == "" {
+		b.conf.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	b.client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+	b.token = &bigQueryTokenSource{client: b.client}
+	if b.conf.AutoCreate {
+		b.token.scope = bigQueryAdminScope
+	}
+
+	if b.conf.CredentialsFile != "" {
+		data, err := os.ReadFile(b.conf.CredentialsFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read bigquery credentials file")
+		}
+
+		b.token.account = &bigQueryServiceAccount{}
+		if err := json.Unmarshal(data, b.token.account); err != nil {
+			return errors.Wrap(err, "failed to decode bigquery credentials file")
+		}
+
+		if b.token.key, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(b.token.account.PrivateKey)); err != nil {
+			return errors.Wrap(err, "invalid bigquery service account private key")
+		}
+
+		if b.conf.ProjectID == "" {
+			b.conf.ProjectID = b.token.account.ProjectID
+		}
+	}
+
+	if b.conf.ProjectID == "" {
+		return errors.New("bigquery project_id not set")
+	}
+
+	b.tableURL = fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables", b.conf.Endpoint,
+		url.PathEscape(b.conf.ProjectID), url.PathEscape(b.conf.DatasetID))
+
+	if b.conf.AutoCreate {
+		ctx, cancel := context.WithTimeout(context.Background(), bigQueryInitTimeout)
+		defer cancel()
+
+		if err := b.createTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("BigQuery pump inserts into table %s.%s.%s", b.conf.ProjectID, b.conf.DatasetID, b.conf.TableID)
+
+	return nil
+}
+
+// createTable creates the analytics table, an already existing table is left as is.
+func (b *BigQueryPump) createTable(ctx context.Context) error {
+	fields := make([]map[string]string, 0, len(bigQueryColumns))
+	for _, column := range bigQueryColumns {
+		fields = append(fields, map[string]string{"name": column.name, "type": column.typ, "mode": "NULLABLE"})
+	}
+
+	table := map[string]interface{}{
+		"tableReference": map[string]string{
+			"projectId": b.conf.ProjectID,
+			"datasetId": b.conf.DatasetID,
+			"tableId":   b.conf.TableID,
+		},
+		"schema":           map[string]interface{}{"fields": fields},
+		"timePartitioning": map[string]string{"type": "DAY", "field": "timestamp"},
+	}
+
+	resp, err := b.request(ctx, b.tableURL, table)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create bigquery table %s", b.conf.TableID)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+
+	return checkResponse("bigquery", resp)
+}
+
+// WriteData inserts a row per record, in requests of at most MaxRowsPerRequest rows and
+// MaxRequestBytes bytes.
+func (b *BigQueryPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	var (
+		rows []json.RawMessage
+		size int
+	)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		row, err := json.Marshal(map[string]interface{}{
+			"insertId": uuid.Must(uuid.NewV4()).String(),
+			"json":     bigQueryRow(&record),
+		})
+		if err != nil {
+			log.Errorf("unable to marshal bigquery row: %s", err.Error())
+
+			continue
+		}
+
+		if len(row) > b.conf.MaxRequestBytes {
+			b.reportRejection(RejectionPayloadTooLarge, 1,
+				errors.Errorf("row of %d bytes exceeds %d bytes", len(row), b.conf.MaxRequestBytes))
+
+			continue
+		}
+
+		if len(rows) == b.conf.MaxRowsPerRequest || size+len(row) > b.conf.MaxRequestBytes {
+			if err := b.insert(ctx, rows); err != nil {
+				return err
+			}
+			rows, size = nil, 0
+		}
+
+		rows = append(rows, row)
+		size += len(row) + 1
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return b.insert(ctx, rows)
+}
+
+// bigQueryRow returns the row of the record, the zero times are null values and the extra
+// fields a json value.
+func bigQueryRow(record *analytics.AnalyticsRecord) map[string]interface{} {
+	row := map[string]interface{}{
+		"timestamp":  record.TimeStamp,
+		"username":   record.Username,
+		"effect":     record.Effect,
+		"conclusion": record.Conclusion,
+		"request":    record.Request,
+		"policies":   record.Policies,
+		"deciders":   record.Deciders,
+	}
+
+	if !record.ExpireAt.IsZero() {
+		row["expireAt"] = record.ExpireAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	if len(record.Extra) > 0 {
+		extra, _ := json.Marshal(record.Extra)
+		row["extra"] = string(extra)
+	}
+
+	return row
+}
+
+// insert sends the rows with an insertAll request. The rows the table refuses do not fail the
+// write, they are logged.
+func (b *BigQueryPump) insert(ctx context.Context, rows []json.RawMessage) error {
+	resp, err := b.request(ctx, b.tableURL+"/"+url.PathEscape(b.conf.TableID)+"/insertAll", map[string]interface{}{
+		"kind":                "bigquery#tableDataInsertAllRequest",
+		"skipInvalidRows":     b.conf.SkipInvalidRows,
+		"ignoreUnknownValues": b.conf.IgnoreUnknownValues,
+		"rows":                rows,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to insert rows into bigquery")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("bigquery", resp); err != nil {
+		return err
+	}
+
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrap(err, "failed to decode bigquery response")
+	}
+
+	for _, insertError := range result.InsertErrors {
+		for _, rowError := range insertError.Errors {
+			// the valid rows of a request with invalid rows are stopped unless skipInvalidRows is set
+			if rowError.Reason != "stopped" {
+				log.Errorf("BigQuery rejected row %d: %s: %s", insertError.Index, rowError.Reason, rowError.Message)
+			}
+		}
+	}
+	if len(result.InsertErrors) > 0 {
+		log.Errorf("BigQuery did not insert %d of %d rows", len(result.InsertErrors), len(rows))
+	}
+
+	return nil
+}
+
+// request posts the json body to the api with the access token of the pump.
+func (b *BigQueryPump) request(ctx context.Context, endpoint string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := b.token.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	addWrittenBytes(ctx, len(payload))
+
+	return resp, nil
+}
+
+// bigQueryTokenSource caches the OAuth2 access token of the pump until it expires, the token of
+// the service account key or of the service account of the instance.
+type bigQueryTokenSource struct {
+	client  *http.Client
+	account *bigQueryServiceAccount
+	key     interface{}
+	scope   string
+
+	mu       sync.Mutex
+	token    string
+	expireAt time.Time
+}
+
+func (t *bigQueryTokenSource) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.expireAt) {
+		return t.token, nil
+	}
+
+	scope := t.scope
+	if scope == "" {
+		scope = bigQueryScope
+	}
+
+	var req *http.Request
+	var err error
+	if t.account != nil {
+		now := time.Now()
+		assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   t.account.ClientEmail,
+			"scope": scope,
+			"aud":   t.account.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(bigQueryServiceAccountTokenTTL).Unix(),
+		})
+		assertion.Header["kid"] = t.account.PrivateKeyID
+
+		var signed string
+		if signed, err = assertion.SignedString(t.key); err != nil {
+			return "", errors.Wrap(err, "failed to sign bigquery token request")
+		}
+
+		form := url.Values{"grant_type": {bigQueryJWTGrantType}, "assertion": {signed}}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.account.TokenURI,
+			strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = defaultGCEMetadataHost
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://"+host+bigQueryMetadataTokenPath+"?"+url.Values{"scopes": {scope}}.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create bigquery token request")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get bigquery access token")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("bigquery token endpoint", resp); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "failed to decode bigquery access token")
+	}
+
+	t.token = result.AccessToken
+	// renew the token a minute before it expires
+	t.expireAt = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+
+	return t.token, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestBigQueryPump(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		created bool
+		inserts []int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(r.PostForm.Get("assertion"), claims, func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		}); err != nil || claims["iss"] != "pump@iam.iam.gserviceaccount.com" {
+			t.Errorf("unexpected assertion %v: %v", claims, err)
+		}
+		_, _ = w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+	})
+	mux.HandleFunc("/bigquery/v2/projects/iam/datasets/analytics/tables", func(w http.ResponseWriter, r *http.Request) {
+		var table struct {
+			Schema struct {
+				Fields []map[string]string `json:"fields"`
+			} `json:"schema"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&table)
+		mu.Lock()
+		created = len(table.Schema.Fields) == len(bigQueryColumns)
+		mu.Unlock()
+	})
+	mux.HandleFunc("/bigquery/v2/projects/iam/datasets/analytics/tables/iam_analytics/insertAll",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer access" {
+				t.Errorf("unexpected authorization %s", r.Header.Get("Authorization"))
+			}
+			var request struct {
+				Rows []struct {
+					InsertID string                 `json:"insertId"`
+					JSON     map[string]interface{} `json:"json"`
+				} `json:"rows"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			if request.Rows[0].InsertID == "" || request.Rows[0].JSON["username"] != "colin" {
+				t.Errorf("unexpected rows %v", request.Rows)
+			}
+			mu.Lock()
+			inserts = append(inserts, len(request.Rows))
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"kind":"bigquery#tableDataInsertAllResponse"}`))
+		})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	account, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "iam",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "pump@iam.iam.gserviceaccount.com",
+		"token_uri":      server.URL + "/token",
+	})
+	credentials := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(credentials, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pmp := (&BigQueryPump{}).New()
+	err = pmp.Init(map[string]interface{}{
+		"dataset_id":           "analytics",
+		"credentials_file":     credentials,
+		"endpoint":             server.URL,
+		"auto_create":          true,
+		"max_rows_per_request": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("the table should be created with the schema of the records")
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"},
+		analytics.AnalyticsRecord{TimeStamp: 1600000001, Username: "colin"},
+		analytics.AnalyticsRecord{TimeStamp: 1600000002, Username: "colin", Extra: map[string]interface{}{"a": 1}},
+	}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inserts) != 2 || inserts[0] != 2 || inserts[1] != 1 {
+		t.Fatalf("unexpected insert requests %v", inserts)
+	}
+}
+
+func TestBigQueryRow(t *testing.T) {
+	row := bigQueryRow(&analytics.AnalyticsRecord{Username: "colin", Extra: map[string]interface{}{"a": 1}})
+	if _, ok := row["expireAt"]; ok {
+		t.Fatal("the zero expiration should be null")
+	}
+	if extra, _ := row["extra"].(string); !strings.Contains(extra, `"a":1`) {
+		t.Fatalf("unexpected extra %v", row["extra"])
+	}
+}
@@ -4,12 +4,19 @@
 
 package pumps
 
-import "github.com/marmotedu/iam/internal/pump/analytics"
+import (
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
 
 // CommonPumpConfig defines common options used by all persistent store, like elasticsearch, kafka, mongo and etc.
 type CommonPumpConfig struct {
 	filters               analytics.AnalyticsFilters
 	timeout               int
+	fieldPrecedence       []string
+	countField            string
+	rejections            RejectionReporter
 	OmitDetailedRecording bool
 }
 
@@ -33,6 +40,26 @@ func (p *CommonPumpConfig) GetTimeout() int {
 	return p.timeout
 }
 
+// SetFieldPrecedence set attributes `fieldPrecedence` for CommonPumpConfig.
+func (p *CommonPumpConfig) SetFieldPrecedence(precedence []string) {
+	p.fieldPrecedence = precedence
+}
+
+// GetFieldPrecedence get attributes `fieldPrecedence` for CommonPumpConfig.
+func (p *CommonPumpConfig) GetFieldPrecedence() []string {
+	return p.fieldPrecedence
+}
+
+// SetCountField set attributes `countField` for CommonPumpConfig.
+func (p *CommonPumpConfig) SetCountField(field string) {
+	p.countField = field
+}
+
+// GetCountField get attributes `countField` for CommonPumpConfig.
+func (p *CommonPumpConfig) GetCountField() string {
+	return p.countField
+}
+
 // SetOmitDetailedRecording set attributes `OmitDetailedRecording` for CommonPumpConfig.
 func (p *CommonPumpConfig) SetOmitDetailedRecording(omitDetailedRecording bool) {
 	p.OmitDetailedRecording = omitDetailedRecording
@@ -42,3 +69,70 @@ func (p *CommonPumpConfig) SetOmitDetailedRecording(omitDetailedRecording bool)
 func (p *CommonPumpConfig) GetOmitDetailedRecording() bool {
 	return p.OmitDetailedRecording
 }
+
+// Shutdown is a no-op for pumps which do not hold resources to release.
+func (p *CommonPumpConfig) Shutdown() error {
+	return nil
+}
+
+// recordMessage returns the document written for the record in the given format, along with the
+// static fields of the pump, the fields set by several sources resolved by the precedence.
+func recordMessage(format string, record *analytics.AnalyticsRecord, static map[string]interface{},
+	precedence []string) Message {
+	return record.Document(format, static, precedence)
+}
+
+// DefaultSampleRateField is the extra field iam-pump annotates the sampled records with, unless a
+// pump configures another one. The sample rate is the inverse of the sampling probability, e.g. 10
+// for a record kept out of 10. The metrics pumps, i.e. prometheus, aggregate, otelmetrics, rollup
+// and statsd, read it with their sample_rate_field option so that their counters are incremented
+// by the rate and reflect the true volume, statsd sends its timings with the rate too.
+const DefaultSampleRateField = "sample_rate"
+
+// sampleWeight returns the number of records the record stands for: the sample rate it is
+// annotated with in the rate field, or 1 when it was not sampled or the rate is not a number of at
+// least 1, times the number of identical records it was coalesced from, annotated in the count
+// field.
+func sampleWeight(record *analytics.AnalyticsRecord, rateField, countField string) float64 {
+	weight := 1.0
+	for _, field := range []string{rateField, countField} {
+		if field == "" {
+			continue
+		}
+
+		switch value := record.Extra[field].(type) {
+		case float64:
+			if value >= 1 {
+				weight *= value
+			}
+		case int64:
+			if value >= 1 {
+				weight *= float64(value)
+			}
+		case int:
+			if value >= 1 {
+				weight *= float64(value)
+			}
+		}
+	}
+
+	return weight
+}
+
+// attributeValue returns the value of the record field or extra field name, or else of the
+// attribute name of the authorization request, e.g. its resource or action. The attributes
+// decoded from the request are cached in request for the next names of the record.
+func attributeValue(record *analytics.AnalyticsRecord, name string,
+	request *map[string]interface{}) (interface{}, bool) {
+	if value, ok := record.FieldValue(name); ok {
+		return value, true
+	}
+
+	if *request == nil {
+		*request = make(map[string]interface{})
+		_ = json.Unmarshal([]byte(record.Request), request)
+	}
+	value, ok := (*request)[name]
+
+	return value, ok && value != nil
+}
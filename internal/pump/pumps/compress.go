@@ -0,0 +1,159 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// defaultCompressQueueSize is the number of rotated files compressed at once.
+const defaultCompressQueueSize = 16
+
+// partialCompressSuffix is the suffix of the archives being written, they are renamed once complete.
+const partialCompressSuffix = ".gz.partial"
+
+// fileCompressor gzips the files rotated by the file-based pumps in the background workers, so
+// that the compression does not delay the writes.
+type fileCompressor struct {
+	size int
+
+	mu      sync.Mutex
+	pending int
+	// backlog holds the rotated files waiting for the queued files to be compressed.
+	backlog []string
+	wg      sync.WaitGroup
+}
+
+func newFileCompressor(queueSize int) *fileCompressor {
+	if queueSize <= 0 {
+		queueSize = defaultCompressQueueSize
+	}
+
+	return &fileCompressor{size: queueSize}
+}
+
+// compress queues a rotated file for compression. When the queue is full the file waits in the
+// backlog, it is queued once a queued file is compressed.
+func (c *fileCompressor) compress(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wg.Add(1)
+	if c.pending >= c.size {
+		log.Debugf("Compression queue is full, %s waits in the backlog", name)
+		c.backlog = append(c.backlog, name)
+
+		return
+	}
+
+	c.start(name)
+}
+
+// start compresses the file in a background worker, c.mu must be held.
+func (c *fileCompressor) start(name string) {
+	c.pending++
+	backgroundWorkers.run(func() {
+		defer c.done()
+
+		if err := compressFile(name); err != nil {
+			log.Errorf("Failed to compress rotated file %s: %s", name, err.Error())
+		}
+	})
+}
+
+func (c *fileCompressor) done() {
+	c.mu.Lock()
+	c.pending--
+	if len(c.backlog) > 0 {
+		next := c.backlog[0]
+		c.backlog = c.backlog[1:]
+		c.start(next)
+	}
+	c.mu.Unlock()
+
+	c.wg.Done()
+}
+
+// close waits for the queued files and the backlog to be compressed.
+func (c *fileCompressor) close() {
+	c.wg.Wait()
+}
+
+// compressFile gzips the file next to it, then removes it. The archive is written under a partial
+// name first, so that an interrupted compression never leaves a truncated archive behind.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer src.Close()
+
+	partial := name + partialCompressSuffix
+	dst, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create archive")
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(partial)
+
+		return errors.Wrap(err, "failed to write archive")
+	}
+
+	if err := os.Rename(partial, name+".gz"); err != nil {
+		_ = os.Remove(partial)
+
+		return errors.Wrap(err, "failed to rename archive")
+	}
+
+	return errors.Wrap(os.Remove(name), "failed to remove compressed file")
+}
+
+// pendingCompressions removes the partial archives left in dir by an interrupted compression and
+// returns the files with the given extension which are not compressed yet, except current.
+func pendingCompressions(dir string, ext string, current string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Warnf("Failed to list %s for pending compressions: %s", dir, err.Error())
+
+		return nil
+	}
+
+	var pending []string
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, partialCompressSuffix):
+			log.Infof("Removing partial archive %s", name)
+			_ = os.Remove(name)
+		case strings.HasSuffix(name, ext) && name != current:
+			pending = append(pending, name)
+		}
+	}
+
+	return pending
+}
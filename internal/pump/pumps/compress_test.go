@@ -0,0 +1,76 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFileCompressor(t *testing.T) {
+	dir := t.TempDir()
+	rotated := filepath.Join(dir, "rotated.csv")
+	current := filepath.Join(dir, "current.csv")
+	partial := filepath.Join(dir, "crashed.csv"+partialCompressSuffix)
+	for _, name := range []string{rotated, current, partial} {
+		if err := ioutil.WriteFile(name, []byte("timestamp,username\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending := pendingCompressions(dir, ".csv", current)
+	if len(pending) != 1 || pending[0] != rotated {
+		t.Fatalf("expected the rotated file to be pending, got %v", pending)
+	}
+
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatal("partial archive should be removed")
+	}
+
+	compressor := newFileCompressor(1)
+	compressor.compress(rotated)
+	compressor.close()
+
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Fatal("rotated file should be removed once compressed")
+	}
+
+	f, err := os.Open(rotated + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadAll(zr)
+	if string(content) != "timestamp,username\n" {
+		t.Fatalf("unexpected archive content %q", content)
+	}
+}
+
+func TestFileCompressorBacklog(t *testing.T) {
+	dir := t.TempDir()
+	compressor := newFileCompressor(1)
+	for i := 0; i < 5; i++ {
+		name := filepath.Join(dir, strconv.Itoa(i)+".csv")
+		if err := ioutil.WriteFile(name, []byte("timestamp,username\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		compressor.compress(name)
+	}
+	compressor.close()
+
+	if pending := pendingCompressions(dir, ".csv", ""); len(pending) != 0 {
+		t.Fatalf("the files beyond the queue should be compressed from the backlog, got %v uncompressed", pending)
+	}
+}
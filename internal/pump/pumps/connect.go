@@ -0,0 +1,123 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// defaultConnectSchemaName is the name of the Kafka Connect schema of the records.
+const defaultConnectSchemaName = "iam.analytics.AnalyticsRecord"
+
+// connectTimestamp is the Kafka Connect logical type of the time fields, encoded as epoch milliseconds.
+const connectTimestamp = "org.apache.kafka.connect.data.Timestamp"
+
+// connectField describes a field of the Kafka Connect schema and how its value is read from a record.
+type connectField struct {
+	name      string
+	connect   string
+	timestamp bool
+	metadata  bool
+}
+
+// connectEnvelope wraps the records in the {schema, payload} envelope expected by the Kafka
+// Connect JsonConverter with schemas enabled. The schema is derived once from AnalyticsRecord and
+// the metadata names, then shared by all the messages.
+type connectEnvelope struct {
+	fields []connectField
+	schema map[string]interface{}
+}
+
+// newConnectEnvelope derives the schema of the envelope from the record fields, the metadata is
+// added as optional string fields.
+func newConnectEnvelope(name string, metadata []string) *connectEnvelope {
+	if name == "" {
+		name = defaultConnectSchemaName
+	}
+
+	fields := make([]connectField, 0)
+	typ := reflect.TypeOf(analytics.AnalyticsRecord{})
+	for i := 0; i < typ.NumField(); i++ {
+		jsonName := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if jsonName == "-" || jsonName == "" {
+			continue
+		}
+
+		field := connectField{name: jsonName}
+		switch fieldType := typ.Field(i).Type; {
+		case fieldType == reflect.TypeOf(time.Time{}):
+			field.connect = "int64"
+			field.timestamp = true
+		case fieldType.Kind() == reflect.Int64:
+			field.connect = "int64"
+		case fieldType.Kind() == reflect.String:
+			field.connect = "string"
+		default:
+			// the extra fields have no fixed schema
+			continue
+		}
+		fields = append(fields, field)
+	}
+
+	sort.Strings(metadata)
+	for _, name := range metadata {
+		if !analytics.IsRecordField(name) {
+			fields = append(fields, connectField{name: name, connect: "string", metadata: true})
+		}
+	}
+
+	schemaFields := make([]interface{}, len(fields))
+	for i, field := range fields {
+		schemaField := map[string]interface{}{
+			"field":    field.name,
+			"type":     field.connect,
+			"optional": field.metadata,
+		}
+		if field.timestamp {
+			schemaField["name"] = connectTimestamp
+			schemaField["version"] = 1
+		}
+		schemaFields[i] = schemaField
+	}
+
+	return &connectEnvelope{
+		fields: fields,
+		schema: map[string]interface{}{
+			"type":     "struct",
+			"name":     name,
+			"optional": false,
+			"fields":   schemaFields,
+		},
+	}
+}
+
+// wrap returns the envelope of the record, the fields which are not in the schema are left out
+// as the sinks would ignore them.
+func (c *connectEnvelope) wrap(record *analytics.AnalyticsRecord, metadata map[string]interface{}) Message {
+	payload := make(map[string]interface{}, len(c.fields))
+	for _, field := range c.fields {
+		if field.metadata {
+			if value, ok := metadata[field.name]; ok {
+				payload[field.name] = fmt.Sprint(value)
+			}
+
+			continue
+		}
+
+		value, _ := record.FieldValue(field.name)
+		if t, ok := value.(time.Time); ok {
+			value = t.UnixNano() / int64(time.Millisecond)
+		}
+		payload[field.name] = value
+	}
+
+	return Message{"schema": c.schema, "payload": payload}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// connectSinkRecord converts an enveloped message as the Kafka Connect JsonConverter does with
+// schemas enabled, it fails on the payloads which do not match their schema.
+func connectSinkRecord(message []byte) (map[string]interface{}, error) {
+	var envelope struct {
+		Schema struct {
+			Type   string `json:"type"`
+			Fields []struct {
+				Field    string `json:"field"`
+				Type     string `json:"type"`
+				Optional bool   `json:"optional"`
+			} `json:"fields"`
+		} `json:"schema"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.Schema.Type != "struct" {
+		return nil, fmt.Errorf("unsupported schema type %s", envelope.Schema.Type)
+	}
+
+	record := make(map[string]interface{}, len(envelope.Schema.Fields))
+	for _, field := range envelope.Schema.Fields {
+		value, ok := envelope.Payload[field.Field]
+		if !ok || value == nil {
+			if !field.Optional {
+				return nil, fmt.Errorf("required field %s is missing", field.Field)
+			}
+
+			continue
+		}
+
+		switch field.Type {
+		case "int64":
+			number, ok := value.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("field %s is not an int64", field.Field)
+			}
+			if _, err := number.Int64(); err != nil {
+				return nil, fmt.Errorf("field %s is not an int64: %w", field.Field, err)
+			}
+		case "string":
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("field %s is not a string", field.Field)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported type %s of field %s", field.Type, field.Field)
+		}
+		record[field.Field] = value
+	}
+
+	return record, nil
+}
+
+func TestConnectEnvelope(t *testing.T) {
+	envelope := newConnectEnvelope("", []string{"env", "username"})
+
+	record := analytics.AnalyticsRecord{
+		TimeStamp: 1600000000,
+		Username:  "colin",
+		Effect:    "allow",
+		ExpireAt:  time.Unix(1600000000, 0),
+	}
+	record.SetExtra("hostname", "pump-0")
+
+	message := envelope.wrap(&record, map[string]interface{}{"env": "prod"})
+	data, err := jsonMarshaler{}.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinkRecord, err := connectSinkRecord(data)
+	if err != nil {
+		t.Fatalf("the envelope should be accepted by a connect sink: %v\n%s", err, data)
+	}
+
+	if sinkRecord["username"] != "colin" || sinkRecord["env"] != "prod" ||
+		sinkRecord["expireAt"] != json.Number("1600000000000") {
+		t.Fatalf("unexpected sink record %v", sinkRecord)
+	}
+
+	if _, ok := sinkRecord["hostname"]; ok {
+		t.Fatal("the extra fields are not part of the schema")
+	}
+
+	other := envelope.wrap(&analytics.AnalyticsRecord{}, nil)
+	if reflect.ValueOf(other["schema"]).Pointer() != reflect.ValueOf(message["schema"]).Pointer() {
+		t.Fatal("the schema should be shared by the messages")
+	}
+
+	data, _ = jsonMarshaler{}.Marshal(other)
+	if _, err := connectSinkRecord(data); err != nil {
+		t.Fatalf("the metadata fields should be optional: %v", err)
+	}
+}
@@ -5,12 +5,22 @@
 package pumps
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"github.com/marmotedu/component-base/pkg/json"
 
 	"github.com/marmotedu/errors"
 	"github.com/mitchellh/mapstructure"
@@ -21,7 +31,16 @@ import (
 
 // CSVPump defines a csv pump with csv specific options and common options.
 type CSVPump struct {
-	csvConf *CSVConf
+	csvConf    *CSVConf
+	compressor *fileCompressor
+
+	mu      sync.Mutex
+	current string
+	// period is the file of the current rotation period, sequence the number of the file of the
+	// period the records are written to.
+	period   string
+	sequence int
+
 	CommonPumpConfig
 }
 
@@ -29,8 +48,48 @@ type CSVPump struct {
 type CSVConf struct {
 	// Specify the directory used to store automatically generated csv file which contains analyzed data.
 	CSVDir string `mapstructure:"csv_dir"`
+	// Compress gzips the csv files once rotated, in the background. CompressQueueSize is the number of
+	// files compressed at once, 16 by default, the next rotated files wait for them.
+	Compress          bool `mapstructure:"compress"`
+	CompressQueueSize int  `mapstructure:"compress_queue_size"`
+	// Columns are the json names of the record fields written, in order. All the fields are
+	// written, with their go names as header, when not set. The raw column holds the original
+	// payload read from the analytics storage, base64 encoded.
+	Columns []string `mapstructure:"columns"`
+	// Delimiter is the field delimiter, a comma by default.
+	Delimiter string `mapstructure:"delimiter"`
+	// BOM starts the new files with a UTF-8 byte order mark, which Excel needs to detect the encoding.
+	BOM bool `mapstructure:"bom"`
+	// TimestampFormats maps the time columns, timestamp and expireAt, to their format: unix,
+	// unix_ms, rfc3339 or a go time layout.
+	TimestampFormats map[string]string `mapstructure:"timestamp_formats"`
+	// Rotation is the period of the csv files, hourly by default or daily.
+	Rotation string `mapstructure:"rotation"`
+	// MaxFileSize is the size in bytes the csv files are rotated at within their period, the next
+	// files of the period are numbered, e.g. 2020-September-13-12.1.csv. 0 disables the size based
+	// rotation.
+	MaxFileSize int64 `mapstructure:"max_file_size"`
 }
 
+// Defines the rotation periods of the csv files.
+const (
+	CSVRotationHourly = "hourly"
+	CSVRotationDaily  = "daily"
+)
+
+// Defines the named timestamp formats of the csv columns.
+const (
+	csvFormatUnix    = "unix"
+	csvFormatUnixMs  = "unix_ms"
+	csvFormatRFC3339 = "rfc3339"
+)
+
+// csvRawColumn is the column of the original payloads read from the analytics storage.
+const csvRawColumn = "raw"
+
+// utf8BOM is the UTF-8 byte order mark.
+const utf8BOM = "\ufeff"
+
 // New create a csv pump instance.
 func (c *CSVPump) New() Pump {
 	newPump := CSVPump{}
@@ -51,11 +110,23 @@ func (c *CSVPump) Init(conf interface{}) error {
 		log.Fatalf("Failed to decode configuration: %s", err.Error())
 	}
 
+	if err := c.validate(); err != nil {
+		return err
+	}
+
 	ferr := os.MkdirAll(c.csvConf.CSVDir, 0o777)
 	if ferr != nil {
 		log.Error(ferr.Error())
 	}
 
+	current := c.rotate(time.Now())
+	if c.csvConf.Compress {
+		c.compressor = newFileCompressor(c.csvConf.CompressQueueSize)
+		for _, name := range pendingCompressions(c.csvConf.CSVDir, ".csv", current) {
+			c.compressor.compress(name)
+		}
+	}
+
 	log.Debug("CSV Initialized")
 
 	return nil
@@ -63,9 +134,7 @@ func (c *CSVPump) Init(conf interface{}) error {
 
 // WriteData write analyzed data to csv persistent back-end storage.
 func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
-	curtime := time.Now()
-	fname := fmt.Sprintf("%d-%s-%d-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour())
-	fname = path.Join(c.csvConf.CSVDir, fname)
+	fname := c.rotate(time.Now())
 
 	var outfile *os.File
 	var appendHeader bool
@@ -86,13 +155,18 @@ func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	}
 
 	defer outfile.Close()
-	writer := csv.NewWriter(outfile)
+	counter := &countingWriter{w: outfile}
+	writer := csv.NewWriter(counter)
+	if c.csvConf.Delimiter != "" {
+		writer.Comma, _ = utf8.DecodeRuneInString(c.csvConf.Delimiter)
+	}
 
 	if appendHeader {
-		startRecord := analytics.AnalyticsRecord{}
-		headers := startRecord.GetFieldNames()
+		if c.csvConf.BOM {
+			_, _ = io.WriteString(counter, utf8BOM)
+		}
 
-		err := writer.Write(headers)
+		err := writer.Write(c.header())
 		if err != nil {
 			log.Errorf("Failed to write file headers: %s", err.Error())
 
@@ -103,7 +177,7 @@ func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	for _, v := range data {
 		decoded, _ := v.(analytics.AnalyticsRecord)
 
-		toWrite := decoded.GetLineValues()
+		toWrite := c.line(&decoded)
 		err := writer.Write(toWrite)
 		if err != nil {
 			log.Error("File write failed!")
@@ -112,6 +186,375 @@ func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	}
 
 	writer.Flush()
+	addWrittenBytes(ctx, counter.n)
+
+	return nil
+}
+
+// Shutdown waits for the rotated files to be compressed.
+func (c *CSVPump) Shutdown() error {
+	if c.compressor != nil {
+		c.compressor.close()
+	}
+
+	return nil
+}
+
+// validate checks the columns and the timestamp formats against the record fields.
+func (c *CSVPump) validate() error {
+	if c.csvConf.Delimiter != "" {
+		delimiter, size := utf8.DecodeRuneInString(c.csvConf.Delimiter)
+		if size != len(c.csvConf.Delimiter) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' {
+			return errors.Errorf("csv delimiter %q must be a single character other than a quote or a newline",
+				c.csvConf.Delimiter)
+		}
+	}
+
+	fields := make(map[string]bool)
+	for _, name := range csvColumns() {
+		fields[name] = true
+	}
+	for _, column := range c.csvConf.Columns {
+		if !fields[column] && column != csvRawColumn {
+			return errors.Errorf("csv column %s is not a record field", column)
+		}
+	}
+
+	switch c.csvConf.Rotation {
+	case "":
+		c.csvConf.Rotation = CSVRotationHourly
+	case CSVRotationHourly, CSVRotationDaily:
+	default:
+		return errors.Errorf("csv rotation must be %s or %s", CSVRotationHourly, CSVRotationDaily)
+	}
+
+	if c.csvConf.MaxFileSize < 0 {
+		return errors.New("csv max_file_size cannot be negative")
+	}
+
+	for column, format := range c.csvConf.TimestampFormats {
+		if column != "timestamp" && column != "expireAt" {
+			return errors.Errorf("csv column %s is not a time column, timestamp formats apply to timestamp and expireAt",
+				column)
+		}
+		if format == "" {
+			return errors.Errorf("csv timestamp format of column %s is empty", column)
+		}
+	}
 
 	return nil
 }
+
+// header returns the header row of the csv files.
+func (c *CSVPump) header() []string {
+	if len(c.csvConf.Columns) == 0 {
+		startRecord := analytics.AnalyticsRecord{}
+
+		return startRecord.GetFieldNames()
+	}
+
+	return c.csvConf.Columns
+}
+
+// line returns the row of the record.
+func (c *CSVPump) line(record *analytics.AnalyticsRecord) []string {
+	if len(c.csvConf.Columns) == 0 && len(c.csvConf.TimestampFormats) == 0 {
+		return record.GetLineValues()
+	}
+
+	columns := c.csvConf.Columns
+	if len(columns) == 0 {
+		columns = csvColumns()
+	}
+
+	values := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if column == csvRawColumn {
+			values = append(values, base64.StdEncoding.EncodeToString(record.Raw))
+
+			continue
+		}
+		value, _ := record.FieldValue(column)
+		if column == "extra" {
+			value = record.Extra
+		}
+		values = append(values, c.formatValue(column, value))
+	}
+
+	return values
+}
+
+// WantsRawRecords reports whether the csv pump writes the raw column.
+func (c *CSVPump) WantsRawRecords() bool {
+	for _, column := range c.csvConf.Columns {
+		if column == csvRawColumn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// csvColumns returns the json names of all the record fields, in the order of the default header.
+func csvColumns() []string {
+	columns := make([]string, 0)
+	typ := reflect.TypeOf(analytics.AnalyticsRecord{})
+	for i := 0; i < typ.NumField(); i++ {
+		if name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; name != "-" && name != "" {
+			columns = append(columns, name)
+		}
+	}
+
+	return columns
+}
+
+// formatValue formats the value of the column, the time columns with their configured format.
+func (c *CSVPump) formatValue(column string, value interface{}) string {
+	format := c.csvConf.TimestampFormats[column]
+	switch v := value.(type) {
+	case time.Time:
+		if format == "" {
+			return v.String()
+		}
+
+		return formatCSVTime(v, format)
+	case int64:
+		if format == "" {
+			return strconv.FormatInt(v, 10)
+		}
+
+		return formatCSVTime(time.Unix(v, 0), format)
+	case string:
+		return v
+	case nil:
+		return ""
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(v)
+
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func formatCSVTime(t time.Time, format string) string {
+	switch format {
+	case csvFormatUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case csvFormatUnixMs:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case csvFormatRFC3339:
+		return t.Format(time.RFC3339)
+	default:
+		return t.Format(format)
+	}
+}
+
+// csvTimeColumns maps the go names of the time columns to their json names.
+var csvTimeColumns = map[string]string{"TimeStamp": "timestamp", "ExpireAt": "expireAt"}
+
+// parseCSVTime parses the time formatted by formatCSVTime.
+func parseCSVTime(value, format string) (time.Time, error) {
+	switch format {
+	case csvFormatUnix, csvFormatUnixMs:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if format == csvFormatUnixMs {
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		}
+
+		return time.Unix(n, 0), nil
+	case csvFormatRFC3339:
+		return time.Parse(time.RFC3339, value)
+	default:
+		return time.Parse(format, value)
+	}
+}
+
+// CSVArchive reads the records back from the csv files written by a csv pump, for the backfill.
+type CSVArchive struct {
+	pump *CSVPump
+}
+
+// NewCSVArchive returns the reader of the csv files written by a csv pump with the configuration,
+// the default options are used when it is nil.
+func NewCSVArchive(config interface{}) (*CSVArchive, error) {
+	pump := &CSVPump{csvConf: &CSVConf{}}
+	if err := mapstructure.Decode(config, &pump.csvConf); err != nil {
+		return nil, errors.Wrap(err, "failed to decode csv configuration")
+	}
+
+	if err := pump.validate(); err != nil {
+		return nil, err
+	}
+
+	return &CSVArchive{pump: pump}, nil
+}
+
+// Read reads the records of a csv file, each is called with every record, or the error of its
+// line. The file is refused when its header holds a column the csv pump does not write, e.g. when
+// it was written with another delimiter.
+func (a *CSVArchive) Read(r io.Reader, each func(analytics.AnalyticsRecord, error) error) error {
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		_, _ = buffered.Discard(len(utf8BOM))
+	}
+
+	reader := csv.NewReader(buffered)
+	if a.pump.csvConf.Delimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(a.pump.csvConf.Delimiter)
+	}
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the default header holds the go names of the fields, the configured columns their json names
+	names := make(map[string]string)
+	goNames := (&analytics.AnalyticsRecord{}).GetFieldNames()
+	for i, column := range csvColumns() {
+		names[column], names[goNames[i]] = goNames[i], goNames[i]
+	}
+	columns := make([]string, len(header))
+	for i, column := range header {
+		if columns[i] = names[column]; columns[i] == "" && column != csvRawColumn {
+			return errors.Errorf("csv column %s is not written by the csv pump", column)
+		}
+	}
+
+	for {
+		values, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record, err := a.record(header, columns, values)
+		if err := each(record, err); err != nil {
+			return err
+		}
+	}
+}
+
+// record returns the record of the line values, columns holds the go names of the header columns.
+func (a *CSVArchive) record(header, columns, values []string) (analytics.AnalyticsRecord, error) {
+	record := analytics.AnalyticsRecord{}
+	for i, column := range header {
+		if i >= len(values) || values[i] == "" {
+			continue
+		}
+
+		switch format := a.pump.csvConf.TimestampFormats[csvTimeColumns[columns[i]]]; {
+		case column == csvRawColumn:
+			raw, err := base64.StdEncoding.DecodeString(values[i])
+			if err != nil {
+				return record, errors.Wrapf(err, "invalid %s value", column)
+			}
+			record.Raw = raw
+		case format != "" && columns[i] == "TimeStamp":
+			t, err := parseCSVTime(values[i], format)
+			if err != nil {
+				return record, errors.Wrapf(err, "invalid %s value %s", column, values[i])
+			}
+			record.TimeStamp = t.Unix()
+		case format != "" && columns[i] == "ExpireAt":
+			t, err := parseCSVTime(values[i], format)
+			if err != nil {
+				return record, errors.Wrapf(err, "invalid %s value %s", column, values[i])
+			}
+			record.ExpireAt = t
+		default:
+			if err := record.SetLineValues(columns[i:i+1], values[i:i+1]); err != nil {
+				return record, err
+			}
+		}
+	}
+
+	return record, nil
+}
+
+// fileName returns the first csv file of the period of curtime, a new file is used every hour, or
+// every day with the daily rotation.
+func (c *CSVPump) fileName(curtime time.Time) string {
+	fname := fmt.Sprintf("%d-%s-%d-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour())
+	if c.csvConf.Rotation == CSVRotationDaily {
+		fname = fmt.Sprintf("%d-%s-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day())
+	}
+
+	return path.Join(c.csvConf.CSVDir, fname)
+}
+
+// rotate returns the csv file the records written at curtime go to: the file of the period, or
+// the next file of the period once it reached the max file size. The previous file is queued for
+// compression when the records go to a new file.
+func (c *CSVPump) rotate(curtime time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	period := c.fileName(curtime)
+	if period != c.period {
+		// the files of the period written before a restart are kept
+		c.period, c.sequence = period, lastCSVSequence(period)
+	}
+
+	if c.csvConf.MaxFileSize > 0 {
+		if info, err := os.Stat(csvSequenceName(period, c.sequence)); err == nil && info.Size() >= c.csvConf.MaxFileSize {
+			c.sequence++
+		}
+	}
+
+	fname := csvSequenceName(period, c.sequence)
+	if c.compressor != nil && c.current != "" && c.current != fname {
+		c.compressor.compress(c.current)
+	}
+	c.current = fname
+
+	return fname
+}
+
+// csvSequenceName returns the name of the file of the given number of the period.
+func csvSequenceName(period string, sequence int) string {
+	if sequence == 0 {
+		return period
+	}
+
+	return fmt.Sprintf("%s.%d.csv", strings.TrimSuffix(period, ".csv"), sequence)
+}
+
+// lastCSVSequence returns the number of the last file of the period found, compressed or not.
+func lastCSVSequence(period string) int {
+	sequence := 0
+	for {
+		name := csvSequenceName(period, sequence+1)
+		if _, err := os.Stat(name); err != nil {
+			if _, err := os.Stat(name + ".gz"); err != nil {
+				return sequence
+			}
+		}
+		sequence++
+	}
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+
+	return n, err
+}
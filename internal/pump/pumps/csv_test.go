@@ -0,0 +1,188 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestCSVPumpColumns(t *testing.T) {
+	dir := t.TempDir()
+	pmp := &CSVPump{}
+	err := pmp.Init(map[string]interface{}{
+		"csv_dir":           dir,
+		"columns":           []string{"expireAt", "username", "timestamp", "region"},
+		"delimiter":         ";",
+		"bom":               true,
+		"timestamp_formats": map[string]string{"timestamp": "rfc3339", "expireAt": "unix_ms"},
+	})
+	if err == nil {
+		t.Fatal("a column which is not a record field should be rejected")
+	}
+
+	err = pmp.Init(map[string]interface{}{
+		"csv_dir":           dir,
+		"columns":           []string{"expireAt", "username", "timestamp"},
+		"delimiter":         ";",
+		"bom":               true,
+		"timestamp_formats": map[string]string{"timestamp": "rfc3339", "expireAt": "unix_ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{
+		TimeStamp: 1600000000,
+		Username:  "colin",
+		ExpireAt:  time.Unix(1600003600, 500*int64(time.Millisecond)),
+	}
+	if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(pmp.fileName(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := utf8BOM + "expireAt;username;timestamp\n1600003600500;colin;" +
+		time.Unix(1600000000, 0).Format(time.RFC3339) + "\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected csv file %q, expected %q", data, expected)
+	}
+
+	if err := (&CSVPump{}).Init(map[string]interface{}{"csv_dir": dir, "delimiter": "||"}); err == nil {
+		t.Fatal("a delimiter of several characters should be rejected")
+	}
+}
+
+func TestCSVPumpRawColumn(t *testing.T) {
+	pmp := &CSVPump{}
+	err := pmp.Init(map[string]interface{}{
+		"csv_dir": t.TempDir(),
+		"columns": []string{"username", "raw"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pmp.WantsRawRecords() {
+		t.Fatal("the raw column should request the raw payloads")
+	}
+
+	record := analytics.AnalyticsRecord{Username: "colin", Raw: []byte{0x81, 0xa8}}
+	if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(pmp.fileName(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "username,raw\ncolin,gag=\n"; string(data) != expected {
+		t.Fatalf("unexpected csv file %q, expected %q", data, expected)
+	}
+}
+
+func TestCSVArchive(t *testing.T) {
+	conf := map[string]interface{}{
+		"csv_dir":           t.TempDir(),
+		"columns":           []string{"timestamp", "username", "expireAt", "extra", "raw"},
+		"delimiter":         ";",
+		"bom":               true,
+		"timestamp_formats": map[string]string{"timestamp": "rfc3339", "expireAt": "unix_ms"},
+	}
+	pmp := &CSVPump{}
+	if err := pmp.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	written := analytics.AnalyticsRecord{
+		TimeStamp: 1600000000,
+		Username:  "colin",
+		ExpireAt:  time.Unix(1700000000, 0),
+		Extra:     map[string]interface{}{"region": "eu"},
+		Raw:       []byte{0x81, 0xa8},
+	}
+	if err := pmp.WriteData(context.Background(), []interface{}{written}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(pmp.fileName(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := NewCSVArchive(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []analytics.AnalyticsRecord
+	err = archive.Read(bytes.NewReader(data), func(record analytics.AnalyticsRecord, err error) error {
+		records = append(records, record)
+
+		return err
+	})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("the record should be read back, got %v: %v", records, err)
+	}
+	if read := records[0]; read.TimeStamp != written.TimeStamp || read.Username != "colin" ||
+		!read.ExpireAt.Equal(written.ExpireAt) || read.Extra["region"] != "eu" || !bytes.Equal(read.Raw, written.Raw) {
+		t.Fatalf("the record should be read with the options of the csv pump, got %+v", read)
+	}
+
+	// the header is not understood with the default delimiter
+	defaults, _ := NewCSVArchive(nil)
+	if err := defaults.Read(bytes.NewReader(data), func(analytics.AnalyticsRecord, error) error {
+		return nil
+	}); err == nil {
+		t.Fatal("the file should be refused with the default options")
+	}
+}
+
+func TestCSVPumpSizeRotation(t *testing.T) {
+	dir := t.TempDir()
+	pmp := &CSVPump{}
+	err := pmp.Init(map[string]interface{}{
+		"csv_dir":       dir,
+		"rotation":      "daily",
+		"max_file_size": 1,
+		"compress":      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}
+	for i := 0; i < 3; i++ {
+		if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pmp.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	period := pmp.fileName(time.Now())
+	for _, name := range []string{period + ".gz", csvSequenceName(period, 1) + ".gz", csvSequenceName(period, 2)} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+	}
+
+	// a restarted pump goes on with the last file of the period
+	restarted := &CSVPump{}
+	if err := restarted.Init(map[string]interface{}{"csv_dir": dir, "rotation": "daily", "max_file_size": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if current := restarted.rotate(time.Now()); current != csvSequenceName(period, 3) {
+		t.Fatalf("unexpected file %s after restart", current)
+	}
+}
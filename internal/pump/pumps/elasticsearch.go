@@ -7,6 +7,7 @@ package pumps
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
@@ -24,6 +25,7 @@ import (
 type ElasticsearchPump struct {
 	operator ElasticsearchOperator
 	esConf   *ElasticsearchConf
+	format   string
 	CommonPumpConfig
 }
 
@@ -40,6 +42,16 @@ type ElasticsearchConf struct {
 	EnableSniffing   bool                    `mapstructure:"use_sniffing"`
 	RollingIndex     bool                    `mapstructure:"rolling_index"`
 	DisableBulk      bool                    `mapstructure:"disable_bulk"`
+	// IndexTemplate routes every record to an index derived from its tenant and creation date,
+	// e.g. iam-{tenant}-{date:2006.01.02}, the UTC date is formatted with the Go layout of every
+	// {date:...} placeholder. It takes precedence over IndexName and RollingIndex.
+	IndexTemplate string `mapstructure:"index_template"`
+	// TenantField is the record field holding the tenant, the records missing it are routed to
+	// the DefaultTenant indices.
+	TenantField   string `mapstructure:"tenant_field"`
+	DefaultTenant string `mapstructure:"default_tenant"`
+	// The headers are set on the elasticsearch requests, the metadata is added to the documents.
+	HeadersConf `mapstructure:",squash"`
 }
 
 // ElasticsearchBulkConfig defines elasticsearch bulk config.
@@ -52,13 +64,15 @@ type ElasticsearchBulkConfig struct {
 
 // ElasticsearchOperator defines interface for all elasticsearch operator.
 type ElasticsearchOperator interface {
-	processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error
+	processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf, format string, precedence []string) error
+	close() error
 }
 
 // Elasticsearch7Operator defines elasticsearch6 operator.
 type Elasticsearch7Operator struct {
 	esClient      *elastic.Client
 	bulkProcessor *elastic.BulkProcessor
+	rejected      RejectionReporter
 }
 
 // APIKeyTransport defiens elasticsearch api key.
@@ -77,7 +91,7 @@ func (t *APIKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(r)
 }
 
-func getOperator(ctx context.Context, conf ElasticsearchConf) (ElasticsearchOperator, error) {
+func getOperator(ctx context.Context, conf ElasticsearchConf, rejected RejectionReporter) (ElasticsearchOperator, error) {
 	var err error
 	urls := strings.Split(conf.ElasticsearchURL, ",")
 	httpClient := http.DefaultClient
@@ -87,13 +101,17 @@ func getOperator(ctx context.Context, conf ElasticsearchConf) (ElasticsearchOper
 		httpClient = &http.Client{Transport: &APIKeyTransport{APIKey: conf.AuthAPIKey, APIKeyID: conf.AuthAPIKeyID}}
 	}
 
-	e := new(Elasticsearch7Operator)
+	headers := http.Header{}
+	conf.setHeaders(headers)
+
+	e := &Elasticsearch7Operator{rejected: rejected}
 
 	e.esClient, err = elastic.NewClient(
 		elastic.SetURL(urls...),
 		elastic.SetSniff(conf.EnableSniffing),
 		elastic.SetBasicAuth(conf.Username, conf.Password),
 		elastic.SetHttpClient(httpClient),
+		elastic.SetHeaders(headers),
 	)
 
 	if err != nil {
@@ -117,7 +135,7 @@ func getOperator(ctx context.Context, conf ElasticsearchConf) (ElasticsearchOper
 		p = p.BulkSize(conf.BulkConfig.BulkSize)
 	}
 
-	e.bulkProcessor, err = p.Do(ctx)
+	e.bulkProcessor, err = p.After(e.afterBulk).Do(ctx)
 
 	return e, errors.Wrap(err, "failed to start bulk processor")
 }
@@ -134,6 +152,11 @@ func (e *ElasticsearchPump) GetName() string {
 	return "Elasticsearch Pump"
 }
 
+// SetFormat sets the format the elasticsearch documents are written in.
+func (e *ElasticsearchPump) SetFormat(format string) {
+	e.format = format
+}
+
 // Init initialize the elasticsearch pump instance.
 func (e *ElasticsearchPump) Init(config interface{}) error {
 	e.esConf = &ElasticsearchConf{}
@@ -155,12 +178,24 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 		e.esConf.DocumentType = "iam_analytics"
 	}
 
+	if strings.Contains(e.esConf.IndexTemplate, tenantPlaceholder) && e.esConf.TenantField == "" {
+		return errors.New("elasticsearch index_template routes by tenant but tenant_field is not set")
+	}
+
+	if e.esConf.DefaultTenant == "" {
+		e.esConf.DefaultTenant = "default"
+	}
+
 	re := regexp.MustCompile(`(.*)\/\/(.*):(.*)\@(.*)`)
 	printableURL := re.ReplaceAllString(e.esConf.ElasticsearchURL, `$1//***:***@$4`)
 
 	log.Infof("Elasticsearch URL: %s", printableURL)
-	log.Infof("Elasticsearch Index: %s", e.esConf.IndexName)
-	if e.esConf.RollingIndex {
+	if e.esConf.IndexTemplate != "" {
+		log.Infof("Elasticsearch Index Template: %s", e.esConf.IndexTemplate)
+	} else {
+		log.Infof("Elasticsearch Index: %s", e.esConf.IndexName)
+	}
+	if e.esConf.RollingIndex && e.esConf.IndexTemplate == "" {
 		log.Infof("Index will have date appended to it in the format %s -YYYY.MM.DD", e.esConf.IndexName)
 	}
 
@@ -172,7 +207,7 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 func (e *ElasticsearchPump) connect(ctx context.Context) {
 	var err error
 
-	e.operator, err = getOperator(ctx, *e.esConf)
+	e.operator, err = getOperator(ctx, *e.esConf, e.reportRejection)
 	if err != nil {
 		log.Errorf("Elasticsearch connection failed: %s", err.Error())
 		time.Sleep(5 * time.Second)
@@ -189,12 +224,21 @@ func (e *ElasticsearchPump) WriteData(ctx context.Context, data []interface{}) e
 		e.connect(ctx)
 		_ = e.WriteData(ctx, data)
 	} else if len(data) > 0 {
-		_ = e.operator.processData(ctx, data, e.esConf)
+		_ = e.operator.processData(ctx, data, e.esConf, e.format, e.GetFieldPrecedence())
 	}
 
 	return nil
 }
 
+// Shutdown flushes the pending bulk requests and stops the elasticsearch client.
+func (e *ElasticsearchPump) Shutdown() error {
+	if e.operator == nil {
+		return nil
+	}
+
+	return e.operator.close()
+}
+
 func getIndexName(esConf *ElasticsearchConf) string {
 	indexName := esConf.IndexName
 
@@ -207,24 +251,68 @@ func getIndexName(esConf *ElasticsearchConf) string {
 	return indexName
 }
 
-func getMapping(datum analytics.AnalyticsRecord) (map[string]interface{}, string) {
-	record := datum
-	mapping := map[string]interface{}{
-		"@timestamp": record.TimeStamp,
-		"username":   record.Username,
-		"effect":     record.Effect,
-		"conclusion": record.Conclusion,
-		"request":    record.Request,
-		"policies":   record.Policies,
-		"deciders":   record.Deciders,
-		"expireAt":   record.ExpireAt,
+// tenantPlaceholder is replaced by the tenant of the record in the index template.
+const tenantPlaceholder = "{tenant}"
+
+// datePlaceholder matches the {date:layout} placeholders of the index template.
+var datePlaceholder = regexp.MustCompile(`\{date:([^}]*)\}`)
+
+// invalidIndexChars matches the characters elasticsearch rejects in index names.
+var invalidIndexChars = regexp.MustCompile(`[\\/*?"<>| ,#:]`)
+
+// getRecordIndexName returns the index the record is written to.
+func getRecordIndexName(esConf *ElasticsearchConf, record *analytics.AnalyticsRecord) string {
+	if esConf.IndexTemplate == "" {
+		return getIndexName(esConf)
+	}
+
+	// the date is formatted first, the tenant could otherwise contain a placeholder
+	created := time.Unix(record.TimeStamp, 0).UTC()
+	indexName := datePlaceholder.ReplaceAllStringFunc(esConf.IndexTemplate, func(placeholder string) string {
+		return created.Format(datePlaceholder.FindStringSubmatch(placeholder)[1])
+	})
+	if !strings.Contains(indexName, tenantPlaceholder) {
+		return indexName
+	}
+
+	tenant := esConf.DefaultTenant
+	if value, ok := record.FieldValue(esConf.TenantField); ok {
+		if name := fmt.Sprint(value); name != "" {
+			tenant = name
+		}
+	}
+	tenant = invalidIndexChars.ReplaceAllString(strings.ToLower(tenant), "_")
+
+	return strings.ReplaceAll(indexName, tenantPlaceholder, tenant)
+}
+
+// getMapping returns the document indexed for the record along with the metadata, its id is
+// generated by elasticsearch.
+func getMapping(
+	datum analytics.AnalyticsRecord,
+	format string,
+	metadata map[string]interface{},
+	precedence []string,
+) (map[string]interface{}, string) {
+	mapping := datum.Document(format, metadata, precedence)
+	if format != analytics.FormatECS {
+		mapping["@timestamp"] = mapping["timestamp"]
+		delete(mapping, "timestamp")
 	}
 
 	return mapping, ""
 }
 
-func (e Elasticsearch7Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+func (e Elasticsearch7Operator) processData(
+	ctx context.Context,
+	data []interface{},
+	esConf *ElasticsearchConf,
+	format string,
+	precedence []string,
+) error {
+	// the records are grouped per index, so that the bulk requests of an index are sent together
+	indices := make([]string, 0, 1)
+	batches := make(map[string][]analytics.AnalyticsRecord)
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
@@ -238,19 +326,112 @@ func (e Elasticsearch7Operator) processData(ctx context.Context, data []interfac
 			continue
 		}
 
-		mapping, id := getMapping(d)
+		indexName := getRecordIndexName(esConf, &d)
+		if _, ok := batches[indexName]; !ok {
+			indices = append(indices, indexName)
+		}
+		batches[indexName] = append(batches[indexName], d)
+	}
+
+	for _, indexName := range indices {
+		log.Debugf("Writing %d records to index %s", len(batches[indexName]), indexName)
+		e.indexRecords(ctx, indexName, batches[indexName], esConf, format, precedence)
+	}
+
+	return nil
+}
+
+func (e Elasticsearch7Operator) indexRecords(
+	ctx context.Context,
+	indexName string,
+	records []analytics.AnalyticsRecord,
+	esConf *ElasticsearchConf,
+	format string,
+	precedence []string,
+) {
+	index := e.esClient.Index().Index(indexName)
+
+	for i := range records {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return
+		}
+
+		mapping, id := getMapping(records[i], format, esConf.metadata(&records[i]), precedence)
 
 		if !esConf.DisableBulk {
-			r := elastic.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elastic.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
 			//nolint: staticcheck
 			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
 			if err != nil {
-				log.Errorf("Error while writing %s %s", data[dataIndex], err.Error())
+				log.Errorf("Error while writing %v %s", records[i], err.Error())
+				e.reportError(1, err)
 			}
 		}
 	}
+}
 
-	return nil
+// afterBulk reports the bulk requests, and the items of the bulk requests, rejected by
+// elasticsearch for their size or rate.
+func (e Elasticsearch7Operator) afterBulk(_ int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if err != nil {
+		e.reportError(len(requests), err)
+
+		return
+	}
+
+	if response == nil {
+		return
+	}
+
+	rejected := make(map[string]int)
+	var details *elastic.ErrorDetails
+	for _, item := range response.Failed() {
+		reason, ok := bulkItemRejectionReason(item)
+		if !ok {
+			continue
+		}
+		rejected[reason]++
+		details = item.Error
+	}
+
+	for reason, count := range rejected {
+		err := errors.New("elasticsearch rejected the bulk items")
+		if details != nil {
+			err = errors.Errorf("elasticsearch rejected the bulk items: %s: %s", details.Type, details.Reason)
+		}
+		e.rejected(reason, count, err)
+	}
+}
+
+// reportError reports the records of a request failing with err when elasticsearch rejected it
+// for its size or rate.
+func (e Elasticsearch7Operator) reportError(records int, err error) {
+	var esErr *elastic.Error
+	if !errors.As(err, &esErr) {
+		return
+	}
+
+	if reason, ok := statusRejectionReason(esErr.Status); ok {
+		e.rejected(reason, records, err)
+	}
+}
+
+// bulkItemRejectionReason returns the reason elasticsearch rejected the bulk item for, when it
+// rejected it for its size or rate.
+func bulkItemRejectionReason(item *elastic.BulkResponseItem) (string, bool) {
+	if item.Error != nil && item.Error.Type == "es_rejected_execution_exception" {
+		return RejectionRateLimited, true
+	}
+
+	return statusRejectionReason(item.Status)
+}
+
+func (e Elasticsearch7Operator) close() error {
+	// Close flushes the pending bulk requests before stopping the workers
+	err := e.bulkProcessor.Close()
+	e.esClient.Stop()
+
+	return errors.Wrap(err, "failed to close bulk processor")
 }
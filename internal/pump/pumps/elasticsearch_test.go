@@ -0,0 +1,38 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestGetRecordIndexName(t *testing.T) {
+	esConf := &ElasticsearchConf{
+		IndexTemplate: "iam-2-{tenant}-{date:2006.01.02}",
+		TenantField:   "tenant",
+		DefaultTenant: "default",
+	}
+	created := time.Date(2020, time.March, 7, 23, 0, 0, 0, time.UTC).Unix()
+
+	record := analytics.AnalyticsRecord{TimeStamp: created}
+	record.SetExtra("tenant", "Team 01")
+	// only the placeholders are substituted, in UTC whatever the local time zone
+	if name := getRecordIndexName(esConf, &record); name != "iam-2-team_01-2020.03.07" {
+		t.Fatalf("the record should be routed by tenant and date, got %s", name)
+	}
+
+	missing := analytics.AnalyticsRecord{TimeStamp: created}
+	if name := getRecordIndexName(esConf, &missing); name != "iam-2-default-2020.03.07" {
+		t.Fatalf("the record without tenant should be routed to the default tenant, got %s", name)
+	}
+
+	esConf = &ElasticsearchConf{IndexName: "iam_analytics"}
+	if name := getRecordIndexName(esConf, &record); name != "iam_analytics" {
+		t.Fatalf("the index name should be used without template, got %s", name)
+	}
+}
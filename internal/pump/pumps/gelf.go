@@ -0,0 +1,310 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/ory/ladon"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the compressions of the GELF messages sent over udp.
+const (
+	GELFCompressionGzip = "gzip"
+	GELFCompressionZlib = "zlib"
+	GELFCompressionNone = "none"
+)
+
+// Defines the defaults and limits of the GELF chunking.
+const (
+	defaultGELFChunkSize = 1420
+	gelfChunkHeaderSize  = 12
+	gelfMaxChunks        = 128
+)
+
+// Defines the syslog severities of the GELF messages.
+const (
+	gelfLevelNotice = 5
+	gelfLevelInfo   = 6
+)
+
+// gelfFieldName matches the valid names of the additional fields.
+var gelfFieldName = regexp.MustCompile(`^[\w.\-]+$`)
+
+// GELFPump defines a pump which sends the analytics records to Graylog as GELF messages, the
+// fields of the records being the additional fields of the messages.
+type GELFPump struct {
+	conf   *GELFConf
+	writer *netWriter
+	format string
+
+	CommonPumpConfig
+}
+
+// GELFConf defines gelf specific options.
+type GELFConf struct {
+	// Transport is udp, the default, tcp or tls. The messages are compressed and chunked over
+	// udp, null byte delimited over the stream transports.
+	Transport   string `mapstructure:"transport"`
+	NetworkAddr string `mapstructure:"network_addr"`
+	// Host is the host field of the messages, the name of the host by default.
+	Host string `mapstructure:"host"`
+	// Compression is gzip, the default, zlib or none.
+	Compression string `mapstructure:"compression"`
+	// ChunkSize is the maximum size of the udp datagrams, 1420 by default, the messages larger
+	// than 128 chunks are dropped.
+	ChunkSize int `mapstructure:"chunk_size"`
+	// The metadata is added to the additional fields.
+	HeadersConf           `mapstructure:",squash"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// New create a gelf pump instance.
+func (g *GELFPump) New() Pump {
+	newPump := GELFPump{}
+
+	return &newPump
+}
+
+// GetName returns the gelf pump name.
+func (g *GELFPump) GetName() string {
+	return "GELF Pump"
+}
+
+// SetFormat sets the format the fields of the gelf messages are written in.
+func (g *GELFPump) SetFormat(format string) {
+	g.format = format
+}
+
+// Init initialize the gelf pump instance, the connection is established by the first write.
+func (g *GELFPump) Init(config interface{}) error {
+	g.conf = &GELFConf{}
+	if err := mapstructure.Decode(config, &g.conf); err != nil {
+		return errors.Wrap(err, "failed to decode gelf configuration")
+	}
+
+	switch g.conf.Transport {
+	case "":
+		g.conf.Transport = "udp"
+	case "udp", "tcp", "tls":
+	default:
+		return errors.Errorf("gelf transport %s is not supported, use udp, tcp or tls", g.conf.Transport)
+	}
+
+	if g.conf.NetworkAddr == "" {
+		return errors.New("gelf network_addr not set")
+	}
+
+	switch g.conf.Compression {
+	case "":
+		g.conf.Compression = GELFCompressionGzip
+	case GELFCompressionGzip, GELFCompressionZlib, GELFCompressionNone:
+	default:
+		return errors.Errorf("gelf compression must be %s, %s or %s",
+			GELFCompressionGzip, GELFCompressionZlib, GELFCompressionNone)
+	}
+
+	if g.conf.ChunkSize <= 0 {
+		g.conf.ChunkSize = defaultGELFChunkSize
+	}
+	if g.conf.ChunkSize <= gelfChunkHeaderSize {
+		return errors.Errorf("gelf chunk_size must be larger than %d", gelfChunkHeaderSize)
+	}
+
+	if g.conf.Host == "" {
+		g.conf.Host, _ = os.Hostname()
+	}
+
+	g.writer = &netWriter{network: g.conf.Transport, addr: g.conf.NetworkAddr}
+	if g.conf.Transport == "tls" {
+		var err error
+		g.writer.tlsConfig, err = loadTLSConfig(g.conf.SSLCAFile, g.conf.SSLCertFile, g.conf.SSLKeyFile,
+			g.conf.SSLInsecureSkipVerify)
+		if err != nil {
+			return errors.Wrap(err, "invalid gelf tls options")
+		}
+	}
+
+	log.Infof("GELF pump sends the records to %s over %s", g.conf.NetworkAddr, g.conf.Transport)
+
+	return nil
+}
+
+// WriteData sends a gelf message per record, within the deadline of the context.
+func (g *GELFPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		message, err := json.Marshal(g.message(&record))
+		if err != nil {
+			log.Errorf("unable to marshal gelf message: %s", err.Error())
+
+			continue
+		}
+
+		if g.conf.Transport != "udp" {
+			n, err := g.writer.write(ctx, append(message, 0))
+			if err != nil {
+				return errors.Wrap(err, "failed to send gelf message")
+			}
+			addWrittenBytes(ctx, n)
+
+			continue
+		}
+
+		datagrams, err := g.datagrams(message)
+		if err != nil {
+			log.Errorf("Dropping gelf message of %s: %s", record.Username, err.Error())
+
+			continue
+		}
+		for _, datagram := range datagrams {
+			n, err := g.writer.write(ctx, datagram)
+			if err != nil {
+				return errors.Wrap(err, "failed to send gelf message")
+			}
+			addWrittenBytes(ctx, n)
+		}
+	}
+
+	return nil
+}
+
+// message returns the gelf message of the record, the fields of its document being additional
+// fields, flattened with dots when nested.
+func (g *GELFPump) message(record *analytics.AnalyticsRecord) map[string]interface{} {
+	shortMessage := fmt.Sprintf("%s %s", record.Username, record.Effect)
+	if record.Conclusion != "" {
+		shortMessage += ": " + record.Conclusion
+	}
+
+	level := gelfLevelInfo
+	if record.Effect != ladon.AllowAccess {
+		level = gelfLevelNotice
+	}
+
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          g.conf.Host,
+		"short_message": shortMessage,
+		"timestamp":     record.TimeStamp,
+		"level":         level,
+	}
+
+	fields := make(map[string]interface{})
+	flattenGELFFields(fields, "", recordMessage(g.format, record, g.conf.metadata(record), g.GetFieldPrecedence()))
+	for name, value := range fields {
+		// _id is reserved by graylog
+		if name != "id" && gelfFieldName.MatchString(name) {
+			message["_"+name] = value
+		}
+	}
+
+	return message
+}
+
+// flattenGELFFields sets the nested fields of document in fields, their name prefixed with the
+// name of their parent. The times are formatted as RFC 3339, the values which are neither
+// strings nor numbers are encoded as json.
+func flattenGELFFields(fields map[string]interface{}, prefix string, document map[string]interface{}) {
+	for name, value := range document {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenGELFFields(fields, prefix+name+".", value)
+		case Message:
+			flattenGELFFields(fields, prefix+name+".", value)
+		case string, int, int64, float64:
+			fields[prefix+name] = value
+		case time.Time:
+			fields[prefix+name] = value.Format(time.RFC3339)
+		case nil:
+		default:
+			b, _ := json.Marshal(value)
+			fields[prefix+name] = string(b)
+		}
+	}
+}
+
+// datagrams compresses the message and splits it into chunks when larger than a datagram.
+func (g *GELFPump) datagrams(message []byte) ([][]byte, error) {
+	payload := message
+	var err error
+	switch g.conf.Compression {
+	case GELFCompressionGzip:
+		payload, err = gzipPayload(message)
+	case GELFCompressionZlib:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		_, err = zw.Write(message)
+		if err == nil {
+			err = zw.Close()
+		}
+		payload = buf.Bytes()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compress message")
+	}
+
+	if len(payload) <= g.conf.ChunkSize {
+		return [][]byte{payload}, nil
+	}
+
+	size := g.conf.ChunkSize - gelfChunkHeaderSize
+	count := (len(payload) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, errors.Errorf("message of %d bytes exceeds %d chunks", len(payload), gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "failed to generate message id")
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*size)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks = append(chunks, append(chunk, payload[i*size:end]...))
+	}
+
+	return chunks, nil
+}
+
+// Shutdown closes the connection to graylog.
+func (g *GELFPump) Shutdown() error {
+	if g.writer == nil {
+		return nil
+	}
+
+	return errors.Wrap(g.writer.close(), "failed to close gelf connection")
+}
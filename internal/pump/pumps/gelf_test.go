@@ -0,0 +1,127 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestGELFPumpUDPChunks(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pmp := (&GELFPump{}).New()
+	err = pmp.Init(map[string]interface{}{
+		"network_addr": conn.LocalAddr().String(),
+		"host":         "iam-pump-0",
+		"chunk_size":   64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "deny",
+		Conclusion: strings.Repeat("no policy matched ", 8)}
+	record.SetExtra("id", "reserved")
+	if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make(map[byte][]byte)
+	var count byte
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for count == 0 || len(chunks) < int(count) {
+		buf := make([]byte, 2048)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 64 || buf[0] != 0x1e || buf[1] != 0x0f {
+			t.Fatalf("unexpected chunk of %d bytes", n)
+		}
+		count = buf[11]
+		chunks[buf[10]] = buf[12:n]
+	}
+
+	var payload []byte
+	for i := byte(0); i < count; i++ {
+		payload = append(payload, chunks[i]...)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := ioutil.ReadAll(zr)
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(decoded, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message["version"] != "1.1" || message["host"] != "iam-pump-0" || message["level"] != float64(5) ||
+		message["_username"] != "colin" || message["timestamp"] != float64(1600000000) ||
+		!strings.HasPrefix(message["short_message"].(string), "colin deny: no policy matched") {
+		t.Fatalf("unexpected message %v", message)
+	}
+	if _, ok := message["_id"]; ok {
+		t.Fatal("the reserved _id field should not be sent")
+	}
+}
+
+func TestGELFPumpTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		message, _ := bufio.NewReader(conn).ReadString(0)
+		received <- message
+	}()
+
+	pmp := (&GELFPump{}).New()
+	err = pmp.Init(map[string]interface{}{"transport": "tcp", "network_addr": listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "allow"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-received:
+		if !strings.HasSuffix(message, "\x00") || !strings.Contains(message, `"_effect":"allow"`) {
+			t.Fatalf("unexpected message %q", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
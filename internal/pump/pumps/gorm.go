@@ -0,0 +1,185 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+
+	"github.com/marmotedu/iam/internal/pkg/logger"
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// gormDialectors maps the supported dialects to their gorm dialector constructor.
+// Support for another GORM-supported database is added by registering its driver here. The sqlite
+// driver needs cgo, it is only registered by the builds with cgo enabled.
+var gormDialectors = map[string]func(dsn string) gorm.Dialector{
+	"mysql":     mysql.Open,
+	"postgres":  postgres.Open,
+	"sqlserver": sqlserver.Open,
+}
+
+// GormPump defines a pump which inserts analytics records into any GORM-supported database.
+type GormPump struct {
+	db   *gorm.DB
+	conf *GormConf
+	CommonPumpConfig
+}
+
+// GormConf defines gorm specific options.
+type GormConf struct {
+	// Dialect is the database of the DSN: mysql, postgres, sqlite or sqlserver, mysql by default.
+	// sqlite is only available in the builds with cgo enabled.
+	Dialect               string `mapstructure:"dialect"`
+	DSN                   string `mapstructure:"dsn"`
+	TableName             string `mapstructure:"table_name"`
+	BatchSize             int    `mapstructure:"batch_size"`
+	MaxIdleConnections    int    `mapstructure:"max_idle_connections"`
+	MaxOpenConnections    int    `mapstructure:"max_open_connections"`
+	MaxConnectionLifeTime int    `mapstructure:"max_connection_life_time"`
+	LogLevel              int    `mapstructure:"log_level"`
+}
+
+// GormAnalyticsRecord is the table model of the analytics records written by the gorm pump.
+type GormAnalyticsRecord struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement"`
+	TimeStamp  int64     `gorm:"index"`
+	Username   string    `gorm:"size:255;index"`
+	Effect     string    `gorm:"size:32"`
+	Conclusion string    `gorm:"type:text"`
+	Request    string    `gorm:"type:text"`
+	Policies   string    `gorm:"type:text"`
+	Deciders   string    `gorm:"type:text"`
+	ExpireAt   time.Time `gorm:"index"`
+}
+
+// New create a gorm pump instance.
+func (g *GormPump) New() Pump {
+	newPump := GormPump{}
+
+	return &newPump
+}
+
+// GetName returns the gorm pump name.
+func (g *GormPump) GetName() string {
+	return "GORM Pump"
+}
+
+// Init initialize the gorm pump instance.
+func (g *GormPump) Init(config interface{}) error {
+	g.conf = &GormConf{}
+	if err := mapstructure.Decode(config, &g.conf); err != nil {
+		return errors.Wrap(err, "failed to decode gorm configuration")
+	}
+
+	if g.conf.Dialect == "" {
+		g.conf.Dialect = "mysql"
+	}
+
+	dialector, ok := gormDialectors[g.conf.Dialect]
+	if !ok {
+		return errors.Errorf("gorm dialect %s is not supported", g.conf.Dialect)
+	}
+
+	if g.conf.DSN == "" {
+		return errors.New("gorm dsn not set")
+	}
+
+	if g.conf.TableName == "" {
+		g.conf.TableName = "iam_analytics"
+	}
+
+	if g.conf.BatchSize <= 0 {
+		g.conf.BatchSize = 500
+	}
+
+	db, err := gorm.Open(dialector(g.conf.DSN), &gorm.Config{
+		Logger: logger.New(g.conf.LogLevel),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to open gorm database")
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return errors.Wrap(err, "failed to get gorm connection pool")
+	}
+
+	if g.conf.MaxIdleConnections > 0 {
+		sqlDB.SetMaxIdleConns(g.conf.MaxIdleConnections)
+	}
+
+	if g.conf.MaxOpenConnections > 0 {
+		sqlDB.SetMaxOpenConns(g.conf.MaxOpenConnections)
+	}
+
+	if g.conf.MaxConnectionLifeTime > 0 {
+		sqlDB.SetConnMaxLifetime(time.Duration(g.conf.MaxConnectionLifeTime) * time.Second)
+	}
+
+	if err := db.Table(g.conf.TableName).AutoMigrate(&GormAnalyticsRecord{}); err != nil {
+		return errors.Wrapf(err, "failed to migrate table %s", g.conf.TableName)
+	}
+
+	g.db = db
+
+	log.Infof("GORM pump writes to %s table %s", g.conf.Dialect, g.conf.TableName)
+
+	return nil
+}
+
+// WriteData write analyzed data to the gorm database in batches.
+func (g *GormPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	rows := make([]GormAnalyticsRecord, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		rows = append(rows, GormAnalyticsRecord{
+			TimeStamp:  record.TimeStamp,
+			Username:   record.Username,
+			Effect:     record.Effect,
+			Conclusion: record.Conclusion,
+			Request:    record.Request,
+			Policies:   record.Policies,
+			Deciders:   record.Deciders,
+			ExpireAt:   record.ExpireAt,
+		})
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := g.db.WithContext(ctx).Table(g.conf.TableName).CreateInBatches(rows, g.conf.BatchSize).Error
+
+	return errors.Wrap(err, "failed to insert analytics records")
+}
+
+// Shutdown closes the database connection pool.
+func (g *GormPump) Shutdown() error {
+	if g.db == nil {
+		return nil
+	}
+
+	sqlDB, err := g.db.DB()
+	if err != nil {
+		return errors.Wrap(err, "failed to get gorm connection pool")
+	}
+
+	return errors.Wrap(sqlDB.Close(), "failed to close gorm connection pool")
+}
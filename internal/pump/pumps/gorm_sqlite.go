@@ -0,0 +1,16 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+
+package pumps
+
+import (
+	"gorm.io/driver/sqlite"
+)
+
+func init() {
+	// go-sqlite3 is a cgo binding, the sqlite dialect is missing from the builds without cgo.
+	gormDialectors["sqlite"] = sqlite.Open
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+
+package pumps
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestGormPumpInit(t *testing.T) {
+	if err := (&GormPump{}).Init(map[string]interface{}{"dialect": "oracle", "dsn": "iam"}); err == nil {
+		t.Fatal("an unknown dialect should be rejected")
+	}
+
+	if err := (&GormPump{}).Init(map[string]interface{}{"dialect": "postgres"}); err == nil {
+		t.Fatal("the dsn should be required")
+	}
+
+	g := &GormPump{}
+	if err := g.Init(map[string]interface{}{
+		"dialect": "sqlite",
+		"dsn":     filepath.Join(t.TempDir(), "iam.db"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	if g.conf.TableName != "iam_analytics" || g.conf.BatchSize != 500 || !g.db.Migrator().HasTable("iam_analytics") {
+		t.Fatalf("the analytics table should be created with the default options, got %+v", g.conf)
+	}
+}
+
+func TestGormPumpWriteData(t *testing.T) {
+	g := &GormPump{}
+	if err := g.Init(map[string]interface{}{
+		"dialect":    "sqlite",
+		"dsn":        filepath.Join(t.TempDir(), "iam.db"),
+		"batch_size": 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	var inserts int
+	if err := g.db.Callback().Create().Before("gorm:create").Register("count", func(*gorm.DB) {
+		inserts++
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{"not a record"}
+	for i := 0; i < 5; i++ {
+		data = append(data, analytics.AnalyticsRecord{TimeStamp: int64(i), Username: "colin", Effect: "allow"})
+	}
+	if err := g.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := g.db.Table(g.conf.TableName).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 || inserts != 3 {
+		t.Fatalf("the records should be inserted in batches of 2, got %d rows in %d inserts", count, inserts)
+	}
+}
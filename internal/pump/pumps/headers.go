@@ -0,0 +1,76 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// HeadersConf defines the headers and metadata options shared by the pumps writing to remote
+// back-ends, it is embedded in their configuration so that the same keys are used whatever the
+// back-end.
+type HeadersConf struct {
+	// Headers are set on every request sent to the back-end, e.g. an authentication token.
+	Headers map[string]string `mapstructure:"headers"`
+	// StaticMetadata is attached as is to every record written.
+	StaticMetadata map[string]string `mapstructure:"static_metadata"`
+	// MetadataFields maps the metadata names to the record fields they are set from.
+	MetadataFields map[string]string `mapstructure:"metadata_fields"`
+}
+
+// setHeaders sets the static headers on the request headers, overriding the ones set by the pump.
+func (c *HeadersConf) setHeaders(header http.Header) {
+	for key, value := range c.Headers {
+		header.Set(key, value)
+	}
+}
+
+// metadata returns the metadata of the record: the static metadata merged with the values of
+// the mapped record fields, which take precedence. It returns nil when no metadata is configured.
+func (c *HeadersConf) metadata(record *analytics.AnalyticsRecord) map[string]interface{} {
+	if len(c.StaticMetadata) == 0 && len(c.MetadataFields) == 0 {
+		return nil
+	}
+
+	metadata := make(map[string]interface{}, len(c.StaticMetadata)+len(c.MetadataFields))
+	for name, value := range c.StaticMetadata {
+		metadata[name] = value
+	}
+
+	for name, field := range c.MetadataFields {
+		if value, ok := record.FieldValue(field); ok {
+			metadata[name] = value
+		}
+	}
+
+	return metadata
+}
+
+// StaticFieldNames returns the names of the static metadata and metadata fields configured in the
+// meta configuration of a pump, which are added to the documents it writes.
+func StaticFieldNames(meta interface{}) []string {
+	conf := HeadersConf{}
+	if err := mapstructure.Decode(meta, &conf); err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(conf.StaticMetadata)+len(conf.MetadataFields))
+	for name := range conf.StaticMetadata {
+		names = append(names, name)
+	}
+	for name := range conf.MetadataFields {
+		if _, ok := conf.StaticMetadata[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestHeadersConf(t *testing.T) {
+	var token string
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Scope-OrgID")
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	pmp := (&TempoPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"endpoint":        server.URL,
+		"attributes":      map[string]string{"iam.username": "username"},
+		"headers":         map[string]string{"X-Scope-OrgID": "tenant-1"},
+		"static_metadata": map[string]string{"env": "prod", "region": "default"},
+		"metadata_fields": map[string]string{"region": "region"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{Username: "colin"}
+	record.SetExtra("region", "eu-west-1")
+	if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "tenant-1" {
+		t.Fatalf("the static headers should be set on the requests, got %q", token)
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range payload.ResourceSpans[0].ScopeSpans[0].Spans[0].Attributes {
+		attributes[attribute.Key] = attribute.Value.StringValue
+	}
+
+	expected := map[string]string{"iam.username": "colin", "env": "prod", "region": "eu-west-1"}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Fatalf("attribute %s should be %q, got %v", key, value, attributes)
+		}
+	}
+
+	if metadata := (&HeadersConf{}).metadata(&record); metadata != nil {
+		t.Fatalf("no metadata should be returned when none is configured, got %v", metadata)
+	}
+}
+
+func TestStaticFieldNames(t *testing.T) {
+	names := StaticFieldNames(map[string]interface{}{
+		"url":             "http://localhost",
+		"static_metadata": map[string]string{"cluster": "prod", "region": "eu"},
+		"metadata_fields": map[string]string{"tenant": "extra.tenant", "cluster": "cluster"},
+	})
+
+	if len(names) != 3 || names[0] != "cluster" || names[1] != "region" || names[2] != "tenant" {
+		t.Errorf("unexpected static field names %v", names)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSkipWrite is returned by a pre-write hook to skip the write of the current batch without
+// reporting it as a failure.
+var ErrSkipWrite = errors.New("write skipped by pre-write hook")
+
+// PreWriteHook runs before each WriteData of the pumps it is attached to. Returning an error aborts
+// the write of the batch, which is then reported as failed unless the error is ErrSkipWrite.
+type PreWriteHook func(ctx context.Context, pump Pump, data []interface{}) error
+
+var (
+	hooksMu        sync.RWMutex
+	availableHooks = map[string]PreWriteHook{
+		"skip-empty": skipEmptyHook,
+	}
+)
+
+// RegisterPreWriteHook registers a named pre-write hook, which pumps can then reference in their
+// `pre-write-hooks` configuration. Hooks are plain go functions compiled into iam-pump, no external
+// command is ever run.
+func RegisterPreWriteHook(name string, hook PreWriteHook) error {
+	if name == "" || hook == nil {
+		return errors.New("pre-write hook needs a name and a function")
+	}
+
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	if _, ok := availableHooks[name]; ok {
+		return errors.New("pre-write hook " + name + " already registered")
+	}
+
+	availableHooks[name] = hook
+
+	return nil
+}
+
+// GetPreWriteHookByName returns the pre-write hook registered with the given name.
+func GetPreWriteHookByName(name string) (PreWriteHook, error) {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+
+	if hook, ok := availableHooks[name]; ok {
+		return hook, nil
+	}
+
+	return nil, errors.New("pre-write hook " + name + " Not found")
+}
+
+// skipEmptyHook skips the write of empty batches, e.g. to avoid creating empty files.
+func skipEmptyHook(ctx context.Context, pump Pump, data []interface{}) error {
+	if len(data) == 0 {
+		return ErrSkipWrite
+	}
+
+	return nil
+}
@@ -105,6 +105,10 @@ func (i *InfluxPump) WriteData(ctx context.Context, data []interface{}) error {
 			"expireAt":   decoded.ExpireAt,
 		}
 
+		for key, value := range decoded.Extra {
+			mapping[key] = value
+		}
+
 		tags := make(map[string]string)
 		fields := make(map[string]interface{})
 
@@ -0,0 +1,231 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Influx2Pump defines a pump which writes the analytics records as points to a bucket of InfluxDB
+// with the v2 write api, one point per record counting it, tagged with the configured fields.
+type Influx2Pump struct {
+	conf   *Influx2Conf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// Influx2Conf defines influxdb v2 specific options.
+type Influx2Conf struct {
+	URL         string `mapstructure:"url"`
+	Org         string `mapstructure:"org"`
+	Bucket      string `mapstructure:"bucket"`
+	Token       string `mapstructure:"token"`
+	Measurement string `mapstructure:"measurement"`
+	// Tags are the record fields, extra fields or attributes of the authorization request, e.g.
+	// resource or action, the points are tagged with. The empty values are not tagged.
+	Tags []string `mapstructure:"tags"`
+	// Fields are the record fields or extra fields written as fields of the points, along with
+	// the count of the record.
+	Fields    []string `mapstructure:"fields"`
+	BatchSize int      `mapstructure:"batch_size"`
+	// The headers are sent with the writes, the metadata is tagged on the points.
+	HeadersConf `mapstructure:",squash"`
+}
+
+// New create an influxdb v2 pump instance.
+func (i *Influx2Pump) New() Pump {
+	newPump := Influx2Pump{}
+
+	return &newPump
+}
+
+// GetName returns the influxdb v2 pump name.
+func (i *Influx2Pump) GetName() string {
+	return "InfluxDB v2 Pump"
+}
+
+// Init initialize the influxdb v2 pump instance.
+func (i *Influx2Pump) Init(config interface{}) error {
+	i.conf = &Influx2Conf{}
+	if err := mapstructure.Decode(config, &i.conf); err != nil {
+		return errors.Wrap(err, "failed to decode influxdb v2 configuration")
+	}
+
+	if i.conf.Org == "" || i.conf.Bucket == "" {
+		return errors.New("influxdb v2 org and bucket must be set")
+	}
+
+	if i.conf.URL == "" {
+		i.conf.URL = "http://localhost:8086"
+	}
+	i.conf.URL = strings.TrimSuffix(i.conf.URL, "/")
+
+	if i.conf.Measurement == "" {
+		i.conf.Measurement = "analytics"
+	}
+
+	if len(i.conf.Tags) == 0 {
+		i.conf.Tags = []string{"username", "effect", "resource"}
+	}
+
+	if i.conf.BatchSize <= 0 {
+		i.conf.BatchSize = 5000
+	}
+
+	i.client = &http.Client{}
+
+	log.Infof("InfluxDB v2 pump writes to bucket %s of org %s at %s", i.conf.Bucket, i.conf.Org, i.conf.URL)
+
+	return nil
+}
+
+// WriteData writes the analytics data as points in line protocol, in batches.
+func (i *Influx2Pump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	lines := make([]string, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		lines = append(lines, i.point(&record, time.Now()))
+	}
+
+	for start := 0; start < len(lines); start += i.conf.BatchSize {
+		end := start + i.conf.BatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		if err := i.write(ctx, lines[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *Influx2Pump) write(ctx context.Context, lines []string) error {
+	body := []byte(strings.Join(lines, "\n"))
+	query := url.Values{"org": {i.conf.Org}, "bucket": {i.conf.Bucket}, "precision": {"s"}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.conf.URL+"/api/v2/write?"+query.Encode(),
+		bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create influxdb write request")
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.conf.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.conf.Token)
+	}
+	i.conf.setHeaders(req.Header)
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to write to influxdb")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("influxdb", resp); err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, len(body))
+
+	return nil
+}
+
+// point returns the line protocol of the point of the record, timestamped with the record.
+func (i *Influx2Pump) point(record *analytics.AnalyticsRecord, now time.Time) string {
+	tags := make(map[string]string, len(i.conf.Tags))
+	var request map[string]interface{}
+	for _, name := range i.conf.Tags {
+		if value, ok := attributeValue(record, name, &request); ok && fmt.Sprint(value) != "" {
+			tags[name] = fmt.Sprint(value)
+		}
+	}
+
+	for name, value := range i.conf.metadata(record) {
+		if s := fmt.Sprint(value); s != "" {
+			tags[name] = s
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(escapeInflux(i.conf.Measurement, ", "))
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	// influxdb expects the tags sorted by key
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString("," + escapeInflux(name, ",= ") + "=" + escapeInflux(tags[name], ",= "))
+	}
+
+	b.WriteString(" count=1i")
+	for _, name := range i.conf.Fields {
+		if value, ok := record.FieldValue(name); ok && name != "count" {
+			b.WriteString("," + escapeInflux(name, ",= ") + "=" + influxFieldValue(value))
+		}
+	}
+
+	timestamp := record.TimeStamp
+	if timestamp == 0 {
+		timestamp = now.Unix()
+	}
+	b.WriteString(" " + strconv.FormatInt(timestamp, 10))
+
+	return b.String()
+}
+
+// influxFieldValue returns the line protocol representation of a field value, the values which
+// are neither numbers nor booleans are written as strings.
+func influxFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return `"` + v.Format(time.RFC3339) + `"`
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fmt.Sprint(value)) + `"`
+}
+
+// escapeInflux escapes the special characters of a measurement, tag or field key or tag value.
+func escapeInflux(s string, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestInflux2Pump(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if query := r.URL.Query(); query.Get("org") != "iam" || query.Get("bucket") != "analytics" ||
+			query.Get("precision") != "s" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	pmp := (&Influx2Pump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"url":    server.URL + "/",
+		"org":    "iam",
+		"bucket": "analytics",
+		"token":  "secret",
+		"fields": []string{"conclusion"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{
+			TimeStamp:  1600000000,
+			Username:   "colin lee",
+			Effect:     "allow",
+			Conclusion: `policy "p1" allows`,
+			Request:    `{"resource":"resources:articles:1,2","action":"delete"}`,
+		},
+		analytics.AnalyticsRecord{TimeStamp: 1600000001, Username: "admin", Effect: "deny"},
+	}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(body, "\n")
+	want := []string{
+		`analytics,effect=allow,resource=resources:articles:1\,2,username=colin\ lee count=1i,` +
+			`conclusion="policy \"p1\" allows" 1600000000`,
+		`analytics,effect=deny,username=admin count=1i,conclusion="" 1600000001`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d points, got %q", len(want), body)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("point %d = %s, want %s", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestInflux2PumpInit(t *testing.T) {
+	if err := (&Influx2Pump{}).New().Init(map[string]interface{}{"org": "iam"}); err == nil {
+		t.Fatal("a bucket should be required")
+	}
+}
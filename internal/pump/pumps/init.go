@@ -19,4 +19,24 @@ func init() {
 	availablePumps["prometheus"] = &PrometheusPump{}
 	availablePumps["kafka"] = &KafkaPump{}
 	availablePumps["syslog"] = &SyslogPump{}
+	availablePumps["remotewrite"] = &RemoteWritePump{}
+	availablePumps["gorm"] = &GormPump{}
+	availablePumps["adx"] = &AdxPump{}
+	availablePumps["pushgateway"] = &PushgatewayPump{}
+	availablePumps["tempo"] = &TempoPump{}
+	availablePumps["snowflake"] = &SnowflakePump{}
+	availablePumps["websocket"] = &WebsocketPump{}
+	availablePumps["otelmetrics"] = &OtelMetricsPump{}
+	availablePumps["influx2"] = &Influx2Pump{}
+	availablePumps["aggregate"] = &AggregatePump{}
+	availablePumps["s3"] = &S3Pump{}
+	availablePumps["splunk"] = &SplunkPump{}
+	availablePumps["stdout"] = &StdoutPump{}
+	availablePumps["gelf"] = &GELFPump{}
+	availablePumps["sqs"] = &SQSPump{}
+	availablePumps["bigquery"] = &BigQueryPump{}
+	availablePumps["statsd"] = &StatsDPump{}
+	availablePumps["otlp"] = &OTLPPump{}
+	availablePumps["mqtt"] = &MQTTPump{}
+	availablePumps["rollup"] = &RollupPump{}
 }
@@ -7,9 +7,10 @@ package pumps
 import (
 	"context"
 	"crypto/tls"
+	"os"
+	"strconv"
 	"time"
 
-	"github.com/marmotedu/component-base/pkg/json"
 	"github.com/marmotedu/errors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/segmentio/kafka-go"
@@ -26,6 +27,11 @@ import (
 type KafkaPump struct {
 	kafkaConf    *KafkaConf
 	writerConfig kafka.WriterConfig
+	registry     *schemaRegistry
+	envelope     *connectEnvelope
+	avro         Marshaler
+	format       string
+	marshaler    Marshaler
 	CommonPumpConfig
 }
 
@@ -48,6 +54,29 @@ type KafkaConf struct {
 	Compressed            bool              `mapstructure:"compressed"`
 	UseSSL                bool              `mapstructure:"use_ssl"`
 	SSLInsecureSkipVerify bool              `mapstructure:"ssl_insecure_skip_verify"`
+	ForwardRaw            bool              `mapstructure:"forward_raw"`
+	ContentType           string            `mapstructure:"content_type"`
+	SchemaRegistryURL     string            `mapstructure:"schema_registry_url"`
+	SchemaRegistryUser    string            `mapstructure:"schema_registry_username"`
+	SchemaRegistryPass    string            `mapstructure:"schema_registry_password"`
+	SchemaSubject         string            `mapstructure:"schema_subject"`
+	// ConnectEnvelope wraps the messages in the {schema, payload} envelope of the Kafka Connect
+	// JsonConverter, so that Connect sinks can consume them with schemas enabled. The format of the
+	// pump does not apply to the enveloped messages.
+	ConnectEnvelope   bool   `mapstructure:"connect_envelope"`
+	ConnectSchemaName string `mapstructure:"connect_schema_name"`
+	// AvroSchemaFile is the file of the Avro record schema the messages are encoded with, the
+	// schema can instead be the latest one registered under the subject of the schema registry.
+	// The Avro encoding takes precedence over the configured marshaler.
+	AvroSchemaFile         string `mapstructure:"avro_schema_file"`
+	AvroSchemaFromRegistry bool   `mapstructure:"avro_schema_from_registry"`
+	// Protobuf encodes the messages with the AnalyticsRecord message of analytics.proto, which is
+	// registered as the PROTOBUF schema of the subject. It takes precedence over the configured
+	// marshaler and the format of the pump.
+	Protobuf bool `mapstructure:"protobuf"`
+	// The headers are attached to the kafka messages, the metadata is added to their payload,
+	// along with the legacy meta_data.
+	HeadersConf `mapstructure:",squash"`
 }
 
 // New create a kafka pump instance.
@@ -62,6 +91,16 @@ func (k *KafkaPump) GetName() string {
 	return "Kafka Pump"
 }
 
+// SetFormat sets the format the kafka messages are written in.
+func (k *KafkaPump) SetFormat(format string) {
+	k.format = format
+}
+
+// SetMarshaler sets the marshaler serializing the kafka messages.
+func (k *KafkaPump) SetMarshaler(marshaler Marshaler) {
+	k.marshaler = marshaler
+}
+
 // Init initialize the kafka pump instance.
 func (k *KafkaPump) Init(config interface{}) error {
 	// Read configuration file
@@ -71,6 +110,15 @@ func (k *KafkaPump) Init(config interface{}) error {
 		log.Fatalf("Failed to decode configuration: %s", err.Error())
 	}
 
+	if len(k.kafkaConf.MetaData) > 0 && k.kafkaConf.StaticMetadata == nil {
+		k.kafkaConf.StaticMetadata = make(map[string]string, len(k.kafkaConf.MetaData))
+	}
+	for key, value := range k.kafkaConf.MetaData {
+		if _, ok := k.kafkaConf.StaticMetadata[key]; !ok {
+			k.kafkaConf.StaticMetadata[key] = value
+		}
+	}
+
 	var tlsConfig *tls.Config
 	// nolint: nestif
 	if k.kafkaConf.UseSSL {
@@ -140,56 +188,217 @@ func (k *KafkaPump) Init(config interface{}) error {
 		k.writerConfig.CompressionCodec = snappy.NewCompressionCodec()
 	}
 
+	if err := k.initSchema(); err != nil {
+		return err
+	}
+
+	if k.kafkaConf.ConnectEnvelope {
+		if k.registry != nil || k.avro != nil || k.kafkaConf.Protobuf {
+			return errors.New("kafka connect_envelope can not be used with a schema registry, avro or protobuf")
+		}
+
+		metadata := make([]string, 0, len(k.kafkaConf.StaticMetadata)+len(k.kafkaConf.MetadataFields))
+		for name := range k.kafkaConf.StaticMetadata {
+			metadata = append(metadata, name)
+		}
+		for name := range k.kafkaConf.MetadataFields {
+			if _, ok := k.kafkaConf.StaticMetadata[name]; !ok {
+				metadata = append(metadata, name)
+			}
+		}
+		k.envelope = newConnectEnvelope(k.kafkaConf.ConnectSchemaName, metadata)
+		log.Infof("Kafka messages will be wrapped in a Kafka Connect envelope")
+	}
+
 	log.Infof("Kafka config: %s", k.writerConfig)
 
 	return nil
 }
 
+// initSchema sets up the schema registry the messages are framed for, and the avro encoding.
+// The subject is registered with the schema of the encoding of the messages: the Avro schema,
+// analytics.proto or the JSON schema of the records.
+func (k *KafkaPump) initSchema() error {
+	if k.kafkaConf.Protobuf && (k.kafkaConf.AvroSchemaFile != "" || k.kafkaConf.AvroSchemaFromRegistry) {
+		return errors.New("kafka protobuf can not be used with avro")
+	}
+
+	schemaType, schema := "JSON", analyticsJSONSchema
+	if k.kafkaConf.Protobuf {
+		schemaType, schema = "PROTOBUF", analytics.ProtoSchema
+	}
+	if k.kafkaConf.AvroSchemaFile != "" {
+		data, err := os.ReadFile(k.kafkaConf.AvroSchemaFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read kafka avro schema")
+		}
+		schemaType, schema = "AVRO", string(data)
+	}
+
+	if k.kafkaConf.SchemaRegistryURL != "" {
+		if k.kafkaConf.SchemaSubject == "" {
+			k.kafkaConf.SchemaSubject = k.kafkaConf.Topic + "-value"
+		}
+		k.registry = newSchemaRegistry(k.kafkaConf.SchemaRegistryURL, k.kafkaConf.SchemaSubject,
+			schemaType, schema, k.kafkaConf.SchemaRegistryUser, k.kafkaConf.SchemaRegistryPass)
+		log.Infof("Kafka messages will be framed with the schema registered under subject %s", k.kafkaConf.SchemaSubject)
+	}
+
+	if k.kafkaConf.AvroSchemaFromRegistry {
+		if k.registry == nil {
+			return errors.New("kafka avro_schema_from_registry needs schema_registry_url")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), schemaRegistryTimeout)
+		defer cancel()
+
+		var err error
+		if schema, err = k.registry.latestSchema(ctx); err != nil {
+			return errors.Wrap(err, "failed to get kafka avro schema")
+		}
+		schemaType = "AVRO"
+	}
+
+	if schemaType != "AVRO" {
+		return nil
+	}
+
+	avro, err := NewAvroMarshaler(schema)
+	if err != nil {
+		return errors.Wrap(err, "invalid kafka avro schema")
+	}
+	k.avro = avro
+	log.Infof("Kafka messages will be encoded in avro")
+
+	return nil
+}
+
 // WriteData write analyzed data to kafka persistent back-end storage.
 func (k *KafkaPump) WriteData(ctx context.Context, data []interface{}) error {
 	startTime := time.Now()
 	log.Infof("Writing %d records ...", len(data))
-	kafkaMessages := make([]kafka.Message, len(data))
-	for i, v := range data {
+
+	var schemaID int32
+	if k.registry != nil {
+		var err error
+		if schemaID, err = k.registry.schemaID(ctx); err != nil {
+			return errors.Wrap(err, "failed to lookup kafka message schema")
+		}
+	}
+	marshaler := marshalerOrDefault(k.marshaler)
+	if k.avro != nil {
+		marshaler = k.avro
+	}
+	contentType := k.kafkaConf.ContentType
+	if contentType == "" {
+		contentType = marshaler.ContentType()
+		if k.kafkaConf.Protobuf {
+			contentType = "application/x-protobuf"
+		}
+	}
+	headers := k.headers(contentType, schemaID)
+	// raw payloads are forwarded as read from the storage, they are neither json nor framed
+	rawHeaders := k.headers("application/msgpack", 0)
+
+	kafkaMessages := make([]kafka.Message, 0, len(data))
+	size := 0
+	for _, v := range data {
 		// Build message format
 		decoded, _ := v.(analytics.AnalyticsRecord)
-		message := Message{
-			"timestamp":  decoded.TimeStamp,
-			"username":   decoded.Username,
-			"effect":     decoded.Effect,
-			"conclusion": decoded.Conclusion,
-			"request":    decoded.Request,
-			"policies":   decoded.Policies,
-			"deciders":   decoded.Deciders,
-			"expireAt":   decoded.ExpireAt,
+		if k.kafkaConf.ForwardRaw && decoded.Raw != nil {
+			size += len(decoded.Raw)
+			kafkaMessages = append(kafkaMessages, kafka.Message{
+				Time:    time.Now(),
+				Value:   decoded.Raw,
+				Headers: rawHeaders,
+			})
+
+			continue
+		}
+
+		if k.kafkaConf.Protobuf {
+			value := encodeProtobuf(&decoded)
+			if k.registry != nil {
+				// the message indexes of the protobuf wire format, a single 0 for the first message of the schema
+				value = frame(schemaID, append([]byte{0}, value...))
+			}
+			size += len(value)
+			kafkaMessages = append(kafkaMessages, kafka.Message{
+				Time:    time.Now(),
+				Value:   value,
+				Headers: headers,
+			})
+
+			continue
 		}
-		// Add static metadata to json
-		for key, value := range k.kafkaConf.MetaData {
-			message[key] = value
+
+		var message Message
+		if k.envelope != nil {
+			message = k.envelope.wrap(&decoded, k.kafkaConf.metadata(&decoded))
+		} else {
+			// Add the static and record metadata to json
+			message = recordMessage(k.format, &decoded, k.kafkaConf.metadata(&decoded), k.GetFieldPrecedence())
 		}
 
-		// Transform object to json string
-		json, jsonError := json.Marshal(message)
-		if jsonError != nil {
-			log.Error("unable to marshal message", log.String("error", jsonError.Error()))
+		// Serialize the message, in json unless another marshaler is configured
+		value, marshalError := marshaler.Marshal(message)
+		if marshalError != nil {
+			// the record is skipped, e.g. when it does not match the avro schema
+			log.Error("unable to marshal message", log.String("error", marshalError.Error()),
+				log.String("username", decoded.Username), log.Int64("timestamp", decoded.TimeStamp))
+
+			continue
 		}
 
-		// Kafka message structure
-		kafkaMessages[i] = kafka.Message{
-			Time:  time.Now(),
-			Value: json,
+		if k.registry != nil {
+			value = frame(schemaID, value)
 		}
+		size += len(value)
+
+		// Kafka message structure
+		kafkaMessages = append(kafkaMessages, kafka.Message{
+			Time:    time.Now(),
+			Value:   value,
+			Headers: headers,
+		})
 	}
 	// Send kafka message
 	kafkaError := k.write(ctx, kafkaMessages)
 	if kafkaError != nil {
 		log.Error("unable to write message", log.String("error", kafkaError.Error()))
+	} else {
+		addWrittenBytes(ctx, size)
 	}
 	log.Debugf("ElapsedTime in seconds for %d records %v", len(data), time.Since(startTime))
 
 	return nil
 }
 
+// headers returns the headers attached to the kafka messages, a zero schemaID means the
+// messages are not framed with a registered schema.
+func (k *KafkaPump) headers(contentType string, schemaID int32) []kafka.Header {
+	headers := make([]kafka.Header, 0, len(k.kafkaConf.Headers)+3)
+	headers = append(headers, kafka.Header{Key: "content-type", Value: []byte(contentType)})
+
+	if schemaID != 0 {
+		headers = append(headers,
+			kafka.Header{Key: "schema.subject", Value: []byte(k.kafkaConf.SchemaSubject)},
+			kafka.Header{Key: "schema.id", Value: []byte(strconv.Itoa(int(schemaID)))},
+		)
+	}
+
+	for key, value := range k.kafkaConf.Headers {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+
+	return headers
+}
+
+// WantsRawRecords reports whether the kafka pump forwards the original payloads untouched.
+func (k *KafkaPump) WantsRawRecords() bool {
+	return k.kafkaConf.ForwardRaw
+}
+
 func (k *KafkaPump) write(ctx context.Context, messages []kafka.Message) error {
 	kafkaWriter := kafka.NewWriter(k.writerConfig)
 	defer kafkaWriter.Close()
@@ -0,0 +1,159 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Marshaler serializes the documents built from the records into the payloads written by the
+// pumps which support it.
+type Marshaler interface {
+	Marshal(doc Message) ([]byte, error)
+	ContentType() string
+}
+
+// MarshalingPump is implemented by the pumps whose payloads are serialized by a configurable Marshaler.
+type MarshalingPump interface {
+	Pump
+	SetMarshaler(marshaler Marshaler)
+}
+
+// DefaultMarshaler is the marshaler of the pumps whose configuration does not name one.
+const DefaultMarshaler = "json"
+
+var (
+	marshalersMu        sync.RWMutex
+	availableMarshalers = map[string]Marshaler{
+		DefaultMarshaler:  jsonMarshaler{},
+		"snake_case_json": snakeCaseJSONMarshaler{},
+		"msgpack":         msgpackMarshaler{},
+	}
+)
+
+// RegisterMarshaler registers a named marshaler, which pumps can then reference in their
+// `marshaler` configuration.
+func RegisterMarshaler(name string, marshaler Marshaler) error {
+	if name == "" || marshaler == nil {
+		return errors.New("marshaler needs a name and an implementation")
+	}
+
+	marshalersMu.Lock()
+	defer marshalersMu.Unlock()
+
+	if _, ok := availableMarshalers[name]; ok {
+		return errors.New("marshaler " + name + " already registered")
+	}
+
+	availableMarshalers[name] = marshaler
+
+	return nil
+}
+
+// GetMarshalerByName returns the marshaler registered with the given name.
+func GetMarshalerByName(name string) (Marshaler, error) {
+	marshalersMu.RLock()
+	defer marshalersMu.RUnlock()
+
+	if marshaler, ok := availableMarshalers[name]; ok {
+		return marshaler, nil
+	}
+
+	return nil, errors.New("marshaler " + name + " Not found")
+}
+
+// marshalerOrDefault returns the marshaler, or the default json marshaler when it is not set.
+func marshalerOrDefault(marshaler Marshaler) Marshaler {
+	if marshaler == nil {
+		return jsonMarshaler{}
+	}
+
+	return marshaler
+}
+
+// jsonMarshaler encodes the documents in json, with the field names of the records.
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(doc Message) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonMarshaler) ContentType() string {
+	return "application/json"
+}
+
+// snakeCaseJSONMarshaler encodes the documents in json, with the field names, including the
+// names of the nested fields, in snake case, e.g. expire_at.
+type snakeCaseJSONMarshaler struct{}
+
+func (snakeCaseJSONMarshaler) Marshal(doc Message) ([]byte, error) {
+	return json.Marshal(snakeCaseKeys(map[string]interface{}(doc)))
+}
+
+func (snakeCaseJSONMarshaler) ContentType() string {
+	return "application/json"
+}
+
+// msgpackMarshaler encodes the documents in msgpack.
+type msgpackMarshaler struct{}
+
+func (msgpackMarshaler) Marshal(doc Message) ([]byte, error) {
+	return msgpack.Marshal(map[string]interface{}(doc))
+}
+
+func (msgpackMarshaler) ContentType() string {
+	return "application/msgpack"
+}
+
+// snakeCaseKeys returns a copy of the value whose map keys are converted to snake case.
+func snakeCaseKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			converted[snakeCase(key)] = snakeCaseKeys(v)
+		}
+
+		return converted
+	case Message:
+		return snakeCaseKeys(map[string]interface{}(value))
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, v := range value {
+			converted[i] = snakeCaseKeys(v)
+		}
+
+		return converted
+	default:
+		return value
+	}
+}
+
+// snakeCase converts a camel case name to snake case, e.g. expireAt to expire_at or clientIP to
+// client_ip.
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			afterWord := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			acronymEnd := i > 0 && unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if afterWord || acronymEnd {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"testing"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMarshalers(t *testing.T) {
+	doc := Message{"expireAt": "never", "extra": map[string]interface{}{"clientIP": "10.0.0.1"}}
+
+	marshaler, err := GetMarshalerByName("snake_case_json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _ := marshaler.Marshal(doc)
+	decoded := map[string]interface{}{}
+	_ = json.Unmarshal(payload, &decoded)
+	extra, _ := decoded["extra"].(map[string]interface{})
+	if decoded["expire_at"] != "never" || extra["client_ip"] != "10.0.0.1" {
+		t.Fatalf("the keys should be in snake case, got %s", payload)
+	}
+
+	marshaler, _ = GetMarshalerByName("msgpack")
+	payload, _ = marshaler.Marshal(doc)
+	decoded = map[string]interface{}{}
+	if err := msgpack.Unmarshal(payload, &decoded); err != nil || decoded["expireAt"] != "never" {
+		t.Fatalf("the document should be msgpack encoded, got %v (%v)", decoded, err)
+	}
+
+	if name := snakeCase("HTTPStatusCode"); name != "http_status_code" {
+		t.Fatalf("wrong snake case name %s", name)
+	}
+
+	if err := RegisterMarshaler(DefaultMarshaler, jsonMarshaler{}); err == nil {
+		t.Fatal("a marshaler name should not be registered twice")
+	}
+
+	if _, err := GetMarshalerByName("xml"); err == nil {
+		t.Fatal("unknown marshalers should not be found")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type byteCounterKey struct{}
+
+// ByteCounter accumulates the amount of bytes written by a pump during a single WriteData call.
+type ByteCounter struct {
+	bytes    int64
+	reported int32
+}
+
+// Add adds n written bytes to the counter.
+func (c *ByteCounter) Add(n int) {
+	atomic.AddInt64(&c.bytes, int64(n))
+	atomic.StoreInt32(&c.reported, 1)
+}
+
+// Value returns the written bytes and whether the pump reported any.
+func (c *ByteCounter) Value() (int64, bool) {
+	return atomic.LoadInt64(&c.bytes), atomic.LoadInt32(&c.reported) == 1
+}
+
+// WithByteCounter returns a copy of ctx which carries the given byte counter. Pumps serializing the
+// records themselves report the size of their payload to it.
+func WithByteCounter(ctx context.Context, c *ByteCounter) context.Context {
+	return context.WithValue(ctx, byteCounterKey{}, c)
+}
+
+// addWrittenBytes reports n bytes written to the counter carried by ctx, if any.
+func addWrittenBytes(ctx context.Context, n int) {
+	if c, ok := ctx.Value(byteCounterKey{}).(*ByteCounter); ok {
+		c.Add(n)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestByteCounter(t *testing.T) {
+	// the pumps report their payload whether the write is metered or not
+	addWrittenBytes(context.Background(), 10)
+
+	counter := &ByteCounter{}
+	if size, reported := counter.Value(); size != 0 || reported {
+		t.Fatalf("a new counter should not be reported, got %d %v", size, reported)
+	}
+
+	ctx := WithByteCounter(context.Background(), counter)
+	addWrittenBytes(ctx, 10)
+	addWrittenBytes(ctx, 0)
+	if size, reported := counter.Value(); size != 10 || !reported {
+		t.Fatalf("the bytes written should be reported, got %d %v", size, reported)
+	}
+}
+
+func TestCSVPumpWrittenBytes(t *testing.T) {
+	dir := t.TempDir()
+	pmp := &CSVPump{}
+	if err := pmp.Init(map[string]interface{}{"csv_dir": dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := &ByteCounter{}
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}
+	if err := pmp.WriteData(WithByteCounter(context.Background(), counter), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("a single csv file should be written, got %d: %v", len(entries), err)
+	}
+	info, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size, reported := counter.Value(); !reported || size != info.Size() {
+		t.Fatalf("the size of the csv written should be reported, got %d for a %d bytes file", size, info.Size())
+	}
+}
@@ -64,6 +64,14 @@ type BaseMongoConf struct {
 	MongoSSLCAFile                string    `json:"mongo_ssl_ca_file"                 mapstructure:"mongo_ssl_ca_file"`
 	MongoSSLPEMKeyfile            string    `json:"mongo_ssl_pem_keyfile"             mapstructure:"mongo_ssl_pem_keyfile"`
 	MongoDBType                   MongoType `json:"mongo_db_type"                     mapstructure:"mongo_db_type"`
+	// The connection pool settings override the ones of the url when set: PoolLimit is the
+	// maximum number of connections per server, PoolTimeout the seconds waited for a connection
+	// of a full pool, MinPoolSize the connections kept open and MaxIdleTime the seconds an unused
+	// connection is kept open for.
+	MongoPoolLimit   int `json:"mongo_pool_limit"    mapstructure:"mongo_pool_limit"`
+	MongoPoolTimeout int `json:"mongo_pool_timeout"  mapstructure:"mongo_pool_timeout"`
+	MongoMinPoolSize int `json:"mongo_min_pool_size" mapstructure:"mongo_min_pool_size"`
+	MongoMaxIdleTime int `json:"mongo_max_idle_time" mapstructure:"mongo_max_idle_time"`
 }
 
 // MongoConf defines mongo specific options.
@@ -75,6 +83,7 @@ type MongoConf struct {
 	MaxDocumentSizeBytes      int    `json:"max_document_size_bytes"       mapstructure:"max_document_size_bytes"`
 	CollectionCapMaxSizeBytes int    `json:"collection_cap_max_size_bytes" mapstructure:"collection_cap_max_size_bytes"`
 	CollectionCapEnable       bool   `json:"collection_cap_enable"         mapstructure:"collection_cap_enable"`
+	ExpireRecords             bool   `json:"expire_records"                mapstructure:"expire_records"`
 }
 
 func loadCertificateAndKeyFromFile(path string) (*tls.Certificate, error) {
@@ -149,6 +158,8 @@ func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
 		return dialInfo, errors.Wrap(err, "failed to parse mongo url")
 	}
 
+	setMongoPool(dialInfo, conf)
+
 	// nolint: nestif
 	if conf.MongoUseSSL {
 		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
@@ -224,6 +235,25 @@ func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
 	return dialInfo, err
 }
 
+// setMongoPool applies the connection pool settings of the configuration to the dial info.
+func setMongoPool(dialInfo *mgo.DialInfo, conf BaseMongoConf) {
+	if conf.MongoPoolLimit > 0 {
+		dialInfo.PoolLimit = conf.MongoPoolLimit
+	}
+
+	if conf.MongoPoolTimeout > 0 {
+		dialInfo.PoolTimeout = time.Duration(conf.MongoPoolTimeout) * time.Second
+	}
+
+	if conf.MongoMinPoolSize > 0 {
+		dialInfo.MinPoolSize = conf.MongoMinPoolSize
+	}
+
+	if conf.MongoMaxIdleTime > 0 {
+		dialInfo.MaxIdleTimeMS = conf.MongoMaxIdleTime * 1000
+	}
+}
+
 // New create a mongo pump instance.
 func (m *MongoPump) New() Pump {
 	newPump := MongoPump{}
@@ -271,6 +301,10 @@ func (m *MongoPump) Init(config interface{}) error {
 
 	m.capCollection()
 
+	if m.dbConf.ExpireRecords && m.dbConf.CollectionCapEnable {
+		log.Warn("Capped collections do not support TTL indexes, records will not be expired")
+	}
+
 	indexCreateErr := m.ensureIndexes()
 	if indexCreateErr != nil {
 		log.Error(indexCreateErr.Error())
@@ -392,9 +426,50 @@ func (m *MongoPump) ensureIndexes() error {
 		return errors.Wrap(err, "failed to ensures an index with the given key exists")
 	}
 
+	// the records are looked up by time range, and by user over a time range
+	timestampIndex := mgo.Index{
+		Name:       "timestampIndex",
+		Key:        []string{"-timestamp"},
+		Background: m.dbConf.MongoDBType == StandardMongo,
+	}
+
+	if err := c.EnsureIndex(timestampIndex); err != nil {
+		return errors.Wrap(err, "failed to ensures the timestamp index exists")
+	}
+
+	usernameIndex := mgo.Index{
+		Name:       "usernameTimestampIndex",
+		Key:        []string{"username", "-timestamp"},
+		Background: m.dbConf.MongoDBType == StandardMongo,
+	}
+
+	if err := c.EnsureIndex(usernameIndex); err != nil {
+		return errors.Wrap(err, "failed to ensures the username index exists")
+	}
+
+	if m.ExpiresRecords() {
+		// mongo removes the documents whose expireAt is older than ExpireAfter, the smallest delay it supports
+		expireIndex := mgo.Index{
+			Name:        "expireAtIndex",
+			Key:         []string{"expireAt"},
+			ExpireAfter: time.Second,
+			Background:  m.dbConf.MongoDBType == StandardMongo,
+		}
+
+		if err := c.EnsureIndex(expireIndex); err != nil {
+			return errors.Wrap(err, "failed to ensures the expireAt ttl index exists")
+		}
+	}
+
 	return nil
 }
 
+// ExpiresRecords reports whether the collection has a TTL index on expireAt. Capped collections
+// do not support TTL indexes.
+func (m *MongoPump) ExpiresRecords() bool {
+	return m.dbConf.ExpireRecords && !m.dbConf.CollectionCapEnable
+}
+
 func (m *MongoPump) connect() {
 	var err error
 	var dialInfo *mgo.DialInfo
@@ -433,7 +508,8 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 	}
 
 	for _, dataSet := range m.AccumulateSet(data) {
-		go func(dataSet []interface{}) {
+		dataSet := dataSet
+		backgroundWorkers.run(func() {
 			sess := m.dbSession.Copy()
 			defer sess.Close()
 
@@ -448,7 +524,16 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 					log.Warn("--> Detected connection failure!")
 				}
 			}
-		}(dataSet)
+		})
+	}
+
+	return nil
+}
+
+// Shutdown closes the mongo session.
+func (m *MongoPump) Shutdown() error {
+	if m.dbSession != nil {
+		m.dbSession.Close()
 	}
 
 	return nil
@@ -0,0 +1,30 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMongoDialInfoPool(t *testing.T) {
+	dialInfo, err := mongoDialInfo(BaseMongoConf{
+		MongoURL:         "mongodb://127.0.0.1:27017/iam_analytics?maxPoolSize=10&minPoolSize=2",
+		MongoPoolLimit:   50,
+		MongoPoolTimeout: 3,
+		MongoMaxIdleTime: 60,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if dialInfo.PoolLimit != 50 || dialInfo.PoolTimeout != 3*time.Second || dialInfo.MaxIdleTimeMS != 60000 {
+		t.Fatalf("the pool settings should override the url, got %+v", dialInfo)
+	}
+
+	if dialInfo.MinPoolSize != 2 {
+		t.Fatalf("the pool settings of the url should be kept when not configured, got %d", dialInfo.MinPoolSize)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the MQTT 3.1.1 control packet types used by the pump.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttDisconnect = 14
+)
+
+// Defines the defaults of the mqtt pump.
+const (
+	defaultMQTTBroker    = "tcp://localhost:1883"
+	defaultMQTTKeepAlive = 60
+	mqttAckTimeout       = 30 * time.Second
+	mqttMaxRemaining     = 268435455
+)
+
+// mqttTopicField matches the {field} placeholders of the topics.
+var mqttTopicField = regexp.MustCompile(`\{([\w.\-]+)\}`)
+
+// MQTTPump defines a pump which publishes the analytics records as messages of an MQTT broker,
+// with the MQTT 3.1.1 protocol.
+type MQTTPump struct {
+	conf   *MQTTConf
+	client *mqttClient
+	format string
+
+	CommonPumpConfig
+}
+
+// MQTTConf defines mqtt specific options.
+type MQTTConf struct {
+	// Broker is the url of the broker, tcp://host:1883, the default, or tls://host:8883, ssl://
+	// and mqtts:// being aliases of tls://.
+	Broker string `mapstructure:"broker"`
+	// Topic is the topic the messages are published to, {field} being replaced with the value of
+	// the record field, extra field or attribute of the authorization request, e.g. iam/{effect}.
+	Topic string `mapstructure:"topic"`
+	// QoS is the quality of service of the messages, 0, the default, 1 or 2.
+	QoS    int  `mapstructure:"qos"`
+	Retain bool `mapstructure:"retain"`
+	// ClientID identifies the pump to the broker, iam-pump-<hostname> by default.
+	ClientID string `mapstructure:"client_id"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// PersistentSession keeps the session of the client on the broker between the connections.
+	PersistentSession bool `mapstructure:"persistent_session"`
+	// KeepAlive is the keep alive interval in seconds, 60 by default, the connection idle for
+	// longer is established again before publishing.
+	KeepAlive             int    `mapstructure:"keep_alive"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// mqttMessage is a message published by the pump.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// New create a mqtt pump instance.
+func (m *MQTTPump) New() Pump {
+	newPump := MQTTPump{}
+
+	return &newPump
+}
+
+// GetName returns the mqtt pump name.
+func (m *MQTTPump) GetName() string {
+	return "MQTT Pump"
+}
+
+// SetFormat sets the format the messages are written in.
+func (m *MQTTPump) SetFormat(format string) {
+	m.format = format
+}
+
+// Init initialize the mqtt pump instance, the connection is established by the first write.
+func (m *MQTTPump) Init(config interface{}) error {
+	m.conf = &MQTTConf{}
+	if err := mapstructure.Decode(config, &m.conf); err != nil {
+		return errors.Wrap(err, "failed to decode mqtt configuration")
+	}
+
+	if m.conf.Topic == "" {
+		return errors.New("mqtt topic not set")
+	}
+	if strings.ContainsAny(m.conf.Topic, "+#") {
+		return errors.Errorf("mqtt topic %s cannot hold wildcards", m.conf.Topic)
+	}
+
+	if m.conf.QoS < 0 || m.conf.QoS > 2 {
+		return errors.New("mqtt qos must be 0, 1 or 2")
+	}
+
+	if m.conf.Broker == "" {
+		m.conf.Broker = defaultMQTTBroker
+	}
+
+	broker, err := url.Parse(m.conf.Broker)
+	if err != nil {
+		return errors.Wrap(err, "invalid mqtt broker")
+	}
+
+	if m.conf.ClientID == "" {
+		hostname, _ := os.Hostname()
+		m.conf.ClientID = "iam-pump-" + hostname
+	}
+
+	if m.conf.KeepAlive <= 0 {
+		m.conf.KeepAlive = defaultMQTTKeepAlive
+	}
+
+	m.client = &mqttClient{conf: m.conf, writer: &netWriter{network: "tcp", addr: broker.Host}}
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		m.client.writer.network = "tls"
+		m.client.writer.tlsConfig, err = loadTLSConfig(m.conf.SSLCAFile, m.conf.SSLCertFile, m.conf.SSLKeyFile,
+			m.conf.SSLInsecureSkipVerify)
+		if err != nil {
+			return errors.Wrap(err, "invalid mqtt tls options")
+		}
+	default:
+		return errors.Errorf("mqtt broker scheme %s is not supported, use tcp or tls", broker.Scheme)
+	}
+
+	log.Infof("MQTT pump publishes the records to %s on %s with qos %d", m.conf.Topic, m.conf.Broker, m.conf.QoS)
+
+	return nil
+}
+
+// WriteData publishes a message per record, the messages of QoS 1 and 2 are acknowledged before
+// it returns.
+func (m *MQTTPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	messages := make([]mqttMessage, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		payload, err := json.Marshal(recordMessage(m.format, &record, nil, m.GetFieldPrecedence()))
+		if err != nil {
+			log.Errorf("unable to marshal mqtt message: %s", err.Error())
+
+			continue
+		}
+
+		messages = append(messages, mqttMessage{topic: m.topic(&record), payload: payload})
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	n, err := m.client.publish(ctx, messages)
+	if err != nil {
+		return errors.Wrap(err, "failed to publish mqtt messages")
+	}
+	addWrittenBytes(ctx, n)
+
+	return nil
+}
+
+// topic returns the topic of the record, the placeholders replaced with the values of the
+// record, without the separators and wildcards of the topics.
+func (m *MQTTPump) topic(record *analytics.AnalyticsRecord) string {
+	var request map[string]interface{}
+
+	return mqttTopicField.ReplaceAllStringFunc(m.conf.Topic, func(placeholder string) string {
+		value, ok := attributeValue(record, placeholder[1:len(placeholder)-1], &request)
+		if !ok || fmt.Sprint(value) == "" {
+			return "unknown"
+		}
+
+		return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(fmt.Sprint(value))
+	})
+}
+
+// Shutdown disconnects from the broker.
+func (m *MQTTPump) Shutdown() error {
+	if m.client == nil {
+		return nil
+	}
+
+	return errors.Wrap(m.client.close(), "failed to disconnect from mqtt broker")
+}
+
+// mqttClient publishes the messages of the pump on a connection to the broker, established
+// again once when a publication fails or when idle for longer than the keep alive interval.
+type mqttClient struct {
+	conf   *MQTTConf
+	writer *netWriter
+
+	mu           sync.Mutex
+	conn         net.Conn
+	reader       *bufio.Reader
+	lastActivity time.Time
+	packetID     uint16
+}
+
+// publish sends the messages and waits for their acknowledgement, it returns the number of bytes
+// written.
+func (c *mqttClient) publish(ctx context.Context, messages []mqttMessage) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		idle := time.Since(c.lastActivity) >= time.Duration(c.conf.KeepAlive)*time.Second
+		if c.conn != nil && idle {
+			c.disconnect()
+		}
+
+		if c.conn == nil {
+			if err = c.connect(ctx); err != nil {
+				return 0, err
+			}
+		}
+
+		var n int
+		if n, err = c.send(ctx, messages); err == nil {
+			c.lastActivity = time.Now()
+
+			return n, nil
+		}
+
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+
+	return 0, err
+}
+
+// connect establishes the connection and the session of the client.
+func (c *mqttClient) connect(ctx context.Context) error {
+	conn, err := c.writer.dial(ctx)
+	if err != nil {
+		return err
+	}
+	c.setDeadline(ctx, conn)
+
+	var flags byte
+	if !c.conf.PersistentSession {
+		flags |= 0x02
+	}
+	if c.conf.Username != "" {
+		flags |= 0x80
+	}
+	if c.conf.Password != "" {
+		flags |= 0x40
+	}
+
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags, byte(c.conf.KeepAlive>>8), byte(c.conf.KeepAlive))
+	body = mqttString(body, c.conf.ClientID)
+	if c.conf.Username != "" {
+		body = mqttString(body, c.conf.Username)
+	}
+	if c.conf.Password != "" {
+		body = mqttString(body, c.conf.Password)
+	}
+
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, body)); err != nil {
+		_ = conn.Close()
+
+		return errors.Wrap(err, "failed to send mqtt connect")
+	}
+
+	reader := bufio.NewReader(conn)
+	typ, ack, err := mqttReadPacket(reader)
+	if err == nil && (typ>>4 != mqttConnack || len(ack) != 2) {
+		err = errors.Errorf("unexpected mqtt packet %d", typ>>4)
+	}
+	if err == nil && ack[1] != 0 {
+		err = errors.Errorf("mqtt connection refused with return code %d", ack[1])
+	}
+	if err != nil {
+		_ = conn.Close()
+
+		return err
+	}
+
+	c.conn, c.reader, c.lastActivity = conn, reader, time.Now()
+
+	return nil
+}
+
+// send writes the publish packets of the messages and reads their acknowledgements.
+func (c *mqttClient) send(ctx context.Context, messages []mqttMessage) (int, error) {
+	c.setDeadline(ctx, c.conn)
+
+	header := byte(mqttPublish<<4 | c.conf.QoS<<1)
+	if c.conf.Retain {
+		header |= 0x01
+	}
+
+	pending := make(map[uint16]bool, len(messages))
+	w := bufio.NewWriter(c.conn)
+	written := 0
+	for _, message := range messages {
+		body := mqttString(nil, message.topic)
+		if c.conf.QoS > 0 {
+			c.packetID++
+			if c.packetID == 0 {
+				c.packetID = 1
+			}
+			pending[c.packetID] = true
+			body = append(body, byte(c.packetID>>8), byte(c.packetID))
+		}
+
+		packet := mqttPacket(header, append(body, message.payload...))
+		if _, err := w.Write(packet); err != nil {
+			return 0, err
+		}
+		written += len(packet)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	for len(pending) > 0 {
+		typ, body, err := mqttReadPacket(c.reader)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to read mqtt acknowledgement")
+		}
+		if len(body) < 2 {
+			continue
+		}
+
+		id := uint16(body[0])<<8 | uint16(body[1])
+		switch typ >> 4 {
+		case mqttPuback, mqttPubcomp:
+			delete(pending, id)
+		case mqttPubrec:
+			if _, err := c.conn.Write(mqttPacket(mqttPubrel<<4|0x02, body[:2])); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// setDeadline bounds the io of the connection by the deadline of the context, or by the
+// acknowledgement timeout without one.
+func (c *mqttClient) setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(mqttAckTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+}
+
+// disconnect closes the connection after a disconnect packet.
+func (c *mqttClient) disconnect() {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = c.conn.Write([]byte{mqttDisconnect << 4, 0})
+	_ = c.conn.Close()
+	c.conn = nil
+}
+
+func (c *mqttClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.disconnect()
+	}
+
+	return nil
+}
+
+// mqttPacket returns the control packet of the header and body, its remaining length encoded as
+// a variable byte integer.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+// mqttString appends the length prefixed utf-8 string s.
+func mqttString(dst []byte, s string) []byte {
+	dst = append(dst, byte(len(s)>>8), byte(len(s)))
+
+	return append(dst, s...)
+}
+
+// mqttReadPacket reads a control packet, returning its header and body.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if length > mqttMaxRemaining {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
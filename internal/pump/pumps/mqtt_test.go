@@ -0,0 +1,139 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// mqttBroker accepts the connections of the pump and acknowledges their publications.
+type mqttBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	clientID string
+	topics   []string
+	payloads []string
+}
+
+func (b *mqttBroker) serve(t *testing.T) {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(t, conn)
+	}
+}
+
+func (b *mqttBroker) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case mqttConnect:
+			b.mu.Lock()
+			// protocol name, level, flags and keep alive precede the client id
+			b.clientID = string(body[12:])
+			b.mu.Unlock()
+			_, _ = conn.Write(mqttPacket(mqttConnack<<4, []byte{0, 0}))
+		case mqttPublish:
+			qos := header >> 1 & 0x03
+			topicLength := int(body[0])<<8 | int(body[1])
+			rest := body[2+topicLength:]
+			b.mu.Lock()
+			b.topics = append(b.topics, string(body[2:2+topicLength]))
+			if qos > 0 {
+				b.payloads = append(b.payloads, string(rest[2:]))
+			} else {
+				b.payloads = append(b.payloads, string(rest))
+			}
+			b.mu.Unlock()
+
+			switch qos {
+			case 1:
+				_, _ = conn.Write(mqttPacket(mqttPuback<<4, rest[:2]))
+			case 2:
+				_, _ = conn.Write(mqttPacket(mqttPubrec<<4, rest[:2]))
+			}
+		case mqttPubrel:
+			_, _ = conn.Write(mqttPacket(mqttPubcomp<<4, body[:2]))
+		case mqttDisconnect:
+			return
+		default:
+			t.Errorf("unexpected mqtt packet %d", header>>4)
+		}
+	}
+}
+
+func TestMQTTPump(t *testing.T) {
+	for _, qos := range []int{0, 1, 2} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		broker := &mqttBroker{listener: listener}
+		go broker.serve(t)
+
+		pmp := (&MQTTPump{}).New()
+		err = pmp.Init(map[string]interface{}{
+			"broker":    "tcp://" + listener.Addr().String(),
+			"topic":     "iam/{effect}/{username}",
+			"qos":       qos,
+			"client_id": "edge-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := []interface{}{
+			analytics.AnalyticsRecord{Username: "colin", Effect: "allow"},
+			analytics.AnalyticsRecord{Username: "a/b", Effect: "deny"},
+		}
+		if err := pmp.WriteData(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+		if err := pmp.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		listener.Close()
+
+		broker.mu.Lock()
+		if qos > 0 {
+			// the publications are acknowledged before the write returns
+			if len(broker.topics) != 2 || broker.topics[0] != "iam/allow/colin" || broker.topics[1] != "iam/deny/a_b" {
+				t.Errorf("qos %d: unexpected topics %v", qos, broker.topics)
+			}
+			if !strings.Contains(broker.payloads[0], `"username":"colin"`) {
+				t.Errorf("qos %d: unexpected payload %s", qos, broker.payloads[0])
+			}
+		}
+		if broker.clientID != "edge-1" {
+			t.Errorf("qos %d: unexpected client id %q", qos, broker.clientID)
+		}
+		broker.mu.Unlock()
+	}
+}
+
+func TestMQTTPacket(t *testing.T) {
+	packet := mqttPacket(mqttPublish<<4, make([]byte, 321))
+	header, body, err := mqttReadPacket(bufio.NewReader(strings.NewReader(string(packet))))
+	if err != nil || header != mqttPublish<<4 || len(body) != 321 || packet[1] != 0xc1 || packet[2] != 0x02 {
+		t.Fatalf("unexpected packet %x: %v", packet[:3], err)
+	}
+}
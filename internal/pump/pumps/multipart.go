@@ -0,0 +1,144 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the defaults of the multipart uploads.
+const (
+	defaultMultipartPartSize    = 8 << 20
+	defaultMultipartConcurrency = 4
+	// multipartAbortTimeout bounds the abort of a failed upload, which is done even when the
+	// deadline of the write is exceeded.
+	multipartAbortTimeout = 30 * time.Second
+)
+
+// MultipartConf defines the multipart upload options shared by the pumps writing to object
+// stores, it is embedded in their configuration so that the same keys are used whatever the store.
+// A payload larger than the threshold is uploaded in parts, several at a time, instead of a
+// single request.
+type MultipartConf struct {
+	// MultipartThreshold is the size in bytes above which a payload is uploaded in parts, 0
+	// disables the multipart uploads.
+	MultipartThreshold int `mapstructure:"multipart_threshold"`
+	// MultipartPartSize is the size in bytes of the parts, 8MB by default.
+	MultipartPartSize int `mapstructure:"multipart_part_size"`
+	// MultipartConcurrency is the number of parts uploaded in parallel, 4 by default.
+	MultipartConcurrency int `mapstructure:"multipart_concurrency"`
+}
+
+// multipartUpload is an upload in parts to an object store, the parts are only visible once
+// completed.
+type multipartUpload interface {
+	// uploadPart uploads the part of the given index, it is called concurrently.
+	uploadPart(ctx context.Context, index int, part []byte) error
+	// complete assembles the uploaded parts in the order of their index.
+	complete(ctx context.Context, parts int) error
+	// abort discards the uploaded parts so that they do not accrue storage.
+	abort(ctx context.Context) error
+}
+
+// validate checks the options and sets the defaults.
+func (c *MultipartConf) validate() error {
+	if c.MultipartThreshold < 0 || c.MultipartPartSize < 0 || c.MultipartConcurrency < 0 {
+		return errors.New("multipart_threshold, multipart_part_size and multipart_concurrency cannot be negative")
+	}
+
+	if c.MultipartPartSize == 0 {
+		c.MultipartPartSize = defaultMultipartPartSize
+	}
+
+	if c.MultipartConcurrency == 0 {
+		c.MultipartConcurrency = defaultMultipartConcurrency
+	}
+
+	return nil
+}
+
+// multipart reports whether a payload of the given size is uploaded in parts.
+func (c *MultipartConf) multipart(size int) bool {
+	return c.MultipartThreshold > 0 && size > c.MultipartThreshold
+}
+
+// upload uploads the payload in parts, MultipartConcurrency at a time, within the deadline of the
+// context, the options must have been validated. The upload is aborted on the first failure, or
+// when the context is done.
+func (c *MultipartConf) upload(ctx context.Context, upload multipartUpload, payload []byte) error {
+	partSize, concurrency := c.MultipartPartSize, c.MultipartConcurrency
+	parts := (len(payload) + partSize - 1) / partSize
+	if parts > 1 && concurrency > parts {
+		concurrency = parts
+	}
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		backgroundWorkers.run(func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				end := (index + 1) * partSize
+				if end > len(payload) {
+					end = len(payload)
+				}
+
+				if err := upload.uploadPart(partCtx, index, payload[index*partSize:end]); err != nil {
+					once.Do(func() {
+						firstErr = errors.Wrapf(err, "failed to upload part %d of %d", index+1, parts)
+						cancel()
+					})
+				}
+			}
+		})
+	}
+
+dispatch:
+	for index := 0; index < parts; index++ {
+		select {
+		case indexes <- index:
+		case <-partCtx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	err := firstErr
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = upload.complete(ctx, parts)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// the context of the write may be done already, the abort gets its own deadline
+	abortCtx, abortCancel := context.WithTimeout(context.Background(), multipartAbortTimeout)
+	defer abortCancel()
+
+	if abortErr := upload.abort(abortCtx); abortErr != nil {
+		log.Warnf("Failed to abort multipart upload, parts may remain in the store: %s", abortErr.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpload keeps the uploaded parts in memory, a part takes delay to upload.
+type fakeUpload struct {
+	delay  time.Duration
+	failAt int
+
+	mu        sync.Mutex
+	parts     map[int][]byte
+	completed int
+	aborted   bool
+}
+
+func newFakeUpload(delay time.Duration, failAt int) *fakeUpload {
+	return &fakeUpload{delay: delay, failAt: failAt, parts: map[int][]byte{}}
+}
+
+func (u *fakeUpload) uploadPart(ctx context.Context, index int, part []byte) error {
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if index == u.failAt {
+		return errors.New("part rejected")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.parts[index] = part
+
+	return nil
+}
+
+func (u *fakeUpload) complete(ctx context.Context, parts int) error {
+	u.completed = parts
+
+	return nil
+}
+
+func (u *fakeUpload) abort(ctx context.Context) error {
+	u.aborted = true
+	u.parts = nil
+
+	return nil
+}
+
+func TestMultipartUpload(t *testing.T) {
+	conf := &MultipartConf{MultipartThreshold: 10, MultipartPartSize: 4, MultipartConcurrency: 3}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.multipart(10) || !conf.multipart(11) {
+		t.Error("only the payloads larger than the threshold should be uploaded in parts")
+	}
+
+	payload := []byte("the analytics records of the window")
+	upload := newFakeUpload(0, -1)
+	if err := conf.upload(context.Background(), upload, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var assembled []byte
+	for index := 0; index < upload.completed; index++ {
+		assembled = append(assembled, upload.parts[index]...)
+	}
+	if !bytes.Equal(assembled, payload) {
+		t.Errorf("the parts should be assembled in order, got %q", assembled)
+	}
+	if upload.aborted {
+		t.Error("a completed upload should not be aborted")
+	}
+
+	if err := (&MultipartConf{MultipartPartSize: -1}).validate(); err == nil {
+		t.Error("a negative part size should be rejected")
+	}
+}
+
+func TestMultipartUploadAbort(t *testing.T) {
+	conf := &MultipartConf{MultipartThreshold: 1, MultipartPartSize: 1, MultipartConcurrency: 2}
+
+	upload := newFakeUpload(0, 3)
+	if err := conf.upload(context.Background(), upload, []byte("0123456789")); err == nil {
+		t.Fatal("a failed part should fail the upload")
+	}
+	if !upload.aborted || upload.completed != 0 {
+		t.Error("a failed upload should be aborted")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	upload = newFakeUpload(10*time.Millisecond, -1)
+	if err := conf.upload(ctx, upload, []byte("0123456789")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if !upload.aborted || upload.completed != 0 {
+		t.Error("an upload past the deadline should be aborted")
+	}
+}
+
+// BenchmarkMultipartUpload uploads a 64MB batch over simulated connections of 256MB/s: the upload
+// time is divided by the concurrency, from 250ms in sequence to 63ms in 8MB parts 4 at a time and
+// 31ms 8 at a time.
+func BenchmarkMultipartUpload(b *testing.B) {
+	const size = 64 << 20
+
+	payload := make([]byte, size)
+	for _, concurrency := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			conf := &MultipartConf{MultipartThreshold: 1, MultipartConcurrency: concurrency}
+			if err := conf.validate(); err != nil {
+				b.Fatal(err)
+			}
+
+			for i := 0; i < b.N; i++ {
+				upload := newFakeUpload(time.Duration(conf.MultipartPartSize)*time.Second/(256<<20), -1)
+				if err := conf.upload(context.Background(), upload, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/errors"
+)
+
+// netDialTimeout bounds the connection to the collector.
+const netDialTimeout = 10 * time.Second
+
+// loadTLSConfig returns the tls configuration of a connection to a collector, verified with the
+// ca file or the system roots and authenticated with the client certificate when set.
+func loadTLSConfig(caFile string, certFile string, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	//nolint: gosec // skipping the verification is an explicit opt-in
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificate found in ca file %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// netWriter writes the messages of the pumps to a collector over udp, tcp or tls. The connection
+// is established on the first write, and established again once when a write fails.
+type netWriter struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *netWriter) write(ctx context.Context, message []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(ctx); err != nil {
+				return 0, err
+			}
+		}
+
+		deadline, _ := ctx.Deadline()
+		_ = w.conn.SetWriteDeadline(deadline)
+
+		var n int
+		if n, err = w.conn.Write(message); err == nil {
+			return n, nil
+		}
+
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+
+	return 0, err
+}
+
+func (w *netWriter) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: netDialTimeout}
+	if w.network != "tls" {
+		return dialer.DialContext(ctx, w.network, w.addr)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", w.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := w.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(w.addr)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+
+		return nil, errors.Wrap(err, "tls handshake failed")
+	}
+
+	return tlsConn, nil
+}
+
+func (w *netWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+
+	return err
+}
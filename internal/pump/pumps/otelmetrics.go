@@ -0,0 +1,550 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the kinds of instruments the otelmetrics pump updates from analytics records.
+const (
+	// OtelMetricsCounter counts the records per attribute set.
+	OtelMetricsCounter = "counter"
+	// OtelMetricsHistogram records the distribution of the numeric value of a record field, e.g.
+	// the latency of the authorizations, per attribute set.
+	OtelMetricsHistogram = "histogram"
+)
+
+// Defines the OTLP protocols the metrics are exported with.
+const (
+	OtelMetricsProtocolProtobuf = "http/protobuf"
+	OtelMetricsProtocolJSON     = "http/json"
+)
+
+// Defines the defaults of the otelmetrics pump.
+const (
+	defaultOtelMetricsExportInterval = 60
+	defaultOtelMetricsExportTimeout  = 10 * time.Second
+	// otlpTemporalityCumulative is the OTLP aggregation temporality of the exported points, they
+	// accumulate since the pump started.
+	otlpTemporalityCumulative = 2
+)
+
+// defaultOtelMetricsBuckets are the histogram bucket bounds used when none are configured,
+// suited to latencies in milliseconds.
+var defaultOtelMetricsBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// OtelMetricsPump defines a pump which derives metrics from analytics records and exports them
+// with OTLP/HTTP to an OpenTelemetry collector. The writes only update the instruments, which are
+// pushed every export interval and once more at shutdown.
+type OtelMetricsPump struct {
+	conf   *OtelMetricsConf
+	client *http.Client
+	start  time.Time
+
+	mu     sync.Mutex
+	points []map[string]*otelMetricsPoint
+
+	stop chan struct{}
+	done chan struct{}
+
+	CommonPumpConfig
+}
+
+// OtelMetricsConf defines otelmetrics specific options.
+type OtelMetricsConf struct {
+	// Endpoint is the OTLP/HTTP base url, the metrics are posted to <endpoint>/v1/metrics.
+	Endpoint string `mapstructure:"endpoint"`
+	// Protocol is http/protobuf, the default, or http/json.
+	Protocol    string `mapstructure:"protocol"`
+	ServiceName string `mapstructure:"service_name"`
+	// ExportInterval is the delay in seconds between the exports, 60 by default.
+	ExportInterval int                     `mapstructure:"export_interval"`
+	Instruments    []OtelMetricsInstrument `mapstructure:"instruments"`
+	// SampleRateField is the field of the sample rate of the records, see DefaultSampleRateField.
+	SampleRateField string `mapstructure:"sample_rate_field"`
+	// The headers are sent with the exports, the static metadata is set as resource attributes.
+	HeadersConf `mapstructure:",squash"`
+}
+
+// OtelMetricsInstrument defines an instrument updated from analytics records.
+type OtelMetricsInstrument struct {
+	Name        string `mapstructure:"name"`
+	Type        string `mapstructure:"type"`
+	Description string `mapstructure:"description"`
+	Unit        string `mapstructure:"unit"`
+	// Field is the record field holding the value recorded by a histogram.
+	Field string `mapstructure:"field"`
+	// Labels is the list of record fields set as attributes of the points.
+	Labels  []string  `mapstructure:"labels"`
+	Buckets []float64 `mapstructure:"buckets"`
+}
+
+// otelMetricsPoint is the cumulative state of an instrument for an attribute set.
+type otelMetricsPoint struct {
+	labels []remoteWriteLabel
+	// sum is the total of a counter, or the sum of the values recorded by a histogram.
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+// New create an otelmetrics pump instance.
+func (o *OtelMetricsPump) New() Pump {
+	newPump := OtelMetricsPump{}
+
+	return &newPump
+}
+
+// GetName returns the otelmetrics pump name.
+func (o *OtelMetricsPump) GetName() string {
+	return "OpenTelemetry Metrics Pump"
+}
+
+// Init initialize the otelmetrics pump instance and starts the periodic export.
+func (o *OtelMetricsPump) Init(config interface{}) error {
+	o.conf = &OtelMetricsConf{}
+	if err := mapstructure.Decode(config, &o.conf); err != nil {
+		return errors.Wrap(err, "failed to decode otelmetrics configuration")
+	}
+
+	if o.conf.SampleRateField == "" {
+		o.conf.SampleRateField = DefaultSampleRateField
+	}
+
+	if o.conf.Endpoint == "" {
+		return errors.New("otelmetrics endpoint not set")
+	}
+	o.conf.Endpoint = strings.TrimSuffix(o.conf.Endpoint, "/")
+
+	switch o.conf.Protocol {
+	case "":
+		o.conf.Protocol = OtelMetricsProtocolProtobuf
+	case OtelMetricsProtocolProtobuf, OtelMetricsProtocolJSON:
+	default:
+		return errors.Errorf("otelmetrics protocol must be %s or %s", OtelMetricsProtocolProtobuf, OtelMetricsProtocolJSON)
+	}
+
+	if o.conf.ServiceName == "" {
+		o.conf.ServiceName = "iam-authz-server"
+	}
+
+	if o.conf.ExportInterval <= 0 {
+		o.conf.ExportInterval = defaultOtelMetricsExportInterval
+	}
+
+	if len(o.conf.Instruments) == 0 {
+		o.conf.Instruments = []OtelMetricsInstrument{
+			{Name: "iam.authorizations", Type: OtelMetricsCounter, Labels: []string{"effect", "conclusion"}},
+		}
+	}
+
+	for i, instrument := range o.conf.Instruments {
+		if instrument.Name == "" {
+			return errors.Errorf("otelmetrics instrument %d has no name", i)
+		}
+
+		switch instrument.Type {
+		case "":
+			o.conf.Instruments[i].Type = OtelMetricsCounter
+		case OtelMetricsCounter:
+		case OtelMetricsHistogram:
+			if instrument.Field == "" {
+				return errors.Errorf("otelmetrics histogram %s has no field", instrument.Name)
+			}
+			if len(instrument.Buckets) == 0 {
+				o.conf.Instruments[i].Buckets = defaultOtelMetricsBuckets
+			}
+			if !sort.Float64sAreSorted(o.conf.Instruments[i].Buckets) {
+				return errors.Errorf("otelmetrics histogram %s buckets must be sorted", instrument.Name)
+			}
+		default:
+			return errors.Errorf("otelmetrics instrument %s has unsupported type %s", instrument.Name, instrument.Type)
+		}
+	}
+
+	o.client = &http.Client{}
+	o.start = time.Now()
+	o.points = make([]map[string]*otelMetricsPoint, len(o.conf.Instruments))
+	for i := range o.points {
+		o.points[i] = make(map[string]*otelMetricsPoint)
+	}
+
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go o.run()
+
+	log.Infof("OpenTelemetry metrics pump exports %d instruments to %s/v1/metrics every %ds",
+		len(o.conf.Instruments), o.conf.Endpoint, o.conf.ExportInterval)
+
+	return nil
+}
+
+// WriteData updates the instruments with the analytics data, they are exported by the periodic push.
+func (o *OtelMetricsPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, item := range data {
+		record, ok := item.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		for i, instrument := range o.conf.Instruments {
+			value := sampleWeight(&record, o.conf.SampleRateField, o.GetCountField())
+			if instrument.Type == OtelMetricsHistogram {
+				field, ok := record.FieldValue(instrument.Field)
+				if !ok {
+					continue
+				}
+				parsed, err := strconv.ParseFloat(fmt.Sprint(field), 64)
+				if err != nil {
+					continue
+				}
+				value = parsed
+			}
+
+			o.point(i, instrument, &record).record(instrument, value)
+		}
+	}
+
+	return nil
+}
+
+// point returns the point of the instrument for the attributes of the record.
+func (o *OtelMetricsPump) point(i int, instrument OtelMetricsInstrument, record *analytics.AnalyticsRecord) *otelMetricsPoint {
+	labels := make([]remoteWriteLabel, 0, len(instrument.Labels))
+	for _, name := range instrument.Labels {
+		value, _ := record.FieldValue(name)
+		labels = append(labels, remoteWriteLabel{name: name, value: fmt.Sprint(value)})
+	}
+
+	key := labelsKey(labels)
+	point, ok := o.points[i][key]
+	if !ok {
+		point = &otelMetricsPoint{labels: labels}
+		if instrument.Type == OtelMetricsHistogram {
+			point.buckets = make([]uint64, len(instrument.Buckets)+1)
+		}
+		o.points[i][key] = point
+	}
+
+	return point
+}
+
+// record adds the value to a counter, or records it in the buckets of a histogram.
+func (p *otelMetricsPoint) record(instrument OtelMetricsInstrument, value float64) {
+	p.sum += value
+	if instrument.Type != OtelMetricsHistogram {
+		return
+	}
+
+	p.count++
+	p.buckets[sort.SearchFloat64s(instrument.Buckets, value)]++
+}
+
+// run exports the instruments every export interval until the pump is shut down, and a last time then.
+func (o *OtelMetricsPump) run() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(time.Duration(o.conf.ExportInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.stop:
+			o.exportAll()
+
+			return
+		}
+
+		o.exportAll()
+	}
+}
+
+func (o *OtelMetricsPump) exportAll() {
+	timeout := defaultOtelMetricsExportTimeout
+	if o.GetTimeout() > 0 {
+		timeout = time.Duration(o.GetTimeout()) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := o.export(ctx, time.Now()); err != nil {
+		log.Errorf("Failed to export the OpenTelemetry metrics: %s", err.Error())
+	}
+}
+
+// export pushes the current state of the instruments to the collector.
+func (o *OtelMetricsPump) export(ctx context.Context, now time.Time) error {
+	body, contentType, err := o.encode(now)
+	if err != nil || body == nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.conf.Endpoint+"/v1/metrics", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create otelmetrics request")
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	o.conf.setHeaders(req.Header)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to export metrics to the otel collector")
+	}
+	defer resp.Body.Close()
+
+	return checkResponse("otel collector", resp)
+}
+
+// encode encodes the points of the instruments as an ExportMetricsServiceRequest in the
+// configured protocol, the body is nil when no point was recorded yet.
+func (o *OtelMetricsPump) encode(now time.Time) ([]byte, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	empty := true
+	for _, points := range o.points {
+		empty = empty && len(points) == 0
+	}
+	if empty {
+		return nil, "", nil
+	}
+
+	attributes := make([]remoteWriteLabel, 0, len(o.conf.StaticMetadata)+1)
+	attributes = append(attributes, remoteWriteLabel{name: "service.name", value: o.conf.ServiceName})
+	for name, value := range o.conf.StaticMetadata {
+		attributes = append(attributes, remoteWriteLabel{name: name, value: value})
+	}
+
+	if o.conf.Protocol == OtelMetricsProtocolJSON {
+		body, err := json.Marshal(o.jsonRequest(attributes, now))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to encode metrics")
+		}
+
+		return body, "application/json", nil
+	}
+
+	return o.protobufRequest(attributes, now), "application/x-protobuf", nil
+}
+
+// sortedPoints returns the points of the instrument ordered by attributes.
+func (o *OtelMetricsPump) sortedPoints(i int) []*otelMetricsPoint {
+	keys := make([]string, 0, len(o.points[i]))
+	for key := range o.points[i] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	points := make([]*otelMetricsPoint, 0, len(keys))
+	for _, key := range keys {
+		points = append(points, o.points[i][key])
+	}
+
+	return points
+}
+
+// jsonRequest builds the request in the OTLP/JSON encoding.
+func (o *OtelMetricsPump) jsonRequest(resource []remoteWriteLabel, now time.Time) map[string]interface{} {
+	start, end := strconv.FormatInt(o.start.UnixNano(), 10), strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := make([]interface{}, 0, len(o.conf.Instruments))
+	for i, instrument := range o.conf.Instruments {
+		dataPoints := make([]interface{}, 0, len(o.points[i]))
+		for _, point := range o.sortedPoints(i) {
+			dataPoint := map[string]interface{}{
+				"attributes":        otlpAttributes(point.labels),
+				"startTimeUnixNano": start,
+				"timeUnixNano":      end,
+			}
+			if instrument.Type == OtelMetricsHistogram {
+				counts := make([]string, len(point.buckets))
+				for j, count := range point.buckets {
+					counts[j] = strconv.FormatUint(count, 10)
+				}
+				dataPoint["count"] = strconv.FormatUint(point.count, 10)
+				dataPoint["sum"] = point.sum
+				dataPoint["bucketCounts"] = counts
+				dataPoint["explicitBounds"] = instrument.Buckets
+			} else {
+				dataPoint["asDouble"] = point.sum
+			}
+			dataPoints = append(dataPoints, dataPoint)
+		}
+
+		metric := map[string]interface{}{
+			"name":        instrument.Name,
+			"description": instrument.Description,
+			"unit":        instrument.Unit,
+		}
+		if instrument.Type == OtelMetricsHistogram {
+			metric["histogram"] = map[string]interface{}{
+				"dataPoints":             dataPoints,
+				"aggregationTemporality": otlpTemporalityCumulative,
+			}
+		} else {
+			metric["sum"] = map[string]interface{}{
+				"dataPoints":             dataPoints,
+				"aggregationTemporality": otlpTemporalityCumulative,
+				"isMonotonic":            true,
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   otlpScope(),
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(labels []remoteWriteLabel) []interface{} {
+	attributes := make([]interface{}, 0, len(labels))
+	for _, label := range labels {
+		attributes = append(attributes, otlpAttribute(label.name, label.value))
+	}
+
+	return attributes
+}
+
+// protobufRequest builds the request in the OTLP protobuf encoding:
+//
+//	message ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	message ResourceMetrics    { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	message Resource           { repeated KeyValue attributes = 1; }
+//	message ScopeMetrics       { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//	message Metric             { string name = 1; string description = 2; string unit = 3;
+//	                             Sum sum = 7; Histogram histogram = 9; }
+//	message Sum                { repeated NumberDataPoint data_points = 1;
+//	                             AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	message Histogram          { repeated HistogramDataPoint data_points = 1;
+//	                             AggregationTemporality aggregation_temporality = 2; }
+//	message NumberDataPoint    { fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	                             double as_double = 4; repeated KeyValue attributes = 7; }
+//	message HistogramDataPoint { fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	                             fixed64 count = 4; double sum = 5; repeated fixed64 bucket_counts = 6;
+//	                             repeated double explicit_bounds = 7; repeated KeyValue attributes = 9; }
+func (o *OtelMetricsPump) protobufRequest(resource []remoteWriteLabel, now time.Time) []byte {
+	start, end := uint64(o.start.UnixNano()), uint64(now.UnixNano())
+
+	scope := appendMessage(nil, 1, encodeOTLPScope())
+
+	for i, instrument := range o.conf.Instruments {
+		var data []byte
+		for _, point := range o.sortedPoints(i) {
+			var p []byte
+			p = protowire.AppendTag(p, 2, protowire.Fixed64Type)
+			p = protowire.AppendFixed64(p, start)
+			p = protowire.AppendTag(p, 3, protowire.Fixed64Type)
+			p = protowire.AppendFixed64(p, end)
+
+			attributesField := protowire.Number(7)
+			if instrument.Type == OtelMetricsHistogram {
+				attributesField = 9
+				p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+				p = protowire.AppendFixed64(p, point.count)
+				p = protowire.AppendTag(p, 5, protowire.Fixed64Type)
+				p = protowire.AppendFixed64(p, math.Float64bits(point.sum))
+
+				var counts, bounds []byte
+				for _, count := range point.buckets {
+					counts = protowire.AppendFixed64(counts, count)
+				}
+				for _, bound := range instrument.Buckets {
+					bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+				}
+				p = appendMessage(p, 6, counts)
+				p = appendMessage(p, 7, bounds)
+			} else {
+				p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+				p = protowire.AppendFixed64(p, math.Float64bits(point.sum))
+			}
+
+			for _, label := range point.labels {
+				p = appendMessage(p, attributesField, encodeOTLPKeyValue(label.name, label.value))
+			}
+
+			data = appendMessage(data, 1, p)
+		}
+
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpTemporalityCumulative)
+
+		var metric []byte
+		metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+		metric = protowire.AppendString(metric, instrument.Name)
+		metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+		metric = protowire.AppendString(metric, instrument.Description)
+		metric = protowire.AppendTag(metric, 3, protowire.BytesType)
+		metric = protowire.AppendString(metric, instrument.Unit)
+		if instrument.Type == OtelMetricsHistogram {
+			metric = appendMessage(metric, 9, data)
+		} else {
+			data = protowire.AppendTag(data, 3, protowire.VarintType)
+			data = protowire.AppendVarint(data, protowire.EncodeBool(true))
+			metric = appendMessage(metric, 7, data)
+		}
+
+		scope = appendMessage(scope, 2, metric)
+	}
+
+	var res []byte
+	for _, label := range resource {
+		res = appendMessage(res, 1, encodeOTLPKeyValue(label.name, label.value))
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, res)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scope)
+
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+// Shutdown stops the periodic export after a last export of the instruments.
+func (o *OtelMetricsPump) Shutdown() error {
+	if o.stop == nil {
+		return nil
+	}
+
+	close(o.stop)
+	<-o.done
+	o.stop = nil
+
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []struct {
+				Name string `json:"name"`
+				Sum  *struct {
+					DataPoints []struct {
+						Attributes []otlpKeyValue `json:"attributes"`
+						AsDouble   float64        `json:"asDouble"`
+					} `json:"dataPoints"`
+					IsMonotonic bool `json:"isMonotonic"`
+				} `json:"sum"`
+				Histogram *struct {
+					DataPoints []struct {
+						Count        string   `json:"count"`
+						Sum          float64  `json:"sum"`
+						BucketCounts []string `json:"bucketCounts"`
+					} `json:"dataPoints"`
+				} `json:"histogram"`
+			} `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func TestOtelMetricsPump(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpMetricsRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		var req otlpMetricsRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pmp := (&OtelMetricsPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"endpoint":        server.URL,
+		"protocol":        "http/json",
+		"export_interval": 3600,
+		"headers":         map[string]string{"Authorization": "Bearer token"},
+		"static_metadata": map[string]string{"deployment.environment": "prod"},
+		"instruments": []map[string]interface{}{
+			{"name": "iam.authorizations", "labels": []string{"effect"}},
+			{"name": "iam.latency", "type": "histogram", "field": "latency", "buckets": []float64{10, 100}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{Effect: "allow", Extra: map[string]interface{}{"latency": 5}},
+		analytics.AnalyticsRecord{Effect: "allow", Extra: map[string]interface{}{"latency": 50}},
+		analytics.AnalyticsRecord{Effect: "deny", Extra: map[string]interface{}{"latency": "500"}},
+	}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the instruments are exported at shutdown
+	if err := pmp.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(requests) != 1 || len(requests[0].ResourceMetrics) != 1 {
+		t.Fatalf("expected a single export, got %+v", requests)
+	}
+
+	resource := requests[0].ResourceMetrics[0]
+	if len(resource.Resource.Attributes) != 2 || resource.Resource.Attributes[0].Value.StringValue != "iam-authz-server" {
+		t.Errorf("unexpected resource attributes %+v", resource.Resource.Attributes)
+	}
+
+	metrics := resource.ScopeMetrics[0].Metrics
+	if len(metrics) != 2 || metrics[0].Sum == nil || metrics[1].Histogram == nil {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+
+	points := metrics[0].Sum.DataPoints
+	if len(points) != 2 || points[0].Attributes[0].Value.StringValue != "allow" || points[0].AsDouble != 2 ||
+		points[1].AsDouble != 1 || !metrics[0].Sum.IsMonotonic {
+		t.Errorf("unexpected counter points %+v", points)
+	}
+
+	histogram := metrics[1].Histogram.DataPoints
+	if len(histogram) != 1 || histogram[0].Count != "3" || histogram[0].Sum != 555 {
+		t.Fatalf("unexpected histogram points %+v", histogram)
+	}
+	for i, count := range []string{"1", "1", "1"} {
+		if histogram[0].BucketCounts[i] != count {
+			t.Errorf("unexpected bucket counts %v", histogram[0].BucketCounts)
+		}
+	}
+}
+
+// protobufField returns the value of the first field num of the message, the raw bytes of a
+// fixed64 field.
+func protobufField(t *testing.T, message []byte, num protowire.Number) []byte {
+	t.Helper()
+
+	for len(message) > 0 {
+		field, typ, n := protowire.ConsumeTag(message)
+		message = message[n:]
+		n = protowire.ConsumeFieldValue(field, typ, message)
+		if n < 0 {
+			t.Fatalf("invalid message: %v", protowire.ParseError(n))
+		}
+
+		if field == num {
+			if typ == protowire.BytesType {
+				value, _ := protowire.ConsumeBytes(message)
+
+				return value
+			}
+
+			return message[:n]
+		}
+		message = message[n:]
+	}
+	t.Fatalf("field %d not found", num)
+
+	return nil
+}
+
+func TestOtelMetricsProtobuf(t *testing.T) {
+	pmp := &OtelMetricsPump{}
+	if err := pmp.Init(map[string]interface{}{"endpoint": "http://127.0.0.1:0", "export_interval": 3600}); err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	if body, _, _ := pmp.encode(time.Now()); body != nil {
+		t.Error("nothing should be exported before the first write")
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{Effect: "allow"}, analytics.AnalyticsRecord{Effect: "allow"}}
+	_ = pmp.WriteData(context.Background(), data)
+	body, contentType, err := pmp.encode(time.Now())
+	if err != nil || contentType != "application/x-protobuf" {
+		t.Fatalf("unexpected encoding %s: %v", contentType, err)
+	}
+
+	// resource_metrics.scope_metrics.metrics
+	metric := protobufField(t, protobufField(t, protobufField(t, body, 1), 2), 2)
+	if name := string(protobufField(t, metric, 1)); name != "iam.authorizations" {
+		t.Errorf("unexpected metric name %s", name)
+	}
+
+	// sum.data_points.as_double
+	value, _ := protowire.ConsumeFixed64(protobufField(t, protobufField(t, protobufField(t, metric, 7), 1), 4))
+	if math.Float64frombits(value) != 2 {
+		t.Errorf("unexpected counter value %v", math.Float64frombits(value))
+	}
+}
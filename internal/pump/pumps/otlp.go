@@ -0,0 +1,620 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/ory/ladon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the signals the otlp pump exports the records as.
+const (
+	// OTLPSignalLogs exports a log record per analytics record.
+	OTLPSignalLogs = "logs"
+	// OTLPSignalSpanEvents exports a span per analytics record, the record being an event of the
+	// span, e.g. to join the spans of the authorizations to their traces.
+	OTLPSignalSpanEvents = "span_events"
+)
+
+// Defines the OTLP protocols the otlp pump exports with.
+const (
+	OTLPProtocolGRPC     = "grpc"
+	OTLPProtocolProtobuf = "http/protobuf"
+	OTLPProtocolJSON     = "http/json"
+)
+
+// Defines the OTLP severities of the log records, allowed requests are informational and the
+// others warnings.
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+// Defines the defaults of the otlp pump.
+const (
+	defaultOTLPBatchSize = 512
+	otlpEventName        = "iam.authorization"
+	otlpLogsPath         = "/v1/logs"
+	otlpTracesPath       = "/v1/traces"
+	otlpLogsMethod       = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	otlpTracesMethod     = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+)
+
+// defaultOTLPAttributes maps the attributes of the log records and events to the record fields,
+// extra fields or attributes of the authorization request they are set from.
+var defaultOTLPAttributes = map[string]string{
+	"iam.username":   "username",
+	"iam.effect":     "effect",
+	"iam.conclusion": "conclusion",
+	"iam.resource":   "resource",
+	"iam.action":     "action",
+}
+
+// OTLPPump defines a pump which converts analytics records into OTLP log records, or span events,
+// and exports them over gRPC or HTTP to an OpenTelemetry collector.
+type OTLPPump struct {
+	conf   *OTLPConf
+	client *http.Client
+	conn   *grpc.ClientConn
+	format string
+
+	CommonPumpConfig
+}
+
+// OTLPConf defines otlp specific options.
+type OTLPConf struct {
+	// Endpoint is the OTLP/HTTP base url, the records are posted to <endpoint>/v1/logs or
+	// <endpoint>/v1/traces, or the host:port of the OTLP/gRPC receiver, https:// enabling tls.
+	Endpoint string `mapstructure:"endpoint"`
+	// Protocol is http/protobuf, the default, http/json or grpc.
+	Protocol string `mapstructure:"protocol"`
+	// Signal is logs, the default, or span_events.
+	Signal      string `mapstructure:"signal"`
+	ServiceName string `mapstructure:"service_name"`
+	// SpanName is the name of the spans of the span events, authorize by default.
+	SpanName  string `mapstructure:"span_name"`
+	BatchSize int    `mapstructure:"batch_size"`
+	// Attributes maps the attribute names to the record fields, extra fields or attributes of the
+	// authorization request they are set from.
+	Attributes map[string]string `mapstructure:"attributes"`
+	// TraceIDField and SpanIDField are the record fields holding the hex encoded ids of the trace
+	// the authorization belongs to. The span events get random ids when missing.
+	TraceIDField string `mapstructure:"trace_id_field"`
+	SpanIDField  string `mapstructure:"span_id_field"`
+	// The headers are sent with the exports, as metadata over grpc, the metadata of the records
+	// is set as attributes.
+	HeadersConf           `mapstructure:",squash"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// otlpRecord is an analytics record converted into a log record or a span event.
+type otlpRecord struct {
+	time       time.Time
+	severity   int
+	body       string
+	attributes []otlpAttributeValue
+	traceID    string
+	spanID     string
+}
+
+type otlpAttributeValue struct {
+	key   string
+	value interface{}
+}
+
+// otlpRawCodec passes the requests encoded by the pump as is to grpc.
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, errors.Errorf("unexpected otlp message %T", v)
+	}
+
+	return *b, nil
+}
+
+func (otlpRawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return errors.Errorf("unexpected otlp message %T", v)
+	}
+	*b = append((*b)[:0], data...)
+
+	return nil
+}
+
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
+
+// New create an otlp pump instance.
+func (o *OTLPPump) New() Pump {
+	newPump := OTLPPump{}
+
+	return &newPump
+}
+
+// GetName returns the otlp pump name.
+func (o *OTLPPump) GetName() string {
+	return "OTLP Pump"
+}
+
+// SetFormat sets the format the bodies of the log records are written in.
+func (o *OTLPPump) SetFormat(format string) {
+	o.format = format
+}
+
+// Init initialize the otlp pump instance, the grpc connection is established in the background.
+func (o *OTLPPump) Init(config interface{}) error {
+	o.conf = &OTLPConf{}
+	if err := mapstructure.Decode(config, &o.conf); err != nil {
+		return errors.Wrap(err, "failed to decode otlp configuration")
+	}
+
+	if o.conf.Endpoint == "" {
+		return errors.New("otlp endpoint not set")
+	}
+	o.conf.Endpoint = strings.TrimSuffix(o.conf.Endpoint, "/")
+
+	switch o.conf.Protocol {
+	case "":
+		o.conf.Protocol = OTLPProtocolProtobuf
+	case OTLPProtocolProtobuf, OTLPProtocolJSON, OTLPProtocolGRPC:
+	default:
+		return errors.Errorf("otlp protocol must be %s, %s or %s", OTLPProtocolProtobuf, OTLPProtocolJSON,
+			OTLPProtocolGRPC)
+	}
+
+	switch o.conf.Signal {
+	case "":
+		o.conf.Signal = OTLPSignalLogs
+	case OTLPSignalLogs, OTLPSignalSpanEvents:
+	default:
+		return errors.Errorf("otlp signal must be %s or %s", OTLPSignalLogs, OTLPSignalSpanEvents)
+	}
+
+	if o.conf.ServiceName == "" {
+		o.conf.ServiceName = "iam-authz-server"
+	}
+
+	if o.conf.SpanName == "" {
+		o.conf.SpanName = "authorize"
+	}
+
+	if o.conf.BatchSize <= 0 {
+		o.conf.BatchSize = defaultOTLPBatchSize
+	}
+
+	if len(o.conf.Attributes) == 0 {
+		o.conf.Attributes = defaultOTLPAttributes
+	}
+
+	tlsConfig, err := loadTLSConfig(o.conf.SSLCAFile, o.conf.SSLCertFile, o.conf.SSLKeyFile,
+		o.conf.SSLInsecureSkipVerify)
+	if err != nil {
+		return errors.Wrap(err, "invalid otlp tls options")
+	}
+
+	if o.conf.Protocol != OTLPProtocolGRPC {
+		o.client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}}
+
+		log.Infof("OTLP pump exports the records as %s to %s%s", o.conf.Signal, o.conf.Endpoint, o.path())
+
+		return nil
+	}
+
+	transport := grpc.WithInsecure()
+	target := strings.TrimPrefix(o.conf.Endpoint, "http://")
+	if strings.HasPrefix(o.conf.Endpoint, "https://") || o.conf.SSLCAFile != "" || o.conf.SSLCertFile != "" {
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+		target = strings.TrimPrefix(target, "https://")
+	}
+
+	if o.conn, err = grpc.Dial(target, transport); err != nil {
+		return errors.Wrapf(err, "failed to connect to otlp receiver %s", target)
+	}
+
+	log.Infof("OTLP pump exports the records as %s to %s over grpc", o.conf.Signal, target)
+
+	return nil
+}
+
+// path returns the path of the OTLP/HTTP exports of the signal.
+func (o *OTLPPump) path() string {
+	if o.conf.Signal == OTLPSignalSpanEvents {
+		return otlpTracesPath
+	}
+
+	return otlpLogsPath
+}
+
+// WriteData converts the analytics data into OTLP records and exports them in batches.
+func (o *OTLPPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	records := make([]otlpRecord, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		records = append(records, o.record(&record))
+	}
+
+	for start := 0; start < len(records); start += o.conf.BatchSize {
+		end := start + o.conf.BatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		if err := o.export(ctx, records[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// record converts an analytics record into an OTLP record.
+func (o *OTLPPump) record(record *analytics.AnalyticsRecord) otlpRecord {
+	r := otlpRecord{time: time.Unix(record.TimeStamp, 0), severity: otlpSeverityInfo}
+	if record.Effect != ladon.AllowAccess {
+		r.severity = otlpSeverityWarn
+	}
+
+	body, _ := json.Marshal(recordMessage(o.format, record, nil, o.GetFieldPrecedence()))
+	r.body = string(body)
+
+	var request map[string]interface{}
+	for name, field := range o.conf.Attributes {
+		if value, ok := attributeValue(record, field, &request); ok {
+			r.attributes = append(r.attributes, otlpAttributeValue{key: name, value: value})
+		}
+	}
+	for name, value := range o.conf.metadata(record) {
+		r.attributes = append(r.attributes, otlpAttributeValue{key: name, value: value})
+	}
+
+	var traceOK, spanOK bool
+	r.traceID, traceOK = otlpRecordID(record, o.conf.TraceIDField, 16)
+	r.spanID, spanOK = otlpRecordID(record, o.conf.SpanIDField, 8)
+	if o.conf.Signal == OTLPSignalSpanEvents {
+		if !traceOK {
+			r.traceID = randomOTLPID(16)
+		}
+		if !spanOK {
+			r.spanID = randomOTLPID(8)
+		}
+	}
+
+	return r
+}
+
+// export sends the records with an Export request of the logs or trace service.
+func (o *OTLPPump) export(ctx context.Context, records []otlpRecord) error {
+	if o.conf.Protocol == OTLPProtocolGRPC {
+		method := otlpLogsMethod
+		if o.conf.Signal == OTLPSignalSpanEvents {
+			method = otlpTracesMethod
+		}
+
+		pairs := make([]string, 0, 2*len(o.conf.Headers))
+		for key, value := range o.conf.Headers {
+			pairs = append(pairs, strings.ToLower(key), value)
+		}
+
+		request := o.protobufRequest(records)
+		var response []byte
+		err := o.conn.Invoke(metadata.AppendToOutgoingContext(ctx, pairs...), method, &request, &response,
+			grpc.ForceCodec(otlpRawCodec{}))
+		if err != nil {
+			return errors.Wrap(err, "failed to export records to the otlp receiver")
+		}
+		addWrittenBytes(ctx, len(request))
+		o.checkPartialSuccess(len(records), response, false)
+
+		return nil
+	}
+
+	body, contentType := o.protobufRequest(records), "application/x-protobuf"
+	if o.conf.Protocol == OTLPProtocolJSON {
+		var err error
+		if body, err = json.Marshal(o.jsonRequest(records)); err != nil {
+			return errors.Wrap(err, "failed to encode otlp records")
+		}
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.conf.Endpoint+o.path(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create otlp request")
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	o.conf.setHeaders(req.Header)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to export records to the otel collector")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("otel collector", resp); err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, len(body))
+
+	response, _ := ioutil.ReadAll(resp.Body)
+	o.checkPartialSuccess(len(records), response, o.conf.Protocol == OTLPProtocolJSON)
+
+	return nil
+}
+
+// checkPartialSuccess logs the records the collector rejected, reported in the partial_success of
+// the response:
+//
+//	message ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	message ExportLogsPartialSuccess  { int64 rejected_log_records = 1; string error_message = 2; }
+func (o *OTLPPump) checkPartialSuccess(records int, response []byte, isJSON bool) {
+	var (
+		rejected int64
+		message  string
+	)
+	if isJSON {
+		var result struct {
+			PartialSuccess map[string]interface{} `json:"partialSuccess"`
+		}
+		_ = json.Unmarshal(response, &result)
+		for key, value := range result.PartialSuccess {
+			if key == "errorMessage" {
+				message = fmt.Sprint(value)
+			} else if strings.HasPrefix(key, "rejected") {
+				// the int64 values are encoded as strings
+				rejected, _ = strconv.ParseInt(fmt.Sprint(value), 10, 64)
+			}
+		}
+	} else if partial := otlpField(response, 1); partial != nil {
+		message = string(otlpField(partial, 2))
+		for len(partial) > 0 {
+			num, typ, n := protowire.ConsumeTag(partial)
+			if n < 0 {
+				break
+			}
+			partial = partial[n:]
+			if num == 1 && typ == protowire.VarintType {
+				v, _ := protowire.ConsumeVarint(partial)
+				rejected = int64(v)
+
+				break
+			}
+			if n = protowire.ConsumeFieldValue(num, typ, partial); n < 0 {
+				break
+			}
+			partial = partial[n:]
+		}
+	}
+
+	if rejected > 0 || message != "" {
+		log.Errorf("The otel collector rejected %d of %d records: %s", rejected, records, message)
+	}
+}
+
+// otlpField returns the first length delimited field num of the message, nil when absent.
+func otlpField(message []byte, num protowire.Number) []byte {
+	for len(message) > 0 {
+		n, typ, m := protowire.ConsumeTag(message)
+		if m < 0 {
+			return nil
+		}
+		message = message[m:]
+
+		if n == num && typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(message)
+
+			return v
+		}
+
+		if m = protowire.ConsumeFieldValue(n, typ, message); m < 0 {
+			return nil
+		}
+		message = message[m:]
+	}
+
+	return nil
+}
+
+// jsonRequest builds the request in the OTLP/JSON encoding.
+func (o *OTLPPump) jsonRequest(records []otlpRecord) map[string]interface{} {
+	resource := map[string]interface{}{
+		"attributes": []interface{}{otlpAttribute("service.name", o.conf.ServiceName)},
+	}
+	scope := otlpScope()
+
+	items := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		timestamp := strconv.FormatInt(record.time.UnixNano(), 10)
+		attributes := make([]interface{}, 0, len(record.attributes))
+		for _, kv := range record.attributes {
+			attributes = append(attributes, otlpAttribute(kv.key, kv.value))
+		}
+
+		if o.conf.Signal == OTLPSignalSpanEvents {
+			items = append(items, map[string]interface{}{
+				"traceId":           record.traceID,
+				"spanId":            record.spanID,
+				"name":              o.conf.SpanName,
+				"kind":              otlpSpanKindServer,
+				"startTimeUnixNano": timestamp,
+				"endTimeUnixNano":   timestamp,
+				"events": []interface{}{map[string]interface{}{
+					"timeUnixNano": timestamp,
+					"name":         otlpEventName,
+					"attributes":   append(attributes, otlpAttribute("iam.record", record.body)),
+				}},
+			})
+
+			continue
+		}
+
+		item := map[string]interface{}{
+			"timeUnixNano":         timestamp,
+			"observedTimeUnixNano": strconv.FormatInt(time.Now().UnixNano(), 10),
+			"severityNumber":       record.severity,
+			"severityText":         otlpSeverityText(record.severity),
+			"body":                 map[string]interface{}{"stringValue": record.body},
+			"attributes":           attributes,
+		}
+		if record.traceID != "" {
+			item["traceId"] = record.traceID
+		}
+		if record.spanID != "" {
+			item["spanId"] = record.spanID
+		}
+		items = append(items, item)
+	}
+
+	if o.conf.Signal == OTLPSignalSpanEvents {
+		return map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   resource,
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": scope, "spans": items}},
+		}}}
+	}
+
+	return map[string]interface{}{"resourceLogs": []interface{}{map[string]interface{}{
+		"resource":  resource,
+		"scopeLogs": []interface{}{map[string]interface{}{"scope": scope, "logRecords": items}},
+	}}}
+}
+
+func otlpSeverityText(severity int) string {
+	if severity == otlpSeverityWarn {
+		return "WARN"
+	}
+
+	return "INFO"
+}
+
+// protobufRequest builds the request in the OTLP protobuf encoding:
+//
+//	message ExportLogsServiceRequest  { repeated ResourceLogs resource_logs = 1; }
+//	message ResourceLogs              { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	message ScopeLogs                 { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	message LogRecord                 { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//	                                    string severity_text = 3; AnyValue body = 5;
+//	                                    repeated KeyValue attributes = 6; bytes trace_id = 9;
+//	                                    bytes span_id = 10; fixed64 observed_time_unix_nano = 11; }
+//	message ExportTraceServiceRequest { repeated ResourceSpans resource_spans = 1; }
+//	message ResourceSpans             { Resource resource = 1; repeated ScopeSpans scope_spans = 2; }
+//	message ScopeSpans                { InstrumentationScope scope = 1; repeated Span spans = 2; }
+//	message Span                      { bytes trace_id = 1; bytes span_id = 2; string name = 5;
+//	                                    SpanKind kind = 6; fixed64 start_time_unix_nano = 7;
+//	                                    fixed64 end_time_unix_nano = 8; repeated Event events = 11; }
+//	message Event                     { fixed64 time_unix_nano = 1; string name = 2;
+//	                                    repeated KeyValue attributes = 3; }
+func (o *OTLPPump) protobufRequest(records []otlpRecord) []byte {
+	scope := appendMessage(nil, 1, encodeOTLPScope())
+
+	observed := uint64(time.Now().UnixNano())
+	for _, record := range records {
+		timestamp := uint64(record.time.UnixNano())
+		traceID, _ := hex.DecodeString(record.traceID)
+		spanID, _ := hex.DecodeString(record.spanID)
+
+		var attributes [][]byte
+		for _, kv := range record.attributes {
+			attributes = append(attributes, encodeOTLPKeyValue(kv.key, kv.value))
+		}
+
+		var item []byte
+		if o.conf.Signal == OTLPSignalSpanEvents {
+			var event []byte
+			event = protowire.AppendTag(event, 1, protowire.Fixed64Type)
+			event = protowire.AppendFixed64(event, timestamp)
+			event = protowire.AppendTag(event, 2, protowire.BytesType)
+			event = protowire.AppendString(event, otlpEventName)
+			for _, attribute := range attributes {
+				event = appendMessage(event, 3, attribute)
+			}
+			event = appendMessage(event, 3, encodeOTLPKeyValue("iam.record", record.body))
+
+			item = appendMessage(item, 1, traceID)
+			item = appendMessage(item, 2, spanID)
+			item = protowire.AppendTag(item, 5, protowire.BytesType)
+			item = protowire.AppendString(item, o.conf.SpanName)
+			item = protowire.AppendTag(item, 6, protowire.VarintType)
+			item = protowire.AppendVarint(item, otlpSpanKindServer)
+			item = protowire.AppendTag(item, 7, protowire.Fixed64Type)
+			item = protowire.AppendFixed64(item, timestamp)
+			item = protowire.AppendTag(item, 8, protowire.Fixed64Type)
+			item = protowire.AppendFixed64(item, timestamp)
+			item = appendMessage(item, 11, event)
+		} else {
+			item = protowire.AppendTag(item, 1, protowire.Fixed64Type)
+			item = protowire.AppendFixed64(item, timestamp)
+			item = protowire.AppendTag(item, 2, protowire.VarintType)
+			item = protowire.AppendVarint(item, uint64(record.severity))
+			item = protowire.AppendTag(item, 3, protowire.BytesType)
+			item = protowire.AppendString(item, otlpSeverityText(record.severity))
+			item = appendMessage(item, 5, encodeOTLPAnyValue(record.body))
+			for _, attribute := range attributes {
+				item = appendMessage(item, 6, attribute)
+			}
+			if len(traceID) > 0 {
+				item = appendMessage(item, 9, traceID)
+			}
+			if len(spanID) > 0 {
+				item = appendMessage(item, 10, spanID)
+			}
+			item = protowire.AppendTag(item, 11, protowire.Fixed64Type)
+			item = protowire.AppendFixed64(item, observed)
+		}
+
+		scope = appendMessage(scope, 2, item)
+	}
+
+	resource := appendMessage(nil, 1, encodeOTLPKeyValue("service.name", o.conf.ServiceName))
+
+	var resourceItems []byte
+	resourceItems = appendMessage(resourceItems, 1, resource)
+	resourceItems = appendMessage(resourceItems, 2, scope)
+
+	return appendMessage(nil, 1, resourceItems)
+}
+
+// Shutdown closes the grpc connection to the otlp receiver.
+func (o *OTLPPump) Shutdown() error {
+	if o.conn == nil {
+		return nil
+	}
+
+	return errors.Wrap(o.conn.Close(), "failed to close otlp connection")
+}
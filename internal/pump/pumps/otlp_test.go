@@ -0,0 +1,164 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// otlpLogRecord returns the first log record of an ExportLogsServiceRequest.
+func otlpLogRecord(request []byte) []byte {
+	return otlpField(otlpField(otlpField(request, 1), 2), 2)
+}
+
+func TestOTLPPumpProtobuf(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	pmp := (&OTLPPump{}).New()
+	if err := pmp.Init(map[string]interface{}{"endpoint": server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "deny"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	logRecord := otlpLogRecord(body)
+	if severity := otlpField(logRecord, 3); string(severity) != "WARN" {
+		t.Fatalf("unexpected severity %q", severity)
+	}
+	if message := otlpField(otlpField(logRecord, 5), 1); !strings.Contains(string(message), `"username":"colin"`) {
+		t.Fatalf("unexpected body %q", message)
+	}
+	if !strings.Contains(string(logRecord), "iam.username") {
+		t.Fatal("the record fields should be attributes of the log record")
+	}
+}
+
+func TestOTLPPumpSpanEvents(t *testing.T) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					Name    string `json:"name"`
+					Events  []struct {
+						Name       string `json:"name"`
+						Attributes []struct {
+							Key string `json:"key"`
+						} `json:"attributes"`
+					} `json:"events"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		_, _ = w.Write([]byte(`{"partialSuccess":{}}`))
+	}))
+	defer server.Close()
+
+	pmp := (&OTLPPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"endpoint":       server.URL,
+		"protocol":       "http/json",
+		"signal":         "span_events",
+		"trace_id_field": "trace",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceID := "0123456789abcdef0123456789abcdef"
+	data := []interface{}{analytics.AnalyticsRecord{
+		TimeStamp: 1600000000, Username: "colin", Effect: "allow",
+		Extra: map[string]interface{}{"trace": traceID},
+	}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != traceID || span.Name != "authorize" || span.Events[0].Name != otlpEventName {
+		t.Fatalf("unexpected span %+v", span)
+	}
+}
+
+func TestOTLPPumpGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		method  string
+		request []byte
+		token   []string
+	)
+	server := grpc.NewServer(grpc.ForceServerCodec(otlpRawCodec{}),
+		grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+			method, _ = grpc.MethodFromServerStream(stream)
+			md, _ := metadata.FromIncomingContext(stream.Context())
+			token = md.Get("authorization")
+			if err := stream.RecvMsg(&request); err != nil {
+				return err
+			}
+
+			// a partial success rejecting one record
+			partial := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1)
+			response := appendMessage(nil, 1, partial)
+
+			return stream.SendMsg(&response)
+		}))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	pmp := (&OTLPPump{}).New()
+	err = pmp.Init(map[string]interface{}{
+		"endpoint": listener.Addr().String(),
+		"protocol": "grpc",
+		"headers":  map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "allow"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != otlpLogsMethod || len(token) != 1 || token[0] != "Bearer token" {
+		t.Fatalf("unexpected call %s with %v", method, token)
+	}
+	if severity := otlpField(otlpLogRecord(request), 3); string(severity) != "INFO" {
+		t.Fatalf("unexpected severity %q", severity)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpScopeName is the name of the instrumentation scope of the OTLP exports.
+const otlpScopeName = "iam-pump"
+
+// otlpScope returns the instrumentation scope of the OTLP exports, in the OTLP/JSON encoding.
+func otlpScope() map[string]string {
+	return map[string]string{"name": otlpScopeName}
+}
+
+// otlpAttribute encodes an attribute as an OTLP KeyValue, in the OTLP/JSON encoding.
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+// encodeOTLPScope encodes the instrumentation scope of the OTLP exports:
+//
+//	message InstrumentationScope { string name = 1; }
+func encodeOTLPScope() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+
+	return protowire.AppendString(b, otlpScopeName)
+}
+
+// encodeOTLPKeyValue encodes an attribute as an OTLP KeyValue:
+//
+//	message KeyValue { string key = 1; AnyValue value = 2; }
+func encodeOTLPKeyValue(key string, value interface{}) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+
+	return appendMessage(b, 2, encodeOTLPAnyValue(value))
+}
+
+// encodeOTLPAnyValue encodes the value as an OTLP AnyValue:
+//
+//	message AnyValue { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+//	                   double double_value = 4; }
+func encodeOTLPAnyValue(value interface{}) []byte {
+	var b []byte
+	switch value := value.(type) {
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(value))
+	case int:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(value))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(value))
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(value))
+	default:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, fmt.Sprint(value))
+	}
+
+	return b
+}
+
+// appendMessage appends the length delimited field num holding b.
+func appendMessage(dst []byte, num protowire.Number, b []byte) []byte {
+	dst = protowire.AppendTag(dst, num, protowire.BytesType)
+
+	return protowire.AppendBytes(dst, b)
+}
@@ -0,0 +1,566 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// Defines the parquet format values used by the encoder, see parquet.thrift.
+const (
+	parquetMagic = "PAR1"
+
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetGzip = 2
+
+	parquetDataPage = 0
+)
+
+// Defines the thrift compact protocol types of the fields of the parquet metadata.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftStruct = 12
+)
+
+// parquetColumn is a column of the parquet files of analytics records, all the columns are
+// required so that no definition nor repetition levels are encoded.
+type parquetColumn struct {
+	name          string
+	typ           int32
+	convertedType int32
+	int64Value    func(record *analytics.AnalyticsRecord) int64
+	stringValue   func(record *analytics.AnalyticsRecord) string
+	// setInt64 and setString set the decoded value of the column on the record.
+	setInt64  func(record *analytics.AnalyticsRecord, value int64)
+	setString func(record *analytics.AnalyticsRecord, value string) error
+}
+
+// parquetColumns are the columns of the analytics records, the extra fields are encoded as a json
+// object, empty when the record has none.
+var parquetColumns = []parquetColumn{
+	{name: "timestamp", typ: parquetInt64, convertedType: -1,
+		int64Value: func(r *analytics.AnalyticsRecord) int64 { return r.TimeStamp },
+		setInt64:   func(r *analytics.AnalyticsRecord, v int64) { r.TimeStamp = v }},
+	{name: "username", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Username },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Username = v; return nil }},
+	{name: "effect", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Effect },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Effect = v; return nil }},
+	{name: "conclusion", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Conclusion },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Conclusion = v; return nil }},
+	{name: "request", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Request },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Request = v; return nil }},
+	{name: "policies", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Policies },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Policies = v; return nil }},
+	{name: "deciders", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string { return r.Deciders },
+		setString:   func(r *analytics.AnalyticsRecord, v string) error { r.Deciders = v; return nil }},
+	{name: "expireAt", typ: parquetInt64, convertedType: parquetTimestampMillis,
+		int64Value: func(r *analytics.AnalyticsRecord) int64 {
+			if r.ExpireAt.IsZero() {
+				return 0
+			}
+
+			return r.ExpireAt.UnixNano() / 1e6
+		},
+		setInt64: func(r *analytics.AnalyticsRecord, v int64) {
+			if v != 0 {
+				r.ExpireAt = time.Unix(0, v*1e6)
+			}
+		}},
+	{name: "extra", typ: parquetByteArray, convertedType: parquetUTF8,
+		stringValue: func(r *analytics.AnalyticsRecord) string {
+			if len(r.Extra) == 0 {
+				return ""
+			}
+			b, _ := json.Marshal(r.Extra)
+
+			return string(b)
+		},
+		setString: func(r *analytics.AnalyticsRecord, v string) error {
+			if v == "" {
+				return nil
+			}
+
+			return json.Unmarshal([]byte(v), &r.Extra)
+		}},
+}
+
+// parquetChunk is the location of a column chunk written in the file.
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// encodeParquet encodes the records as a parquet file of a single row group, each column chunk
+// being a single gzip compressed page of plain encoded values.
+func encodeParquet(records []analytics.AnalyticsRecord) ([]byte, error) {
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+
+	chunks := make([]parquetChunk, len(parquetColumns))
+	for i, column := range parquetColumns {
+		var values bytes.Buffer
+		for j := range records {
+			if column.typ == parquetInt64 {
+				_ = binary.Write(&values, binary.LittleEndian, column.int64Value(&records[j]))
+
+				continue
+			}
+
+			value := column.stringValue(&records[j])
+			_ = binary.Write(&values, binary.LittleEndian, uint32(len(value)))
+			values.WriteString(value)
+		}
+
+		compressed, err := gzipPayload(values.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		header := &thriftWriter{}
+		header.structBegin()
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(values.Len()))
+		header.i32Field(3, int32(len(compressed)))
+		header.structField(5)
+		header.i32Field(1, int32(len(records)))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.structEnd()
+		header.structEnd()
+
+		chunks[i] = parquetChunk{
+			offset:           int64(file.Len()),
+			uncompressedSize: int64(header.buf.Len() + values.Len()),
+			compressedSize:   int64(header.buf.Len() + len(compressed)),
+		}
+		file.Write(header.buf.Bytes())
+		file.Write(compressed)
+	}
+
+	footer := parquetFooter(len(records), chunks)
+	file.Write(footer)
+	_ = binary.Write(&file, binary.LittleEndian, uint32(len(footer)))
+	file.WriteString(parquetMagic)
+
+	return file.Bytes(), nil
+}
+
+// parquetFooter returns the file metadata of the file with the given column chunks.
+func parquetFooter(rows int, chunks []parquetChunk) []byte {
+	w := &thriftWriter{}
+	w.structBegin()
+	w.i32Field(1, 1)
+
+	w.listField(2, thriftStruct, len(parquetColumns)+1)
+	w.structBegin()
+	w.binaryField(4, "schema")
+	w.i32Field(5, int32(len(parquetColumns)))
+	w.structEnd()
+	for _, column := range parquetColumns {
+		w.structBegin()
+		w.i32Field(1, column.typ)
+		w.i32Field(3, parquetRequired)
+		w.binaryField(4, column.name)
+		if column.convertedType >= 0 {
+			w.i32Field(6, column.convertedType)
+		}
+		w.structEnd()
+	}
+
+	w.i64Field(3, int64(rows))
+
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.uncompressedSize
+	}
+
+	w.listField(4, thriftStruct, 1)
+	w.structBegin()
+	w.listField(1, thriftStruct, len(chunks))
+	for i, chunk := range chunks {
+		w.structBegin()
+		w.i64Field(2, chunk.offset)
+		w.structField(3)
+		w.i32Field(1, parquetColumns[i].typ)
+		w.listField(2, thriftI32, 2)
+		w.varint(parquetPlain)
+		w.varint(parquetRLE)
+		w.listField(3, thriftBinary, 1)
+		w.binary(parquetColumns[i].name)
+		w.i32Field(4, parquetGzip)
+		w.i64Field(5, int64(rows))
+		w.i64Field(6, chunk.uncompressedSize)
+		w.i64Field(7, chunk.compressedSize)
+		w.i64Field(9, chunk.offset)
+		w.structEnd()
+		w.structEnd()
+	}
+	w.i64Field(2, totalSize)
+	w.i64Field(3, int64(rows))
+	w.structEnd()
+
+	w.binaryField(6, "iam-pump")
+	w.structEnd()
+
+	return w.buf.Bytes()
+}
+
+// thriftWriter encodes structs with the thrift compact protocol, the encoding of the parquet
+// metadata. The field ids are delta encoded against the previous field of the same struct.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func (w *thriftWriter) structBegin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint writes a zigzag encoded integer.
+func (w *thriftWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (w *thriftWriter) binary(s string) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], uint64(len(s)))])
+	w.buf.WriteString(s)
+}
+
+func (w *thriftWriter) i32Field(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64Field(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binaryField(id int16, s string) {
+	w.fieldHeader(id, thriftBinary)
+	w.binary(s)
+}
+
+// structField begins a struct field, it is ended by structEnd.
+func (w *thriftWriter) structField(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.structBegin()
+}
+
+// listField begins a list field of size elements, the elements are written next.
+func (w *thriftWriter) listField(id int16, elemType byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size)<<4 | elemType)
+
+		return
+	}
+
+	w.buf.WriteByte(0xf0 | elemType)
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], uint64(size))])
+}
+
+// DecodeParquet decodes the records of a parquet file written by the s3 pump: required columns of
+// plain encoded values, in gzip compressed or uncompressed data pages. The columns which are not
+// record fields are skipped.
+func DecodeParquet(file []byte) ([]analytics.AnalyticsRecord, error) {
+	if len(file) < 12 || string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		return nil, errors.New("not a parquet file")
+	}
+
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if footerSize > len(file)-12 {
+		return nil, errors.New("invalid parquet footer size")
+	}
+	metadata, err := (&thriftReader{buf: file[len(file)-8-footerSize : len(file)-8]}).readStruct()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid parquet metadata")
+	}
+
+	rows, _ := metadata[3].(int64)
+	records := make([]analytics.AnalyticsRecord, rows)
+	rowGroups, _ := metadata[4].([]interface{})
+	start := 0
+	for _, value := range rowGroups {
+		rowGroup, _ := value.(thriftFields)
+		groupRows, _ := rowGroup[3].(int64)
+		if start+int(groupRows) > len(records) {
+			return nil, errors.New("invalid parquet row group size")
+		}
+
+		columns, _ := rowGroup[1].([]interface{})
+		for _, chunk := range columns {
+			chunk, _ := chunk.(thriftFields)
+			meta, _ := chunk[3].(thriftFields)
+			if err := decodeParquetChunk(file, meta, records[start:start+int(groupRows)]); err != nil {
+				return nil, err
+			}
+		}
+		start += int(groupRows)
+	}
+
+	return records, nil
+}
+
+// decodeParquetChunk decodes the values of the column chunk into the records.
+func decodeParquetChunk(file []byte, meta thriftFields, records []analytics.AnalyticsRecord) error {
+	path, _ := meta[3].([]interface{})
+	if len(path) != 1 {
+		return errors.New("invalid parquet column path")
+	}
+	name, _ := path[0].(string)
+
+	var column *parquetColumn
+	for i := range parquetColumns {
+		if parquetColumns[i].name == name {
+			column = &parquetColumns[i]
+		}
+	}
+	if column == nil {
+		return nil
+	}
+
+	typ, _ := meta[1].(int64)
+	codec, _ := meta[4].(int64)
+	offset, _ := meta[9].(int64)
+	if int32(typ) != column.typ || (codec != parquetGzip && codec != 0) {
+		return errors.Errorf("unsupported type or codec of parquet column %s", name)
+	}
+
+	row := 0
+	for row < len(records) {
+		if offset < 0 || offset >= int64(len(file)) {
+			return errors.Errorf("invalid page offset of parquet column %s", name)
+		}
+
+		reader := &thriftReader{buf: file[offset:]}
+		header, err := reader.readStruct()
+		if err != nil {
+			return errors.Wrapf(err, "invalid page header of parquet column %s", name)
+		}
+		size, _ := header[3].(int64)
+		dataHeader, _ := header[5].(thriftFields)
+		values, _ := dataHeader[1].(int64)
+		encoding, _ := dataHeader[2].(int64)
+		if pageType, _ := header[1].(int64); pageType != parquetDataPage || encoding != parquetPlain ||
+			size < 0 || int64(reader.pos)+size > int64(len(file[offset:])) || row+int(values) > len(records) {
+			return errors.Errorf("unsupported page of parquet column %s", name)
+		}
+
+		page := file[offset+int64(reader.pos) : offset+int64(reader.pos)+size]
+		if codec == parquetGzip {
+			zr, err := gzip.NewReader(bytes.NewReader(page))
+			if err != nil {
+				return errors.Wrapf(err, "invalid page of parquet column %s", name)
+			}
+			if page, err = ioutil.ReadAll(zr); err != nil {
+				return errors.Wrapf(err, "invalid page of parquet column %s", name)
+			}
+		}
+
+		if err := column.decode(page, records[row:row+int(values)]); err != nil {
+			return errors.Wrapf(err, "invalid values of parquet column %s", name)
+		}
+		row += int(values)
+		offset += int64(reader.pos) + size
+	}
+
+	return nil
+}
+
+// decode sets the plain encoded values of the page on the records.
+func (c *parquetColumn) decode(page []byte, records []analytics.AnalyticsRecord) error {
+	for i := range records {
+		if c.typ == parquetInt64 {
+			if len(page) < 8 {
+				return errors.New("truncated values")
+			}
+			c.setInt64(&records[i], int64(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+
+			continue
+		}
+
+		if len(page) < 4 || int(binary.LittleEndian.Uint32(page)) > len(page)-4 {
+			return errors.New("truncated values")
+		}
+		size := int(binary.LittleEndian.Uint32(page))
+		if err := c.setString(&records[i], string(page[4:4+size])); err != nil {
+			return err
+		}
+		page = page[4+size:]
+	}
+
+	return nil
+}
+
+// thriftFields is a struct decoded from the thrift compact protocol, by field id.
+type thriftFields map[int16]interface{}
+
+// thriftReader decodes the structs of the parquet metadata encoded with the thrift compact protocol.
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) readStruct() (thriftFields, error) {
+	fields := make(thriftFields)
+	var last int16
+	for {
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+
+		if fields[id], err = r.value(header & 0x0f); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *thriftReader) value(typ byte) (interface{}, error) {
+	switch typ {
+	case thriftTrue:
+		return true, nil
+	case thriftFalse:
+		return false, nil
+	case thriftByte:
+		b, err := r.byte()
+
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return r.varint()
+	case thriftDouble:
+		if len(r.buf)-r.pos < 8 {
+			return nil, errors.New("truncated thrift double")
+		}
+		r.pos += 8
+
+		return nil, nil
+	case thriftBinary:
+		size, n := binary.Uvarint(r.buf[r.pos:])
+		if n <= 0 || size > uint64(len(r.buf)-r.pos-n) {
+			return nil, errors.New("truncated thrift binary")
+		}
+		r.pos += n
+		value := string(r.buf[r.pos : r.pos+int(size)])
+		r.pos += int(size)
+
+		return value, nil
+	case thriftList, thriftSet:
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			var n int
+			if size, n = binary.Uvarint(r.buf[r.pos:]); n <= 0 || size > uint64(len(r.buf)-r.pos) {
+				return nil, errors.New("truncated thrift list")
+			}
+			r.pos += n
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = r.value(header & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	case thriftStruct:
+		return r.readStruct()
+	default:
+		return nil, errors.Errorf("unsupported thrift type %d", typ)
+	}
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errors.New("truncated thrift struct")
+	}
+	r.pos++
+
+	return r.buf[r.pos-1], nil
+}
+
+// varint reads a zigzag encoded integer.
+func (r *thriftReader) varint() (int64, error) {
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errors.New("truncated thrift integer")
+	}
+	r.pos += n
+
+	return v, nil
+}
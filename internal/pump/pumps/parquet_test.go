@@ -0,0 +1,105 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestEncodeParquet(t *testing.T) {
+	records := []analytics.AnalyticsRecord{
+		{TimeStamp: 1600000000, Username: "colin", Effect: "allow"},
+		{TimeStamp: 1600000001, Username: "admin", Effect: "deny", Extra: map[string]interface{}{"region": "eu"}},
+	}
+
+	file, err := encodeParquet(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		t.Fatal("the file should start and end with the parquet magic")
+	}
+
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerSize : len(file)-8]
+	metadata, err := (&thriftReader{buf: footer}).readStruct()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata[3] != int64(2) {
+		t.Fatalf("unexpected number of rows %v", metadata[3])
+	}
+
+	schema, _ := metadata[2].([]interface{})
+	if len(schema) != len(parquetColumns)+1 || schema[2].(thriftFields)[4] != "username" {
+		t.Fatalf("unexpected schema %v", schema)
+	}
+
+	rowGroup := metadata[4].([]interface{})[0].(thriftFields)
+	columns := rowGroup[1].([]interface{})
+	username := columns[1].(thriftFields)[3].(thriftFields)
+	if path := username[3].([]interface{}); path[0] != "username" || username[4] != int64(parquetGzip) {
+		t.Fatalf("unexpected column metadata %v", username)
+	}
+
+	// the page of the column follows its header
+	page := &thriftReader{buf: file[username[9].(int64):]}
+	header, err := page.readStruct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := page.buf[page.pos : page.pos+int(header[3].(int64))]
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := ioutil.ReadAll(zr)
+	want := []byte("\x05\x00\x00\x00colin\x05\x00\x00\x00admin")
+	if !bytes.Equal(values, want) || header[2] != int64(len(want)) {
+		t.Fatalf("unexpected page values %q", values)
+	}
+}
+
+func TestDecodeParquet(t *testing.T) {
+	records := []analytics.AnalyticsRecord{
+		{TimeStamp: 1600000000, Username: "colin", Effect: "allow", Policies: "[]"},
+		{
+			TimeStamp: 1600000001, Username: "admin", Effect: "deny",
+			ExpireAt: time.Unix(1700000000, 0), Extra: map[string]interface{}{"region": "eu"},
+		},
+	}
+
+	file, err := encodeParquet(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeParquet(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded[1].ExpireAt.Equal(records[1].ExpireAt) {
+		t.Fatalf("unexpected expire time %v", decoded[1].ExpireAt)
+	}
+	decoded[1].ExpireAt = records[1].ExpireAt
+	if !reflect.DeepEqual(decoded, records) {
+		t.Fatalf("unexpected records %+v", decoded)
+	}
+
+	if _, err := DecodeParquet(file[:len(file)-1]); err == nil {
+		t.Fatal("a truncated file should be rejected")
+	}
+}
@@ -31,6 +31,8 @@ type PrometheusPump struct {
 type PrometheusConf struct {
 	Addr string `mapstructure:"listen_address"`
 	Path string `mapstructure:"path"`
+	// SampleRateField is the field of the sample rate of the records, see DefaultSampleRateField.
+	SampleRateField string `mapstructure:"sample_rate_field"`
 }
 
 // New create a prometheus pump instance.
@@ -62,6 +64,10 @@ func (p *PrometheusPump) Init(conf interface{}) error {
 		log.Fatalf("Failed to decode configuration: %s", err.Error())
 	}
 
+	if p.conf.SampleRateField == "" {
+		p.conf.SampleRateField = DefaultSampleRateField
+	}
+
 	if p.conf.Path == "" {
 		p.conf.Path = "/metrics"
 	}
@@ -92,7 +98,7 @@ func (p *PrometheusPump) WriteData(ctx context.Context, data []interface{}) erro
 			code = "1"
 		}
 
-		p.TotalStatusMetrics.WithLabelValues(code, record.Username).Inc()
+		p.TotalStatusMetrics.WithLabelValues(code, record.Username).Add(sampleWeight(&record, p.conf.SampleRateField, p.GetCountField()))
 	}
 
 	return nil
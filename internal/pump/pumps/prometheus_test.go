@@ -0,0 +1,48 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestPrometheusPumpSampleRate(t *testing.T) {
+	pmp, _ := (&PrometheusPump{}).New().(*PrometheusPump)
+	if err := pmp.Init(map[string]interface{}{
+		"listen_address": "127.0.0.1:0",
+		"path":           "/prometheus-pump-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sampled := analytics.AnalyticsRecord{Username: "sampled", Effect: "allow"}
+	sampled.SetExtra(DefaultSampleRateField, 4.0)
+	if err := pmp.WriteData(context.Background(), []interface{}{
+		sampled,
+		analytics.AnalyticsRecord{Username: "sampled", Effect: "allow"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := testutil.ToFloat64(pmp.TotalStatusMetrics.WithLabelValues("0", "sampled")); count != 5 {
+		t.Fatalf("a sampled record should count as its sample rate, got %v", count)
+	}
+
+	// a sampled record coalesced from 3 records stands for 12 records
+	pmp.SetCountField("count")
+	sampled.SetExtra("count", int64(3))
+	if err := pmp.WriteData(context.Background(), []interface{}{sampled}); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := testutil.ToFloat64(pmp.TotalStatusMetrics.WithLabelValues("0", "sampled")); count != 17 {
+		t.Fatalf("a coalesced record should count as its records, got %v", count)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// encodeProtobuf encodes the record with the AnalyticsRecord message of analytics/analytics.proto.
+// The extra fields which are not strings are written formatted.
+func encodeProtobuf(record *analytics.AnalyticsRecord) []byte {
+	var b []byte
+	if record.TimeStamp != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(record.TimeStamp))
+	}
+
+	for i, value := range []string{
+		record.Username, record.Effect, record.Conclusion, record.Request, record.Policies, record.Deciders,
+	} {
+		if value != "" {
+			b = protowire.AppendTag(b, protowire.Number(i+2), protowire.BytesType)
+			b = protowire.AppendString(b, value)
+		}
+	}
+
+	if !record.ExpireAt.IsZero() {
+		var timestamp []byte
+		timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+		timestamp = protowire.AppendVarint(timestamp, uint64(record.ExpireAt.Unix()))
+		timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+		timestamp = protowire.AppendVarint(timestamp, uint64(record.ExpireAt.Nanosecond()))
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, timestamp)
+	}
+
+	names := make([]string, 0, len(record.Extra))
+	for name := range record.Extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := record.Extra[name].(string)
+		if !ok {
+			value = fmt.Sprint(record.Extra[name])
+		}
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, value)
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b
+}
@@ -16,6 +16,8 @@ type Pump interface {
 	GetName() string
 	New() Pump
 	Init(interface{}) error
+	// WriteData must return once the context is done. A write which outlives its timeout is
+	// abandoned and the pump is skipped until it returns.
 	WriteData(context.Context, []interface{}) error
 	SetFilters(analytics.AnalyticsFilters)
 	GetFilters() analytics.AnalyticsFilters
@@ -23,6 +25,46 @@ type Pump interface {
 	GetTimeout() int
 	SetOmitDetailedRecording(bool)
 	GetOmitDetailedRecording() bool
+	Shutdown() error
+}
+
+// RawRecordsPump is implemented by pumps which can write the original payload read from the analytics
+// storage instead of re-serializing the decoded record, e.g. lossless archives. When at least one pump
+// wants raw records, the decoded records carry their original payload in AnalyticsRecord.Raw.
+// The payload is untouched, the pipeline transformations only apply to the decoded fields, so the
+// pumps writing it can not scrub or omit fields.
+type RawRecordsPump interface {
+	Pump
+	WantsRawRecords() bool
+}
+
+// ExpiringPump is implemented by pumps whose back-end deletes each record once its ExpireAt is
+// reached, e.g. through a TTL index. The expiry of the records is computed from the retention
+// configured for the pump.
+type ExpiringPump interface {
+	Pump
+	ExpiresRecords() bool
+}
+
+// FormattedPump is implemented by the pumps writing the records as documents, which can write
+// them in another format than their json field names, e.g. the Elastic Common Schema.
+type FormattedPump interface {
+	Pump
+	SetFormat(format string)
+}
+
+// FieldPrecedencePump is implemented by the pumps resolving the document fields set by several
+// sources, the record, the pipeline, the pump metadata and the format, with a precedence.
+type FieldPrecedencePump interface {
+	Pump
+	SetFieldPrecedence(precedence []string)
+}
+
+// CountingPump is implemented by the pumps counting the records, which weigh the coalesced
+// records by the number of records they were coalesced from, annotated in the count field.
+type CountingPump interface {
+	Pump
+	SetCountField(field string)
 }
 
 // GetPumpByName returns the pump instance by given name.
@@ -0,0 +1,135 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/ory/ladon"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// PushgatewayPump defines a pump which pushes the authorization metrics to a prometheus pushgateway
+// at the end of each purge cycle, for the pump executions which are not scraped.
+type PushgatewayPump struct {
+	conf     *PushgatewayConf
+	client   *http.Client
+	registry *prometheus.Registry
+
+	totalStatus *prometheus.CounterVec
+	lastPush    prometheus.Gauge
+
+	CommonPumpConfig
+}
+
+// PushgatewayConf defines pushgateway specific options.
+type PushgatewayConf struct {
+	URL      string            `mapstructure:"url"`
+	Job      string            `mapstructure:"job"`
+	Grouping map[string]string `mapstructure:"grouping"`
+	Username string            `mapstructure:"username"`
+	Password string            `mapstructure:"password"`
+	// Only the headers apply, the metrics are aggregated over the records.
+	HeadersConf `mapstructure:",squash"`
+}
+
+// ctxDoer sends the pushgateway requests with the context of the write and the configured headers.
+type ctxDoer struct {
+	ctx     context.Context
+	client  *http.Client
+	headers *HeadersConf
+}
+
+func (d ctxDoer) Do(req *http.Request) (*http.Response, error) {
+	d.headers.setHeaders(req.Header)
+
+	return d.client.Do(req.WithContext(d.ctx))
+}
+
+// New create a pushgateway pump instance.
+func (p *PushgatewayPump) New() Pump {
+	newPump := PushgatewayPump{}
+
+	return &newPump
+}
+
+// GetName returns the pushgateway pump name.
+func (p *PushgatewayPump) GetName() string {
+	return "Pushgateway Pump"
+}
+
+// Init initialize the pushgateway pump instance.
+func (p *PushgatewayPump) Init(config interface{}) error {
+	p.conf = &PushgatewayConf{}
+	if err := mapstructure.Decode(config, &p.conf); err != nil {
+		return errors.Wrap(err, "failed to decode pushgateway configuration")
+	}
+
+	if p.conf.URL == "" {
+		return errors.New("pushgateway url not set")
+	}
+
+	if p.conf.Job == "" {
+		p.conf.Job = "iam-pump"
+	}
+
+	// the metrics are kept in a registry of their own, which is pushed as a whole
+	p.registry = prometheus.NewRegistry()
+	p.totalStatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "iam_user_authorization_status_total",
+			Help: "authorization effect per user",
+		},
+		[]string{"code", "username"},
+	)
+	p.lastPush = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "iam_pump_last_push_timestamp_seconds",
+		Help: "Unix time of the last push of the authorization metrics.",
+	})
+	p.registry.MustRegister(p.totalStatus, p.lastPush)
+
+	p.client = &http.Client{}
+
+	log.Infof("Pushgateway pump pushes job %s to %s", p.conf.Job, p.conf.URL)
+
+	return nil
+}
+
+// WriteData aggregates the analytics data into the authorization metrics and pushes them to the pushgateway.
+func (p *PushgatewayPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	for _, item := range data {
+		record, _ := item.(analytics.AnalyticsRecord)
+		code := "0"
+		if record.Effect != ladon.AllowAccess {
+			code = "1"
+		}
+
+		p.totalStatus.WithLabelValues(code, record.Username).Inc()
+	}
+	p.lastPush.Set(float64(time.Now().Unix()))
+
+	pusher := push.New(p.conf.URL, p.conf.Job).
+		Gatherer(p.registry).
+		Client(ctxDoer{ctx: ctx, client: p.client, headers: &p.conf.HeadersConf})
+	for name, value := range p.conf.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	if p.conf.Username != "" {
+		pusher = pusher.BasicAuth(p.conf.Username, p.conf.Password)
+	}
+
+	return errors.Wrap(pusher.Push(), "failed to push to the pushgateway")
+}
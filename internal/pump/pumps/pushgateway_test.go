@@ -0,0 +1,49 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestPushgatewayPump(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pmp := (&PushgatewayPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"url":      server.URL,
+		"grouping": map[string]string{"instance": "pump-0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{Username: "colin", Effect: "allow"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/metrics/job/iam-pump/instance/pump-0" {
+		t.Fatalf("unexpected push path %s", path)
+	}
+
+	if !strings.Contains(body, "iam_user_authorization_status_total") {
+		t.Fatal("pushed metrics should contain the authorization status")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"net/http"
+
+	"github.com/marmotedu/errors"
+)
+
+// Defines the reasons the back-ends reject the records for.
+const (
+	// RejectionPayloadTooLarge is a request or record over the size the back-end accepts.
+	RejectionPayloadTooLarge = "payload-too-large"
+	// RejectionRateLimited is a request over the rate the back-end accepts, or the capacity it
+	// has left, e.g. an elasticsearch bulk item rejected on a full write queue.
+	RejectionRateLimited = "rate-limited"
+)
+
+// RejectionReporter accounts the records of the pump the back-end rejected for reason, err is the
+// rejection reported by the back-end.
+type RejectionReporter func(reason string, records int, err error)
+
+// RejectionReportingPump is implemented by the pumps reporting the rejections of their back-end
+// which do not fail the write, e.g. the items of the bulk requests sent in the background.
+type RejectionReportingPump interface {
+	Pump
+	SetRejectionReporter(reporter RejectionReporter)
+}
+
+// SetRejectionReporter set attributes `rejections` for CommonPumpConfig.
+func (p *CommonPumpConfig) SetRejectionReporter(reporter RejectionReporter) {
+	p.rejections = reporter
+}
+
+// reportRejection reports records rejected by the back-end for reason, if a reporter is set.
+func (p *CommonPumpConfig) reportRejection(reason string, records int, err error) {
+	if p.rejections != nil && records > 0 {
+		p.rejections(reason, records, err)
+	}
+}
+
+// RejectionReason returns the reason the back-end rejected the write failing with err, when it
+// rejected it for its size or rate.
+func RejectionReason(err error) (string, bool) {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return "", false
+	}
+
+	return statusRejectionReason(statusErr.StatusCode)
+}
+
+// statusRejectionReason returns the rejection reason of a http status.
+func statusRejectionReason(status int) (string, bool) {
+	switch status {
+	case http.StatusRequestEntityTooLarge:
+		return RejectionPayloadTooLarge, true
+	case http.StatusTooManyRequests:
+		return RejectionRateLimited, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/marmotedu/errors"
+	elastic "github.com/olivere/elastic/v7"
+)
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{errors.Wrap(&StatusError{StatusCode: http.StatusRequestEntityTooLarge}, "write failed"), RejectionPayloadTooLarge},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, RejectionRateLimited},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, ""},
+		{errors.New("connection reset"), ""},
+	}
+
+	for _, tt := range tests {
+		if reason, ok := RejectionReason(tt.err); reason != tt.reason || ok != (tt.reason != "") {
+			t.Errorf("RejectionReason(%v) = %q, want %q", tt.err, reason, tt.reason)
+		}
+	}
+}
+
+func TestElasticsearchBulkRejections(t *testing.T) {
+	pmp := &ElasticsearchPump{}
+	rejected := make(map[string]int)
+	pmp.SetRejectionReporter(func(reason string, records int, err error) {
+		rejected[reason] += records
+	})
+	operator := Elasticsearch7Operator{rejected: pmp.reportRejection}
+
+	response := &elastic.BulkResponse{Items: []map[string]*elastic.BulkResponseItem{
+		{"index": {Status: http.StatusCreated}},
+		{"index": {Status: http.StatusTooManyRequests, Error: &elastic.ErrorDetails{Type: "es_rejected_execution_exception"}}},
+		{"index": {Status: http.StatusTooManyRequests, Error: &elastic.ErrorDetails{Type: "es_rejected_execution_exception"}}},
+		{"index": {Status: http.StatusBadRequest, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception"}}},
+	}}
+	operator.afterBulk(1, nil, response, nil)
+
+	requests := []elastic.BulkableRequest{elastic.NewBulkIndexRequest(), elastic.NewBulkIndexRequest()}
+	operator.afterBulk(2, requests, nil, &elastic.Error{Status: http.StatusRequestEntityTooLarge})
+
+	if rejected[RejectionRateLimited] != 2 || rejected[RejectionPayloadTooLarge] != 2 || len(rejected) != 2 {
+		t.Fatalf("unexpected rejections: %v", rejected)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the kinds of series the remote write pump derives from analytics records.
+const (
+	// RemoteWriteCounter counts the records per label set, the sample is the cumulative total.
+	RemoteWriteCounter = "counter"
+	// RemoteWriteDelay is the average delay in seconds between the authorization and the write
+	// of the records per label set in the last batch.
+	RemoteWriteDelay = "delay"
+)
+
+// defaultRemoteWriteMaxSeries is the number of counter series whose totals are tracked by default.
+const defaultRemoteWriteMaxSeries = 10000
+
+// RemoteWritePump defines a pump which pushes time series derived from analytics records with the
+// prometheus remote write protocol, to VictoriaMetrics or any compatible back-end.
+type RemoteWritePump struct {
+	conf   *RemoteWriteConf
+	client *http.Client
+
+	mu     sync.Mutex
+	totals map[string]*remoteWriteTotal
+
+	CommonPumpConfig
+}
+
+// RemoteWriteConf defines remote write specific options.
+type RemoteWriteConf struct {
+	URL         string             `mapstructure:"url"`
+	Username    string             `mapstructure:"username"`
+	Password    string             `mapstructure:"password"`
+	BearerToken string             `mapstructure:"bearer_token"`
+	Series      []RemoteWriteSerie `mapstructure:"series"`
+	// MaxSeries bounds the counter series whose totals are tracked, 10000 by default. Beyond it the
+	// least recently updated series is evicted, its total restarts from zero as a counter reset.
+	MaxSeries int `mapstructure:"max_series"`
+	// Only the headers apply, the series are labeled from the record fields.
+	HeadersConf `mapstructure:",squash"`
+}
+
+// RemoteWriteSerie defines a time series derived from analytics records.
+type RemoteWriteSerie struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+	// Labels is the list of record fields used as labels of the series.
+	Labels []string `mapstructure:"labels"`
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriteTotal is the cumulative total of a counter series.
+type remoteWriteTotal struct {
+	value   float64
+	updated time.Time
+}
+
+type remoteWriteSample struct {
+	labels []remoteWriteLabel
+	value  float64
+}
+
+// New create a remote write pump instance.
+func (r *RemoteWritePump) New() Pump {
+	newPump := RemoteWritePump{}
+
+	return &newPump
+}
+
+// GetName returns the remote write pump name.
+func (r *RemoteWritePump) GetName() string {
+	return "Remote Write Pump"
+}
+
+// Init initialize the remote write pump instance.
+func (r *RemoteWritePump) Init(config interface{}) error {
+	r.conf = &RemoteWriteConf{}
+	if err := mapstructure.Decode(config, &r.conf); err != nil {
+		return errors.Wrap(err, "failed to decode remote write configuration")
+	}
+
+	if r.conf.URL == "" {
+		return errors.New("remote write url not set")
+	}
+
+	if len(r.conf.Series) == 0 {
+		r.conf.Series = []RemoteWriteSerie{
+			{Name: "iam_authorization_total", Type: RemoteWriteCounter, Labels: []string{"effect", "username"}},
+		}
+	}
+
+	for i, serie := range r.conf.Series {
+		if serie.Name == "" {
+			return errors.Errorf("remote write series %d has no name", i)
+		}
+
+		switch serie.Type {
+		case "":
+			r.conf.Series[i].Type = RemoteWriteCounter
+		case RemoteWriteCounter, RemoteWriteDelay:
+		default:
+			return errors.Errorf("remote write series %s has unsupported type %s", serie.Name, serie.Type)
+		}
+
+		for _, label := range serie.Labels {
+			if !analytics.IsRecordField(label) {
+				return errors.Errorf("remote write series %s uses unknown record field %s as label", serie.Name, label)
+			}
+		}
+	}
+
+	if r.conf.MaxSeries <= 0 {
+		r.conf.MaxSeries = defaultRemoteWriteMaxSeries
+	}
+
+	r.client = &http.Client{}
+	r.totals = make(map[string]*remoteWriteTotal)
+
+	log.Infof("Remote write pump will push %d series to %s", len(r.conf.Series), r.conf.URL)
+
+	return nil
+}
+
+// WriteData derives the configured series from the analytics data and pushes them to the remote write back-end.
+func (r *RemoteWritePump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	samples := r.aggregate(data, time.Now())
+	if len(samples) == 0 {
+		return nil
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(samples, time.Now().UnixNano()/int64(time.Millisecond)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create remote write request")
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	r.conf.setHeaders(req.Header)
+
+	switch {
+	case r.conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+r.conf.BearerToken)
+	case r.conf.Username != "":
+		req.SetBasicAuth(r.conf.Username, r.conf.Password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to push to remote write back-end")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("remote write back-end", resp); err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, len(body))
+
+	return nil
+}
+
+// aggregate derives the samples of every configured series from the records.
+func (r *RemoteWritePump) aggregate(data []interface{}, now time.Time) []remoteWriteSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	samples := make([]remoteWriteSample, 0)
+	for _, serie := range r.conf.Series {
+		labelSets := make(map[string][]remoteWriteLabel)
+		counts := make(map[string]float64)
+		delays := make(map[string]float64)
+
+		for _, item := range data {
+			record, ok := item.(analytics.AnalyticsRecord)
+			if !ok {
+				continue
+			}
+
+			labels := serieLabels(serie, record)
+			key := labelsKey(labels)
+			labelSets[key] = labels
+			counts[key]++
+			delays[key] += math.Max(0, float64(now.Unix()-record.TimeStamp))
+		}
+
+		for key, labels := range labelSets {
+			sample := remoteWriteSample{labels: labels}
+			if serie.Type == RemoteWriteDelay {
+				sample.value = delays[key] / counts[key]
+			} else {
+				total, ok := r.totals[key]
+				if !ok {
+					r.evict()
+					total = &remoteWriteTotal{}
+					r.totals[key] = total
+				}
+				total.value += counts[key]
+				total.updated = now
+				sample.value = total.value
+			}
+			samples = append(samples, sample)
+		}
+	}
+
+	return samples
+}
+
+// evict forgets the least recently updated counter series once max_series are tracked.
+func (r *RemoteWritePump) evict() {
+	if len(r.totals) < r.conf.MaxSeries {
+		return
+	}
+
+	var oldest string
+	for key, total := range r.totals {
+		if oldest == "" || total.updated.Before(r.totals[oldest].updated) {
+			oldest = key
+		}
+	}
+	delete(r.totals, oldest)
+	log.Debugf("Remote write pump tracks %d series, evicted the least recently updated", r.conf.MaxSeries)
+}
+
+func serieLabels(serie RemoteWriteSerie, record analytics.AnalyticsRecord) []remoteWriteLabel {
+	labels := make([]remoteWriteLabel, 0, len(serie.Labels)+1)
+	labels = append(labels, remoteWriteLabel{name: "__name__", value: serie.Name})
+
+	for _, name := range serie.Labels {
+		value, _ := record.FieldValue(name)
+		labels = append(labels, remoteWriteLabel{name: name, value: fmt.Sprint(value)})
+	}
+
+	// remote write back-ends expect the labels of a series sorted by name
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	return labels
+}
+
+func labelsKey(labels []remoteWriteLabel) string {
+	var b strings.Builder
+	for _, label := range labels {
+		b.WriteString(label.name)
+		b.WriteByte(0xff)
+		b.WriteString(label.value)
+		b.WriteByte(0xff)
+	}
+
+	return b.String()
+}
+
+// encodeWriteRequest encodes the samples as a prometheus remote write WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []remoteWriteSample, timestampMs int64) []byte {
+	var req []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(timestampMs))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+
+	return req
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestRemoteWritePump(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("unexpected content encoding %s", r.Header.Get("Content-Encoding"))
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, compressed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	pmp := (&RemoteWritePump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"url": server.URL,
+		"series": []map[string]interface{}{
+			{"name": "iam_decisions_total", "labels": []string{"effect"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{Username: "colin", Effect: "allow"},
+		analytics.AnalyticsRecord{Username: "james", Effect: "allow"},
+	}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"__name__", "iam_decisions_total", "effect", "allow"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Fatalf("write request does not contain %s", expected)
+		}
+	}
+
+	if total := pmp.(*RemoteWritePump).totals; len(total) != 1 {
+		t.Fatalf("expected one series, got %d", len(total))
+	}
+}
+
+func TestRemoteWritePumpMaxSeries(t *testing.T) {
+	pmp := &RemoteWritePump{}
+	err := pmp.Init(map[string]interface{}{
+		"url":        "http://localhost:8428/api/v1/write",
+		"max_series": 1,
+		"series": []map[string]interface{}{
+			{"name": "iam_decisions_total", "labels": []string{"username"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	pmp.aggregate([]interface{}{analytics.AnalyticsRecord{Username: "colin"}}, now)
+	pmp.aggregate([]interface{}{analytics.AnalyticsRecord{Username: "james"}}, now.Add(time.Second))
+	if len(pmp.totals) != 1 {
+		t.Fatalf("the series beyond max_series should be evicted, got %d", len(pmp.totals))
+	}
+
+	samples := pmp.aggregate([]interface{}{analytics.AnalyticsRecord{Username: "colin"}}, now.Add(2*time.Second))
+	if len(samples) != 1 || samples[0].value != 1 {
+		t.Fatalf("the total of an evicted series should restart from zero, got %v", samples)
+	}
+}
+
+func TestRemoteWritePumpInvalidLabel(t *testing.T) {
+	err := (&RemoteWritePump{}).New().Init(map[string]interface{}{
+		"url": "http://localhost:8428/api/v1/write",
+		"series": []map[string]interface{}{
+			{"name": "iam_decisions_total", "labels": []string{"unknown"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("unknown label field should be rejected")
+	}
+}
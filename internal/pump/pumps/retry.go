@@ -0,0 +1,103 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/marmotedu/errors"
+)
+
+// permanentError marks an error which retrying the write can not fix, e.g. an authentication
+// failure or a schema mismatch.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as permanent, the write failing with it is not retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// ErrorClassifier is implemented by pumps which classify their own write errors.
+type ErrorClassifier interface {
+	Pump
+	Retryable(err error) bool
+}
+
+// IsRetryable reports whether the write which failed with err may succeed when retried. The pump
+// classification takes precedence, then errors marked permanent or carrying a permanent http
+// status are not retryable. Any other error is treated as transient.
+func IsRetryable(pump Pump, err error) bool {
+	if classifier, ok := pump.(ErrorClassifier); ok {
+		return classifier.Retryable(err)
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+
+	return true
+}
+
+// StatusError is returned by the http based pumps when the back-end answers with an error status.
+type StatusError struct {
+	Backend    string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.Backend, e.Status, e.Message)
+}
+
+// Retryable reports whether the request may succeed later: server errors, request timeouts and
+// rate limiting are transient, the other client errors are permanent.
+func (e *StatusError) Retryable() bool {
+	if e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout {
+		return true
+	}
+
+	return e.StatusCode < 400 || e.StatusCode >= 500
+}
+
+// checkResponse returns a StatusError when the response status is not a success.
+func checkResponse(backend string, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	return &StatusError{
+		Backend:    backend,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(msg)),
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/marmotedu/errors"
+)
+
+func TestIsRetryable(t *testing.T) {
+	pmp := &DummyPump{}
+
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset"), true},
+		{errors.Wrap(Permanent(errors.New("schema mismatch")), "write failed"), false},
+		{&StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{errors.Wrap(&StatusError{StatusCode: http.StatusTooManyRequests}, "write failed"), true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(pmp, tt.err); got != tt.retryable {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.retryable)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/marmotedu/iam/internal/pkg/logger"
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the databases the rollup pump writes to.
+const (
+	rollupStoreMongo = "mongo"
+	rollupStoreGorm  = "gorm"
+)
+
+// RollupPump defines a pump which does not store the analytics records but counts them per
+// interval, per minute by default, grouped by username, resource and effect. The counts of the
+// interval are added to the rollup documents of MongoDB or rows of a GORM-supported database, so
+// that the dashboards only read one document per group and interval.
+type RollupPump struct {
+	conf      *RollupConf
+	dbSession *mgo.Session
+	db        *gorm.DB
+
+	CommonPumpConfig
+}
+
+// RollupConf defines rollup specific options.
+type RollupConf struct {
+	// Store is the database the rollups are written to, mongo or gorm.
+	Store string `mapstructure:"store"`
+	// Interval is the duration in seconds of the interval the records are counted per, 60 by default.
+	Interval int64 `mapstructure:"interval"`
+	// ResourceField is the record field, extra field or attribute of the authorization request
+	// holding the resource the records are grouped by, resource by default.
+	ResourceField string `mapstructure:"resource_field"`
+	// SampleRateField is the field of the sample rate of the records, see DefaultSampleRateField.
+	SampleRateField string `mapstructure:"sample_rate_field"`
+	// Mongo holds the connection options of the mongo store.
+	Mongo BaseMongoConf `mapstructure:"mongo"`
+	// CollectionName is the collection of the mongo store, iam_analytics_rollups by default.
+	CollectionName string `mapstructure:"collection_name"`
+	// Gorm holds the connection options of the gorm store, its table_name defaults to
+	// iam_analytics_rollups.
+	Gorm GormConf `mapstructure:"gorm"`
+}
+
+// RollupRecord is the number of records of a group over an interval.
+type RollupRecord struct {
+	// TimeStamp is the start of the interval.
+	TimeStamp int64  `json:"timestamp" bson:"timestamp" gorm:"uniqueIndex:idx_rollup"`
+	Username  string `json:"username"  bson:"username"  gorm:"size:255;uniqueIndex:idx_rollup"`
+	Resource  string `json:"resource"  bson:"resource"  gorm:"size:255;uniqueIndex:idx_rollup"`
+	Effect    string `json:"effect"    bson:"effect"    gorm:"size:32;uniqueIndex:idx_rollup"`
+	Count     int64  `json:"count"     bson:"count"`
+}
+
+// GormRollupRecord is the table model of the rollups written by the rollup pump.
+type GormRollupRecord struct {
+	ID uint64 `gorm:"primaryKey;autoIncrement"`
+	RollupRecord
+}
+
+// New create a rollup pump instance.
+func (r *RollupPump) New() Pump {
+	newPump := RollupPump{}
+
+	return &newPump
+}
+
+// GetName returns the rollup pump name.
+func (r *RollupPump) GetName() string {
+	return "Rollup Pump"
+}
+
+// Init initialize the rollup pump instance and connects to its store.
+func (r *RollupPump) Init(config interface{}) error {
+	r.conf = &RollupConf{}
+	if err := mapstructure.Decode(config, &r.conf); err != nil {
+		return errors.Wrap(err, "failed to decode rollup configuration")
+	}
+
+	if r.conf.Interval <= 0 {
+		r.conf.Interval = 60
+	}
+
+	if r.conf.SampleRateField == "" {
+		r.conf.SampleRateField = DefaultSampleRateField
+	}
+
+	if r.conf.ResourceField == "" {
+		r.conf.ResourceField = "resource"
+	}
+
+	var err error
+	switch r.conf.Store {
+	case rollupStoreMongo:
+		err = r.initMongo()
+	case rollupStoreGorm:
+		err = r.initGorm()
+	default:
+		err = errors.Errorf("rollup store must be %s or %s", rollupStoreMongo, rollupStoreGorm)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Rollup pump counts the records per %d seconds into %s", r.conf.Interval, r.conf.Store)
+
+	return nil
+}
+
+// initMongo connects to the mongo store and indexes the rollups by interval and group.
+func (r *RollupPump) initMongo() error {
+	if r.conf.CollectionName == "" {
+		r.conf.CollectionName = "iam_analytics_rollups"
+	}
+
+	dialInfo, err := mongoDialInfo(r.conf.Mongo)
+	if err != nil {
+		return errors.Wrap(err, "invalid rollup mongo url")
+	}
+	dialInfo.Timeout = 5 * time.Second
+
+	if r.dbSession, err = mgo.DialWithInfo(dialInfo); err != nil {
+		return errors.Wrap(err, "failed to connect to the rollup mongo")
+	}
+
+	err = r.dbSession.DB("").C(r.conf.CollectionName).EnsureIndex(mgo.Index{
+		Key:        []string{"timestamp", "username", "resource", "effect"},
+		Unique:     true,
+		Background: true,
+	})
+
+	return errors.Wrap(err, "failed to index the rollup collection")
+}
+
+// initGorm connects to the gorm store and migrates the rollup table.
+func (r *RollupPump) initGorm() error {
+	conf := &r.conf.Gorm
+	if conf.Dialect == "" {
+		conf.Dialect = "mysql"
+	}
+
+	dialector, ok := gormDialectors[conf.Dialect]
+	if !ok {
+		return errors.Errorf("gorm dialect %s is not supported", conf.Dialect)
+	}
+
+	if conf.DSN == "" {
+		return errors.New("rollup gorm dsn not set")
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = "iam_analytics_rollups"
+	}
+
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 500
+	}
+
+	db, err := gorm.Open(dialector(conf.DSN), &gorm.Config{Logger: logger.New(conf.LogLevel)})
+	if err != nil {
+		return errors.Wrap(err, "failed to open rollup gorm database")
+	}
+
+	if err := db.Table(conf.TableName).AutoMigrate(&GormRollupRecord{}); err != nil {
+		return errors.Wrapf(err, "failed to migrate table %s", conf.TableName)
+	}
+	r.db = db
+
+	return nil
+}
+
+// WriteData counts the analytics data per interval and group, and adds the counts to the rollups.
+// The counts of a failed write are added again when it is retried.
+func (r *RollupPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	rollups := r.rollup(data)
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	if r.db != nil {
+		return r.writeGorm(ctx, rollups)
+	}
+
+	return r.writeMongo(rollups)
+}
+
+// rollup counts the records per interval and group, in the order of the intervals and groups.
+func (r *RollupPump) rollup(data []interface{}) []RollupRecord {
+	counts := map[RollupRecord]float64{}
+	for _, item := range data {
+		record, ok := item.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		key := RollupRecord{
+			TimeStamp: record.TimeStamp - record.TimeStamp%r.conf.Interval,
+			Username:  record.Username,
+			Effect:    record.Effect,
+		}
+		var request map[string]interface{}
+		if resource, ok := attributeValue(&record, r.conf.ResourceField, &request); ok {
+			key.Resource = fmt.Sprint(resource)
+		}
+		counts[key] += sampleWeight(&record, r.conf.SampleRateField, r.GetCountField())
+	}
+
+	rollups := make([]RollupRecord, 0, len(counts))
+	for key, count := range counts {
+		key.Count = int64(count)
+		rollups = append(rollups, key)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if a.TimeStamp != b.TimeStamp {
+			return a.TimeStamp < b.TimeStamp
+		}
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+
+		return a.Effect < b.Effect
+	})
+
+	return rollups
+}
+
+// writeMongo adds the counts to the rollup documents, the documents missing are created.
+func (r *RollupPump) writeMongo(rollups []RollupRecord) error {
+	sess := r.dbSession.Copy()
+	defer sess.Close()
+
+	bulk := sess.DB("").C(r.conf.CollectionName).Bulk()
+	bulk.Unordered()
+	for _, rollup := range rollups {
+		selector := bson.M{
+			"timestamp": rollup.TimeStamp,
+			"username":  rollup.Username,
+			"resource":  rollup.Resource,
+			"effect":    rollup.Effect,
+		}
+		bulk.Upsert(selector, bson.M{"$inc": bson.M{"count": rollup.Count}})
+	}
+
+	_, err := bulk.Run()
+
+	return errors.Wrap(err, "failed to upsert the rollups")
+}
+
+// writeGorm adds the counts to the rollup rows, the rows missing are inserted.
+func (r *RollupPump) writeGorm(ctx context.Context, rollups []RollupRecord) error {
+	rows := make([]GormRollupRecord, 0, len(rollups))
+	for _, rollup := range rollups {
+		rows = append(rows, GormRollupRecord{RollupRecord: rollup})
+	}
+
+	// the conflicts on the unique index of the interval and group add the counts, the
+	// expression is the mysql one
+	err := r.db.WithContext(ctx).Table(r.conf.Gorm.TableName).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "time_stamp"}, {Name: "username"}, {Name: "resource"}, {Name: "effect"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + VALUES(count)")}),
+	}).CreateInBatches(rows, r.conf.Gorm.BatchSize).Error
+
+	return errors.Wrap(err, "failed to upsert the rollups")
+}
+
+// Shutdown closes the connection to the store.
+func (r *RollupPump) Shutdown() error {
+	if r.dbSession != nil {
+		r.dbSession.Close()
+	}
+
+	if r.db == nil {
+		return nil
+	}
+
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return errors.Wrap(err, "failed to get gorm connection pool")
+	}
+
+	return sqlDB.Close()
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestRollupPump(t *testing.T) {
+	r := &RollupPump{conf: &RollupConf{Interval: 60, ResourceField: "resource", SampleRateField: "sample_rate"}}
+
+	sampled := analytics.AnalyticsRecord{TimeStamp: 1700000010, Username: "colin", Effect: "allow",
+		Request: `{"resource":"articles"}`}
+	sampled.SetExtra("sample_rate", 10.0)
+	data := []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: 1700000001, Username: "colin", Effect: "allow",
+			Request: `{"resource":"articles"}`},
+		sampled,
+		analytics.AnalyticsRecord{TimeStamp: 1700000059, Username: "colin", Effect: "deny",
+			Request: `{"resource":"articles"}`},
+		analytics.AnalyticsRecord{TimeStamp: 1700000061, Username: "colin", Effect: "allow",
+			Request: `{"resource":"articles"}`},
+		"not a record",
+	}
+
+	expected := []RollupRecord{
+		{TimeStamp: 1699999980, Username: "colin", Resource: "articles", Effect: "allow", Count: 11},
+		{TimeStamp: 1700000040, Username: "colin", Resource: "articles", Effect: "allow", Count: 1},
+		{TimeStamp: 1700000040, Username: "colin", Resource: "articles", Effect: "deny", Count: 1},
+	}
+
+	if rollups := r.rollup(data); !reflect.DeepEqual(rollups, expected) {
+		t.Fatalf("the records should be counted per minute and group, got %+v", rollups)
+	}
+}
+
+func TestRollupPumpInit(t *testing.T) {
+	if err := (&RollupPump{}).Init(map[string]interface{}{}); err == nil {
+		t.Fatal("the store should be required")
+	}
+
+	if err := (&RollupPump{}).Init(map[string]interface{}{"store": "gorm"}); err == nil {
+		t.Fatal("the gorm dsn should be required")
+	}
+}
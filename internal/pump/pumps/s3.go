@@ -0,0 +1,617 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the formats of the objects written by the s3 pump.
+const (
+	// S3FormatParquet writes the records as gzip compressed parquet files.
+	S3FormatParquet = "parquet"
+	// S3FormatJSONL writes the records as gzip compressed json lines.
+	S3FormatJSONL = "jsonl"
+	// S3FormatRaw writes the original payloads read from the analytics storage as a gzip compressed
+	// stream of msgpack binary values, for lossless archives.
+	S3FormatRaw = "raw"
+	// S3FormatAvro writes the records as Avro object container files with the schema of
+	// avro_schema_file, for the Avro data lakes the csv pump does not write to. The avro objects
+	// are not replayed by the backfill.
+	S3FormatAvro = "avro"
+)
+
+// Defines the defaults of the s3 pump.
+const (
+	defaultS3Region        = "us-east-1"
+	defaultS3KeyLayout     = "2006/01/02/15"
+	defaultS3FlushInterval = 60
+	defaultS3MaxRecords    = 100000
+	defaultS3FlushTimeout  = 60 * time.Second
+)
+
+// S3Pump defines a pump which buffers the analytics records and periodically writes them as
+// compressed objects to an S3 compatible storage, under keys partitioned by the hour of the
+// records so that they can be queried with Athena. The buffer is also written once it holds
+// max_records, and a last time at shutdown.
+type S3Pump struct {
+	conf   *S3Conf
+	client *http.Client
+	avro   *avroMarshaler
+
+	mu      sync.Mutex
+	records []analytics.AnalyticsRecord
+	// flushMu serializes the periodic flushes and those of a full buffer.
+	flushMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+
+	CommonPumpConfig
+}
+
+// S3Conf defines s3 specific options.
+type S3Conf struct {
+	// Endpoint is the url of the storage, https://s3.<region>.amazonaws.com by default.
+	Endpoint string `mapstructure:"endpoint"`
+	Region   string `mapstructure:"region"`
+	Bucket   string `mapstructure:"bucket"`
+	// ForcePathStyle addresses the bucket in the path of the urls rather than in their host, as
+	// expected by most S3 compatible storages, e.g. minio.
+	ForcePathStyle  bool   `mapstructure:"force_path_style"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	// Format is parquet, the default, jsonl, raw or avro.
+	Format string `mapstructure:"format"`
+	// AvroSchemaFile is the file of the Avro record schema of the avro format.
+	AvroSchemaFile string `mapstructure:"avro_schema_file"`
+	// Prefix is prepended to the keys of the objects.
+	Prefix string `mapstructure:"prefix"`
+	// KeyLayout is the time layout of the partition of the records in the keys, formatted with
+	// the UTC time of the records, 2006/01/02/15 (year/month/day/hour) by default. The Hive
+	// style year=2006/month=01/day=02/hour=15 lets Athena discover the partitions.
+	KeyLayout string `mapstructure:"key_layout"`
+	// FlushInterval is the delay in seconds between the writes of the buffered records.
+	FlushInterval int `mapstructure:"flush_interval"`
+	// MaxRecords is the number of buffered records written without waiting for the interval.
+	MaxRecords int `mapstructure:"max_records"`
+	// MultipartConf uploads the large objects in parts.
+	MultipartConf `mapstructure:",squash"`
+}
+
+// New create a s3 pump instance.
+func (s *S3Pump) New() Pump {
+	newPump := S3Pump{}
+
+	return &newPump
+}
+
+// GetName returns the s3 pump name.
+func (s *S3Pump) GetName() string {
+	return "S3 Pump"
+}
+
+// Init initialize the s3 pump instance and starts the periodic flush.
+func (s *S3Pump) Init(config interface{}) error {
+	s.conf = &S3Conf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode s3 configuration")
+	}
+
+	if s.conf.Bucket == "" {
+		return errors.New("s3 bucket not set")
+	}
+
+	if s.conf.Region == "" {
+		s.conf.Region = defaultS3Region
+	}
+
+	if s.conf.Endpoint == "" {
+		s.conf.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.conf.Region)
+	}
+	s.conf.Endpoint = strings.TrimSuffix(s.conf.Endpoint, "/")
+	if _, err := url.Parse(s.conf.Endpoint); err != nil {
+		return errors.Wrap(err, "invalid s3 endpoint")
+	}
+
+	switch s.conf.Format {
+	case "":
+		s.conf.Format = S3FormatParquet
+	case S3FormatParquet, S3FormatJSONL, S3FormatRaw:
+	case S3FormatAvro:
+		if err := s.initAvro(); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("s3 format must be %s, %s, %s or %s", S3FormatParquet, S3FormatJSONL, S3FormatRaw,
+			S3FormatAvro)
+	}
+
+	if s.conf.KeyLayout == "" {
+		s.conf.KeyLayout = defaultS3KeyLayout
+	}
+
+	if s.conf.FlushInterval <= 0 {
+		s.conf.FlushInterval = defaultS3FlushInterval
+	}
+
+	if s.conf.MaxRecords <= 0 {
+		s.conf.MaxRecords = defaultS3MaxRecords
+	}
+
+	if err := s.conf.MultipartConf.validate(); err != nil {
+		return errors.Wrap(err, "invalid s3 multipart options")
+	}
+
+	s.client = &http.Client{}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+
+	log.Infof("S3 pump writes %s objects to bucket %s every %ds", s.conf.Format, s.conf.Bucket, s.conf.FlushInterval)
+
+	return nil
+}
+
+// initAvro reads the schema of the avro format, the records are validated against it.
+func (s *S3Pump) initAvro() error {
+	if s.conf.AvroSchemaFile == "" {
+		return errors.New("s3 avro format needs avro_schema_file")
+	}
+
+	schema, err := os.ReadFile(s.conf.AvroSchemaFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read s3 avro schema")
+	}
+
+	marshaler, err := NewAvroMarshaler(string(schema))
+	if err != nil {
+		return errors.Wrap(err, "invalid s3 avro schema")
+	}
+	s.avro, _ = marshaler.(*avroMarshaler)
+
+	return nil
+}
+
+// WriteData buffers the analytics data, it is written by the periodic flush or once the buffer
+// holds max_records. The data is refused when the buffer is full of the records failing to be
+// written.
+func (s *S3Pump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	s.mu.Lock()
+	if len(s.records) >= 2*s.conf.MaxRecords {
+		s.mu.Unlock()
+
+		return errors.Errorf("s3 buffer is full of %d records not written yet", 2*s.conf.MaxRecords)
+	}
+
+	for _, v := range data {
+		if record, ok := v.(analytics.AnalyticsRecord); ok {
+			s.records = append(s.records, record)
+		}
+	}
+	full := len(s.records) >= s.conf.MaxRecords
+	s.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+
+	// the records are buffered once added, those of the objects failing to be written are kept
+	// for the next flush, so the write succeeds rather than have them written again
+	if err := s.flush(ctx); err != nil {
+		log.Errorf("Failed to write the buffered records to s3, retrying at the next flush: %s", err.Error())
+	}
+
+	return nil
+}
+
+// run flushes the buffer every flush interval until the pump is shut down, and a last time then.
+func (s *S3Pump) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Duration(s.conf.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			s.flushAll()
+
+			return
+		}
+
+		s.flushAll()
+	}
+}
+
+func (s *S3Pump) flushAll() {
+	timeout := defaultS3FlushTimeout
+	if s.GetTimeout() > 0 {
+		timeout = time.Duration(s.GetTimeout()) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.flush(ctx); err != nil {
+		log.Errorf("Failed to write the buffered records to s3: %s", err.Error())
+	}
+}
+
+// flush writes the buffered records, one object per partition. The records of the objects which
+// failed to be written are buffered again for the next flush.
+func (s *S3Pump) flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	records := s.records
+	s.records = nil
+	s.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	partitions := make(map[string][]analytics.AnalyticsRecord)
+	for _, record := range records {
+		partition := time.Unix(record.TimeStamp, 0).UTC().Format(s.conf.KeyLayout)
+		partitions[partition] = append(partitions[partition], record)
+	}
+
+	var (
+		failed   []analytics.AnalyticsRecord
+		firstErr error
+	)
+	for partition, partitionRecords := range partitions {
+		if err := s.writeObject(ctx, partition, partitionRecords); err != nil {
+			failed = append(failed, partitionRecords...)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		s.mu.Lock()
+		s.records = append(failed, s.records...)
+		s.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// writeObject writes the records of a partition as a new object.
+func (s *S3Pump) writeObject(ctx context.Context, partition string, records []analytics.AnalyticsRecord) error {
+	var (
+		payload []byte
+		ext     string
+		err     error
+	)
+	switch s.conf.Format {
+	case S3FormatParquet:
+		ext = "parquet"
+		payload, err = encodeParquet(records)
+	case S3FormatRaw:
+		ext = "msgpack.gz"
+		payload, err = encodeRawPayloads(records)
+	case S3FormatAvro:
+		ext = "avro"
+		payload, err = s.avro.encodeContainer(records)
+	default:
+		ext = "jsonl.gz"
+		payload, err = encodeJSONLines(records)
+	}
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%s/%d-%s.%s", s.conf.Prefix, partition, time.Now().UnixNano(),
+		uuid.Must(uuid.NewV4()).String(), ext)
+
+	if s.conf.multipart(len(payload)) {
+		err = s.uploadMultipart(ctx, key, payload)
+	} else {
+		_, _, err = s.request(ctx, http.MethodPut, key, nil, payload)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write s3 object %s", key)
+	}
+
+	addWrittenBytes(ctx, len(payload))
+
+	return nil
+}
+
+func encodeJSONLines(records []analytics.AnalyticsRecord) ([]byte, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, errors.Wrap(err, "failed to encode analytics record")
+		}
+	}
+
+	return gzipPayload(body.Bytes())
+}
+
+// encodeRawPayloads writes the original payloads of the records as msgpack binary values, which
+// delimit the payloads whatever their codec. The records read without their payload are encoded
+// again in msgpack.
+func encodeRawPayloads(records []analytics.AnalyticsRecord) ([]byte, error) {
+	var body bytes.Buffer
+	encoder := msgpack.NewEncoder(&body)
+	for i := range records {
+		payload := records[i].Raw
+		if payload == nil {
+			var err error
+			if payload, err = msgpack.Marshal(records[i]); err != nil {
+				return nil, errors.Wrap(err, "failed to encode analytics record")
+			}
+		}
+
+		if err := encoder.EncodeBytes(payload); err != nil {
+			return nil, errors.Wrap(err, "failed to encode analytics payload")
+		}
+	}
+
+	return gzipPayload(body.Bytes())
+}
+
+// WantsRawRecords reports whether the s3 pump writes the original payloads.
+func (s *S3Pump) WantsRawRecords() bool {
+	return s.conf.Format == S3FormatRaw
+}
+
+// uploadMultipart creates a multipart upload of the object and uploads the payload in parts.
+func (s *S3Pump) uploadMultipart(ctx context.Context, key string, payload []byte) error {
+	_, body, err := s.request(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create multipart upload")
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return errors.New("failed to create multipart upload: no upload id returned")
+	}
+
+	return s.conf.upload(ctx, &s3MultipartUpload{pump: s, key: key, uploadID: result.UploadID}, payload)
+}
+
+// request sends a request signed with the credentials of the pump for the object key, and
+// returns the headers and the body of the response.
+func (s *S3Pump) request(ctx context.Context, method string, key string, query url.Values,
+	payload []byte) (http.Header, []byte, error) {
+	target, err := url.Parse(s.conf.Endpoint)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid s3 endpoint")
+	}
+
+	path := "/" + awsEscape(key, false)
+	if s.conf.ForcePathStyle {
+		path = "/" + awsEscape(s.conf.Bucket, true) + path
+	} else {
+		target.Host = s.conf.Bucket + "." + target.Host
+	}
+	rawURL := target.Scheme + "://" + target.Host + strings.TrimSuffix(target.Path, "/") + path
+	if len(query) > 0 {
+		rawURL += "?" + awsQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create s3 request")
+	}
+
+	if s.conf.AccessKeyID != "" {
+		credentials := awsCredentials{
+			AccessKeyID:     s.conf.AccessKeyID,
+			SecretAccessKey: s.conf.SecretAccessKey,
+			SessionToken:    s.conf.SessionToken,
+		}
+		signAWSRequest(req, payload, credentials, s.conf.Region, "s3", time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("s3", resp); err != nil {
+		return nil, nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read s3 response")
+	}
+
+	return resp.Header, body, nil
+}
+
+// Shutdown stops the periodic flush after writing the buffered records a last time.
+func (s *S3Pump) Shutdown() error {
+	if s.stop == nil {
+		return nil
+	}
+
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+
+	return nil
+}
+
+// s3MultipartUpload uploads an object in parts, the object is created when the upload is completed.
+type s3MultipartUpload struct {
+	pump     *S3Pump
+	key      string
+	uploadID string
+
+	mu    sync.Mutex
+	etags map[int]string
+}
+
+func (u *s3MultipartUpload) uploadPart(ctx context.Context, index int, part []byte) error {
+	header, _, err := u.pump.request(ctx, http.MethodPut, u.key,
+		url.Values{"partNumber": {fmt.Sprint(index + 1)}, "uploadId": {u.uploadID}}, part)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.etags == nil {
+		u.etags = make(map[int]string)
+	}
+	u.etags[index] = header.Get("ETag")
+
+	return nil
+}
+
+// complete assembles the parts, the storage may report a failure in the body of a successful response.
+func (u *s3MultipartUpload) complete(ctx context.Context, parts int) error {
+	var body strings.Builder
+	body.WriteString("<CompleteMultipartUpload>")
+	for index := 0; index < parts; index++ {
+		var etag bytes.Buffer
+		_ = xml.EscapeText(&etag, []byte(u.etags[index]))
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", index+1, etag.String())
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+
+	_, result, err := u.pump.request(ctx, http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}},
+		[]byte(body.String()))
+	if err != nil {
+		return err
+	}
+
+	if bytes.Contains(result, []byte("<Error>")) {
+		return errors.Errorf("failed to complete multipart upload: %s", strings.TrimSpace(string(result)))
+	}
+
+	return nil
+}
+
+// abort discards the uploaded parts so that they do not accrue storage.
+func (u *s3MultipartUpload) abort(ctx context.Context) error {
+	_, _, err := u.pump.request(ctx, http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil)
+
+	return err
+}
+
+// S3Archive lists and reads the objects written by the s3 pump under a prefix, to replay them.
+type S3Archive struct {
+	pump   *S3Pump
+	prefix string
+}
+
+// NewS3Archive returns the archive of a s3://bucket/prefix url, read from the endpoint, or
+// https://s3.<region>.amazonaws.com by default, with the credentials of the environment, the
+// shared credentials file or the instance metadata.
+func NewS3Archive(ctx context.Context, archive, endpoint, region string, forcePathStyle bool) (*S3Archive, error) {
+	location, err := url.Parse(archive)
+	if err != nil || location.Scheme != "s3" || location.Host == "" {
+		return nil, errors.Errorf("invalid s3 archive %s", archive)
+	}
+
+	if region == "" {
+		region = defaultS3Region
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	credentials, err := newAWSCredentialsChain("", "", "", "").retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Archive{
+		pump: &S3Pump{
+			conf: &S3Conf{
+				Endpoint:        strings.TrimSuffix(endpoint, "/"),
+				Region:          region,
+				Bucket:          location.Host,
+				ForcePathStyle:  forcePathStyle,
+				AccessKeyID:     credentials.AccessKeyID,
+				SecretAccessKey: credentials.SecretAccessKey,
+				SessionToken:    credentials.SessionToken,
+			},
+			client: &http.Client{},
+		},
+		prefix: strings.TrimPrefix(location.Path, "/"),
+	}, nil
+}
+
+// List returns the keys of the objects under the prefix of the archive, in key order, which is the
+// order the objects of a partition were written in.
+func (a *S3Archive) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {a.prefix}}
+	for {
+		_, body, err := a.pump.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list s3 objects")
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, errors.Wrap(err, "invalid s3 objects list")
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Get returns the content of the object.
+func (a *S3Archive) Get(ctx context.Context, key string) ([]byte, error) {
+	_, body, err := a.pump.request(ctx, http.MethodGet, key, nil, nil)
+
+	return body, err
+}
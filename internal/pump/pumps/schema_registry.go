@@ -0,0 +1,166 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+)
+
+// confluentMagicByte prefixes every payload framed with the Confluent wire format.
+const confluentMagicByte = 0
+
+// schemaRegistryTimeout bounds the requests to the schema registry made at initialization.
+const schemaRegistryTimeout = 10 * time.Second
+
+// analyticsJSONSchema is the JSON schema of the messages produced from analytics records.
+const analyticsJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "AnalyticsRecord",
+  "type": "object",
+  "properties": {
+    "timestamp": {"type": "integer"},
+    "username": {"type": "string"},
+    "effect": {"type": "string"},
+    "conclusion": {"type": "string"},
+    "request": {"type": "string"},
+    "policies": {"type": "string"},
+    "deciders": {"type": "string"},
+    "expireAt": {"type": "string"}
+  }
+}`
+
+// schemaRegistry is a minimal Confluent schema registry client which registers a schema under a
+// subject once and caches its id.
+type schemaRegistry struct {
+	url        string
+	subject    string
+	schemaType string
+	schema     string
+	username   string
+	password   string
+	client     *http.Client
+
+	mu sync.Mutex
+	id int32
+}
+
+func newSchemaRegistry(registryURL, subject, schemaType, schema, username, password string) *schemaRegistry {
+	return &schemaRegistry{
+		url:        strings.TrimSuffix(registryURL, "/"),
+		subject:    subject,
+		schemaType: schemaType,
+		schema:     schema,
+		username:   username,
+		password:   password,
+		client:     &http.Client{},
+	}
+}
+
+// schemaID returns the id of the schema in the registry, registering it on first use. Registering
+// an already registered schema is idempotent and returns its existing id.
+func (r *schemaRegistry) schemaID(ctx context.Context) (int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.id != 0 {
+		return r.id, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"schema": r.schema, "schemaType": r.schemaType})
+	reqURL := fmt.Sprintf("%s/subjects/%s/versions", r.url, url.PathEscape(r.subject))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create schema registry request")
+	}
+
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to register schema")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("schema registry", resp); err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, errors.Wrap(err, "failed to decode schema registry response")
+	}
+
+	r.id = result.ID
+
+	return r.id, nil
+}
+
+// latestSchema returns the latest version of the schema registered under the subject, and caches
+// its id.
+func (r *schemaRegistry) latestSchema(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reqURL := fmt.Sprintf("%s/subjects/%s/versions/latest", r.url, url.PathEscape(r.subject))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create schema registry request")
+	}
+
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get schema")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("schema registry", resp); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		ID     int32  `json:"id"`
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "failed to decode schema registry response")
+	}
+
+	r.id = result.ID
+	r.schema = result.Schema
+
+	return result.Schema, nil
+}
+
+// frame prefixes the payload with the Confluent wire format header: a magic byte followed by the
+// schema id as a 4 bytes big-endian integer.
+func frame(schemaID int32, payload []byte) []byte {
+	framed := make([]byte, 5+len(payload))
+	framed[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(framed[1:5], uint32(schemaID))
+	copy(framed[5:], payload)
+
+	return framed
+}
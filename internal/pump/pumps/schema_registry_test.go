@@ -0,0 +1,111 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestSchemaRegistry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/subjects/iam-analytics-value/versions" {
+			t.Errorf("unexpected registry path %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+
+	registry := newSchemaRegistry(server.URL, "iam-analytics-value", "JSON", analyticsJSONSchema, "", "")
+	for i := 0; i < 2; i++ {
+		id, err := registry.schemaID(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 42 {
+			t.Fatalf("expected schema id 42, got %d", id)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("schema id should be cached, registry called %d times", calls)
+	}
+
+	framed := frame(42, []byte("{}"))
+	expected := []byte{0, 0, 0, 0, 42, '{', '}'}
+	if string(framed) != string(expected) {
+		t.Fatalf("unexpected framing %v", framed)
+	}
+}
+
+func TestSchemaRegistryProtobuf(t *testing.T) {
+	var registered map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&registered)
+		_, _ = w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+
+	pmp := &KafkaPump{}
+	err := pmp.Init(map[string]interface{}{
+		"broker":              []string{"localhost:9092"},
+		"topic":               "iam",
+		"schema_registry_url": server.URL,
+		"protobuf":            true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pmp.registry.schemaID(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if registered["schemaType"] != "PROTOBUF" || registered["schema"] != analytics.ProtoSchema {
+		t.Fatalf("the subject should be registered with analytics.proto, got %s", registered["schemaType"])
+	}
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", ExpireAt: time.Unix(1600003600, 0)}
+	b := encodeProtobuf(&record)
+	fields := make(map[protowire.Number][]byte)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatalf("invalid protobuf record: %v", protowire.ParseError(n))
+		}
+		fields[num] = b[:n]
+		b = b[n:]
+	}
+	if timestamp, _ := protowire.ConsumeVarint(fields[1]); timestamp != 1600000000 {
+		t.Fatalf("unexpected timestamp %d", timestamp)
+	}
+	if username, _ := protowire.ConsumeString(fields[2]); username != "colin" {
+		t.Fatalf("unexpected username %s", username)
+	}
+	if _, ok := fields[8]; !ok || len(fields) != 3 {
+		t.Fatalf("only the fields set should be encoded, got %d fields", len(fields))
+	}
+
+	err = (&KafkaPump{}).Init(map[string]interface{}{
+		"broker":           []string{"localhost:9092"},
+		"topic":            "iam",
+		"protobuf":         true,
+		"avro_schema_file": "analytics.avsc",
+	})
+	if err == nil {
+		t.Fatal("protobuf and avro should be exclusive")
+	}
+}
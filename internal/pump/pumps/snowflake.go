@@ -0,0 +1,295 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	// the snowflake driver of database/sql, its PUT support uploads the batches to the stage
+	_ "github.com/snowflakedb/gosnowflake"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// snowflakeInitTimeout bounds the connection check and the table creation done by Init.
+const snowflakeInitTimeout = 30 * time.Second
+
+// snowflakeColumns defines the columns of the analytics table, loaded from the json keys of the
+// records matched by name.
+var snowflakeColumns = []struct {
+	name string
+	typ  string
+}{
+	{"timestamp", "NUMBER(19,0)"},
+	{"username", "VARCHAR"},
+	{"effect", "VARCHAR"},
+	{"conclusion", "VARCHAR"},
+	{"request", "VARCHAR"},
+	{"policies", "VARCHAR"},
+	{"deciders", "VARCHAR"},
+	{"expireAt", "TIMESTAMP_TZ"},
+	{"extra", "VARIANT"},
+}
+
+// snowflakeIdentifier matches the unquoted, optionally qualified, object names accepted in the
+// statements built by the pump.
+var snowflakeIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*){0,2}$`)
+
+// SnowflakePump defines a pump which loads the analytics records into a Snowflake table: every
+// batch is uploaded as a gzip NDJSON file to an internal stage, then copied into the table.
+//
+// The pump talks to Snowflake through database/sql with the Snowflake driver
+// (github.com/snowflakedb/gosnowflake), whose PUT support uploads the files to the stage.
+type SnowflakePump struct {
+	db   *sql.DB
+	conf *SnowflakeConf
+	CommonPumpConfig
+}
+
+// SnowflakeConf defines snowflake specific options.
+type SnowflakeConf struct {
+	// Driver is the name of the registered database/sql driver, snowflake by default.
+	Driver    string `mapstructure:"driver"`
+	Account   string `mapstructure:"account"`
+	User      string `mapstructure:"user"`
+	Role      string `mapstructure:"role"`
+	Warehouse string `mapstructure:"warehouse"`
+	Database  string `mapstructure:"database"`
+	Schema    string `mapstructure:"schema"`
+	Table     string `mapstructure:"table"`
+	// Stage is the internal stage the batches are uploaded to, the table stage by default.
+	Stage string `mapstructure:"stage"`
+	// Password authenticates the user, unless a PKCS8 private key is configured for key-pair
+	// authentication.
+	Password       string `mapstructure:"password"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	// DSN overrides the data source name built from the options above.
+	DSN string `mapstructure:"dsn"`
+}
+
+// New create a snowflake pump instance.
+func (s *SnowflakePump) New() Pump {
+	newPump := SnowflakePump{}
+
+	return &newPump
+}
+
+// GetName returns the snowflake pump name.
+func (s *SnowflakePump) GetName() string {
+	return "Snowflake Pump"
+}
+
+// Init initialize the snowflake pump instance, the analytics table is created if absent.
+func (s *SnowflakePump) Init(config interface{}) error {
+	s.conf = &SnowflakeConf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode snowflake configuration")
+	}
+
+	if s.conf.Driver == "" {
+		s.conf.Driver = "snowflake"
+	}
+
+	if s.conf.Table == "" {
+		s.conf.Table = "iam_analytics"
+	}
+
+	if !snowflakeIdentifier.MatchString(s.conf.Table) {
+		return errors.Errorf("snowflake table %s is not a valid identifier", s.conf.Table)
+	}
+
+	if s.conf.Stage == "" {
+		s.conf.Stage = "%" + s.conf.Table
+	}
+	s.conf.Stage = strings.TrimPrefix(s.conf.Stage, "@")
+	if !snowflakeIdentifier.MatchString(strings.TrimPrefix(s.conf.Stage, "%")) {
+		return errors.Errorf("snowflake stage %s is not a valid identifier", s.conf.Stage)
+	}
+
+	dsn, err := s.dsn()
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(s.conf.Driver, dsn)
+	if err != nil {
+		return errors.Wrap(err, "failed to open snowflake database")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snowflakeInitTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, s.createTableStatement()); err != nil {
+		_ = db.Close()
+
+		return errors.Wrapf(err, "failed to create snowflake table %s", s.conf.Table)
+	}
+
+	s.db = db
+
+	log.Infof("Snowflake pump loads into table %s through stage @%s", s.conf.Table, s.conf.Stage)
+
+	return nil
+}
+
+// dsn returns the data source name of the snowflake driver.
+func (s *SnowflakePump) dsn() (string, error) {
+	if s.conf.DSN != "" {
+		return s.conf.DSN, nil
+	}
+
+	if s.conf.Account == "" || s.conf.User == "" {
+		return "", errors.New("snowflake account and user must be set")
+	}
+
+	if s.conf.Database == "" || s.conf.Schema == "" {
+		return "", errors.New("snowflake database and schema must be set")
+	}
+
+	params := url.Values{}
+	if s.conf.Warehouse != "" {
+		params.Set("warehouse", s.conf.Warehouse)
+	}
+	if s.conf.Role != "" {
+		params.Set("role", s.conf.Role)
+	}
+
+	user := url.User(s.conf.User)
+	switch {
+	case s.conf.PrivateKeyFile != "":
+		key, err := snowflakePrivateKey(s.conf.PrivateKeyFile)
+		if err != nil {
+			return "", err
+		}
+		params.Set("authenticator", "SNOWFLAKE_JWT")
+		params.Set("privateKey", key)
+	case s.conf.Password != "":
+		user = url.UserPassword(s.conf.User, s.conf.Password)
+	default:
+		return "", errors.New("snowflake password or private_key_file must be set")
+	}
+
+	return fmt.Sprintf("%s@%s/%s/%s?%s", user.String(), s.conf.Account, s.conf.Database, s.conf.Schema,
+		params.Encode()), nil
+}
+
+// snowflakePrivateKey reads the PKCS8 private key of the key-pair authentication, encoded as
+// expected by the driver.
+func snowflakePrivateKey(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read snowflake private key")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.Errorf("snowflake private key %s is not PEM encoded", file)
+	}
+
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		return "", errors.Wrap(err, "snowflake private key must be an unencrypted PKCS8 key")
+	}
+
+	return base64.URLEncoding.EncodeToString(block.Bytes), nil
+}
+
+func (s *SnowflakePump) createTableStatement() string {
+	columns := make([]string, 0, len(snowflakeColumns))
+	for _, column := range snowflakeColumns {
+		columns = append(columns, fmt.Sprintf("%q %s", column.name, column.typ))
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", s.conf.Table, strings.Join(columns, ", "))
+}
+
+// WriteData uploads the analytics data to the stage as a gzip NDJSON file and copies it into the
+// table, within the deadline of the context.
+func (s *SnowflakePump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	file, err := os.CreateTemp("", "iam-analytics-*.json.gz")
+	if err != nil {
+		return errors.Wrap(err, "failed to create snowflake batch file")
+	}
+	defer os.Remove(file.Name())
+
+	written, err := writeNDJSON(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write snowflake batch file")
+	}
+
+	if written == 0 {
+		return nil
+	}
+
+	put := fmt.Sprintf("PUT 'file://%s' @%s AUTO_COMPRESS=FALSE SOURCE_COMPRESSION=GZIP OVERWRITE=TRUE",
+		filepath.ToSlash(file.Name()), s.conf.Stage)
+	if _, err := s.db.ExecContext(ctx, put); err != nil {
+		return errors.Wrap(err, "failed to upload batch to snowflake stage")
+	}
+
+	copyInto := fmt.Sprintf("COPY INTO %s FROM @%s FILES=('%s') FILE_FORMAT=(TYPE=JSON) "+
+		"MATCH_BY_COLUMN_NAME=CASE_INSENSITIVE ON_ERROR=ABORT_STATEMENT PURGE=TRUE",
+		s.conf.Table, s.conf.Stage, filepath.Base(file.Name()))
+	if _, err := s.db.ExecContext(ctx, copyInto); err != nil {
+		return errors.Wrapf(err, "failed to copy batch into snowflake table %s", s.conf.Table)
+	}
+
+	if info, err := os.Stat(file.Name()); err == nil {
+		addWrittenBytes(ctx, int(info.Size()))
+	}
+
+	return nil
+}
+
+// writeNDJSON writes the records gzip compressed, one json document per line, and returns the
+// number of records written.
+func writeNDJSON(file *os.File, data []interface{}) (int, error) {
+	zw := gzip.NewWriter(file)
+	encoder := json.NewEncoder(zw)
+
+	written := 0
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, zw.Close()
+}
+
+// Shutdown closes the database connection pool.
+func (s *SnowflakePump) Shutdown() error {
+	if s.db == nil {
+		return nil
+	}
+
+	return errors.Wrap(s.db.Close(), "failed to close snowflake connection pool")
+}
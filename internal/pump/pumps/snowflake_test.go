@@ -0,0 +1,127 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// snowflakeDriver is a database/sql driver recording the statements executed by the pump, and
+// the lines of the files it uploads.
+type snowflakeDriver struct {
+	mu         sync.Mutex
+	dsn        string
+	statements []string
+	lines      []string
+}
+
+func (d *snowflakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dsn = dsn
+
+	return &snowflakeConn{driver: d}, nil
+}
+
+type snowflakeConn struct {
+	driver *snowflakeDriver
+}
+
+func (c *snowflakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *snowflakeConn) Close() error { return nil }
+
+func (c *snowflakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *snowflakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	d := c.driver
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.statements = append(d.statements, query)
+	if strings.HasPrefix(query, "PUT 'file://") {
+		file, err := os.Open(strings.SplitN(strings.TrimPrefix(query, "PUT 'file://"), "'", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(zr)
+		for scanner.Scan() {
+			d.lines = append(d.lines, scanner.Text())
+		}
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+var testSnowflakeDriver = &snowflakeDriver{}
+
+func init() {
+	sql.Register("snowflake-test", testSnowflakeDriver)
+}
+
+func TestSnowflakePump(t *testing.T) {
+	pmp := (&SnowflakePump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"driver":    "snowflake-test",
+		"account":   "iam-eu",
+		"user":      "pump",
+		"password":  "secret",
+		"warehouse": "analytics_wh",
+		"database":  "iam",
+		"schema":    "public",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pmp.WriteData(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"},
+		analytics.AnalyticsRecord{TimeStamp: 1600000001, Username: "james"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := testSnowflakeDriver
+	if d.dsn != "pump:secret@iam-eu/iam/public?warehouse=analytics_wh" {
+		t.Fatalf("unexpected dsn %s", d.dsn)
+	}
+
+	if len(d.statements) != 3 || !strings.HasPrefix(d.statements[0], "CREATE TABLE IF NOT EXISTS iam_analytics") ||
+		!strings.Contains(d.statements[1], "@%iam_analytics") ||
+		!strings.HasPrefix(d.statements[2], "COPY INTO iam_analytics FROM @%iam_analytics FILES=('iam-analytics-") {
+		t.Fatalf("unexpected statements %v", d.statements)
+	}
+
+	if len(d.lines) != 2 || !strings.Contains(d.lines[1], `"username":"james"`) {
+		t.Fatalf("the records should be uploaded as NDJSON, got %v", d.lines)
+	}
+
+	if err := (&SnowflakePump{}).Init(map[string]interface{}{"driver": "snowflake-test", "table": "iam; DROP"}); err == nil {
+		t.Fatal("an invalid table name should be rejected")
+	}
+}
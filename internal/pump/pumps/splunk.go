@@ -0,0 +1,214 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the defaults of the splunk pump.
+const (
+	splunkEventPath              = "/services/collector/event"
+	defaultSplunkBatchSize       = 100
+	defaultSplunkBatchMaxBytes   = 1 << 20
+	defaultSplunkSourceType      = "_json"
+	splunkAuthorizationKeyPrefix = "Splunk "
+)
+
+// SplunkPump defines a pump which sends the analytics records as events to a Splunk HTTP Event
+// Collector, in batches of events.
+type SplunkPump struct {
+	conf   *SplunkConf
+	client *http.Client
+	format string
+
+	CommonPumpConfig
+}
+
+// SplunkConf defines splunk specific options.
+type SplunkConf struct {
+	// URL is the base url of the collector, e.g. https://splunk:8088, the events are posted to
+	// <url>/services/collector/event.
+	URL   string `mapstructure:"url"`
+	Token string `mapstructure:"token"`
+	// Source, SourceType, Index and Host are set on every event, the sourcetype is _json by
+	// default, the defaults of the token apply to the others.
+	Source     string `mapstructure:"source"`
+	SourceType string `mapstructure:"sourcetype"`
+	Index      string `mapstructure:"index"`
+	Host       string `mapstructure:"host"`
+	// BatchSize is the maximum number of events per request, 100 by default.
+	BatchSize int `mapstructure:"batch_size"`
+	// BatchMaxBytes is the maximum size in bytes of the events of a request before compression,
+	// 1MB by default. A single larger event is sent alone.
+	BatchMaxBytes int  `mapstructure:"batch_max_bytes"`
+	EnableGzip    bool `mapstructure:"enable_gzip"`
+	// The headers are sent with the requests, the metadata is set as indexed fields of the events.
+	HeadersConf           `mapstructure:",squash"`
+	SSLInsecureSkipVerify bool `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// New create a splunk pump instance.
+func (s *SplunkPump) New() Pump {
+	newPump := SplunkPump{}
+
+	return &newPump
+}
+
+// GetName returns the splunk pump name.
+func (s *SplunkPump) GetName() string {
+	return "Splunk HEC Pump"
+}
+
+// SetFormat sets the format the splunk events are written in.
+func (s *SplunkPump) SetFormat(format string) {
+	s.format = format
+}
+
+// Init initialize the splunk pump instance.
+func (s *SplunkPump) Init(config interface{}) error {
+	s.conf = &SplunkConf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode splunk configuration")
+	}
+
+	if s.conf.URL == "" || s.conf.Token == "" {
+		return errors.New("splunk url and token must be set")
+	}
+	s.conf.URL = strings.TrimSuffix(strings.TrimSuffix(s.conf.URL, "/"), splunkEventPath)
+
+	if s.conf.SourceType == "" {
+		s.conf.SourceType = defaultSplunkSourceType
+	}
+
+	if s.conf.BatchSize <= 0 {
+		s.conf.BatchSize = defaultSplunkBatchSize
+	}
+
+	if s.conf.BatchMaxBytes <= 0 {
+		s.conf.BatchMaxBytes = defaultSplunkBatchMaxBytes
+	}
+
+	s.client = &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		//nolint: gosec // skipping the verification is an explicit opt-in
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: s.conf.SSLInsecureSkipVerify},
+	}}
+
+	log.Infof("Splunk pump sends the records to %s%s", s.conf.URL, splunkEventPath)
+
+	return nil
+}
+
+// WriteData sends the analytics data as events, in batches of at most BatchSize events and
+// BatchMaxBytes bytes.
+func (s *SplunkPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	var (
+		batch  bytes.Buffer
+		events int
+	)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		event, err := json.Marshal(s.event(&record))
+		if err != nil {
+			log.Errorf("unable to marshal splunk event: %s", err.Error())
+
+			continue
+		}
+
+		if events > 0 && (events >= s.conf.BatchSize || batch.Len()+len(event) > s.conf.BatchMaxBytes) {
+			if err := s.send(ctx, batch.Bytes()); err != nil {
+				return err
+			}
+			batch.Reset()
+			events = 0
+		}
+
+		batch.Write(event)
+		events++
+	}
+
+	if events == 0 {
+		return nil
+	}
+
+	return s.send(ctx, batch.Bytes())
+}
+
+// event returns the collector event of the record.
+func (s *SplunkPump) event(record *analytics.AnalyticsRecord) map[string]interface{} {
+	event := map[string]interface{}{
+		"time":       record.TimeStamp,
+		"sourcetype": s.conf.SourceType,
+		"event":      recordMessage(s.format, record, nil, s.GetFieldPrecedence()),
+	}
+
+	for key, value := range map[string]string{"source": s.conf.Source, "index": s.conf.Index, "host": s.conf.Host} {
+		if value != "" {
+			event[key] = value
+		}
+	}
+
+	if fields := s.conf.metadata(record); fields != nil {
+		event["fields"] = fields
+	}
+
+	return event
+}
+
+// send posts the concatenated events of a batch to the collector.
+func (s *SplunkPump) send(ctx context.Context, events []byte) error {
+	body := events
+	if s.conf.EnableGzip {
+		compressed, err := gzipPayload(events)
+		if err != nil {
+			return err
+		}
+		body = compressed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.URL+splunkEventPath, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create splunk request")
+	}
+
+	req.Header.Set("Authorization", splunkAuthorizationKeyPrefix+s.conf.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.conf.EnableGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	s.conf.setHeaders(req.Header)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send events to splunk")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("splunk", resp); err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, len(body))
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestSplunkPump(t *testing.T) {
+	var batches [][]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/collector/event" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Splunk 00000000-0000-0000-0000-000000000000" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("the events should be compressed")
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batch []map[string]interface{}
+		decoder := json.NewDecoder(zr)
+		for decoder.More() {
+			var event map[string]interface{}
+			if err := decoder.Decode(&event); err != nil {
+				t.Fatal(err)
+			}
+			batch = append(batch, event)
+		}
+		batches = append(batches, batch)
+		_, _ = w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer server.Close()
+
+	pmp := (&SplunkPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"url":             server.URL + "/services/collector/event",
+		"token":           "00000000-0000-0000-0000-000000000000",
+		"source":          "iam-authz-server",
+		"sourcetype":      "iam:authorization",
+		"index":           "security",
+		"batch_size":      2,
+		"enable_gzip":     true,
+		"metadata_fields": map[string]string{"user": "username"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "allow"},
+		analytics.AnalyticsRecord{TimeStamp: 1600000001, Username: "admin", Effect: "deny"},
+		analytics.AnalyticsRecord{TimeStamp: 1600000002, Username: "alice", Effect: "allow"},
+	}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	event := batches[0][1]
+	if event["time"] != float64(1600000001) || event["source"] != "iam-authz-server" ||
+		event["sourcetype"] != "iam:authorization" || event["index"] != "security" {
+		t.Fatalf("unexpected event %v", event)
+	}
+	if fields, _ := event["fields"].(map[string]interface{}); fields["user"] != "admin" {
+		t.Fatalf("unexpected fields %v", event["fields"])
+	}
+	if body, _ := event["event"].(map[string]interface{}); body["effect"] != "deny" {
+		t.Fatalf("unexpected event body %v", event["event"])
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the services the sqs pump publishes the records to.
+const (
+	SQSServiceSQS = "sqs"
+	SQSServiceSNS = "sns"
+)
+
+// Defines the limits of the SendMessageBatch and PublishBatch actions.
+const (
+	sqsMaxBatchEntries    = 10
+	sqsMaxBatchBytes      = 256 << 10
+	defaultSQSGroupField  = "username"
+	sqsFIFOSuffix         = ".fifo"
+	sqsAPIVersion         = "2012-11-05"
+	snsAPIVersion         = "2010-03-31"
+	sqsFormContentType    = "application/x-www-form-urlencoded; charset=utf-8"
+	sqsThrottlingExcerpt  = "throttl"
+	sqsTooLongCodeExcerpt = "toolong"
+)
+
+// SQSPump defines a pump which publishes the analytics records as messages of an SQS queue or
+// of an SNS topic, in batches of at most 10 messages, e.g. to be processed by lambda functions.
+type SQSPump struct {
+	conf        *SQSConf
+	client      *http.Client
+	credentials *awsCredentialsChain
+	endpoint    string
+	fifo        bool
+	format      string
+
+	CommonPumpConfig
+}
+
+// SQSConf defines sqs specific options.
+type SQSConf struct {
+	// Service is sqs, the default, or sns.
+	Service string `mapstructure:"service"`
+	// QueueURL is the url of the queue the sqs messages are sent to.
+	QueueURL string `mapstructure:"queue_url"`
+	// TopicARN is the arn of the topic the sns messages are published to.
+	TopicARN string `mapstructure:"topic_arn"`
+	// Region is the region of the queue or topic, read from the queue url or topic arn, or from
+	// AWS_REGION, by default.
+	Region string `mapstructure:"region"`
+	// Endpoint overrides the endpoint of the service, e.g. of localstack.
+	Endpoint string `mapstructure:"endpoint"`
+	// The static keys, the credentials of the environment, of the profile of the shared
+	// credentials file, of the container or of the instance are used otherwise.
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	Profile         string `mapstructure:"profile"`
+	// MessageGroupField is the record field the message group of the FIFO queues and topics is
+	// set from, username by default. The messages are deduplicated by their content.
+	MessageGroupField string `mapstructure:"message_group_field"`
+	// The headers are sent with the requests, the metadata is set as the message attributes,
+	// of the Number type for numbers and of the String type otherwise.
+	HeadersConf `mapstructure:",squash"`
+}
+
+// sqsBatchResponse is the response of the SendMessageBatch and PublishBatch actions, only its
+// failed entries are decoded.
+type sqsBatchResponse struct {
+	SQSFailed []sqsFailedEntry `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+	SNSFailed []sqsFailedEntry `xml:"PublishBatchResult>Failed>member"`
+}
+
+type sqsFailedEntry struct {
+	ID          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+// New create a sqs pump instance.
+func (s *SQSPump) New() Pump {
+	newPump := SQSPump{}
+
+	return &newPump
+}
+
+// GetName returns the sqs pump name.
+func (s *SQSPump) GetName() string {
+	return "SQS/SNS Pump"
+}
+
+// SetFormat sets the format the messages are written in.
+func (s *SQSPump) SetFormat(format string) {
+	s.format = format
+}
+
+// Init initialize the sqs pump instance.
+func (s *SQSPump) Init(config interface{}) error {
+	s.conf = &SQSConf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode sqs configuration")
+	}
+
+	var target string
+	switch s.conf.Service {
+	case "", SQSServiceSQS:
+		s.conf.Service = SQSServiceSQS
+		if s.conf.QueueURL == "" {
+			return errors.New("sqs queue_url not set")
+		}
+		target = s.conf.QueueURL
+		s.endpoint = s.conf.QueueURL
+	case SQSServiceSNS:
+		if s.conf.TopicARN == "" {
+			return errors.New("sqs topic_arn not set")
+		}
+		target = s.conf.TopicARN
+	default:
+		return errors.Errorf("sqs service must be %s or %s", SQSServiceSQS, SQSServiceSNS)
+	}
+	s.fifo = strings.HasSuffix(target, sqsFIFOSuffix)
+
+	if s.conf.Region == "" {
+		s.conf.Region = sqsRegion(s.conf.Service, target)
+	}
+	if s.conf.Region == "" {
+		return errors.New("sqs region not set")
+	}
+
+	if s.conf.Service == SQSServiceSNS {
+		s.endpoint = "https://sns." + s.conf.Region + ".amazonaws.com/"
+	}
+	if s.conf.Endpoint != "" {
+		s.endpoint = s.conf.Endpoint
+	}
+
+	if s.conf.MessageGroupField == "" {
+		s.conf.MessageGroupField = defaultSQSGroupField
+	}
+
+	s.client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+	s.credentials = newAWSCredentialsChain(s.conf.AccessKeyID, s.conf.SecretAccessKey, s.conf.SessionToken,
+		s.conf.Profile)
+
+	log.Infof("SQS pump publishes the records to %s %s", s.conf.Service, target)
+
+	return nil
+}
+
+// sqsRegion returns the region of the queue url, sqs.<region>.amazonaws.com, or of the topic arn,
+// arn:aws:sns:<region>:<account>:<topic>, else the region of the environment.
+func sqsRegion(service string, target string) string {
+	if service == SQSServiceSNS {
+		if parts := strings.Split(target, ":"); len(parts) == 6 && parts[3] != "" {
+			return parts[3]
+		}
+	} else if u, err := url.Parse(target); err == nil {
+		if parts := strings.Split(u.Hostname(), "."); len(parts) >= 4 && parts[0] == "sqs" {
+			return parts[1]
+		}
+	}
+
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// WriteData publishes a message per record, in batches of at most 10 messages and 256KB. The
+// messages larger than 256KB are rejected.
+func (s *SQSPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	var (
+		messages []url.Values
+		size     int
+	)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		body, err := json.Marshal(recordMessage(s.format, &record, nil, s.GetFieldPrecedence()))
+		if err != nil {
+			log.Errorf("unable to marshal sqs message: %s", err.Error())
+
+			continue
+		}
+
+		if len(body) > sqsMaxBatchBytes {
+			s.reportRejection(RejectionPayloadTooLarge, 1,
+				errors.Errorf("message of %d bytes exceeds %d bytes", len(body), sqsMaxBatchBytes))
+
+			continue
+		}
+
+		if len(messages) == sqsMaxBatchEntries || size+len(body) > sqsMaxBatchBytes {
+			if err := s.send(ctx, messages); err != nil {
+				return err
+			}
+			messages, size = nil, 0
+		}
+
+		messages = append(messages, s.message(&record, body))
+		size += len(body)
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return s.send(ctx, messages)
+}
+
+// message returns the parameters of the batch entry of the record, without their prefix.
+func (s *SQSPump) message(record *analytics.AnalyticsRecord, body []byte) url.Values {
+	message := url.Values{}
+	if s.conf.Service == SQSServiceSNS {
+		message.Set("Message", string(body))
+	} else {
+		message.Set("MessageBody", string(body))
+	}
+
+	if s.fifo {
+		group := "-"
+		if value, ok := record.FieldValue(s.conf.MessageGroupField); ok && fmt.Sprint(value) != "" {
+			group = fmt.Sprint(value)
+		}
+		hash := sha256.Sum256(body)
+		message.Set("MessageGroupId", group)
+		message.Set("MessageDeduplicationId", hex.EncodeToString(hash[:]))
+	}
+
+	attribute, attributes := "MessageAttribute.", 1
+	if s.conf.Service == SQSServiceSNS {
+		attribute = "MessageAttributes.entry."
+	}
+	for name, value := range s.conf.metadata(record) {
+		prefix := attribute + strconv.Itoa(attributes) + "."
+		dataType := "String"
+		switch value.(type) {
+		case int, int64, float64:
+			dataType = "Number"
+		}
+		message.Set(prefix+"Name", name)
+		message.Set(prefix+"Value.DataType", dataType)
+		message.Set(prefix+"Value.StringValue", sqsAttributeValue(value))
+		attributes++
+	}
+
+	return message
+}
+
+// sqsAttributeValue returns the string value of a message attribute, the value itself for
+// strings and its json encoding otherwise.
+func sqsAttributeValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	b, _ := json.Marshal(value)
+
+	return string(b)
+}
+
+// send sends the messages with a SendMessageBatch or a PublishBatch request. The failed entries
+// do not fail the write, they are logged, and reported when throttled or too large.
+func (s *SQSPump) send(ctx context.Context, messages []url.Values) error {
+	form := url.Values{}
+	entry := "SendMessageBatchRequestEntry."
+	if s.conf.Service == SQSServiceSNS {
+		form.Set("Action", "PublishBatch")
+		form.Set("Version", snsAPIVersion)
+		form.Set("TopicArn", s.conf.TopicARN)
+		entry = "PublishBatchRequestEntries.member."
+	} else {
+		form.Set("Action", "SendMessageBatch")
+		form.Set("Version", sqsAPIVersion)
+		form.Set("QueueUrl", s.conf.QueueURL)
+	}
+
+	for i, message := range messages {
+		prefix := entry + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"Id", strconv.Itoa(i))
+		for key, values := range message {
+			form[prefix+key] = values
+		}
+	}
+
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create sqs request")
+	}
+	req.Header.Set("Content-Type", sqsFormContentType)
+	s.conf.setHeaders(req.Header)
+
+	credentials, err := s.credentials.retrieve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve sqs credentials")
+	}
+	signAWSRequest(req, payload, credentials, s.conf.Region, s.conf.Service, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send messages to %s", s.conf.Service)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(s.conf.Service, resp); err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s response", s.conf.Service)
+	}
+	addWrittenBytes(ctx, len(payload))
+
+	response := sqsBatchResponse{}
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return errors.Wrapf(err, "failed to decode %s response", s.conf.Service)
+	}
+
+	for _, failed := range append(response.SQSFailed, response.SNSFailed...) {
+		err := errors.Errorf("%s message rejected with %s: %s", s.conf.Service, failed.Code, failed.Message)
+		switch code := strings.ToLower(failed.Code); {
+		case strings.Contains(code, sqsThrottlingExcerpt):
+			s.reportRejection(RejectionRateLimited, 1, err)
+		case strings.Contains(code, sqsTooLongCodeExcerpt):
+			s.reportRejection(RejectionPayloadTooLarge, 1, err)
+		}
+		log.Errorf("Failed to publish a message of the batch: %s", err.Error())
+	}
+
+	return nil
+}
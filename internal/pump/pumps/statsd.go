@@ -0,0 +1,280 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the defaults of the statsd pump.
+const (
+	defaultStatsDAddr          = "localhost:8125"
+	defaultStatsDPrefix        = "iam."
+	defaultStatsDMaxPacketSize = 1432
+	statsDUnknownValue         = "unknown"
+)
+
+// StatsDPump defines a pump which does not store the analytics records but emits counters of the
+// requests per user, resource and effect, and timings of the decisions, to a StatsD server over
+// udp. The DogStatsD tags carry the dimensions when enabled, the metric names otherwise.
+type StatsDPump struct {
+	conf   *StatsDConf
+	writer *netWriter
+	tags   string
+
+	CommonPumpConfig
+}
+
+// StatsDConf defines statsd specific options.
+type StatsDConf struct {
+	NetworkAddr string `mapstructure:"network_addr"`
+	// Prefix is prepended to the metric names, iam. by default.
+	Prefix string `mapstructure:"prefix"`
+	// DogStatsD sets the user, resource and effect as tags of the metrics, e.g.
+	// iam.requests:1|c|#effect:allow,username:colin, instead of in their names, e.g.
+	// iam.users.colin.allow:1|c.
+	DogStatsD bool `mapstructure:"dogstatsd"`
+	// Tags are added to every metric when DogStatsD is enabled, e.g. env:prod.
+	Tags []string `mapstructure:"tags"`
+	// ResourceField is the record field, extra field or attribute of the authorization request
+	// holding the resource the requests are counted per, resource by default.
+	ResourceField string `mapstructure:"resource_field"`
+	// LatencyField is the record field holding the duration of the authorization decision in
+	// milliseconds, the decision timings are not emitted when it is not set.
+	LatencyField string `mapstructure:"latency_field"`
+	// SampleRateField is the field of the sample rate of the records, see DefaultSampleRateField.
+	SampleRateField string `mapstructure:"sample_rate_field"`
+	// MaxPacketSize is the maximum size of the datagrams the metrics are packed in, 1432 by
+	// default, 8932 suits the jumbo frames of the local networks.
+	MaxPacketSize int `mapstructure:"max_packet_size"`
+}
+
+// New create a statsd pump instance.
+func (s *StatsDPump) New() Pump {
+	newPump := StatsDPump{}
+
+	return &newPump
+}
+
+// GetName returns the statsd pump name.
+func (s *StatsDPump) GetName() string {
+	return "StatsD Pump"
+}
+
+// Init initialize the statsd pump instance, the socket is opened by the first write.
+func (s *StatsDPump) Init(config interface{}) error {
+	s.conf = &StatsDConf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode statsd configuration")
+	}
+
+	if s.conf.NetworkAddr == "" {
+		s.conf.NetworkAddr = defaultStatsDAddr
+	}
+
+	if s.conf.Prefix == "" {
+		s.conf.Prefix = defaultStatsDPrefix
+	}
+
+	if s.conf.SampleRateField == "" {
+		s.conf.SampleRateField = DefaultSampleRateField
+	}
+
+	if s.conf.ResourceField == "" {
+		s.conf.ResourceField = "resource"
+	}
+
+	if s.conf.MaxPacketSize <= 0 {
+		s.conf.MaxPacketSize = defaultStatsDMaxPacketSize
+	}
+
+	tags := make([]string, 0, len(s.conf.Tags))
+	for _, tag := range s.conf.Tags {
+		tags = append(tags, statsDTagValue(tag))
+	}
+	s.tags = strings.Join(tags, ",")
+
+	s.writer = &netWriter{network: "udp", addr: s.conf.NetworkAddr}
+
+	log.Infof("StatsD pump emits the request metrics to %s", s.conf.NetworkAddr)
+
+	return nil
+}
+
+// WriteData emits the metrics of the analytics data, the counters of a batch are summed before
+// being sent.
+func (s *StatsDPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	counters := make(map[string]float64)
+	var timings []string
+	for _, item := range data {
+		record, ok := item.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		weight := sampleWeight(&record, s.conf.SampleRateField, s.GetCountField())
+		effect := s.dimension(record.Effect)
+		username := s.dimension(record.Username)
+
+		var request map[string]interface{}
+		resource := statsDUnknownValue
+		if value, ok := attributeValue(&record, s.conf.ResourceField, &request); ok {
+			resource = s.dimension(fmt.Sprint(value))
+		}
+
+		if s.conf.DogStatsD {
+			counters[s.metric("requests", "effect:"+effect, "username:"+username)] += weight
+			counters[s.metric("resource_requests", "effect:"+effect, "resource:"+resource)] += weight
+		} else {
+			counters[s.metric("requests."+effect)] += weight
+			counters[s.metric("users."+username+"."+effect)] += weight
+			counters[s.metric("resources."+resource+"."+effect)] += weight
+		}
+
+		if s.conf.LatencyField == "" {
+			continue
+		}
+		value, ok := record.FieldValue(s.conf.LatencyField)
+		if !ok {
+			continue
+		}
+		ms, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil || ms < 0 {
+			continue
+		}
+
+		name := s.metric("decision_time." + effect)
+		if s.conf.DogStatsD {
+			name = s.metric("decision_time", "effect:"+effect)
+		}
+		timings = append(timings, statsDLine(name, ms, "ms", weight))
+	}
+
+	lines := make([]string, 0, len(counters)+len(timings))
+	for name, count := range counters {
+		lines = append(lines, statsDLine(name, count, "c", 1))
+	}
+	sort.Strings(lines)
+
+	return s.send(ctx, append(lines, timings...))
+}
+
+// metric returns the name of a metric with its tags, separated by a tab as the names cannot hold
+// one, the tags being sent after the type and sample rate of the metric.
+func (s *StatsDPump) metric(name string, tags ...string) string {
+	if !s.conf.DogStatsD {
+		return s.conf.Prefix + name
+	}
+
+	if s.tags != "" {
+		tags = append(tags, s.tags)
+	}
+
+	return s.conf.Prefix + name + "\t" + strings.Join(tags, ",")
+}
+
+// statsDLine returns the line of a metric, name:value|type[|@rate][|#tags].
+func statsDLine(metric string, value float64, typ string, weight float64) string {
+	name, tags, _ := strings.Cut(metric, "\t")
+
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ
+	if weight > 1 {
+		line += "|@" + strconv.FormatFloat(1/weight, 'g', 6, 64)
+	}
+	if tags != "" {
+		line += "|#" + tags
+	}
+
+	return line
+}
+
+// send packs the lines in datagrams of at most MaxPacketSize bytes, a longer line is sent alone.
+func (s *StatsDPump) send(ctx context.Context, lines []string) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+
+		n, err := s.writer.write(ctx, packet.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "failed to send statsd metrics")
+		}
+		addWrittenBytes(ctx, n)
+		packet.Reset()
+
+		return nil
+	}
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.conf.MaxPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	return flush()
+}
+
+// dimension returns the value of a tag, or of a segment of the metric names without DogStatsD,
+// unknown when empty.
+func (s *StatsDPump) dimension(value string) string {
+	if value == "" {
+		return statsDUnknownValue
+	}
+
+	if s.conf.DogStatsD {
+		return statsDTagValue(value)
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ':' {
+			return '_'
+		}
+
+		return r
+	}, statsDTagValue(value))
+}
+
+// statsDTagValue returns the value of a tag without the characters separating the tags, replaced
+// with underscores.
+func statsDTagValue(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', '@', '#', ',', '\n', '\t', ' ':
+			return '_'
+		}
+
+		return r
+	}, tag)
+}
+
+// Shutdown closes the socket of the pump.
+func (s *StatsDPump) Shutdown() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	return errors.Wrap(s.writer.close(), "failed to close statsd socket")
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func readStatsDLines(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > 256 {
+			t.Fatalf("datagram of %d bytes exceeds the packet size", n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestStatsDPump(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{Username: "colin", Effect: "allow",
+			Extra: map[string]interface{}{"resource": "articles:1", "latency": 3, "rate": int64(10)}},
+		analytics.AnalyticsRecord{Username: "colin", Effect: "allow",
+			Extra: map[string]interface{}{"resource": "articles:1"}},
+		analytics.AnalyticsRecord{Username: "admin", Effect: "deny"},
+	}
+
+	tests := []struct {
+		name string
+		conf map[string]interface{}
+		want []string
+	}{
+		{
+			name: "statsd",
+			conf: map[string]interface{}{},
+			want: []string{
+				"iam.requests.allow:11|c",
+				"iam.requests.deny:1|c",
+				"iam.users.colin.allow:11|c",
+				"iam.resources.articles_1.allow:11|c",
+				"iam.resources.unknown.deny:1|c",
+				"iam.decision_time.allow:3|ms|@0.1",
+			},
+		},
+		{
+			name: "dogstatsd",
+			conf: map[string]interface{}{"dogstatsd": true, "tags": []string{"env:test"}},
+			want: []string{
+				"iam.requests:11|c|#effect:allow,username:colin,env:test",
+				"iam.requests:1|c|#effect:deny,username:admin,env:test",
+				"iam.resource_requests:11|c|#effect:allow,resource:articles:1,env:test",
+				"iam.decision_time:3|ms|@0.1|#effect:allow,env:test",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf["network_addr"] = conn.LocalAddr().String()
+			tt.conf["latency_field"] = "latency"
+			tt.conf["sample_rate_field"] = "rate"
+			tt.conf["max_packet_size"] = 256
+
+			pmp := (&StatsDPump{}).New()
+			if err := pmp.Init(tt.conf); err != nil {
+				t.Fatal(err)
+			}
+			defer pmp.Shutdown()
+
+			if err := pmp.WriteData(context.Background(), data); err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Join(readStatsDLines(t, conn), "\n")
+			for _, want := range tt.want {
+				if !strings.Contains("\n"+lines+"\n", "\n"+want+"\n") {
+					t.Errorf("missing metric %s in\n%s", want, lines)
+				}
+			}
+		})
+	}
+}
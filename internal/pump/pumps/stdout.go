@@ -0,0 +1,119 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// StdoutPump defines a pump which prints the analytics records to the standard output, one json
+// document per line, to be collected from the container logs, e.g. by Fluent Bit or Vector.
+type StdoutPump struct {
+	conf   *StdoutConf
+	format string
+
+	mu  sync.Mutex
+	out io.Writer
+
+	CommonPumpConfig
+}
+
+// StdoutConf defines stdout specific options.
+type StdoutConf struct {
+	// Fields are the fields of the documents printed, all of them when not set. They are the top
+	// level fields of the documents of the format, e.g. user rather than user.name in ecs.
+	Fields []string `mapstructure:"fields"`
+}
+
+// New create a stdout pump instance.
+func (s *StdoutPump) New() Pump {
+	newPump := StdoutPump{}
+
+	return &newPump
+}
+
+// GetName returns the stdout pump name.
+func (s *StdoutPump) GetName() string {
+	return "Stdout Pump"
+}
+
+// SetFormat sets the format the stdout documents are written in.
+func (s *StdoutPump) SetFormat(format string) {
+	s.format = format
+}
+
+// Init initialize the stdout pump instance.
+func (s *StdoutPump) Init(config interface{}) error {
+	s.conf = &StdoutConf{}
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return errors.Wrap(err, "failed to decode stdout configuration")
+	}
+
+	if s.out == nil {
+		s.out = os.Stdout
+	}
+
+	log.Debug("Stdout Pump active")
+
+	return nil
+}
+
+// WriteData prints a json document per record, the documents of the batch are printed at once
+// so that the lines of concurrent writes do not interleave.
+func (s *StdoutPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		if err := encoder.Encode(s.document(&record)); err != nil {
+			log.Errorf("unable to marshal stdout document: %s", err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.out.Write(lines.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to write to stdout")
+	}
+	addWrittenBytes(ctx, n)
+
+	return nil
+}
+
+// document returns the document of the record, restricted to the configured fields.
+func (s *StdoutPump) document(record *analytics.AnalyticsRecord) Message {
+	message := recordMessage(s.format, record, nil, s.GetFieldPrecedence())
+	if len(s.conf.Fields) == 0 {
+		return message
+	}
+
+	document := make(Message, len(s.conf.Fields))
+	for _, name := range s.conf.Fields {
+		if value, ok := message[name]; ok {
+			document[name] = value
+		}
+	}
+
+	return document
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestStdoutPump(t *testing.T) {
+	var out bytes.Buffer
+	pmp := &StdoutPump{out: &out}
+	if err := pmp.Init(map[string]interface{}{"fields": []string{"username", "effect", "region"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Effect: "allow", Policies: "[]"}
+	record.SetExtra("region", "eu")
+	data := []interface{}{record, analytics.AnalyticsRecord{Username: "admin", Effect: "deny"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"effect":"allow","region":"eu","username":"colin"}` + "\n" +
+		`{"effect":"deny","username":"admin"}` + "\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected output %q, expected %q", out.String(), expected)
+	}
+}
@@ -7,20 +7,46 @@ package pumps
 import (
 	"context"
 	"fmt"
-	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/marmotedu/errors"
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/marmotedu/iam/internal/pump/analytics"
 	"github.com/marmotedu/iam/pkg/log"
 )
 
+// Defines the protocols the syslog messages are written with.
+const (
+	// SyslogRFC3164 writes the messages of log/syslog, `<PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG`,
+	// newline framed on the stream transports.
+	SyslogRFC3164 = "rfc3164"
+	// SyslogRFC5424 writes the messages of RFC 5424 with the structured data of the records,
+	// octet counting framed on the stream transports as required by RFC 5425.
+	SyslogRFC5424 = "rfc5424"
+)
+
+// Defines the defaults of the syslog pump.
+const (
+	defaultSyslogSDID        = "iam@32473"
+	syslogMaxParamNameLength = 32
+)
+
+// defaultSyslogStructuredData are the fields set as the structured data of the RFC 5424 messages
+// when none are configured.
+var defaultSyslogStructuredData = []string{"username", "effect", "resource", "action"}
+
 // SyslogPump defines a syslog pump with syslog specific options and common options.
 type SyslogPump struct {
 	syslogConf *SyslogConf
-	writer     *syslog.Writer
+	writer     *netWriter
 	filters    analytics.AnalyticsFilters
 	timeout    int
+	format     string
+	marshaler  Marshaler
 	CommonPumpConfig
 }
 
@@ -28,10 +54,28 @@ var logPrefix = "syslog-pump"
 
 // SyslogConf defines syslog specific options.
 type SyslogConf struct {
+	// Transport is udp, the default, tcp or tls.
 	Transport   string `mapstructure:"transport"`
 	NetworkAddr string `mapstructure:"network_addr"`
-	LogLevel    int    `mapstructure:"log_level"`
-	Tag         string `mapstructure:"tag"`
+	// LogLevel is the priority of the messages, the facility times 8 plus the severity.
+	LogLevel int    `mapstructure:"log_level"`
+	Tag      string `mapstructure:"tag"`
+	// Protocol is rfc3164, the default, or rfc5424.
+	Protocol string `mapstructure:"protocol"`
+	// Hostname is the host the messages are sent from, the name of the host by default.
+	Hostname string `mapstructure:"hostname"`
+	// MsgID is the MSGID of the RFC 5424 messages, nil by default.
+	MsgID string `mapstructure:"msg_id"`
+	// SDID is the SD-ID of the structured data of the RFC 5424 messages, iam@32473 by default.
+	SDID string `mapstructure:"sd_id"`
+	// StructuredData are the record fields, extra fields or attributes of the authorization
+	// request set as the parameters of the structured data of the RFC 5424 messages.
+	StructuredData []string `mapstructure:"structured_data"`
+	// The certificates of the tls transport, the system roots verify the server by default.
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
 }
 
 // New create a syslog pump instance.
@@ -46,45 +90,55 @@ func (s *SyslogPump) GetName() string {
 	return "Syslog Pump"
 }
 
-// Init initialize the syslog pump instance.
+// SetFormat sets the format the syslog messages are written in.
+func (s *SyslogPump) SetFormat(format string) {
+	s.format = format
+}
+
+// SetMarshaler sets the marshaler serializing the syslog messages, they are printed as go maps
+// when no marshaler is set.
+func (s *SyslogPump) SetMarshaler(marshaler Marshaler) {
+	s.marshaler = marshaler
+}
+
+// Init initialize the syslog pump instance, the connection is established by the first write.
 func (s *SyslogPump) Init(config interface{}) error {
 	// Read configuration file
 	s.syslogConf = &SyslogConf{}
-	err := mapstructure.Decode(config, &s.syslogConf)
-	if err != nil {
-		log.Fatalf("Failed to decode configuration: %s", err.Error())
+	if err := mapstructure.Decode(config, &s.syslogConf); err != nil {
+		return errors.Wrap(err, "failed to decode syslog configuration")
 	}
 
 	// Init the configs
-	initConfigs(s)
+	if err := initConfigs(s); err != nil {
+		return err
+	}
 
 	// Init the Syslog writer
-	initWriter(s)
+	if err := initWriter(s); err != nil {
+		return err
+	}
 
 	log.Debug("Syslog Pump active")
 
 	return nil
 }
 
-func initWriter(s *SyslogPump) {
-	tag := logPrefix
-	if s.syslogConf.Tag != "" {
-		tag = s.syslogConf.Tag
-	}
-	syslogWriter, err := syslog.Dial(
-		s.syslogConf.Transport,
-		s.syslogConf.NetworkAddr,
-		syslog.Priority(s.syslogConf.LogLevel),
-		tag)
-	if err != nil {
-		log.Fatalf("failed to connect to Syslog Daemon: %s", err.Error())
+func initWriter(s *SyslogPump) error {
+	s.writer = &netWriter{network: s.syslogConf.Transport, addr: s.syslogConf.NetworkAddr}
+	if s.syslogConf.Transport != "tls" {
+		return nil
 	}
 
-	s.writer = syslogWriter
+	var err error
+	s.writer.tlsConfig, err = loadTLSConfig(s.syslogConf.SSLCAFile, s.syslogConf.SSLCertFile,
+		s.syslogConf.SSLKeyFile, s.syslogConf.SSLInsecureSkipVerify)
+
+	return errors.Wrap(err, "invalid syslog tls options")
 }
 
 // Set default values if they are not explicitly given and perform validation.
-func initConfigs(pump *SyslogPump) {
+func initConfigs(pump *SyslogPump) error {
 	if pump.syslogConf.Transport == "" {
 		pump.syslogConf.Transport = "udp"
 		log.Info("No Transport given, using 'udp'")
@@ -93,7 +147,7 @@ func initConfigs(pump *SyslogPump) {
 	if pump.syslogConf.Transport != "udp" &&
 		pump.syslogConf.Transport != "tcp" &&
 		pump.syslogConf.Transport != "tls" {
-		log.Fatal("Chosen invalid Transport type.  Please use a supported Transport type for Syslog")
+		return errors.Errorf("syslog transport %s is not supported, use udp, tcp or tls", pump.syslogConf.Transport)
 	}
 
 	if pump.syslogConf.NetworkAddr == "" {
@@ -104,6 +158,36 @@ func initConfigs(pump *SyslogPump) {
 	if pump.syslogConf.LogLevel == 0 {
 		log.Warn("Using Log Level 0 (KERNEL) for Syslog pump")
 	}
+
+	if pump.syslogConf.LogLevel < 0 || pump.syslogConf.LogLevel > 191 {
+		return errors.Errorf("syslog log_level %d is not a valid priority", pump.syslogConf.LogLevel)
+	}
+
+	switch pump.syslogConf.Protocol {
+	case "":
+		pump.syslogConf.Protocol = SyslogRFC3164
+	case SyslogRFC3164, SyslogRFC5424:
+	default:
+		return errors.Errorf("syslog protocol must be %s or %s", SyslogRFC3164, SyslogRFC5424)
+	}
+
+	if pump.syslogConf.Tag == "" {
+		pump.syslogConf.Tag = logPrefix
+	}
+
+	if pump.syslogConf.Hostname == "" {
+		pump.syslogConf.Hostname, _ = os.Hostname()
+	}
+
+	if pump.syslogConf.SDID == "" {
+		pump.syslogConf.SDID = defaultSyslogSDID
+	}
+
+	if len(pump.syslogConf.StructuredData) == 0 {
+		pump.syslogConf.StructuredData = defaultSyslogStructuredData
+	}
+
+	return nil
 }
 
 // WriteData write analyzed data to syslog persistent back-end storage.
@@ -116,25 +200,130 @@ func (s *SyslogPump) WriteData(ctx context.Context, data []interface{}) error {
 		default:
 			// Decode the raw analytics into Form
 			decoded, _ := v.(analytics.AnalyticsRecord)
-			message := Message{
-				"timestamp":  decoded.TimeStamp,
-				"username":   decoded.Username,
-				"effect":     decoded.Effect,
-				"conclusion": decoded.Conclusion,
-				"request":    decoded.Request,
-				"policies":   decoded.Policies,
-				"deciders":   decoded.Deciders,
-				"expireAt":   decoded.ExpireAt,
+			message := recordMessage(s.format, &decoded, nil, s.GetFieldPrecedence())
+
+			payload := []byte(fmt.Sprintf("%s", message))
+			if s.marshaler != nil {
+				var err error
+				if payload, err = s.marshaler.Marshal(message); err != nil {
+					log.Errorf("Failed to marshal syslog message: %s", err.Error())
+
+					continue
+				}
 			}
 
-			// Print to Syslog
-			_, _ = fmt.Fprintf(s.writer, "%s", message)
+			n, err := s.writer.write(ctx, s.frame(&decoded, payload, time.Now()))
+			if err != nil {
+				return errors.Wrap(err, "failed to write to syslog")
+			}
+			addWrittenBytes(ctx, n)
 		}
 	}
 
 	return nil
 }
 
+// frame returns the syslog message of the record with its framing on the stream transports.
+func (s *SyslogPump) frame(record *analytics.AnalyticsRecord, payload []byte, now time.Time) []byte {
+	timestamp := now
+	if record.TimeStamp != 0 {
+		timestamp = time.Unix(record.TimeStamp, 0)
+	}
+
+	conf := s.syslogConf
+	if conf.Protocol == SyslogRFC3164 {
+		message := fmt.Sprintf("<%d>%s %s %s[%d]: %s", conf.LogLevel, timestamp.Format(time.RFC3339),
+			conf.Hostname, conf.Tag, os.Getpid(), payload)
+		if conf.Transport != "udp" && !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+
+		return []byte(message)
+	}
+
+	message := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", conf.LogLevel, timestamp.UTC().Format(time.RFC3339),
+		syslogHeaderValue(conf.Hostname, 255), syslogHeaderValue(conf.Tag, 48), os.Getpid(),
+		syslogHeaderValue(conf.MsgID, 32), s.structuredData(record), payload)
+	if conf.Transport == "udp" {
+		return []byte(message)
+	}
+
+	return []byte(strconv.Itoa(len(message)) + " " + message)
+}
+
+// structuredData returns the structured data element of the record, or the nil value when none
+// of the structured data fields is set.
+func (s *SyslogPump) structuredData(record *analytics.AnalyticsRecord) string {
+	var (
+		element strings.Builder
+		request map[string]interface{}
+	)
+	for _, name := range s.syslogConf.StructuredData {
+		value, ok := attributeValue(record, name, &request)
+		if !ok {
+			continue
+		}
+
+		element.WriteString(" " + syslogParamName(name) + `="` +
+			strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(fmt.Sprint(value)) + `"`)
+	}
+
+	if element.Len() == 0 {
+		return "-"
+	}
+
+	return "[" + syslogParamName(s.syslogConf.SDID) + element.String() + "]"
+}
+
+// syslogHeaderValue returns the printable ascii value of a header field of the RFC 5424
+// messages, truncated to its maximum length, or the nil value when empty.
+func syslogHeaderValue(value string, maxLength int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+
+		return r
+	}, value)
+
+	if value == "" {
+		return "-"
+	}
+
+	if len(value) > maxLength {
+		value = value[:maxLength]
+	}
+
+	return value
+}
+
+// syslogParamName returns a valid SD-ID or PARAM-NAME of the structured data, without the
+// characters they cannot hold.
+func syslogParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+
+		return r
+	}, syslogHeaderValue(name, syslogMaxParamNameLength))
+
+	if name == "" {
+		return "-"
+	}
+
+	return name
+}
+
+// Shutdown closes the connection to the syslog daemon.
+func (s *SyslogPump) Shutdown() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	return errors.Wrap(s.writer.close(), "failed to close syslog writer")
+}
+
 // SetTimeout set attributes `timeout` for SyslogPump.
 func (s *SyslogPump) SetTimeout(timeout int) {
 	s.timeout = timeout
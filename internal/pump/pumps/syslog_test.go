@@ -0,0 +1,140 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestSyslogPumpRFC5424(t *testing.T) {
+	record := analytics.AnalyticsRecord{
+		TimeStamp: 1600000000,
+		Username:  "colin",
+		Effect:    "deny",
+		Request:   `{"resource":"resources:articles:[1]","action":"delete"}`,
+	}
+
+	pmp := &SyslogPump{syslogConf: &SyslogConf{
+		Transport: "tcp",
+		LogLevel:  134,
+		Protocol:  SyslogRFC5424,
+		Hostname:  "iam-pump-0",
+		Tag:       "iam-pump",
+	}}
+	if err := initConfigs(pmp); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := string(pmp.frame(&record, []byte("denied"), time.Now()))
+	message := `<134>1 2020-09-13T12:26:40Z iam-pump-0 iam-pump `
+	if !strings.Contains(frame, message) {
+		t.Fatalf("unexpected header %s", frame)
+	}
+
+	length, message, _ := strings.Cut(frame, " ")
+	if length != strconv.Itoa(len(message)) {
+		t.Fatalf("the message should be octet counting framed, got %s", frame)
+	}
+
+	sd := `- [iam@32473 username="colin" effect="deny" resource="resources:articles:[1\]" action="delete"] denied`
+	if !strings.HasSuffix(frame, sd) {
+		t.Fatalf("unexpected structured data %s", frame)
+	}
+}
+
+func TestSyslogPumpTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	defer server.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	pmp := (&SyslogPump{}).New()
+	err = pmp.Init(map[string]interface{}{
+		"transport":                "tls",
+		"network_addr":             listener.Addr().String(),
+		"log_level":                134,
+		"ssl_insecure_skip_verify": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-received:
+		if !strings.HasPrefix(line, "<134>") || !strings.Contains(line, "syslog-pump[") {
+			t.Fatalf("unexpected message %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestSyslogPumpUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pmp := (&SyslogPump{}).New()
+	err = pmp.Init(map[string]interface{}{
+		"network_addr": conn.LocalAddr().String(),
+		"log_level":    134,
+		"protocol":     "rfc5424",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message := string(buf[:n]); !strings.HasPrefix(message, "<134>1 ") ||
+		!strings.Contains(message, `[iam@32473 username="colin"`) {
+		t.Fatalf("unexpected datagram %s", message)
+	}
+}
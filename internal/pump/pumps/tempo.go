@@ -0,0 +1,245 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// otlpSpanKindServer is the OTLP kind of the spans derived from the authorization requests.
+const otlpSpanKindServer = 2
+
+// TempoPump defines a pump which converts analytics records into trace spans and exports them
+// with OTLP/HTTP to Grafana Tempo or any OTLP compatible tracing back-end.
+type TempoPump struct {
+	conf   *TempoConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// TempoConf defines tempo specific options.
+type TempoConf struct {
+	// Endpoint is the OTLP/HTTP base url, the spans are posted to <endpoint>/v1/traces.
+	Endpoint    string `mapstructure:"endpoint"`
+	ServiceName string `mapstructure:"service_name"`
+	SpanName    string `mapstructure:"span_name"`
+	BatchSize   int    `mapstructure:"batch_size"`
+	// The metadata of the records is set as span attributes.
+	HeadersConf `mapstructure:",squash"`
+	// Attributes maps the span attribute names to the record fields they are set from.
+	Attributes map[string]string `mapstructure:"attributes"`
+	// TraceIDField and SpanIDField are the record fields holding the hex encoded ids of the trace
+	// the authorization belongs to, random ids are used when missing.
+	TraceIDField string `mapstructure:"trace_id_field"`
+	SpanIDField  string `mapstructure:"span_id_field"`
+	// DurationField is the record field holding the duration of the authorization in milliseconds.
+	DurationField string `mapstructure:"duration_field"`
+}
+
+// New create a tempo pump instance.
+func (t *TempoPump) New() Pump {
+	newPump := TempoPump{}
+
+	return &newPump
+}
+
+// GetName returns the tempo pump name.
+func (t *TempoPump) GetName() string {
+	return "Tempo Pump"
+}
+
+// Init initialize the tempo pump instance.
+func (t *TempoPump) Init(config interface{}) error {
+	t.conf = &TempoConf{}
+	if err := mapstructure.Decode(config, &t.conf); err != nil {
+		return errors.Wrap(err, "failed to decode tempo configuration")
+	}
+
+	if t.conf.Endpoint == "" {
+		return errors.New("tempo endpoint not set")
+	}
+	t.conf.Endpoint = strings.TrimSuffix(t.conf.Endpoint, "/")
+
+	if t.conf.ServiceName == "" {
+		t.conf.ServiceName = "iam-authz-server"
+	}
+
+	if t.conf.SpanName == "" {
+		t.conf.SpanName = "authorize"
+	}
+
+	if t.conf.BatchSize <= 0 {
+		t.conf.BatchSize = 512
+	}
+
+	if len(t.conf.Attributes) == 0 {
+		t.conf.Attributes = map[string]string{
+			"iam.username":   "username",
+			"iam.effect":     "effect",
+			"iam.conclusion": "conclusion",
+		}
+	}
+
+	t.client = &http.Client{}
+
+	log.Infof("Tempo pump exports spans to %s/v1/traces", t.conf.Endpoint)
+
+	return nil
+}
+
+// WriteData converts the analytics data into spans and exports them in batches.
+func (t *TempoPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	spans := make([]map[string]interface{}, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		spans = append(spans, t.span(&record))
+	}
+
+	for start := 0; start < len(spans); start += t.conf.BatchSize {
+		end := start + t.conf.BatchSize
+		if end > len(spans) {
+			end = len(spans)
+		}
+
+		if err := t.export(ctx, spans[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *TempoPump) export(ctx context.Context, spans []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{otlpAttribute("service.name", t.conf.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": otlpScope(),
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spans")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.conf.Endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create tempo request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	t.conf.setHeaders(req.Header)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to export spans to tempo")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse("tempo", resp); err != nil {
+		return err
+	}
+
+	addWrittenBytes(ctx, len(body))
+
+	return nil
+}
+
+// span converts a record into an OTLP span, in the OTLP/JSON encoding.
+func (t *TempoPump) span(record *analytics.AnalyticsRecord) map[string]interface{} {
+	start := time.Unix(record.TimeStamp, 0)
+	end := start
+	if t.conf.DurationField != "" {
+		if value, ok := record.FieldValue(t.conf.DurationField); ok {
+			if ms, err := strconv.ParseFloat(fmt.Sprint(value), 64); err == nil && ms > 0 {
+				end = start.Add(time.Duration(ms * float64(time.Millisecond)))
+			}
+		}
+	}
+
+	metadata := t.conf.metadata(record)
+	attributes := make([]interface{}, 0, len(t.conf.Attributes)+len(metadata))
+	for name, field := range t.conf.Attributes {
+		if value, ok := record.FieldValue(field); ok {
+			attributes = append(attributes, otlpAttribute(name, value))
+		}
+	}
+	for name, value := range metadata {
+		attributes = append(attributes, otlpAttribute(name, value))
+	}
+
+	return map[string]interface{}{
+		"traceId":           t.id(record, t.conf.TraceIDField, 16),
+		"spanId":            t.id(record, t.conf.SpanIDField, 8),
+		"name":              t.conf.SpanName,
+		"kind":              otlpSpanKindServer,
+		"startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attributes,
+	}
+}
+
+// id returns the hex encoded id held by the record field, or a random id of size bytes.
+func (t *TempoPump) id(record *analytics.AnalyticsRecord, field string, size int) string {
+	if id, ok := otlpRecordID(record, field, size); ok {
+		return id
+	}
+
+	return randomOTLPID(size)
+}
+
+// randomOTLPID returns a random hex encoded id of size bytes.
+func randomOTLPID(size int) string {
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// otlpRecordID returns the hex encoded id of size bytes held by the record field, if valid.
+func otlpRecordID(record *analytics.AnalyticsRecord, field string, size int) (string, bool) {
+	if field == "" {
+		return "", false
+	}
+
+	value, ok := record.FieldValue(field)
+	if !ok {
+		return "", false
+	}
+
+	id := fmt.Sprint(value)
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 2*size {
+		return "", false
+	}
+
+	return strings.ToLower(id), true
+}
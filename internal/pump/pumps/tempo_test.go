@@ -0,0 +1,72 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestTempoPump(t *testing.T) {
+	var requests int
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID           string `json:"traceId"`
+					StartTimeUnixNano string `json:"startTimeUnixNano"`
+					EndTimeUnixNano   string `json:"endTimeUnixNano"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	pmp := (&TempoPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"endpoint":       server.URL,
+		"batch_size":     1,
+		"trace_id_field": "trace_id",
+		"duration_field": "duration",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}
+	record.SetExtra("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736")
+	record.SetExtra("duration", 250)
+
+	data := []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000}, record}
+	if err := pmp.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 2 {
+		t.Fatalf("expected one request per batch, got %d", requests)
+	}
+
+	span := payload.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("span should belong to the record trace, got %s", span.TraceID)
+	}
+
+	if span.StartTimeUnixNano != "1600000000000000000" || span.EndTimeUnixNano != "1600000000250000000" {
+		t.Fatalf("unexpected span timing %s - %s", span.StartTimeUnixNano, span.EndTimeUnixNano)
+	}
+}
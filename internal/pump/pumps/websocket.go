@@ -0,0 +1,266 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/marmotedu/component-base/pkg/json"
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the defaults of the websocket connection.
+const (
+	defaultWebsocketDialTimeout       = 10
+	defaultWebsocketReconnectAttempts = 3
+	defaultWebsocketReconnectBackoff  = 500
+	maxWebsocketReconnectBackoff      = 30 * time.Second
+	websocketCloseTimeout             = time.Second
+)
+
+// WebsocketPump defines a pump which streams the analytics records as json messages, one per
+// record, over a connection to a WebSocket server, e.g. to feed live dashboards. The connection is
+// kept open between the writes and reestablished when it fails.
+type WebsocketPump struct {
+	conf   *WebsocketConf
+	dialer *websocket.Dialer
+	header http.Header
+	format string
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	closed chan struct{}
+
+	CommonPumpConfig
+}
+
+// WebsocketConf defines websocket specific options.
+type WebsocketConf struct {
+	// URL is the ws:// or wss:// url of the server.
+	URL string `mapstructure:"url"`
+	// Origin is sent in the handshake, the http(s) url of the server host by default.
+	Origin   string `mapstructure:"origin"`
+	Protocol string `mapstructure:"protocol"`
+	// The headers are sent in the handshake, the metadata is added to the messages.
+	HeadersConf           `mapstructure:",squash"`
+	SSLInsecureSkipVerify bool `mapstructure:"ssl_insecure_skip_verify"`
+	// DialTimeout bounds the handshake in seconds, 10 by default.
+	DialTimeout int `mapstructure:"dial_timeout"`
+	// ReconnectAttempts is the number of reconnections tried by a write when the connection
+	// fails, 3 by default, negative to fail the write at once.
+	ReconnectAttempts int `mapstructure:"reconnect_attempts"`
+	// ReconnectBackoff is the delay in milliseconds before the first reconnection, doubled for the
+	// next ones up to 30s, 500 by default.
+	ReconnectBackoff int `mapstructure:"reconnect_backoff"`
+}
+
+// New create a websocket pump instance.
+func (w *WebsocketPump) New() Pump {
+	newPump := WebsocketPump{}
+
+	return &newPump
+}
+
+// GetName returns the websocket pump name.
+func (w *WebsocketPump) GetName() string {
+	return "WebSocket Pump"
+}
+
+// SetFormat sets the format the websocket messages are written in.
+func (w *WebsocketPump) SetFormat(format string) {
+	w.format = format
+}
+
+// Init initialize the websocket pump instance, the connection is established by the first write.
+func (w *WebsocketPump) Init(config interface{}) error {
+	w.conf = &WebsocketConf{}
+	if err := mapstructure.Decode(config, &w.conf); err != nil {
+		return errors.Wrap(err, "failed to decode websocket configuration")
+	}
+
+	location, err := url.Parse(w.conf.URL)
+	if err != nil || (location.Scheme != "ws" && location.Scheme != "wss") {
+		return errors.Errorf("websocket url %s must be a ws:// or wss:// url", w.conf.URL)
+	}
+
+	if w.conf.Origin == "" {
+		origin := url.URL{Scheme: "http", Host: location.Host}
+		if location.Scheme == "wss" {
+			origin.Scheme = "https"
+		}
+		w.conf.Origin = origin.String()
+	}
+
+	if w.conf.DialTimeout <= 0 {
+		w.conf.DialTimeout = defaultWebsocketDialTimeout
+	}
+
+	if w.conf.ReconnectAttempts == 0 {
+		w.conf.ReconnectAttempts = defaultWebsocketReconnectAttempts
+	}
+
+	if w.conf.ReconnectBackoff <= 0 {
+		w.conf.ReconnectBackoff = defaultWebsocketReconnectBackoff
+	}
+
+	w.dialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Duration(w.conf.DialTimeout) * time.Second,
+		//nolint: gosec // skipping the verification is an explicit opt-in
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: w.conf.SSLInsecureSkipVerify},
+	}
+	if w.conf.Protocol != "" {
+		w.dialer.Subprotocols = []string{w.conf.Protocol}
+	}
+
+	w.header = http.Header{}
+	w.conf.setHeaders(w.header)
+	w.header.Set("Origin", w.conf.Origin)
+
+	log.Infof("WebSocket pump streams the records to %s", w.conf.URL)
+
+	return nil
+}
+
+// WriteData sends a json message per record, within the deadline of the context. A failed
+// connection is reestablished and the remaining messages are sent again, up to
+// ReconnectAttempts times.
+func (w *WebsocketPump) WriteData(ctx context.Context, data []interface{}) error {
+	log.Debugf("Writing %d records", len(data))
+
+	messages := make([][]byte, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		message := recordMessage(w.format, &record, w.conf.metadata(&record), w.GetFieldPrecedence())
+
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			log.Errorf("unable to marshal websocket message: %s", err.Error())
+
+			continue
+		}
+		messages = append(messages, encoded)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	backoff := time.Duration(w.conf.ReconnectBackoff) * time.Millisecond
+	sent, size := 0, 0
+	for attempt := 0; ; attempt++ {
+		err := w.connect(ctx)
+		for err == nil && sent < len(messages) {
+			if err = w.send(ctx, messages[sent]); err == nil {
+				size += len(messages[sent])
+				sent++
+			}
+		}
+
+		if err == nil {
+			addWrittenBytes(ctx, size)
+
+			return nil
+		}
+
+		w.disconnect()
+		if ctx.Err() != nil || attempt >= w.conf.ReconnectAttempts {
+			addWrittenBytes(ctx, size)
+
+			return errors.Wrapf(err, "failed to send %d websocket messages", len(messages)-sent)
+		}
+
+		log.Warnf("WebSocket connection to %s failed, reconnecting in %s: %s", w.conf.URL, backoff, err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+
+		if backoff *= 2; backoff > maxWebsocketReconnectBackoff {
+			backoff = maxWebsocketReconnectBackoff
+		}
+	}
+}
+
+// connect establishes the connection if it is not open, within the deadline of the context.
+func (w *WebsocketPump) connect(ctx context.Context) error {
+	if w.conn != nil {
+		select {
+		case <-w.closed:
+			// the server closed the connection since the last write
+			w.disconnect()
+		default:
+			return nil
+		}
+	}
+
+	conn, resp, err := w.dialer.DialContext(ctx, w.conf.URL, w.header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to websocket server %s", w.conf.URL)
+	}
+	closed := make(chan struct{})
+	w.conn, w.closed = conn, closed
+
+	// the frames sent by the server are read so that its pings are answered and its close noticed,
+	// the messages are discarded
+	go func() {
+		defer close(closed)
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (w *WebsocketPump) send(ctx context.Context, message []byte) error {
+	deadline, _ := ctx.Deadline()
+	if err := w.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	return w.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// disconnect closes the connection, telling the server when it is still open.
+func (w *WebsocketPump) disconnect() {
+	if w.conn == nil {
+		return
+	}
+
+	_ = w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(websocketCloseTimeout))
+	_ = w.conn.Close()
+	w.conn = nil
+}
+
+// Shutdown closes the connection to the server.
+func (w *WebsocketPump) Shutdown() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.disconnect()
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestWebsocketPump(t *testing.T) {
+	var mu sync.Mutex
+	var messages []map[string]interface{}
+	var tokens []string
+	connections := 0
+
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		mu.Lock()
+		connections++
+		first := connections == 1
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mu.Unlock()
+
+		for {
+			var message map[string]interface{}
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+
+			mu.Lock()
+			messages = append(messages, message)
+			mu.Unlock()
+
+			// the first connection is dropped after a message, the pump reconnects
+			if first {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	pmp := (&WebsocketPump{}).New()
+	err := pmp.Init(map[string]interface{}{
+		"url":               "ws" + strings.TrimPrefix(server.URL, "http"),
+		"headers":           map[string]string{"Authorization": "Bearer token"},
+		"static_metadata":   map[string]string{"cluster": "prod"},
+		"reconnect_backoff": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmp.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := pmp.WriteData(ctx, []interface{}{analytics.AnalyticsRecord{Username: "colin"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the server drop the first connection
+	time.Sleep(50 * time.Millisecond)
+
+	data := []interface{}{analytics.AnalyticsRecord{Username: "alice"}, analytics.AnalyticsRecord{Username: "bob"}}
+	if err := pmp.WriteData(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		received := len(messages)
+		mu.Unlock()
+		if received == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(messages) != 3 || connections != 2 {
+		encoded, _ := json.Marshal(messages)
+		t.Fatalf("expected 3 messages over 2 connections, got %s over %d", encoded, connections)
+	}
+
+	for i, username := range []string{"colin", "alice", "bob"} {
+		if messages[i]["username"] != username || messages[i]["cluster"] != "prod" {
+			t.Errorf("unexpected message %v", messages[i])
+		}
+	}
+
+	for _, token := range tokens {
+		if token != "Bearer token" {
+			t.Errorf("the headers should be sent in the handshake, got %q", token)
+		}
+	}
+}
+
+func TestWebsocketPumpInit(t *testing.T) {
+	if err := (&WebsocketPump{}).Init(map[string]interface{}{"url": "http://localhost"}); err == nil {
+		t.Error("a non websocket url should be rejected")
+	}
+
+	pmp := &WebsocketPump{}
+	if err := pmp.Init(map[string]interface{}{"url": "wss://dashboard.example.com/ws"}); err != nil {
+		t.Fatal(err)
+	}
+	if pmp.conf.Origin != "https://dashboard.example.com" {
+		t.Errorf("unexpected default origin %s", pmp.conf.Origin)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"sync"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+)
+
+// backgroundWorkers runs the background tasks of all the pumps: the parts of the multipart
+// uploads, the compression of the rotated files and the asynchronous mongo inserts.
+var backgroundWorkers = &workerPool{}
+
+// SetMaxBackgroundWorkers caps the number of goroutines running the background tasks of the pumps,
+// 0 means no cap. It is set before the pumps are initialized.
+func SetMaxBackgroundWorkers(max int) {
+	backgroundWorkers.setMax(max)
+}
+
+// workerPool runs tasks in at most max goroutines. The tasks submitted while all the workers are
+// busy are queued, and run in submission order by the workers once their task is done.
+type workerPool struct {
+	mu      sync.Mutex
+	max     int
+	workers int
+	queue   []func()
+}
+
+func (p *workerPool) setMax(max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.max = max
+	metrics.BackgroundWorkersMax.Set(float64(max))
+
+	// a raised cap starts workers for the queued tasks
+	for len(p.queue) > 0 && (p.max == 0 || p.workers < p.max) {
+		p.start(p.dequeue())
+	}
+}
+
+// run runs the task in a worker, or queues it when all the workers are busy. The tasks must not
+// wait for other tasks of the pool, they could wait forever for a worker.
+func (p *workerPool) run(task func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.max > 0 && p.workers >= p.max {
+		p.queue = append(p.queue, task)
+		metrics.BackgroundTasksQueued.Set(float64(len(p.queue)))
+
+		return
+	}
+
+	p.start(task)
+}
+
+// start runs the task in a new worker, p.mu must be held.
+func (p *workerPool) start(task func()) {
+	p.workers++
+	metrics.BackgroundWorkers.Set(float64(p.workers))
+
+	go p.work(task)
+}
+
+// dequeue returns the first queued task, p.mu must be held.
+func (p *workerPool) dequeue() func() {
+	task := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	metrics.BackgroundTasksQueued.Set(float64(len(p.queue)))
+
+	return task
+}
+
+// work runs the task, then the queued tasks until none is left or the cap was lowered.
+func (p *workerPool) work(task func()) {
+	for task != nil {
+		task()
+
+		p.mu.Lock()
+		task = nil
+		if len(p.queue) > 0 && (p.max == 0 || p.workers <= p.max) {
+			task = p.dequeue()
+		} else {
+			p.workers--
+			metrics.BackgroundWorkers.Set(float64(p.workers))
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pumps
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := &workerPool{}
+	pool.setMax(2)
+
+	var running, peak int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		pool.run(func() {
+			defer wg.Done()
+
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&peak)
+				if current <= max || atomic.CompareAndSwapInt32(&peak, max, current) {
+					break
+				}
+			}
+
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	pool.mu.Lock()
+	workers, queued := pool.workers, len(pool.queue)
+	pool.mu.Unlock()
+	if workers != 2 || queued != 4 {
+		t.Fatalf("expected 2 workers and 4 queued tasks, got %d and %d", workers, queued)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("expected at most 2 tasks at a time, got %d", peak)
+	}
+
+	// the queued tasks run in submission order
+	pool.setMax(1)
+	var order []int
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		i := i
+		pool.run(func() {
+			defer wg.Done()
+			order = append(order, i)
+		})
+	}
+	wg.Wait()
+
+	for i, task := range order {
+		if task != i {
+			t.Fatalf("unexpected order %v", order)
+		}
+	}
+}
+
+func TestWorkerPoolRaisedCap(t *testing.T) {
+	pool := &workerPool{}
+	pool.setMax(1)
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pool.run(func() {
+		defer wg.Done()
+		<-release
+	})
+	started := make(chan struct{})
+	pool.run(func() {
+		defer wg.Done()
+		close(started)
+	})
+
+	// the queued task starts once the cap is raised, without waiting for the running one
+	pool.setMax(0)
+	<-started
+	close(release)
+	wg.Wait()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.workers != 0 || len(pool.queue) != 0 {
+		t.Errorf("expected the workers to exit, got %d workers and %d queued", pool.workers, len(pool.queue))
+	}
+}
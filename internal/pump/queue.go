@@ -0,0 +1,222 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"sync"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// pumpQueue is the bounded queue of a pump written asynchronously: the purge loop pushes the
+// records of every window to it and a dedicated goroutine drains it to the pump, so that a slow
+// pump does not hold the write of the next window to the other pumps. When the queue is full the
+// records are handled according to its policy.
+type pumpQueue struct {
+	pmp        *pumpInstance
+	capacity   int
+	policy     string
+	purgeDelay int
+
+	mu      sync.Mutex
+	notFull *sync.Cond
+	records []interface{}
+	closed  bool
+	ready   chan struct{}
+	done    chan struct{}
+}
+
+// newPumpQueue creates the queue of the pump and starts draining it.
+func newPumpQueue(pmp *pumpInstance, capacity int, policy string, purgeDelay int) *pumpQueue {
+	if policy == "" {
+		policy = options.QueuePolicyBlock
+	}
+
+	q := &pumpQueue{
+		pmp:        pmp,
+		capacity:   capacity,
+		policy:     policy,
+		purgeDelay: purgeDelay,
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	q.notFull = sync.NewCond(&q.mu)
+
+	log.Infof("Pump %s is written asynchronously through a queue of %d records (%s when full)",
+		pmp.name, capacity, policy)
+	go q.run()
+
+	return q
+}
+
+// push queues the records of the window, it only blocks with the block policy while the queue is full. A batch
+// larger than the queue is accepted once the queue is empty with the block policy.
+func (q *pumpQueue) push(window context.Context, records []interface{}) {
+	if len(records) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	var dropped []interface{}
+	switch q.policy {
+	case options.QueuePolicyDropNewest:
+		room := q.capacity - len(q.records)
+		if room < 0 {
+			room = 0
+		}
+		if room < len(records) {
+			dropped = records[room:]
+			records = records[:room]
+		}
+		q.records = append(q.records, records...)
+	case options.QueuePolicyDropOldest:
+		q.records = append(q.records, records...)
+		if excess := len(q.records) - q.capacity; excess > 0 {
+			dropped = q.records[:excess]
+			q.records = append([]interface{}(nil), q.records[excess:]...)
+		}
+	default:
+		for len(q.records) > 0 && len(q.records)+len(records) > q.capacity && !q.closed {
+			q.notFull.Wait()
+		}
+		q.records = append(q.records, records...)
+	}
+	metrics.QueuedRecords.WithLabelValues(q.pmp.name).Set(float64(len(q.records)))
+	q.mu.Unlock()
+
+	if len(dropped) > 0 {
+		log.Warnf("Queue of pump %s is full, %d records dropped (%s)", q.pmp.name, len(dropped), q.policy)
+		metrics.QueueDrops.WithLabelValues(q.pmp.name, q.policy).Add(float64(len(dropped)))
+		auditOf(window).addDropped(len(dropped))
+		q.pmp.drops.sample(q.pmp.name, dropReasonQueue, dropped...)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued records to the pump until the queue is closed and drained.
+func (q *pumpQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.mu.Lock()
+		for len(q.records) == 0 && !q.closed {
+			q.mu.Unlock()
+			<-q.ready
+			q.mu.Lock()
+		}
+		records := q.records
+		q.records = nil
+		closed := q.closed
+		metrics.QueuedRecords.WithLabelValues(q.pmp.name).Set(0)
+		q.notFull.Broadcast()
+		q.mu.Unlock()
+
+		if len(records) > 0 {
+			// the queued records are written asynchronously, beyond the window they were read in
+			_ = writePump(context.Background(), q.pmp, &records, q.purgeDelay)
+		}
+
+		if closed && len(records) == 0 {
+			return
+		}
+	}
+}
+
+// close stops accepting records and waits for the queued ones to be written.
+func (q *pumpQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	pending := len(q.records)
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+
+	if pending > 0 {
+		log.Infof("Flushing %d records queued for pump %s", pending, q.pmp.name)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	<-q.done
+}
+
+// startQueues creates the queues of the pumps written asynchronously. The pumps not configuring a
+// queue get the default one, except the pumps retaining the source data which are written in the
+// window.
+func (s *pumpServer) startQueues() {
+	for _, pmp := range s.pmps {
+		// the pumps kept running by a reload keep their queue
+		if pmp.queue != nil {
+			continue
+		}
+
+		size, policy := s.pumpQueueSize(pmp), pmp.config.QueuePolicy
+		if policy == "" {
+			policy = s.queuePolicy
+		}
+
+		if size > 0 {
+			pmp.queue = newPumpQueue(pmp, size, policy, s.secInterval)
+		}
+	}
+}
+
+// pumpQueueSize returns the size of the queue of the pump, its own or the default one unless it
+// retains the source data. 0 writes the pump in the window.
+func (s *pumpServer) pumpQueueSize(pmp *pumpInstance) int {
+	if pmp.config.QueueSize == 0 && !pmp.retainSource {
+		return s.queueSize
+	}
+
+	return pmp.config.QueueSize
+}
+
+// closeQueues waits for the records queued for the pumps to be written, it is called at shutdown.
+func (s *pumpServer) closeQueues() {
+	closePumpQueues(s.pmps)
+}
+
+// closePumpQueues waits for the records queued for the given pumps to be written.
+func closePumpQueues(instances []*pumpInstance) {
+	var wg sync.WaitGroup
+	for _, pmp := range instances {
+		if pmp.queue == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(queue *pumpQueue) {
+			defer wg.Done()
+
+			queue.close()
+		}(pmp.queue)
+	}
+	wg.Wait()
+}
+
+// send writes the batch to the pump in a goroutine accounted by wg, or pushes it to the queue of
+// the pump, in which case wg only waits for the batch to be queued.
+func (p *pumpInstance) send(window context.Context, wg *sync.WaitGroup, batch []interface{}, purgeDelay int) {
+	wg.Add(1)
+	if p.queue == nil {
+		go execPumpWriting(window, wg, p, &batch, purgeDelay)
+
+		return
+	}
+
+	go func() {
+		defer wg.Done()
+
+		p.queue.push(window, batch)
+	}()
+}
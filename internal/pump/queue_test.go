@@ -0,0 +1,97 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+// slowPump records the batches written to it once released.
+type slowPump struct {
+	mockPump
+	release chan struct{}
+}
+
+func (p *slowPump) WriteData(ctx context.Context, data []interface{}) error {
+	<-p.release
+
+	return p.mockPump.WriteData(ctx, data)
+}
+
+func TestPumpQueue(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		expected []string
+	}{
+		{policy: options.QueuePolicyDropNewest, expected: []string{"a", "b", "c"}},
+		{policy: options.QueuePolicyDropOldest, expected: []string{"a", "c", "d"}},
+	} {
+		slow := &slowPump{release: make(chan struct{})}
+		fast := &mockPump{}
+		s := &pumpServer{
+			secInterval: 1,
+			pmps: []*pumpInstance{
+				{Pump: slow, name: "slow", config: options.PumpConfig{QueueSize: 2, QueuePolicy: test.policy}},
+				{Pump: fast, name: "fast"},
+			},
+		}
+		s.startQueues()
+
+		for _, username := range []string{"a", "b", "c", "d"} {
+			s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{Username: username}})
+			// let the queue take the first record before the next window
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if len(fast.records()) != 4 {
+			t.Fatalf("the fast pump should not wait for the slow one, got %d records", len(fast.records()))
+		}
+
+		close(slow.release)
+		s.closeQueues()
+
+		written := slow.records()
+		if len(written) != len(test.expected) {
+			t.Fatalf("%s: expected records %v, got %v", test.policy, test.expected, written)
+		}
+		for i, username := range test.expected {
+			if record, _ := written[i].(analytics.AnalyticsRecord); record.Username != username {
+				t.Fatalf("%s: expected records %v, got %v", test.policy, test.expected, written)
+			}
+		}
+	}
+}
+
+func TestDefaultQueue(t *testing.T) {
+	s := &pumpServer{
+		secInterval: 1,
+		queueSize:   100,
+		queuePolicy: options.QueuePolicyDropOldest,
+		pmps: []*pumpInstance{
+			{Pump: &mockPump{}, name: "default"},
+			{Pump: &mockPump{}, name: "own", config: options.PumpConfig{QueueSize: 5, QueuePolicy: options.QueuePolicyBlock}},
+			{Pump: &mockPump{}, name: "retaining", retainSource: true},
+		},
+	}
+	s.startQueues()
+	defer s.closeQueues()
+
+	if queue := s.pmps[0].queue; queue == nil || queue.capacity != 100 || queue.policy != options.QueuePolicyDropOldest {
+		t.Fatalf("the pump should get the default queue, got %+v", queue)
+	}
+
+	if queue := s.pmps[1].queue; queue == nil || queue.capacity != 5 || queue.policy != options.QueuePolicyBlock {
+		t.Fatalf("the pump should keep its own queue, got %+v", queue)
+	}
+
+	if s.pmps[2].queue != nil {
+		t.Fatal("the pump retaining the source data should be written in the window")
+	}
+}
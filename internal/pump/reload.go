@@ -0,0 +1,160 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/marmotedu/errors"
+	"github.com/spf13/viper"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// reload applies the pumps and the timeouts of the updated options. It runs in the purge loop
+// between two windows. The pumps whose configuration is unchanged keep running, the removed and
+// changed ones write the records buffered and queued for them before they are shut down, and the
+// previous pumps are initialized again when the new ones fail to. The other options are only
+// applied by a restart, the options reported by the control api are those applied.
+func (s *pumpServer) reload(updated *options.Options) {
+	// the windows of the additional sources write to the pumps under the read lock, the retired
+	// pumps are only stopped once no window is writing to them
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.windowDeadline = time.Duration(updated.WindowDeadline) * time.Second
+	s.shutdownTimeout = time.Duration(updated.ShutdownTimeout) * time.Second
+
+	applied := *s.options
+	applied.WindowDeadline, applied.ShutdownTimeout = updated.WindowDeadline, updated.ShutdownTimeout
+	s.options = &applied
+	reloaded := applied
+	reloaded.Pumps, reloaded.Routes, reloaded.DefaultPumps = updated.Pumps, updated.Routes, updated.DefaultPumps
+	if !reflect.DeepEqual(&reloaded, updated) {
+		log.Warn("The options other than the pumps, their routes and the timeouts are only applied by a restart")
+	}
+
+	if reflect.DeepEqual(updated.Pumps, s.pumps) && reflect.DeepEqual(updated.Routes, s.routes) &&
+		reflect.DeepEqual(updated.DefaultPumps, s.defaultPumps) {
+		log.Info("The pumps configuration is unchanged, nothing to reload")
+		s.options = &reloaded
+
+		return
+	}
+
+	running := make(map[string]*pumpInstance, len(s.pmps))
+	var retired []*pumpInstance
+	for _, pmp := range s.instances() {
+		if config, ok := updated.Pumps[pmp.name]; ok && reflect.DeepEqual(config, s.pumps[pmp.name]) {
+			running[pmp.name] = pmp
+		} else {
+			retired = append(retired, pmp)
+		}
+	}
+
+	log.Infof("Reloading the configuration of %d pumps, %d of them unchanged", len(updated.Pumps), len(running))
+	s.stopPumps(retired)
+
+	pumps, routes, defaults := s.pumps, s.routes, s.defaultPumps
+	if err := s.initializePumps(updated.Pumps, updated.Routes, updated.DefaultPumps, running); err != nil {
+		log.Errorf("Failed to reload the pumps, restoring the previous ones: %s", err.Error())
+		var started []*pumpInstance
+		for _, pmp := range s.instances() {
+			if running[pmp.name] != pmp {
+				started = append(started, pmp)
+			}
+		}
+		shutdownPumpInstances(started)
+
+		if err := s.initializePumps(pumps, routes, defaults, running); err != nil {
+			log.Errorf("Failed to restore the previous pumps: %s", err.Error())
+		}
+
+		return
+	}
+
+	s.options = &reloaded
+	log.Infof("Reloaded %d pumps", len(s.pmps))
+}
+
+// stopPumps writes the records buffered and queued for the pumps, then shuts them down.
+func (s *pumpServer) stopPumps(instances []*pumpInstance) {
+	s.flushPumpBuffers(instances)
+	closePumpQueues(instances)
+	shutdownPumpInstances(instances)
+}
+
+// initializePumps initializes the pumps of the given configuration in place of the current ones,
+// except the running ones which are kept.
+func (s *pumpServer) initializePumps(configs map[string]options.PumpConfig, routes []options.Route,
+	defaults []string, running map[string]*pumpInstance) error {
+	s.pumps, s.routes, s.defaultPumps = configs, routes, defaults
+	s.keepRaw = false
+	if s.drops != nil {
+		s.drops.sink = nil
+	}
+
+	return s.initializeKeeping(running)
+}
+
+// readConfig reads the configuration file of iam-pump again, overridden by the remote
+// configuration when one is read, as at startup.
+func readConfig() (*options.Options, error) {
+	if viper.ConfigFileUsed() == "" {
+		return nil, errors.New("iam-pump was not started with a configuration file")
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, "failed to read configuration file")
+	}
+
+	opts := options.NewOptions()
+	if err := viper.Unmarshal(opts); err != nil {
+		return nil, errors.Wrap(err, "failed to decode configuration file")
+	}
+
+	if err := opts.Complete(); err != nil {
+		return nil, err
+	}
+
+	if errs := opts.Validate(); len(errs) != 0 {
+		return nil, errors.NewAggregate(errs)
+	}
+
+	return opts, nil
+}
+
+// reloadConfig reads the configuration file again and hands it to the purge loop, which reloads
+// it between two windows. A reload still pending is replaced.
+func (s *pumpServer) reloadConfig() {
+	opts, err := readConfig()
+	if err != nil {
+		log.Errorf("Failed to reload the configuration: %s", err.Error())
+
+		return
+	}
+
+	log.Infof("Reloading the configuration file %s", viper.ConfigFileUsed())
+	select {
+	case <-s.reloads:
+	default:
+	}
+
+	select {
+	case s.reloads <- opts:
+	default:
+	}
+}
+
+// watchConfig reloads the configuration file whenever it changes.
+func (s *pumpServer) watchConfig() {
+	viper.OnConfigChange(func(fsnotify.Event) {
+		s.reloadConfig()
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func TestReload(t *testing.T) {
+	opts := options.NewOptions()
+	opts.Pumps = map[string]options.PumpConfig{"dummy": {}}
+	s := &pumpServer{secInterval: 1, pumps: opts.Pumps, options: opts, strict: true}
+	if err := s.initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := options.NewOptions()
+	updated.Pumps = map[string]options.PumpConfig{
+		"first":  {Type: "dummy", Meta: map[string]interface{}{"id": 1}},
+		"second": {Type: "dummy", Meta: map[string]interface{}{"id": 2}, Order: 1},
+	}
+	updated.PurgeDelay = opts.PurgeDelay + 1
+	s.reload(updated)
+
+	if len(s.pmps) != 2 || s.pmps[0].name != "first" || s.pmps[1].name != "second" ||
+		!reflect.DeepEqual(s.options.Pumps, updated.Pumps) {
+		t.Fatalf("expected the updated pumps, got %v", s.pmps)
+	}
+	if s.options.PurgeDelay != opts.PurgeDelay {
+		t.Errorf("the options only applied by a restart should be reported as running, got %d", s.options.PurgeDelay)
+	}
+
+	// the previous pumps are restored when the updated ones fail to initialize
+	invalid := options.NewOptions()
+	invalid.Pumps = map[string]options.PumpConfig{"unknown": {}}
+	s.reload(invalid)
+
+	if len(s.pmps) != 2 || s.pmps[0].name != "first" || !reflect.DeepEqual(s.options.Pumps, updated.Pumps) {
+		t.Fatalf("expected the previous pumps to be restored, got %v", s.pmps)
+	}
+
+	// an unchanged configuration keeps the running pumps
+	running := s.pmps[0]
+	s.reload(updated)
+	if s.pmps[0] != running {
+		t.Error("an unchanged configuration should not reinitialize the pumps")
+	}
+}
+
+func TestReloadKeepsUnchangedPumps(t *testing.T) {
+	opts := options.NewOptions()
+	opts.Pumps = map[string]options.PumpConfig{
+		"kept":    {Type: "dummy", Meta: map[string]interface{}{"id": 1}},
+		"changed": {Type: "dummy", Meta: map[string]interface{}{"id": 2}},
+		"removed": {Type: "dummy", Meta: map[string]interface{}{"id": 3}},
+	}
+	s := &pumpServer{secInterval: 1, pumps: opts.Pumps, options: opts, strict: true}
+	if err := s.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	previous := make(map[string]*pumpInstance, len(s.pmps))
+	for _, pmp := range s.pmps {
+		previous[pmp.name] = pmp
+	}
+
+	updated := options.NewOptions()
+	updated.WindowDeadline = 5
+	updated.Pumps = map[string]options.PumpConfig{
+		"kept":    {Type: "dummy", Meta: map[string]interface{}{"id": 1}},
+		"changed": {Type: "dummy", Meta: map[string]interface{}{"id": 4}},
+		"added":   {Type: "dummy", Meta: map[string]interface{}{"id": 5}},
+	}
+	s.reload(updated)
+
+	current := make(map[string]*pumpInstance, len(s.pmps))
+	for _, pmp := range s.pmps {
+		current[pmp.name] = pmp
+	}
+	if len(current) != 3 || current["added"] == nil || current["removed"] != nil {
+		t.Fatalf("expected the updated pumps, got %v", s.pmps)
+	}
+
+	if current["kept"] != previous["kept"] {
+		t.Error("the unchanged pump should keep running")
+	}
+
+	if current["changed"] == previous["changed"] {
+		t.Error("the changed pump should be initialized again")
+	}
+
+	if s.windowDeadline != 5*time.Second {
+		t.Errorf("the window deadline should be reloaded, got %s", s.windowDeadline)
+	}
+}
+
+// endlessStore is an analytics storage returning a record at every read.
+type endlessStore struct {
+	chunkedStore
+}
+
+func (e *endlessStore) GetSetLength(string) int64 { return 1 }
+
+func (e *endlessStore) GetAndDeleteSet(string) []interface{} {
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+
+	return []interface{}{string(b)}
+}
+
+func (e *endlessStore) GetAndDeleteChunk(key string, _ int64) []interface{} {
+	return e.GetAndDeleteSet(key)
+}
+
+// retiredPump counts the writes running while or after it is shut down.
+type retiredPump struct {
+	mockPump
+	shutdown int32
+	late     int32
+}
+
+func (p *retiredPump) WriteData(ctx context.Context, data []interface{}) error {
+	if atomic.LoadInt32(&p.shutdown) == 1 {
+		atomic.AddInt32(&p.late, 1)
+	}
+	time.Sleep(time.Millisecond)
+	if atomic.LoadInt32(&p.shutdown) == 1 {
+		atomic.AddInt32(&p.late, 1)
+	}
+
+	return p.mockPump.WriteData(ctx, data)
+}
+
+func (p *retiredPump) Shutdown() error {
+	atomic.StoreInt32(&p.shutdown, 1)
+
+	return nil
+}
+
+func TestReloadWhileSourcePurging(t *testing.T) {
+	opts := options.NewOptions()
+	opts.Pumps = map[string]options.PumpConfig{"retired": {Type: "dummy", Meta: map[string]interface{}{"id": 1}}}
+	retired := &retiredPump{}
+	s := &pumpServer{
+		secInterval:  1,
+		readInterval: time.Millisecond,
+		pumps:        opts.Pumps,
+		options:      opts,
+		strict:       true,
+		pmps:         []*pumpInstance{{Pump: retired, name: "retired", config: opts.Pumps["retired"]}},
+		sources:      []*analyticsSource{{name: "b", key: "b-analytics", store: &endlessStore{}}},
+	}
+
+	s.startSources()
+	time.Sleep(20 * time.Millisecond)
+
+	updated := options.NewOptions()
+	updated.Pumps = map[string]options.PumpConfig{"added": {Type: "dummy", Meta: map[string]interface{}{"id": 2}}}
+	s.reload(updated)
+
+	time.Sleep(20 * time.Millisecond)
+	s.stopSources()
+
+	if len(retired.records()) == 0 {
+		t.Fatal("the source should be purged into the pump before the reload")
+	}
+
+	if late := atomic.LoadInt32(&retired.late); late != 0 {
+		t.Fatalf("no window should write to a retired pump once it is shut down, got %d late writes", late)
+	}
+
+	if len(s.pmps) != 1 || s.pmps[0].name != "added" {
+		t.Fatalf("expected the updated pumps, got %v", s.pmps)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer viper.Reset()
+
+	s := &pumpServer{reloads: make(chan *options.Options, 1)}
+	s.reloadConfig()
+	if len(s.reloads) != 0 {
+		t.Fatal("no reload should be requested without configuration file")
+	}
+
+	file := filepath.Join(t.TempDir(), "iam-pump.yaml")
+	if err := os.WriteFile(file, []byte("pumps:\n  archive:\n    type: dummy\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+
+	s.reloadConfig()
+	s.reloadConfig()
+	if len(s.reloads) != 1 {
+		t.Fatalf("a pending reload should be replaced, got %d reloads", len(s.reloads))
+	}
+
+	if updated := <-s.reloads; updated.Pumps["archive"].Type != "dummy" {
+		t.Fatalf("the pumps of the configuration file should be reloaded, got %v", updated.Pumps)
+	}
+}
+
+func TestReloadConfigRemote(t *testing.T) {
+	defer viper.Reset()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		_, _ = w.Write([]byte("pumps:\n  remote:\n    type: dummy\n"))
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "iam-pump.yaml")
+	config := "remote-config:\n  provider: consul\n  endpoint: " + server.URL + "\n  path: /iam/pump\n" +
+		"pumps:\n  archive:\n    type: dummy\n"
+	if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+
+	opts, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := opts.Pumps["remote"]; !ok || len(opts.Pumps) != 1 {
+		t.Fatalf("the remote configuration should override the configuration file, got %v", opts.Pumps)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package remoteconfig implements the viper remote providers reading the iam-pump configuration
+// from a Consul or etcd key. It is registered as viper.RemoteConfig when imported.
+package remoteconfig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/spf13/viper"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the supported providers.
+const (
+	// ProviderConsul reads the configuration from a key of the Consul KV store.
+	ProviderConsul = "consul"
+	// ProviderEtcd reads the configuration from an etcd key with the v3 API.
+	ProviderEtcd = "etcd"
+)
+
+// Defines the timeouts of the requests to the providers.
+const (
+	requestTimeout = 10 * time.Second
+	// watchWait is the maximum duration of a consul blocking query.
+	watchWait = 5 * time.Minute
+	// watchRetry is the delay before watching again after a failure.
+	watchRetry = 5 * time.Second
+)
+
+// consulTokenEnv is the environment variable holding the ACL token sent to Consul, as for the
+// consul cli.
+const consulTokenEnv = "CONSUL_HTTP_TOKEN"
+
+// nolint: gochecknoinits
+func init() {
+	viper.RemoteConfig = provider{}
+}
+
+// Key is the key of a KV store holding the configuration.
+type Key struct {
+	provider string
+	endpoint string
+	path     string
+}
+
+// NewKey returns the key at path of the KV store of the provider at endpoint.
+func NewKey(provider, endpoint, path string) *Key {
+	return &Key{provider: provider, endpoint: endpoint, path: path}
+}
+
+// Provider returns the name of the KV store.
+func (k *Key) Provider() string { return k.provider }
+
+// Endpoint returns the address of the KV store.
+func (k *Key) Endpoint() string { return k.endpoint }
+
+// Path returns the key.
+func (k *Key) Path() string { return k.path }
+
+// SecretKeyring returns no keyring, the values are not encrypted.
+func (k *Key) SecretKeyring() string { return "" }
+
+// provider implements the remote config factory of viper.
+type provider struct{}
+
+func (provider) Get(rp viper.RemoteProvider) (io.Reader, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	value, _, err := get(ctx, rp, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(value), nil
+}
+
+func (p provider) Watch(rp viper.RemoteProvider) (io.Reader, error) {
+	return p.Get(rp)
+}
+
+// WatchChannel sends the new value of the key every time it changes, until true is sent on the
+// returned quit channel.
+func (provider) WatchChannel(rp viper.RemoteProvider) (<-chan *viper.RemoteResponse, chan bool) {
+	responses := make(chan *viper.RemoteResponse)
+	quit := make(chan bool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	go func() {
+		defer close(responses)
+
+		var err error
+		if rp.Provider() == ProviderEtcd {
+			err = watchEtcd(ctx, rp, responses)
+		} else {
+			err = watchConsul(ctx, rp, responses)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Stopped watching %s key %s: %s", rp.Provider(), rp.Path(), err.Error())
+		}
+	}()
+
+	return responses, quit
+}
+
+// get reads the key, waiting for a change of the consul index when index is not 0.
+func get(ctx context.Context, rp viper.RemoteProvider, index uint64) ([]byte, uint64, error) {
+	switch rp.Provider() {
+	case ProviderConsul:
+		return getConsul(ctx, rp, index)
+	case ProviderEtcd:
+		return getEtcd(ctx, rp)
+	default:
+		return nil, 0, errors.Errorf("unsupported remote config provider %s", rp.Provider())
+	}
+}
+
+func getConsul(ctx context.Context, rp viper.RemoteProvider, index uint64) ([]byte, uint64, error) {
+	endpoint := rp.Endpoint()
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	query := url.Values{"raw": {""}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(watchWait.Seconds())))
+	}
+	reqURL := fmt.Sprintf("%s/v1/kv/%s?%s", strings.TrimSuffix(endpoint, "/"), strings.TrimPrefix(rp.Path(), "/"),
+		query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to create consul request")
+	}
+
+	if token := os.Getenv(consulTokenEnv); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read consul key")
+	}
+	defer resp.Body.Close()
+
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read consul key")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("consul key %s returned %s: %s", rp.Path(), resp.Status, strings.TrimSpace(string(value)))
+	}
+
+	modifyIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	return value, modifyIndex, nil
+}
+
+// watchConsul watches the key with blocking queries.
+func watchConsul(ctx context.Context, rp viper.RemoteProvider, responses chan<- *viper.RemoteResponse) error {
+	_, index, err := getConsul(ctx, rp, 0)
+	for ctx.Err() == nil {
+		if err != nil {
+			log.Warnf("Failed to watch consul key %s, retrying in %s: %s", rp.Path(), watchRetry, err.Error())
+			select {
+			case <-time.After(watchRetry):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		var value []byte
+		var next uint64
+		value, next, err = getConsul(ctx, rp, index)
+		if err != nil {
+			continue
+		}
+
+		// the index is reset when it goes backwards, e.g. after a restore of the cluster
+		if next < index {
+			next = 0
+		}
+		if next == index {
+			continue
+		}
+		index = next
+
+		select {
+		case responses <- &viper.RemoteResponse{Value: value}:
+		case <-ctx.Done():
+		}
+	}
+
+	return nil
+}
+
+func etcdClient(rp viper.RemoteProvider) (*clientv3.Client, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(rp.Endpoint(), ","),
+		DialTimeout: requestTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to etcd")
+	}
+
+	return client, nil
+}
+
+func getEtcd(ctx context.Context, rp viper.RemoteProvider) ([]byte, uint64, error) {
+	client, err := etcdClient(rp)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Close()
+
+	resp, err := client.Get(ctx, rp.Path())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read etcd key")
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, 0, errors.Errorf("etcd key %s not found", rp.Path())
+	}
+
+	return resp.Kvs[0].Value, uint64(resp.Kvs[0].ModRevision), nil
+}
+
+// watchEtcd sends the values put to the key.
+func watchEtcd(ctx context.Context, rp viper.RemoteProvider, responses chan<- *viper.RemoteResponse) error {
+	client, err := etcdClient(rp)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for watch := range client.Watch(clientv3.WithRequireLeader(ctx), rp.Path()) {
+		if err := watch.Err(); err != nil {
+			return err
+		}
+
+		for _, event := range watch.Events {
+			if event.Type != clientv3.EventTypePut {
+				continue
+			}
+
+			select {
+			case responses <- &viper.RemoteResponse{Value: event.Kv.Value}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package remoteconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConsul(t *testing.T) {
+	var mu sync.Mutex
+	index, value := 1, "purge-delay: 10"
+	changed := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/iam/pump" || r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		// the blocking queries return once the index changed
+		if wait := r.URL.Query().Get("index"); wait != "" {
+			mu.Lock()
+			current := strconv.Itoa(index)
+			mu.Unlock()
+			if wait == current {
+				select {
+				case <-changed:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		_, _ = w.Write([]byte(value))
+	}))
+	defer server.Close()
+
+	t.Setenv(consulTokenEnv, "token")
+	key := NewKey(ProviderConsul, server.URL, "/iam/pump")
+
+	reader, err := viper.RemoteConfig.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(reader); string(data) != "purge-delay: 10" {
+		t.Fatalf("unexpected value %q", data)
+	}
+
+	responses, quit := viper.RemoteConfig.WatchChannel(key)
+	defer close(quit)
+
+	// let the watch read the initial index
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	index, value = 2, "purge-delay: 20"
+	mu.Unlock()
+	close(changed)
+
+	select {
+	case resp := <-responses:
+		if string(resp.Value) != "purge-delay: 20" {
+			t.Errorf("unexpected watched value %q", resp.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change of the key was not watched")
+	}
+
+	if _, err := viper.RemoteConfig.Get(NewKey(ProviderConsul, server.URL, "/iam/unknown")); err == nil {
+		t.Error("a missing key should fail")
+	}
+}
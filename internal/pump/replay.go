@@ -0,0 +1,286 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	cliflag "github.com/marmotedu/component-base/pkg/cli/flag"
+	"github.com/marmotedu/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+
+	genericapiserver "github.com/marmotedu/iam/internal/pkg/server"
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/config"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+const replayDesc = `Write the records dead-lettered by a pump, in the redis list of --dead-letter-key or the file of
+--dead-letter-dir, to the pump again, then exit. The records are removed from the dead-letter queue
+once written, a failing write stops the replay and leaves the records not written in the queue.`
+
+// newReplayCommand creates the replay sub command. The pumps configuration is read from the
+// configuration file of iam-pump, given by configFlag.
+func newReplayCommand(opts *options.Options, configFlag *pflag.Flag) *cobra.Command {
+	replayOpts := options.NewReplayOptions()
+	cmd := &cobra.Command{
+		Use:           "replay",
+		Short:         "Write the dead-lettered records of a pump to it again",
+		Long:          replayDesc,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := viper.Unmarshal(opts); err != nil {
+				return err
+			}
+
+			if errs := append(opts.Validate(), replayOpts.Validate()...); len(errs) != 0 {
+				return errors.NewAggregate(errs)
+			}
+
+			log.Init(opts.Log)
+			defer log.Flush()
+
+			cfg, err := config.CreateConfigFromOptions(opts)
+			if err != nil {
+				return err
+			}
+
+			return Replay(cfg, replayOpts, genericapiserver.SetupSignalHandler())
+		},
+	}
+
+	namedFlagSets := replayOpts.Flags()
+	namedFlagSets.FlagSet("global").AddFlag(configFlag)
+	for _, fs := range namedFlagSets.FlagSets {
+		cmd.Flags().AddFlagSet(fs)
+	}
+
+	// the usage of iam-pump lists the flags of the purge loop, not the replay ones
+	cmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\nUsage:\n  %s\n", cmd.Long, cmd.UseLine())
+		cliflag.PrintSections(cmd.OutOrStdout(), namedFlagSets, 0)
+	})
+
+	return cmd
+}
+
+// Replay writes the dead-lettered records of the pump to it again, it returns once the dead-letter
+// queue of the pump is empty, a write failed or stopCh is closed.
+func Replay(cfg *config.Config, opts *options.ReplayOptions, stopCh <-chan struct{}) error {
+	tuneMemory(cfg.MemoryLimit, cfg.GCPercent)
+
+	server, err := createPumpServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if server.deadLetters == nil {
+		return errors.New("no dead-letter queue is configured, set --dead-letter-key or --dead-letter-dir")
+	}
+
+	pmp, ok := server.pumps[opts.Pump]
+	if !ok {
+		return errors.Errorf("pump %s is not configured", opts.Pump)
+	}
+
+	// only the replayed pump is initialized
+	server.pumps = map[string]options.PumpConfig{opts.Pump: pmp}
+	if err := server.initialize(); err != nil {
+		return err
+	}
+	defer server.shutdown()
+
+	if len(server.pmps) == 0 {
+		return errors.Errorf("pump %s could not be initialized", opts.Pump)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	limit := rate.Inf
+	if opts.Rate > 0 {
+		limit = rate.Limit(opts.Rate)
+	}
+
+	return server.replay(ctx, server.pmps[0], rate.NewLimiter(limit, opts.BatchSize), opts.BatchSize)
+}
+
+// replay writes the dead-lettered records of the pump to it, in batches.
+func (s *pumpServer) replay(ctx context.Context, pmp *pumpInstance, limiter *rate.Limiter, batchSize int) error {
+	location := s.deadLetters.location(pmp.name)
+	write := func(batch []interface{}) error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := limiter.WaitN(ctx, len(batch)); err != nil {
+			return err
+		}
+
+		return pmp.writeWithRetry(ctx, batch)
+	}
+
+	log.Infof("Replaying the dead-lettered records of pump %s from %s", pmp.name, location)
+	replayed, err := s.deadLetters.replay(ctx, pmp.name, batchSize, write)
+	log.Infof("Replayed %d records to pump %s", replayed, pmp.name)
+
+	return errors.Wrapf(err, "failed to replay %s", location)
+}
+
+// replay reads the dead-lettered records of the pump in batches, passes them to write, and
+// removes them once written. It returns the number of records written.
+func (q *deadLetterQueue) replay(ctx context.Context, pump string, batchSize int, write func([]interface{}) error) (int, error) {
+	if q.dir != "" {
+		return q.replayFile(pump, batchSize, write)
+	}
+
+	key, replayed := q.listKey(pump), 0
+	for {
+		values, err := q.client.LRange(ctx, key, 0, int64(batchSize)-1).Result()
+		if err != nil || len(values) == 0 {
+			return replayed, err
+		}
+
+		batch := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			record := analytics.AnalyticsRecord{}
+			if err := unmarshalDeadLetter([]byte(value), &record); err != nil {
+				log.Warnf("Skipping undecodable dead-lettered record of %s: %s", key, err.Error())
+
+				continue
+			}
+			batch = append(batch, record)
+		}
+
+		if err := write(batch); err != nil {
+			return replayed, err
+		}
+		// the records dead-lettered meanwhile are pushed after the ones read
+		if err := q.client.LTrim(ctx, key, int64(len(values)), -1).Err(); err != nil {
+			return replayed, err
+		}
+		replayed += len(batch)
+	}
+}
+
+// replayFile replays the dead-letter file of the pump. The file is renamed while replayed, so that
+// the records dead-lettered meanwhile go to a new file, and only keeps the records not written
+// when the replay fails, to be replayed first by the next one.
+func (q *deadLetterQueue) replayFile(pump string, batchSize int, write func([]interface{}) error) (int, error) {
+	name := q.fileName(pump)
+	replaying := name + ".replaying"
+	if _, err := os.Stat(replaying); os.IsNotExist(err) {
+		q.mu.Lock()
+		err = os.Rename(name, replaying)
+		q.mu.Unlock()
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.Open(replaying)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	batch := make([]interface{}, 0, batchSize)
+	replayed, offset, batchOffset := 0, int64(0), int64(0)
+	flush := func() error {
+		if err := write(batch); err != nil {
+			return keepFrom(f, replaying, batchOffset, err)
+		}
+		replayed += len(batch)
+		// the pump may still hold the written batch, e.g. an abandoned write
+		batch, batchOffset = make([]interface{}, 0, batchSize), offset
+
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if len(line) > 0 {
+			record := analytics.AnalyticsRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				log.Warnf("Skipping undecodable dead-lettered record of %s: %s", replaying, err.Error())
+			} else {
+				batch = append(batch, record)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return replayed, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return replayed, err
+	}
+
+	return replayed, os.Remove(replaying)
+}
+
+// keepFrom truncates the head of the file being replayed up to offset, the records already
+// written, and returns the write error.
+func keepFrom(f *os.File, name string, offset int64, writeErr error) error {
+	if offset == 0 {
+		return writeErr
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	return writeErr
+}
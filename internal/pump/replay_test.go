@@ -0,0 +1,107 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/time/rate"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+)
+
+// exhaustedPump fails permanently once it wrote its writes.
+type exhaustedPump struct {
+	mockPump
+	writes int
+	calls  int
+}
+
+func (p *exhaustedPump) WriteData(ctx context.Context, data []interface{}) error {
+	if p.calls++; p.calls > p.writes {
+		return pumps.Permanent(errors.New("quota exhausted"))
+	}
+
+	return p.mockPump.WriteData(ctx, data)
+}
+
+func TestReplayDeadLetterFile(t *testing.T) {
+	dir := t.TempDir()
+	queue := &deadLetterQueue{dir: dir}
+	failing := &pumpInstance{Pump: &mockPump{}, name: "mongo", deadLetters: queue}
+
+	records := make([]interface{}, 0, 5)
+	for _, username := range []string{"colin", "alice", "bob", "eve", "mallory"} {
+		records = append(records, analytics.AnalyticsRecord{Username: username})
+	}
+	failing.deadLetter(records[:3], deadLetterPermanent)
+	failing.deadLetter(records[3:], deadLetterRetriesExhausted)
+
+	// the second batch fails permanently, the records not written are kept
+	flaky := &exhaustedPump{writes: 1}
+	s := &pumpServer{deadLetters: queue}
+	pmp := &pumpInstance{Pump: flaky, name: "mongo"}
+	if err := s.replay(context.Background(), pmp, rate.NewLimiter(rate.Inf, 2), 2); err == nil {
+		t.Fatal("a failing write should stop the replay")
+	}
+
+	if written := flaky.records(); len(written) != 2 || written[0].(analytics.AnalyticsRecord).Username != "colin" {
+		t.Fatalf("the first batch should be written, got %v", written)
+	}
+
+	// the records dead-lettered during a replay go to a new file, replayed by the next one
+	failing.deadLetter([]interface{}{analytics.AnalyticsRecord{Username: "trudy"}}, deadLetterPermanent)
+
+	mock := &mockPump{}
+	pmp = &pumpInstance{Pump: mock, name: "mongo"}
+	if err := s.replay(context.Background(), pmp, rate.NewLimiter(rate.Inf, 2), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if written := mock.records(); len(written) != 3 || written[0].(analytics.AnalyticsRecord).Username != "bob" {
+		t.Fatalf("the records not written should be replayed from the first failed batch, got %v", written)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "mongo.json.replaying")); !os.IsNotExist(err) {
+		t.Fatalf("the replayed file should be removed, got %v", err)
+	}
+
+	if err := s.replay(context.Background(), pmp, rate.NewLimiter(rate.Inf, 2), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if written := mock.records(); len(written) != 4 || written[3].(analytics.AnalyticsRecord).Username != "trudy" {
+		t.Fatalf("the records dead-lettered during the replay should be replayed next, got %v", written)
+	}
+}
+
+func TestDeadLetterEncoding(t *testing.T) {
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin"}
+	record.SetExtra("country", "FR")
+
+	b, err := marshalDeadLetter(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed analytics.AnalyticsRecord
+	if err := unmarshalDeadLetter(b, &replayed); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Username != "colin" || replayed.TimeStamp != 1600000000 || replayed.Extra["country"] != "FR" {
+		t.Fatalf("the dead-lettered record should be replayed with its extra fields, got %+v", replayed)
+	}
+
+	// the dead letters are still decoded like the analytics records read from the storage
+	var decoded analytics.AnalyticsRecord
+	if err := newRecordDecoder().decode(string(b), &decoded); err != nil || decoded.Username != "colin" {
+		t.Fatalf("the dead letter should decode as an analytics record, got %+v: %v", decoded, err)
+	}
+}
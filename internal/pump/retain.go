@@ -0,0 +1,175 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"strings"
+
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// observeSource records the outcome of a write of the window to the pump.
+func (p *pumpInstance) observeSource(err error) {
+	if err == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.sourceFailed = true
+	p.mu.Unlock()
+}
+
+// windowSourceKey is the context key of the source of a purge window.
+type windowSourceKey struct{}
+
+// withWindowSource returns a copy of ctx writing the values read from src.
+func withWindowSource(ctx context.Context, src *analyticsSource) context.Context {
+	return context.WithValue(ctx, windowSourceKey{}, src)
+}
+
+// retaining reports whether the values of the source are put back when the pump fails to write
+// them, it is called with mu held. The buffered pumps write the records of the previous windows.
+func (p *pumpInstance) retaining(src *analyticsSource) bool {
+	return p.retainSource || (src.atLeastOnce && !p.buffered)
+}
+
+// retains reports whether the records the pump fails to write in the window are put back in the
+// source of the window, to be written again by the next one, rather than dead-lettered.
+func (p *pumpInstance) retains(window context.Context) bool {
+	src, _ := window.Value(windowSourceKey{}).(*analyticsSource)
+	if src == nil {
+		return false
+	}
+	if _, ok := src.store.(storage.RequeueingStorage); !ok {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.retaining(src) && (p.retainMaxWindows <= 0 || p.retained < p.retainMaxWindows)
+}
+
+// deadLetterUnretained dead-letters the records the pump failed to write in the window, unless
+// they are put back in its source, so that they are only dead-lettered once.
+func (p *pumpInstance) deadLetterUnretained(window context.Context, records []interface{}, reason string) {
+	if p.retains(window) {
+		return
+	}
+
+	p.deadLetter(records, reason)
+}
+
+// failedPumps returns the names of the pumps whose write of the window failed and which retain
+// the values of the source, and of those which failed to write the values retained for them for
+// the last retainMaxWindows windows, which are not retained anymore. It resets their outcome for
+// the next window.
+func (s *pumpServer) failedPumps(src *analyticsSource) ([]string, []string) {
+	var failed, exhausted []string
+	for _, pmp := range s.pmps {
+		pmp.mu.Lock()
+		switch {
+		case !pmp.retaining(src):
+		case !pmp.sourceFailed:
+			pmp.retained = 0
+		case pmp.retainMaxWindows > 0 && pmp.retained >= pmp.retainMaxWindows:
+			exhausted = append(exhausted, pmp.name)
+			pmp.retained = 0
+		default:
+			failed = append(failed, pmp.name)
+			pmp.retained++
+		}
+		pmp.sourceFailed = false
+		pmp.mu.Unlock()
+	}
+
+	return failed, exhausted
+}
+
+// retain puts the values read back in their source when a pump retaining the source data
+// failed to write them, or any pump for the sources in at-least-once mode, so that they are read
+// again by the next window. The values are only deleted once every such pump succeeded, it reports
+// whether they were put back. The values go to every pump again, the pumps which succeeded write
+// them again at every window they are put back in. A pump failing to write them for
+// retainMaxWindows consecutive windows does not retain them anymore, its records are dead-lettered.
+func (s *pumpServer) retain(src *analyticsSource, values []interface{}) bool {
+	failed, exhausted := s.failedPumps(src)
+	for _, name := range exhausted {
+		log.Errorf("Pump %s failed to write the records put back for it in %d consecutive windows, "+
+			"they are dead-lettered", name, s.retainMax)
+	}
+	if len(failed) == 0 {
+		return false
+	}
+
+	requeueing, ok := src.store.(storage.RequeueingStorage)
+	if !ok {
+		return false
+	}
+
+	if err := requeueing.Requeue(src.key, values); err != nil {
+		log.Errorf("Failed to retain the %d records not written to %s, they are lost for these pumps: %s",
+			len(values), strings.Join(failed, ", "), err.Error())
+
+		return false
+	}
+
+	log.Warnf("Retained the %d records read in the analytics storage until written to %s",
+		len(values), strings.Join(failed, ", "))
+	for _, name := range failed {
+		metrics.RetainedRecords.WithLabelValues(name).Add(float64(len(values)))
+	}
+
+	return true
+}
+
+// checkRetainingPumps warns about the pumps whose source data can not be retained: the storage
+// can not put the data read back or the pump buffers the records. It refuses the queued pumps
+// retaining the source data or reading from a source acknowledged once every pump wrote the
+// records, their writes complete after the window.
+func (s *pumpServer) checkRetainingPumps() error {
+	_, requeueing := s.analyticsStore.(storage.RequeueingStorage)
+	atLeastOnce := s.atLeastOnce
+	for _, src := range s.sources {
+		atLeastOnce = atLeastOnce || src.atLeastOnce
+	}
+	for _, pmp := range s.pmps {
+		if atLeastOnce && pmp.buffered {
+			log.Warnf("Pump %s buffers the records across windows, they are acknowledged before it writes them "+
+				"in at-least-once mode", pmp.name)
+		}
+		if atLeastOnce && s.pumpQueueSize(pmp) > 0 {
+			return errors.Errorf("pump %s queues its writes, which the at-least-once acknowledgement of the source "+
+				"does not support: the writes of a queued pump complete after the records are acknowledged", pmp.name)
+		}
+
+		if !pmp.retainSource {
+			continue
+		}
+
+		if pmp.config.QueueSize > 0 {
+			return errors.Errorf("pump %s retains the source data until written, which its queue-size does not "+
+				"support: the writes of a queued pump complete after the window", pmp.name)
+		}
+
+		switch {
+		case !requeueing:
+			log.Warnf("Pump %s retains the source data until written, which the %s storage does not support",
+				pmp.name, s.analyticsStore.GetName())
+			pmp.retainSource = false
+		case pmp.buffered:
+			log.Warnf("Pump %s retains the source data until written, which its purge-delay above the read "+
+				"interval does not support: the records are buffered across windows", pmp.name)
+			pmp.retainSource = false
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+// requeueingStore is an in-memory analytics storage which can put the values read back.
+type requeueingStore struct {
+	chunkedStore
+}
+
+func (r *requeueingStore) Requeue(_ string, values []interface{}) error {
+	r.values = append(append([]interface{}{}, values...), r.values...)
+
+	return nil
+}
+
+func TestRetainSourceUntilSuccess(t *testing.T) {
+	store := &requeueingStore{}
+	for _, username := range []string{"colin", "admin"} {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: username})
+		store.values = append(store.values, string(b))
+	}
+
+	flaky := &flakyPump{failures: 1, err: errors.New("backend unavailable")}
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		pmps: []*pumpInstance{
+			{Pump: flaky, name: "flaky", retainSource: true},
+			{Pump: mock, name: "mock"},
+		},
+	}
+	if err := s.checkRetainingPumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.drain(context.Background())
+	if len(store.values) != 2 || len(mock.records()) != 2 {
+		t.Fatalf("the records should be retained until written to flaky, got %d left", len(store.values))
+	}
+
+	s.drain(context.Background())
+	if len(store.values) != 0 || len(flaky.records()) != 2 {
+		t.Fatalf("the records should be deleted once written to flaky, got %d left", len(store.values))
+	}
+
+	// the pumps which succeeded receive the retained records again
+	if len(mock.records()) != 4 {
+		t.Fatalf("the retained records should be written again to every pump, got %d", len(mock.records()))
+	}
+	if record, _ := flaky.records()[0].(analytics.AnalyticsRecord); record.Username != "colin" {
+		t.Fatalf("the retained records should keep their order, got %v", record.Username)
+	}
+}
+
+func TestRetainMaxWindows(t *testing.T) {
+	store := &requeueingStore{}
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	store.values = []interface{}{string(b)}
+
+	dir := t.TempDir()
+	failing := &flakyPump{failures: 10, err: errors.New("backend unavailable")}
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		retainMax:      2,
+		pmps: []*pumpInstance{
+			{Pump: failing, name: "failing", retainSource: true, retainMaxWindows: 2, deadLetters: &deadLetterQueue{dir: dir}},
+			{Pump: mock, name: "mock"},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		s.drain(context.Background())
+		if len(store.values) != 1 {
+			t.Fatalf("the records should be retained for 2 windows, got %d left after %d", len(store.values), i+1)
+		}
+	}
+
+	s.drain(context.Background())
+	if len(store.values) != 0 || len(mock.records()) != 3 {
+		t.Fatalf("the records should be deleted once retained for 2 windows, got %d left", len(store.values))
+	}
+
+	// the records are only dead-lettered once they are not retained anymore
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("expected the dead letters of the failing pump, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Fatalf("the records should be dead-lettered once, got %d", lines)
+	}
+}
+
+type acknowledgingStore struct {
+	requeueingStore
+	acks int
+}
+
+func (a *acknowledgingStore) Ack() error {
+	a.acks++
+
+	return nil
+}
+
+func TestRetainSourceAcknowledgement(t *testing.T) {
+	store := &acknowledgingStore{}
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	store.values = []interface{}{string(b)}
+
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		pmps: []*pumpInstance{
+			{Pump: &flakyPump{failures: 1, err: errors.New("backend unavailable")}, name: "flaky", retainSource: true},
+		},
+	}
+	if err := s.checkRetainingPumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.drain(context.Background())
+	if store.acks != 0 {
+		t.Fatal("the records retained should not be acknowledged")
+	}
+
+	s.drain(context.Background())
+	if store.acks != 1 || len(store.values) != 0 {
+		t.Fatalf("the records should be acknowledged once written, got %d acks", store.acks)
+	}
+}
+
+func TestAtLeastOnceRequeue(t *testing.T) {
+	store := &acknowledgingStore{}
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	store.values = []interface{}{string(b)}
+
+	flaky := &flakyPump{failures: 1, err: errors.New("backend unavailable")}
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		atLeastOnce:    true,
+		pmps: []*pumpInstance{
+			{Pump: flaky, name: "flaky"},
+			{Pump: &mockPump{}, name: "mock"},
+		},
+	}
+
+	s.drain(context.Background())
+	if store.acks != 0 || len(store.values) != 1 {
+		t.Fatalf("the records a pump failed to write should be requeued, got %d acks and %d left",
+			store.acks, len(store.values))
+	}
+
+	s.drain(context.Background())
+	if store.acks != 1 || len(store.values) != 0 || len(flaky.records()) != 1 {
+		t.Fatalf("the records should be acknowledged once written to every pump, got %d acks", store.acks)
+	}
+
+	// without at-least-once, the failure of a pump not retaining the source data is acknowledged
+	store.values = []interface{}{string(b)}
+	flaky.failures = flaky.calls + 1
+	s.atLeastOnce = false
+	s.drain(context.Background())
+	if store.acks != 2 || len(store.values) != 0 {
+		t.Fatalf("the records should be acknowledged, got %d acks and %d left", store.acks, len(store.values))
+	}
+}
+
+func TestAcknowledgingSourceRequeue(t *testing.T) {
+	store := &acknowledgingStore{}
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	store.values = []interface{}{string(b)}
+
+	flaky := &flakyPump{failures: 1, err: errors.New("backend unavailable")}
+	s := &pumpServer{
+		secInterval: 1,
+		pmps: []*pumpInstance{
+			{Pump: flaky, name: "flaky"},
+			{Pump: &mockPump{}, name: "mock"},
+		},
+	}
+	src := &analyticsSource{name: "kafka", key: "analytics", store: store, atLeastOnce: true}
+
+	// the additional sources acknowledging the records read requeue them without --at-least-once
+	s.drainSource(context.Background(), src)
+	if store.acks != 0 || len(store.values) != 1 {
+		t.Fatalf("the records a pump failed to write should be requeued, got %d acks and %d left",
+			store.acks, len(store.values))
+	}
+
+	s.drainSource(context.Background(), src)
+	if store.acks != 1 || len(store.values) != 0 {
+		t.Fatalf("the records should be acknowledged once written to every pump, got %d acks", store.acks)
+	}
+}
+
+func TestChunkAcknowledgement(t *testing.T) {
+	store := &acknowledgingStore{}
+	for i := 0; i < 5; i++ {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+		store.values = append(store.values, string(b))
+	}
+
+	s := &pumpServer{
+		secInterval:    1,
+		analyticsStore: store,
+		purgeChunkSize: 2,
+		pmps:           []*pumpInstance{{Pump: &mockPump{}, name: "mock"}},
+	}
+
+	s.drain(context.Background())
+	if store.acks != 3 || len(store.reads) != 3 {
+		t.Fatalf("every chunk should be acknowledged once written, got %d acks for reads %v", store.acks, store.reads)
+	}
+}
+
+func TestRetainSourceUnsupported(t *testing.T) {
+	s := &pumpServer{
+		analyticsStore: &chunkedStore{},
+		pmps:           []*pumpInstance{{Pump: &mockPump{}, name: "mock", retainSource: true}},
+	}
+
+	if err := s.checkRetainingPumps(); err != nil {
+		t.Fatal(err)
+	}
+	if s.pmps[0].retainSource {
+		t.Fatal("the source data can not be retained by a storage which can not requeue it")
+	}
+}
+
+func TestRetainSourceQueued(t *testing.T) {
+	s := &pumpServer{
+		analyticsStore: &requeueingStore{},
+		pmps: []*pumpInstance{{
+			Pump:         &mockPump{},
+			name:         "mock",
+			retainSource: true,
+			config:       options.PumpConfig{RetainSourceUntilSuccess: true, QueueSize: 10},
+		}},
+	}
+
+	if err := s.checkRetainingPumps(); err == nil {
+		t.Fatal("a pump retaining the source data should not configure a queue")
+	}
+}
+
+func TestAtLeastOnceQueued(t *testing.T) {
+	s := &pumpServer{
+		analyticsStore: &requeueingStore{},
+		atLeastOnce:    true,
+		queueSize:      10,
+		pmps:           []*pumpInstance{{Pump: &mockPump{}, name: "mock"}},
+	}
+
+	if err := s.checkRetainingPumps(); err == nil {
+		t.Fatal("the default queue should not be applied to the pumps of an at-least-once source")
+	}
+
+	s.atLeastOnce = false
+	if err := s.checkRetainingPumps(); err != nil {
+		t.Fatalf("the pumps of a source acknowledged once read should be queued, got %v", err)
+	}
+}
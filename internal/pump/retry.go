@@ -0,0 +1,216 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	goredislib "github.com/go-redis/redis/v8"
+	"github.com/marmotedu/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// Defines the default backoff between the attempts of a failed write.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// Defines the reasons why records are dead-lettered.
+const (
+	deadLetterPermanent        = "permanent"
+	deadLetterRetriesExhausted = "retries-exhausted"
+	deadLetterMissingFields    = "missing-fields"
+)
+
+// deadLetterTimeout bounds the time spent storing dead-lettered records.
+const deadLetterTimeout = 5 * time.Second
+
+// writeWithRetry writes the data, retrying the transient failures up to the configured number of
+// retries, with an exponential backoff, as long as the context allows.
+func (p *pumpInstance) writeWithRetry(ctx context.Context, data []interface{}) error {
+	backoff, maxBackoff := p.retryBackoff, p.maxRetryBackoff
+	if backoff <= 0 {
+		backoff = retryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = maxRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := p.write(ctx, data)
+		if err == nil || errors.Is(err, pumps.ErrSkipWrite) || attempt >= p.maxRetries || !pumps.IsRetryable(p.current(), err) {
+			return err
+		}
+
+		log.Debugf("Retrying write to %s in %s after transient error: %s", p.current().GetName(), backoff, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// deadLetterReason returns why the records whose write failed with err are dead-lettered.
+func (p *pumpInstance) deadLetterReason(err error) string {
+	if pumps.IsRetryable(p.current(), err) {
+		return deadLetterRetriesExhausted
+	}
+
+	return deadLetterPermanent
+}
+
+// deadLetterQueue stores the records a pump failed to write in a redis list per pump, msgpack
+// encoded like the analytics records read from the analytics storage along with their extra
+// fields, or in a file per pump of the dead-letter directory, one json record per line.
+type deadLetterQueue struct {
+	client *goredislib.Client
+	key    string
+	dir    string
+
+	// mu serializes the appends to the dead-letter files.
+	mu sync.Mutex
+}
+
+// deadLetterRecord is the msgpack encoding of the dead-lettered records, the extra fields set by the
+// pipeline are not part of the analytics records encoding but are needed to replay the records as
+// they were written.
+type deadLetterRecord struct {
+	analytics.AnalyticsRecord `msgpack:",inline"`
+	Extra                     map[string]interface{} `msgpack:"extra,omitempty"`
+}
+
+func marshalDeadLetter(v interface{}) ([]byte, error) {
+	record, ok := v.(analytics.AnalyticsRecord)
+	if !ok {
+		return msgpack.Marshal(v)
+	}
+
+	return msgpack.Marshal(deadLetterRecord{AnalyticsRecord: record, Extra: record.Extra})
+}
+
+func unmarshalDeadLetter(b []byte, record *analytics.AnalyticsRecord) error {
+	var letter deadLetterRecord
+	if err := msgpack.Unmarshal(b, &letter); err != nil {
+		return err
+	}
+
+	*record = letter.AnalyticsRecord
+	record.Extra = letter.Extra
+
+	return nil
+}
+
+func (q *deadLetterQueue) listKey(pump string) string {
+	return fmt.Sprintf("%s:%s", q.key, pump)
+}
+
+func (q *deadLetterQueue) fileName(pump string) string {
+	return filepath.Join(q.dir, pump+".json")
+}
+
+// location returns where the records of the pump are dead-lettered.
+func (q *deadLetterQueue) location(pump string) string {
+	if q.dir != "" {
+		return q.fileName(pump)
+	}
+
+	return q.listKey(pump)
+}
+
+// store stores the records of the pump, it returns the number of records stored.
+func (q *deadLetterQueue) store(ctx context.Context, pump string, records []interface{}) (int, error) {
+	marshal := marshalDeadLetter
+	if q.dir != "" {
+		marshal = json.Marshal
+	}
+
+	values := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		encoded, err := marshal(record)
+		if err != nil {
+			log.Errorf("Failed to encode dead-lettered record: %s", err.Error())
+
+			continue
+		}
+		values = append(values, encoded)
+	}
+
+	if q.dir == "" {
+		return len(values), q.client.RPush(ctx, q.listKey(pump), values...).Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(q.fileName(pump), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+
+	var lines bytes.Buffer
+	for _, value := range values {
+		lines.Write(value.([]byte))
+		lines.WriteByte('\n')
+	}
+	if _, err := f.Write(lines.Bytes()); err != nil {
+		f.Close()
+
+		return 0, err
+	}
+
+	return len(values), f.Close()
+}
+
+// deadLetter stores the records a pump failed to write, they are dropped when no dead-letter
+// queue is configured.
+func (p *pumpInstance) deadLetter(records []interface{}, reason string) {
+	if len(records) == 0 {
+		return
+	}
+
+	metrics.DeadLetters.WithLabelValues(p.name, reason).Add(float64(len(records)))
+
+	if p.deadLetters == nil {
+		log.Warnf("Dropping %d records pump %s failed to write (%s)", len(records), p.name, reason)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+
+	location := p.deadLetters.location(p.name)
+	stored, err := p.deadLetters.store(ctx, p.name, records)
+	if err != nil {
+		log.Errorf("Failed to dead-letter %d records of pump %s: %s", len(records), p.name, err.Error())
+
+		return
+	}
+
+	log.Warnf("Dead-lettered %d records pump %s failed to write (%s) to %s", stored, p.name, reason, location)
+}
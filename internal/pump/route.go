@@ -0,0 +1,168 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"fmt"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// route sends the records matching all its conditions to its pumps. The missing pumps are those of
+// the route which are not initialized.
+type route struct {
+	conditions []options.RouteCondition
+	pumps      []int
+	missing    []string
+}
+
+// router assigns each record to the pumps it is routed to. Records matching no route go to the
+// default pumps, to every pump when no default pumps are configured.
+type router struct {
+	routes   []route
+	defaults route
+}
+
+// newRouter resolves the pumps of the routes against the initialized pumps. Pumps which are not
+// initialized are ignored, the records only routed to them are dropped.
+func newRouter(routes []options.Route, defaults []string, pmps []*pumpInstance) *router {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	indexes := make(map[string]int, len(pmps))
+	for i, pmp := range pmps {
+		indexes[pmp.name] = i
+	}
+
+	resolve := func(conditions []options.RouteCondition, names []string) route {
+		resolved := route{conditions: conditions, pumps: make([]int, 0, len(names))}
+		for _, name := range names {
+			i, ok := indexes[name]
+			if !ok {
+				log.Warnf("Records routed to pump %s are ignored, the pump is not initialized", name)
+				resolved.missing = append(resolved.missing, name)
+
+				continue
+			}
+			resolved.pumps = append(resolved.pumps, i)
+		}
+
+		return resolved
+	}
+
+	r := &router{}
+	for _, rt := range routes {
+		r.routes = append(r.routes, resolve(rt.Match, rt.Pumps))
+	}
+
+	if len(defaults) > 0 {
+		r.defaults = resolve(nil, defaults)
+	} else {
+		for i := range pmps {
+			r.defaults.pumps = append(r.defaults.pumps, i)
+		}
+	}
+
+	return r
+}
+
+// dispatch splits the records into one batch per pump, indexed like the pumps. The records only
+// routed to pumps which are not initialized are returned by missing pump.
+func (r *router) dispatch(keys []interface{}, pumpCount int) ([][]interface{}, map[string][]interface{}) {
+	batches := make([][]interface{}, pumpCount)
+	targets := make([]bool, pumpCount)
+	var unrouted map[string][]interface{}
+
+	for _, key := range keys {
+		record, _ := key.(analytics.AnalyticsRecord)
+
+		for i := range targets {
+			targets[i] = false
+		}
+
+		matched := make([]route, 0, 1)
+		for _, rt := range r.routes {
+			if rt.matches(&record) {
+				matched = append(matched, rt)
+			}
+		}
+		if len(matched) == 0 {
+			matched = append(matched, r.defaults)
+		}
+
+		routed := false
+		for _, rt := range matched {
+			for _, i := range rt.pumps {
+				targets[i] = true
+				routed = true
+			}
+		}
+
+		if !routed {
+			for _, rt := range matched {
+				for _, name := range rt.missing {
+					if unrouted == nil {
+						unrouted = make(map[string][]interface{})
+					}
+					unrouted[name] = append(unrouted[name], key)
+				}
+			}
+		}
+
+		for i, target := range targets {
+			if target {
+				batches[i] = append(batches[i], key)
+			}
+		}
+	}
+
+	return batches, unrouted
+}
+
+func (rt route) matches(record *analytics.AnalyticsRecord) bool {
+	for _, condition := range rt.conditions {
+		value, ok := record.FieldValue(condition.Field)
+		if !ok || !contains(condition.Values, fmt.Sprint(value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// batches returns the records each pump writes, indexed like the pumps.
+func (s *pumpServer) batches(keys []interface{}) [][]interface{} {
+	if s.router == nil {
+		batches := make([][]interface{}, len(s.pmps))
+		for i := range batches {
+			batches[i] = keys
+		}
+
+		return batches
+	}
+
+	batches, unrouted := s.router.dispatch(keys, len(s.pmps))
+	for name, records := range unrouted {
+		log.Debugf("Dropping %d records only routed to pump %s, the pump is not initialized", len(records), name)
+		metrics.UnroutedRecords.WithLabelValues(name).Add(float64(len(records)))
+		s.drops.sample(name, dropReasonUnrouted, records...)
+	}
+
+	return batches
+}
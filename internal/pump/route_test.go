@@ -0,0 +1,90 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func TestRouting(t *testing.T) {
+	audit := &mockPump{}
+	metrics := &mockPump{}
+	archive := &mockPump{}
+
+	s := &pumpServer{
+		secInterval: 1,
+		pmps: []*pumpInstance{
+			{Pump: audit, name: "audit"},
+			{Pump: metrics, name: "metrics"},
+			{Pump: archive, name: "archive"},
+		},
+	}
+	s.router = newRouter([]options.Route{
+		{
+			Match: []options.RouteCondition{{Field: "effect", Values: []string{"deny"}}},
+			Pumps: []string{"audit", "archive"},
+		},
+		{
+			Match: []options.RouteCondition{{Field: "username", Values: []string{"admin"}}},
+			Pumps: []string{"audit"},
+		},
+	}, []string{"metrics"}, s.pmps)
+
+	s.writeToPumps(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{Username: "colin", Effect: "deny"},
+		analytics.AnalyticsRecord{Username: "admin", Effect: "deny"},
+		analytics.AnalyticsRecord{Username: "colin", Effect: "allow"},
+	})
+
+	if got := len(audit.records()); got != 2 {
+		t.Fatalf("expected 2 records routed to audit, got %d", got)
+	}
+
+	if got := len(archive.records()); got != 2 {
+		t.Fatalf("expected 2 records routed to archive, got %d", got)
+	}
+
+	if got := len(metrics.records()); got != 1 {
+		t.Fatalf("expected the unrouted record to go to the default pump, got %d", got)
+	}
+}
+
+func TestRoutingNotInitialized(t *testing.T) {
+	audit := &mockPump{}
+	s := &pumpServer{
+		secInterval: 1,
+		pmps:        []*pumpInstance{{Pump: audit, name: "audit"}},
+	}
+	s.router = newRouter([]options.Route{
+		{
+			Match: []options.RouteCondition{{Field: "effect", Values: []string{"deny"}}},
+			Pumps: []string{"archive"},
+		},
+		{
+			Match: []options.RouteCondition{{Field: "username", Values: []string{"admin"}}},
+			Pumps: []string{"audit", "archive"},
+		},
+	}, nil, s.pmps)
+
+	before := testutil.ToFloat64(metrics.UnroutedRecords.WithLabelValues("archive"))
+	s.writeToPumps(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{Username: "colin", Effect: "deny"},
+		analytics.AnalyticsRecord{Username: "admin", Effect: "deny"},
+	})
+
+	if got := len(audit.records()); got != 1 {
+		t.Fatalf("expected the record also routed to audit to be written, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.UnroutedRecords.WithLabelValues("archive")) - before; got != 1 {
+		t.Fatalf("expected the record only routed to archive to be counted, got %v", got)
+	}
+}
@@ -5,18 +5,30 @@
 package pump
 
 import (
-	genericapiserver "github.com/marmotedu/iam/internal/pkg/server"
 	"github.com/marmotedu/iam/internal/pump/config"
 )
 
 // Run runs the specified pump server. This should never exit.
 func Run(cfg *config.Config, stopCh <-chan struct{}) error {
-	go genericapiserver.ServeHealthCheck(cfg.HealthCheckPath, cfg.HealthCheckAddress)
+	tuneMemory(cfg.MemoryLimit, cfg.GCPercent)
 
 	server, err := createPumpServer(cfg)
 	if err != nil {
 		return err
 	}
 
-	return server.PrepareRun().Run(stopCh)
+	go server.serveHealthCheck(cfg.HealthCheckPath, cfg.HealthCheckAddress)
+
+	// the pumps are reloaded when the remote configuration changes
+	server.updates, err = cfg.WatchRemoteConfig(stopCh)
+	if err != nil {
+		return err
+	}
+
+	prepared, err := server.PrepareRun()
+	if err != nil {
+		return err
+	}
+
+	return prepared.Run(stopCh)
 }
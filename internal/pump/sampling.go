@@ -0,0 +1,48 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"math/rand"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+)
+
+// defaultSampleRateField is the extra field annotating the sampled records with their sample rate.
+const defaultSampleRateField = pumps.DefaultSampleRateField
+
+// sampleRateField returns the configured name of the sample rate field, or the default one.
+func sampleRateField(name string) string {
+	if name == "" {
+		return defaultSampleRateField
+	}
+
+	return name
+}
+
+// sampled reports whether the pump only receives a fraction of the records.
+func (p *pumpInstance) sampled() bool {
+	return p.sampleRate > 0 && p.sampleRate < 1
+}
+
+// keep samples the record with the probability of the sample rate of the pump. A kept record is
+// annotated with the number of records it stands for, the inverse of the rate, so that the
+// back-ends can scale the counts back up to the true volume.
+func (p *pumpInstance) keep(record *analytics.AnalyticsRecord) bool {
+	if rand.Float64() >= p.sampleRate { //nolint: gosec // sampling does not need a secure source
+		return false
+	}
+
+	// the extra fields are shared by the copies of the record written to the other pumps
+	extra := make(map[string]interface{}, len(record.Extra)+1)
+	for name, value := range record.Extra {
+		extra[name] = value
+	}
+	extra[p.sampleRateField] = 1 / p.sampleRate
+	record.Extra = extra
+
+	return true
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+// scrub clears or hashes the scrub fields of the pump in the record, whether detailed recording is
+// omitted or not, so that every destination only receives the personal data it may store.
+func (p *pumpInstance) scrub(record *analytics.AnalyticsRecord) {
+	if len(p.scrubFields) == 0 {
+		return
+	}
+
+	if p.scrubMode == options.ScrubModeHash {
+		record.HashFields(p.scrubFields, p.scrubHashKey)
+
+		return
+	}
+
+	record.ClearFields(p.scrubFields)
+}
@@ -7,31 +7,234 @@ package pump
 import (
 	"context"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	goredislib "github.com/go-redis/redis/v8"
 	"github.com/go-redsync/redsync/v4"
 	"github.com/go-redsync/redsync/v4/redis/goredis/v8"
-	"github.com/vmihailenco/msgpack/v5"
+	"github.com/marmotedu/errors"
 
 	"github.com/marmotedu/iam/internal/pump/analytics"
 	"github.com/marmotedu/iam/internal/pump/config"
+	"github.com/marmotedu/iam/internal/pump/enrichers"
+	"github.com/marmotedu/iam/internal/pump/metrics"
 	"github.com/marmotedu/iam/internal/pump/options"
 	"github.com/marmotedu/iam/internal/pump/pumps"
 	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/internal/pump/storage/amqp"
+	"github.com/marmotedu/iam/internal/pump/storage/kafka"
+	"github.com/marmotedu/iam/internal/pump/storage/nats"
 	"github.com/marmotedu/iam/internal/pump/storage/redis"
 	"github.com/marmotedu/iam/pkg/log"
 )
 
-var pmps []pumps.Pump
+// pumpInstance binds an initialized pump to the key it is configured with.
+type pumpInstance struct {
+	pumps.Pump
+	name             string
+	shutdownPriority int
+	hooks            []pumps.PreWriteHook
+	omittedFields    []string
+	scrubFields      []string
+	scrubMode        string
+	scrubHashKey     []byte
+	retention        time.Duration
+	flatten          string
+	flattenDelimiter string
+	order            int
+	onError          string
+	maxRetries       int
+	retryBackoff     time.Duration
+	maxRetryBackoff  time.Duration
+	requiredFields   []string
+	onMissingFields  string
+	sampleRate       float64
+	sampleRateField  string
+	maxRecordAge     time.Duration
+	maxRecordSize    int
+	deadLetters      *deadLetterQueue
+	drops            *dropSampler
+	queue            *pumpQueue
+	breaker          *circuitBreaker
+	retainSource     bool
+
+	// purgeDelay is the flush cadence of the pump. The records of a buffered pump, flushed less
+	// often than the analytics storage is read, are kept in buffer until lastFlush is older.
+	purgeDelay time.Duration
+	buffered   bool
+	buffer     []interface{}
+	lastFlush  time.Time
+
+	// mu guards the state of the write in flight. A write abandoned on timeout keeps running in
+	// its goroutine until WriteData returns, abandoned records when that happened.
+	mu         sync.Mutex
+	writing    bool
+	abandoned  time.Time
+	generation int
+
+	// lastWrite, lastError and lastErrorAt are the outcome of the last writes reaching the pump and
+	// written the number of records written, reported by the diagnostics dump and the health check.
+	// They are guarded by mu too.
+	lastWrite   time.Time
+	lastError   string
+	lastErrorAt time.Time
+	written     int64
+
+	// sourceFailed reports that a write of the window to the pump failed, retained counts the
+	// consecutive windows put back in their source as the pump failed to write them, up to
+	// retainMaxWindows when set. They are guarded by mu.
+	sourceFailed     bool
+	retained         int
+	retainMaxWindows int
+
+	// config, marshaler, countField and initTimeout recreate the pump when the watchdog restarts
+	// it, after watchdog consecutive windows without a completed write counted by stalls, guarded
+	// by mu. restarting reports a restart in the background, also guarded by mu, restarts waits
+	// for it.
+	config      options.PumpConfig
+	marshaler   pumps.Marshaler
+	countField  string
+	initTimeout time.Duration
+	watchdog    int
+	stalls      int
+	restarting  bool
+	restarts    sync.WaitGroup
+}
+
+// startWrite marks a write in flight. It refuses to start a new write while a previously
+// abandoned one is still running, which bounds the goroutines a misbehaving pump can leak to one.
+// The generation of the pump instance the write is started on is returned along.
+func (p *pumpInstance) startWrite() (time.Time, int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.abandoned.IsZero() {
+		return p.abandoned, p.generation, false
+	}
+	p.writing = true
+
+	return time.Time{}, p.generation, true
+}
+
+// abandonWrite records that the write in flight outlived its window.
+func (p *pumpInstance) abandonWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writing && p.abandoned.IsZero() {
+		p.abandoned = time.Now()
+		metrics.StuckWrites.WithLabelValues(p.name).Inc()
+	}
+}
+
+// endWrite is called once WriteData returned, whether its window is over or not.
+func (p *pumpInstance) endWrite(generation int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if generation != p.generation {
+		log.Warnf("Stuck write to %s returned after the pump was restarted", p.name)
+
+		return
+	}
+
+	p.writing = false
+	if !p.abandoned.IsZero() {
+		log.Warnf("Stuck write to %s returned %s after it was abandoned", p.GetName(), time.Since(p.abandoned))
+		p.abandoned = time.Time{}
+		metrics.StuckWrites.WithLabelValues(p.name).Dec()
+	}
+}
+
+// write runs the pre-write hooks of the pump, then writes the data unless a hook aborted it.
+func (p *pumpInstance) write(ctx context.Context, data []interface{}) error {
+	pump := p.current()
+	for _, hook := range p.hooks {
+		if err := hook(ctx, pump, data); err != nil {
+			return err
+		}
+	}
+
+	return pump.WriteData(ctx, data)
+}
+
+// errWriteStuck is returned when a write is skipped because the previous one is still running.
+var errWriteStuck = errors.New("previous write is stuck")
+
+// errBreakerOpen is returned when a write is skipped because the circuit breaker of the pump is open.
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// sharedPumpTypeWarnThreshold is the number of pumps of the same type from which a warning is logged.
+const sharedPumpTypeWarnThreshold = 5
 
 type pumpServer struct {
-	secInterval    int
-	omitDetails    bool
-	mutex          *redsync.Mutex
-	analyticsStore storage.AnalyticsStorage
-	pumps          map[string]options.PumpConfig
+	secInterval     int
+	memoryBudget    int64
+	purgeChunkSize  int64
+	expiration      int64
+	windowDeadline  time.Duration
+	atLeastOnce     bool
+	retainMax       int
+	recordSize      float64
+	readInterval    time.Duration
+	omitDetails     bool
+	omittedFields   []string
+	retention       int
+	pauseFile       string
+	pauseRedisKey   string
+	paused          int32
+	decodeErrors    *decodeGuard
+	instanceField   string
+	instanceID      string
+	coalescer       *coalescer
+	deduplicator    *deduplicator
+	lookup          *lookupTable
+	enrichers       []enrichers.Enricher
+	strict          bool
+	initTimeout     time.Duration
+	shutdownTimeout time.Duration
+	maxPumps        int
+	queueSize       int
+	queuePolicy     string
+	keepRaw         bool
+	codec           string
+	decodeWorkers   int
+	decodeBatchSize int
+	client          *goredislib.Client
+	mutex           *redsync.Mutex
+	analyticsStore  storage.AnalyticsStorage
+	sources         []*analyticsSource
+	sourcesStop     chan struct{}
+	sourcesWg       sync.WaitGroup
+	windowMu        sync.Mutex
+	pumps           map[string]options.PumpConfig
+	pmps            []*pumpInstance
+	reloadMu        sync.RWMutex
+	// published holds the pumps reported by the health check, which does not wait for a reload.
+	published       atomic.Value
+	sequential      bool
+	routes          []options.Route
+	defaultPumps    []string
+	router          *router
+	deadLetters     *deadLetterQueue
+	drops           *dropSampler
+	audit           *auditLog
+	dropSamplePump  string
+	keyTypeCheck    string
+	watchdog        int
+	options         *options.Options
+	controlToken    string
+	updates         <-chan *options.Options
+	reloads         chan *options.Options
+	watchConfigFile bool
+
+	// windowStart is the start of the purge window in flight in unix nanoseconds, 0 between windows.
+	windowStart int64
 }
 
 // preparedGenericAPIServer is a private wrapper that enforces a call of PrepareRun() before Run can be invoked.
@@ -39,59 +242,324 @@ type preparedPumpServer struct {
 	*pumpServer
 }
 
+// newLockClient creates the client of the redis holding the lock of the instances, the pause key
+// and the dead letters. The master is discovered through the sentinels when a master name is set.
+func newLockClient(conf *options.RedisSourceOptions) (*goredislib.Client, error) {
+	tlsConfig, err := redis.TLSConfig(*conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.MasterName != "" {
+		return goredislib.NewFailoverClient(&goredislib.FailoverOptions{
+			MasterName:       conf.MasterName,
+			SentinelAddrs:    conf.Addrs,
+			SentinelPassword: conf.SentinelPassword,
+			Username:         conf.Username,
+			Password:         conf.Password,
+			DB:               conf.Database,
+			TLSConfig:        tlsConfig,
+		}), nil
+	}
+
+	return goredislib.NewClient(&goredislib.Options{
+		Addr:      fmt.Sprintf("%s:%d", conf.Host, conf.Port),
+		Username:  conf.Username,
+		Password:  conf.Password,
+		DB:        conf.Database,
+		TLSConfig: tlsConfig,
+	}), nil
+}
+
 func createPumpServer(cfg *config.Config) (*pumpServer, error) {
-	// use the same redis database with authorization log history
-	client := goredislib.NewClient(&goredislib.Options{
-		Addr:     fmt.Sprintf("%s:%d", cfg.RedisOptions.Host, cfg.RedisOptions.Port),
-		Username: cfg.RedisOptions.Username,
-		Password: cfg.RedisOptions.Password,
-	})
+	// use the same redis database with authorization log history, only when it holds the lock of
+	// the redis source, the pause key or the dead letters
+	var client *goredislib.Client
+	if cfg.Source == options.SourceRedis || cfg.PauseRedisKey != "" || cfg.DeadLetterKey != "" {
+		var err error
+		if client, err = newLockClient(cfg.RedisOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	commands := redis.CommandOptions{
+		ReadTimeout:   time.Duration(cfg.RedisReadTimeout) * time.Second,
+		WriteTimeout:  time.Duration(cfg.RedisWriteTimeout) * time.Second,
+		SlowThreshold: time.Duration(cfg.RedisSlowThreshold) * time.Millisecond,
+	}
+	instanceID := resolveInstanceID(cfg.InstanceID)
+	// the records read are kept in a processing key of the instance until written
+	var processingID string
+	if cfg.AtLeastOnce {
+		processingID = instanceID
+	}
+	// the sources acknowledging the records read only acknowledge those written to every pump
+	atLeastOnce := cfg.AtLeastOnce || cfg.Source != options.SourceRedis
+
+	var analyticsStore storage.AnalyticsStorage = &redis.RedisClusterStorageManager{
+		Commands:     commands,
+		ProcessingID: processingID,
+	}
+	var storeConfig interface{} = cfg.RedisOptions
+	// the instances consuming kafka share the partitions of the topic as a group, the instances
+	// consuming nats the durable consumer and the instances consuming amqp the queue, no lock is needed
+	var mutex *redsync.Mutex
+	switch cfg.Source {
+	case options.SourceKafka:
+		analyticsStore = &kafka.StorageManager{}
+		storeConfig = cfg.KafkaSource
+	case options.SourceNATS:
+		analyticsStore = &nats.StorageManager{}
+		storeConfig = cfg.NATSSource
+	case options.SourceAMQP:
+		analyticsStore = &amqp.StorageManager{}
+		storeConfig = cfg.AMQPSource
+	default:
+		mutex = redsync.New(goredis.NewPool(client)).NewMutex("iam-pump", redsync.WithExpiry(10*time.Minute))
+	}
 
-	rs := redsync.New(goredis.NewPool(client))
+	pumps.SetMaxBackgroundWorkers(cfg.MaxBackgroundWorkers)
 
 	server := &pumpServer{
-		secInterval:    cfg.PurgeDelay,
-		omitDetails:    cfg.OmitDetailedRecording,
-		mutex:          rs.NewMutex("iam-pump", redsync.WithExpiry(10*time.Minute)),
-		analyticsStore: &redis.RedisClusterStorageManager{},
-		pumps:          cfg.Pumps,
+		secInterval:     cfg.PurgeDelay,
+		windowDeadline:  time.Duration(cfg.WindowDeadline) * time.Second,
+		atLeastOnce:     atLeastOnce,
+		retainMax:       cfg.RetainMaxWindows,
+		memoryBudget:    int64(cfg.PurgeMemoryBudget) << 20,
+		purgeChunkSize:  int64(cfg.PurgeChunkSize),
+		expiration:      int64(cfg.StorageExpirationTime),
+		omitDetails:     cfg.OmitDetailedRecording,
+		omittedFields:   omittedFields(cfg.OmittedFields),
+		retention:       cfg.Retention,
+		pauseFile:       cfg.PauseFile,
+		pauseRedisKey:   cfg.PauseRedisKey,
+		decodeErrors:    newDecodeGuard(cfg.DecodeErrorThreshold, cfg.DecodeErrorWindows),
+		instanceField:   cfg.InstanceField,
+		instanceID:      instanceID,
+		coalescer:       newCoalescer(cfg.CoalesceFields, cfg.CoalesceTimestamps, cfg.CoalesceCountField),
+		deduplicator:    newDeduplicator(time.Duration(cfg.DedupWindow)*time.Second, cfg.DedupFields),
+		strict:          cfg.Strict,
+		initTimeout:     time.Duration(cfg.InitTimeout) * time.Second,
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
+		maxPumps:        cfg.MaxPumps,
+		queueSize:       cfg.QueueSize,
+		queuePolicy:     cfg.QueuePolicy,
+		codec:           cfg.Codec,
+		decodeWorkers:   cfg.DecodeWorkers,
+		decodeBatchSize: cfg.DecodeBatchSize,
+		client:          client,
+		mutex:           mutex,
+		analyticsStore:  analyticsStore,
+		pumps:           cfg.Pumps,
+		sequential:      cfg.Sequential,
+		routes:          cfg.Routes,
+		defaultPumps:    cfg.DefaultPumps,
+		options:         cfg.Options,
+		controlToken:    cfg.ControlToken,
+		dropSamplePump:  cfg.DropSamplePump,
+		keyTypeCheck:    cfg.KeyTypeCheck,
+		watchdog:        cfg.WatchdogWindows,
+		reloads:         make(chan *options.Options, 1),
+		watchConfigFile: cfg.WatchConfig,
+	}
+
+	lookup, err := newLookupTable(cfg.Lookup.File, cfg.Lookup.KeyField)
+	if err != nil {
+		return nil, err
+	}
+	server.lookup = lookup
+
+	if server.enrichers, err = newEnrichers(cfg.Enrichers); err != nil {
+		return nil, err
 	}
 
-	if err := server.analyticsStore.Init(cfg.RedisOptions); err != nil {
+	if cfg.DeadLetterKey != "" || cfg.DeadLetterDir != "" {
+		server.deadLetters = &deadLetterQueue{client: client, key: cfg.DeadLetterKey, dir: cfg.DeadLetterDir}
+	}
+
+	if cfg.DropSampleRate > 0 {
+		server.drops = &dropSampler{rate: cfg.DropSampleRate}
+	}
+
+	if err := server.analyticsStore.Init(storeConfig); err != nil {
 		return nil, err
 	}
 
+	if server.sources, err = newAnalyticsSources(cfg.Sources, commands, processingID); err != nil {
+		return nil, err
+	}
+
+	audit, err := newAuditLog(cfg.AuditLogFile, cfg.AuditLogMaxSize, cfg.AuditLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	server.audit = audit
+
 	return server, nil
 }
 
-func (s *pumpServer) PrepareRun() preparedPumpServer {
-	s.initialize()
+func (s *pumpServer) PrepareRun() (preparedPumpServer, error) {
+	if err := s.initialize(); err != nil {
+		return preparedPumpServer{}, err
+	}
 
-	return preparedPumpServer{s}
+	if err := s.checkKeyType(); err != nil {
+		return preparedPumpServer{}, err
+	}
+
+	s.recoverSources()
+
+	return preparedPumpServer{s}, nil
+}
+
+// recoverSources puts back the analytics data read and not acknowledged by the instances which
+// stopped in the middle of a window, before the first window reads the sources.
+func (s *pumpServer) recoverSources() {
+	for _, src := range append([]*analyticsSource{s.primarySource()}, s.sources...) {
+		recovering, ok := src.store.(storage.RecoveringStorage)
+		if !ok {
+			continue
+		}
+
+		if err := recovering.Recover(src.key); err != nil {
+			log.Errorf("Failed to recover the analytics data not acknowledged in source %s: %s", src.name, err.Error())
+		}
+	}
+}
+
+// checkKeyType verifies that the analytics key, when it exists, has the type drained by the
+// storage. A mismatch otherwise shows up as empty or failing purges at every window.
+func (s *pumpServer) checkKeyType() error {
+	checker, ok := s.analyticsStore.(storage.KeyTypeCheckingStorage)
+	if !ok || s.keyTypeCheck == options.KeyTypeCheckOff {
+		return nil
+	}
+
+	err := checker.CheckKeyType(storage.AnalyticsKeyName)
+	if err == nil {
+		return nil
+	}
+
+	if s.keyTypeCheck == options.KeyTypeCheckFail {
+		return err
+	}
+	log.Warnf("Analytics key check failed: %s", err.Error())
+
+	return nil
 }
 
 func (s preparedPumpServer) Run(stopCh <-chan struct{}) error {
-	ticker := time.NewTicker(time.Duration(s.secInterval) * time.Second)
+	ticker := time.NewTicker(s.readInterval)
 	defer ticker.Stop()
 
+	go s.handleSignals(stopCh)
+	if s.watchConfigFile {
+		s.watchConfig()
+	}
+	s.startSources()
+
 	log.Info("Now run loop to clean data from redis")
 	for {
 		select {
 		case <-ticker.C:
 			s.pump()
+		case updated := <-s.updates:
+			s.reload(updated)
+			ticker.Reset(s.readInterval)
+			s.resetSources(s.readInterval)
+		case updated := <-s.reloads:
+			s.reload(updated)
+			ticker.Reset(s.readInterval)
+			s.resetSources(s.readInterval)
 		// exit consumption cycle when receive SIGINT and SIGTERM signal
 		case <-stopCh:
 			log.Info("stop purge loop")
 
-			return nil
+			return s.stop()
 		}
 	}
 }
 
+// stop runs a final purge window, writing the records stored since the last window instead of
+// leaving them to the next start, waits for the final windows of the additional sources, then
+// shuts the pump server down. A window in flight when the stop is signaled completes first, as
+// the windows run in the purge loop.
+func (s *pumpServer) stop() error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		s.pump()
+		s.stopSources()
+		s.shutdown()
+	}()
+
+	if s.shutdownTimeout <= 0 {
+		<-done
+
+		return nil
+	}
+
+	timer := time.NewTimer(s.shutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return errors.Errorf("shutdown timed out after %s", s.shutdownTimeout)
+	}
+}
+
 // pump get authorization log from redis and write to pumps.
 func (s *pumpServer) pump() {
+	start, audit, status := time.Now(), &windowAudit{}, auditProcessed
+	defer func() {
+		s.audit.window(start, primarySourceName, audit, status)
+	}()
+
+	if s.decodeErrors.isHalted() {
+		log.Error("Purge loop is halted on decode errors, leaving analytics data in redis")
+		status = auditHalted
+
+		return
+	}
+
+	if s.checkPaused() {
+		log.Debug("Purge loop is paused, leaving analytics data in redis")
+		status = auditPaused
+
+		return
+	}
+
+	// never drain the analytics data from redis when there is nowhere to write it
+	if len(s.pmps) == 0 {
+		log.Warn("No pumps defined! Leaving analytics data in redis")
+		status = auditNoPumps
+
+		return
+	}
+
+	ctx, cancel := s.windowContext(start)
+	atomic.StoreInt64(&s.windowStart, start.UnixNano())
+	defer func() {
+		atomic.StoreInt64(&s.windowStart, 0)
+		cancel()
+		if s.abandonedWindow(ctx) {
+			status = auditAbandoned
+		}
+	}()
+	ctx = withWindowAudit(ctx, audit)
+
+	if s.mutex == nil {
+		s.drain(ctx)
+
+		return
+	}
+
 	if err := s.mutex.Lock(); err != nil {
 		log.Info("there is already an iam-pump instance running.")
+		status = auditLocked
 
 		return
 	}
@@ -101,69 +569,480 @@ func (s *pumpServer) pump() {
 		}
 	}()
 
-	analyticsValues := s.analyticsStore.GetAndDeleteSet(storage.AnalyticsKeyName)
-	if len(analyticsValues) == 0 {
-		return
-	}
+	s.drain(ctx)
+}
+
+// process decodes the analytics values read from the storage and writes them to the pumps. It
+// returns the undecodable values to put back in the storage, by window, when the decode errors
+// halt the loop.
+func (s *pumpServer) process(ctx context.Context, analyticsValues []interface{}) [][]interface{} {
+	audit := auditOf(ctx)
+	audit.addRead(len(analyticsValues))
+	size := 0
 
 	// Convert to something clean
-	keys := make([]interface{}, len(analyticsValues))
+	keys := make([]interface{}, 0, len(analyticsValues))
 
+	var undecodable []interface{}
+	records, errs := decodeValues(analyticsValues, newCodec(s.codec), s.decodeWorkers, s.decodeBatchSize,
+		func(raw string, record *analytics.AnalyticsRecord) {
+			if s.keepRaw {
+				record.Raw = []byte(raw)
+			}
+			s.transform(record)
+		})
 	for i, v := range analyticsValues {
-		decoded := analytics.AnalyticsRecord{}
-		err := msgpack.Unmarshal([]byte(v.(string)), &decoded)
-		log.Debugf("Decoded Record: %v", decoded)
-		if err != nil {
-			log.Errorf("Couldn't unmarshal analytics data: %s", err.Error())
+		raw, _ := v.(string)
+		size += len(raw)
+		log.Debugf("Decoded Record: %v", records[i])
+		if errs[i] != nil {
+			log.Errorf("Couldn't unmarshal analytics data: %s", errs[i].Error())
+			undecodable = append(undecodable, v)
+			// the undecodable record is lost for every pump
+			audit.addDropped(len(s.pmps))
 		} else {
-			if s.omitDetails {
-				decoded.Policies = ""
-				decoded.Deciders = ""
-			}
-			keys[i] = interface{}(decoded)
+			keys = append(keys, interface{}(records[i]))
 		}
 	}
 
+	metrics.RecordsDecoded.Add(float64(len(analyticsValues) - len(undecodable)))
+	metrics.DecodeErrors.Add(float64(len(undecodable)))
+	s.observeRecordSize(size, len(analyticsValues))
+	held := s.decodeErrors.observe(undecodable, len(analyticsValues))
+	keys = s.deduplicator.dedup(keys)
+	keys = s.coalescer.coalesce(keys)
+
 	// Send to pumps
-	writeToPumps(keys, s.secInterval)
+	s.writeToPumps(ctx, keys)
+
+	return held
+}
+
+// initialize initializes the configured pumps.
+func (s *pumpServer) initialize() error {
+	return s.initializeKeeping(nil)
 }
 
-func (s *pumpServer) initialize() {
-	pmps = make([]pumps.Pump, len(s.pumps))
-	i := 0
+// initializeKeeping initializes the configured pumps, except the running ones which are kept as
+// they are.
+func (s *pumpServer) initializeKeeping(running map[string]*pumpInstance) error {
+	if s.maxPumps > 0 && len(s.pumps) > s.maxPumps {
+		return errors.Errorf("%d pumps configured, which exceeds the maximum of %d pumps (see --max-pumps)",
+			len(s.pumps), s.maxPumps)
+	}
+
+	warnSharedPumpTypes(s.pumps)
+	if err := checkDuplicatePumps(s.pumps, s.strict); err != nil {
+		return err
+	}
+
+	s.pmps = make([]*pumpInstance, 0, len(s.pumps))
 	for key, pmp := range s.pumps {
-		pumpTypeName := pmp.Type
-		if pumpTypeName == "" {
-			pumpTypeName = key
+		if kept, ok := running[key]; ok {
+			if rawPump, ok := kept.current().(pumps.RawRecordsPump); ok && rawPump.WantsRawRecords() {
+				s.keepRaw = true
+			}
+			s.pmps = append(s.pmps, kept)
+
+			continue
+		}
+
+		pumpTypeName := pumpType(key, pmp)
+
+		hooks, err := preWriteHooks(pmp.PreWriteHooks)
+		if err == nil {
+			err = analytics.ValidateFlatten(pmp.Flatten)
+		}
+		if err == nil {
+			err = analytics.ValidateFormat(pmp.Format)
+		}
+		if err == nil {
+			err = analytics.ValidateFieldPrecedence(pmp.FieldPrecedence)
+		}
+		if err == nil {
+			pmp.Filters, err = pmp.Filters.Compile()
+		}
+		var marshaler pumps.Marshaler
+		if err == nil && pmp.Marshaler != "" {
+			marshaler, err = pumps.GetMarshalerByName(pmp.Marshaler)
+		}
+		if err != nil {
+			if s.strict {
+				return errors.Wrapf(err, "failed to load pump %s", key)
+			}
+			log.Errorf("Pump load error (skipping): %s", err.Error())
+
+			continue
 		}
 
 		pmpType, err := pumps.GetPumpByName(pumpTypeName)
 		if err != nil {
+			if s.strict {
+				return errors.Wrapf(err, "failed to load pump %s", key)
+			}
 			log.Errorf("Pump load error (skipping): %s", err.Error())
 		} else {
 			pmpIns := pmpType.New()
-			initErr := pmpIns.Init(pmp.Meta)
+			var initErr error
+			if _, ok := pmpIns.(pumps.MarshalingPump); marshaler != nil && !ok {
+				initErr = errors.Errorf("pump %s does not support marshalers, remove its %s marshaler", key, pmp.Marshaler)
+			} else {
+				initErr = initPump(pmpIns, pmp.Meta, s.initTimeout)
+				if initErr == nil {
+					if initErr = s.checkRawRecords(pmpIns, key, pmp); initErr != nil {
+						_ = pmpIns.Shutdown()
+					}
+				}
+			}
 			if initErr != nil {
+				if s.strict {
+					return errors.Wrapf(initErr, "failed to init pump %s", key)
+				}
 				log.Errorf("Pump init error (skipping): %s", initErr.Error())
 			} else {
 				log.Infof("Init Pump: %s", pmpIns.GetName())
-				pmpIns.SetFilters(pmp.Filters)
-				pmpIns.SetTimeout(pmp.Timeout)
-				pmpIns.SetOmitDetailedRecording(pmp.OmitDetailedRecording)
-				pmps[i] = pmpIns
+				configurePump(pmpIns, key, pmp, marshaler, s.coalescer.field())
+				s.warnFieldCollisions(key, pmp)
+				purgeDelay := pmp.PurgeDelay
+				if purgeDelay == 0 {
+					purgeDelay = s.secInterval
+				}
+				retention := pmp.Retention
+				if retention == 0 {
+					retention = s.retention
+				}
+				if expiring, ok := pmpIns.(pumps.ExpiringPump); retention > 0 && (!ok || !expiring.ExpiresRecords()) {
+					log.Warnf("Pump %s does not expire records, the retention only sets their expireAt", key)
+				}
+				if rawPump, ok := pmpIns.(pumps.RawRecordsPump); ok && rawPump.WantsRawRecords() {
+					log.Infof("Pump %s requests the raw analytics payloads", key)
+					s.keepRaw = true
+				}
+				s.pmps = append(s.pmps, &pumpInstance{
+					Pump:             pmpIns,
+					name:             key,
+					shutdownPriority: pmp.ShutdownPriority,
+					hooks:            hooks,
+					omittedFields:    omittedFields(pmp.OmittedFields, s.omittedFields),
+					scrubFields:      pmp.ScrubFields,
+					scrubMode:        pmp.ScrubMode,
+					scrubHashKey:     []byte(pmp.ScrubHashKey),
+					retention:        time.Duration(retention) * time.Second,
+					flatten:          pmp.Flatten,
+					flattenDelimiter: pmp.FlattenDelimiter,
+					order:            pmp.Order,
+					onError:          pmp.OnError,
+					maxRetries:       pmp.MaxRetries,
+					retryBackoff:     time.Duration(pmp.RetryBackoff) * time.Millisecond,
+					maxRetryBackoff:  time.Duration(pmp.MaxRetryBackoff) * time.Millisecond,
+					requiredFields:   pmp.RequiredFields,
+					onMissingFields:  pmp.OnMissingFields,
+					sampleRate:       pmp.SampleRate,
+					sampleRateField:  sampleRateField(pmp.SampleRateField),
+					maxRecordAge:     time.Duration(pmp.MaxRecordAge) * time.Second,
+					maxRecordSize:    pmp.MaxRecordSize,
+					deadLetters:      s.deadLetters,
+					drops:            s.drops,
+					breaker:          newCircuitBreaker(pmp.BreakerThreshold, time.Duration(pmp.BreakerCooldown)*time.Second),
+					retainSource:     pmp.RetainSourceUntilSuccess,
+					retainMaxWindows: s.retainMax,
+					purgeDelay:       time.Duration(purgeDelay) * time.Second,
+					config:           pmp,
+					marshaler:        marshaler,
+					countField:       s.coalescer.field(),
+					initTimeout:      s.initTimeout,
+					watchdog:         s.watchdog,
+				})
 			}
 		}
-		i++
+	}
+
+	if len(s.pmps) == 0 {
+		if s.strict {
+			return errors.New("no pump could be initialized, refusing to start")
+		}
+		log.Error("No pump could be initialized, analytics data will be kept in redis until pumps are configured")
+	}
+
+	if err := s.setDropSink(); err != nil {
+		return err
+	}
+
+	s.setReadInterval()
+	if err := s.checkRetainingPumps(); err != nil {
+		return err
+	}
+	s.startQueues()
+
+	// the order only matters to the sequential mode, it keeps the logs deterministic otherwise
+	sort.SliceStable(s.pmps, func(i, j int) bool {
+		if s.pmps[i].order != s.pmps[j].order {
+			return s.pmps[i].order < s.pmps[j].order
+		}
+
+		return s.pmps[i].name < s.pmps[j].name
+	})
+
+	s.router = newRouter(s.routes, s.defaultPumps, s.pmps)
+	s.publishPumps()
+
+	return nil
+}
+
+// configurePump applies the common options of the pump configuration to the initialized pump,
+// along with the format, marshaler and coalesced count field of the pumps supporting them.
+func configurePump(pmpIns pumps.Pump, key string, pmp options.PumpConfig, marshaler pumps.Marshaler,
+	countField string) {
+	pmpIns.SetFilters(pmp.Filters)
+	pmpIns.SetTimeout(pmp.Timeout)
+	pmpIns.SetOmitDetailedRecording(pmp.OmitDetailedRecording)
+	if formatted, ok := pmpIns.(pumps.FormattedPump); ok {
+		formatted.SetFormat(pmp.Format)
+	} else if pmp.Format != analytics.FormatDefault {
+		log.Warnf("Pump %s does not support formats, the %s format is ignored", key, pmp.Format)
+	}
+	if resolving, ok := pmpIns.(pumps.FieldPrecedencePump); ok {
+		resolving.SetFieldPrecedence(pmp.FieldPrecedence)
+	}
+	if reporting, ok := pmpIns.(pumps.RejectionReportingPump); ok {
+		reporting.SetRejectionReporter(func(reason string, records int, err error) {
+			reportRejection(key, reason, records, err)
+		})
+	}
+	if marshaling, ok := pmpIns.(pumps.MarshalingPump); ok && marshaler != nil {
+		marshaling.SetMarshaler(marshaler)
+	}
+	if counting, ok := pmpIns.(pumps.CountingPump); ok {
+		counting.SetCountField(countField)
+	}
+}
+
+// omittedFields returns the first configured list of fields to clear when detailed recording is
+// omitted, falling back to the default fields.
+func omittedFields(lists ...[]string) []string {
+	for _, fields := range lists {
+		if len(fields) > 0 {
+			return fields
+		}
+	}
+
+	return analytics.DefaultOmittedFields
+}
+
+// checkRawRecords refuses the pump writing the original payloads which scrubs or omits fields,
+// the payloads are written untouched.
+func (s *pumpServer) checkRawRecords(pmp pumps.Pump, key string, config options.PumpConfig) error {
+	if rawPump, ok := pmp.(pumps.RawRecordsPump); !ok || !rawPump.WantsRawRecords() {
+		return nil
+	}
+
+	if len(config.ScrubFields) > 0 || config.OmitDetailedRecording || s.omitDetails {
+		return errors.Errorf("pump %s writes the original payloads, which its scrub-fields and "+
+			"omit-detailed-recording would not apply to", key)
+	}
+
+	return nil
+}
+
+// preWriteHooks resolves the pre-write hooks referenced by name in a pump configuration.
+func preWriteHooks(names []string) ([]pumps.PreWriteHook, error) {
+	hooks := make([]pumps.PreWriteHook, 0, len(names))
+	for _, name := range names {
+		hook, err := pumps.GetPreWriteHookByName(name)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// pumpType returns the type of the pump configured under key, which defaults to the key itself.
+func pumpType(key string, pmp options.PumpConfig) string {
+	if pmp.Type != "" {
+		return pmp.Type
+	}
+
+	return key
+}
+
+// warnSharedPumpTypes warns when many pumps write to the same type of back-end, which is
+// usually the sign of a mistake in a generated configuration.
+func warnSharedPumpTypes(configs map[string]options.PumpConfig) {
+	counts := make(map[string]int)
+	for key, pmp := range configs {
+		counts[pumpType(key, pmp)]++
+	}
+
+	for typ, count := range counts {
+		if count >= sharedPumpTypeWarnThreshold {
+			log.Warnf("%d pumps are configured with the same back-end type %s, check the pumps configuration", count, typ)
+		}
+	}
+}
+
+// checkDuplicatePumps detects the pumps configured under different keys which resolve to the same
+// pump with the same meta configuration, they would write every record twice to the same back-end.
+// It warns about them, or fails in strict mode.
+func checkDuplicatePumps(configs map[string]options.PumpConfig, strict bool) error {
+	identities := make(map[string][]string)
+	for key, pmp := range configs {
+		pmpType, err := pumps.GetPumpByName(pumpType(key, pmp))
+		if err != nil {
+			// reported when the pump is loaded
+			continue
+		}
+
+		identity := fmt.Sprintf("%s %v", pmpType.GetName(), pmp.Meta)
+		identities[identity] = append(identities[identity], key)
+	}
+
+	duplicates := make([]string, 0)
+	for _, keys := range identities {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			duplicates = append(duplicates, strings.Join(keys, ", "))
+		}
+	}
+	sort.Strings(duplicates)
+
+	for _, keys := range duplicates {
+		if strict {
+			return errors.Errorf("pumps %s are configured with the same back-end, their records would be written twice", keys)
+		}
+		log.Warnf("Pumps %s are configured with the same back-end, their records are written twice", keys)
+	}
+
+	return nil
+}
+
+// initPump initializes the pump within the given timeout, a zero timeout waits forever.
+// A pump which does not finish initializing in time is reported as failed, its Init keeps
+// running in the background as the Pump interface does not allow to cancel it.
+func initPump(pmp pumps.Pump, meta map[string]interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return pmp.Init(meta)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- pmp.Init(meta)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return errors.Errorf("%s initialization timed out after %s", pmp.GetName(), timeout)
 	}
 }
 
-func writeToPumps(keys []interface{}, purgeDelay int) {
+// shutdown releases the resources held by the pump server once the purge loop stopped.
+func (s *pumpServer) shutdown() {
+	s.flushBuffers()
+	s.closeQueues()
+	s.shutdownPumps()
+	stats.logSummary()
+	s.audit.close()
+
+	if closer, ok := s.analyticsStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("could not close the %s analytics storage. err: %v", s.analyticsStore.GetName(), err)
+		}
+	}
+
+	s.closeSources()
+	s.closeEnrichers()
+
+	if s.client == nil {
+		return
+	}
+	if err := s.client.Close(); err != nil {
+		log.Errorf("could not close redis client. err: %v", err)
+	}
+}
+
+// shutdownPumps shuts the pumps down in descending shutdown priority. All the pumps sharing a priority
+// are shut down concurrently, and the next priority starts only once all of them returned.
+func (s *pumpServer) shutdownPumps() {
+	shutdownPumpInstances(s.instances())
+}
+
+// instances returns the pumps of the server, along with the sink of the dropped record samples.
+func (s *pumpServer) instances() []*pumpInstance {
+	instances := make([]*pumpInstance, len(s.pmps), len(s.pmps)+1)
+	copy(instances, s.pmps)
+	if s.drops != nil && s.drops.sink != nil {
+		instances = append(instances, s.drops.sink)
+	}
+
+	return instances
+}
+
+// shutdownPumpInstances shuts the given pumps down in descending shutdown priority.
+func shutdownPumpInstances(instances []*pumpInstance) {
+	ordered := make([]*pumpInstance, len(instances))
+	copy(ordered, instances)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].shutdownPriority > ordered[j].shutdownPriority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start
+		for end < len(ordered) && ordered[end].shutdownPriority == ordered[start].shutdownPriority {
+			end++
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(end - start)
+		for _, pmp := range ordered[start:end] {
+			go func(pmp *pumpInstance) {
+				defer wg.Done()
+
+				// the pump replaced by a restart in flight would otherwise not be shut down
+				pmp.restarts.Wait()
+				log.Infof("Shutting down pump %s", pmp.name)
+				if err := pmp.current().Shutdown(); err != nil {
+					log.Errorf("Pump %s shutdown error: %s", pmp.name, err.Error())
+				}
+			}(pmp)
+		}
+		wg.Wait()
+
+		start = end
+	}
+}
+
+// writeToPumps writes the records to the pumps within the deadline of the window context.
+func (s *pumpServer) writeToPumps(ctx context.Context, keys []interface{}) {
+	defer s.drops.flush(time.Duration(s.secInterval) * time.Second)
+
+	batches := s.batches(keys)
+	if s.router != nil {
+		for _, batch := range batches {
+			auditOf(ctx).addFiltered(len(keys) - len(batch))
+		}
+	}
+	s.bufferBatches(batches, time.Now())
+
+	if s.sequential {
+		s.writeToPumpsSequentially(ctx, batches)
+
+		return
+	}
+
 	// Send to pumps
-	if pmps != nil {
+	if len(s.pmps) > 0 {
 		var wg sync.WaitGroup
-		wg.Add(len(pmps))
-		for _, pmp := range pmps {
-			go execPumpWriting(&wg, pmp, &keys, purgeDelay)
+		for i, pmp := range s.pmps {
+			if len(batches[i]) == 0 {
+				continue
+			}
+			pmp.send(ctx, &wg, batches[i], s.secInterval)
 		}
 		wg.Wait()
 	} else {
@@ -171,77 +1050,299 @@ func writeToPumps(keys []interface{}, purgeDelay int) {
 	}
 }
 
-func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
-	filters := pump.GetFilters()
-	if !filters.HasFilter() && !pump.GetOmitDetailedRecording() {
-		return keys
+// writeToPumpsSequentially writes the data to the pumps one after another, in their configured order.
+// When a pump with the abort error policy fails, the remaining pumps are not written for this window.
+func (s *pumpServer) writeToPumpsSequentially(ctx context.Context, batches [][]interface{}) {
+	for i, pmp := range s.pmps {
+		if len(batches[i]) == 0 {
+			continue
+		}
+
+		// the queued pumps are written asynchronously, their errors can not abort the window
+		if pmp.queue != nil {
+			pmp.queue.push(ctx, batches[i])
+
+			continue
+		}
+
+		err := writePump(ctx, pmp, &batches[i], s.secInterval)
+		pmp.observeSource(err)
+		if err != nil && pmp.onError == options.OnErrorAbort {
+			log.Warnf("Pump %s failed, aborting the write of this window to the %d remaining pumps", pmp.name, len(s.pmps)-i-1)
+			for j, batch := range batches[i+1:] {
+				auditOf(ctx).addDropped(len(batch))
+				s.drops.sample(s.pmps[i+1+j].name, dropReasonAbort, batch...)
+				if len(batch) > 0 {
+					s.pmps[i+1+j].observeSource(err)
+				}
+			}
+
+			return
+		}
+	}
+}
+
+// filterData applies the transformations of the pump to the records and returns the records to
+// write. The records filtered out are dropped, the records missing a required field are returned
+// apart as rejected.
+func filterData(pump *pumpInstance, keys []interface{}) ([]interface{}, []interface{}) {
+	// the watchdog may replace the pump of the instance while its records are filtered
+	current := pump.current()
+	filters := current.GetFilters()
+	omit := current.GetOmitDetailedRecording()
+	if !filters.HasFilter() && !omit && len(pump.scrubFields) == 0 &&
+		pump.retention == 0 && pump.flatten == "" && len(pump.requiredFields) == 0 && !pump.sampled() &&
+		pump.maxRecordAge == 0 && pump.maxRecordSize == 0 {
+		return keys, nil
 	}
-	filteredKeys := keys[:] // nolint: gocritic
-	newLenght := 0
+	// keys is shared by all the pumps written concurrently, so filter into a new slice
+	filteredKeys := make([]interface{}, 0, len(keys))
+	var rejected []interface{}
 
-	for _, key := range filteredKeys {
+	for _, key := range keys {
 		decoded, _ := key.(analytics.AnalyticsRecord)
-		if pump.GetOmitDetailedRecording() {
-			decoded.Policies = ""
-			decoded.Deciders = ""
+		if omit {
+			decoded.ClearFields(pump.omittedFields)
+		}
+		pump.scrub(&decoded)
+		if pump.retention > 0 {
+			decoded.ExpireAt = time.Unix(decoded.TimeStamp, 0).Add(pump.retention)
 		}
+		decoded.Flatten(pump.flatten, pump.flattenDelimiter)
 		if filters.ShouldFilter(decoded) {
+			pump.drops.sample(pump.name, dropReasonFilter, decoded)
+
+			continue
+		}
+		if pump.maxRecordAge > 0 && time.Since(time.Unix(decoded.TimeStamp, 0)) > pump.maxRecordAge {
+			pump.drops.sample(pump.name, dropReasonStale, decoded)
+
 			continue
 		}
-		filteredKeys[newLenght] = decoded
-		newLenght++
+		if pump.maxRecordSize > 0 && decoded.EstimateSize() > pump.maxRecordSize {
+			pump.drops.sample(pump.name, dropReasonOversize, decoded)
+
+			continue
+		}
+		if field, ok := missingField(&decoded, pump.requiredFields); ok {
+			metrics.MissingFields.WithLabelValues(pump.name, field).Inc()
+			rejected = append(rejected, decoded)
+
+			continue
+		}
+		if pump.sampled() && !pump.keep(&decoded) {
+			pump.drops.sample(pump.name, dropReasonSample, decoded)
+
+			continue
+		}
+		filteredKeys = append(filteredKeys, decoded)
+	}
+
+	return filteredKeys, rejected
+}
+
+// missingField returns the first of the required fields the record misses.
+func missingField(record *analytics.AnalyticsRecord, required []string) (string, bool) {
+	for _, field := range required {
+		if !record.HasField(field) {
+			return field, true
+		}
+	}
+
+	return "", false
+}
+
+// reject drops or dead-letters the records missing a field required by the pump in the window.
+func (p *pumpInstance) reject(window context.Context, records []interface{}) {
+	if len(records) == 0 {
+		return
 	}
-	filteredKeys = filteredKeys[:newLenght]
 
-	return filteredKeys
+	log.Warnf("Pump %s rejected %d records missing a required field", p.name, len(records))
+	auditOf(window).addDropped(len(records))
+	if p.onMissingFields == options.OnMissingFieldsDeadLetter {
+		p.deadLetter(records, deadLetterMissingFields)
+
+		return
+	}
+	p.drops.sample(p.name, dropReasonFields, records...)
 }
 
-func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, purgeDelay int) {
+func execPumpWriting(window context.Context, wg *sync.WaitGroup, pmp *pumpInstance, keys *[]interface{}, purgeDelay int) {
+	defer wg.Done()
+
+	pmp.observeSource(writePump(window, pmp, keys, purgeDelay))
+}
+
+// writePump writes the data to a pump within the deadline of the window context, it returns the
+// error which made the write fail, if any.
+func writePump(window context.Context, pmp *pumpInstance, keys *[]interface{}, purgeDelay int) error {
+	// the watchdog may replace the pump of the instance before the timer fires
+	pump := pmp.current()
+	audit := auditOf(window)
 	timer := time.AfterFunc(time.Duration(purgeDelay)*time.Second, func() {
-		if pmp.GetTimeout() == 0 {
+		if pump.GetTimeout() == 0 {
 			log.Warnf(
 				"Pump %s is taking more time than the value configured of purge_delay. You should try to set a timeout for this pump.",
-				pmp.GetName(),
+				pump.GetName(),
 			)
-		} else if pmp.GetTimeout() > purgeDelay {
-			log.Warnf("Pump %s is taking more time than the value configured of purge_delay. You should try lowering the timeout configured for this pump.", pmp.GetName())
+		} else if pump.GetTimeout() > purgeDelay {
+			log.Warnf("Pump %s is taking more time than the value configured of purge_delay. You should try lowering the timeout configured for this pump.", pump.GetName())
 		}
 	})
 	defer timer.Stop()
-	defer wg.Done()
 
-	log.Debugf("Writing to: %s", pmp.GetName())
+	since, generation, ok := pmp.startWrite()
+	if !ok {
+		log.Warnf("Skipping write to %s: the previous write is stuck since %s, the pump does not honor its context",
+			pump.GetName(), time.Since(since))
+		metrics.SkippedWrites.WithLabelValues(pmp.name).Inc()
+		audit.addDropped(len(*keys))
+		pmp.drops.sample(pmp.name, dropReasonStuck, *keys...)
+		pmp.stalled()
+
+		return errWriteStuck
+	}
+
+	if window.Err() != nil {
+		pmp.endWrite(generation)
+		log.Warnf("Skipping write to %s: the deadline of the window is exceeded", pump.GetName())
+		audit.addErrored(len(*keys))
+		pmp.deadLetterUnretained(window, *keys, deadLetterWindowDeadline)
+
+		return window.Err()
+	}
+
+	if !pmp.breaker.allow(time.Now()) {
+		pmp.endWrite(generation)
+		log.Debugf("Skipping write to %s: its circuit breaker is open", pump.GetName())
+		audit.addErrored(len(*keys))
+		pmp.deadLetterUnretained(window, *keys, deadLetterBreakerOpen)
+
+		return errBreakerOpen
+	}
+
+	log.Debugf("Writing to: %s", pump.GetName())
 
 	ch := make(chan error, 1)
 	var ctx context.Context
 	var cancel context.CancelFunc
 	// Initialize context depending if the pump has a configured timeout
-	if tm := pmp.GetTimeout(); tm > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(tm)*time.Second)
+	if tm := pump.GetTimeout(); tm > 0 {
+		ctx, cancel = context.WithTimeout(window, time.Duration(tm)*time.Second)
 	} else {
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(window)
 	}
 
 	defer cancel()
 
-	go func(ch chan error, ctx context.Context, pmp pumps.Pump, keys *[]interface{}) {
-		filteredKeys := filterData(pmp, *keys)
+	counter := &pumps.ByteCounter{}
+	ctx = pumps.WithByteCounter(ctx, counter)
+	filteredKeys, rejected := filterData(pmp, *keys)
+	audit.addFiltered(len(*keys) - len(filteredKeys) - len(rejected))
+	metrics.FilteredRecords.WithLabelValues(pmp.name).Add(float64(len(*keys) - len(filteredKeys) - len(rejected)))
+	pmp.reject(window, rejected)
 
-		ch <- pmp.WriteData(ctx, filteredKeys)
-	}(ch, ctx, pmp, keys)
+	start := time.Now()
+	go func(ch chan error, ctx context.Context, pmp *pumpInstance, keys []interface{}) {
+		err := pmp.writeWithRetry(ctx, keys)
+		pmp.endWrite(generation)
+		ch <- err
+	}(ch, ctx, pmp, filteredKeys)
 
 	select {
 	case err := <-ch:
+		pmp.resetStalls()
+		if errors.Is(err, pumps.ErrSkipWrite) {
+			log.Debugf("Writing to %s skipped by pre-write hook", pump.GetName())
+			audit.addFiltered(len(filteredKeys))
+			metrics.FilteredRecords.WithLabelValues(pmp.name).Add(float64(len(filteredKeys)))
+			pmp.drops.sample(pmp.name, dropReasonHook, filteredKeys...)
+
+			pmp.breaker.release()
+
+			return nil
+		}
+		pmp.breaker.done(pmp.name, err, time.Now())
+		pmp.wrote(len(filteredKeys), err, time.Now())
+		metrics.WriteDuration.WithLabelValues(pmp.name).Observe(time.Since(start).Seconds())
 		if err != nil {
-			log.Warnf("Error Writing to: %s - Error: %s", pmp.GetName(), err.Error())
+			log.Warnf("Error Writing to: %s - Error: %s", pump.GetName(), err.Error())
+			metrics.WriteErrors.WithLabelValues(pmp.name).Inc()
+			if reason, ok := pumps.RejectionReason(err); ok {
+				reportRejection(pmp.name, reason, len(filteredKeys), err)
+			}
+			audit.error(pmp.name, err)
+			audit.addErrored(len(filteredKeys))
+			pmp.deadLetterUnretained(window, filteredKeys, pmp.deadLetterReason(err))
+
+			return err
 		}
+		audit.addWritten(len(filteredKeys))
+		meterWrite(pmp.name, filteredKeys, counter, time.Now())
+
+		return nil
 	case <-ctx.Done():
+		pmp.abandonWrite()
+		pmp.breaker.done(pmp.name, ctx.Err(), time.Now())
+		pmp.wrote(0, ctx.Err(), time.Now())
+		audit.addErrored(len(filteredKeys))
 		//nolint: errorlint
 		switch ctx.Err() {
 		case context.Canceled:
-			log.Warnf("The writing to %s have got canceled.", pmp.GetName())
+			log.Warnf("The writing to %s have got canceled.", pump.GetName())
 		case context.DeadlineExceeded:
-			log.Warnf("Timeout Writing to: %s", pmp.GetName())
+			log.Warnf("Timeout Writing to: %s", pump.GetName())
+			metrics.WriteTimeouts.WithLabelValues(pmp.name).Inc()
+		}
+		audit.error(pmp.name, ctx.Err())
+		if window.Err() != nil {
+			// the records of the abandoned window are spilled, they may still be written by the
+			// abandoned write. The write was cut off by the window, the pump did not stall.
+			pmp.deadLetterUnretained(window, filteredKeys, deadLetterWindowDeadline)
+
+			return ctx.Err()
 		}
+		pmp.stalled()
+
+		return ctx.Err()
 	}
 }
+
+// reportRejection accounts the records of the pump its back-end rejected for reason, and logs the
+// rejection with its reason as structured fields.
+func reportRejection(name string, reason string, records int, err error) {
+	metrics.BackendRejections.WithLabelValues(name, reason).Add(float64(records))
+	log.Warnw("Back-end rejected records", "pump", name, "reason", reason, "records", records, "error", err.Error())
+}
+
+// meterWrite accounts the records and bytes successfully written by a pump, and their end-to-end latency.
+func meterWrite(name string, keys []interface{}, counter *pumps.ByteCounter, now time.Time) {
+	metrics.RecordsWritten.WithLabelValues(name).Add(float64(len(keys)))
+
+	latency := metrics.E2ELatency.WithLabelValues(name)
+	size, reported := counter.Value()
+	for _, key := range keys {
+		record, ok := key.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		if !reported {
+			size += int64(record.EstimateSize())
+		}
+		latency.Observe(recordLatency(record, now))
+	}
+	metrics.BytesWritten.WithLabelValues(name).Add(float64(size))
+}
+
+// recordLatency returns the delay in seconds between the creation of the record and now. A record
+// created in the future by a node whose clock is ahead is clamped to zero.
+func recordLatency(record analytics.AnalyticsRecord, now time.Time) float64 {
+	latency := now.Sub(time.Unix(record.TimeStamp, 0)).Seconds()
+	if latency < 0 {
+		return 0
+	}
+
+	return latency
+}
@@ -0,0 +1,678 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goredislib "github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+)
+
+// mockPump records every batch written to it.
+type mockPump struct {
+	mu         sync.Mutex
+	written    []interface{}
+	initDelay  time.Duration
+	onShutdown func()
+	pumps.CommonPumpConfig
+}
+
+func (p *mockPump) New() pumps.Pump {
+	return &mockPump{}
+}
+
+func (p *mockPump) GetName() string {
+	return "Mock Pump"
+}
+
+func (p *mockPump) Init(conf interface{}) error {
+	time.Sleep(p.initDelay)
+
+	return nil
+}
+
+func (p *mockPump) WriteData(ctx context.Context, data []interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.written = append(p.written, data...)
+
+	return nil
+}
+
+func (p *mockPump) Shutdown() error {
+	if p.onShutdown != nil {
+		p.onShutdown()
+	}
+
+	return nil
+}
+
+func (p *mockPump) records() []interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.written
+}
+
+func TestMeterWrite(t *testing.T) {
+	record := analytics.AnalyticsRecord{Username: "colin", Request: "{}"}
+	keys := []interface{}{record, record}
+
+	meterWrite("meter-estimated", keys, &pumps.ByteCounter{}, time.Now())
+	if written := testutil.ToFloat64(metrics.RecordsWritten.WithLabelValues("meter-estimated")); written != 2 {
+		t.Errorf("the records written should be counted, got %v", written)
+	}
+	if size := testutil.ToFloat64(metrics.BytesWritten.WithLabelValues("meter-estimated")); size !=
+		float64(2*record.EstimateSize()) {
+		t.Errorf("the size of the records should be estimated when the pump does not report it, got %v", size)
+	}
+
+	counter := &pumps.ByteCounter{}
+	counter.Add(100)
+	meterWrite("meter-reported", keys, counter, time.Now())
+	if size := testutil.ToFloat64(metrics.BytesWritten.WithLabelValues("meter-reported")); size != 100 {
+		t.Errorf("the size reported by the pump should be counted, got %v", size)
+	}
+}
+
+func TestWriteToPumps(t *testing.T) {
+	all := &mockPump{}
+	filtered := &mockPump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{SkippedUsernames: []string{"admin"}})
+
+	s := &pumpServer{
+		secInterval: 1,
+		pmps: []*pumpInstance{
+			{Pump: all, name: "all"},
+			{Pump: filtered, name: "filtered"},
+		},
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{Username: "admin"},
+		analytics.AnalyticsRecord{Username: "colin"},
+	})
+
+	if got := len(all.records()); got != 2 {
+		t.Fatalf("expected 2 records written to unfiltered pump, got %d", got)
+	}
+
+	if got := len(filtered.records()); got != 1 {
+		t.Fatalf("expected 1 record written to filtered pump, got %d", got)
+	}
+}
+
+func TestInitPumpTimeout(t *testing.T) {
+	slow := &mockPump{initDelay: 100 * time.Millisecond}
+	if err := initPump(slow, nil, 10*time.Millisecond); err == nil {
+		t.Fatal("slow pump initialization should time out")
+	}
+
+	fast := &mockPump{}
+	if err := initPump(fast, nil, time.Second); err != nil {
+		t.Fatalf("pump initialization should succeed, got %v", err)
+	}
+
+	if err := initPump(slow, nil, 0); err != nil {
+		t.Fatalf("pump initialization without deadline should succeed, got %v", err)
+	}
+}
+
+func TestShutdownPumpsByPriority(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	newPump := func(name string, priority int) *pumpInstance {
+		return &pumpInstance{
+			Pump: &mockPump{onShutdown: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, name)
+			}},
+			name:             name,
+			shutdownPriority: priority,
+		}
+	}
+
+	s := &pumpServer{pmps: []*pumpInstance{
+		newPump("relay", 0),
+		newPump("archive", 10),
+		newPump("metrics", 5),
+	}}
+	s.shutdownPumps()
+
+	expected := []string{"archive", "metrics", "relay"}
+	for i, name := range expected {
+		if order[i] != name {
+			t.Fatalf("expected shutdown order %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestInitializeMaxPumps(t *testing.T) {
+	s := &pumpServer{
+		maxPumps: 1,
+		pumps: map[string]options.PumpConfig{
+			"dummy":   {},
+			"another": {Type: "dummy"},
+		},
+	}
+
+	if err := s.initialize(); err == nil {
+		t.Fatal("initialize should refuse more pumps than the maximum")
+	}
+
+	s.maxPumps = 2
+	if err := s.initialize(); err != nil {
+		t.Fatalf("initialize should accept pumps up to the maximum, got %v", err)
+	}
+
+	if len(s.pmps) != 2 {
+		t.Fatalf("expected 2 initialized pumps, got %d", len(s.pmps))
+	}
+}
+
+func TestInitializeWithoutPumps(t *testing.T) {
+	s := &pumpServer{pumps: map[string]options.PumpConfig{"unknown": {}}}
+	if err := s.initialize(); err != nil {
+		t.Fatalf("initialize should skip unknown pumps, got %v", err)
+	}
+
+	s.strict = true
+	if err := s.initialize(); err == nil {
+		t.Fatal("initialize should fail in strict mode when no pump is available")
+	}
+}
+
+func TestInitializeFilterExpression(t *testing.T) {
+	s := &pumpServer{secInterval: 1, strict: true, pumps: map[string]options.PumpConfig{
+		"denied": {Type: "dummy", Filters: analytics.AnalyticsFilters{Expression: `record.Effect == "deny"`}},
+	}}
+	if err := s.initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, _ := filterData(s.pmps[0], []interface{}{
+		analytics.AnalyticsRecord{Effect: "allow"},
+		analytics.AnalyticsRecord{Effect: "deny"},
+	})
+	if len(kept) != 1 || kept[0].(analytics.AnalyticsRecord).Effect != "deny" {
+		t.Fatalf("only the records matching the expression should be written, got %v", kept)
+	}
+
+	s.pumps["denied"] = options.PumpConfig{Type: "dummy", Filters: analytics.AnalyticsFilters{Expression: `record.`}}
+	if err := s.initialize(); err == nil {
+		t.Fatal("an invalid filter expression should fail in strict mode")
+	}
+}
+
+func TestInitializeMarshaler(t *testing.T) {
+	s := &pumpServer{secInterval: 1, strict: true, pumps: map[string]options.PumpConfig{
+		"dummy": {Type: "dummy", Marshaler: "msgpack"},
+	}}
+	if err := s.initialize(); err == nil {
+		t.Fatal("a marshaler should be rejected for a pump which does not support marshalers")
+	}
+
+	s = &pumpServer{secInterval: 1, pumps: map[string]options.PumpConfig{
+		"dummy": {Type: "dummy", Marshaler: "msgpack"},
+		"kept":  {Type: "dummy"},
+	}}
+	if err := s.initialize(); err != nil || len(s.pmps) != 1 || s.pmps[0].name != "kept" {
+		t.Fatalf("the pump with an unsupported marshaler should be skipped, got %v", err)
+	}
+}
+
+func TestInitializeRawRecords(t *testing.T) {
+	raw := map[string]interface{}{"csv_dir": t.TempDir(), "columns": []string{"timestamp", "raw"}}
+	s := &pumpServer{secInterval: 1, strict: true, pumps: map[string]options.PumpConfig{
+		"csv": {Type: "csv", Meta: raw, ScrubFields: []string{"username"}},
+	}}
+	if err := s.initialize(); err == nil {
+		t.Fatal("a pump writing the original payloads should not scrub fields")
+	}
+
+	s = &pumpServer{secInterval: 1, strict: true, omitDetails: true, pumps: map[string]options.PumpConfig{
+		"csv": {Type: "csv", Meta: raw},
+	}}
+	if err := s.initialize(); err == nil {
+		t.Fatal("a pump writing the original payloads should not omit fields")
+	}
+
+	s.omitDetails = false
+	if err := s.initialize(); err != nil || !s.keepRaw {
+		t.Fatalf("a pump writing the original payloads should be initialized, got %v", err)
+	}
+	shutdownPumpInstances(s.pmps)
+}
+
+func TestPreWriteHooks(t *testing.T) {
+	errLocked := errors.New("lock not acquired")
+	if err := pumps.RegisterPreWriteHook("test-lock", func(ctx context.Context, pump pumps.Pump, data []interface{}) error {
+		return errLocked
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, err := preWriteHooks([]string{"skip-empty", "test-lock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := preWriteHooks([]string{"unknown"}); err == nil {
+		t.Fatal("unknown pre-write hook should be rejected")
+	}
+
+	pmp := &mockPump{}
+	instance := &pumpInstance{Pump: pmp, name: "mock", hooks: hooks}
+
+	if err := instance.write(context.Background(), nil); !errors.Is(err, pumps.ErrSkipWrite) {
+		t.Fatalf("empty batch should be skipped, got %v", err)
+	}
+
+	if err := instance.write(context.Background(), []interface{}{analytics.AnalyticsRecord{}}); !errors.Is(err, errLocked) {
+		t.Fatalf("write should be aborted by the hook, got %v", err)
+	}
+
+	if len(pmp.records()) != 0 {
+		t.Fatal("aborted writes should not reach the pump")
+	}
+}
+
+// blockingPump ignores the context of its writes and blocks until released.
+type blockingPump struct {
+	mockPump
+	release chan struct{}
+	calls   int32
+}
+
+func (p *blockingPump) WriteData(ctx context.Context, data []interface{}) error {
+	atomic.AddInt32(&p.calls, 1)
+	<-p.release
+
+	return nil
+}
+
+func TestStuckWriteDoesNotLeakGoroutines(t *testing.T) {
+	pmp := &blockingPump{release: make(chan struct{})}
+	pmp.SetTimeout(1)
+
+	s := &pumpServer{
+		secInterval: 1,
+		pmps:        []*pumpInstance{{Pump: pmp, name: "blocking"}},
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	}
+
+	if calls := atomic.LoadInt32(&pmp.calls); calls != 1 {
+		t.Fatalf("expected writes to be skipped while the first one is stuck, got %d calls", calls)
+	}
+
+	if leaked := runtime.NumGoroutine() - before; leaked > 0 {
+		t.Fatalf("expected goroutines not to accumulate across windows, got %d more", leaked)
+	}
+
+	close(pmp.release)
+	time.Sleep(10 * time.Millisecond)
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	if calls := atomic.LoadInt32(&pmp.calls); calls != 2 {
+		t.Fatalf("expected writes to resume once the stuck write returned, got %d calls", calls)
+	}
+}
+
+func TestFilterDataRetention(t *testing.T) {
+	pmp := &pumpInstance{Pump: &mockPump{}, name: "mock", retention: time.Hour}
+
+	filtered, _ := filterData(pmp, []interface{}{analytics.AnalyticsRecord{TimeStamp: 1600000000}})
+	record, _ := filtered[0].(analytics.AnalyticsRecord)
+	if expected := time.Unix(1600000000, 0).Add(time.Hour); !record.ExpireAt.Equal(expected) {
+		t.Fatalf("expected record to expire at %s, got %s", expected, record.ExpireAt)
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	now := time.Unix(1600000010, 0)
+
+	if latency := recordLatency(analytics.AnalyticsRecord{TimeStamp: 1600000000}, now); latency != 10 {
+		t.Fatalf("expected 10s latency, got %v", latency)
+	}
+
+	if latency := recordLatency(analytics.AnalyticsRecord{TimeStamp: 1600000020}, now); latency != 0 {
+		t.Fatalf("expected records from the future to be clamped to 0, got %v", latency)
+	}
+}
+
+// failingPump fails every write.
+type failingPump struct {
+	mockPump
+}
+
+func (p *failingPump) WriteData(ctx context.Context, data []interface{}) error {
+	return errors.New("backend unavailable")
+}
+
+func TestWriteToPumpsSequentially(t *testing.T) {
+	first := &mockPump{}
+	last := &mockPump{}
+	s := &pumpServer{
+		secInterval: 1,
+		sequential:  true,
+		pmps: []*pumpInstance{
+			{Pump: first, name: "first"},
+			{Pump: &failingPump{}, name: "critical", onError: options.OnErrorAbort},
+			{Pump: last, name: "last"},
+		},
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	if len(first.records()) != 1 || len(last.records()) != 0 {
+		t.Fatal("the failure of the critical pump should abort the write to the remaining pumps")
+	}
+
+	s.pmps[1].onError = options.OnErrorContinue
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	if len(last.records()) != 1 {
+		t.Fatal("the remaining pumps should be written when the failing pump continues on error")
+	}
+}
+
+// flakyPump fails its first writes with the given error.
+type flakyPump struct {
+	mockPump
+	failures int
+	err      error
+	calls    int
+}
+
+func (p *flakyPump) WriteData(ctx context.Context, data []interface{}) error {
+	p.calls++
+	if p.calls <= p.failures {
+		return p.err
+	}
+
+	return p.mockPump.WriteData(ctx, data)
+}
+
+func TestWriteWithRetry(t *testing.T) {
+	transient := &flakyPump{failures: 2, err: errors.New("connection reset")}
+	instance := &pumpInstance{Pump: transient, name: "transient", maxRetries: 2, retryBackoff: time.Millisecond}
+	start := time.Now()
+	if err := instance.writeWithRetry(context.Background(), []interface{}{analytics.AnalyticsRecord{}}); err != nil {
+		t.Fatalf("transient failures should be retried, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= retryBackoff {
+		t.Fatalf("the retries should wait for the configured backoff, took %s", elapsed)
+	}
+
+	permanent := &flakyPump{failures: 1, err: pumps.Permanent(errors.New("unauthorized"))}
+	instance = &pumpInstance{Pump: permanent, name: "permanent", maxRetries: 2}
+	if err := instance.writeWithRetry(context.Background(), nil); err == nil || permanent.calls != 1 {
+		t.Fatalf("permanent failures should not be retried, got %d calls", permanent.calls)
+	}
+
+	if reason := instance.deadLetterReason(permanent.err); reason != deadLetterPermanent {
+		t.Fatalf("expected permanent dead-letter reason, got %s", reason)
+	}
+
+	classified := &classifyingPump{flakyPump{failures: 1, err: errors.New("quota exceeded")}}
+	instance = &pumpInstance{Pump: classified, name: "classified", maxRetries: 2}
+	if err := instance.writeWithRetry(context.Background(), nil); err == nil || classified.calls != 1 {
+		t.Fatalf("the errors classified permanent by the pump should not be retried, got %d calls", classified.calls)
+	}
+}
+
+// classifyingPump classifies all its errors as permanent.
+type classifyingPump struct {
+	flakyPump
+}
+
+func (p *classifyingPump) Retryable(err error) bool {
+	return false
+}
+
+func TestFilterDataRequiredFields(t *testing.T) {
+	pmp := &pumpInstance{Pump: &mockPump{}, name: "mock", requiredFields: []string{"timestamp", "region"}}
+
+	valid := analytics.AnalyticsRecord{TimeStamp: 1600000000}
+	valid.SetExtra("region", "cn")
+	filtered, rejected := filterData(pmp, []interface{}{
+		valid,
+		analytics.AnalyticsRecord{TimeStamp: 1600000000},
+		analytics.AnalyticsRecord{Username: "colin"},
+	})
+	if len(filtered) != 1 || len(rejected) != 2 {
+		t.Fatalf("records missing a required field should be rejected, got %d kept and %d rejected",
+			len(filtered), len(rejected))
+	}
+
+	if field, ok := missingField(&valid, pmp.requiredFields); ok {
+		t.Fatalf("no field should be missing, got %s", field)
+	}
+}
+
+func TestFilterDataSampleRate(t *testing.T) {
+	pmp := &pumpInstance{Pump: &mockPump{}, name: "mock", sampleRate: 0.25, sampleRateField: sampleRateField("")}
+
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = analytics.AnalyticsRecord{TimeStamp: int64(i)}
+	}
+
+	filtered, _ := filterData(pmp, keys)
+	if len(filtered) == 0 || len(filtered) == len(keys) {
+		t.Fatalf("a fraction of the records should be kept, got %d of %d", len(filtered), len(keys))
+	}
+
+	for _, key := range filtered {
+		record, _ := key.(analytics.AnalyticsRecord)
+		if rate, _ := record.Extra[defaultSampleRateField].(float64); rate != 4 {
+			t.Fatalf("the kept records should be annotated with the sample rate, got %v", record.Extra)
+		}
+	}
+
+	if original, _ := keys[0].(analytics.AnalyticsRecord); original.Extra != nil {
+		t.Fatalf("the records shared with the other pumps should not be annotated, got %v", original.Extra)
+	}
+}
+
+func TestFilterDataScrubFields(t *testing.T) {
+	record := analytics.AnalyticsRecord{TimeStamp: 1600000000, Username: "colin", Policies: "[]"}
+	record.SetExtra("remoteIPAddress", "10.0.0.1")
+	keys := []interface{}{record}
+
+	cleared, _ := filterData(&pumpInstance{
+		Pump:        &mockPump{},
+		name:        "cleared",
+		scrubFields: []string{"username", "remoteIPAddress"},
+	}, keys)
+	scrubbed, _ := cleared[0].(analytics.AnalyticsRecord)
+	if scrubbed.Username != "" || scrubbed.Extra["remoteIPAddress"] != nil || scrubbed.Policies != "[]" {
+		t.Fatalf("only the scrub fields should be cleared, got %+v", scrubbed)
+	}
+
+	hashed, _ := filterData(&pumpInstance{
+		Pump:         &mockPump{},
+		name:         "hashed",
+		scrubFields:  []string{"username", "remoteIPAddress"},
+		scrubMode:    options.ScrubModeHash,
+		scrubHashKey: []byte("secret"),
+	}, keys)
+	scrubbed, _ = hashed[0].(analytics.AnalyticsRecord)
+	if len(scrubbed.Username) != 64 || scrubbed.Username == "colin" || scrubbed.Extra["remoteIPAddress"] == "10.0.0.1" {
+		t.Fatalf("the scrub fields should be hashed, got %+v", scrubbed)
+	}
+
+	if original, _ := keys[0].(analytics.AnalyticsRecord); original.Username != "colin" ||
+		original.Extra["remoteIPAddress"] != "10.0.0.1" {
+		t.Fatalf("the records shared with the other pumps should not be scrubbed, got %+v", original)
+	}
+}
+
+func TestCheckDuplicatePumps(t *testing.T) {
+	configs := map[string]options.PumpConfig{
+		"csv":     {Type: "csv", Meta: map[string]interface{}{"csv_dir": "./analytics-data"}},
+		"archive": {Type: "csv", Meta: map[string]interface{}{"csv_dir": "./analytics-data"}},
+		"backup":  {Type: "csv", Meta: map[string]interface{}{"csv_dir": "./backup"}},
+	}
+
+	if err := checkDuplicatePumps(configs, false); err != nil {
+		t.Fatalf("duplicates should only be reported outside of strict mode, got %v", err)
+	}
+
+	err := checkDuplicatePumps(configs, true)
+	if err == nil || !strings.Contains(err.Error(), "archive, csv") {
+		t.Fatalf("duplicates should fail in strict mode with the conflicting keys, got %v", err)
+	}
+
+	delete(configs, "archive")
+	if err := checkDuplicatePumps(configs, true); err != nil {
+		t.Fatalf("pumps with different configurations are not duplicates, got %v", err)
+	}
+}
+
+// listStore is an analytics storage whose key has the given redis type.
+type listStore struct {
+	chunkedStore
+	keyType string
+}
+
+func (l *listStore) CheckKeyType(key string) error {
+	if l.keyType != "list" {
+		return errors.New(key + " is a " + l.keyType)
+	}
+
+	return nil
+}
+
+func TestCheckKeyType(t *testing.T) {
+	store := &listStore{keyType: "set"}
+	s := &pumpServer{analyticsStore: store, keyTypeCheck: options.KeyTypeCheckFail}
+	if err := s.checkKeyType(); err == nil {
+		t.Fatal("a key of the wrong type should fail the startup")
+	}
+
+	s.keyTypeCheck = options.KeyTypeCheckWarn
+	if err := s.checkKeyType(); err != nil {
+		t.Fatalf("a key of the wrong type should only be warned about, got %v", err)
+	}
+
+	s.keyTypeCheck = options.KeyTypeCheckFail
+	store.keyType = "list"
+	if err := s.checkKeyType(); err != nil {
+		t.Fatalf("a list key should pass the check, got %v", err)
+	}
+}
+
+func TestStopRunsFinalWindow(t *testing.T) {
+	store := &chunkedStore{}
+	for i := 0; i < 3; i++ {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+		store.values = append(store.values, string(b))
+	}
+
+	shutdown := false
+	mock := &mockPump{onShutdown: func() { shutdown = true }}
+	s := &pumpServer{
+		secInterval:     1,
+		shutdownTimeout: time.Second,
+		analyticsStore:  store,
+		client:          goredislib.NewClient(&goredislib.Options{}),
+		pmps:            []*pumpInstance{{Pump: mock, name: "mock"}},
+	}
+
+	if err := s.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.records()) != 3 || len(store.values) != 0 {
+		t.Errorf("the records left in the storage should be written at stop, got %d", len(mock.records()))
+	}
+
+	if !shutdown {
+		t.Error("the pumps should be shut down after the final window")
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	s := &pumpServer{
+		secInterval:     1,
+		shutdownTimeout: 50 * time.Millisecond,
+		analyticsStore:  &chunkedStore{},
+		client:          goredislib.NewClient(&goredislib.Options{}),
+		pmps:            []*pumpInstance{{Pump: &mockPump{onShutdown: func() { <-release }}, name: "stuck"}},
+	}
+
+	start := time.Now()
+	if err := s.stop(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("a stuck shutdown should time out, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the stop should return at the shutdown timeout, took %s", elapsed)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	filtered := &mockPump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{SkippedUsernames: []string{"admin"}})
+	s := &pumpServer{
+		secInterval: 1,
+		pmps: []*pumpInstance{
+			{Pump: filtered, name: "metrics-filtered"},
+			{Pump: &failingPump{}, name: "metrics-failing"},
+			{Pump: &contextPump{}, name: "metrics-slow"},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.writeToPumps(ctx, []interface{}{
+		analytics.AnalyticsRecord{Username: "admin"},
+		analytics.AnalyticsRecord{Username: "colin"},
+	})
+
+	if filtered := testutil.ToFloat64(metrics.FilteredRecords.WithLabelValues("metrics-filtered")); filtered != 1 {
+		t.Errorf("the filtered records should be counted, got %v", filtered)
+	}
+
+	if written := testutil.ToFloat64(metrics.RecordsWritten.WithLabelValues("metrics-filtered")); written != 1 {
+		t.Errorf("the written records should be counted, got %v", written)
+	}
+
+	if failed := testutil.ToFloat64(metrics.WriteErrors.WithLabelValues("metrics-failing")); failed != 1 {
+		t.Errorf("the failed writes should be counted, got %v", failed)
+	}
+
+	if timeouts := testutil.ToFloat64(metrics.WriteTimeouts.WithLabelValues("metrics-slow")); timeouts != 1 {
+		t.Errorf("the timed out writes should be counted, got %v", timeouts)
+	}
+
+	if observed := testutil.CollectAndCount(metrics.WriteDuration, "pump_write_duration_seconds"); observed < 2 {
+		t.Errorf("the duration of the completed writes should be observed, got %d series", observed)
+	}
+}
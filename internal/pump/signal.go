@@ -0,0 +1,50 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"os"
+	"os/signal"
+)
+
+// handleSignals dumps the runtime diagnostics on the diagnostics signals and reloads the lookup
+// table and the configuration file on the reload signals, until stopCh is closed. It runs in its own goroutine so that the
+// state of a purge window holding the loop can be dumped.
+func (s *pumpServer) handleSignals(stopCh <-chan struct{}) {
+	handled := append(append([]os.Signal{}, diagnosticsSignals...), reloadSignals...)
+	// no signals would relay them all
+	if len(handled) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, handled...)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case sig := <-signals:
+			if isSignal(sig, diagnosticsSignals) {
+				s.dumpDiagnostics()
+			}
+			if isSignal(sig, reloadSignals) {
+				s.reloadLookup()
+				s.reloadConfig()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func isSignal(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+
+	return false
+}
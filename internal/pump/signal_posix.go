@@ -0,0 +1,19 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package pump
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// diagnosticsSignals are the signals dumping the runtime diagnostics.
+	diagnosticsSignals = []os.Signal{syscall.SIGUSR1}
+	// reloadSignals are the signals reloading the lookup table and the configuration file.
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+)
@@ -0,0 +1,14 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import "os"
+
+// windows has no SIGUSR1 and no SIGHUP is delivered, the diagnostics and reloads are not
+// triggered by signals.
+var (
+	diagnosticsSignals []os.Signal
+	reloadSignals      []os.Signal
+)
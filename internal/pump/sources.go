@@ -0,0 +1,256 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	goredislib "github.com/go-redis/redis/v8"
+	"github.com/go-redsync/redsync/v4"
+	"github.com/go-redsync/redsync/v4/redis/goredis/v8"
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/internal/pump/storage/amqp"
+	"github.com/marmotedu/iam/internal/pump/storage/kafka"
+	"github.com/marmotedu/iam/internal/pump/storage/nats"
+	"github.com/marmotedu/iam/internal/pump/storage/redis"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// primarySourceName is the name of the source configured by the --source flags.
+const primarySourceName = "default"
+
+// analyticsSource is an analytics storage drained into the pumps: the storage configured by the
+// --source flags, or one of the additional sources purged by their own loops.
+type analyticsSource struct {
+	name  string
+	key   string
+	store storage.AnalyticsStorage
+	// mutex ensures a single iam-pump instance drains a redis source, it is nil for the sources
+	// shared by the instances as a group.
+	mutex  *redsync.Mutex
+	client *goredislib.Client
+	// atLeastOnce puts the values read back when any pump failed to write them synchronously, as
+	// the redis sources in at-least-once mode and the sources acknowledging the records read do.
+	atLeastOnce bool
+	// intervals hands the read interval of the reloaded configuration to the purge loop.
+	intervals chan time.Duration
+}
+
+// primarySource returns the source configured by the --source flags.
+func (s *pumpServer) primarySource() *analyticsSource {
+	return &analyticsSource{
+		name:        primarySourceName,
+		key:         storage.AnalyticsKeyName,
+		store:       s.analyticsStore,
+		mutex:       s.mutex,
+		atLeastOnce: s.atLeastOnce,
+	}
+}
+
+// newAnalyticsSources creates and initializes the additional sources, in the order of their names.
+// The redis sources keep the records read in the processing key of processingID when set.
+func newAnalyticsSources(
+	configs map[string]options.SourceConfig,
+	commands redis.CommandOptions,
+	processingID string,
+) ([]*analyticsSource, error) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sources := make([]*analyticsSource, 0, len(names))
+	for _, name := range names {
+		config := configs[name]
+		conf, err := config.StorageOptions()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid source %s", name)
+		}
+
+		src := &analyticsSource{name: name, key: config.Key, atLeastOnce: true}
+		if src.key == "" {
+			src.key = storage.AnalyticsKeyName
+		}
+
+		switch conf := conf.(type) {
+		case *options.RedisSourceOptions:
+			src.store = &redis.RedisClusterStorageManager{
+				Commands:     commands,
+				Dedicated:    true,
+				ProcessingID: processingID,
+			}
+			src.atLeastOnce = processingID != ""
+			if src.client, err = newLockClient(conf); err != nil {
+				return nil, errors.Wrapf(err, "invalid source %s", name)
+			}
+			// the instances draining another key of the same cluster do not contend for its lock
+			lock := "iam-pump"
+			if src.key != storage.AnalyticsKeyName {
+				lock += ":" + src.key
+			}
+			src.mutex = redsync.New(goredis.NewPool(src.client)).NewMutex(lock, redsync.WithExpiry(10*time.Minute))
+		case *options.KafkaSourceOptions:
+			src.store = &kafka.StorageManager{}
+		case *options.NATSSourceOptions:
+			src.store = &nats.StorageManager{}
+		case *options.AMQPSourceOptions:
+			src.store = &amqp.StorageManager{}
+		}
+
+		if err := src.store.Init(conf); err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize source %s", name)
+		}
+		log.Infof("Purging the additional %s source %s into the pumps", src.store.GetName(), name)
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// startSources starts the purge loop of every additional source.
+func (s *pumpServer) startSources() {
+	if len(s.sources) == 0 {
+		return
+	}
+
+	s.sourcesStop = make(chan struct{})
+	for _, src := range s.sources {
+		src.intervals = make(chan time.Duration, 1)
+		s.sourcesWg.Add(1)
+		go s.runSource(src)
+	}
+}
+
+// resetSources resets the tickers of the purge loops of the additional sources to the read
+// interval, once a reload changed it. A reset still pending is replaced.
+func (s *pumpServer) resetSources(interval time.Duration) {
+	if s.sourcesStop == nil {
+		return
+	}
+
+	for _, src := range s.sources {
+		select {
+		case <-src.intervals:
+		default:
+		}
+
+		select {
+		case src.intervals <- interval:
+		default:
+		}
+	}
+}
+
+// stopSources stops the purge loops of the additional sources, once their final window is written.
+func (s *pumpServer) stopSources() {
+	if s.sourcesStop == nil {
+		return
+	}
+
+	close(s.sourcesStop)
+	s.sourcesWg.Wait()
+	s.sourcesStop = nil
+}
+
+// runSource purges the source at every read interval until the sources are stopped, a final
+// window writing the records stored since the last one.
+func (s *pumpServer) runSource(src *analyticsSource) {
+	defer s.sourcesWg.Done()
+
+	ticker := time.NewTicker(s.readInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.purgeSource(src)
+		case interval := <-src.intervals:
+			ticker.Reset(interval)
+		case <-s.sourcesStop:
+			s.purgeSource(src)
+
+			return
+		}
+	}
+}
+
+// purgeSource drains the source in a purge window. The windows of the sources are written to the
+// pumps one at a time, the maintenance switch and the halt of the purge loop apply to every source.
+func (s *pumpServer) purgeSource(src *analyticsSource) {
+	start, audit, status := time.Now(), &windowAudit{}, auditProcessed
+	defer func() {
+		s.audit.window(start, src.name, audit, status)
+	}()
+
+	if s.decodeErrors.isHalted() {
+		status = auditHalted
+
+		return
+	}
+
+	if s.isPaused() {
+		status = auditPaused
+
+		return
+	}
+
+	// the pumps are not reloaded while the window is written
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+
+	if len(s.pmps) == 0 {
+		status = auditNoPumps
+
+		return
+	}
+
+	ctx, cancel := s.windowContext(start)
+	defer func() {
+		cancel()
+		if s.abandonedWindow(ctx) {
+			status = auditAbandoned
+		}
+	}()
+	ctx = withWindowAudit(ctx, audit)
+
+	if src.mutex != nil {
+		if err := src.mutex.Lock(); err != nil {
+			log.Debugf("There is already an iam-pump instance draining source %s", src.name)
+			status = auditLocked
+
+			return
+		}
+		defer func() {
+			if _, err := src.mutex.Unlock(); err != nil {
+				log.Errorf("could not release the iam-pump lock of source %s. err: %v", src.name, err)
+			}
+		}()
+	}
+
+	s.drainSource(ctx, src)
+}
+
+// closeSources closes the storages and the redis clients of the additional sources.
+func (s *pumpServer) closeSources() {
+	for _, src := range s.sources {
+		if closer, ok := src.store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Errorf("could not close the analytics storage of source %s. err: %v", src.name, err)
+			}
+		}
+
+		if src.client != nil {
+			if err := src.client.Close(); err != nil {
+				log.Errorf("could not close the redis client of source %s. err: %v", src.name, err)
+			}
+		}
+	}
+}
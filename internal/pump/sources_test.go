@@ -0,0 +1,148 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/storage"
+	"github.com/marmotedu/iam/internal/pump/storage/kafka"
+	"github.com/marmotedu/iam/internal/pump/storage/redis"
+)
+
+func TestSources(t *testing.T) {
+	stores := map[string]*chunkedStore{}
+	for _, username := range []string{"colin", "james", "admin"} {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: username})
+		stores[username] = &chunkedStore{values: []interface{}{string(b)}}
+	}
+
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:    1,
+		readInterval:   time.Hour,
+		analyticsStore: stores["colin"],
+		pmps:           []*pumpInstance{{Pump: mock, name: "mock"}},
+		sources: []*analyticsSource{
+			{name: "b", key: "b-analytics", store: stores["james"]},
+			{name: "c", key: storage.AnalyticsKeyName, store: stores["admin"]},
+		},
+	}
+
+	s.startSources()
+	s.drain(context.Background())
+	s.stopSources()
+
+	if len(mock.records()) != 3 {
+		t.Fatalf("the records of every source should be written to the pumps, got %d", len(mock.records()))
+	}
+
+	for username, store := range stores {
+		if len(store.values) != 0 {
+			t.Fatalf("the source of %s should be drained", username)
+		}
+	}
+
+	s.stopSources()
+}
+
+func TestResetSources(t *testing.T) {
+	b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+	mock := &mockPump{}
+	s := &pumpServer{
+		secInterval:  1,
+		readInterval: time.Hour,
+		pmps:         []*pumpInstance{{Pump: mock, name: "mock"}},
+		sources: []*analyticsSource{
+			{name: "b", key: "b-analytics", store: &chunkedStore{values: []interface{}{string(b)}}},
+		},
+	}
+
+	s.startSources()
+	defer s.stopSources()
+
+	s.resetSources(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(mock.records()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(mock.records()) != 1 {
+		t.Fatal("the source should be purged at the reloaded read interval")
+	}
+}
+
+func TestNewAnalyticsSources(t *testing.T) {
+	sources, err := newAnalyticsSources(map[string]options.SourceConfig{
+		"kafka":   {Source: options.SourceKafka, Meta: map[string]interface{}{"brokers": []string{"127.0.0.1:9092"}}},
+		"cluster": {Key: "other-analytics", Meta: map[string]interface{}{"host": "10.0.0.2"}},
+	}, redis.CommandOptions{}, "pump-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		(&pumpServer{sources: sources}).closeSources()
+	}()
+
+	if len(sources) != 2 || sources[0].name != "cluster" || sources[1].name != "kafka" {
+		t.Fatalf("the sources should be created in the order of their names, got %+v", sources)
+	}
+
+	store, ok := sources[0].store.(*redis.RedisClusterStorageManager)
+	if !ok || !store.Dedicated || store.Config.Host != "10.0.0.2" || store.Config.Port != 6379 ||
+		store.ProcessingID != "pump-0" {
+		t.Fatalf("the redis source should use its own client with the default options, got %+v", sources[0].store)
+	}
+	if sources[0].key != "other-analytics" || sources[0].mutex == nil {
+		t.Fatalf("the redis source should drain its key under a lock, got %+v", sources[0])
+	}
+
+	if _, ok := sources[1].store.(*kafka.StorageManager); !ok || sources[1].mutex != nil {
+		t.Fatalf("the kafka source should be consumed as a group, got %+v", sources[1])
+	}
+
+	if _, err := newAnalyticsSources(map[string]options.SourceConfig{"bad": {Source: "files"}},
+		redis.CommandOptions{}, ""); err == nil {
+		t.Fatal("an unknown source type should be rejected")
+	}
+}
+
+// recoveringStore is a chunked store recording the keys recovered.
+type recoveringStore struct {
+	chunkedStore
+	recovered []string
+}
+
+func (r *recoveringStore) Recover(key string) error {
+	r.recovered = append(r.recovered, key)
+
+	return nil
+}
+
+func TestRecoverSources(t *testing.T) {
+	primary, other := &recoveringStore{}, &recoveringStore{}
+	s := &pumpServer{
+		analyticsStore: primary,
+		sources: []*analyticsSource{
+			{name: "b", key: "b-analytics", store: other},
+			{name: "c", key: storage.AnalyticsKeyName, store: &chunkedStore{}},
+		},
+	}
+
+	s.recoverSources()
+	if len(primary.recovered) != 1 || primary.recovered[0] != storage.AnalyticsKeyName {
+		t.Fatalf("the key of the primary source should be recovered, got %v", primary.recovered)
+	}
+
+	if len(other.recovered) != 1 || other.recovered[0] != "b-analytics" {
+		t.Fatalf("the key of the additional source should be recovered, got %v", other.recovered)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/marmotedu/component-base/pkg/json"
+
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// lifetimeStats accounts the records processed since iam-pump started. Read counts the records
+// read from the analytics storage, the other counters are summed over the pumps: for each pump,
+// every record read is either written, filtered, dropped or errored.
+type lifetimeStats struct {
+	read     int64
+	written  int64
+	filtered int64
+	dropped  int64
+	errored  int64
+}
+
+// statsSnapshot is a consistent enough copy of the lifetime stats, for reporting.
+type statsSnapshot struct {
+	Read     int64 `json:"read"`
+	Written  int64 `json:"written"`
+	Filtered int64 `json:"filtered"`
+	Dropped  int64 `json:"dropped"`
+	Errored  int64 `json:"errored"`
+}
+
+// stats is the lifetime stats of the process.
+var stats lifetimeStats
+
+func (l *lifetimeStats) addRead(n int)     { atomic.AddInt64(&l.read, int64(n)) }
+func (l *lifetimeStats) addWritten(n int)  { atomic.AddInt64(&l.written, int64(n)) }
+func (l *lifetimeStats) addFiltered(n int) { atomic.AddInt64(&l.filtered, int64(n)) }
+func (l *lifetimeStats) addDropped(n int)  { atomic.AddInt64(&l.dropped, int64(n)) }
+func (l *lifetimeStats) addErrored(n int)  { atomic.AddInt64(&l.errored, int64(n)) }
+
+func (l *lifetimeStats) snapshot() statsSnapshot {
+	return statsSnapshot{
+		Read:     atomic.LoadInt64(&l.read),
+		Written:  atomic.LoadInt64(&l.written),
+		Filtered: atomic.LoadInt64(&l.filtered),
+		Dropped:  atomic.LoadInt64(&l.dropped),
+		Errored:  atomic.LoadInt64(&l.errored),
+	}
+}
+
+// logSummary logs the lifetime stats, it is called at shutdown.
+func (l *lifetimeStats) logSummary() {
+	snapshot := l.snapshot()
+	log.Infof("Processed records summary: read=%d written=%d filtered=%d dropped=%d errored=%d",
+		snapshot.Read, snapshot.Written, snapshot.Filtered, snapshot.Dropped, snapshot.Errored)
+}
+
+// serveStats returns the lifetime stats of the records processed.
+func (s *pumpServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	data, _ := json.Marshal(stats.snapshot())
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+func TestLifetimeStats(t *testing.T) {
+	before := stats.snapshot()
+
+	filtered := &mockPump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{SkippedUsernames: []string{"admin"}})
+	s := &pumpServer{
+		secInterval: 1,
+		pmps: []*pumpInstance{
+			{Pump: filtered, name: "filtered"},
+			{Pump: &failingPump{}, name: "failing"},
+		},
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{
+		analytics.AnalyticsRecord{Username: "admin"},
+		analytics.AnalyticsRecord{Username: "colin"},
+	})
+
+	after := stats.snapshot()
+	if written := after.Written - before.Written; written != 1 {
+		t.Fatalf("expected 1 record written, got %d", written)
+	}
+
+	if filtered := after.Filtered - before.Filtered; filtered != 1 {
+		t.Fatalf("expected 1 record filtered, got %d", filtered)
+	}
+
+	if errored := after.Errored - before.Errored; errored != 2 {
+		t.Fatalf("expected 2 records errored, got %d", errored)
+	}
+}
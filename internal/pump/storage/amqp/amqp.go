@@ -0,0 +1,234 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package amqp provides an AMQP (RabbitMQ) implementation of the AnalyticsStorage storage interface.
+package amqp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// StorageManager consumes the analytics records published to a RabbitMQ queue, with manual
+// acknowledgements. The records read are only acknowledged once written to the pumps, the broker
+// delivers again the records not acknowledged when the channel closes, e.g. the records of a
+// crashed instance, and at once the records requeued. The broker is connected on the first read
+// and connected again after the connection is lost.
+type StorageManager struct {
+	conf      options.AMQPSourceOptions
+	tlsConfig *tls.Config
+
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	channel    *amqp.Channel
+	deliveries <-chan amqp.Delivery
+	// lastTag is the delivery tag of the last record read since the last acknowledgement, 0 when none
+	lastTag uint64
+}
+
+// GetName returns the amqp storage name.
+func (a *StorageManager) GetName() string {
+	return "amqp"
+}
+
+// Init initialize the amqp consumer from the amqp source options.
+func (a *StorageManager) Init(config interface{}) error {
+	if err := mapstructure.Decode(config, &a.conf); err != nil {
+		return errors.Wrap(err, "failed to decode amqp source configuration")
+	}
+
+	if a.conf.URL == "" || a.conf.Queue == "" {
+		return errors.New("amqp source url and queue must be set")
+	}
+
+	uri, err := amqp.ParseURI(a.conf.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid amqp source url")
+	}
+
+	if uri.Scheme == "amqps" {
+		if a.tlsConfig, err = newTLSConfig(&a.conf); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Consuming analytics records from amqp queue %s", a.conf.Queue)
+
+	return nil
+}
+
+// Connect reports whether the consumer is set up, the broker is connected on the first read.
+func (a *StorageManager) Connect() bool {
+	return a.conf.URL != ""
+}
+
+// GetAndDeleteSet reads a batch of at most batch-size records, waiting at most fetch-timeout for
+// the records not available yet. The key is ignored, the records are read from the queue. The
+// records are delivered again unless acknowledged.
+func (a *StorageManager) GetAndDeleteSet(string) []interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	values := make([]interface{}, 0)
+	if err := a.consume(); err != nil {
+		log.Errorf("Failed to consume analytics records from amqp: %s", err.Error())
+
+		return values
+	}
+
+	timeout := time.NewTimer(time.Duration(a.conf.FetchTimeout) * time.Second)
+	defer timeout.Stop()
+
+	for len(values) < a.conf.BatchSize {
+		select {
+		case delivery, ok := <-a.deliveries:
+			if !ok {
+				// the records not acknowledged are delivered again by the broker
+				log.Warn("The amqp channel was closed, the records read will be delivered again")
+				a.reset()
+
+				return values
+			}
+
+			a.lastTag = delivery.DeliveryTag
+			values = append(values, string(delivery.Body))
+		case <-timeout.C:
+			return values
+		}
+	}
+
+	return values
+}
+
+// Ack acknowledges the records read since the last acknowledgement.
+func (a *StorageManager) Ack() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.lastTag == 0 || a.channel == nil {
+		return nil
+	}
+
+	tag := a.lastTag
+	a.lastTag = 0
+
+	return errors.Wrap(a.channel.Ack(tag, true), "failed to acknowledge amqp deliveries")
+}
+
+// Requeue negatively acknowledges the records read since the last acknowledgement, so that the
+// broker delivers them again. The key and values are ignored, the records read are requeued.
+func (a *StorageManager) Requeue(string, []interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.lastTag == 0 || a.channel == nil {
+		return nil
+	}
+
+	tag := a.lastTag
+	a.lastTag = 0
+
+	return errors.Wrap(a.channel.Nack(tag, true, true), "failed to requeue amqp deliveries")
+}
+
+// Close closes the connection to the broker, the records not acknowledged are delivered again.
+func (a *StorageManager) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	err := a.conn.Close()
+	a.reset()
+
+	return err
+}
+
+// consume connects to the broker and starts consuming the queue, unless already consuming.
+func (a *StorageManager) consume() error {
+	if a.conn != nil && !a.conn.IsClosed() && a.deliveries != nil {
+		return nil
+	}
+	a.reset()
+
+	conn, err := amqp.DialTLS(a.conf.URL, a.tlsConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to amqp broker")
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+
+		return errors.Wrap(err, "failed to open amqp channel")
+	}
+
+	if err := channel.Qos(a.conf.PrefetchCount, 0, false); err != nil {
+		conn.Close()
+
+		return errors.Wrap(err, "failed to set amqp prefetch count")
+	}
+
+	if a.conf.DeclareQueue {
+		if _, err := channel.QueueDeclare(a.conf.Queue, true, false, false, false, nil); err != nil {
+			conn.Close()
+
+			return errors.Wrapf(err, "failed to declare amqp queue %s", a.conf.Queue)
+		}
+	}
+
+	deliveries, err := channel.Consume(a.conf.Queue, a.conf.ConsumerTag, false, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+
+		return errors.Wrapf(err, "failed to consume amqp queue %s", a.conf.Queue)
+	}
+
+	a.conn, a.channel, a.deliveries = conn, channel, deliveries
+
+	return nil
+}
+
+// reset forgets the connection, the delivery tags of the records read being only valid on its channel.
+func (a *StorageManager) reset() {
+	a.conn, a.channel, a.deliveries, a.lastTag = nil, nil, nil, 0
+}
+
+// newTLSConfig returns the TLS configuration of the amqps connections.
+func newTLSConfig(conf *options.AMQPSourceOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.SSLInsecureSkipVerify} //nolint: gosec // opt-in
+
+	if conf.SSLCAFile != "" {
+		ca, err := os.ReadFile(conf.SSLCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read amqp source CA certificates")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificate found in %s", conf.SSLCAFile)
+		}
+	}
+
+	if conf.SSLCertFile != "" && conf.SSLKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.SSLCertFile, conf.SSLKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading mTLS certificates")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package kafka provides a kafka implementation of the AnalyticsStorage storage interface.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// commitTimeout bounds the commit of the offsets of the records acknowledged.
+const commitTimeout = 10 * time.Second
+
+// StorageManager consumes the analytics records produced to a kafka topic, as a member of a
+// consumer group. The offsets of the records read are only committed once acknowledged, after
+// they have been written to the pumps, so that the records of a crashed instance are consumed
+// again by the group. The records requeued are returned again by the next read, their offsets
+// being committed with the records of the first window acknowledged.
+type StorageManager struct {
+	conf   options.KafkaSourceOptions
+	reader *kafka.Reader
+
+	mu       sync.Mutex
+	pending  []kafka.Message
+	requeued []interface{}
+}
+
+// GetName returns the kafka storage name.
+func (k *StorageManager) GetName() string {
+	return "kafka"
+}
+
+// Init initialize the kafka consumer from the kafka source options.
+func (k *StorageManager) Init(config interface{}) error {
+	if err := mapstructure.Decode(config, &k.conf); err != nil {
+		return errors.Wrap(err, "failed to decode kafka source configuration")
+	}
+
+	if len(k.conf.Brokers) == 0 || k.conf.Topic == "" {
+		return errors.New("kafka source brokers and topic must be set")
+	}
+
+	dialer, err := newDialer(&k.conf)
+	if err != nil {
+		return err
+	}
+
+	k.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers: k.conf.Brokers,
+		GroupID: k.conf.GroupID,
+		Topic:   k.conf.Topic,
+		Dialer:  dialer,
+		MaxWait: time.Duration(k.conf.FetchTimeout) * time.Second,
+	})
+
+	log.Infof("Consuming analytics records from kafka topic %s as group %s", k.conf.Topic, k.conf.GroupID)
+
+	return nil
+}
+
+// Connect reports whether the consumer is set up, the brokers are connected on the first fetch.
+func (k *StorageManager) Connect() bool {
+	return k.reader != nil
+}
+
+// GetAndDeleteSet reads a batch of at most batch-size records, waiting at most fetch-timeout for
+// the records not available yet. The key is ignored, the records are read from the topic. The
+// records are read again by the group unless acknowledged, the records requeued are returned
+// instead of new records.
+func (k *StorageManager) GetAndDeleteSet(string) []interface{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if values := k.requeued; len(values) > 0 {
+		k.requeued = nil
+
+		return values
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(k.conf.FetchTimeout)*time.Second)
+	defer cancel()
+
+	values := make([]interface{}, 0)
+	for len(values) < k.conf.BatchSize {
+		message, err := k.reader.FetchMessage(ctx)
+		if err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				log.Errorf("Failed to consume analytics records from kafka: %s", err.Error())
+			}
+
+			break
+		}
+
+		k.pending = append(k.pending, message)
+		values = append(values, string(message.Value))
+	}
+
+	return values
+}
+
+// Ack commits the offsets of the records read since the last acknowledgement.
+func (k *StorageManager) Ack() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.pending) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+	defer cancel()
+
+	if err := k.reader.CommitMessages(ctx, k.pending...); err != nil {
+		return errors.Wrap(err, "failed to commit kafka offsets")
+	}
+	k.pending = nil
+
+	return nil
+}
+
+// Requeue keeps the records read for the next read, without committing their offsets. The key is
+// ignored.
+func (k *StorageManager) Requeue(_ string, values []interface{}) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.requeued = append(append([]interface{}{}, values...), k.requeued...)
+
+	return nil
+}
+
+// Close leaves the consumer group.
+func (k *StorageManager) Close() error {
+	if k.reader == nil {
+		return nil
+	}
+
+	return k.reader.Close()
+}
+
+// newDialer returns the dialer of the consumer, set up with the TLS and SASL options.
+func newDialer(conf *options.KafkaSourceOptions) (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		ClientID:  conf.ClientID,
+		DualStack: true,
+	}
+
+	if conf.UseSSL {
+		tlsConfig := &tls.Config{InsecureSkipVerify: conf.SSLInsecureSkipVerify} //nolint: gosec // opt-in
+
+		if conf.SSLCAFile != "" {
+			ca, err := os.ReadFile(conf.SSLCAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read kafka source CA certificates")
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.Errorf("no certificate found in %s", conf.SSLCAFile)
+			}
+		}
+
+		if conf.SSLCertFile != "" && conf.SSLKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.SSLCertFile, conf.SSLKeyFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed loading mTLS certificates")
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		dialer.TLS = tlsConfig
+	} else if conf.SASLMechanism != "" {
+		log.Warn("SASL-Mechanism is setted but use_ssl is false.", log.String("SASL-Mechanism", conf.SASLMechanism))
+	}
+
+	mechanism, err := saslMechanism(conf)
+	if err != nil {
+		return nil, err
+	}
+	dialer.SASLMechanism = mechanism
+
+	return dialer, nil
+}
+
+func saslMechanism(conf *options.KafkaSourceOptions) (sasl.Mechanism, error) {
+	switch strings.ToLower(conf.SASLMechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: conf.SASLUsername, Password: conf.SASLPassword}, nil
+	case "scram":
+		algorithm := scram.SHA256
+		if strings.EqualFold(conf.SASLAlgorithm, "sha-512") {
+			algorithm = scram.SHA512
+		}
+		mechanism, err := scram.Mechanism(algorithm, conf.SASLUsername, conf.SASLPassword)
+
+		return mechanism, errors.Wrap(err, "failed to initialize kafka SASL mechanism")
+	default:
+		return nil, errors.Errorf("kafka SASL mechanism %s is not supported", conf.SASLMechanism)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package kafka
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func TestInit(t *testing.T) {
+	conf := options.NewKafkaSourceOptions()
+	conf.Brokers = []string{"127.0.0.1:9092"}
+	conf.UseSSL = true
+	conf.SASLMechanism = "plain"
+	conf.SASLUsername = "pump"
+	conf.SASLPassword = "secret"
+
+	store := &StorageManager{}
+	if err := store.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if !store.Connect() || store.conf.GroupID != "iam-pump" || store.conf.BatchSize != 1000 {
+		t.Fatalf("the consumer should be set up from the source options, got %+v", store.conf)
+	}
+
+	if err := store.Ack(); err != nil {
+		t.Fatalf("acknowledging without records read should be a no-op, got %v", err)
+	}
+
+	dialer, err := newDialer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.TLS == nil || dialer.SASLMechanism != (plain.Mechanism{Username: "pump", Password: "secret"}) {
+		t.Fatalf("the dialer should use TLS and SASL, got %+v", dialer)
+	}
+
+	conf.SSLCAFile = "/nonexistent/ca.pem"
+	if _, err := newDialer(conf); err == nil {
+		t.Fatal("a missing CA file should be rejected")
+	}
+
+	conf.SSLCAFile = ""
+	conf.SASLMechanism = "gssapi"
+	if _, err := newDialer(conf); err == nil {
+		t.Fatal("an unsupported SASL mechanism should be rejected")
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	store := &StorageManager{}
+	if err := store.Requeue("", []interface{}{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if values := store.GetAndDeleteSet(""); len(values) != 2 || values[0] != "a" {
+		t.Fatalf("the records requeued should be read again, got %v", values)
+	}
+
+	if len(store.requeued) != 0 {
+		t.Fatalf("the records requeued should only be read once, got %v", store.requeued)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package nats provides a NATS JetStream implementation of the AnalyticsStorage storage interface.
+package nats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marmotedu/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/nats-io/nats.go"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// StorageManager consumes the analytics records stored in a JetStream stream, with a durable pull
+// consumer shared by the iam-pump instances. The records read are only acknowledged once written
+// to the pumps, JetStream delivers again the records not acknowledged within the ack wait, e.g.
+// the records of a crashed instance, and at once the records requeued.
+type StorageManager struct {
+	conf options.NATSSourceOptions
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	mu      sync.Mutex
+	sub     *nats.Subscription
+	pending []*nats.Msg
+}
+
+// GetName returns the nats storage name.
+func (n *StorageManager) GetName() string {
+	return "nats"
+}
+
+// Init initialize the connection to the NATS servers from the nats source options, the servers
+// not reachable yet are connected in the background.
+func (n *StorageManager) Init(config interface{}) error {
+	if err := mapstructure.Decode(config, &n.conf); err != nil {
+		return errors.Wrap(err, "failed to decode nats source configuration")
+	}
+
+	if len(n.conf.URLs) == 0 || n.conf.Stream == "" || n.conf.Durable == "" {
+		return errors.New("nats source urls, stream and durable must be set")
+	}
+
+	opts, err := connectOptions(&n.conf)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nats.Connect(strings.Join(n.conf.URLs, ","), opts...)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to nats")
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+
+		return errors.Wrap(err, "failed to get jetstream context")
+	}
+	n.conn, n.js = conn, js
+
+	log.Infof("Consuming analytics records from jetstream stream %s as durable consumer %s", n.conf.Stream, n.conf.Durable)
+
+	return nil
+}
+
+// Connect reports whether the connection is set up, the consumer is bound on the first read.
+func (n *StorageManager) Connect() bool {
+	return n.conn != nil
+}
+
+// Ping checks that the connection to the nats servers is up, it is reconnected in the background
+// once lost.
+func (n *StorageManager) Ping() error {
+	if n.conn == nil || !n.conn.IsConnected() {
+		return errors.New("not connected to nats")
+	}
+
+	return nil
+}
+
+// GetAndDeleteSet reads a batch of at most batch-size records, waiting at most fetch-timeout for
+// the records not available yet. The key is ignored, the records are read from the stream. The
+// records are delivered again unless acknowledged.
+func (n *StorageManager) GetAndDeleteSet(string) []interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	values := make([]interface{}, 0)
+	if n.sub == nil {
+		sub, err := n.js.PullSubscribe(n.conf.Subject, n.conf.Durable,
+			nats.BindStream(n.conf.Stream),
+			nats.ManualAck(),
+			nats.AckExplicit(),
+			nats.AckWait(time.Duration(n.conf.AckWait)*time.Second),
+		)
+		if err != nil {
+			log.Errorf("Failed to subscribe to jetstream stream %s: %s", n.conf.Stream, err.Error())
+
+			return values
+		}
+		n.sub = sub
+	}
+
+	messages, err := n.sub.Fetch(n.conf.BatchSize, nats.MaxWait(time.Duration(n.conf.FetchTimeout)*time.Second))
+	if err != nil && !errors.Is(err, nats.ErrTimeout) {
+		log.Errorf("Failed to consume analytics records from jetstream: %s", err.Error())
+	}
+
+	for _, message := range messages {
+		n.pending = append(n.pending, message)
+		values = append(values, string(message.Data))
+	}
+
+	return values
+}
+
+// Ack acknowledges the records read since the last acknowledgement.
+func (n *StorageManager) Ack() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var errs []error
+	for _, message := range n.pending {
+		if err := message.Ack(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	n.pending = nil
+
+	return errors.Wrap(errors.NewAggregate(errs), "failed to acknowledge jetstream messages")
+}
+
+// Requeue negatively acknowledges the records read since the last acknowledgement, so that
+// JetStream delivers them again. The key and values are ignored, the records read are requeued.
+func (n *StorageManager) Requeue(string, []interface{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var errs []error
+	for _, message := range n.pending {
+		if err := message.Nak(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	n.pending = nil
+
+	return errors.Wrap(errors.NewAggregate(errs), "failed to requeue jetstream messages")
+}
+
+// Close drains the subscription and closes the connection.
+func (n *StorageManager) Close() error {
+	if n.conn == nil {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.sub != nil {
+		_ = n.sub.Unsubscribe()
+	}
+	n.conn.Close()
+
+	return nil
+}
+
+// connectOptions returns the options of the connection, set up with the authentication and TLS options.
+func connectOptions(conf *options.NATSSourceOptions) ([]nats.Option, error) {
+	opts := []nats.Option{
+		nats.Name("iam-pump"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+
+	switch {
+	case conf.CredentialsFile != "":
+		opts = append(opts, nats.UserCredentials(conf.CredentialsFile))
+	case conf.Token != "":
+		opts = append(opts, nats.Token(conf.Token))
+	case conf.Username != "":
+		opts = append(opts, nats.UserInfo(conf.Username, conf.Password))
+	}
+
+	if !conf.UseSSL {
+		return opts, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.SSLInsecureSkipVerify} //nolint: gosec // opt-in
+	if conf.SSLCAFile != "" {
+		ca, err := os.ReadFile(conf.SSLCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read nats source CA certificates")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificate found in %s", conf.SSLCAFile)
+		}
+	}
+
+	if conf.SSLCertFile != "" && conf.SSLKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.SSLCertFile, conf.SSLKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading mTLS certificates")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return append(opts, nats.Secure(tlsConfig)), nil
+}
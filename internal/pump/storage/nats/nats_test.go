@@ -0,0 +1,44 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package nats
+
+import (
+	"testing"
+
+	"github.com/marmotedu/iam/internal/pump/options"
+)
+
+func TestInit(t *testing.T) {
+	conf := options.NewNATSSourceOptions()
+	conf.URLs = []string{"nats://127.0.0.1:1"}
+
+	store := &StorageManager{}
+	if err := store.Init(conf); err != nil {
+		t.Fatalf("the servers not reachable yet should be connected in the background, got %v", err)
+	}
+	defer store.Close()
+
+	if !store.Connect() || store.conf.Durable != "iam-pump" || store.conf.BatchSize != 1000 {
+		t.Fatalf("the consumer should be set up from the source options, got %+v", store.conf)
+	}
+
+	if err := store.Ack(); err != nil {
+		t.Fatalf("acknowledging without records read should be a no-op, got %v", err)
+	}
+
+	if err := store.Requeue("", nil); err != nil {
+		t.Fatalf("requeueing without records read should be a no-op, got %v", err)
+	}
+
+	conf.UseSSL = true
+	conf.SSLCAFile = "/nonexistent/ca.pem"
+	if _, err := connectOptions(conf); err == nil {
+		t.Fatal("a missing CA file should be rejected")
+	}
+
+	if err := (&StorageManager{}).Init(options.NewNATSSourceOptions()); err == nil {
+		t.Fatal("the urls should be required")
+	}
+}
@@ -6,8 +6,14 @@
 package redis
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	redis "github.com/go-redis/redis/v7"
@@ -15,6 +21,7 @@ import (
 	"github.com/mitchellh/mapstructure"
 
 	genericoptions "github.com/marmotedu/iam/internal/pkg/options"
+	"github.com/marmotedu/iam/internal/pump/options"
 	"github.com/marmotedu/iam/pkg/log"
 )
 
@@ -26,6 +33,17 @@ const (
 	defaultRedisAddress = "127.0.0.1:6379"
 )
 
+// Defines the keys holding the values read by an instance until they are acknowledged.
+const (
+	// processingInfix separates the key from the instance id in the name of a processing key.
+	processingInfix = ":processing:"
+	// leaseInfix separates the key from the instance id in the name of the lease of a processing key.
+	leaseInfix = ":lease:"
+	// processingLease is the time a processing key is in use after the last read of its instance,
+	// the processing keys of the instances which did not read for longer are recovered.
+	processingLease = 10 * time.Minute
+)
+
 var redisClusterSingleton redis.UniversalClient
 
 // RedisClusterStorageManager is a storage manager that uses the redis database.
@@ -33,11 +51,34 @@ type RedisClusterStorageManager struct {
 	db        redis.UniversalClient
 	KeyPrefix string
 	HashKeys  bool
-	Config    genericoptions.RedisOptions
+	Config    options.RedisSourceOptions
+	Commands  CommandOptions
+	// Dedicated connects the storage with its own client instead of the client shared by the
+	// process, e.g. to drain another redis cluster.
+	Dedicated bool
+	// ProcessingID, when set, moves the values read to a processing key of the instance with this id
+	// instead of deleting them, the processing key being deleted once the values are acknowledged.
+	ProcessingID string
+	// processing holds the processing keys of the values read since the last acknowledgement.
+	processing map[string]struct{}
+}
+
+// CommandOptions tunes the commands run by the redis client.
+type CommandOptions struct {
+	// ReadTimeout and WriteTimeout bound the time a command waits for redis, they default to the
+	// timeout of the redis options.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// SlowThreshold is the duration above which a command is logged as slow, 0 disables the log.
+	SlowThreshold time.Duration
 }
 
 // NewRedisClusterPool returns a redis cluster client.
-func NewRedisClusterPool(forceReconnect bool, config genericoptions.RedisOptions) redis.UniversalClient {
+func NewRedisClusterPool(
+	forceReconnect bool,
+	config options.RedisSourceOptions,
+	commands CommandOptions,
+) redis.UniversalClient {
 	if !forceReconnect {
 		if redisClusterSingleton != nil {
 			log.Debug("Redis pool already INITIALIZED")
@@ -50,6 +91,13 @@ func NewRedisClusterPool(forceReconnect bool, config genericoptions.RedisOptions
 		}
 	}
 
+	redisClusterSingleton = newRedisClient(config, commands)
+
+	return redisClusterSingleton
+}
+
+// newRedisClient creates a redis client from the options.
+func newRedisClient(config options.RedisSourceOptions, commands CommandOptions) redis.UniversalClient {
 	log.Debug("Creating new Redis connection pool")
 
 	maxActive := 500
@@ -63,30 +111,41 @@ func NewRedisClusterPool(forceReconnect bool, config genericoptions.RedisOptions
 		timeout = time.Duration(config.Timeout) * time.Second
 	}
 
-	var tlsConfig *tls.Config
-	if config.UseSSL {
-		tlsConfig = &tls.Config{
-			InsecureSkipVerify: config.SSLInsecureSkipVerify,
-		}
+	readTimeout, writeTimeout := timeout, timeout
+	if commands.ReadTimeout > 0 {
+		readTimeout = commands.ReadTimeout
+	}
+
+	if commands.WriteTimeout > 0 {
+		writeTimeout = commands.WriteTimeout
+	}
+
+	// the TLS options are verified by Init
+	tlsConfig, err := TLSConfig(config)
+	if err != nil {
+		log.Errorf("Invalid redis TLS options: %s", err.Error())
 	}
 
 	var client redis.UniversalClient
 	opts := &RedisOpts{
 		MasterName:   config.MasterName,
-		Addrs:        getRedisAddrs(config),
+		Addrs:        getRedisAddrs(config.RedisOptions),
 		DB:           config.Database,
+		Username:     config.Username,
 		Password:     config.Password,
 		PoolSize:     maxActive,
 		IdleTimeout:  240 * time.Second,
-		ReadTimeout:  timeout,
-		WriteTimeout: timeout,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
 		DialTimeout:  timeout,
 		TLSConfig:    tlsConfig,
 	}
 
 	if opts.MasterName != "" {
 		log.Info("--> [REDIS] Creating sentinel-backed failover client")
-		client = redis.NewFailoverClient(opts.failover())
+		failover := opts.failover()
+		failover.SentinelPassword = config.SentinelPassword
+		client = redis.NewFailoverClient(failover)
 	} else if config.EnableCluster {
 		log.Info("--> [REDIS] Creating cluster client")
 		client = redis.NewClusterClient(opts.cluster())
@@ -95,11 +154,104 @@ func NewRedisClusterPool(forceReconnect bool, config genericoptions.RedisOptions
 		client = redis.NewClient(opts.simple())
 	}
 
-	redisClusterSingleton = client
+	if commands.SlowThreshold > 0 {
+		client.AddHook(slowLogHook{threshold: commands.SlowThreshold})
+	}
 
 	return client
 }
 
+// TLSConfig returns the TLS configuration of the connections to redis, nil when TLS is not used.
+// The server is verified with the CA certificates of the options when set, and the client
+// certificate of the options is presented to it.
+func TLSConfig(config options.RedisSourceOptions) (*tls.Config, error) {
+	if !config.UseSSL {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SSLInsecureSkipVerify} //nolint: gosec // opt-in
+
+	if config.SSLCAFile != "" {
+		ca, err := os.ReadFile(config.SSLCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read redis CA certificates")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificate found in %s", config.SSLCAFile)
+		}
+	}
+
+	if config.SSLCertFile != "" && config.SSLKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.SSLCertFile, config.SSLKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading redis mTLS certificates")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type commandStartKey struct{}
+
+// slowLogHook logs the commands and pipelines which take longer than the threshold, so that
+// a degraded redis stalling the purge loop is visible.
+type slowLogHook struct {
+	threshold time.Duration
+}
+
+func (h slowLogHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+func (h slowLogHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.observe(ctx, describeCmds(cmd))
+
+	return nil
+}
+
+func (h slowLogHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+func (h slowLogHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	h.observe(ctx, describeCmds(cmds...))
+
+	return nil
+}
+
+// observe logs the command when it took longer than the threshold and reports whether it did.
+func (h slowLogHook) observe(ctx context.Context, command string) bool {
+	start, ok := ctx.Value(commandStartKey{}).(time.Time)
+	if !ok {
+		return false
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < h.threshold {
+		return false
+	}
+
+	log.Warnf("Slow redis command %s took %s", command, elapsed)
+
+	return true
+}
+
+// describeCmds returns the names and keys of the commands, without their values.
+func describeCmds(cmds ...redis.Cmder) string {
+	parts := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		part := cmd.Name()
+		if args := cmd.Args(); len(args) > 1 {
+			part = fmt.Sprintf("%s %v", part, args[1])
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, "; ")
+}
+
 func getRedisAddrs(config genericoptions.RedisOptions) (addrs []string) {
 	if len(config.Addrs) != 0 {
 		addrs = config.Addrs
@@ -127,6 +279,7 @@ func (o *RedisOpts) cluster() *redis.ClusterOptions {
 		Addrs:     o.Addrs,
 		OnConnect: o.OnConnect,
 
+		Username: o.Username,
 		Password: o.Password,
 
 		MaxRedirects:   o.MaxRedirects,
@@ -163,6 +316,7 @@ func (o *RedisOpts) simple() *redis.Options {
 		OnConnect: o.OnConnect,
 
 		DB:       o.DB,
+		Username: o.Username,
 		Password: o.Password,
 
 		MaxRetries:      o.MaxRetries,
@@ -195,6 +349,7 @@ func (o *RedisOpts) failover() *redis.FailoverOptions {
 		OnConnect:     o.OnConnect,
 
 		DB:       o.DB,
+		Username: o.Username,
 		Password: o.Password,
 
 		MaxRetries:      o.MaxRetries,
@@ -223,7 +378,7 @@ func (r *RedisClusterStorageManager) GetName() string {
 
 // Init initialize the redis cluster storage manager.
 func (r *RedisClusterStorageManager) Init(config interface{}) error {
-	r.Config = genericoptions.RedisOptions{}
+	r.Config = options.RedisSourceOptions{}
 	err := mapstructure.Decode(config, &r.Config)
 	if err != nil {
 		log.Fatalf("Failed to decode configuration: %s", err.Error())
@@ -231,14 +386,26 @@ func (r *RedisClusterStorageManager) Init(config interface{}) error {
 
 	r.KeyPrefix = RedisKeyPrefix
 
+	if _, err := TLSConfig(r.Config); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // Connect will establish a connection to the r.db.
 func (r *RedisClusterStorageManager) Connect() bool {
+	if r.Dedicated {
+		if r.db == nil {
+			r.db = newRedisClient(r.Config, r.Commands)
+		}
+
+		return true
+	}
+
 	if r.db == nil {
 		log.Debug("Connecting to redis cluster")
-		r.db = NewRedisClusterPool(false, r.Config)
+		r.db = NewRedisClusterPool(false, r.Config, r.Commands)
 
 		return true
 	}
@@ -251,6 +418,15 @@ func (r *RedisClusterStorageManager) Connect() bool {
 	return true
 }
 
+// Close closes the dedicated client of the storage, the client shared by the process is left open.
+func (r *RedisClusterStorageManager) Close() error {
+	if !r.Dedicated || r.db == nil {
+		return nil
+	}
+
+	return r.db.Close()
+}
+
 func (r *RedisClusterStorageManager) hashKey(in string) string {
 	return in
 }
@@ -280,6 +456,10 @@ func (r *RedisClusterStorageManager) GetAndDeleteSet(keyName string) []interface
 
 	log.Debugf("Fixed keyname is: %s", fixedKey)
 
+	if r.ProcessingID != "" {
+		return r.moveToProcessing(keyName, 0)
+	}
+
 	var lrange *redis.StringSliceCmd
 	_, err := r.db.TxPipelined(func(pipe redis.Pipeliner) error {
 		lrange = pipe.LRange(fixedKey, 0, -1)
@@ -304,6 +484,291 @@ func (r *RedisClusterStorageManager) GetAndDeleteSet(keyName string) []interface
 	return result
 }
 
+// GetSetLength returns the number of values of the key.
+func (r *RedisClusterStorageManager) GetSetLength(keyName string) int64 {
+	r.ensureConnection()
+
+	length, err := r.db.LLen(r.fixKey(keyName)).Result()
+	if err != nil {
+		log.Errorf("Could not LLEN key: %s", err.Error())
+	}
+
+	return length
+}
+
+// GetAndDeleteChunk get and delete the first size values of the key from redis.
+func (r *RedisClusterStorageManager) GetAndDeleteChunk(keyName string, size int64) []interface{} {
+	r.ensureConnection()
+
+	if r.ProcessingID != "" {
+		return r.moveToProcessing(keyName, size)
+	}
+
+	fixedKey := r.fixKey(keyName)
+
+	var lrange *redis.StringSliceCmd
+	_, err := r.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(fixedKey, 0, size-1)
+		pipe.LTrim(fixedKey, size, -1)
+
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Multi command failed: %s", err)
+		r.Connect()
+	}
+
+	vals := lrange.Val()
+
+	result := make([]interface{}, len(vals))
+	for i, v := range vals {
+		result[i] = v
+	}
+
+	log.Debugf("Unpacked vals: %d", len(result))
+
+	return result
+}
+
+// Requeue pushes the values back to the head of the key, in their order. The values read since
+// the last acknowledgement are no longer processing once put back.
+func (r *RedisClusterStorageManager) Requeue(keyName string, values []interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	r.ensureConnection()
+
+	if err := r.pushFront(r.fixKey(keyName), values); err != nil {
+		return err
+	}
+
+	return r.Ack()
+}
+
+// Ack deletes the processing keys of the values read since the last acknowledgement, once the
+// values are written to the pumps.
+func (r *RedisClusterStorageManager) Ack() error {
+	if len(r.processing) == 0 {
+		return nil
+	}
+
+	r.ensureConnection()
+
+	keys := make([]string, 0, len(r.processing))
+	for key := range r.processing {
+		keys = append(keys, key)
+	}
+	r.processing = nil
+
+	// the keys are deleted one at a time, they may be stored on different nodes of a cluster
+	for _, key := range keys {
+		if err := r.db.Del(key).Err(); err != nil {
+			return errors.Wrapf(err, "failed to delete processing key %s", key)
+		}
+	}
+
+	return nil
+}
+
+// Recover puts the values of the processing keys of the key back at its head, so that they are
+// read again: the processing key of the instance, holding the values read before it restarted, and
+// the processing keys of the instances which did not read for longer than their lease, e.g. which
+// crashed while writing a window.
+func (r *RedisClusterStorageManager) Recover(keyName string) error {
+	if r.ProcessingID == "" {
+		return nil
+	}
+
+	r.ensureConnection()
+
+	fixedKey := r.fixKey(keyName)
+	prefix := processingKey(fixedKey, "")
+	keys, err := r.scan(prefix + "*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to list the processing keys of %s", fixedKey)
+	}
+
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, prefix)
+		lease := leaseKey(fixedKey, id)
+		if id != r.ProcessingID {
+			leased, err := r.db.Exists(lease).Result()
+			if err != nil {
+				return errors.Wrapf(err, "failed to check the lease of %s", key)
+			}
+			if leased > 0 {
+				continue
+			}
+		}
+
+		vals, err := r.db.LRange(key, 0, -1).Result()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read processing key %s", key)
+		}
+
+		// the values are put back before the processing key is deleted, a failure in between
+		// reads them twice rather than losing them
+		if err := r.pushFront(fixedKey, toValues(vals)); err != nil {
+			return err
+		}
+		if err := r.db.Del(key, lease).Err(); err != nil {
+			return errors.Wrapf(err, "failed to delete processing key %s", key)
+		}
+
+		log.Warnf("Recovered %d records read and not acknowledged by iam-pump instance %s", len(vals), id)
+	}
+
+	return nil
+}
+
+// moveToProcessingScript moves the first values of KEYS[1], up to the index ARGV[1], to the
+// processing key KEYS[2] and sets the lease KEYS[3] to ARGV[2] for ARGV[3] seconds, in one step so
+// that no failure in between loses the values or reads them twice. The values are pushed in batches, unpack
+// is bound by the Lua stack.
+var moveToProcessingScript = redis.NewScript(`
+local vals = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]))
+if #vals == 0 then
+	return vals
+end
+for i = 1, #vals, 1000 do
+	redis.call('RPUSH', KEYS[2], unpack(vals, i, math.min(i + 999, #vals)))
+end
+redis.call('LTRIM', KEYS[1], #vals, -1)
+redis.call('SET', KEYS[3], ARGV[2], 'EX', ARGV[3])
+return vals
+`)
+
+// processingKey returns the name of the processing key of the instance. The name of the key is
+// its hash tag, so that both are stored on the same node of a cluster and moved by one script.
+func processingKey(fixedKey, id string) string {
+	return "{" + fixedKey + "}" + processingInfix + id
+}
+
+// leaseKey returns the name of the lease of the processing key of the instance.
+func leaseKey(fixedKey, id string) string {
+	return "{" + fixedKey + "}" + leaseInfix + id
+}
+
+// moveToProcessing reads the first size values of the key, all of them when size is 0, and moves
+// them to the processing key of the instance.
+func (r *RedisClusterStorageManager) moveToProcessing(keyName string, size int64) []interface{} {
+	fixedKey := r.fixKey(keyName)
+	processing := processingKey(fixedKey, r.ProcessingID)
+
+	vals, err := moveToProcessingScript.Run(
+		r.db,
+		[]string{fixedKey, processing, leaseKey(fixedKey, r.ProcessingID)},
+		size-1, time.Now().Unix(), int64(processingLease/time.Second),
+	).Result()
+	if err != nil {
+		// the values are left in the key and read by the next window
+		log.Errorf("Could not move the values read to processing key %s: %s", processing, err.Error())
+		r.Connect()
+
+		return []interface{}{}
+	}
+
+	result, _ := vals.([]interface{})
+	if len(result) == 0 {
+		return []interface{}{}
+	}
+
+	if r.processing == nil {
+		r.processing = map[string]struct{}{}
+	}
+	r.processing[processing] = struct{}{}
+
+	log.Debugf("Unpacked vals: %d", len(result))
+
+	return result
+}
+
+// pushFront pushes the values to the head of the key, in their order.
+func (r *RedisClusterStorageManager) pushFront(fixedKey string, values []interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	// LPUSH prepends the values one after another, the last one pushed ends up first
+	reversed := make([]interface{}, len(values))
+	for i, v := range values {
+		reversed[len(values)-1-i] = v
+	}
+
+	return errors.Wrapf(r.db.LPush(fixedKey, reversed...).Err(), "failed to push values back to %s", fixedKey)
+}
+
+// scan returns the keys matching the pattern, on every master of a cluster.
+func (r *RedisClusterStorageManager) scan(pattern string) ([]string, error) {
+	cluster, ok := r.db.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(r.db, pattern)
+	}
+
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		found, err := scanKeys(client, pattern)
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+
+		return err
+	})
+
+	return keys, err
+}
+
+// scanKeys returns the keys of the node matching the pattern.
+func scanKeys(client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(0, pattern, 100).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
+
+// toValues converts the values read from redis to the values of the analytics storage.
+func toValues(vals []string) []interface{} {
+	result := make([]interface{}, len(vals))
+	for i, v := range vals {
+		result[i] = v
+	}
+
+	return result
+}
+
+// Ping checks that redis is reachable.
+func (r *RedisClusterStorageManager) Ping() error {
+	r.ensureConnection()
+
+	return errors.Wrap(r.db.Ping().Err(), "failed to ping redis")
+}
+
+// CheckKeyType returns an error when the key exists and is not a list, the analytics records are
+// pushed to and drained from a list.
+func (r *RedisClusterStorageManager) CheckKeyType(keyName string) error {
+	r.ensureConnection()
+
+	fixedKey := r.fixKey(keyName)
+	keyType, err := r.db.Type(fixedKey).Result()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the type of key %s", fixedKey)
+	}
+
+	if keyType != "none" && keyType != "list" {
+		return errors.Errorf("key %s is a %s, the analytics records are expected in a list: "+
+			"check the producer writes to the same key with RPUSH", fixedKey, keyType)
+	}
+
+	return nil
+}
+
 // SetKey will create (or update) a key value in the store.
 func (r *RedisClusterStorageManager) SetKey(keyName, session string, timeout int64) error {
 	log.Debugf("[STORE] SET Raw key is: %s", keyName)
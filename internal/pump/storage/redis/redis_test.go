@@ -5,9 +5,16 @@
 package redis
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v7"
 
 	genericoptions "github.com/marmotedu/iam/internal/pkg/options"
+	"github.com/marmotedu/iam/internal/pump/options"
 )
 
 func TestRedisAddressConfiguration(t *testing.T) {
@@ -66,3 +73,72 @@ func TestRedisAddressConfiguration(t *testing.T) {
 		}
 	})
 }
+
+func TestSlowLogHook(t *testing.T) {
+	hook := slowLogHook{threshold: 10 * time.Millisecond}
+
+	cmds := []redis.Cmder{redis.NewStringSliceCmd("lrange", "analytics-key", 0, -1), redis.NewIntCmd("del", "analytics-key")}
+	if got := describeCmds(cmds...); got != "lrange analytics-key; del analytics-key" {
+		t.Fatalf("Wrong command description: %s", got)
+	}
+
+	ctx, _ := hook.BeforeProcessPipeline(context.Background(), cmds)
+	if hook.observe(ctx, describeCmds(cmds...)) {
+		t.Fatal("A fast pipeline is not slow")
+	}
+
+	ctx = context.WithValue(context.Background(), commandStartKey{}, time.Now().Add(-time.Second))
+	if !hook.observe(ctx, describeCmds(cmds...)) {
+		t.Fatal("A pipeline over the threshold is slow")
+	}
+
+	if hook.observe(context.Background(), "") {
+		t.Fatal("A command without start time is not slow")
+	}
+}
+
+func TestProcessingDisabled(t *testing.T) {
+	r := &RedisClusterStorageManager{}
+	if err := r.Ack(); err != nil {
+		t.Fatalf("acknowledging without values read should be a no-op, got %v", err)
+	}
+
+	if err := r.Recover("iam-system-analytics"); err != nil {
+		t.Fatalf("recovering without processing id should be a no-op, got %v", err)
+	}
+
+	if r.db != nil {
+		t.Fatal("no connection should be made without processing id")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if tlsConfig, err := TLSConfig(options.RedisSourceOptions{}); tlsConfig != nil || err != nil {
+		t.Fatalf("no TLS configuration should be built without use-ssl, got %v %v", tlsConfig, err)
+	}
+
+	tlsConfig, err := TLSConfig(options.RedisSourceOptions{
+		RedisOptions: genericoptions.RedisOptions{UseSSL: true, SSLInsecureSkipVerify: true},
+	})
+	if err != nil || tlsConfig == nil || !tlsConfig.InsecureSkipVerify || tlsConfig.RootCAs != nil {
+		t.Fatalf("the system CA certificates should be used by default, got %+v %v", tlsConfig, err)
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSConfig(options.RedisSourceOptions{
+		RedisOptions: genericoptions.RedisOptions{UseSSL: true},
+		SSLCAFile:    ca,
+	}); err == nil {
+		t.Fatal("a CA file without certificate should be rejected")
+	}
+
+	if err := (&RedisClusterStorageManager{}).Init(options.RedisSourceOptions{
+		RedisOptions: genericoptions.RedisOptions{UseSSL: true},
+		SSLCAFile:    "/nonexistent/ca.pem",
+	}); err == nil {
+		t.Fatal("a missing CA file should be rejected")
+	}
+}
@@ -13,6 +13,56 @@ type AnalyticsStorage interface {
 	GetAndDeleteSet(string) []interface{}
 }
 
+// ChunkedAnalyticsStorage is implemented by the analytics storages which can drain the analytics
+// data in chunks, so that a large backlog is not loaded in memory at once.
+type ChunkedAnalyticsStorage interface {
+	AnalyticsStorage
+	GetSetLength(string) int64
+	GetAndDeleteChunk(string, int64) []interface{}
+}
+
+// KeyTypeCheckingStorage is implemented by the analytics storages which can verify that an
+// existing key holds the data structure they drain.
+type KeyTypeCheckingStorage interface {
+	AnalyticsStorage
+	CheckKeyType(string) error
+}
+
+// AcknowledgingStorage is implemented by the analytics storages which only forget the data read
+// once acknowledged, Ack is called once the data read has been written to the pumps.
+type AcknowledgingStorage interface {
+	AnalyticsStorage
+	Ack() error
+}
+
+// RequeueingStorage is implemented by the analytics storages which can put the data read back,
+// ahead of the data not read yet, so that it is read again by the next purge.
+type RequeueingStorage interface {
+	AnalyticsStorage
+	Requeue(string, []interface{}) error
+}
+
+// RecoveringStorage is implemented by the analytics storages which can put back the data read
+// and not acknowledged by the instances which stopped, so that it is read again.
+type RecoveringStorage interface {
+	AnalyticsStorage
+	Recover(string) error
+}
+
+// PingingStorage is implemented by the analytics storages which can check that they reach their
+// backend, e.g. for the health check.
+type PingingStorage interface {
+	AnalyticsStorage
+	Ping() error
+}
+
+// ExpiringStorage is implemented by the analytics storages which can expire the analytics data
+// left unread.
+type ExpiringStorage interface {
+	AnalyticsStorage
+	SetExp(string, int64) error
+}
+
 const (
 	// AnalyticsKeyName defines the key name in redis which used to analytics.
 	AnalyticsKeyName string = "iam-system-analytics"
@@ -0,0 +1,50 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"os"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// transform applies the pipeline transformations to a decoded record before it is sent to the pumps.
+func (s *pumpServer) transform(record *analytics.AnalyticsRecord) {
+	if s.omitDetails {
+		record.ClearFields(s.omittedFields)
+	}
+
+	if s.instanceField != "" {
+		record.SetExtra(s.instanceField, s.instanceID)
+	}
+
+	s.lookup.enrich(record)
+
+	for _, enricher := range s.enrichers {
+		enricher.Enrich(record)
+	}
+}
+
+// resolveInstanceID returns the id identifying this iam-pump instance. An explicitly configured id
+// takes precedence over the downward-API pod name, which takes precedence over the hostname.
+func resolveInstanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Failed to get hostname for instance id: %s", err.Error())
+
+		return "unknown"
+	}
+
+	return hostname
+}
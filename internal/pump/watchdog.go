@@ -0,0 +1,108 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"time"
+
+	"github.com/marmotedu/errors"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// watchdogShutdownTimeout bounds the shutdown of a stuck pump, its client may be deadlocked too.
+const watchdogShutdownTimeout = 10 * time.Second
+
+// stalled counts a purge window in which the pump completed no write, because it timed out or
+// was skipped while its previous write is stuck. The pump is restarted in the background once the
+// watchdog threshold of consecutive stalled windows is reached, the purge does not wait for it.
+func (p *pumpInstance) stalled() {
+	if p.watchdog <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stalls++; p.stalls < p.watchdog || p.restarting {
+		return
+	}
+	p.stalls = 0
+	p.restarting = true
+	p.restarts.Add(1)
+
+	log.Warnf("Pump %s completed no write in %d consecutive windows, restarting it", p.name, p.watchdog)
+	go func() {
+		defer p.restarts.Done()
+
+		err := p.restart()
+		p.mu.Lock()
+		p.restarting = false
+		p.mu.Unlock()
+		if err != nil {
+			log.Errorf("Failed to restart pump %s, keeping it: %s", p.name, err.Error())
+
+			return
+		}
+		metrics.PumpRestarts.WithLabelValues(p.name).Inc()
+	}()
+}
+
+// resetStalls resets the count of stalled windows once a write of the pump completed.
+func (p *pumpInstance) resetStalls() {
+	p.mu.Lock()
+	p.stalls = 0
+	p.mu.Unlock()
+}
+
+// current returns the pump of the instance, which the watchdog may replace while a stuck write
+// is running.
+func (p *pumpInstance) current() pumps.Pump {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.Pump
+}
+
+// restart replaces the pump with a new instance initialized from its configuration, then shuts
+// the previous one down. The previous pump is kept when the new instance fails to initialize. The
+// write still stuck in the previous instance is left to return on its own.
+func (p *pumpInstance) restart() error {
+	previous := p.current()
+
+	pmpIns := previous.New()
+	if err := initPump(pmpIns, p.config.Meta, p.initTimeout); err != nil {
+		return errors.Wrapf(err, "failed to init pump %s", p.name)
+	}
+	configurePump(pmpIns, p.name, p.config, p.marshaler, p.countField)
+
+	p.mu.Lock()
+	p.Pump = pmpIns
+	p.generation++
+	p.writing = false
+	if !p.abandoned.IsZero() {
+		p.abandoned = time.Time{}
+		metrics.StuckWrites.WithLabelValues(p.name).Dec()
+	}
+	p.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- previous.Shutdown()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Warnf("Failed to shutdown stuck pump %s: %s", p.name, err.Error())
+		}
+	case <-time.After(watchdogShutdownTimeout):
+		log.Warnf("Shutdown of stuck pump %s timed out after %s", p.name, watchdogShutdownTimeout)
+	}
+	log.Infof("Pump %s restarted", p.name)
+
+	return nil
+}
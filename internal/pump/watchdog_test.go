@@ -0,0 +1,138 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+	"github.com/marmotedu/iam/internal/pump/options"
+	"github.com/marmotedu/iam/internal/pump/pumps"
+)
+
+func TestWatchdogRestartsStuckPump(t *testing.T) {
+	var shutdown bool
+	stuck := &blockingPump{release: make(chan struct{})}
+	stuck.SetTimeout(1)
+	stuck.onShutdown = func() { shutdown = true }
+
+	pmp := &pumpInstance{
+		Pump:     stuck,
+		name:     "blocking",
+		config:   options.PumpConfig{Timeout: 1},
+		watchdog: 2,
+	}
+	s := &pumpServer{secInterval: 1, pmps: []*pumpInstance{pmp}}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	if pmp.Pump != stuck {
+		t.Fatal("the pump should not be restarted before the watchdog threshold")
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{}})
+	// the restart runs in the background of the purge
+	pmp.restarts.Wait()
+	restarted, ok := pmp.current().(*mockPump)
+	if !ok || !shutdown {
+		t.Fatalf("the stuck pump should be shut down and replaced, got %T", pmp.Pump)
+	}
+
+	if restarted.GetTimeout() != 1 {
+		t.Fatal("the restarted pump should be configured as the stuck one")
+	}
+
+	s.writeToPumps(context.Background(), []interface{}{analytics.AnalyticsRecord{Username: "colin"}})
+	if len(restarted.records()) != 1 {
+		t.Fatalf("the restarted pump should be written, got %v", restarted.records())
+	}
+
+	close(stuck.release)
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, ok := pmp.startWrite(); !ok {
+		t.Fatal("the stuck write returning should not affect the restarted pump")
+	}
+}
+
+func TestWatchdogIgnoresWindowDeadline(t *testing.T) {
+	blocking := &blockingPump{release: make(chan struct{})}
+	defer close(blocking.release)
+
+	pmp := &pumpInstance{Pump: blocking, name: "blocking", watchdog: 1}
+	window, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	keys := []interface{}{analytics.AnalyticsRecord{Username: "colin"}}
+	if err := writePump(window, pmp, &keys, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the write should be cut off by the window deadline, got %v", err)
+	}
+	pmp.restarts.Wait()
+	if pmp.current() != blocking || pmp.stalls != 0 {
+		t.Fatal("a write cut off by the window deadline should not count as a stall")
+	}
+}
+
+func TestWatchdogRestartDuringWrite(t *testing.T) {
+	pmp := &pumpInstance{Pump: &mockPump{}, name: "mock", watchdog: 1}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 20; i++ {
+			// a single stalled window reaches the threshold and restarts the pump
+			pmp.stalled()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		keys := []interface{}{analytics.AnalyticsRecord{Username: "colin"}}
+		if err := writePump(context.Background(), pmp, &keys, 1); err != nil {
+			t.Fatalf("the writes should succeed while the pump is restarted, got %v", err)
+		}
+	}
+	<-done
+	pmp.restarts.Wait()
+
+	if _, ok := pmp.current().(*mockPump); !ok {
+		t.Fatalf("the pump should be replaced by a new instance, got %T", pmp.current())
+	}
+}
+
+// failingInitPump is a pump whose new instances fail to initialize.
+type failingInitPump struct {
+	mockPump
+}
+
+func (p *failingInitPump) New() pumps.Pump {
+	return &failingInitPump{}
+}
+
+func (p *failingInitPump) Init(conf interface{}) error {
+	return errors.New("unreachable back-end")
+}
+
+func TestWatchdogKeepsPumpFailingToInit(t *testing.T) {
+	var shutdown bool
+	failing := &failingInitPump{}
+	failing.onShutdown = func() { shutdown = true }
+	pmp := &pumpInstance{Pump: failing, name: "failing", watchdog: 1}
+
+	pmp.stalled()
+	pmp.restarts.Wait()
+	if pmp.current() != failing || shutdown {
+		t.Fatal("the pump should be kept running when its new instance fails to initialize")
+	}
+
+	// the next stalled window tries again
+	pmp.stalled()
+	pmp.restarts.Wait()
+	if pmp.current() != failing {
+		t.Fatal("the pump should still be kept")
+	}
+}
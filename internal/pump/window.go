@@ -0,0 +1,41 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/marmotedu/iam/internal/pump/metrics"
+	"github.com/marmotedu/iam/pkg/log"
+)
+
+// deadLetterWindowDeadline is the reason the records of the writes abandoned at the deadline of
+// their window are dead-lettered with.
+const deadLetterWindowDeadline = "window-deadline"
+
+// windowContext returns the context of the purge window started at start. It expires at the
+// window deadline when one is configured, so that the writes still running are abandoned and the
+// next window starts on schedule instead of overlapping.
+func (s *pumpServer) windowContext(start time.Time) (context.Context, context.CancelFunc) {
+	if s.windowDeadline <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithDeadline(context.Background(), start.Add(s.windowDeadline))
+}
+
+// abandonedWindow reports whether the window of the context was abandoned at its deadline.
+func (s *pumpServer) abandonedWindow(ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+
+	log.Warnf("The purge window was abandoned at its deadline of %s", s.windowDeadline)
+	metrics.AbandonedWindows.Inc()
+
+	return true
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package pump
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/marmotedu/iam/internal/pump/analytics"
+)
+
+// contextPump blocks every write until its context is done.
+type contextPump struct {
+	mockPump
+}
+
+func (p *contextPump) WriteData(ctx context.Context, data []interface{}) error {
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func TestWindowDeadline(t *testing.T) {
+	store := &chunkedStore{}
+	for i := 0; i < 6; i++ {
+		b, _ := msgpack.Marshal(analytics.AnalyticsRecord{Username: "colin"})
+		store.values = append(store.values, string(b))
+	}
+
+	path := filepath.Join(t.TempDir(), "iam-pump.audit")
+	audit, err := newAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &pumpServer{
+		secInterval:    1,
+		windowDeadline: 50 * time.Millisecond,
+		analyticsStore: store,
+		memoryBudget:   2 * defaultRecordSize,
+		recordSize:     defaultRecordSize,
+		audit:          audit,
+		pmps:           []*pumpInstance{{Pump: &contextPump{}, name: "slow"}},
+	}
+
+	before := stats.snapshot()
+	start := time.Now()
+	s.pump()
+	audit.close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the window should end at its deadline, took %s", elapsed)
+	}
+
+	if len(store.reads) != 1 || len(store.values) != 4 {
+		t.Fatalf("the chunks not read at the deadline should be left to the next window, got reads %v", store.reads)
+	}
+
+	if errored := stats.snapshot().Errored - before.Errored; errored != 2 {
+		t.Errorf("the records of the abandoned write should be errored, got %d", errored)
+	}
+
+	windows := readAuditWindows(t, path)
+	if len(windows) != 1 || windows[0].Status != auditAbandoned {
+		t.Errorf("the window should be audited as abandoned, got %+v", windows)
+	}
+
+	// the next window is not abandoned by the expired one
+	s.pmps = []*pumpInstance{{Pump: &mockPump{}, name: "mock"}}
+	ctx, cancel := s.windowContext(time.Now())
+	s.drain(ctx)
+	cancel()
+	if s.abandonedWindow(ctx) || len(store.values) != 0 {
+		t.Errorf("the next window should complete, %d records left", len(store.values))
+	}
+}
+
+func TestWindowDeadlineDisabled(t *testing.T) {
+	s := &pumpServer{}
+	ctx, cancel := s.windowContext(time.Now().Add(-time.Hour))
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("a window has no deadline unless configured")
+	}
+}